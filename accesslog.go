@@ -0,0 +1,242 @@
+package separation
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Access Layer
+type AccessLogFormat int
+
+const (
+	CommonLogFormat AccessLogFormat = iota
+	CombinedLogFormat
+	JSONLogFormat
+)
+
+func ParseAccessLogFormat(s string) (AccessLogFormat, error) {
+	switch s {
+	case "", "common":
+		return CommonLogFormat, nil
+	case "combined":
+		return CombinedLogFormat, nil
+	case "json":
+		return JSONLogFormat, nil
+	}
+	return 0, fmt.Errorf("Unknown access log format %q", s)
+}
+
+type AccessLogEntry struct {
+	RemoteHost string        `json:"remote_host"`
+	Time       time.Time     `json:"time"`
+	Method     string        `json:"method"`
+	URI        string        `json:"uri"`
+	Proto      string        `json:"proto"`
+	Status     int           `json:"status"`
+	Size       int64         `json:"size"`
+	Referer    string        `json:"referer,omitempty"`
+	UserAgent  string        `json:"user_agent,omitempty"`
+	Duration   time.Duration `json:"duration_ns"`
+}
+
+const clfTimeLayout = "02/Jan/2006:15:04:05 -0700"
+
+// Format renders the entry as a single line, including the trailing newline.
+func (f AccessLogFormat) Format(e *AccessLogEntry) []byte {
+	if f == JSONLogFormat {
+		b, err := json.Marshal(e)
+		if err != nil {
+			return nil
+		}
+		return append(b, '\n')
+	}
+
+	size := "-"
+	if e.Size > 0 {
+		size = strconv.FormatInt(e.Size, 10)
+	}
+
+	line := fmt.Sprintf("%s - - [%s] \"%s %s %s\" %d %s",
+		e.RemoteHost, e.Time.Format(clfTimeLayout), e.Method, e.URI, e.Proto, e.Status, size)
+	if f == CombinedLogFormat {
+		line += fmt.Sprintf(" %q %q", dashIfEmpty(e.Referer), dashIfEmpty(e.UserAgent))
+	}
+	return []byte(line + "\n")
+}
+
+func dashIfEmpty(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// AccessLogger writes one line per request to out.
+// It is kept separate from the application log so operators can ship it elsewhere.
+type AccessLogger struct {
+	next   http.Handler
+	format AccessLogFormat
+
+	mu  sync.Mutex
+	out io.Writer
+}
+
+func NewAccessLogger(next http.Handler, out io.Writer, format AccessLogFormat) *AccessLogger {
+	return &AccessLogger{
+		next:   next,
+		format: format,
+		out:    out,
+	}
+}
+
+func (al *AccessLogger) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	rec := NewStatusRecorder(w)
+	al.next.ServeHTTP(rec, r)
+
+	line := al.format.Format(&AccessLogEntry{
+		RemoteHost: clientIPFromRequest(r),
+		Time:       start,
+		Method:     r.Method,
+		URI:        r.RequestURI,
+		Proto:      r.Proto,
+		Status:     rec.Status(),
+		Size:       rec.Size(),
+		Referer:    r.Referer(),
+		UserAgent:  r.UserAgent(),
+		Duration:   time.Since(start),
+	})
+
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	// A failing access log must never fail the request itself.
+	_, _ = al.out.Write(line)
+}
+
+// Action Layer
+// RotatingFile is an io.WriteCloser that starts a new file once the current one
+// grows past MaxSize bytes or has been open longer than MaxAge.
+// A zero MaxSize or MaxAge disables that trigger.
+// Rotated files are renamed with a timestamp suffix.
+type RotatingFile struct {
+	path    string
+	maxSize int64
+	maxAge  time.Duration
+
+	mu     sync.Mutex
+	file   *os.File
+	size   int64
+	opened time.Time
+}
+
+func NewRotatingFile(path string, maxSize int64, maxAge time.Duration) (*RotatingFile, error) {
+	rf := &RotatingFile{
+		path:    path,
+		maxSize: maxSize,
+		maxAge:  maxAge,
+	}
+	err := rf.open()
+	if err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *RotatingFile) open() error {
+	err := os.MkdirAll(filepath.Dir(rf.path), 0755)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(rf.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	rf.file = f
+	rf.size = info.Size()
+	rf.opened = time.Now()
+	return nil
+}
+
+func (rf *RotatingFile) shouldRotate(n int) bool {
+	if rf.maxSize > 0 && rf.size > 0 && rf.size+int64(n) > rf.maxSize {
+		return true
+	}
+	return rf.maxAge > 0 && time.Since(rf.opened) > rf.maxAge
+}
+
+func (rf *RotatingFile) rotate() error {
+	err := rf.file.Close()
+	if err != nil {
+		return err
+	}
+
+	rotated := rf.path + "." + time.Now().UTC().Format("20060102T150405.000000000")
+	err = os.Rename(rf.path, rotated)
+	if err != nil {
+		return err
+	}
+
+	return rf.open()
+}
+
+func (rf *RotatingFile) Write(b []byte) (int, error) {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if rf.file == nil {
+		return 0, errors.New("Rotating file is closed")
+	}
+
+	if rf.shouldRotate(len(b)) {
+		err := rf.rotate()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := rf.file.Write(b)
+	rf.size += int64(n)
+	return n, err
+}
+
+func (rf *RotatingFile) Close() error {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+
+	if rf.file == nil {
+		return nil
+	}
+	err := rf.file.Close()
+	rf.file = nil
+	return err
+}
+
+// OpenAccessLog resolves an ACCESS_LOG destination.
+// dest is "stdout", "stderr", "syslog", or a file path.
+func OpenAccessLog(dest string, maxSize int64, maxAge time.Duration) (io.Writer, error) {
+	switch dest {
+	case "stdout":
+		return os.Stdout, nil
+	case "stderr":
+		return os.Stderr, nil
+	case "syslog":
+		return openSyslog("separation")
+	}
+	return NewRotatingFile(dest, maxSize, maxAge)
+}
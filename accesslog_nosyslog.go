@@ -0,0 +1,13 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package separation
+
+import (
+	"errors"
+	"io"
+)
+
+func openSyslog(tag string) (io.Writer, error) {
+	return nil, errors.New("Syslog is not supported on this platform")
+}
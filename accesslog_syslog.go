@@ -0,0 +1,13 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package separation
+
+import (
+	"io"
+	"log/syslog"
+)
+
+func openSyslog(tag string) (io.Writer, error) {
+	return syslog.New(syslog.LOG_INFO|syslog.LOG_LOCAL0, tag)
+}
@@ -0,0 +1,267 @@
+package separation
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/oralordos/separation/internal/clock"
+	"github.com/oralordos/separation/internal/principal"
+)
+
+// Business Logic
+// RecordActivityParams records when users were last seen, batched by an ActivityTracker.
+type RecordActivityParams struct {
+	Seen map[Email]time.Time
+}
+
+func (rp *RecordActivityParams) CommandName() string {
+	return "RecordActivity"
+}
+
+// InactiveUsersQuery finds the users not seen for at least InactiveFor.
+// Users never seen count from when they registered.
+type InactiveUsersQuery struct {
+	// InactiveFor defaults to the configured threshold when it is zero
+	InactiveFor time.Duration
+}
+
+func (iq *InactiveUsersQuery) QueryName() string {
+	return "InactiveUsers"
+}
+
+func (iq *InactiveUsersQuery) Validate() error {
+	if iq.InactiveFor < 0 {
+		return NewValidationError("The inactivity threshold cannot be negative")
+	}
+	return nil
+}
+
+type ActivityHandler struct {
+	userStorage UserStorer
+	updates     *UserUpdater
+	clock       clock.Clock
+	inactiveFor time.Duration
+}
+
+// NewActivityHandler counts users as inactive once they have not been seen for inactiveFor,
+// unless a query asks for another threshold.
+func NewActivityHandler(us UserStorer, updates *UserUpdater, clk clock.Clock, inactiveFor time.Duration) *ActivityHandler {
+	return &ActivityHandler{
+		userStorage: us,
+		updates:     updates,
+		clock:       clk,
+		inactiveFor: inactiveFor,
+	}
+}
+
+// Record saves each user's last seen time, unless a later one is already saved.
+// Users deleted since they were seen are skipped. Being seen is not an edit, so UpdatedAt is left alone.
+func (ah *ActivityHandler) Record(ctx context.Context, cmd Command) error {
+	params, ok := cmd.(*RecordActivityParams)
+	if !ok {
+		return fmt.Errorf("ActivityHandler cannot record %T", cmd)
+	}
+
+	err := requireAdmin(ctx)
+	if err != nil {
+		return err
+	}
+
+	for email, at := range params.Seen {
+		at := at.UTC()
+		err = ah.updates.Update(ctx, email, func(u *User) (bool, error) {
+			if u.LastSeenAt != nil && !u.LastSeenAt.Before(at) {
+				return false, nil
+			}
+			u.LastSeenAt = &at
+			return true, nil
+		})
+		if err != nil && err != ErrUserNotFound {
+			return err
+		}
+	}
+	return nil
+}
+
+// lastActive is when u was last seen, or when they registered if they never were.
+func lastActive(u *User) time.Time {
+	if u.LastSeenAt != nil {
+		return *u.LastSeenAt
+	}
+	return u.CreatedAt
+}
+
+// Inactive lists the inactive users, longest inactive first.
+func (ah *ActivityHandler) Inactive(ctx context.Context, q Query) (interface{}, error) {
+	query, ok := q.(*InactiveUsersQuery)
+	if !ok {
+		return nil, fmt.Errorf("ActivityHandler cannot list %T", q)
+	}
+
+	err := requireAdmin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	err = query.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	users, err := ah.userStorage.List(ctx, LabelSelector{})
+	if err != nil {
+		return nil, err
+	}
+
+	inactiveFor := query.InactiveFor
+	if inactiveFor == 0 {
+		inactiveFor = ah.inactiveFor
+	}
+	cutoff := ah.clock.Now().Add(-inactiveFor)
+	inactive := []*User{}
+	for _, u := range users {
+		if lastActive(u).Before(cutoff) {
+			inactive = append(inactive, u)
+		}
+	}
+	sort.Slice(inactive, func(i, j int) bool {
+		return lastActive(inactive[i]).Before(lastActive(inactive[j]))
+	})
+	return inactive, nil
+}
+
+// ActivityTracker collects when users are seen and records them in batches,
+// so busy users cost one write per interval rather than one per request.
+type ActivityTracker struct {
+	users UserService
+	clock clock.Clock
+
+	mu      sync.Mutex
+	pending map[Email]time.Time
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewActivityTracker records what it has collected every interval until it is closed.
+func NewActivityTracker(users UserService, clk clock.Clock, interval time.Duration) *ActivityTracker {
+	at := &ActivityTracker{
+		users:   users,
+		clock:   clk,
+		pending: map[Email]time.Time{},
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go at.run(interval)
+	return at
+}
+
+// Seen notes that the user made a request now.
+func (at *ActivityTracker) Seen(email Email) {
+	now := at.clock.Now()
+	at.mu.Lock()
+	defer at.mu.Unlock()
+	at.pending[email] = now
+}
+
+func (at *ActivityTracker) run(interval time.Duration) {
+	defer close(at.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			_ = at.Flush(context.Background())
+		case <-at.stop:
+			return
+		}
+	}
+}
+
+// Flush records everything collected so far. What could not be recorded is dropped,
+// as the user's next request will be seen again.
+func (at *ActivityTracker) Flush(ctx context.Context) error {
+	at.mu.Lock()
+	seen := at.pending
+	at.pending = map[Email]time.Time{}
+	at.mu.Unlock()
+
+	if len(seen) == 0 {
+		return nil
+	}
+	ctx = principal.NewContext(ctx, &principal.Principal{
+		Subject: "activity",
+		Scheme:  "system",
+		Admin:   true,
+	})
+	return at.users.RecordActivity(ctx, &RecordActivityParams{Seen: seen})
+}
+
+// Close stops the tracker and records what it has left.
+func (at *ActivityTracker) Close() error {
+	close(at.stop)
+	<-at.done
+	return at.Flush(context.Background())
+}
+
+// Access Layer
+// ActivityMiddleware tells the tracker about every request made by a user.
+// It must run inside the auth middleware to see who the user is.
+type ActivityMiddleware struct {
+	next    http.Handler
+	tracker *ActivityTracker
+}
+
+func NewActivityMiddleware(next http.Handler, tracker *ActivityTracker) *ActivityMiddleware {
+	return &ActivityMiddleware{
+		next:    next,
+		tracker: tracker,
+	}
+}
+
+func (am *ActivityMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if p, ok := principal.FromContext(r.Context()); ok && p.Email != "" {
+		email, err := ParseEmail(p.Email)
+		if err == nil {
+			am.tracker.Seen(email)
+		}
+	}
+	am.next.ServeHTTP(w, r)
+}
+
+// InactiveUsers serves GET /users/inactive, listing users not seen for the configured threshold.
+// ?for=2160h overrides the threshold.
+func (a *AdminHTTP) InactiveUsers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, NewMethodError("InactiveUsers requires a get request"))
+		return
+	}
+
+	query := &InactiveUsersQuery{}
+	if s := r.FormValue("for"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			writeError(w, r, NewValidationError(fmt.Sprintf("Invalid duration %q, use one such as 720h", s)))
+			return
+		}
+		query.InactiveFor = d
+	}
+
+	users, err := a.users.InactiveUsers(r.Context(), query)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(users)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+}
@@ -0,0 +1,61 @@
+package separation
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/oralordos/separation/internal/clock"
+	"github.com/oralordos/separation/internal/principal"
+	"golang.org/x/text/language"
+)
+
+// TestActivityKeepsConcurrentUpdates records activity while labels are being set on the
+// same user, and checks the activity flush never writes back a stale copy of the user.
+func TestActivityKeepsConcurrentUpdates(t *testing.T) {
+	const rounds = 50
+	ctx := principal.NewContext(context.Background(), &principal.Principal{Subject: "admin", Admin: true})
+	email, _ := ParseEmail("a@example.com")
+	us := &yieldingUserStorer{UserStorer: NewMemoryUserStorage(), rng: rand.New(rand.NewSource(1))}
+	err := us.Save(ctx, &User{Email: email})
+	if err != nil {
+		t.Fatal(err)
+	}
+	updater := NewUserUpdater(us)
+	lh := NewLabelHandler(us, updater, clock.Real, language.English)
+	ah := NewActivityHandler(us, updater, clock.Real, time.Hour)
+
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < rounds; i++ {
+		seen := start.Add(time.Duration(i) * time.Minute)
+
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			err := lh.Set(ctx, &SetLabelsParams{Email: email, Labels: Labels{fmt.Sprintf("key%d", i): "set"}})
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			err := ah.Record(ctx, &RecordActivityParams{Seen: map[Email]time.Time{email: seen}})
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+		wg.Wait()
+
+		u, err := us.Get(ctx, email)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if u.LastSeenAt == nil || !u.LastSeenAt.Equal(seen) || len(u.Labels) != i+1 {
+			t.Fatalf("Round %d left the user last seen %v with %d labels, want %s and %d", i, u.LastSeenAt, len(u.Labels), seen, i+1)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package separation
+
+import (
+	"crypto/subtle"
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+	"strings"
+
+	"github.com/oralordos/separation/internal/principal"
+)
+
+// Access Layer
+// AdminHTTP is the access layer for operators.
+// Every request must carry the admin token as a bearer token.
+type AdminHTTP struct {
+	router *http.ServeMux
+	token  []byte
+	users  UserService
+	maint  MaintenanceService
+	// ipFilter is nil when the IP rules cannot be managed
+	ipFilter  IPFilterService
+	slow      SlowCallLister
+	changes   ChangeLog
+	stats     *UserStats
+	templates *MessageTemplates
+
+	maxAvatarSize int64
+}
+
+// NewAdminHTTP only mounts /ip-rules, /slow-queries, /changes, /stats and /templates when
+// ipFilter, slow, changes, stats and templates are not nil, and only caches GET /users
+// when responses is not nil.
+func NewAdminHTTP(token string, debug bool, users UserService, maint MaintenanceService, ipFilter IPFilterService, slow SlowCallLister, changes ChangeLog, stats *UserStats, templates *MessageTemplates, responses *ResponseCache, maxAvatarSize int64) *AdminHTTP {
+	r := http.NewServeMux()
+	a := &AdminHTTP{
+		router:        r,
+		token:         []byte(token),
+		users:         users,
+		maint:         maint,
+		ipFilter:      ipFilter,
+		slow:          slow,
+		changes:       changes,
+		stats:         stats,
+		templates:     templates,
+		maxAvatarSize: maxAvatarSize,
+	}
+	if responses != nil {
+		r.Handle("/users", responses.Wrap(http.HandlerFunc(a.ListUsers)))
+	} else {
+		r.HandleFunc("/users", a.ListUsers)
+	}
+	r.HandleFunc("/users/labels", a.Labels)
+	r.HandleFunc("/users/username", a.SetUsername)
+	r.HandleFunc("/users/avatar", a.SetAvatar)
+	r.HandleFunc("/users/terms-pending", a.PendingTerms)
+	r.HandleFunc("/users/inactive", a.InactiveUsers)
+	r.HandleFunc("/invites", a.Invites)
+	r.HandleFunc("/invites/resend", a.ResendInvite)
+	r.HandleFunc("/invites/revoke", a.RevokeInvite)
+	r.HandleFunc("/reviews", a.Reviews)
+	r.HandleFunc("/reviews/approve", a.ApproveReview)
+	r.HandleFunc("/reviews/reject", a.RejectReview)
+	r.HandleFunc("/policy/registration", a.RegistrationPolicy)
+	r.HandleFunc("/users/bulk-delete/preview", a.PreviewBulkDelete)
+	r.HandleFunc("/users/bulk-delete", a.BulkDelete)
+	r.HandleFunc("/backup", a.Backup)
+	r.HandleFunc("/restore", a.Restore)
+	r.HandleFunc("/maintenance", a.Maintenance)
+	if ipFilter != nil {
+		r.HandleFunc("/ip-rules", a.IPRules)
+	}
+	if slow != nil {
+		r.HandleFunc("/slow-queries", a.SlowQueries)
+	}
+	if changes != nil {
+		r.HandleFunc("/changes", a.Changes)
+	}
+	if stats != nil {
+		r.HandleFunc("/stats", a.Stats)
+	}
+	if templates != nil {
+		r.HandleFunc("/templates", a.Templates)
+		r.HandleFunc("/templates/preview", a.PreviewTemplate)
+	}
+	if debug {
+		mountDebug(r)
+	}
+	return a
+}
+
+func (a *AdminHTTP) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !a.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+		writeError(w, r, ErrUnauthenticated)
+		return
+	}
+	r = r.WithContext(principal.NewContext(r.Context(), &principal.Principal{
+		Subject: "admin",
+		Scheme:  "admin-token",
+		Admin:   true,
+	}))
+	a.router.ServeHTTP(w, r)
+}
+
+func (a *AdminHTTP) authorized(r *http.Request) bool {
+	if len(a.token) == 0 {
+		return false
+	}
+
+	auth := r.Header.Get("Authorization")
+	const prefix = "Bearer "
+	if !strings.HasPrefix(auth, prefix) {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(auth[len(prefix):]), a.token) == 1
+}
+
+// mountDebug registers the runtime profiling endpoints.
+// They are mounted explicitly so nothing leaks onto http.DefaultServeMux.
+func mountDebug(r *http.ServeMux) {
+	r.HandleFunc("/debug/pprof/", pprof.Index)
+	r.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	r.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	r.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	r.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	r.Handle("/debug/vars", expvar.Handler())
+}
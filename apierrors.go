@@ -0,0 +1,233 @@
+package separation
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/oralordos/separation/internal/ctxkeys"
+)
+
+// Access Layer
+var (
+	ErrMalformedRequest = registerError(errors.New("Unable to read your request"), "malformed_request", http.StatusBadRequest, "The request body could not be decoded")
+	ErrRequestTooLarge  = registerError(errors.New("Your request is too large"), "request_too_large", http.StatusRequestEntityTooLarge, "The request body is larger than the endpoint accepts")
+)
+
+// MethodError is returned when an endpoint is called with the wrong HTTP method.
+type MethodError struct {
+	msg string
+}
+
+func NewMethodError(msg string) *MethodError {
+	return &MethodError{msg: msg}
+}
+
+func (me *MethodError) Error() string {
+	return me.msg
+}
+
+// ErrorInfo describes one machine-readable error code the API can return.
+type ErrorInfo struct {
+	Code        string `json:"code"`
+	Status      int    `json:"status"`
+	Description string `json:"description"`
+}
+
+type errorMapping struct {
+	ErrorInfo
+	matches func(error) bool
+}
+
+func is(target error) func(error) bool {
+	return func(err error) bool {
+		return errors.Is(err, target)
+	}
+}
+
+func isType[T error](err error) bool {
+	var t T
+	return errors.As(err, &t)
+}
+
+// errorCatalogue is the single place errors are mapped to codes and statuses.
+// Errors join it where they are declared, through registerError and registerErrorType,
+// so an error cannot be added without a code. writeError and GET /errors both read it,
+// so the documented codes cannot drift from the ones returned.
+var errorCatalogue struct {
+	errors []errorMapping
+	types  []errorMapping
+	codes  map[string]bool
+}
+
+func registerMapping(mappings *[]errorMapping, info ErrorInfo, matches func(error) bool) {
+	if errorCatalogue.codes[info.Code] {
+		panic(fmt.Sprintf("Error code %q is registered twice", info.Code))
+	}
+	if errorCatalogue.codes == nil {
+		errorCatalogue.codes = map[string]bool{}
+	}
+	errorCatalogue.codes[info.Code] = true
+	*mappings = append(*mappings, errorMapping{info, matches})
+}
+
+// registerError gives err a code in the catalogue and returns it, for use where err is declared.
+func registerError(err error, code string, status int, description string) error {
+	registerMapping(&errorCatalogue.errors, ErrorInfo{code, status, description}, is(err))
+	return err
+}
+
+// registerErrorType gives every error of type T a code in the catalogue.
+// Registered error values are matched first, so a value of a registered type,
+// such as ErrEmailEmpty, keeps a code of its own.
+func registerErrorType[T error](code string, status int, description string) {
+	registerMapping(&errorCatalogue.types, ErrorInfo{code, status, description}, isType[T])
+}
+
+func init() {
+	registerErrorType[*MethodError]("method_not_allowed", http.StatusMethodNotAllowed, "The endpoint does not support the request method")
+}
+
+var internalError = ErrorInfo{"internal_error", http.StatusInternalServerError, "Something unexpected went wrong on the server"}
+
+func lookupError(err error) ErrorInfo {
+	for _, mappings := range [][]errorMapping{errorCatalogue.errors, errorCatalogue.types} {
+		for _, m := range mappings {
+			if m.matches(err) {
+				return m.ErrorInfo
+			}
+		}
+	}
+	return internalError
+}
+
+// ErrorCodes lists every code the API can return, sorted by code.
+func ErrorCodes() []ErrorInfo {
+	codes := make([]ErrorInfo, 0, len(errorCatalogue.errors)+len(errorCatalogue.types)+1)
+	for _, mappings := range [][]errorMapping{errorCatalogue.errors, errorCatalogue.types} {
+		for _, m := range mappings {
+			codes = append(codes, m.ErrorInfo)
+		}
+	}
+	codes = append(codes, internalError)
+	sort.Slice(codes, func(i, j int) bool { return codes[i].Code < codes[j].Code })
+	return codes
+}
+
+// ErrorWriter serializes an error response body in one format.
+type ErrorWriter interface {
+	WriteError(w http.ResponseWriter, r *http.Request, err error, info ErrorInfo)
+}
+
+// TextErrors writes the error message as plain text.
+type TextErrors struct{}
+
+func (TextErrors) WriteError(w http.ResponseWriter, r *http.Request, err error, info ErrorInfo) {
+	http.Error(w, err.Error(), info.Status)
+}
+
+const problemContentType = "application/problem+json"
+
+// Problem is an RFC 7807 problem details body, extended with the error code.
+type Problem struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Detail   string `json:"detail"`
+	Instance string `json:"instance"`
+	Code     string `json:"code"`
+}
+
+// ProblemErrors writes RFC 7807 problem details. The type points at the code's entry in GET /errors.
+type ProblemErrors struct{}
+
+func (ProblemErrors) WriteError(w http.ResponseWriter, r *http.Request, err error, info ErrorInfo) {
+	w.Header().Set("Content-Type", problemContentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(info.Status)
+	_ = json.NewEncoder(w).Encode(&Problem{
+		Type:     "/errors#" + info.Code,
+		Title:    info.Description,
+		Status:   info.Status,
+		Detail:   err.Error(),
+		Instance: r.URL.Path,
+		Code:     info.Code,
+	})
+}
+
+var errorWriters = map[string]ErrorWriter{
+	"text":    TextErrors{},
+	"problem": ProblemErrors{},
+}
+
+// ParseErrorFormat returns the ErrorWriter for a format name, text or problem.
+func ParseErrorFormat(name string) (ErrorWriter, error) {
+	if name == "" {
+		return TextErrors{}, nil
+	}
+
+	ew, ok := errorWriters[name]
+	if !ok {
+		return nil, fmt.Errorf("Unknown error format %q, use text or problem", name)
+	}
+	return ew, nil
+}
+
+var errorWriterKey = ctxkeys.New[ErrorWriter]("error writer")
+
+// WithErrorWriter makes ew the error format for every request to next
+// that does not ask for problem details in its Accept header.
+func WithErrorWriter(next http.Handler, ew ErrorWriter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(errorWriterKey.With(r.Context(), ew)))
+	})
+}
+
+func errorWriterFor(r *http.Request) ErrorWriter {
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mt, _, err := mime.ParseMediaType(strings.TrimSpace(accept))
+		if err == nil && mt == problemContentType {
+			return ProblemErrors{}
+		}
+	}
+
+	if ew, ok := errorWriterKey.From(r.Context()); ok {
+		return ew
+	}
+	return TextErrors{}
+}
+
+// writeError is the central error mapper for every access layer handler.
+// The code is sent in the X-Error-Code header, and the body is written in the format
+// the client asked for or the transport was configured with.
+// Any OnError hook in the request's context is told about the error first.
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	info := lookupError(err)
+	if h := hooksFromContext(r.Context()); h != nil && h.OnError != nil {
+		h.OnError(r, err, info)
+	}
+	w.Header().Set("X-Error-Code", info.Code)
+	errorWriterFor(r).WriteError(w, r, err, info)
+}
+
+// decodeError keeps validation errors raised while decoding, such as a bad email,
+// and bodies over the route's limit, and reports anything else as a malformed request.
+func decodeError(err error) error {
+	if isValidationError(err) || err == ErrRequestTooLarge {
+		return err
+	}
+	return ErrMalformedRequest
+}
+
+func (j *JsonOverHTTP) Errors(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(ErrorCodes())
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+}
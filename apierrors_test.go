@@ -0,0 +1,65 @@
+package separation
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// unregisteredErrors are the exported errors that never reach a response.
+// They are translated before then, take the code of their type, or only mean
+// a bug in the wiring, which is reported as internal_error.
+var unregisteredErrors = map[string]bool{
+	"ErrNoHandler":           true,
+	"ErrNotFound":            true,
+	"ErrReferralCodeInvalid": true,
+	"ErrUnknownCommand":      true,
+}
+
+// TestErrorsAreRegistered checks that every exported error is declared through
+// registerError, so none can be added without a code in GET /errors.
+func TestErrorsAreRegistered(t *testing.T) {
+	files, err := filepath.Glob("*.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fset := token.NewFileSet()
+	for _, name := range files {
+		if strings.HasSuffix(name, "_test.go") {
+			continue
+		}
+		f, err := parser.ParseFile(fset, name, nil, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, decl := range f.Decls {
+			gen, ok := decl.(*ast.GenDecl)
+			if !ok || gen.Tok != token.VAR {
+				continue
+			}
+			for _, spec := range gen.Specs {
+				vs := spec.(*ast.ValueSpec)
+				for i, id := range vs.Names {
+					if !strings.HasPrefix(id.Name, "Err") || !id.IsExported() || unregisteredErrors[id.Name] {
+						continue
+					}
+					if !isCallTo(vs.Values[i], "registerError") {
+						t.Errorf("%s at %s is not declared through registerError", id.Name, fset.Position(id.Pos()))
+					}
+				}
+			}
+		}
+	}
+}
+
+func isCallTo(expr ast.Expr, name string) bool {
+	call, ok := expr.(*ast.CallExpr)
+	if !ok {
+		return false
+	}
+	fn, ok := call.Fun.(*ast.Ident)
+	return ok && fn.Name == name
+}
@@ -0,0 +1,90 @@
+package separation
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/oralordos/separation/internal/principal"
+)
+
+var (
+	ErrUnauthenticated = registerError(errors.New("Authentication required"), "unauthenticated", http.StatusUnauthorized, "The endpoint requires credentials that were missing or invalid")
+	ErrForbidden       = registerError(errors.New("You are not allowed to do that"), "forbidden", http.StatusForbidden, "The caller is not allowed to perform the operation")
+)
+
+// Business Logic
+// requireAdmin may return an ErrForbidden error
+func requireAdmin(ctx context.Context) error {
+	p, ok := principal.FromContext(ctx)
+	if !ok || !p.Admin {
+		return ErrForbidden
+	}
+	return nil
+}
+
+// requireSelfOrAdmin lets users act on their own account, and admins on anyone's.
+// It may return an ErrUnauthenticated or ErrForbidden error
+func requireSelfOrAdmin(ctx context.Context, email Email) error {
+	p, ok := principal.FromContext(ctx)
+	if !ok {
+		return ErrUnauthenticated
+	}
+	if !p.Admin && p.Email != email.String() {
+		return ErrForbidden
+	}
+	return nil
+}
+
+// Access Layer
+// Authenticator checks the credentials on a request.
+// It returns a nil principal and no error when the request carries none of its credentials,
+// and an error when it carries credentials that are not valid.
+type Authenticator interface {
+	Authenticate(r *http.Request) (*principal.Principal, error)
+}
+
+// ResponseAuthenticator is an Authenticator that may also answer the client while checking
+// its credentials, such as to expire a cookie it no longer accepts. AuthMiddleware calls
+// AuthenticateResponse in place of Authenticate.
+type ResponseAuthenticator interface {
+	Authenticator
+	AuthenticateResponse(w http.ResponseWriter, r *http.Request) (*principal.Principal, error)
+}
+
+// AuthMiddleware places the principal from the first authenticator that
+// recognizes the request into its context. Requests without credentials pass
+// through anonymously, so each handler decides whether it requires a principal.
+type AuthMiddleware struct {
+	next  http.Handler
+	auths []Authenticator
+}
+
+func NewAuthMiddleware(next http.Handler, auths ...Authenticator) *AuthMiddleware {
+	return &AuthMiddleware{
+		next:  next,
+		auths: auths,
+	}
+}
+
+func (am *AuthMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	for _, a := range am.auths {
+		var p *principal.Principal
+		var err error
+		if ra, ok := a.(ResponseAuthenticator); ok {
+			p, err = ra.AuthenticateResponse(w, r)
+		} else {
+			p, err = a.Authenticate(r)
+		}
+		if err != nil {
+			writeError(w, r, fmt.Errorf("%w: %v", ErrUnauthenticated, err))
+			return
+		}
+		if p != nil {
+			r = r.WithContext(principal.NewContext(r.Context(), p))
+			break
+		}
+	}
+	am.next.ServeHTTP(w, r)
+}
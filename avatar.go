@@ -0,0 +1,343 @@
+package separation
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	_ "image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/oralordos/separation/internal/clock"
+	"github.com/oralordos/separation/internal/principal"
+)
+
+// Business Logic
+// AvatarSizes are the square sizes, in pixels, every avatar is stored at. The last is the default.
+var AvatarSizes = []int{64, 256}
+
+const maxAvatarDimension = 4096
+
+var avatarContentTypes = map[string]bool{
+	"image/png":  true,
+	"image/jpeg": true,
+	"image/gif":  true,
+}
+
+type SetAvatarParams struct {
+	Email Email
+	Image []byte
+}
+
+func (sp *SetAvatarParams) CommandName() string {
+	return "SetAvatar"
+}
+
+func (sp *SetAvatarParams) Validate() error {
+	if sp.Email.IsZero() {
+		return ErrEmailEmpty
+	}
+	if len(sp.Image) == 0 {
+		return NewValidationError("An avatar image is required")
+	}
+	return nil
+}
+
+type GetAvatarQuery struct {
+	ID   string
+	Size int
+}
+
+func (gq *GetAvatarQuery) QueryName() string {
+	return "GetAvatar"
+}
+
+// Avatar is one stored size of an avatar image.
+type Avatar struct {
+	ContentType string
+	Data        []byte
+}
+
+type AvatarHandler struct {
+	userStorage UserStorer
+	updates     *UserUpdater
+	blobs       BlobStore
+	clock       clock.Clock
+	maxSize     int64
+}
+
+// NewAvatarHandler refuses uploads larger than maxSize bytes.
+func NewAvatarHandler(us UserStorer, updates *UserUpdater, blobs BlobStore, clk clock.Clock, maxSize int64) *AvatarHandler {
+	return &AvatarHandler{
+		userStorage: us,
+		updates:     updates,
+		blobs:       blobs,
+		clock:       clk,
+		maxSize:     maxSize,
+	}
+}
+
+func avatarKey(id string, size int) string {
+	return fmt.Sprintf("avatars/%s-%d.png", id, size)
+}
+
+// Set stores the image at every size in AvatarSizes and points the user at it.
+// The ID is a hash of the upload, so a stored avatar never changes and can be cached forever.
+func (ah *AvatarHandler) Set(ctx context.Context, cmd Command) error {
+	params, ok := cmd.(*SetAvatarParams)
+	if !ok {
+		return fmt.Errorf("AvatarHandler cannot set %T", cmd)
+	}
+
+	p, ok := principal.FromContext(ctx)
+	if !ok {
+		return ErrUnauthenticated
+	}
+	if !p.Admin && p.Email != params.Email.String() {
+		return ErrForbidden
+	}
+
+	if int64(len(params.Image)) > ah.maxSize {
+		return NewValidationError(fmt.Sprintf("Avatar images cannot be larger than %d bytes", ah.maxSize))
+	}
+	contentType := http.DetectContentType(params.Image)
+	if !avatarContentTypes[contentType] {
+		return NewValidationError("Avatar images must be PNG, JPEG or GIF")
+	}
+
+	// Check the dimensions before decoding, so a small file cannot claim a huge image
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(params.Image))
+	if err != nil {
+		return NewValidationError("Avatar image could not be read")
+	}
+	if cfg.Width > maxAvatarDimension || cfg.Height > maxAvatarDimension {
+		return NewValidationError(fmt.Sprintf("Avatar images cannot be larger than %dx%d pixels", maxAvatarDimension, maxAvatarDimension))
+	}
+	img, _, err := image.Decode(bytes.NewReader(params.Image))
+	if err != nil {
+		return NewValidationError("Avatar image could not be read")
+	}
+
+	// Check the user exists before storing images nobody would use
+	_, err = ah.userStorage.Get(ctx, params.Email)
+	if err != nil {
+		return err
+	}
+
+	sum := sha256.Sum256(params.Image)
+	id := hex.EncodeToString(sum[:16])
+	for _, size := range AvatarSizes {
+		var buf bytes.Buffer
+		err = png.Encode(&buf, resizeSquare(img, size))
+		if err != nil {
+			return err
+		}
+		err = ah.blobs.Put(ctx, avatarKey(id, size), "image/png", buf.Bytes())
+		if err != nil {
+			return err
+		}
+	}
+
+	var old string
+	err = ah.updates.Update(ctx, params.Email, func(u *User) (bool, error) {
+		old = u.AvatarID
+		u.AvatarID = id
+		u.UpdatedAt = ah.clock.Now().UTC()
+		return true, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if old != "" && old != id {
+		for _, size := range AvatarSizes {
+			// A leftover blob only wastes space, so do not fail the upload over it
+			_ = ah.blobs.Delete(ctx, avatarKey(old, size))
+		}
+	}
+	return nil
+}
+
+func (ah *AvatarHandler) Get(ctx context.Context, q Query) (interface{}, error) {
+	query, ok := q.(*GetAvatarQuery)
+	if !ok {
+		return nil, fmt.Errorf("AvatarHandler cannot get %T", q)
+	}
+
+	_, err := hex.DecodeString(query.ID)
+	if err != nil || len(query.ID) != 32 {
+		return nil, ErrBlobNotFound
+	}
+
+	size := query.Size
+	if size == 0 {
+		size = AvatarSizes[len(AvatarSizes)-1]
+	}
+	valid := false
+	for _, s := range AvatarSizes {
+		valid = valid || s == size
+	}
+	if !valid {
+		return nil, NewValidationError(fmt.Sprintf("Avatar size must be one of %v", AvatarSizes))
+	}
+
+	data, contentType, err := ah.blobs.Get(ctx, avatarKey(query.ID, size))
+	if err != nil {
+		return nil, err
+	}
+	return &Avatar{ContentType: contentType, Data: data}, nil
+}
+
+// resizeSquare crops the middle square out of img and scales it to size by size,
+// averaging the source pixels that fall under each destination pixel.
+func resizeSquare(img image.Image, size int) *image.NRGBA {
+	b := img.Bounds()
+	side := b.Dx()
+	if b.Dy() < side {
+		side = b.Dy()
+	}
+	x0 := b.Min.X + (b.Dx()-side)/2
+	y0 := b.Min.Y + (b.Dy()-side)/2
+
+	dst := image.NewNRGBA(image.Rect(0, 0, size, size))
+	for dy := 0; dy < size; dy++ {
+		sy0 := y0 + dy*side/size
+		sy1 := y0 + (dy+1)*side/size
+		if sy1 <= sy0 {
+			sy1 = sy0 + 1
+		}
+		for dx := 0; dx < size; dx++ {
+			sx0 := x0 + dx*side/size
+			sx1 := x0 + (dx+1)*side/size
+			if sx1 <= sx0 {
+				sx1 = sx0 + 1
+			}
+
+			var r, g, bl, a, n uint64
+			for sy := sy0; sy < sy1; sy++ {
+				for sx := sx0; sx < sx1; sx++ {
+					c := color.NRGBA64Model.Convert(img.At(sx, sy)).(color.NRGBA64)
+					r += uint64(c.R)
+					g += uint64(c.G)
+					bl += uint64(c.B)
+					a += uint64(c.A)
+					n++
+				}
+			}
+			dst.Set(dx, dy, color.NRGBA64{
+				R: uint16(r / n),
+				G: uint16(g / n),
+				B: uint16(bl / n),
+				A: uint16(a / n),
+			})
+		}
+	}
+	return dst
+}
+
+// Access Layer
+// SetMyAvatar serves POST /me/avatar with a multipart form holding the image in an avatar field.
+func (j *JsonOverHTTP) SetMyAvatar(w http.ResponseWriter, r *http.Request) {
+	p, ok := principal.FromContext(r.Context())
+	if !ok || p.Email == "" {
+		writeError(w, r, ErrUnauthenticated)
+		return
+	}
+	email, err := ParseEmail(p.Email)
+	if err != nil {
+		writeError(w, r, ErrUnauthenticated)
+		return
+	}
+
+	uploadAvatar(w, r, j.usrServ, email, j.maxAvatarSize)
+}
+
+// uploadAvatar reads the image from the avatar field of a multipart form and sets it as email's avatar.
+func uploadAvatar(w http.ResponseWriter, r *http.Request, users UserService, email Email, maxSize int64) {
+	// Leave room for the multipart framing around the image
+	r.Body = http.MaxBytesReader(w, r.Body, maxSize+64*1024)
+	f, _, err := r.FormFile("avatar")
+	if err != nil {
+		writeError(w, r, NewValidationError("An avatar image is required in the avatar form field, no larger than "+strconv.FormatInt(maxSize, 10)+" bytes"))
+		return
+	}
+	defer f.Close()
+
+	data, err := io.ReadAll(f)
+	if err != nil {
+		writeError(w, r, ErrMalformedRequest)
+		return
+	}
+
+	err = users.SetAvatar(r.Context(), &SetAvatarParams{Email: email, Image: data})
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	u, err := users.GetByEmail(r.Context(), email)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.Header().Set("Location", "/avatars/"+u.AvatarID)
+	w.WriteHeader(http.StatusCreated)
+}
+
+// SetAvatar serves POST /users/avatar?email=..., replacing any user's avatar, such as one breaking the rules.
+func (a *AdminHTTP) SetAvatar(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, NewMethodError("SetAvatar requires a post request"))
+		return
+	}
+
+	email, err := ParseEmail(r.URL.Query().Get("email"))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	uploadAvatar(w, r, a.users, email, a.maxAvatarSize)
+}
+
+// Avatar serves GET /avatars/{id}, optionally with ?size=64.
+func (j *JsonOverHTTP) Avatar(w http.ResponseWriter, r *http.Request) {
+	query := &GetAvatarQuery{ID: strings.TrimPrefix(r.URL.Path, "/avatars/")}
+	if s := r.URL.Query().Get("size"); s != "" {
+		size, err := strconv.Atoi(s)
+		if err != nil {
+			writeError(w, r, NewValidationError("Avatar size must be a number"))
+			return
+		}
+		query.Size = size
+	}
+
+	etag := `"` + query.ID + "-" + strconv.Itoa(query.Size) + `"`
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	avatar, err := j.usrServ.Avatar(r.Context(), query)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	// Avatar IDs are content hashes, so a response never goes stale
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Content-Type", avatar.ContentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(avatar.Data)))
+	if r.Method == http.MethodGet {
+		_, _ = w.Write(avatar.Data)
+	}
+}
@@ -0,0 +1,491 @@
+package separation
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/oralordos/separation/internal/httpclient"
+)
+
+// Business Logic
+type ExportUsersQuery struct {
+	// Since only exports users updated at or after it, when it is not zero.
+	Since time.Time
+	// Filter only exports the users it matches, when it is not nil.
+	Filter Filter
+}
+
+func (eq *ExportUsersQuery) QueryName() string {
+	return "ExportUsers"
+}
+
+type ImportUsersParams struct {
+	Users []*User
+}
+
+func (ip *ImportUsersParams) CommandName() string {
+	return "ImportUsers"
+}
+
+// Validate checks every user before any is imported, so a bad user cannot leave an
+// import half done.
+func (ip *ImportUsersParams) Validate() error {
+	emails := map[Email]bool{}
+	usernames := map[Username]bool{}
+	for _, u := range ip.Users {
+		if u.Email.IsZero() {
+			return ErrEmailEmpty
+		}
+		if emails[u.Email] {
+			return NewValidationError(fmt.Sprintf("%s is in the import more than once", u.Email))
+		}
+		emails[u.Email] = true
+
+		if !u.Username.IsZero() {
+			if usernames[u.Username] {
+				return NewValidationError(fmt.Sprintf("Username %s is given to more than one user in the import", u.Username))
+			}
+			usernames[u.Username] = true
+		}
+
+		err := u.Labels.Validate()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type BackupHandler struct {
+	userStorage UserStorer
+}
+
+func NewBackupHandler(us UserStorer) *BackupHandler {
+	return &BackupHandler{
+		userStorage: us,
+	}
+}
+
+func (bh *BackupHandler) Export(ctx context.Context, q Query) (interface{}, error) {
+	query, ok := q.(*ExportUsersQuery)
+	if !ok {
+		return nil, fmt.Errorf("BackupHandler cannot export %T", q)
+	}
+
+	err := requireAdmin(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	users, err := listFiltered(ctx, bh.userStorage, LabelSelector{}, query.Filter)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Email.String() < users[j].Email.String()
+	})
+	if query.Since.IsZero() {
+		return users, nil
+	}
+
+	changed := users[:0]
+	for _, u := range users {
+		if !u.UpdatedAt.Before(query.Since) {
+			changed = append(changed, u)
+		}
+	}
+	return changed, nil
+}
+
+// Import saves users exactly as they were exported, overwriting any with the same email.
+// It imports every user or none: usernames held by users outside the import are checked
+// before anything is saved, and a failure part way through puts back the users saved so far.
+func (bh *BackupHandler) Import(ctx context.Context, cmd Command) error {
+	params, ok := cmd.(*ImportUsersParams)
+	if !ok {
+		return fmt.Errorf("BackupHandler cannot import %T", cmd)
+	}
+
+	err := requireAdmin(ctx)
+	if err != nil {
+		return err
+	}
+
+	importing := map[Email]bool{}
+	for _, u := range params.Users {
+		importing[u.Email] = true
+	}
+
+	// previous holds the users overwritten, or nil for those that did not exist
+	previous := map[Email]*User{}
+	for _, u := range params.Users {
+		old, err := bh.userStorage.Get(ctx, u.Email)
+		if err != nil && err != ErrUserNotFound {
+			return err
+		}
+		previous[u.Email] = old
+
+		if u.Username.IsZero() {
+			continue
+		}
+		owner, err := bh.userStorage.GetByUsername(ctx, u.Username)
+		if err == nil && owner.Email != u.Email && !importing[owner.Email] {
+			return fmt.Errorf("%s: %w", u.Email, ErrUsernameTaken)
+		} else if err != nil && err != ErrUserNotFound {
+			return err
+		}
+	}
+
+	var saved []*User
+	err = bh.save(ctx, params.Users, &saved)
+	if err == nil {
+		return nil
+	}
+
+	for i := len(saved) - 1; i >= 0; i-- {
+		email := saved[i].Email
+		var rerr error
+		if old := previous[email]; old != nil {
+			rerr = bh.userStorage.Save(ctx, old)
+		} else {
+			_, rerr = bh.userStorage.Delete(ctx, []Email{email})
+		}
+		if rerr != nil {
+			return fmt.Errorf("Import failed: %w, and putting back %s failed: %v", err, email, rerr)
+		}
+	}
+	return err
+}
+
+// save saves users, appending each saved to saved. A user whose username another user in
+// the import still holds is retried once the rest are saved, as they may free it.
+func (bh *BackupHandler) save(ctx context.Context, users []*User, saved *[]*User) error {
+	for len(users) > 0 {
+		var retry []*User
+		var taken error
+		for _, u := range users {
+			err := bh.userStorage.Save(ctx, u)
+			if err == ErrUsernameTaken {
+				retry = append(retry, u)
+				taken = fmt.Errorf("%s: %w", u.Email, err)
+				continue
+			} else if err != nil {
+				return fmt.Errorf("%s: %w", u.Email, err)
+			}
+			*saved = append(*saved, u)
+		}
+		if len(retry) == len(users) {
+			return taken
+		}
+		users = retry
+	}
+	return nil
+}
+
+// Access Layer
+// A backup archive is JSON lines: a header, one line per user, and a trailer
+// holding the number of users and the SHA-256 of every user line.
+const (
+	backupFormat  = "separation-backup"
+	backupVersion = 1
+)
+
+var ErrBadBackup = registerError(errors.New("Backup archive is corrupt or unsupported"), "malformed_backup", http.StatusBadRequest, "The backup archive is corrupt or in an unsupported format")
+
+type backupHeader struct {
+	Format    string     `json:"format"`
+	Version   int        `json:"version"`
+	CreatedAt time.Time  `json:"created_at"`
+	Since     *time.Time `json:"since,omitempty"`
+}
+
+type backupTrailer struct {
+	Count  int    `json:"count"`
+	SHA256 string `json:"sha256"`
+}
+
+// WriteBackup writes users as an archive. When it fails after writing has started, the
+// archive is cut short of its trailer, so ReadBackup refuses it.
+func WriteBackup(w io.Writer, users []*User, since time.Time) error {
+	h := backupHeader{
+		Format:    backupFormat,
+		Version:   backupVersion,
+		CreatedAt: time.Now().UTC(),
+	}
+	if !since.IsZero() {
+		h.Since = &since
+	}
+
+	// Every user is encoded before anything is written, so once writing starts the only
+	// errors left are those of w itself
+	sum := sha256.New()
+	lines := make([][]byte, len(users))
+	for i, u := range users {
+		line, err := json.Marshal(u)
+		if err != nil {
+			return err
+		}
+		lines[i] = append(line, '\n')
+		sum.Write(lines[i])
+	}
+
+	enc := json.NewEncoder(w)
+	err := enc.Encode(h)
+	if err != nil {
+		return err
+	}
+	for _, line := range lines {
+		_, err = w.Write(line)
+		if err != nil {
+			return err
+		}
+	}
+
+	return enc.Encode(backupTrailer{
+		Count:  len(users),
+		SHA256: hex.EncodeToString(sum.Sum(nil)),
+	})
+}
+
+// ReadBackup reads a whole archive and only returns its users once the checksum matches.
+// It may return an ErrBadBackup error.
+func ReadBackup(r io.Reader) ([]*User, error) {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, 1<<20)
+
+	if !sc.Scan() {
+		return nil, ErrBadBackup
+	}
+	h := backupHeader{}
+	err := json.Unmarshal(sc.Bytes(), &h)
+	if err != nil || h.Format != backupFormat || h.Version != backupVersion {
+		return nil, ErrBadBackup
+	}
+
+	var lines [][]byte
+	for sc.Scan() {
+		lines = append(lines, append([]byte(nil), sc.Bytes()...))
+	}
+	if sc.Err() != nil {
+		return nil, sc.Err()
+	}
+	if len(lines) == 0 {
+		return nil, ErrBadBackup
+	}
+
+	t := backupTrailer{}
+	err = json.Unmarshal(lines[len(lines)-1], &t)
+	lines = lines[:len(lines)-1]
+	if err != nil || t.Count != len(lines) {
+		return nil, ErrBadBackup
+	}
+
+	sum := sha256.New()
+	users := make([]*User, 0, len(lines))
+	for _, line := range lines {
+		sum.Write(line)
+		sum.Write([]byte{'\n'})
+
+		u := &User{}
+		err := json.Unmarshal(line, u)
+		if err != nil {
+			return nil, ErrBadBackup
+		}
+		users = append(users, u)
+	}
+
+	if hex.EncodeToString(sum.Sum(nil)) != t.SHA256 {
+		return nil, ErrBadBackup
+	}
+	return users, nil
+}
+
+// Backup serves GET /backup, with an optional ?since=<RFC 3339 time> for incremental backups
+// and an optional ?filter= expression to back up only some users.
+func (a *AdminHTTP) Backup(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, NewMethodError("Backup requires a get request"))
+		return
+	}
+
+	var since time.Time
+	if s := r.FormValue("since"); s != "" {
+		var err error
+		since, err = time.Parse(time.RFC3339, s)
+		if err != nil {
+			writeError(w, r, NewValidationError("Since must be an RFC 3339 time"))
+			return
+		}
+	}
+
+	filter, err := ParseFilter(r.FormValue("filter"))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	users, err := a.users.Export(r.Context(), &ExportUsersQuery{Since: since, Filter: filter})
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	rec := NewStatusRecorder(w)
+	err = WriteBackup(rec, users, since)
+	// Once the archive has started there is no status left to change. The failure is then
+	// the client's connection, and the archive it got has no trailer, so restoring refuses it.
+	if err != nil && rec.Size() == 0 {
+		writeError(w, r, err)
+	}
+}
+
+// Restore serves POST /restore with a backup archive as the body.
+func (a *AdminHTTP) Restore(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, NewMethodError("Restore requires a post request"))
+		return
+	}
+
+	users, err := ReadBackup(r.Body)
+	if err != nil {
+		writeError(w, r, ErrBadBackup)
+		return
+	}
+
+	err = a.users.Import(r.Context(), users)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]int{"restored": len(users)})
+}
+
+// adminClientFlags are shared by the subcommands that talk to a running server's admin layer.
+func adminClientFlags(fs *flag.FlagSet) (adminURL, token *string) {
+	defURL := os.Getenv("ADMIN_URL")
+	if defURL == "" && os.Getenv("ADMIN_PORT") != "" {
+		defURL = "http://localhost:" + os.Getenv("ADMIN_PORT")
+	}
+	adminURL = fs.String("admin-url", defURL, "base URL of the admin layer, defaults to $ADMIN_URL")
+	token = fs.String("token", os.Getenv("ADMIN_TOKEN"), "admin token, defaults to $ADMIN_TOKEN")
+	return adminURL, token
+}
+
+// adminClient retries the idempotent admin requests, such as fetching a backup.
+var adminClient = httpclient.New("admin", httpclient.Options{})
+
+func adminRequest(method, adminURL, token, path string, body io.Reader) (*http.Response, error) {
+	if adminURL == "" {
+		return nil, errors.New("-admin-url or ADMIN_URL must be set")
+	}
+
+	req, err := http.NewRequest(method, strings.TrimSuffix(adminURL, "/")+path, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := adminClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, fmt.Errorf("%s %s: %s: %s", method, path, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return resp, nil
+}
+
+// runBackup implements `separation backup`.
+func runBackup(args []string) error {
+	fs := flag.NewFlagSet("backup", flag.ExitOnError)
+	adminURL, token := adminClientFlags(fs)
+	out := fs.String("o", "", "file to write the archive to, defaults to stdout")
+	since := fs.String("since", "", "only back up users changed since this RFC 3339 time or duration ago, e.g. 24h")
+	filter := fs.String("filter", "", "only back up users matching this filter expression, e.g. 'labels.env eq prod'")
+	fs.Parse(args)
+
+	query := url.Values{}
+	if *filter != "" {
+		query.Set("filter", *filter)
+	}
+	if *since != "" {
+		t, err := time.Parse(time.RFC3339, *since)
+		if err != nil {
+			d, derr := time.ParseDuration(*since)
+			if derr != nil {
+				return fmt.Errorf("-since must be an RFC 3339 time or a duration")
+			}
+			t = time.Now().Add(-d)
+		}
+		query.Set("since", t.UTC().Format(time.RFC3339))
+	}
+	path := "/backup"
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+
+	resp, err := adminRequest(http.MethodGet, *adminURL, *token, path, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var w io.Writer = os.Stdout
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// runRestore implements `separation restore`.
+func runRestore(args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	adminURL, token := adminClientFlags(fs)
+	in := fs.String("i", "", "archive to restore, defaults to stdin")
+	fs.Parse(args)
+
+	var r io.Reader = os.Stdin
+	if *in != "" {
+		f, err := os.Open(*in)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	resp, err := adminRequest(http.MethodPost, *adminURL, *token, "/restore", r)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	_, err = io.Copy(os.Stdout, resp.Body)
+	return err
+}
@@ -0,0 +1,152 @@
+package separation
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/oralordos/separation/internal/principal"
+)
+
+// failingUserStorer fails the save of one email, as a backend might part way through an import.
+type failingUserStorer struct {
+	UserStorer
+	fail Email
+}
+
+var errSaveFailed = errors.New("Save failed")
+
+func (fs *failingUserStorer) Save(ctx context.Context, user *User) error {
+	if user.Email == fs.fail {
+		return errSaveFailed
+	}
+	return fs.UserStorer.Save(ctx, user)
+}
+
+func TestImportIsAllOrNothing(t *testing.T) {
+	ctx := principal.NewContext(context.Background(), &principal.Principal{Subject: "admin", Admin: true})
+	email := func(s string) Email {
+		e, _ := ParseEmail(s)
+		return e
+	}
+	username := func(s string) Username {
+		u, err := ParseUsername(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return u
+	}
+	existing := func() []*User {
+		return []*User{
+			{Email: email("a@example.com"), Name: "Old A", Username: username("alpha")},
+			{Email: email("outsider@example.com"), Name: "Outsider", Username: username("taken")},
+		}
+	}
+
+	tests := []struct {
+		name    string
+		users   []*User
+		fail    Email
+		wantErr error
+	}{
+		{
+			name: "invalid label",
+			users: []*User{
+				{Email: email("a@example.com"), Name: "New A"},
+				{Email: email("b@example.com"), Labels: Labels{"not a key!": "x"}},
+			},
+		},
+		{
+			name: "duplicate email",
+			users: []*User{
+				{Email: email("b@example.com"), Name: "B"},
+				{Email: email("b@example.com"), Name: "B again"},
+			},
+		},
+		{
+			name: "username held outside the import",
+			users: []*User{
+				{Email: email("a@example.com"), Name: "New A"},
+				{Email: email("b@example.com"), Username: username("taken")},
+			},
+			wantErr: ErrUsernameTaken,
+		},
+		{
+			name: "failure part way",
+			users: []*User{
+				{Email: email("a@example.com"), Name: "New A", Username: username("renamed")},
+				{Email: email("b@example.com"), Name: "B", Username: username("alpha")},
+				{Email: email("c@example.com"), Name: "C"},
+			},
+			fail:    email("c@example.com"),
+			wantErr: errSaveFailed,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			us := NewMemoryUserStorage()
+			for _, u := range existing() {
+				err := us.Save(ctx, u)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			d := NewDispatcher()
+			d.UseCommand(ValidateCommands)
+			d.HandleCommand((&ImportUsersParams{}).CommandName(), CommandHandlerFunc(NewBackupHandler(&failingUserStorer{UserStorer: us, fail: tt.fail}).Import))
+
+			err := d.Dispatch(ctx, &ImportUsersParams{Users: tt.users})
+			if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+				t.Errorf("Importing returned %v, want %v", err, tt.wantErr)
+			} else if tt.wantErr == nil && !isValidationError(err) {
+				t.Errorf("Importing returned %v, want a ValidationError", err)
+			}
+
+			got, err := us.List(ctx, LabelSelector{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			sort.Slice(got, func(i, j int) bool { return got[i].Email.String() < got[j].Email.String() })
+			if !reflect.DeepEqual(got, existing()) {
+				t.Errorf("After a failed import the users are %+v, want them unchanged", got)
+			}
+			for _, u := range existing() {
+				owner, err := us.GetByUsername(ctx, u.Username)
+				if err != nil || owner.Email != u.Email {
+					t.Errorf("Username %s belongs to %v, %v, want %s", u.Username, owner, err, u.Email)
+				}
+			}
+		})
+	}
+}
+
+func TestImportPassesUsernamesAlong(t *testing.T) {
+	ctx := principal.NewContext(context.Background(), &principal.Principal{Subject: "admin", Admin: true})
+	a, _ := ParseEmail("a@example.com")
+	b, _ := ParseEmail("b@example.com")
+	x, _ := ParseUsername("xray")
+	y, _ := ParseUsername("yankee")
+
+	us := NewMemoryUserStorage()
+	err := us.Save(ctx, &User{Email: a, Username: x})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// b takes a's username, which a only gives up later in the import
+	err = NewBackupHandler(us).Import(ctx, &ImportUsersParams{Users: []*User{
+		{Email: b, Username: x},
+		{Email: a, Username: y},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for username, want := range map[Username]Email{x: b, y: a} {
+		owner, err := us.GetByUsername(ctx, username)
+		if err != nil || owner.Email != want {
+			t.Errorf("Username %s belongs to %v, %v, want %s", username, owner, err, want)
+		}
+	}
+}
@@ -0,0 +1,359 @@
+package separation
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oralordos/separation/internal/httpclient"
+)
+
+// Action Layer
+var ErrBlobNotFound = registerError(errors.New("Blob not found"), "avatar_not_found", http.StatusNotFound, "No avatar has the requested ID")
+
+// BlobStore keeps opaque binary objects, such as avatar images, by key.
+// Keys are made of letters, digits, '-', '_' and '.', with '/' separating parts.
+type BlobStore interface {
+	Put(ctx context.Context, key, contentType string, data []byte) error
+	// Get may return an ErrBlobNotFound error
+	Get(ctx context.Context, key string) (data []byte, contentType string, err error)
+	// Delete does nothing if the blob does not exist
+	Delete(ctx context.Context, key string) error
+}
+
+var blobKeyRE = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9_.-]*(/[A-Za-z0-9_-][A-Za-z0-9_.-]*)*$`)
+
+func validateBlobKey(key string) error {
+	if !blobKeyRE.MatchString(key) {
+		return fmt.Errorf("Invalid blob key %q", key)
+	}
+	return nil
+}
+
+// OpenBlobStore opens memory, file:///path/to/dir or s3://bucket?region=...&endpoint=...
+// S3 credentials are read from AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY.
+func OpenBlobStore(dest string) (BlobStore, error) {
+	if dest == "" || dest == "memory" {
+		return NewMemoryBlobStore(), nil
+	}
+
+	u, err := url.Parse(dest)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "file":
+		return NewFileBlobStore(u.Path)
+	case "s3":
+		region := u.Query().Get("region")
+		if region == "" {
+			region = "us-east-1"
+		}
+		endpoint := u.Query().Get("endpoint")
+		if endpoint == "" {
+			endpoint = "https://s3." + region + ".amazonaws.com"
+		}
+		return NewS3BlobStore(endpoint, u.Host, region, os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY")), nil
+	}
+	return nil, fmt.Errorf("Unknown blob store %q, use memory, file:// or s3://", dest)
+}
+
+type memoryBlob struct {
+	data        []byte
+	contentType string
+}
+
+type MemoryBlobStore struct {
+	mu    sync.RWMutex
+	blobs map[string]memoryBlob
+}
+
+func NewMemoryBlobStore() *MemoryBlobStore {
+	return &MemoryBlobStore{
+		blobs: map[string]memoryBlob{},
+	}
+}
+
+func (ms *MemoryBlobStore) Put(ctx context.Context, key, contentType string, data []byte) error {
+	err := validateBlobKey(key)
+	if err != nil {
+		return err
+	}
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.blobs[key] = memoryBlob{data: append([]byte(nil), data...), contentType: contentType}
+	return nil
+}
+
+func (ms *MemoryBlobStore) Get(ctx context.Context, key string) ([]byte, string, error) {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+
+	b, ok := ms.blobs[key]
+	if !ok {
+		return nil, "", ErrBlobNotFound
+	}
+	return b.data, b.contentType, nil
+}
+
+func (ms *MemoryBlobStore) Delete(ctx context.Context, key string) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	delete(ms.blobs, key)
+	return nil
+}
+
+// FileBlobStore keeps each blob in a file under a directory,
+// with its content type in a sidecar file next to it.
+type FileBlobStore struct {
+	dir string
+}
+
+func NewFileBlobStore(dir string) (*FileBlobStore, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	return &FileBlobStore{dir: dir}, nil
+}
+
+func (fs *FileBlobStore) path(key string) (string, error) {
+	err := validateBlobKey(key)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(fs.dir, filepath.FromSlash(key)), nil
+}
+
+// writeFileAtomic writes to a temporary file and renames it into place,
+// so readers never see half a blob.
+func writeFileAtomic(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (fs *FileBlobStore) Put(ctx context.Context, key, contentType string, data []byte) error {
+	p, err := fs.path(key)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(p), 0755)
+	if err != nil {
+		return err
+	}
+	err = writeFileAtomic(p+".type", []byte(contentType))
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(p, data)
+}
+
+func (fs *FileBlobStore) Get(ctx context.Context, key string) ([]byte, string, error) {
+	p, err := fs.path(key)
+	if err != nil {
+		return nil, "", ErrBlobNotFound
+	}
+
+	data, err := os.ReadFile(p)
+	if os.IsNotExist(err) {
+		return nil, "", ErrBlobNotFound
+	} else if err != nil {
+		return nil, "", err
+	}
+
+	contentType, err := os.ReadFile(p + ".type")
+	if err != nil {
+		contentType = []byte("application/octet-stream")
+	}
+	return data, string(contentType), nil
+}
+
+func (fs *FileBlobStore) Delete(ctx context.Context, key string) error {
+	p, err := fs.path(key)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range []string{p, p + ".type"} {
+		err = os.Remove(f)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// S3BlobStore keeps blobs in an S3 compatible bucket, addressed path style
+// so it also works with stores such as MinIO. Requests are signed with AWS Signature Version 4.
+type S3BlobStore struct {
+	endpoint  string
+	bucket    string
+	region    string
+	accessKey string
+	secretKey string
+	client    *httpclient.Client
+}
+
+func NewS3BlobStore(endpoint, bucket, region, accessKey, secretKey string) *S3BlobStore {
+	return &S3BlobStore{
+		endpoint:  strings.TrimSuffix(endpoint, "/"),
+		bucket:    bucket,
+		region:    region,
+		accessKey: accessKey,
+		secretKey: secretKey,
+		client:    httpclient.New("s3", httpclient.Options{}),
+	}
+}
+
+func (ss *S3BlobStore) do(ctx context.Context, method, key, contentType string, body []byte) (*http.Response, error) {
+	err := validateBlobKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, ss.endpoint+"/"+ss.bucket+"/"+key, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	ss.sign(req, body, time.Now().UTC())
+
+	resp, err := ss.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, ErrBlobNotFound
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, fmt.Errorf("S3 %s %s: %s: %s", method, key, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return resp, nil
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// sign adds an AWS Signature Version 4 Authorization header to req.
+func (ss *S3BlobStore) sign(req *http.Request, body []byte, now time.Time) {
+	signAWSv4(req, body, now, ss.accessKey, ss.secretKey, ss.region, "s3")
+}
+
+// signAWSv4 adds an AWS Signature Version 4 Authorization header to req for service in region.
+func signAWSv4(req *http.Request, body []byte, now time.Time, accessKey, secretKey, region, service string) {
+	payloadHash := sha256.Sum256(body)
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+
+	var names []string
+	headers := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		headers[strings.ToLower(k)] = strings.TrimSpace(strings.Join(v, ","))
+	}
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, k := range names {
+		canonicalHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+
+	scope := day + "/" + region + "/" + service + "/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), day)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, signedHeaders, signature))
+}
+
+func (ss *S3BlobStore) Put(ctx context.Context, key, contentType string, data []byte) error {
+	resp, err := ss.do(ctx, http.MethodPut, key, contentType, data)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (ss *S3BlobStore) Get(ctx context.Context, key string) ([]byte, string, error) {
+	resp, err := ss.do(ctx, http.MethodGet, key, "", nil)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	return data, resp.Header.Get("Content-Type"), nil
+}
+
+func (ss *S3BlobStore) Delete(ctx context.Context, key string) error {
+	resp, err := ss.do(ctx, http.MethodDelete, key, "", nil)
+	if err == ErrBlobNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
@@ -0,0 +1,271 @@
+package separation
+
+import (
+	"context"
+	"expvar"
+	"hash/fnv"
+	"math"
+	"sync"
+	"time"
+)
+
+// Action Layer
+// bloomFilter answers whether a key may have been added, with no false negatives.
+type bloomFilter struct {
+	bits   []uint64
+	hashes uint64
+}
+
+// newBloomFilter sizes a filter to hold capacity keys at about falsePositiveRate.
+func newBloomFilter(capacity int, falsePositiveRate float64) *bloomFilter {
+	n := math.Max(1, float64(capacity))
+	m := math.Ceil(-n * math.Log(falsePositiveRate) / (math.Ln2 * math.Ln2))
+	k := math.Max(1, math.Round(m/n*math.Ln2))
+	return &bloomFilter{
+		bits:   make([]uint64, (uint64(m)+63)/64),
+		hashes: uint64(k),
+	}
+}
+
+// positions derives every bit of key from two halves of one hash.
+func (bf *bloomFilter) positions(key string, fn func(word int, bit uint64)) {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	sum := h.Sum64()
+	h1, h2 := sum&0xffffffff, sum>>32|1
+	size := uint64(len(bf.bits)) * 64
+	for i := uint64(0); i < bf.hashes; i++ {
+		p := (h1 + i*h2) % size
+		fn(int(p/64), 1<<(p%64))
+	}
+}
+
+func (bf *bloomFilter) add(key string) {
+	bf.positions(key, func(word int, bit uint64) {
+		bf.bits[word] |= bit
+	})
+}
+
+func (bf *bloomFilter) mayContain(key string) bool {
+	found := true
+	bf.positions(key, func(word int, bit uint64) {
+		if bf.bits[word]&bit == 0 {
+			found = false
+		}
+	})
+	return found
+}
+
+var (
+	bloomStats             = expvar.NewMap("storage_bloom")
+	bloomFalsePositiveRate = new(expvar.Float)
+)
+
+func init() {
+	expvar.Publish("storage_bloom_false_positive_rate", bloomFalsePositiveRate)
+}
+
+// EmailSource lists every registered email, to fill a bloom filter from.
+type EmailSource func(ctx context.Context) ([]Email, error)
+
+// EmailsFromChangeLog replays log to find the emails saved and not since deleted.
+func EmailsFromChangeLog(log ChangeLog) EmailSource {
+	return func(ctx context.Context) ([]Email, error) {
+		live := map[Email]bool{}
+		err := log.Replay(ctx, 0, func(c *Change) error {
+			switch c.Op {
+			case ChangeSave:
+				live[c.User.Email] = true
+			case ChangeDelete:
+				for _, e := range c.Emails {
+					delete(live, e)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		emails := make([]Email, 0, len(live))
+		for e := range live {
+			emails = append(emails, e)
+		}
+		return emails, nil
+	}
+}
+
+// EmailsFromStorage lists us.
+func EmailsFromStorage(us UserStorer) EmailSource {
+	return func(ctx context.Context) ([]Email, error) {
+		users, err := us.List(ctx, LabelSelector{})
+		if err != nil {
+			return nil, err
+		}
+		emails := make([]Email, len(users))
+		for i, u := range users {
+			emails[i] = u.Email
+		}
+		return emails, nil
+	}
+}
+
+// BloomUserStorage answers Get for emails that were never saved without asking next,
+// which saves a backend round trip on most registrations. Deleted users stay in the
+// filter until it is rebuilt from source, every interval.
+//
+// Lookups, definite misses and false positives are counted in the storage_bloom expvar,
+// and the false positive rate of the lookups the filter let through is
+// storage_bloom_false_positive_rate.
+type BloomUserStorage struct {
+	next              UserStorer
+	source            EmailSource
+	capacity          int
+	falsePositiveRate float64
+	onError           func(error)
+
+	mu     sync.RWMutex
+	filter *bloomFilter
+	// added records saves made while rebuilding, as the source may have missed them
+	rebuilding bool
+	added      []Email
+
+	passed, falsePositives int64
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewBloomUserStorage fills the filter from source before returning, then rebuilds it
+// every interval until it is closed. Rebuilds that fail keep the old filter and are reported to onError.
+func NewBloomUserStorage(ctx context.Context, next UserStorer, source EmailSource, capacity int, falsePositiveRate float64, interval time.Duration, onError func(error)) (*BloomUserStorage, error) {
+	bs := &BloomUserStorage{
+		next:              next,
+		source:            source,
+		capacity:          capacity,
+		falsePositiveRate: falsePositiveRate,
+		onError:           onError,
+		stop:              make(chan struct{}),
+		done:              make(chan struct{}),
+	}
+	err := bs.Rebuild(ctx)
+	if err != nil {
+		return nil, err
+	}
+	go bs.run(interval)
+	return bs, nil
+}
+
+func (bs *BloomUserStorage) run(interval time.Duration) {
+	defer close(bs.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			err := bs.Rebuild(context.Background())
+			if err != nil {
+				bs.onError(err)
+			}
+		case <-bs.stop:
+			return
+		}
+	}
+}
+
+// Rebuild replaces the filter with one filled from the source, which drops deleted users.
+func (bs *BloomUserStorage) Rebuild(ctx context.Context) error {
+	bs.mu.Lock()
+	bs.rebuilding = true
+	bs.added = nil
+	bs.mu.Unlock()
+
+	emails, err := bs.source(ctx)
+
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	bs.rebuilding = false
+	if err != nil {
+		bs.added = nil
+		return err
+	}
+
+	filter := newBloomFilter(bs.capacity, bs.falsePositiveRate)
+	for _, e := range emails {
+		filter.add(e.String())
+	}
+	for _, e := range bs.added {
+		filter.add(e.String())
+	}
+	bs.added = nil
+	bs.filter = filter
+	return nil
+}
+
+func (bs *BloomUserStorage) Get(ctx context.Context, email Email) (*User, error) {
+	bs.mu.RLock()
+	maybe := bs.filter.mayContain(email.String())
+	bs.mu.RUnlock()
+
+	bloomStats.Add("lookups", 1)
+	if !maybe {
+		bloomStats.Add("definite_misses", 1)
+		return nil, ErrUserNotFound
+	}
+
+	u, err := bs.next.Get(ctx, email)
+	bs.mu.Lock()
+	bs.passed++
+	if err == ErrUserNotFound {
+		bs.falsePositives++
+		bloomStats.Add("false_positives", 1)
+	}
+	bloomFalsePositiveRate.Set(float64(bs.falsePositives) / float64(bs.passed))
+	bs.mu.Unlock()
+	return u, err
+}
+
+// add puts email in the filter, and in the one being rebuilt.
+func (bs *BloomUserStorage) add(email Email) {
+	bs.mu.Lock()
+	bs.filter.add(email.String())
+	if bs.rebuilding {
+		bs.added = append(bs.added, email)
+	}
+	bs.mu.Unlock()
+}
+
+// Save adds the user to the filter before saving, so that a Get never misses a user being saved.
+func (bs *BloomUserStorage) Save(ctx context.Context, user *User) error {
+	bs.add(user.Email)
+	return bs.next.Save(ctx, user)
+}
+
+func (bs *BloomUserStorage) Insert(ctx context.Context, user *User) error {
+	bs.add(user.Email)
+	return bs.next.Insert(ctx, user)
+}
+
+func (bs *BloomUserStorage) GetByUsername(ctx context.Context, username Username) (*User, error) {
+	return bs.next.GetByUsername(ctx, username)
+}
+
+func (bs *BloomUserStorage) List(ctx context.Context, sel LabelSelector) ([]*User, error) {
+	return bs.next.List(ctx, sel)
+}
+
+func (bs *BloomUserStorage) ListFiltered(ctx context.Context, sel LabelSelector, f Filter) ([]*User, error) {
+	return listFiltered(ctx, bs.next, sel, f)
+}
+
+func (bs *BloomUserStorage) Delete(ctx context.Context, emails []Email) (int, error) {
+	return bs.next.Delete(ctx, emails)
+}
+
+// Close stops rebuilding the filter.
+func (bs *BloomUserStorage) Close() error {
+	close(bs.stop)
+	<-bs.done
+	return nil
+}
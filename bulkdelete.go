@@ -0,0 +1,347 @@
+package separation
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/oralordos/separation/internal/clock"
+)
+
+// Business Logic
+// UserFilter selects users for admin operations.
+type UserFilter struct {
+	// Domain matches users whose email is at this domain, with or without the leading '@'.
+	Domain string `json:"domain"`
+	// Where matches users by a filter expression, such as labels.env eq staging.
+	// A filter needs a Domain, a Where, or both.
+	Where string `json:"where"`
+
+	where Filter
+}
+
+func (uf *UserFilter) Validate() error {
+	if strings.TrimPrefix(strings.TrimSpace(uf.Domain), "@") == "" && strings.TrimSpace(uf.Where) == "" {
+		return NewValidationError("Domain or where is required")
+	}
+
+	var err error
+	uf.where, err = ParseFilter(uf.Where)
+	return err
+}
+
+func (uf *UserFilter) domain() string {
+	return "@" + strings.ToLower(strings.TrimPrefix(strings.TrimSpace(uf.Domain), "@"))
+}
+
+func (uf *UserFilter) inDomain(u *User) bool {
+	return strings.TrimSpace(uf.Domain) == "" || strings.HasSuffix(u.Email.String(), uf.domain())
+}
+
+// Matches may only be called once Validate has parsed the filter.
+func (uf *UserFilter) Matches(u *User) bool {
+	return uf.inDomain(u) && CompileFilter(uf.where)(u)
+}
+
+type BulkDeletePreview struct {
+	Count     int       `json:"count"`
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type PreviewBulkDeleteQuery struct {
+	Filter UserFilter
+}
+
+func (pq *PreviewBulkDeleteQuery) QueryName() string {
+	return "PreviewBulkDelete"
+}
+
+func (pq *PreviewBulkDeleteQuery) Validate() error {
+	return pq.Filter.Validate()
+}
+
+type BulkDeleteParams struct {
+	Filter UserFilter `json:"filter"`
+	Token  string     `json:"token"`
+
+	// Progress is called after each batch is deleted.
+	Progress func(deleted, total int) `json:"-"`
+}
+
+func (bp *BulkDeleteParams) CommandName() string {
+	return "BulkDeleteUsers"
+}
+
+func (bp *BulkDeleteParams) Validate() error {
+	if bp.Token == "" {
+		return NewValidationError("Token cannot be empty")
+	}
+
+	return bp.Filter.Validate()
+}
+
+var (
+	ErrInvalidConfirmation = registerError(errors.New("Confirmation token is invalid or expired"), "invalid_confirmation", http.StatusConflict, "The bulk delete confirmation token is invalid, expired, or for another filter")
+	ErrFilterChanged       = registerError(errors.New("The users matching the filter changed since it was previewed"), "filter_changed", http.StatusConflict, "The users matching the bulk delete filter changed since it was previewed")
+)
+
+const (
+	bulkDeleteTokenTTL  = 10 * time.Minute
+	bulkDeleteBatchSize = 100
+)
+
+// BulkDeleteHandler implements both steps of bulk deletion.
+// The preview issues a token bound to the filter and a digest of the users it matched,
+// and the delete refuses to run without it, or once the filter matches other users.
+type BulkDeleteHandler struct {
+	userStorage UserStorer
+	clock       clock.Clock
+	key         []byte
+	batchSize   int
+}
+
+// NewBulkDeleteHandler signs tokens with key. Without one it signs with a random key, and
+// only accepts the tokens it issued itself.
+func NewBulkDeleteHandler(us UserStorer, clk clock.Clock, key []byte) *BulkDeleteHandler {
+	if len(key) == 0 {
+		key = make([]byte, 32)
+		_, err := rand.Read(key)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	return &BulkDeleteHandler{
+		userStorage: us,
+		clock:       clk,
+		key:         key,
+		batchSize:   bulkDeleteBatchSize,
+	}
+}
+
+func (bh *BulkDeleteHandler) matching(ctx context.Context, f *UserFilter) ([]Email, error) {
+	users, err := listFiltered(ctx, bh.userStorage, LabelSelector{}, f.where)
+	if err != nil {
+		return nil, err
+	}
+
+	var emails []Email
+	for _, u := range users {
+		if f.inDomain(u) {
+			emails = append(emails, u.Email)
+		}
+	}
+	return emails, nil
+}
+
+// digestEmails hashes a set of emails, in whatever order they are listed.
+func digestEmails(emails []Email) string {
+	sorted := make([]string, len(emails))
+	for i, e := range emails {
+		sorted[i] = e.String()
+	}
+	sort.Strings(sorted)
+
+	h := sha256.New()
+	for _, e := range sorted {
+		fmt.Fprintf(h, "%s\n", e)
+	}
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil))
+}
+
+func (bh *BulkDeleteHandler) sign(f *UserFilter, digest string, expires int64) string {
+	mac := hmac.New(sha256.New, bh.key)
+	fmt.Fprintf(mac, "%s\n%q\n%s\n%d", f.domain(), strings.TrimSpace(f.Where), digest, expires)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (bh *BulkDeleteHandler) token(f *UserFilter, emails []Email, expires time.Time) string {
+	exp := expires.Unix()
+	digest := digestEmails(emails)
+	return fmt.Sprintf("%d.%s.%s", exp, digest, bh.sign(f, digest, exp))
+}
+
+// verify returns the digest of the users the token was issued for.
+func (bh *BulkDeleteHandler) verify(f *UserFilter, token string) (string, error) {
+	parts := strings.SplitN(token, ".", 3)
+	if len(parts) != 3 {
+		return "", ErrInvalidConfirmation
+	}
+
+	exp, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return "", ErrInvalidConfirmation
+	}
+	digest := parts[1]
+
+	if !hmac.Equal([]byte(parts[2]), []byte(bh.sign(f, digest, exp))) {
+		return "", ErrInvalidConfirmation
+	}
+	if bh.clock.Now().Unix() > exp {
+		return "", ErrInvalidConfirmation
+	}
+	return digest, nil
+}
+
+func (bh *BulkDeleteHandler) Preview(ctx context.Context, q Query) (interface{}, error) {
+	query, ok := q.(*PreviewBulkDeleteQuery)
+	if !ok {
+		return nil, fmt.Errorf("BulkDeleteHandler cannot preview %T", q)
+	}
+
+	err := requireAdmin(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	emails, err := bh.matching(ctx, &query.Filter)
+	if err != nil {
+		return nil, err
+	}
+
+	expires := bh.clock.Now().Add(bulkDeleteTokenTTL).Truncate(time.Second)
+	return &BulkDeletePreview{
+		Count:     len(emails),
+		Token:     bh.token(&query.Filter, emails, expires),
+		ExpiresAt: expires,
+	}, nil
+}
+
+func (bh *BulkDeleteHandler) Delete(ctx context.Context, cmd Command) error {
+	params, ok := cmd.(*BulkDeleteParams)
+	if !ok {
+		return fmt.Errorf("BulkDeleteHandler cannot delete %T", cmd)
+	}
+
+	err := requireAdmin(ctx)
+	if err != nil {
+		return err
+	}
+
+	previewed, err := bh.verify(&params.Filter, params.Token)
+	if err != nil {
+		return err
+	}
+
+	// Only the users the admin saw previewed are deleted, so any change to who matches,
+	// even with the same count, needs a fresh preview
+	emails, err := bh.matching(ctx, &params.Filter)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal([]byte(digestEmails(emails)), []byte(previewed)) {
+		return ErrFilterChanged
+	}
+
+	deleted := 0
+	for start := 0; start < len(emails); start += bh.batchSize {
+		end := start + bh.batchSize
+		if end > len(emails) {
+			end = len(emails)
+		}
+
+		n, err := bh.userStorage.Delete(ctx, emails[start:end])
+		deleted += n
+		if err != nil {
+			return err
+		}
+
+		if params.Progress != nil {
+			params.Progress(deleted, len(emails))
+		}
+	}
+	return nil
+}
+
+// Access Layer
+func (a *AdminHTTP) PreviewBulkDelete(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, NewMethodError("PreviewBulkDelete requires a post request"))
+		return
+	}
+
+	filter := &UserFilter{}
+	err := json.NewDecoder(r.Body).Decode(filter)
+	if err != nil {
+		writeError(w, r, ErrMalformedRequest)
+		return
+	}
+
+	preview, err := a.users.PreviewBulkDelete(r.Context(), filter)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(preview)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+}
+
+type bulkDeleteProgress struct {
+	Deleted int    `json:"deleted"`
+	Total   int    `json:"total"`
+	Done    bool   `json:"done,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// BulkDelete streams one JSON line per deleted batch so operators can follow progress.
+// Errors found before anything is deleted get a normal error response instead.
+func (a *AdminHTTP) BulkDelete(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, NewMethodError("BulkDelete requires a post request"))
+		return
+	}
+
+	params := &BulkDeleteParams{}
+	err := json.NewDecoder(r.Body).Decode(params)
+	if err != nil {
+		writeError(w, r, ErrMalformedRequest)
+		return
+	}
+
+	enc := json.NewEncoder(w)
+	flusher, _ := w.(http.Flusher)
+	started := false
+	last := bulkDeleteProgress{}
+	params.Progress = func(deleted, total int) {
+		if !started {
+			w.Header().Set("Content-Type", "application/x-ndjson")
+			started = true
+		}
+		last = bulkDeleteProgress{Deleted: deleted, Total: total}
+		_ = enc.Encode(last)
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+
+	err = a.users.BulkDelete(r.Context(), params)
+	if !started {
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	}
+
+	last.Done = err == nil
+	if err != nil {
+		last.Error = err.Error()
+	}
+	_ = enc.Encode(last)
+}
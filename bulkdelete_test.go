@@ -0,0 +1,71 @@
+package separation
+
+import (
+	"context"
+	"testing"
+
+	"github.com/oralordos/separation/internal/clock"
+	"github.com/oralordos/separation/internal/principal"
+)
+
+func TestBulkDeleteRefusesChangedMatches(t *testing.T) {
+	ctx := principal.NewContext(context.Background(), &principal.Principal{Subject: "admin", Admin: true})
+	us := NewMemoryUserStorage()
+	save := func(addr string) Email {
+		email, _ := ParseEmail(addr)
+		err := us.Save(ctx, &User{Email: email})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return email
+	}
+	a := save("a@example.com")
+	save("b@example.com")
+
+	key := []byte("0123456789abcdef0123456789abcdef")
+	filter := UserFilter{Domain: "example.com"}
+	err := filter.Validate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	preview := func() string {
+		res, err := NewBulkDeleteHandler(us, clock.Real, key).Preview(ctx, &PreviewBulkDeleteQuery{Filter: filter})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res.(*BulkDeletePreview).Token
+	}
+	token := preview()
+
+	// Swapping one matching user for another keeps the count but changes who would be deleted
+	_, err = us.Delete(ctx, []Email{a})
+	if err != nil {
+		t.Fatal(err)
+	}
+	save("c@example.com")
+	err = NewBulkDeleteHandler(us, clock.Real, key).Delete(ctx, &BulkDeleteParams{Filter: filter, Token: token})
+	if err != ErrFilterChanged {
+		t.Fatalf("Deleting after the matches changed returned %v, want %v", err, ErrFilterChanged)
+	}
+
+	// Another handler with the same key, such as another instance, accepts a fresh token
+	token = preview()
+	err = NewBulkDeleteHandler(us, clock.Real, key).Delete(ctx, &BulkDeleteParams{Filter: filter, Token: token})
+	if err != nil {
+		t.Fatal(err)
+	}
+	users, err := us.List(ctx, LabelSelector{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 0 {
+		t.Errorf("%d users were left", len(users))
+	}
+
+	// A handler with another key does not
+	token = preview()
+	err = NewBulkDeleteHandler(us, clock.Real, []byte("fedcba9876543210fedcba9876543210")).Delete(ctx, &BulkDeleteParams{Filter: filter, Token: token})
+	if err != ErrInvalidConfirmation {
+		t.Errorf("Deleting with a token signed by another key returned %v, want %v", err, ErrInvalidConfirmation)
+	}
+}
@@ -0,0 +1,500 @@
+package separation
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/oralordos/separation/internal/clock"
+)
+
+// Action Layer
+type cachedUser struct {
+	user     *User
+	cachedAt time.Time
+	expires  time.Time
+}
+
+// CachingUserStorage keeps the users read from next in memory for a while, so repeated
+// lookups of the same user do not reach the backend.
+//
+// In write behind mode it also holds saves back and writes them to next in batches, every
+// interval or once batchSize are pending, which is far quicker for bulk imports. A save is
+// acknowledged before it reaches next, so saves still pending are lost if the process dies
+// without being closed, and a username conflict found at flush time drops the save.
+// Close always flushes what is pending.
+type CachingUserStorage struct {
+	next  UserStorer
+	ttl   time.Duration
+	clock clock.Clock
+
+	mu        sync.Mutex
+	entries   map[Email]cachedUser
+	usernames map[Username]Email
+
+	writeBehind bool
+	batchSize   int
+	onError     func(error)
+	// saveMu makes checking a pending save's username and queueing it one step
+	saveMu  sync.Mutex
+	flushMu sync.Mutex
+	pending map[Email]*User
+	// flushing is the batch being written, still read from until it is written
+	flushing map[Email]*User
+	stop     chan struct{}
+	done     chan struct{}
+
+	// bus shares saves and deletes with the caches of other instances. It is nil when
+	// the backend is not shared.
+	bus       InvalidationBus
+	origin    string
+	staleness time.Duration
+	// degraded is set while invalidations from other instances may be missed
+	degraded  bool
+	busOnErr  func(error)
+	busCancel context.CancelFunc
+	busDone   chan struct{}
+}
+
+// NewCachingUserStorage reads through to next, keeping each user for ttl.
+// Saves are written to next before they return.
+func NewCachingUserStorage(next UserStorer, ttl time.Duration, clk clock.Clock) *CachingUserStorage {
+	return &CachingUserStorage{
+		next:      next,
+		ttl:       ttl,
+		clock:     clk,
+		entries:   map[Email]cachedUser{},
+		usernames: map[Username]Email{},
+	}
+}
+
+// NewWriteBehindUserStorage caches like NewCachingUserStorage, and writes saves to next
+// every interval or once batchSize are pending, until it is closed. Saves that fail when
+// flushed in the background are retried at the next flush and reported to onError.
+func NewWriteBehindUserStorage(next UserStorer, ttl time.Duration, clk clock.Clock, interval time.Duration, batchSize int, onError func(error)) *CachingUserStorage {
+	cs := NewCachingUserStorage(next, ttl, clk)
+	cs.writeBehind = true
+	cs.batchSize = batchSize
+	cs.onError = onError
+	cs.pending = map[Email]*User{}
+	cs.stop = make(chan struct{})
+	cs.done = make(chan struct{})
+	go cs.run(interval)
+	return cs
+}
+
+func (cs *CachingUserStorage) run(interval time.Duration) {
+	defer close(cs.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			err := cs.Flush(context.Background())
+			if err != nil {
+				cs.onError(err)
+			}
+		case <-cs.stop:
+			return
+		}
+	}
+}
+
+// remember caches u. The caller must hold mu.
+func (cs *CachingUserStorage) remember(u *User) {
+	if cs.ttl <= 0 {
+		return
+	}
+	cs.forget(u.Email)
+	now := cs.clock.Now()
+	cs.entries[u.Email] = cachedUser{user: u, cachedAt: now, expires: now.Add(cs.ttl)}
+	if !u.Username.IsZero() {
+		cs.usernames[u.Username] = u.Email
+	}
+}
+
+// forget drops the cached copy of the user with email. The caller must hold mu.
+func (cs *CachingUserStorage) forget(email Email) {
+	if old, ok := cs.entries[email]; ok {
+		if cs.usernames[old.user.Username] == email {
+			delete(cs.usernames, old.user.Username)
+		}
+		delete(cs.entries, email)
+	}
+}
+
+// Warm loads up to n of the most recently seen users into the cache, so the first requests
+// after a deploy do not all reach the backend. Users never seen rank by when they registered.
+// It stops early when ctx is done, and returns how many users it loaded.
+func (cs *CachingUserStorage) Warm(ctx context.Context, n int) (int, error) {
+	if cs.ttl <= 0 || n <= 0 {
+		return 0, nil
+	}
+	users, err := cs.next.List(ctx, LabelSelector{})
+	if err != nil {
+		return 0, err
+	}
+
+	lastActive := func(u *User) time.Time {
+		if u.LastSeenAt != nil {
+			return *u.LastSeenAt
+		}
+		return u.CreatedAt
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return lastActive(users[i]).After(lastActive(users[j]))
+	})
+	if len(users) > n {
+		users = users[:n]
+	}
+
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	loaded := 0
+	for _, u := range users {
+		if ctx.Err() != nil {
+			return loaded, ctx.Err()
+		}
+		if _, ok := cs.held(u.Email); !ok {
+			cs.remember(u)
+		}
+		loaded++
+	}
+	return loaded, nil
+}
+
+// held returns the save of the user with email not yet written to the backend.
+// The caller must hold mu.
+func (cs *CachingUserStorage) held(email Email) (*User, bool) {
+	if u, ok := cs.pending[email]; ok {
+		return u, true
+	}
+	u, ok := cs.flushing[email]
+	return u, ok
+}
+
+// cached returns the held or unexpired cached user with email. The caller must hold mu.
+func (cs *CachingUserStorage) cached(email Email) (*User, bool) {
+	if u, ok := cs.held(email); ok {
+		return u, true
+	}
+	e, ok := cs.entries[email]
+	if !ok {
+		return nil, false
+	}
+	now := cs.clock.Now()
+	if !now.Before(e.expires) || (cs.degraded && now.Sub(e.cachedAt) > cs.staleness) {
+		cs.forget(email)
+		return nil, false
+	}
+	return e.user, true
+}
+
+func (cs *CachingUserStorage) Get(ctx context.Context, email Email) (*User, error) {
+	cs.mu.Lock()
+	u, ok := cs.cached(email)
+	cs.mu.Unlock()
+	if ok {
+		return u, nil
+	}
+
+	u, err := cs.next.Get(ctx, email)
+	if err != nil {
+		return nil, err
+	}
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	// A save may have gone past while reading, and it is newer
+	if newer, ok := cs.cached(email); ok {
+		return newer, nil
+	}
+	cs.remember(u)
+	return u, nil
+}
+
+func (cs *CachingUserStorage) GetByUsername(ctx context.Context, username Username) (*User, error) {
+	cs.mu.Lock()
+	for _, held := range []map[Email]*User{cs.pending, cs.flushing} {
+		for _, u := range held {
+			if u.Username == username {
+				cs.mu.Unlock()
+				return u, nil
+			}
+		}
+	}
+	if email, ok := cs.usernames[username]; ok {
+		if u, ok := cs.cached(email); ok && u.Username == username {
+			cs.mu.Unlock()
+			return u, nil
+		}
+	}
+	cs.mu.Unlock()
+
+	u, err := cs.next.GetByUsername(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	// A pending save of the user may have changed their username
+	if newer, ok := cs.held(u.Email); ok {
+		if newer.Username != username {
+			return nil, ErrUserNotFound
+		}
+		return newer, nil
+	}
+	cs.remember(u)
+	return u, nil
+}
+
+func (cs *CachingUserStorage) Save(ctx context.Context, user *User) error {
+	if !cs.writeBehind {
+		err := cs.next.Save(ctx, user)
+		cs.mu.Lock()
+		if err != nil {
+			cs.forget(user.Email)
+			cs.mu.Unlock()
+			return err
+		}
+		cs.remember(user)
+		cs.mu.Unlock()
+		cs.publish(ctx, []Email{user.Email})
+		return nil
+	}
+
+	cs.saveMu.Lock()
+	if !user.Username.IsZero() {
+		owner, err := cs.GetByUsername(ctx, user.Username)
+		if err == nil && owner.Email != user.Email {
+			cs.saveMu.Unlock()
+			return ErrUsernameTaken
+		} else if err != nil && err != ErrUserNotFound {
+			cs.saveMu.Unlock()
+			return err
+		}
+	}
+	cs.mu.Lock()
+	cs.forget(user.Email)
+	cs.pending[user.Email] = user
+	full := len(cs.pending) >= cs.batchSize
+	cs.mu.Unlock()
+	cs.saveMu.Unlock()
+
+	if full {
+		return cs.Flush(ctx)
+	}
+	return nil
+}
+
+// Insert flushes pending saves first and inserts straight into the backend, even in
+// write behind mode, as only the backend can refuse a taken email atomically.
+func (cs *CachingUserStorage) Insert(ctx context.Context, user *User) error {
+	err := cs.Flush(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = cs.next.Insert(ctx, user)
+	cs.mu.Lock()
+	if err != nil {
+		cs.forget(user.Email)
+		cs.mu.Unlock()
+		return err
+	}
+	cs.remember(user)
+	cs.mu.Unlock()
+	cs.publish(ctx, []Email{user.Email})
+	return nil
+}
+
+// List flushes pending saves first, so that it sees them.
+func (cs *CachingUserStorage) List(ctx context.Context, sel LabelSelector) ([]*User, error) {
+	err := cs.Flush(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return cs.next.List(ctx, sel)
+}
+
+// ListFiltered flushes pending saves first, so that it sees them.
+func (cs *CachingUserStorage) ListFiltered(ctx context.Context, sel LabelSelector, f Filter) ([]*User, error) {
+	err := cs.Flush(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return listFiltered(ctx, cs.next, sel, f)
+}
+
+// Delete flushes pending saves first, so that none of them brings a deleted user back.
+func (cs *CachingUserStorage) Delete(ctx context.Context, emails []Email) (int, error) {
+	err := cs.Flush(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := cs.next.Delete(ctx, emails)
+	cs.mu.Lock()
+	for _, email := range emails {
+		cs.forget(email)
+	}
+	cs.mu.Unlock()
+	cs.publish(ctx, emails)
+	return n, err
+}
+
+// Flush writes every pending save to the backend. Saves that fail are kept for the next
+// flush, except those refused for a taken username, which are dropped as they never succeed.
+// It does nothing unless in write behind mode.
+func (cs *CachingUserStorage) Flush(ctx context.Context) error {
+	if !cs.writeBehind {
+		return nil
+	}
+	cs.flushMu.Lock()
+	defer cs.flushMu.Unlock()
+
+	cs.mu.Lock()
+	batch := cs.pending
+	cs.pending = map[Email]*User{}
+	cs.flushing = batch
+	cs.mu.Unlock()
+
+	var saved, failed []*User
+	var firstErr error
+	// A save may take a username another save in the batch gives up, so saves refused
+	// for a taken username are tried again for as long as the others make progress
+	remaining := make([]*User, 0, len(batch))
+	for _, u := range batch {
+		remaining = append(remaining, u)
+	}
+	for progress := true; progress && len(remaining) > 0; {
+		progress = false
+		var taken []*User
+		for _, u := range remaining {
+			err := cs.next.Save(ctx, u)
+			if err == ErrUsernameTaken {
+				taken = append(taken, u)
+			} else if err != nil {
+				failed = append(failed, u)
+				if firstErr == nil {
+					firstErr = err
+				}
+			} else {
+				saved = append(saved, u)
+				progress = true
+			}
+		}
+		remaining = taken
+	}
+	dropped := len(remaining)
+
+	cs.mu.Lock()
+	cs.flushing = nil
+	written := make([]Email, 0, len(saved))
+	for _, u := range saved {
+		written = append(written, u.Email)
+		if _, ok := cs.pending[u.Email]; !ok {
+			cs.remember(u)
+		}
+	}
+	for _, u := range failed {
+		// A save queued during the flush is newer than the failed one
+		if _, ok := cs.pending[u.Email]; !ok {
+			cs.pending[u.Email] = u
+		}
+	}
+	cs.mu.Unlock()
+	if len(written) > 0 {
+		cs.publish(ctx, written)
+	}
+
+	if dropped > 0 {
+		return fmt.Errorf("Write behind dropped %d saves whose username was taken", dropped)
+	}
+	if firstErr != nil {
+		return fmt.Errorf("Write behind could not save %d users, they will be retried: %v", len(failed), firstErr)
+	}
+	return nil
+}
+
+// ShareInvalidations keeps the cache consistent with those of other instances sharing the
+// backend. Saves and deletes, once they reach the backend, are published on bus, and the
+// users published by other instances are dropped from the cache. While invalidations
+// cannot be received, cached users are only served for staleness after they were read,
+// and the whole cache is dropped once they can be received again. origin must be unique
+// to the instance. Failures to publish are reported to onError.
+func (cs *CachingUserStorage) ShareInvalidations(bus InvalidationBus, origin string, staleness time.Duration, onError func(error)) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cs.mu.Lock()
+	cs.bus = bus
+	cs.origin = origin
+	cs.staleness = staleness
+	cs.busOnErr = onError
+	// Until subscribed, invalidations may be missed
+	cs.degraded = true
+	cs.busCancel = cancel
+	cs.busDone = make(chan struct{})
+	cs.mu.Unlock()
+
+	go func() {
+		defer close(cs.busDone)
+		subscribed := false
+		bus.Subscribe(ctx, func(inv *CacheInvalidation) {
+			if inv.Origin == cs.origin {
+				return
+			}
+			cs.Invalidate(inv.Emails...)
+		}, func(connected bool) {
+			cs.mu.Lock()
+			defer cs.mu.Unlock()
+			if connected && subscribed {
+				// Invalidations sent while disconnected were missed
+				cs.entries = map[Email]cachedUser{}
+				cs.usernames = map[Username]Email{}
+			}
+			subscribed = subscribed || connected
+			cs.degraded = !connected
+		})
+	}()
+}
+
+// Invalidate drops the cached copies of the users with emails, as when another instance
+// saved or deleted them. Saves held back in write behind mode are kept, as they are newer.
+func (cs *CachingUserStorage) Invalidate(emails ...Email) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	for _, email := range emails {
+		cs.forget(email)
+	}
+}
+
+// publish tells the other instances that the users with emails changed.
+func (cs *CachingUserStorage) publish(ctx context.Context, emails []Email) {
+	cs.mu.Lock()
+	bus, origin, onError := cs.bus, cs.origin, cs.busOnErr
+	cs.mu.Unlock()
+	if bus == nil {
+		return
+	}
+	err := bus.Publish(ctx, &CacheInvalidation{Origin: origin, Emails: emails})
+	if err != nil && onError != nil {
+		onError(fmt.Errorf("Unable to publish cache invalidations: %v", err))
+	}
+}
+
+// Close stops background flushing and writes what is left, and stops receiving invalidations.
+// It does not close the backend.
+func (cs *CachingUserStorage) Close() error {
+	if cs.busCancel != nil {
+		cs.busCancel()
+		<-cs.busDone
+	}
+	if !cs.writeBehind {
+		return nil
+	}
+	close(cs.stop)
+	<-cs.done
+	return cs.Flush(context.Background())
+}
@@ -0,0 +1,157 @@
+package separation
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"sync"
+	"time"
+
+	"github.com/oralordos/separation/internal/redis"
+)
+
+// Action Layer
+// CacheInvalidation tells the caches of other instances which users were saved or deleted.
+type CacheInvalidation struct {
+	// Origin is the instance that sent it, which skips its own invalidations
+	Origin string  `json:"origin"`
+	Emails []Email `json:"emails"`
+}
+
+// newInstanceID names this instance on the invalidation bus.
+func newInstanceID() (string, error) {
+	b := make([]byte, 8)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// InvalidationBus carries cache invalidations between instances.
+type InvalidationBus interface {
+	Publish(ctx context.Context, inv *CacheInvalidation) error
+	// Subscribe delivers every published invalidation to fn until ctx is done. It calls
+	// connected with false when invalidations may be missed, and with true once they are
+	// received again.
+	Subscribe(ctx context.Context, fn func(*CacheInvalidation), connected func(bool))
+}
+
+// MemoryInvalidationBus carries invalidations between caches in one process, such as
+// several servers embedded in the same binary.
+type MemoryInvalidationBus struct {
+	mu   sync.RWMutex
+	subs map[int]func(*CacheInvalidation)
+	next int
+}
+
+func NewMemoryInvalidationBus() *MemoryInvalidationBus {
+	return &MemoryInvalidationBus{
+		subs: map[int]func(*CacheInvalidation){},
+	}
+}
+
+func (mb *MemoryInvalidationBus) Publish(ctx context.Context, inv *CacheInvalidation) error {
+	mb.mu.RLock()
+	defer mb.mu.RUnlock()
+	for _, fn := range mb.subs {
+		fn(inv)
+	}
+	return nil
+}
+
+func (mb *MemoryInvalidationBus) Subscribe(ctx context.Context, fn func(*CacheInvalidation), connected func(bool)) {
+	mb.mu.Lock()
+	id := mb.next
+	mb.next++
+	mb.subs[id] = fn
+	mb.mu.Unlock()
+	connected(true)
+
+	<-ctx.Done()
+	mb.mu.Lock()
+	delete(mb.subs, id)
+	mb.mu.Unlock()
+}
+
+// RedisInvalidationBus carries invalidations over a Redis pub/sub channel, to every
+// instance using the same server.
+type RedisInvalidationBus struct {
+	client  *redis.Client
+	channel string
+	// retry is how long to wait before resubscribing after the connection drops
+	retry time.Duration
+}
+
+func NewRedisInvalidationBus(client *redis.Client, channel string) *RedisInvalidationBus {
+	return &RedisInvalidationBus{
+		client:  client,
+		channel: channel,
+		retry:   time.Second,
+	}
+}
+
+func (rb *RedisInvalidationBus) Publish(ctx context.Context, inv *CacheInvalidation) error {
+	b, err := json.Marshal(inv)
+	if err != nil {
+		return err
+	}
+	_, err = rb.client.Do(ctx, "PUBLISH", rb.channel, string(b))
+	return err
+}
+
+func (rb *RedisInvalidationBus) Subscribe(ctx context.Context, fn func(*CacheInvalidation), connected func(bool)) {
+	for ctx.Err() == nil {
+		rb.listen(ctx, fn, connected)
+		connected(false)
+
+		select {
+		case <-time.After(rb.retry):
+		case <-ctx.Done():
+		}
+	}
+}
+
+// listen receives invalidations on one connection until it drops or ctx is done.
+func (rb *RedisInvalidationBus) listen(ctx context.Context, fn func(*CacheInvalidation), connected func(bool)) {
+	conn, err := rb.client.Dial(ctx)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	// Receive blocks without a deadline, so the connection is closed to stop it
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+
+	_, err = conn.Do(ctx, "SUBSCRIBE", rb.channel)
+	if err != nil {
+		return
+	}
+	connected(true)
+
+	for {
+		reply, err := conn.Receive(time.Time{})
+		if err != nil {
+			return
+		}
+		// Messages arrive as ["message", channel, payload]
+		msg, ok := reply.([]interface{})
+		if !ok || len(msg) != 3 || msg[0] != "message" {
+			continue
+		}
+		payload, _ := msg[2].(string)
+		inv := &CacheInvalidation{}
+		if json.Unmarshal([]byte(payload), inv) != nil {
+			continue
+		}
+		fn(inv)
+	}
+}
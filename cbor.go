@@ -0,0 +1,133 @@
+package separation
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// Access Layer
+// The WebAuthn messages are small CBOR documents of a few known shapes, so they are
+// decoded here rather than pulling in a CBOR library, as codec.go does for protobuf.
+
+var errMalformedCBOR = errors.New("Malformed CBOR")
+
+// cborMaxDepth bounds nesting, so a hostile document cannot exhaust the stack.
+const cborMaxDepth = 16
+
+// decodeCBOR decodes the first CBOR item of b, returning it and the bytes after it.
+// Unsigned and negative integers decode to int64, byte strings to []byte, text to string,
+// arrays to []interface{}, maps to map[interface{}]interface{}, and floats to float64.
+// Tags are dropped, leaving the item they tag. Indefinite lengths are not supported,
+// as WebAuthn requires the canonical encoding.
+func decodeCBOR(b []byte) (interface{}, []byte, error) {
+	return decodeCBORItem(b, 0)
+}
+
+func decodeCBORItem(b []byte, depth int) (interface{}, []byte, error) {
+	if len(b) == 0 || depth > cborMaxDepth {
+		return nil, nil, errMalformedCBOR
+	}
+	major, info := b[0]>>5, b[0]&0x1f
+	b = b[1:]
+
+	if major == 7 {
+		return decodeCBORSimple(b, info)
+	}
+
+	var arg uint64
+	switch {
+	case info < 24:
+		arg = uint64(info)
+	case info == 24 && len(b) >= 1:
+		arg, b = uint64(b[0]), b[1:]
+	case info == 25 && len(b) >= 2:
+		arg, b = uint64(binary.BigEndian.Uint16(b)), b[2:]
+	case info == 26 && len(b) >= 4:
+		arg, b = uint64(binary.BigEndian.Uint32(b)), b[4:]
+	case info == 27 && len(b) >= 8:
+		arg, b = binary.BigEndian.Uint64(b), b[8:]
+	default:
+		return nil, nil, errMalformedCBOR
+	}
+
+	switch major {
+	case 0:
+		if arg > math.MaxInt64 {
+			return nil, nil, errMalformedCBOR
+		}
+		return int64(arg), b, nil
+	case 1:
+		if arg > math.MaxInt64 {
+			return nil, nil, errMalformedCBOR
+		}
+		return -1 - int64(arg), b, nil
+	case 2, 3:
+		if arg > uint64(len(b)) {
+			return nil, nil, errMalformedCBOR
+		}
+		if major == 2 {
+			return append([]byte(nil), b[:arg]...), b[arg:], nil
+		}
+		return string(b[:arg]), b[arg:], nil
+	case 4:
+		// Every item takes at least a byte, which bounds the allocation
+		if arg > uint64(len(b)) {
+			return nil, nil, errMalformedCBOR
+		}
+		items := make([]interface{}, 0, arg)
+		for i := uint64(0); i < arg; i++ {
+			var item interface{}
+			var err error
+			item, b, err = decodeCBORItem(b, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			items = append(items, item)
+		}
+		return items, b, nil
+	case 5:
+		if arg > uint64(len(b))/2 {
+			return nil, nil, errMalformedCBOR
+		}
+		m := make(map[interface{}]interface{}, arg)
+		for i := uint64(0); i < arg; i++ {
+			var k, v interface{}
+			var err error
+			k, b, err = decodeCBORItem(b, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			switch k.(type) {
+			case int64, string:
+			default:
+				return nil, nil, errMalformedCBOR
+			}
+			v, b, err = decodeCBORItem(b, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			m[k] = v
+		}
+		return m, b, nil
+	default:
+		// Tags carry no meaning WebAuthn relies on
+		return decodeCBORItem(b, depth+1)
+	}
+}
+
+func decodeCBORSimple(b []byte, info byte) (interface{}, []byte, error) {
+	switch {
+	case info == 20:
+		return false, b, nil
+	case info == 21:
+		return true, b, nil
+	case info == 22 || info == 23:
+		return nil, b, nil
+	case info == 26 && len(b) >= 4:
+		return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), b[4:], nil
+	case info == 27 && len(b) >= 8:
+		return math.Float64frombits(binary.BigEndian.Uint64(b)), b[8:], nil
+	}
+	return nil, nil, errMalformedCBOR
+}
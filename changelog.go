@@ -0,0 +1,386 @@
+package separation
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/oralordos/separation/internal/clock"
+)
+
+// Action Layer
+type ChangeOp string
+
+const (
+	ChangeSave   ChangeOp = "save"
+	ChangeDelete ChangeOp = "delete"
+)
+
+// Change is one mutation recorded in the change log.
+type Change struct {
+	Seq    uint64    `json:"seq"`
+	Time   time.Time `json:"time"`
+	Op     ChangeOp  `json:"op"`
+	User   *User     `json:"user,omitempty"`
+	Emails []Email   `json:"emails,omitempty"`
+}
+
+type ChangeLog interface {
+	// Append assigns the next sequence number to c and durably records it.
+	Append(ctx context.Context, c *Change) error
+	// Replay calls fn for every change with a sequence number after afterSeq, in order.
+	Replay(ctx context.Context, afterSeq uint64, fn func(*Change) error) error
+}
+
+// FileChangeLog is an append-only change log stored as JSON lines.
+type FileChangeLog struct {
+	path string
+
+	mu   sync.Mutex
+	file *os.File
+	seq  uint64
+}
+
+// OpenFileChangeLog opens the log at path, creating it if needed. A last line torn by
+// a crash during an append is truncated, as its change was never acknowledged.
+func OpenFileChangeLog(path string) (*FileChangeLog, error) {
+	fl := &FileChangeLog{
+		path: path,
+	}
+
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	// Find the last sequence number so appends continue from it.
+	complete, err := readChanges(context.Background(), f, 0, func(c *Change) error {
+		fl.seq = c.Seq
+		return nil
+	})
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	err = f.Truncate(complete)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	fl.file = f
+	return fl, nil
+}
+
+func (fl *FileChangeLog) Append(ctx context.Context, c *Change) error {
+	fl.mu.Lock()
+	defer fl.mu.Unlock()
+
+	c.Seq = fl.seq + 1
+	line, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+
+	_, err = fl.file.Write(append(line, '\n'))
+	if err != nil {
+		return err
+	}
+
+	err = fl.file.Sync()
+	if err != nil {
+		return err
+	}
+	fl.seq = c.Seq
+	return nil
+}
+
+func (fl *FileChangeLog) Replay(ctx context.Context, afterSeq uint64, fn func(*Change) error) error {
+	f, err := os.Open(fl.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return replayChanges(ctx, f, afterSeq, fn)
+}
+
+func (fl *FileChangeLog) Close() error {
+	fl.mu.Lock()
+	defer fl.mu.Unlock()
+	return fl.file.Close()
+}
+
+func replayChanges(ctx context.Context, r io.Reader, afterSeq uint64, fn func(*Change) error) error {
+	_, err := readChanges(ctx, r, afterSeq, fn)
+	return err
+}
+
+// readChanges calls fn for every change after afterSeq, returning the length of the
+// complete lines read. A last line without its newline is torn, by a crash or by an
+// append still being written, and is skipped.
+func readChanges(ctx context.Context, r io.Reader, afterSeq uint64, fn func(*Change) error) (int64, error) {
+	br := bufio.NewReader(r)
+	var complete int64
+	for {
+		if ctx.Err() != nil {
+			return complete, ctx.Err()
+		}
+
+		line, err := br.ReadBytes('\n')
+		if err == io.EOF {
+			return complete, nil
+		} else if err != nil {
+			return complete, err
+		}
+		complete += int64(len(line))
+
+		c := &Change{}
+		err = json.Unmarshal(line, c)
+		if err != nil {
+			return complete, fmt.Errorf("Corrupt change log entry: %v", err)
+		}
+		if c.Seq <= afterSeq {
+			continue
+		}
+
+		err = fn(c)
+		if err != nil {
+			return complete, err
+		}
+	}
+}
+
+// ChangeLogger is a UserStorer decorator that records every mutation in a change log
+// once it has been applied. Mutations are applied and recorded one at a time, so the
+// log holds them in the order storage applied them, and a refused mutation is never recorded.
+type ChangeLogger struct {
+	next  UserStorer
+	log   ChangeLog
+	clock clock.Clock
+
+	mu sync.Mutex
+}
+
+func NewChangeLogger(next UserStorer, log ChangeLog, clk clock.Clock) *ChangeLogger {
+	return &ChangeLogger{
+		next:  next,
+		log:   log,
+		clock: clk,
+	}
+}
+
+func (cl *ChangeLogger) Get(ctx context.Context, email Email) (*User, error) {
+	return cl.next.Get(ctx, email)
+}
+
+func (cl *ChangeLogger) GetByUsername(ctx context.Context, username Username) (*User, error) {
+	return cl.next.GetByUsername(ctx, username)
+}
+
+func (cl *ChangeLogger) List(ctx context.Context, sel LabelSelector) ([]*User, error) {
+	return cl.next.List(ctx, sel)
+}
+
+func (cl *ChangeLogger) ListFiltered(ctx context.Context, sel LabelSelector, f Filter) ([]*User, error) {
+	return listFiltered(ctx, cl.next, sel, f)
+}
+
+func (cl *ChangeLogger) Save(ctx context.Context, user *User) error {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	err := cl.next.Save(ctx, user)
+	if err != nil {
+		return err
+	}
+	return cl.log.Append(ctx, &Change{
+		Time: cl.clock.Now().UTC(),
+		Op:   ChangeSave,
+		User: user,
+	})
+}
+
+func (cl *ChangeLogger) Insert(ctx context.Context, user *User) error {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	err := cl.next.Insert(ctx, user)
+	if err != nil {
+		return err
+	}
+	// Replay applies it as a save, as nothing could have taken the email before it
+	return cl.log.Append(ctx, &Change{
+		Time: cl.clock.Now().UTC(),
+		Op:   ChangeSave,
+		User: user,
+	})
+}
+
+func (cl *ChangeLogger) Delete(ctx context.Context, emails []Email) (int, error) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	n, err := cl.next.Delete(ctx, emails)
+	if n == 0 {
+		return n, err
+	}
+	deleted := emails
+	if err != nil {
+		// Only the users the failed delete reached are recorded
+		deleted = nil
+		for _, email := range emails {
+			_, getErr := cl.next.Get(ctx, email)
+			if getErr == ErrUserNotFound {
+				deleted = append(deleted, email)
+			}
+		}
+	}
+	appendErr := cl.log.Append(ctx, &Change{
+		Time:   cl.clock.Now().UTC(),
+		Op:     ChangeDelete,
+		Emails: deleted,
+	})
+	if err == nil {
+		err = appendErr
+	}
+	return n, err
+}
+
+// ApplyChange replays a single change onto us.
+func ApplyChange(ctx context.Context, us UserStorer, c *Change) error {
+	switch c.Op {
+	case ChangeSave:
+		if c.User == nil {
+			return fmt.Errorf("Change %d saves no user", c.Seq)
+		}
+		err := us.Save(ctx, c.User)
+		if errors.Is(err, ErrUsernameTaken) {
+			// Logs written before saves were recorded after applying them may hold refused saves
+			return nil
+		}
+		return err
+	case ChangeDelete:
+		_, err := us.Delete(ctx, c.Emails)
+		return err
+	}
+	return fmt.Errorf("Change %d has unknown op %q", c.Seq, c.Op)
+}
+
+// RecoverFromChangeLog rebuilds us from every change in log, stopping after
+// untilSeq or untilTime when they are not zero, for point-in-time recovery.
+func RecoverFromChangeLog(ctx context.Context, log ChangeLog, us UserStorer, untilSeq uint64, untilTime time.Time) (uint64, error) {
+	var last uint64
+	errStop := errors.New("stop")
+	err := log.Replay(ctx, 0, func(c *Change) error {
+		if untilSeq != 0 && c.Seq > untilSeq {
+			return errStop
+		}
+		if !untilTime.IsZero() && c.Time.After(untilTime) {
+			return errStop
+		}
+
+		err := ApplyChange(ctx, us, c)
+		if err != nil {
+			return err
+		}
+		last = c.Seq
+		return nil
+	})
+	if err == errStop {
+		err = nil
+	}
+	return last, err
+}
+
+// Access Layer
+// Changes serves GET /changes?after=<seq> so downstream consumers can follow the change log.
+func (a *AdminHTTP) Changes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, NewMethodError("Changes requires a get request"))
+		return
+	}
+
+	var after uint64
+	if s := r.FormValue("after"); s != "" {
+		var err error
+		after, err = strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			writeError(w, r, NewValidationError("After must be a sequence number"))
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	enc := json.NewEncoder(w)
+	err := a.changes.Replay(r.Context(), after, func(c *Change) error {
+		return enc.Encode(c)
+	})
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+}
+
+// runReplayChangeLog implements `separation replay-changelog`, which rebuilds the
+// users as of a point in time and writes them out as a backup archive
+// that `separation restore` can load.
+func runReplayChangeLog(args []string) error {
+	fs := flag.NewFlagSet("replay-changelog", flag.ExitOnError)
+	logPath := fs.String("log", os.Getenv("CHANGE_LOG"), "change log to replay, defaults to $CHANGE_LOG")
+	untilSeq := fs.Uint64("until-seq", 0, "stop after this sequence number")
+	until := fs.String("until", "", "stop after changes made at this RFC 3339 time")
+	out := fs.String("o", "", "file to write the archive to, defaults to stdout")
+	fs.Parse(args)
+
+	if *logPath == "" {
+		return errors.New("-log or CHANGE_LOG must be set")
+	}
+
+	var untilTime time.Time
+	if *until != "" {
+		var err error
+		untilTime, err = time.Parse(time.RFC3339, *until)
+		if err != nil {
+			return errors.New("-until must be an RFC 3339 time")
+		}
+	}
+
+	ctx := context.Background()
+	us := NewMemoryUserStorage()
+	last, err := RecoverFromChangeLog(ctx, &FileChangeLog{path: *logPath}, us, *untilSeq, untilTime)
+	if err != nil {
+		return err
+	}
+
+	users, err := us.List(ctx, LabelSelector{})
+	if err != nil {
+		return err
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Email.String() < users[j].Email.String()
+	})
+
+	var w io.Writer = os.Stdout
+	if *out != "" {
+		f, err := os.Create(*out)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	fmt.Fprintf(os.Stderr, "Replayed through change %d: %d users\n", last, len(users))
+	return WriteBackup(w, users, time.Time{})
+}
@@ -0,0 +1,93 @@
+package separation
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/oralordos/separation/internal/clock"
+)
+
+func TestFileChangeLogTruncatesTornLine(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "changes.log")
+
+	log, err := OpenFileChangeLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	email, _ := ParseEmail("a@example.com")
+	err = log.Append(ctx, &Change{Op: ChangeSave, User: &User{Email: email}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	log.Close()
+
+	// A crash partway through the second append
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"seq":2,"op":"sa`)
+	f.Close()
+
+	log, err = OpenFileChangeLog(path)
+	if err != nil {
+		t.Fatalf("Opening a log with a torn line: %v", err)
+	}
+	defer log.Close()
+	err = log.Append(ctx, &Change{Op: ChangeDelete, Emails: []Email{email}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var seqs []uint64
+	err = log.Replay(ctx, 0, func(c *Change) error {
+		seqs = append(seqs, c.Seq)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(seqs) != 2 || seqs[0] != 1 || seqs[1] != 2 {
+		t.Errorf("Replayed %v, want [1 2]", seqs)
+	}
+}
+
+func TestChangeLoggerSkipsRefusedSaves(t *testing.T) {
+	ctx := context.Background()
+	log, err := OpenFileChangeLog(filepath.Join(t.TempDir(), "changes.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+	cl := NewChangeLogger(NewMemoryUserStorage(), log, clock.Real)
+
+	a, _ := ParseEmail("a@example.com")
+	b, _ := ParseEmail("b@example.com")
+	name, err := ParseUsername("taken")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cl.Save(ctx, &User{Email: a, Username: name})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cl.Save(ctx, &User{Email: b, Username: name})
+	if err != ErrUsernameTaken {
+		t.Fatalf("Saving a taken username returned %v", err)
+	}
+
+	count := 0
+	err = log.Replay(ctx, 0, func(c *Change) error {
+		count++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("Logged %d changes, want only the accepted save", count)
+	}
+}
@@ -0,0 +1,165 @@
+package separation
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/oralordos/separation/internal/ctxkeys"
+)
+
+// Access Layer
+// TrustedProxies are the networks whose forwarding headers are believed.
+type TrustedProxies []*net.IPNet
+
+// ParseTrustedProxies reads comma separated CIDRs or bare IP addresses.
+func ParseTrustedProxies(s string) (TrustedProxies, error) {
+	var tp TrustedProxies
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		if !strings.Contains(part, "/") {
+			ip := net.ParseIP(part)
+			if ip == nil {
+				return nil, fmt.Errorf("%q is not an IP address or CIDR", part)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			tp = append(tp, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, n, err := net.ParseCIDR(part)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not an IP address or CIDR", part)
+		}
+		tp = append(tp, n)
+	}
+	return tp, nil
+}
+
+func (tp TrustedProxies) Contains(ip net.IP) bool {
+	for _, n := range tp {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseHop reads one address from a forwarding header, which may be quoted,
+// bracketed, or carry a port, as in "[2001:db8::17]:4711".
+func parseHop(s string) net.IP {
+	s = strings.Trim(strings.TrimSpace(s), `"`)
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	}
+	return net.ParseIP(strings.Trim(s, "[]"))
+}
+
+// forwardedFor lists the for= addresses of a Forwarded header (RFC 7239), nearest the client first.
+// An address that cannot be read, such as an obfuscated identifier, is kept as nil.
+func forwardedFor(header []string) []net.IP {
+	var hops []net.IP
+	for _, h := range header {
+		for _, elem := range strings.Split(h, ",") {
+			for _, pair := range strings.Split(elem, ";") {
+				k, v, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if ok && strings.EqualFold(k, "for") {
+					hops = append(hops, parseHop(v))
+				}
+			}
+		}
+	}
+	return hops
+}
+
+func xForwardedFor(header []string) []net.IP {
+	var hops []net.IP
+	for _, h := range header {
+		for _, v := range strings.Split(h, ",") {
+			hops = append(hops, parseHop(v))
+		}
+	}
+	return hops
+}
+
+// ClientIP works out the address of the client that made r. Forwarding headers are
+// only believed when they come from a trusted proxy, and are read from the proxy
+// nearest us outwards, stopping at the first address that is not a trusted proxy,
+// so a client cannot spoof its address by sending the headers itself.
+// Forwarded is preferred over X-Forwarded-For, which is preferred over X-Real-IP.
+func ClientIP(r *http.Request, trusted TrustedProxies) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	peer := net.ParseIP(host)
+	if peer == nil || !trusted.Contains(peer) {
+		return peer
+	}
+
+	var hops []net.IP
+	switch {
+	case len(r.Header.Values("Forwarded")) > 0:
+		hops = forwardedFor(r.Header.Values("Forwarded"))
+	case len(r.Header.Values("X-Forwarded-For")) > 0:
+		hops = xForwardedFor(r.Header.Values("X-Forwarded-For"))
+	case r.Header.Get("X-Real-IP") != "":
+		hops = []net.IP{parseHop(r.Header.Get("X-Real-IP"))}
+	}
+
+	client := peer
+	for i := len(hops) - 1; i >= 0; i-- {
+		if hops[i] == nil {
+			// The proxies cannot vouch for anything beyond an address they could not read
+			break
+		}
+		client = hops[i]
+		if !trusted.Contains(client) {
+			break
+		}
+	}
+	return client
+}
+
+var clientIPKey = ctxkeys.New[net.IP]("client ip")
+
+// clientIPFromRequest returns the address the ClientIP middleware resolved, falling back
+// to the connection's peer address when the middleware is not in the stack.
+func clientIPFromRequest(r *http.Request) string {
+	if ip, ok := clientIPKey.From(r.Context()); ok && ip != nil {
+		return ip.String()
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// clientIPFromContext returns the address the ClientIP middleware resolved for the request
+// ctx belongs to, or an empty string outside of a request.
+func clientIPFromContext(ctx context.Context) string {
+	if ip, ok := clientIPKey.From(ctx); ok && ip != nil {
+		return ip.String()
+	}
+	return ""
+}
+
+// WithClientIP resolves each request's client address once, for everything further in to use.
+func WithClientIP(next http.Handler, trusted TrustedProxies) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := ClientIP(r, trusted)
+		next.ServeHTTP(w, r.WithContext(clientIPKey.With(r.Context(), ip)))
+	})
+}
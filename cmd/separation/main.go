@@ -0,0 +1,36 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/oralordos/separation"
+)
+
+func main() {
+	if len(os.Args) > 1 {
+		err := separation.RunCommand(os.Args[1], os.Args[2:])
+		if errors.Is(err, separation.ErrUnknownCommand) {
+			fmt.Fprintf(os.Stderr, "%v\nUsage: separation [backup|restore|replay-changelog|replay-recording|check|dev|rebuild-projections] [flags]\n", err)
+			os.Exit(2)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	err := separation.New().Run(ctx)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
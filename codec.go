@@ -0,0 +1,198 @@
+package separation
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// Access Layer
+// Codec translates between the wire and the types passed to the business logic.
+type Codec interface {
+	ContentType() string
+	DecodeRegisterParams(r io.Reader, params *RegisterParams) error
+	EncodeUser(w io.Writer, u *User) error
+	EncodePublicUser(w io.Writer, u *PublicUser) error
+}
+
+const protobufContentType = "application/x-protobuf"
+
+// requestCodec picks the codec for the request body from its Content-Type.
+func requestCodec(r *http.Request) Codec {
+	mt, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err == nil && mt == protobufContentType {
+		return protobufCodec{}
+	}
+	return jsonCodec{}
+}
+
+// responseCodec picks the codec for the response from the Accept header.
+func responseCodec(r *http.Request) Codec {
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mt, _, err := mime.ParseMediaType(strings.TrimSpace(accept))
+		if err == nil && mt == protobufContentType {
+			return protobufCodec{}
+		}
+	}
+	return jsonCodec{}
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) ContentType() string {
+	return "application/json"
+}
+
+func (jsonCodec) DecodeRegisterParams(r io.Reader, params *RegisterParams) error {
+	return json.NewDecoder(r).Decode(params)
+}
+
+func (jsonCodec) EncodeUser(w io.Writer, u *User) error {
+	return json.NewEncoder(w).Encode(u)
+}
+
+func (jsonCodec) EncodePublicUser(w io.Writer, u *PublicUser) error {
+	return json.NewEncoder(w).Encode(u)
+}
+
+// protobufCodec implements the messages in proto/separation.proto.
+// They only hold strings, so the wire format is encoded directly rather than
+// pulling in generated code.
+type protobufCodec struct{}
+
+func (protobufCodec) ContentType() string {
+	return protobufContentType
+}
+
+func (protobufCodec) DecodeRegisterParams(r io.Reader, params *RegisterParams) error {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	var email, username, phone string
+	err = decodeProtoStrings(b, map[uint64]*string{
+		1: &email,
+		2: &params.Name,
+		3: &username,
+		4: &params.AcceptTerms,
+		5: &params.InviteToken,
+		6: &params.ReferralCode,
+		7: &params.CaptchaToken,
+		8: &phone,
+	})
+	if err != nil {
+		return err
+	}
+
+	// proto3 cannot tell a missing field from an empty one, so leave
+	// the zero Email for RegisterParams.Validate to report.
+	if email != "" {
+		params.Email, err = ParseEmail(email)
+		if err != nil {
+			return err
+		}
+	}
+	if username != "" {
+		params.Username, err = ParseUsername(username)
+		if err != nil {
+			return err
+		}
+	}
+	if phone != "" {
+		params.Phone, err = ParsePhone(phone)
+	}
+	return err
+}
+
+func (protobufCodec) EncodeUser(w io.Writer, u *User) error {
+	var b []byte
+	b = appendProtoString(b, 1, u.Email.String())
+	b = appendProtoString(b, 2, u.Name)
+	b = appendProtoString(b, 3, u.Username.String())
+	_, err := w.Write(b)
+	return err
+}
+
+func (protobufCodec) EncodePublicUser(w io.Writer, u *PublicUser) error {
+	var b []byte
+	b = appendProtoString(b, 1, u.Email.String())
+	b = appendProtoString(b, 3, u.Username.String())
+	b = appendProtoString(b, 4, u.AvatarID)
+	_, err := w.Write(b)
+	return err
+}
+
+const (
+	protoVarint  = 0
+	protoFixed64 = 1
+	protoBytes   = 2
+	protoFixed32 = 5
+)
+
+var errMalformedProto = errors.New("Malformed protobuf message")
+
+func appendProtoString(b []byte, field uint64, s string) []byte {
+	// proto3 does not encode default values
+	if s == "" {
+		return b
+	}
+	b = appendUvarint(b, field<<3|protoBytes)
+	b = appendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], v)
+	return append(b, buf[:n]...)
+}
+
+// decodeProtoStrings reads string fields into fields by field number.
+// Unknown fields are skipped so older servers accept newer clients.
+func decodeProtoStrings(b []byte, fields map[uint64]*string) error {
+	for len(b) > 0 {
+		key, n := binary.Uvarint(b)
+		if n <= 0 {
+			return errMalformedProto
+		}
+		b = b[n:]
+
+		field, wire := key>>3, key&7
+		switch wire {
+		case protoVarint:
+			_, n = binary.Uvarint(b)
+			if n <= 0 {
+				return errMalformedProto
+			}
+			b = b[n:]
+		case protoFixed64:
+			if len(b) < 8 {
+				return errMalformedProto
+			}
+			b = b[8:]
+		case protoFixed32:
+			if len(b) < 4 {
+				return errMalformedProto
+			}
+			b = b[4:]
+		case protoBytes:
+			l, n := binary.Uvarint(b)
+			if n <= 0 || l > uint64(len(b)-n) {
+				return errMalformedProto
+			}
+			b = b[n:]
+			if dst, ok := fields[field]; ok {
+				*dst = string(b[:l])
+			}
+			b = b[l:]
+		default:
+			return errMalformedProto
+		}
+	}
+	return nil
+}
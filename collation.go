@@ -0,0 +1,67 @@
+package separation
+
+import (
+	"sort"
+	"sync"
+
+	"golang.org/x/text/collate"
+	"golang.org/x/text/language"
+)
+
+// Business Logic
+type lockedCollator struct {
+	mu sync.Mutex
+	c  *collate.Collator
+}
+
+// CollatorCache hands out a collator for the supported locale best matching a request.
+// Building a collator is expensive, so one is kept per locale. A collator is not safe
+// for concurrent use, so each is locked while it sorts.
+type CollatorCache struct {
+	tags    []language.Tag
+	matcher language.Matcher
+
+	mu        sync.Mutex
+	collators map[int]*lockedCollator
+}
+
+// NewCollatorCache returns a cache that falls back to fallback
+// when none of the requested locales are supported.
+func NewCollatorCache(fallback language.Tag) *CollatorCache {
+	// A matcher picks its first tag when nothing matches
+	tags := append([]language.Tag{fallback}, collate.Supported()...)
+	return &CollatorCache{
+		tags:      tags,
+		matcher:   language.NewMatcher(tags),
+		collators: map[int]*lockedCollator{},
+	}
+}
+
+func (cc *CollatorCache) get(langs []language.Tag) *lockedCollator {
+	_, i, _ := cc.matcher.Match(langs...)
+
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	lc, ok := cc.collators[i]
+	if !ok {
+		lc = &lockedCollator{c: collate.New(cc.tags[i])}
+		cc.collators[i] = lc
+	}
+	return lc
+}
+
+// SortByName orders users by name for the best match of langs, most preferred first.
+// Users with names that collate equally are ordered by email.
+func (cc *CollatorCache) SortByName(users []*User, langs []language.Tag) {
+	lc := cc.get(langs)
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	sort.Slice(users, func(i, j int) bool {
+		c := lc.c.CompareString(users[i].Name, users[j].Name)
+		if c != 0 {
+			return c < 0
+		}
+		return users[i].Email.String() < users[j].Email.String()
+	})
+}
@@ -0,0 +1,1064 @@
+package separation
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/oralordos/separation/internal/clock"
+	"golang.org/x/text/language"
+)
+
+// Config holds the settings used to wire the program together.
+// All values are read from the environment.
+type Config struct {
+	Port string
+	// Listen overrides Port with tcp://host:port, unix:///path/to.sock or systemd.
+	Listen string
+
+	// AdminPort is the port the admin router listens on.
+	// The admin router is disabled when it is empty.
+	AdminPort  string
+	AdminToken string
+	// BulkDeleteKey signs the confirmation tokens of bulk deletes, so every instance sharing
+	// it accepts the tokens of the others. A random key per process is used when it is empty.
+	BulkDeleteKey string
+
+	// Secrets looks up the settings given as secret:NAME rather than in plain text.
+	Secrets SecretsProvider
+
+	// DebugEndpoints mounts pprof and expvar under /debug on the admin router.
+	DebugEndpoints bool
+
+	// AccessLog is "stdout", "stderr", "syslog", or a file path.
+	// Access logging is disabled when it is empty.
+	AccessLog        string
+	AccessLogFormat  AccessLogFormat
+	AccessLogMaxSize int64
+	AccessLogMaxAge  time.Duration
+
+	// RecordFile is "stdout", "stderr", or a file path that every exchange with the JSON
+	// access layer is written to, for replaying later. Nothing is recorded when it is empty.
+	RecordFile string
+
+	// ContentSecurityPolicy is sent with every response from the JSON access layer.
+	// The header is left out when it is empty.
+	ContentSecurityPolicy string
+
+	// TrustedProxies are the proxies whose Forwarded, X-Forwarded-For and X-Real-IP headers are believed.
+	TrustedProxies TrustedProxies
+
+	// MaintenanceStateFile persists maintenance mode across restarts.
+	// The state is only kept in memory when it is empty.
+	MaintenanceStateFile  string
+	MaintenanceMessage    string
+	MaintenanceRetryAfter int
+
+	// RegistrationPolicyFile persists the registration policy set through the admin API.
+	// The policy is only kept in memory when it is empty.
+	RegistrationPolicyFile string
+
+	// IPRulesFile persists the IP rules set through the admin API.
+	// The rules are only kept in memory when it is empty.
+	IPRulesFile string
+
+	// SlowQueryThreshold records storage calls slower than it. Zero disables recording.
+	SlowQueryThreshold time.Duration
+	SlowQueryLogSize   int
+
+	// Storage is the registered name of the user storage driver.
+	Storage string
+	// StorageDSN is passed to the storage driver to tell it where to connect.
+	StorageDSN string
+
+	// StorageCallLog is "stdout", "stderr", "syslog", or a file path that every storage call is logged to.
+	// Storage calls are not logged when it is empty.
+	StorageCallLog string
+	// StorageMetrics counts storage calls, errors and time spent per store and operation in expvar.
+	StorageMetrics bool
+	// StorageSnapshotEvery is how many events the eventsourced storage driver records between snapshots.
+	StorageSnapshotEvery int
+	// StorageCacheTTL is how long users read from storage are kept in memory. Zero disables the cache.
+	StorageCacheTTL time.Duration
+	// ResponseCacheTTL is how long admin user listings are kept in memory. Zero disables the cache.
+	ResponseCacheTTL time.Duration
+	// ResponseCacheControl is the Cache-Control header of cached listings.
+	ResponseCacheControl string
+	// StorageWriteBehind acknowledges saves before they are written to storage, and writes them
+	// every StorageWriteBehindInterval or once StorageWriteBehindBatch are pending. Saves not yet
+	// written are lost if the process dies without shutting down.
+	StorageWriteBehind         bool
+	StorageWriteBehindInterval time.Duration
+	StorageWriteBehindBatch    int
+	// StorageCacheWarm is how many of the most recently seen users are loaded into the cache
+	// before serving, within StorageCacheWarmBudget. Zero disables warming.
+	StorageCacheWarm       int
+	StorageCacheWarmBudget time.Duration
+	// StorageCacheInvalidation shares saves and deletes with the caches of other instances
+	// through Redis. While they cannot be received, cached users are served for at most
+	// StorageCacheStaleness.
+	StorageCacheInvalidation bool
+	StorageCacheStaleness    time.Duration
+	// StorageBloomCapacity sizes a bloom filter that answers lookups of unregistered emails
+	// without reaching storage, to hold that many users at StorageBloomFalsePositiveRate.
+	// Zero disables the filter. It is rebuilt every StorageBloomRebuildInterval.
+	StorageBloomCapacity          int
+	StorageBloomFalsePositiveRate float64
+	StorageBloomRebuildInterval   time.Duration
+
+	// MemoryShards splits the in-memory user storage into this many independently locked shards.
+	MemoryShards int
+
+	// ChangeLog is the path of the append-only change log.
+	// Users are recovered from it on boot. Nothing is recorded when it is empty.
+	ChangeLog string
+
+	// DefaultLocale is used to sort names when a request's Accept-Language has no supported locale.
+	DefaultLocale language.Tag
+
+	// BlobStore is memory, file:///path/to/dir or s3://bucket?region=...&endpoint=...
+	BlobStore string
+	// AvatarMaxSize is the largest avatar upload accepted, in bytes.
+	AvatarMaxSize int64
+
+	// InviteOnly requires an invite token to register.
+	InviteOnly bool
+	// InviteTTL is how long invites last unless they say otherwise.
+	InviteTTL time.Duration
+
+	// EventLog is "stdout", "stderr", "syslog", or a file path that business events are written to.
+	// Events are not logged when it is empty.
+	EventLog string
+
+	// ActivityFlushInterval is how often the last seen times of users are saved.
+	ActivityFlushInterval time.Duration
+	// InactivityThreshold is how long a user must go unseen to be reported as inactive.
+	InactivityThreshold time.Duration
+	// StatsRefreshInterval is how often the admin stats are recomputed from every user,
+	// which is when deleted users stop being counted.
+	StatsRefreshInterval time.Duration
+
+	// DetectRegistrationsPerIP alerts when more users than it register from one IP address
+	// within DetectRegistrationsWindow. Zero disables the rule.
+	DetectRegistrationsPerIP  int
+	DetectRegistrationsWindow time.Duration
+	// DetectSpikeMultipliers alert when the registrations of a minute pass each of them times the
+	// average a minute over DetectSpikeBaseline, with at least DetectSpikeMin registrations.
+	// The rule is disabled when there are none.
+	DetectSpikeMultipliers []float64
+	DetectSpikeBaseline    time.Duration
+	DetectSpikeMin         int
+
+	// RiskThresholds act on registrations by the sum of their risk scores. Registrations are
+	// only scored when one is set.
+	RiskThresholds RiskThresholds
+	// RiskVelocityPerIP is how many registrations from one IP address within RiskVelocityWindow
+	// give the most suspicious velocity score.
+	RiskVelocityPerIP  int
+	RiskVelocityWindow time.Duration
+	// CaptchaVerifyURL is the siteverify endpoint captchas are checked with, using CaptchaSecret.
+	CaptchaVerifyURL string
+	CaptchaSecret    string
+	// SMTPAddr is the host:port of the SMTP server notifications are emailed through, from SMTPFrom.
+	// Notifications are not emailed when it is empty.
+	SMTPAddr     string
+	SMTPFrom     string
+	SMTPUsername string
+	SMTPPassword string
+	// NotifyWebhook is a URL every notification is posted to as JSON, unless the user turned it off.
+	NotifyWebhook string
+	// NotifyMaxAttempts is how many times a notification is tried before it is dropped, waiting
+	// NotifyRetryBackoff before the first retry and twice as long before each after.
+	NotifyMaxAttempts  int
+	NotifyRetryBackoff time.Duration
+	// NotifySuppressWindow drops repeats of a notification to the same user within it.
+	NotifySuppressWindow time.Duration
+	// TwilioAccountSID, TwilioAuthToken and TwilioFrom send text messages through Twilio.
+	TwilioAccountSID string
+	TwilioAuthToken  string
+	TwilioFrom       string
+	// PhoneCodeTTL is how long a phone verification code may be used, and PhoneCodeAttempts
+	// how many wrong codes are accepted before it is dropped. At most PhoneCodeLimit codes
+	// are sent to a number within PhoneCodeWindow.
+	PhoneCodeTTL      time.Duration
+	PhoneCodeAttempts int
+	PhoneCodeLimit    int
+	PhoneCodeWindow   time.Duration
+	// SessionKeys sign and encrypt the session cookies of users signed in with a magic link or
+	// passkey. The cookies hold the token of a server-side session, which ends once it goes
+	// unused for SessionTTL. Signing in is disabled without them.
+	SessionKeys [][]byte
+	SessionTTL  time.Duration
+	// SessionSameSite is the SameSite attribute of session cookies.
+	SessionSameSite http.SameSite
+	// LoginRedirect is where browsers are sent once signed in.
+	LoginRedirect string
+	// MagicLinkURL is the callback emailed sign-in links point at, valid for MagicLinkTTL.
+	// MagicLinkBinding is none, ip or device. At most MagicLinkLimit links are requested for
+	// an email, and MagicLinkIPLimit from an address, within MagicLinkWindow.
+	MagicLinkURL     string
+	MagicLinkTTL     time.Duration
+	MagicLinkBinding string
+	MagicLinkLimit   int
+	MagicLinkIPLimit int
+	MagicLinkWindow  time.Duration
+	// WebAuthnRPID is the domain passkeys are registered to, which disables them when empty.
+	// WebAuthnOrigins are the origins of the pages that may use them, and WebAuthnChallengeTTL
+	// how long a browser has to answer a challenge.
+	WebAuthnRPID         string
+	WebAuthnRPName       string
+	WebAuthnOrigins      []string
+	WebAuthnChallengeTTL time.Duration
+	// TemplatesDir holds files overriding the embedded notification templates, named like them.
+	TemplatesDir string
+
+	// ReviewSLA is how soon held registrations should be approved or rejected. Later decisions
+	// are counted as breaches in the registration_reviews expvar.
+	ReviewSLA time.Duration
+	// AlertLog is "stdout", "stderr", "syslog", or a file path that alerts are written to.
+	AlertLog string
+	// AlertWebhook is a URL alerts are posted to as JSON.
+	AlertWebhook string
+
+	// TermsVersion is the version of the terms of service every user must have accepted.
+	// No acceptance is required when it is empty.
+	TermsVersion string
+
+	// SeedFile is a JSON fixtures file of users registered on boot.
+	SeedFile string
+
+	// ErrorFormat writes error bodies for clients that do not ask for a format.
+	ErrorFormat ErrorWriter
+
+	// MaxRequestTimeout bounds how long a request may run, whatever timeout the client asks for.
+	MaxRequestTimeout time.Duration
+
+	// MTLSListen is the address of the listener that requires client certificates issued by MTLSClientCA.
+	MTLSListen   string
+	MTLSCertFile string
+	MTLSKeyFile  string
+	MTLSClientCA string
+	// MTLSRequiredPaths are the path prefixes only served to clients with a verified certificate.
+	MTLSRequiredPaths []string
+
+	// HTTP3Listen is the UDP address of the HTTP/3 transport, served by the
+	// github.com/oralordos/separation/http3 module when it is imported.
+	HTTP3Listen   string
+	HTTP3CertFile string
+	HTTP3KeyFile  string
+
+	// HMACKeys are the shared secrets of machine clients that sign their requests.
+	HMACKeys HMACKeys
+	// HMACAdminKeys are the IDs of the HMACKeys whose requests act as admins.
+	HMACAdminKeys []string
+	// HMACMaxSkew is how far a signed request's timestamp may be from the server's time.
+	HMACMaxSkew time.Duration
+
+	// ReplayProtectedPaths are the path prefixes whose requests must carry a fresh nonce and timestamp.
+	ReplayProtectedPaths []string
+	// ReplayWindow is how far a request timestamp may be from the server's time.
+	ReplayWindow time.Duration
+
+	// ConcurrencyLimits bound the requests of each route class running at once.
+	ConcurrencyLimits ConcurrencyLimits
+	// ConcurrencyQueueWait is how long a request over its class's limit waits before it is shed.
+	ConcurrencyQueueWait time.Duration
+	// PriorityWeights favour authenticated and admin callers over anonymous ones
+	// when requests queue or are shed.
+	PriorityWeights PriorityWeights
+
+	// RateLimits bound how many requests each authenticated caller may make, by tier.
+	RateLimits RateLimits
+	// RedisAddr is the Redis server instances share state through, such as rate limit
+	// counters. State is kept in memory, per instance, when it is empty.
+	RedisAddr     string
+	RedisPassword string
+	RedisDB       int
+	// LeaderTTL is how long the leader of a background task holds it without renewing,
+	// which bounds how long the task stops for when the leader dies.
+	LeaderTTL time.Duration
+
+	// BackpressureP95 and BackpressureErrorRate are the storage latency and error rate past
+	// which less critical requests start being shed. Zero disables either.
+	BackpressureP95       time.Duration
+	BackpressureErrorRate float64
+	// BackpressureWindow is how far back storage calls count towards the latency and error rate.
+	BackpressureWindow time.Duration
+
+	// Middleware lists the middleware wrapping the user facing access layer
+	// by registered name, outermost first.
+	Middleware []string
+
+	// Transports lists the access layers to start, by registered name.
+	Transports      []string
+	ShutdownTimeout time.Duration
+}
+
+func LoadConfig() (*Config, error) {
+	cfg := &Config{
+		Port:      os.Getenv("PORT"),
+		Listen:    os.Getenv("LISTEN"),
+		AdminPort: os.Getenv("ADMIN_PORT"),
+		AccessLog: os.Getenv("ACCESS_LOG"),
+		ChangeLog: os.Getenv("CHANGE_LOG"),
+
+		MaintenanceStateFile: os.Getenv("MAINTENANCE_STATE_FILE"),
+		MaintenanceMessage:   os.Getenv("MAINTENANCE_MESSAGE"),
+		SeedFile:             os.Getenv("SEED_FILE"),
+		TermsVersion:         os.Getenv("TERMS_VERSION"),
+		EventLog:             os.Getenv("EVENT_LOG"),
+		BlobStore:            os.Getenv("BLOB_STORE"),
+		AlertLog:             os.Getenv("ALERT_LOG"),
+		AlertWebhook:         os.Getenv("ALERT_WEBHOOK"),
+		CaptchaVerifyURL:     os.Getenv("CAPTCHA_VERIFY_URL"),
+		SMTPAddr:             os.Getenv("SMTP_ADDR"),
+		SMTPFrom:             os.Getenv("SMTP_FROM"),
+		SMTPUsername:         os.Getenv("SMTP_USERNAME"),
+		NotifyWebhook:        os.Getenv("NOTIFY_WEBHOOK"),
+		TemplatesDir:         os.Getenv("TEMPLATES_DIR"),
+		LoginRedirect:        os.Getenv("LOGIN_REDIRECT"),
+		MagicLinkURL:         os.Getenv("MAGIC_LINK_URL"),
+		MagicLinkBinding:     os.Getenv("MAGIC_LINK_BINDING"),
+		WebAuthnRPID:         os.Getenv("WEBAUTHN_RP_ID"),
+		WebAuthnRPName:       os.Getenv("WEBAUTHN_RP_NAME"),
+		TwilioAccountSID:     os.Getenv("TWILIO_ACCOUNT_SID"),
+		TwilioFrom:           os.Getenv("TWILIO_FROM"),
+		IPRulesFile:          os.Getenv("IP_RULES_FILE"),
+		MTLSListen:           os.Getenv("MTLS_LISTEN"),
+		MTLSCertFile:         os.Getenv("MTLS_CERT_FILE"),
+		MTLSKeyFile:          os.Getenv("MTLS_KEY_FILE"),
+		MTLSClientCA:         os.Getenv("MTLS_CLIENT_CA"),
+		HTTP3Listen:          os.Getenv("HTTP3_LISTEN"),
+		HTTP3CertFile:        os.Getenv("HTTP3_CERT_FILE"),
+		HTTP3KeyFile:         os.Getenv("HTTP3_KEY_FILE"),
+
+		RegistrationPolicyFile: os.Getenv("REGISTRATION_POLICY_FILE"),
+		Storage:                os.Getenv("STORAGE"),
+		RecordFile:             os.Getenv("RECORD_FILE"),
+		StorageCallLog:         os.Getenv("STORAGE_CALL_LOG"),
+	}
+
+	if cfg.Port == "" {
+		cfg.Port = "8080"
+	}
+	if cfg.Storage == "" {
+		cfg.Storage = "memory"
+	}
+
+	var err error
+	secrets, err := OpenSecretsProvider(os.Getenv("SECRETS_PROVIDER"), clock.Real)
+	if err != nil {
+		return nil, fmt.Errorf("SECRETS_PROVIDER: %v", err)
+	}
+	secretsTTL, err := envDuration("SECRETS_CACHE_TTL")
+	if err != nil {
+		return nil, err
+	}
+	if secretsTTL <= 0 {
+		secretsTTL = 5 * time.Minute
+	}
+	cfg.Secrets = NewCachingSecrets(secrets, secretsTTL, clock.Real)
+
+	cfg.AdminToken, err = envSecret(cfg.Secrets, "ADMIN_TOKEN")
+	if err != nil {
+		return nil, err
+	}
+	cfg.BulkDeleteKey, err = envSecret(cfg.Secrets, "BULK_DELETE_KEY")
+	if err != nil {
+		return nil, err
+	}
+	if cfg.BulkDeleteKey != "" && len(cfg.BulkDeleteKey) < 32 {
+		return nil, fmt.Errorf("BULK_DELETE_KEY must be at least 32 characters")
+	}
+	cfg.StorageDSN, err = envSecret(cfg.Secrets, "STORAGE_DSN")
+	if err != nil {
+		return nil, err
+	}
+
+	cfg.DebugEndpoints, err = envBool("DEBUG_ENDPOINTS")
+	if err != nil {
+		return nil, err
+	}
+
+	cfg.StorageMetrics, err = envBool("STORAGE_METRICS")
+	if err != nil {
+		return nil, err
+	}
+
+	snapshotEvery, err := envInt("STORAGE_SNAPSHOT_EVERY")
+	if err != nil {
+		return nil, err
+	}
+	cfg.StorageSnapshotEvery = int(snapshotEvery)
+	if cfg.StorageSnapshotEvery <= 0 {
+		cfg.StorageSnapshotEvery = 1000
+	}
+
+	cfg.StorageCacheTTL, err = envDuration("STORAGE_CACHE_TTL")
+	if err != nil {
+		return nil, err
+	}
+	cfg.ResponseCacheTTL, err = envDuration("RESPONSE_CACHE_TTL")
+	if err != nil {
+		return nil, err
+	}
+	cfg.ResponseCacheControl = os.Getenv("RESPONSE_CACHE_CONTROL")
+	if cfg.ResponseCacheControl == "" {
+		cfg.ResponseCacheControl = "private, no-cache"
+	}
+	cfg.StorageWriteBehind, err = envBool("STORAGE_WRITE_BEHIND")
+	if err != nil {
+		return nil, err
+	}
+	cfg.StorageWriteBehindInterval, err = envDuration("STORAGE_WRITE_BEHIND_INTERVAL")
+	if err != nil {
+		return nil, err
+	}
+	if cfg.StorageWriteBehindInterval <= 0 {
+		cfg.StorageWriteBehindInterval = time.Second
+	}
+	writeBehindBatch, err := envInt("STORAGE_WRITE_BEHIND_BATCH")
+	if err != nil {
+		return nil, err
+	}
+	cfg.StorageWriteBehindBatch = int(writeBehindBatch)
+	if cfg.StorageWriteBehindBatch <= 0 {
+		cfg.StorageWriteBehindBatch = 500
+	}
+
+	cacheWarm, err := envInt("STORAGE_CACHE_WARM")
+	if err != nil {
+		return nil, err
+	}
+	cfg.StorageCacheWarm = int(cacheWarm)
+	if cfg.StorageCacheWarm > 0 && cfg.StorageCacheTTL <= 0 {
+		return nil, errors.New("STORAGE_CACHE_WARM requires STORAGE_CACHE_TTL to be set")
+	}
+	cfg.StorageCacheWarmBudget, err = envDuration("STORAGE_CACHE_WARM_BUDGET")
+	if err != nil {
+		return nil, err
+	}
+	if cfg.StorageCacheWarmBudget <= 0 {
+		cfg.StorageCacheWarmBudget = 10 * time.Second
+	}
+
+	bloomCapacity, err := envInt("STORAGE_BLOOM_CAPACITY")
+	if err != nil {
+		return nil, err
+	}
+	cfg.StorageBloomCapacity = int(bloomCapacity)
+	cfg.StorageBloomFalsePositiveRate, err = envFloat("STORAGE_BLOOM_FALSE_POSITIVE_RATE")
+	if err != nil {
+		return nil, err
+	}
+	if cfg.StorageBloomFalsePositiveRate == 0 {
+		cfg.StorageBloomFalsePositiveRate = 0.01
+	}
+	if cfg.StorageBloomFalsePositiveRate <= 0 || cfg.StorageBloomFalsePositiveRate >= 1 {
+		return nil, errors.New("STORAGE_BLOOM_FALSE_POSITIVE_RATE must be between 0 and 1")
+	}
+	cfg.StorageBloomRebuildInterval, err = envDuration("STORAGE_BLOOM_REBUILD_INTERVAL")
+	if err != nil {
+		return nil, err
+	}
+	if cfg.StorageBloomRebuildInterval <= 0 {
+		cfg.StorageBloomRebuildInterval = time.Hour
+	}
+
+	cfg.InviteOnly, err = envBool("INVITE_ONLY")
+	if err != nil {
+		return nil, err
+	}
+
+	cfg.InviteTTL, err = envDuration("INVITE_TTL")
+	if err != nil {
+		return nil, err
+	}
+	if cfg.InviteTTL <= 0 {
+		cfg.InviteTTL = 7 * 24 * time.Hour
+	}
+
+	cfg.ActivityFlushInterval, err = envDuration("ACTIVITY_FLUSH_INTERVAL")
+	if err != nil {
+		return nil, err
+	}
+	if cfg.ActivityFlushInterval <= 0 {
+		cfg.ActivityFlushInterval = time.Minute
+	}
+
+	cfg.InactivityThreshold, err = envDuration("INACTIVITY_THRESHOLD")
+	if err != nil {
+		return nil, err
+	}
+	if cfg.InactivityThreshold <= 0 {
+		cfg.InactivityThreshold = 30 * 24 * time.Hour
+	}
+
+	cfg.StatsRefreshInterval, err = envDuration("STATS_REFRESH_INTERVAL")
+	if err != nil {
+		return nil, err
+	}
+	if cfg.StatsRefreshInterval <= 0 {
+		cfg.StatsRefreshInterval = time.Hour
+	}
+
+	perIP, err := envInt("DETECT_REGISTRATIONS_PER_IP")
+	if err != nil {
+		return nil, err
+	}
+	cfg.DetectRegistrationsPerIP = int(perIP)
+
+	cfg.DetectRegistrationsWindow, err = envDuration("DETECT_REGISTRATIONS_WINDOW")
+	if err != nil {
+		return nil, err
+	}
+	if cfg.DetectRegistrationsWindow <= 0 {
+		cfg.DetectRegistrationsWindow = 10 * time.Minute
+	}
+
+	cfg.DetectSpikeMultipliers, err = ParseSpikeMultipliers(os.Getenv("DETECT_SPIKE_MULTIPLIERS"))
+	if err != nil {
+		return nil, fmt.Errorf("DETECT_SPIKE_MULTIPLIERS: %v", err)
+	}
+
+	cfg.DetectSpikeBaseline, err = envDuration("DETECT_SPIKE_BASELINE")
+	if err != nil {
+		return nil, err
+	}
+	if cfg.DetectSpikeBaseline <= 0 {
+		cfg.DetectSpikeBaseline = time.Hour
+	}
+	if cfg.DetectSpikeBaseline < time.Minute {
+		return nil, fmt.Errorf("DETECT_SPIKE_BASELINE must be at least 1m")
+	}
+
+	spikeMin, err := envInt("DETECT_SPIKE_MIN")
+	if err != nil {
+		return nil, err
+	}
+	cfg.DetectSpikeMin = int(spikeMin)
+	if cfg.DetectSpikeMin <= 0 {
+		cfg.DetectSpikeMin = 10
+	}
+
+	for _, t := range []struct {
+		name      string
+		threshold *float64
+	}{
+		{"RISK_REVIEW_SCORE", &cfg.RiskThresholds.Review},
+		{"RISK_CAPTCHA_SCORE", &cfg.RiskThresholds.Captcha},
+		{"RISK_REJECT_SCORE", &cfg.RiskThresholds.Reject},
+	} {
+		*t.threshold, err = envFloat(t.name)
+		if err != nil {
+			return nil, err
+		}
+		if *t.threshold < 0 {
+			return nil, fmt.Errorf("%s cannot be negative", t.name)
+		}
+	}
+
+	velocity, err := envInt("RISK_VELOCITY_PER_IP")
+	if err != nil {
+		return nil, err
+	}
+	cfg.RiskVelocityPerIP = int(velocity)
+	if cfg.RiskVelocityPerIP <= 0 {
+		cfg.RiskVelocityPerIP = 5
+	}
+
+	cfg.RiskVelocityWindow, err = envDuration("RISK_VELOCITY_WINDOW")
+	if err != nil {
+		return nil, err
+	}
+	if cfg.RiskVelocityWindow <= 0 {
+		cfg.RiskVelocityWindow = time.Hour
+	}
+
+	cfg.CaptchaSecret, err = envSecret(cfg.Secrets, "CAPTCHA_SECRET")
+	if err != nil {
+		return nil, err
+	}
+	if cfg.RiskThresholds.Captcha > 0 && cfg.CaptchaVerifyURL == "" {
+		return nil, fmt.Errorf("RISK_CAPTCHA_SCORE requires CAPTCHA_VERIFY_URL")
+	}
+
+	if cfg.SMTPAddr != "" && cfg.SMTPFrom == "" {
+		return nil, fmt.Errorf("SMTP_ADDR requires SMTP_FROM")
+	}
+	cfg.SMTPPassword, err = envSecret(cfg.Secrets, "SMTP_PASSWORD")
+	if err != nil {
+		return nil, err
+	}
+
+	attempts, err := envInt("NOTIFY_MAX_ATTEMPTS")
+	if err != nil {
+		return nil, err
+	}
+	cfg.NotifyMaxAttempts = int(attempts)
+	if cfg.NotifyMaxAttempts <= 0 {
+		cfg.NotifyMaxAttempts = 5
+	}
+
+	cfg.NotifyRetryBackoff, err = envDuration("NOTIFY_RETRY_BACKOFF")
+	if err != nil {
+		return nil, err
+	}
+	if cfg.NotifyRetryBackoff <= 0 {
+		cfg.NotifyRetryBackoff = time.Second
+	}
+
+	cfg.NotifySuppressWindow, err = envDuration("NOTIFY_SUPPRESS_WINDOW")
+	if err != nil {
+		return nil, err
+	}
+	if cfg.NotifySuppressWindow <= 0 {
+		cfg.NotifySuppressWindow = time.Hour
+	}
+
+	if cfg.TwilioAccountSID != "" && cfg.TwilioFrom == "" {
+		return nil, fmt.Errorf("TWILIO_ACCOUNT_SID requires TWILIO_FROM")
+	}
+	cfg.TwilioAuthToken, err = envSecret(cfg.Secrets, "TWILIO_AUTH_TOKEN")
+	if err != nil {
+		return nil, err
+	}
+
+	cfg.PhoneCodeTTL, err = envDuration("PHONE_CODE_TTL")
+	if err != nil {
+		return nil, err
+	}
+	if cfg.PhoneCodeTTL <= 0 {
+		cfg.PhoneCodeTTL = 10 * time.Minute
+	}
+
+	codeAttempts, err := envInt("PHONE_CODE_ATTEMPTS")
+	if err != nil {
+		return nil, err
+	}
+	cfg.PhoneCodeAttempts = int(codeAttempts)
+	if cfg.PhoneCodeAttempts <= 0 {
+		cfg.PhoneCodeAttempts = 5
+	}
+
+	codeLimit, err := envInt("PHONE_CODE_LIMIT")
+	if err != nil {
+		return nil, err
+	}
+	cfg.PhoneCodeLimit = int(codeLimit)
+	if cfg.PhoneCodeLimit <= 0 {
+		cfg.PhoneCodeLimit = 3
+	}
+
+	cfg.PhoneCodeWindow, err = envDuration("PHONE_CODE_WINDOW")
+	if err != nil {
+		return nil, err
+	}
+	if cfg.PhoneCodeWindow <= 0 {
+		cfg.PhoneCodeWindow = time.Hour
+	}
+
+	sessionKeys, err := envSecret(cfg.Secrets, "SESSION_KEYS")
+	if err != nil {
+		return nil, err
+	}
+	cfg.SessionKeys, err = ParseSessionKeys(sessionKeys)
+	if err != nil {
+		return nil, fmt.Errorf("SESSION_KEYS: %v", err)
+	}
+	if len(cfg.SessionKeys) > 0 && cfg.MagicLinkURL == "" {
+		return nil, fmt.Errorf("SESSION_KEYS requires MAGIC_LINK_URL")
+	}
+
+	cfg.SessionTTL, err = envDuration("SESSION_TTL")
+	if err != nil {
+		return nil, err
+	}
+	if cfg.SessionTTL <= 0 {
+		cfg.SessionTTL = 7 * 24 * time.Hour
+	}
+
+	switch os.Getenv("SESSION_SAME_SITE") {
+	case "", "lax":
+		cfg.SessionSameSite = http.SameSiteLaxMode
+	case "strict":
+		cfg.SessionSameSite = http.SameSiteStrictMode
+	case "none":
+		cfg.SessionSameSite = http.SameSiteNoneMode
+	default:
+		return nil, fmt.Errorf("SESSION_SAME_SITE must be lax, strict or none")
+	}
+
+	cfg.MagicLinkTTL, err = envDuration("MAGIC_LINK_TTL")
+	if err != nil {
+		return nil, err
+	}
+	if cfg.MagicLinkTTL <= 0 {
+		cfg.MagicLinkTTL = 15 * time.Minute
+	}
+
+	switch cfg.MagicLinkBinding {
+	case "":
+		cfg.MagicLinkBinding = MagicLinkBindNone
+	case MagicLinkBindNone, MagicLinkBindIP, MagicLinkBindDevice:
+	default:
+		return nil, fmt.Errorf("MAGIC_LINK_BINDING must be none, ip or device")
+	}
+
+	linkLimit, err := envInt("MAGIC_LINK_LIMIT")
+	if err != nil {
+		return nil, err
+	}
+	cfg.MagicLinkLimit = int(linkLimit)
+	if cfg.MagicLinkLimit <= 0 {
+		cfg.MagicLinkLimit = 5
+	}
+
+	linkIPLimit, err := envInt("MAGIC_LINK_IP_LIMIT")
+	if err != nil {
+		return nil, err
+	}
+	cfg.MagicLinkIPLimit = int(linkIPLimit)
+	if cfg.MagicLinkIPLimit <= 0 {
+		cfg.MagicLinkIPLimit = 20
+	}
+
+	cfg.MagicLinkWindow, err = envDuration("MAGIC_LINK_WINDOW")
+	if err != nil {
+		return nil, err
+	}
+	if cfg.MagicLinkWindow <= 0 {
+		cfg.MagicLinkWindow = time.Hour
+	}
+
+	cfg.WebAuthnOrigins = parseNameList(os.Getenv("WEBAUTHN_ORIGINS"))
+	if cfg.WebAuthnRPID != "" {
+		if len(cfg.SessionKeys) == 0 {
+			return nil, fmt.Errorf("WEBAUTHN_RP_ID requires SESSION_KEYS")
+		}
+		if len(cfg.WebAuthnOrigins) == 0 {
+			return nil, fmt.Errorf("WEBAUTHN_RP_ID requires WEBAUTHN_ORIGINS")
+		}
+	}
+	if cfg.WebAuthnRPName == "" {
+		cfg.WebAuthnRPName = "separation"
+	}
+	cfg.WebAuthnChallengeTTL, err = envDuration("WEBAUTHN_CHALLENGE_TTL")
+	if err != nil {
+		return nil, err
+	}
+	if cfg.WebAuthnChallengeTTL <= 0 {
+		cfg.WebAuthnChallengeTTL = 5 * time.Minute
+	}
+
+	cfg.ReviewSLA, err = envDuration("REVIEW_SLA")
+	if err != nil {
+		return nil, err
+	}
+	if cfg.ReviewSLA <= 0 {
+		cfg.ReviewSLA = 24 * time.Hour
+	}
+
+	cfg.ContentSecurityPolicy = DefaultContentSecurityPolicy
+	if csp, ok := os.LookupEnv("CONTENT_SECURITY_POLICY"); ok {
+		cfg.ContentSecurityPolicy = csp
+	}
+
+	cfg.TrustedProxies, err = ParseTrustedProxies(os.Getenv("TRUSTED_PROXIES"))
+	if err != nil {
+		return nil, fmt.Errorf("TRUSTED_PROXIES must be comma separated CIDRs: %v", err)
+	}
+
+	cfg.AccessLogFormat, err = ParseAccessLogFormat(os.Getenv("ACCESS_LOG_FORMAT"))
+	if err != nil {
+		return nil, err
+	}
+
+	cfg.AccessLogMaxSize, err = envInt("ACCESS_LOG_MAX_SIZE")
+	if err != nil {
+		return nil, err
+	}
+
+	cfg.AccessLogMaxAge, err = envDuration("ACCESS_LOG_MAX_AGE")
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.MaintenanceMessage == "" {
+		cfg.MaintenanceMessage = "The service is down for maintenance"
+	}
+
+	retryAfter, err := envInt("MAINTENANCE_RETRY_AFTER")
+	if err != nil {
+		return nil, err
+	}
+	cfg.MaintenanceRetryAfter = int(retryAfter)
+	if cfg.MaintenanceRetryAfter == 0 {
+		cfg.MaintenanceRetryAfter = 300
+	}
+
+	cfg.SlowQueryThreshold, err = envDuration("SLOW_QUERY_THRESHOLD")
+	if err != nil {
+		return nil, err
+	}
+
+	slowSize, err := envInt("SLOW_QUERY_LOG_SIZE")
+	if err != nil {
+		return nil, err
+	}
+	cfg.SlowQueryLogSize = int(slowSize)
+	if cfg.SlowQueryLogSize <= 0 {
+		cfg.SlowQueryLogSize = 100
+	}
+
+	shards, err := envInt("MEMORY_SHARDS")
+	if err != nil {
+		return nil, err
+	}
+	cfg.MemoryShards = int(shards)
+
+	cfg.AvatarMaxSize, err = envInt("AVATAR_MAX_SIZE")
+	if err != nil {
+		return nil, err
+	}
+	if cfg.AvatarMaxSize <= 0 {
+		cfg.AvatarMaxSize = 5 << 20
+	}
+
+	cfg.ErrorFormat, err = ParseErrorFormat(os.Getenv("ERROR_FORMAT"))
+	if err != nil {
+		return nil, err
+	}
+
+	cfg.MaxRequestTimeout, err = envDuration("MAX_REQUEST_TIMEOUT")
+	if err != nil {
+		return nil, err
+	}
+	if cfg.MaxRequestTimeout == 0 {
+		cfg.MaxRequestTimeout = 30 * time.Second
+	}
+
+	cfg.DefaultLocale = language.English
+	if v := os.Getenv("DEFAULT_LOCALE"); v != "" {
+		cfg.DefaultLocale, err = language.Parse(v)
+		if err != nil {
+			return nil, fmt.Errorf("DEFAULT_LOCALE must be a BCP 47 language tag: %v", err)
+		}
+	}
+
+	cfg.MTLSRequiredPaths = parseNameList(os.Getenv("MTLS_REQUIRED_PATHS"))
+
+	hmacKeys, err := envSecret(cfg.Secrets, "HMAC_KEYS")
+	if err != nil {
+		return nil, err
+	}
+	cfg.HMACKeys, err = ParseHMACKeys(hmacKeys)
+	if err != nil {
+		return nil, fmt.Errorf("HMAC_KEYS: %v", err)
+	}
+	cfg.HMACAdminKeys = parseNameList(os.Getenv("HMAC_ADMIN_KEYS"))
+	for _, id := range cfg.HMACAdminKeys {
+		if _, ok := cfg.HMACKeys[id]; !ok {
+			return nil, fmt.Errorf("HMAC_ADMIN_KEYS: %q is not one of HMAC_KEYS", id)
+		}
+	}
+	cfg.HMACMaxSkew, err = envDuration("HMAC_MAX_SKEW")
+	if err != nil {
+		return nil, err
+	}
+	if cfg.HMACMaxSkew <= 0 {
+		cfg.HMACMaxSkew = 5 * time.Minute
+	}
+
+	cfg.ReplayProtectedPaths = parseNameList(os.Getenv("REPLAY_PROTECTED_PATHS"))
+	cfg.ReplayWindow, err = envDuration("REPLAY_WINDOW")
+	if err != nil {
+		return nil, err
+	}
+	if cfg.ReplayWindow <= 0 {
+		cfg.ReplayWindow = 5 * time.Minute
+	}
+
+	cfg.ConcurrencyLimits, err = ParseConcurrencyLimits(os.Getenv("CONCURRENCY_LIMITS"))
+	if err != nil {
+		return nil, fmt.Errorf("CONCURRENCY_LIMITS: %v", err)
+	}
+	cfg.ConcurrencyQueueWait, err = envDuration("CONCURRENCY_QUEUE_WAIT")
+	if err != nil {
+		return nil, err
+	}
+	if cfg.ConcurrencyQueueWait <= 0 {
+		cfg.ConcurrencyQueueWait = time.Second
+	}
+
+	cfg.PriorityWeights, err = ParsePriorityWeights(os.Getenv("CONCURRENCY_PRIORITY"))
+	if err != nil {
+		return nil, fmt.Errorf("CONCURRENCY_PRIORITY: %v", err)
+	}
+
+	cfg.RateLimits, err = ParseRateLimits(os.Getenv("RATE_LIMITS"))
+	if err != nil {
+		return nil, fmt.Errorf("RATE_LIMITS: %v", err)
+	}
+
+	cfg.RedisAddr = os.Getenv("REDIS_ADDR")
+	cfg.RedisPassword, err = envSecret(cfg.Secrets, "REDIS_PASSWORD")
+	if err != nil {
+		return nil, err
+	}
+	redisDB, err := envInt("REDIS_DB")
+	if err != nil {
+		return nil, err
+	}
+	cfg.RedisDB = int(redisDB)
+
+	cfg.StorageCacheInvalidation, err = envBool("STORAGE_CACHE_INVALIDATION")
+	if err != nil {
+		return nil, err
+	}
+	if cfg.StorageCacheInvalidation && (cfg.RedisAddr == "" || cfg.StorageCacheTTL <= 0) {
+		return nil, errors.New("STORAGE_CACHE_INVALIDATION requires REDIS_ADDR and STORAGE_CACHE_TTL to be set")
+	}
+	cfg.StorageCacheStaleness, err = envDuration("STORAGE_CACHE_STALENESS")
+	if err != nil {
+		return nil, err
+	}
+
+	cfg.LeaderTTL, err = envDuration("LEADER_TTL")
+	if err != nil {
+		return nil, err
+	}
+	if cfg.LeaderTTL <= 0 {
+		cfg.LeaderTTL = 15 * time.Second
+	}
+
+	cfg.BackpressureP95, err = envDuration("BACKPRESSURE_P95")
+	if err != nil {
+		return nil, err
+	}
+	cfg.BackpressureErrorRate, err = envFloat("BACKPRESSURE_ERROR_RATE")
+	if err != nil {
+		return nil, err
+	}
+	if cfg.BackpressureErrorRate < 0 || cfg.BackpressureErrorRate > 1 {
+		return nil, errors.New("BACKPRESSURE_ERROR_RATE must be between 0 and 1")
+	}
+	cfg.BackpressureWindow, err = envDuration("BACKPRESSURE_WINDOW")
+	if err != nil {
+		return nil, err
+	}
+	if cfg.BackpressureWindow <= 0 {
+		cfg.BackpressureWindow = 30 * time.Second
+	}
+
+	cfg.Middleware = parseNameList(os.Getenv("MIDDLEWARE"))
+	if len(cfg.Middleware) == 0 {
+		cfg.Middleware = DefaultMiddleware
+	}
+
+	cfg.Transports = parseNameList(os.Getenv("TRANSPORTS"))
+	if len(cfg.Transports) == 0 {
+		cfg.Transports = []string{"http"}
+		if cfg.AdminPort != "" {
+			cfg.Transports = append(cfg.Transports, "admin")
+		}
+		if cfg.MTLSListen != "" {
+			cfg.Transports = append(cfg.Transports, "mtls")
+		}
+		if cfg.HTTP3Listen != "" {
+			cfg.Transports = append(cfg.Transports, "http3")
+		}
+	}
+
+	cfg.ShutdownTimeout, err = envDuration("SHUTDOWN_TIMEOUT")
+	if err != nil {
+		return nil, err
+	}
+	if cfg.ShutdownTimeout == 0 {
+		cfg.ShutdownTimeout = 10 * time.Second
+	}
+
+	if cfg.AdminPort != "" && cfg.AdminToken == "" {
+		return nil, errors.New("ADMIN_TOKEN must be set when ADMIN_PORT is set")
+	}
+
+	if cfg.DebugEndpoints && cfg.AdminPort == "" {
+		return nil, errors.New("DEBUG_ENDPOINTS requires ADMIN_PORT to be set")
+	}
+
+	return cfg, nil
+}
+
+// envSecret reads the environment variable name, looking its value up in secrets
+// when it is secret:NAME so that it need not be kept in plain text.
+func envSecret(secrets SecretsProvider, name string) (string, error) {
+	v := os.Getenv(name)
+	if !strings.HasPrefix(v, "secret:") {
+		return v, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	s, err := secrets.Secret(ctx, strings.TrimPrefix(v, "secret:"))
+	if err != nil {
+		return "", fmt.Errorf("%s: %v", name, err)
+	}
+	return s.Value, nil
+}
+
+func envBool(name string) (bool, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return false, nil
+	}
+
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, fmt.Errorf("%s must be a boolean: %v", name, err)
+	}
+	return b, nil
+}
+
+func envInt(name string) (int64, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return 0, nil
+	}
+
+	i, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%s must be an integer: %v", name, err)
+	}
+	return i, nil
+}
+
+func envFloat(name string) (float64, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return 0, nil
+	}
+
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%s must be a number: %v", name, err)
+	}
+	return f, nil
+}
+
+func envDuration(name string) (time.Duration, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return 0, nil
+	}
+
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("%s must be a duration: %v", name, err)
+	}
+	return d, nil
+}
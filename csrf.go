@@ -0,0 +1,70 @@
+package separation
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/http"
+
+	"github.com/oralordos/separation/internal/principal"
+)
+
+// Access Layer
+var ErrCSRFTokenInvalid = registerError(errors.New("CSRF token is missing or invalid"), "csrf_token_invalid", http.StatusForbidden, "A change made with a session cookie must carry the X-CSRF-Token header given on a GET of the same session")
+
+// csrfHeader carries the CSRF token, both when it is issued and when it is presented.
+const csrfHeader = "X-CSRF-Token"
+
+// CSRFGuard protects users signed in with a session cookie from requests other sites make
+// in their browser. Every safe request of a session is answered with a token in the
+// X-CSRF-Token header, and every other request of the session must send it back in the same
+// header, which another site cannot read or set. The token is an HMAC of the session ID, so
+// it lasts as long as the session and nothing is stored. Callers authenticated any other
+// way send no ambient credentials and are let through.
+type CSRFGuard struct {
+	next http.Handler
+	keys [][]byte
+}
+
+// NewCSRFGuard makes tokens with the first of keys, accepting tokens made with any of them.
+func NewCSRFGuard(next http.Handler, keys [][]byte) *CSRFGuard {
+	return &CSRFGuard{
+		next: next,
+		keys: keys,
+	}
+}
+
+func csrfToken(key []byte, session string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("csrf:" + session))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (cg *CSRFGuard) valid(session, token string) bool {
+	for _, k := range cg.keys {
+		if hmac.Equal([]byte(csrfToken(k, session)), []byte(token)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (cg *CSRFGuard) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p, ok := principal.FromContext(r.Context())
+	if !ok || p.Session == "" {
+		cg.next.ServeHTTP(w, r)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		w.Header().Set(csrfHeader, csrfToken(cg.keys[0], p.Session))
+	default:
+		if !cg.valid(p.Session, r.Header.Get(csrfHeader)) {
+			writeError(w, r, ErrCSRFTokenInvalid)
+			return
+		}
+	}
+	cg.next.ServeHTTP(w, r)
+}
@@ -0,0 +1,104 @@
+package separation
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Access Layer
+func init() {
+	registerError(context.DeadlineExceeded, "deadline_exceeded", http.StatusGatewayTimeout, "The request ran out of time, see the X-Request-Timeout header")
+}
+
+var grpcTimeoutUnits = map[byte]time.Duration{
+	'H': time.Hour,
+	'M': time.Minute,
+	'S': time.Second,
+	'm': time.Millisecond,
+	'u': time.Microsecond,
+	'n': time.Nanosecond,
+}
+
+// parseGRPCTimeout reads the grpc-timeout format: at most eight digits followed by a unit,
+// one of H, M, S, m, u or n. A zero timeout is refused, and one too long to represent,
+// such as 99999999H, is cut to the longest duration.
+func parseGRPCTimeout(s string) (time.Duration, error) {
+	if len(s) < 2 || len(s) > 9 {
+		return 0, fmt.Errorf("Grpc-Timeout %q must be one to eight digits and a unit", s)
+	}
+
+	unit, ok := grpcTimeoutUnits[s[len(s)-1]]
+	if !ok {
+		return 0, fmt.Errorf("Grpc-Timeout %q has an unknown unit", s)
+	}
+
+	n, err := strconv.ParseUint(s[:len(s)-1], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Grpc-Timeout %q must be one to eight digits and a unit", s)
+	}
+	if n == 0 {
+		return 0, fmt.Errorf("Grpc-Timeout %q must be positive", s)
+	}
+	if n > math.MaxInt64/uint64(unit) {
+		return math.MaxInt64, nil
+	}
+	return time.Duration(n) * unit, nil
+}
+
+// requestTimeout reads how long the client is willing to wait from X-Request-Timeout,
+// a duration such as 1.5s, or failing that Grpc-Timeout. It returns zero when neither is set.
+func requestTimeout(r *http.Request) (time.Duration, error) {
+	if v := r.Header.Get("X-Request-Timeout"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return 0, fmt.Errorf("X-Request-Timeout %q must be a positive duration such as 1.5s", v)
+		}
+		return d, nil
+	}
+
+	if v := r.Header.Get("Grpc-Timeout"); v != "" {
+		return parseGRPCTimeout(v)
+	}
+	return 0, nil
+}
+
+// DeadlineMiddleware gives every request a context deadline. Clients may ask for a shorter
+// one with X-Request-Timeout or Grpc-Timeout, but never a longer one than max.
+// Work cut short by the deadline is reported with 504.
+type DeadlineMiddleware struct {
+	next http.Handler
+	max  time.Duration
+}
+
+// NewDeadlineMiddleware only applies client timeouts when max is zero.
+func NewDeadlineMiddleware(next http.Handler, max time.Duration) *DeadlineMiddleware {
+	return &DeadlineMiddleware{
+		next: next,
+		max:  max,
+	}
+}
+
+func (dm *DeadlineMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	timeout, err := requestTimeout(r)
+	if err != nil {
+		writeError(w, r, NewValidationError(err.Error()))
+		return
+	}
+
+	if dm.max > 0 && (timeout == 0 || timeout > dm.max) {
+		timeout = dm.max
+	}
+
+	if timeout == 0 {
+		dm.next.ServeHTTP(w, r)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+	dm.next.ServeHTTP(w, r.WithContext(ctx))
+}
@@ -0,0 +1,45 @@
+package separation
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestParseGRPCTimeout(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    time.Duration
+		wantErr bool
+	}{
+		{in: "1S", want: time.Second},
+		{in: "250m", want: 250 * time.Millisecond},
+		{in: "99999999n", want: 99999999 * time.Nanosecond},
+		{in: "2H", want: 2 * time.Hour},
+		{in: "99999999H", want: math.MaxInt64},
+		{in: "99999999M", want: 99999999 * time.Minute},
+		{in: "99999999S", want: 99999999 * time.Second},
+		{in: "0S", wantErr: true},
+		{in: "00000000m", wantErr: true},
+		{in: "S", wantErr: true},
+		{in: "123456789S", wantErr: true},
+		{in: "1X", wantErr: true},
+		{in: "-1S", wantErr: true},
+		{in: "+1S", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseGRPCTimeout(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseGRPCTimeout(%q) = %v, want an error", tt.in, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("parseGRPCTimeout(%q) = %v, %v, want %v", tt.in, got, err, tt.want)
+		}
+		if got <= 0 {
+			t.Errorf("parseGRPCTimeout(%q) = %v, which is not positive", tt.in, got)
+		}
+	}
+}
@@ -0,0 +1,306 @@
+package separation
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/oralordos/separation/internal/clock"
+	"github.com/oralordos/separation/internal/httpclient"
+)
+
+// Business Logic
+// UserRegistered is published when a user registers.
+type UserRegistered struct {
+	Email Email `json:"email"`
+	// IP is the client address the registration came from. It is empty outside of a request.
+	IP string    `json:"ip,omitempty"`
+	At time.Time `json:"at"`
+}
+
+func (ur *UserRegistered) EventName() string {
+	return "UserRegistered"
+}
+
+// Alert reports activity a DetectionRule found suspicious.
+type Alert struct {
+	Rule string `json:"rule"`
+	// Subject is what the activity came from, such as an email or an IP address
+	Subject string    `json:"subject"`
+	Message string    `json:"message"`
+	At      time.Time `json:"at"`
+}
+
+// DetectionRule looks at each event, and returns an alert when it finds the activity suspicious.
+// Rules must be safe to call concurrently.
+type DetectionRule interface {
+	Evaluate(ctx context.Context, e Event) *Alert
+}
+
+// AlertSink delivers alerts to the people who act on them.
+type AlertSink interface {
+	SendAlert(ctx context.Context, a *Alert) error
+}
+
+// Detector evaluates every event against the rules, and sends the alerts they raise to every sink.
+// Alerts are sent in the background, so a slow sink does not hold up the event bus.
+type Detector struct {
+	rules   []DetectionRule
+	sinks   []AlertSink
+	onError func(err error)
+}
+
+// NewDetector reports the errors of sinks to onError, which may be nil to drop them.
+func NewDetector(rules []DetectionRule, sinks []AlertSink, onError func(err error)) *Detector {
+	return &Detector{
+		rules:   rules,
+		sinks:   sinks,
+		onError: onError,
+	}
+}
+
+func (d *Detector) HandleEvent(ctx context.Context, e Event) {
+	for _, r := range d.rules {
+		a := r.Evaluate(ctx, e)
+		if a == nil {
+			continue
+		}
+
+		for _, s := range d.sinks {
+			go func(s AlertSink) {
+				ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+				defer cancel()
+				err := s.SendAlert(ctx, a)
+				if err != nil && d.onError != nil {
+					d.onError(fmt.Errorf("Unable to send %s alert: %w", a.Rule, err))
+				}
+			}(s)
+		}
+	}
+}
+
+// RapidRegistrationsRule alerts when more than max users register from one IP address within window.
+// It alerts once when the limit is passed, and again only after the address has quietened down.
+type RapidRegistrationsRule struct {
+	max    int
+	window time.Duration
+	clock  clock.Clock
+
+	mu   sync.Mutex
+	seen map[string][]time.Time
+}
+
+func NewRapidRegistrationsRule(max int, window time.Duration, clk clock.Clock) *RapidRegistrationsRule {
+	return &RapidRegistrationsRule{
+		max:    max,
+		window: window,
+		clock:  clk,
+		seen:   map[string][]time.Time{},
+	}
+}
+
+func (rr *RapidRegistrationsRule) Evaluate(ctx context.Context, e Event) *Alert {
+	reg, ok := e.(*UserRegistered)
+	if !ok || reg.IP == "" {
+		return nil
+	}
+
+	now := rr.clock.Now()
+	cutoff := now.Add(-rr.window)
+
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+
+	// Forget every address that has gone quiet, so the map does not grow without bound
+	for ip, times := range rr.seen {
+		if !times[len(times)-1].After(cutoff) {
+			delete(rr.seen, ip)
+		}
+	}
+
+	recent := []time.Time{}
+	for _, t := range rr.seen[reg.IP] {
+		if t.After(cutoff) {
+			recent = append(recent, t)
+		}
+	}
+	recent = append(recent, now)
+	rr.seen[reg.IP] = recent
+
+	if len(recent) != rr.max+1 {
+		return nil
+	}
+	return &Alert{
+		Rule:    "rapid_registrations",
+		Subject: reg.IP,
+		Message: fmt.Sprintf("%d users registered from %s within %s", len(recent), reg.IP, rr.window),
+		At:      now.UTC(),
+	}
+}
+
+// ParseSpikeMultipliers parses a comma separated list of how many times the baseline
+// registration rate must be passed to alert, such as "3,10".
+func ParseSpikeMultipliers(s string) ([]float64, error) {
+	var multipliers []float64
+	for _, v := range parseNameList(s) {
+		m, err := strconv.ParseFloat(v, 64)
+		if err != nil || m <= 1 {
+			return nil, fmt.Errorf("%q must be a number greater than 1", v)
+		}
+		multipliers = append(multipliers, m)
+	}
+	sort.Float64s(multipliers)
+	return multipliers, nil
+}
+
+// RegistrationSpikeRule alerts when the registrations of the current minute pass a multiple
+// of the average per minute over the baseline before it, an early warning of bot signups.
+// Minutes with fewer than min registrations never alert, so a quiet baseline is not
+// set off by a handful of users. Each multiplier alerts at most once a minute.
+type RegistrationSpikeRule struct {
+	multipliers []float64
+	baseline    time.Duration
+	min         int
+	clock       clock.Clock
+
+	mu      sync.Mutex
+	started time.Time
+	minutes map[time.Time]int
+	// alerted is the highest multiplier passed in each minute
+	alerted map[time.Time]float64
+}
+
+func NewRegistrationSpikeRule(multipliers []float64, baseline time.Duration, min int, clk clock.Clock) *RegistrationSpikeRule {
+	return &RegistrationSpikeRule{
+		multipliers: multipliers,
+		baseline:    baseline,
+		min:         min,
+		clock:       clk,
+		minutes:     map[time.Time]int{},
+		alerted:     map[time.Time]float64{},
+	}
+}
+
+func (rs *RegistrationSpikeRule) Evaluate(ctx context.Context, e Event) *Alert {
+	if _, ok := e.(*UserRegistered); !ok {
+		return nil
+	}
+
+	now := rs.clock.Now()
+	minute := now.Truncate(time.Minute)
+	cutoff := minute.Add(-rs.baseline)
+
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	if rs.started.IsZero() {
+		rs.started = minute
+	}
+	for m := range rs.minutes {
+		if m.Before(cutoff) {
+			delete(rs.minutes, m)
+			delete(rs.alerted, m)
+		}
+	}
+	rs.minutes[minute]++
+	current := rs.minutes[minute]
+
+	// Until a whole baseline has been seen, average over the minutes that have
+	if cutoff.Before(rs.started) {
+		cutoff = rs.started
+	}
+	elapsed := int(minute.Sub(cutoff) / time.Minute)
+	if elapsed == 0 || current < rs.min {
+		return nil
+	}
+	total := 0
+	for m, n := range rs.minutes {
+		if m.Before(minute) {
+			total += n
+		}
+	}
+	rate := float64(total) / float64(elapsed)
+
+	passed := 0.0
+	for _, m := range rs.multipliers {
+		if float64(current) > m*rate {
+			passed = m
+		}
+	}
+	if passed <= rs.alerted[minute] {
+		return nil
+	}
+	rs.alerted[minute] = passed
+	return &Alert{
+		Rule:    "registration_spike",
+		Subject: minute.UTC().Format(time.RFC3339),
+		Message: fmt.Sprintf("%d users registered this minute, over %g times the baseline of %.1f a minute", current, passed, rate),
+		At:      now.UTC(),
+	}
+}
+
+// Access Layer
+type logAlertSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewLogAlertSink writes each alert to w as a line of JSON.
+func NewLogAlertSink(w io.Writer) AlertSink {
+	return &logAlertSink{w: w}
+}
+
+func (ls *logAlertSink) SendAlert(ctx context.Context, a *Alert) error {
+	b, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+	_, err = ls.w.Write(append(b, '\n'))
+	return err
+}
+
+// WebhookAlertSink posts each alert as JSON to a URL.
+type WebhookAlertSink struct {
+	url    string
+	client *httpclient.Client
+}
+
+func NewWebhookAlertSink(url string) *WebhookAlertSink {
+	return &WebhookAlertSink{
+		url:    url,
+		client: httpclient.New("alerts", httpclient.Options{Timeout: 10 * time.Second}),
+	}
+}
+
+func (ws *WebhookAlertSink) SendAlert(ctx context.Context, a *Alert) error {
+	b, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, ws.url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := ws.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("Webhook answered %s", resp.Status)
+	}
+	return nil
+}
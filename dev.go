@@ -0,0 +1,193 @@
+package separation
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+)
+
+// Access Layer
+// devSampleUsers are registered when `separation dev` starts.
+var devSampleUsers = []struct {
+	email, name string
+}{
+	{"ada@example.com", "Ada Lovelace"},
+	{"grace@example.com", "Grace Hopper"},
+	{"linus@example.com", "Linus Torvalds"},
+}
+
+const devHelp = `Commands:
+  register <email> <name>  register a user through the JSON access layer
+  get <email>              fetch a user through the JSON access layer
+  users                    list the users held by the action layer, bypassing the other layers
+  help                     show this help
+  quit                     stop the server and exit
+`
+
+// runDev implements `separation dev`, which runs the server on in-memory storage with
+// sample users and a prompt for sending it requests.
+func runDev(args []string) error {
+	fs := flag.NewFlagSet("dev", flag.ExitOnError)
+	listen := fs.String("listen", "127.0.0.1:8080", "address to serve the JSON access layer on")
+	noSeed := fs.Bool("no-seed", false, "start without the sample users")
+	fs.Parse(args)
+
+	cfg, err := LoadConfig()
+	if err != nil {
+		return fmt.Errorf("Invalid configuration: %v", err)
+	}
+	// Nothing outlives a dev session, and nothing gets in the way of registering
+	cfg.Transports = []string{"http"}
+	cfg.ChangeLog = ""
+	cfg.SeedFile = ""
+	cfg.InviteOnly = false
+
+	ln, err := net.Listen("tcp", *listen)
+	if err != nil {
+		return err
+	}
+	users := NewMemoryUserStorage()
+
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- New(WithConfig(cfg), WithStorage(users), WithListener(ln)).Run(ctx)
+	}()
+
+	base := "http://" + ln.Addr().String()
+	fmt.Printf("Serving on %s with in-memory storage\n", base)
+	if !*noSeed {
+		for _, u := range devSampleUsers {
+			err = devRegister(os.Stdout, base, u.email, u.name, cfg.TermsVersion)
+			if err != nil {
+				cancel()
+				<-done
+				return err
+			}
+		}
+	}
+	fmt.Print(devHelp)
+
+	lines := make(chan string)
+	go func() {
+		sc := bufio.NewScanner(os.Stdin)
+		for sc.Scan() {
+			lines <- sc.Text()
+		}
+		close(lines)
+	}()
+
+	for {
+		fmt.Print("> ")
+		select {
+		case err = <-done:
+			return err
+		case line, ok := <-lines:
+			if !ok || devCommand(ctx, os.Stdout, base, users, cfg.TermsVersion, line) {
+				cancel()
+				return <-done
+			}
+		}
+	}
+}
+
+// devCommand runs one line typed at the dev prompt, and returns true when it asks to quit.
+func devCommand(ctx context.Context, out io.Writer, base string, users UserStorer, termsVersion, line string) bool {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return false
+	}
+
+	var err error
+	switch fields[0] {
+	case "register":
+		if len(fields) < 3 {
+			fmt.Fprintln(out, "Usage: register <email> <name>")
+			return false
+		}
+		err = devRegister(out, base, fields[1], strings.Join(fields[2:], " "), termsVersion)
+	case "get":
+		if len(fields) != 2 {
+			fmt.Fprintln(out, "Usage: get <email>")
+			return false
+		}
+		err = devShow(out, http.MethodGet, base+"/user?email="+url.QueryEscape(fields[1]), nil)
+	case "users":
+		err = devListUsers(ctx, out, users)
+	case "help":
+		fmt.Fprint(out, devHelp)
+	case "quit", "exit":
+		return true
+	default:
+		fmt.Fprintf(out, "Unknown command %q, type help for the commands\n", fields[0])
+	}
+
+	if err != nil {
+		fmt.Fprintln(out, err)
+	}
+	return false
+}
+
+func devRegister(out io.Writer, base, email, name, termsVersion string) error {
+	body, err := json.Marshal(map[string]string{
+		"email":        email,
+		"name":         name,
+		"accept_terms": termsVersion,
+	})
+	if err != nil {
+		return err
+	}
+	return devShow(out, http.MethodPost, base+"/register", body)
+}
+
+// devShow sends a request and prints the status and body of the response.
+func devShow(out io.Writer, method, url string, body []byte) error {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	fmt.Fprintf(out, "%s %s: %s\n", method, req.URL.RequestURI(), resp.Status)
+	_, err = io.Copy(out, resp.Body)
+	return err
+}
+
+func devListUsers(ctx context.Context, out io.Writer, users UserStorer) error {
+	list, err := users.List(ctx, LabelSelector{})
+	if err != nil {
+		return err
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Email.String() < list[j].Email.String()
+	})
+
+	tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "EMAIL\tNAME\tUSERNAME\tCREATED")
+	for _, u := range list {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", u.Email, u.Name, u.Username, u.CreatedAt.Format("15:04:05"))
+	}
+	fmt.Fprintf(tw, "%d users\n", len(list))
+	return tw.Flush()
+}
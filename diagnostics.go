@@ -0,0 +1,203 @@
+package separation
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// Check is one step of the startup self-check.
+// Run returns an error describing what is wrong, and Hint says how to fix it.
+type Check struct {
+	Name string
+	Hint string
+	Run  func(ctx context.Context) error
+}
+
+type CheckResult struct {
+	Name     string
+	OK       bool
+	Err      error
+	Hint     string
+	Duration time.Duration
+}
+
+// RunDiagnostics runs every check, even after one fails, so the report shows every problem at once.
+func RunDiagnostics(ctx context.Context, checks []Check) ([]CheckResult, bool) {
+	results := make([]CheckResult, 0, len(checks))
+	ok := true
+	for _, c := range checks {
+		start := time.Now()
+		err := c.Run(ctx)
+		results = append(results, CheckResult{
+			Name:     c.Name,
+			OK:       err == nil,
+			Err:      err,
+			Hint:     c.Hint,
+			Duration: time.Since(start),
+		})
+		if err != nil {
+			ok = false
+		}
+	}
+	return results, ok
+}
+
+// PrintDiagnostics writes one logfmt line per check.
+func PrintDiagnostics(w io.Writer, results []CheckResult) {
+	for _, r := range results {
+		if r.OK {
+			fmt.Fprintf(w, "check=%q status=ok duration=%s\n", r.Name, r.Duration)
+			continue
+		}
+		fmt.Fprintf(w, "check=%q status=failed duration=%s error=%q hint=%q\n", r.Name, r.Duration, r.Err.Error(), r.Hint)
+	}
+}
+
+// bootChecks are run before the server starts accepting requests.
+func bootChecks(cfg *Config, us UserStorer) []Check {
+	checks := []Check{
+		{
+			Name: "ports",
+			Hint: "Set PORT and ADMIN_PORT to different numbers between 1 and 65535, or LISTEN to tcp://host:port, unix:///path/to.sock or systemd",
+			Run: func(ctx context.Context) error {
+				return checkPorts(cfg)
+			},
+		},
+		{
+			Name: "user storage",
+			Hint: "Check that the user storage backend is reachable",
+			Run: func(ctx context.Context) error {
+				probe, err := ParseEmail("diagnostics@invalid.example")
+				if err != nil {
+					return err
+				}
+				_, err = us.Get(ctx, probe)
+				if err != nil && err != ErrUserNotFound {
+					return err
+				}
+				return nil
+			},
+		},
+	}
+
+	if cfg.ChangeLog != "" {
+		checks = append(checks, Check{
+			Name: "change log",
+			Hint: "Make sure CHANGE_LOG points at a file this user can read and append to",
+			Run: func(ctx context.Context) error {
+				return checkAppendable(cfg.ChangeLog)
+			},
+		})
+	}
+
+	if cfg.MaintenanceStateFile != "" {
+		checks = append(checks, Check{
+			Name: "maintenance state",
+			Hint: "Make sure MAINTENANCE_STATE_FILE holds valid JSON and its directory is writable, or remove the file to reset it",
+			Run: func(ctx context.Context) error {
+				_, err := NewFileMaintenanceStorage(cfg.MaintenanceStateFile).Get(ctx)
+				if err != nil {
+					return err
+				}
+				return checkDirWritable(filepath.Dir(cfg.MaintenanceStateFile))
+			},
+		})
+	}
+
+	if cfg.SeedFile != "" {
+		checks = append(checks, Check{
+			Name: "seed file",
+			Hint: "Make sure SEED_FILE points at a readable JSON array of users with an email and a name",
+			Run: func(ctx context.Context) error {
+				_, err := readFixturesFile(cfg.SeedFile)
+				return err
+			},
+		})
+	}
+
+	if cfg.AccessLog != "" && !isStdStream(cfg.AccessLog) && cfg.AccessLog != "syslog" {
+		checks = append(checks, Check{
+			Name: "access log",
+			Hint: "Make sure ACCESS_LOG points at a file this user can append to",
+			Run: func(ctx context.Context) error {
+				return checkAppendable(cfg.AccessLog)
+			},
+		})
+	}
+	return checks
+}
+
+func checkPorts(cfg *Config) error {
+	ports := []struct {
+		name  string
+		value string
+	}{
+		{"PORT", cfg.Port},
+		{"ADMIN_PORT", cfg.AdminPort},
+	}
+	for _, p := range ports {
+		if p.value == "" {
+			continue
+		}
+		n, err := strconv.Atoi(p.value)
+		if err != nil || n < 1 || n > 65535 {
+			return fmt.Errorf("%s is %q, which is not a valid port", p.name, p.value)
+		}
+	}
+
+	if cfg.Listen != "" {
+		_, _, err := parseListenAddr(cfg.Listen)
+		return err
+	}
+
+	if cfg.AdminPort == cfg.Port {
+		return errors.New("PORT and ADMIN_PORT are the same")
+	}
+	return nil
+}
+
+func checkAppendable(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+func checkDirWritable(dir string) error {
+	f, err := os.CreateTemp(dir, ".separation-check")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// runCheck implements `separation check`, which runs the startup self-check and exits.
+func runCheck(args []string) error {
+	cfg, err := LoadConfig()
+	if err != nil {
+		return fmt.Errorf("Invalid configuration: %v", err)
+	}
+
+	us, err := OpenUserStorage(cfg.Storage, cfg)
+	if err != nil {
+		return err
+	}
+	if c, ok := us.(io.Closer); ok {
+		defer c.Close()
+	}
+
+	results, ok := RunDiagnostics(context.Background(), bootChecks(cfg, us))
+	PrintDiagnostics(os.Stdout, results)
+	if !ok {
+		return errors.New("Self-check failed")
+	}
+	return nil
+}
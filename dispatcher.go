@@ -0,0 +1,164 @@
+package separation
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+)
+
+// Business Logic
+// Command asks the business logic to change something.
+type Command interface {
+	CommandName() string
+}
+
+// Query asks the business logic for information without changing anything.
+type Query interface {
+	QueryName() string
+}
+
+type CommandHandler interface {
+	Handle(ctx context.Context, cmd Command) error
+}
+
+type CommandHandlerFunc func(ctx context.Context, cmd Command) error
+
+func (f CommandHandlerFunc) Handle(ctx context.Context, cmd Command) error {
+	return f(ctx, cmd)
+}
+
+type QueryHandler interface {
+	Handle(ctx context.Context, q Query) (interface{}, error)
+}
+
+type QueryHandlerFunc func(ctx context.Context, q Query) (interface{}, error)
+
+func (f QueryHandlerFunc) Handle(ctx context.Context, q Query) (interface{}, error) {
+	return f(ctx, q)
+}
+
+// CommandMiddleware wraps every command handler with a cross-cutting concern.
+type CommandMiddleware func(next CommandHandler) CommandHandler
+
+// QueryMiddleware wraps every query handler with a cross-cutting concern.
+type QueryMiddleware func(next QueryHandler) QueryHandler
+
+var ErrNoHandler = errors.New("No handler registered")
+
+// Dispatcher routes commands and queries to their handlers by name.
+// Middleware is applied in the order it was added, so the first one added runs first.
+type Dispatcher struct {
+	commands map[string]CommandHandler
+	queries  map[string]QueryHandler
+	cmdMW    []CommandMiddleware
+	queryMW  []QueryMiddleware
+}
+
+func NewDispatcher() *Dispatcher {
+	return &Dispatcher{
+		commands: map[string]CommandHandler{},
+		queries:  map[string]QueryHandler{},
+	}
+}
+
+func (d *Dispatcher) HandleCommand(name string, h CommandHandler) {
+	d.commands[name] = h
+}
+
+func (d *Dispatcher) HandleQuery(name string, h QueryHandler) {
+	d.queries[name] = h
+}
+
+func (d *Dispatcher) UseCommand(mw ...CommandMiddleware) {
+	d.cmdMW = append(d.cmdMW, mw...)
+}
+
+func (d *Dispatcher) UseQuery(mw ...QueryMiddleware) {
+	d.queryMW = append(d.queryMW, mw...)
+}
+
+// Dispatch may return an ErrNoHandler error, or the context's error if it is already done
+func (d *Dispatcher) Dispatch(ctx context.Context, cmd Command) error {
+	err := ctx.Err()
+	if err != nil {
+		return err
+	}
+
+	h, ok := d.commands[cmd.CommandName()]
+	if !ok {
+		return fmt.Errorf("%w for command %s", ErrNoHandler, cmd.CommandName())
+	}
+
+	for i := len(d.cmdMW) - 1; i >= 0; i-- {
+		h = d.cmdMW[i](h)
+	}
+	return h.Handle(ctx, cmd)
+}
+
+// Ask may return an ErrNoHandler error, or the context's error if it is already done
+func (d *Dispatcher) Ask(ctx context.Context, q Query) (interface{}, error) {
+	err := ctx.Err()
+	if err != nil {
+		return nil, err
+	}
+
+	h, ok := d.queries[q.QueryName()]
+	if !ok {
+		return nil, fmt.Errorf("%w for query %s", ErrNoHandler, q.QueryName())
+	}
+
+	for i := len(d.queryMW) - 1; i >= 0; i-- {
+		h = d.queryMW[i](h)
+	}
+	return h.Handle(ctx, q)
+}
+
+type Validator interface {
+	Validate() error
+}
+
+// ValidateCommands runs Validate on any command that implements Validator
+// before it reaches its handler.
+func ValidateCommands(next CommandHandler) CommandHandler {
+	return CommandHandlerFunc(func(ctx context.Context, cmd Command) error {
+		if v, ok := cmd.(Validator); ok {
+			err := v.Validate()
+			if err != nil {
+				return err
+			}
+		}
+		return next.Handle(ctx, cmd)
+	})
+}
+
+var (
+	commandCounts = expvar.NewMap("commands")
+	commandErrors = expvar.NewMap("command_errors")
+	queryCounts   = expvar.NewMap("queries")
+	queryErrors   = expvar.NewMap("query_errors")
+)
+
+// CountCommands publishes how many times each command ran and failed through expvar.
+func CountCommands(next CommandHandler) CommandHandler {
+	return CommandHandlerFunc(func(ctx context.Context, cmd Command) error {
+		commandCounts.Add(cmd.CommandName(), 1)
+		err := next.Handle(ctx, cmd)
+		if err != nil {
+			commandErrors.Add(cmd.CommandName(), 1)
+		}
+		return err
+	})
+}
+
+// CountQueries publishes how many times each query ran and failed through expvar.
+func CountQueries(next QueryHandler) QueryHandler {
+	return QueryHandlerFunc(func(ctx context.Context, q Query) (interface{}, error) {
+		queryCounts.Add(q.QueryName(), 1)
+		res, err := next.Handle(ctx, q)
+		if err != nil {
+			queryErrors.Add(q.QueryName(), 1)
+		}
+		return res, err
+	})
+}
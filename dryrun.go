@@ -0,0 +1,39 @@
+package separation
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+)
+
+// Access Layer
+// dryRunRequested reports whether a mutating request asked to only be checked,
+// through either the dry_run query parameter or the Dry-Run header.
+func dryRunRequested(r *http.Request) (bool, error) {
+	v := r.URL.Query().Get("dry_run")
+	if v == "" {
+		v = r.Header.Get("Dry-Run")
+	}
+	if v == "" {
+		return false, nil
+	}
+
+	dry, err := strconv.ParseBool(v)
+	if err != nil {
+		return false, NewValidationError("Dry run must be true or false")
+	}
+	return dry, nil
+}
+
+// writeDryRun answers a successful dry run with what the request would have done.
+func writeDryRun(w http.ResponseWriter, r *http.Request, wouldCreate interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"dry_run":      true,
+		"would_create": wouldCreate,
+	})
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+}
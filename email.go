@@ -0,0 +1,68 @@
+package separation
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+var (
+	ErrEmailEmpty = registerError(NewValidationError("Email cannot be empty"), "email_empty", http.StatusBadRequest, "An email address is required but was empty")
+	ErrEmailNoAt  = registerError(NewValidationError("Email must include an '@' symbol"), "email_invalid", http.StatusBadRequest, "The email address is not valid")
+)
+
+// Email is a validated, canonical email address.
+// The only way to build a non-zero Email is ParseEmail, so any Email passed
+// between the layers is known to be valid.
+type Email struct {
+	addr string
+}
+
+// ParseEmail validates s and canonicalizes it by trimming surrounding
+// whitespace and lowercasing it, so the same mailbox always maps to the same Email.
+// It may return an ErrEmailEmpty or ErrEmailNoAt error.
+func ParseEmail(s string) (Email, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if s == "" {
+		return Email{}, ErrEmailEmpty
+	}
+
+	at := strings.LastIndexByte(s, '@')
+	if at <= 0 || at == len(s)-1 {
+		return Email{}, ErrEmailNoAt
+	}
+
+	return Email{addr: s}, nil
+}
+
+func (e Email) String() string {
+	return e.addr
+}
+
+// Domain returns the part after the '@'.
+func (e Email) Domain() string {
+	return e.addr[strings.LastIndexByte(e.addr, '@')+1:]
+}
+
+func (e Email) IsZero() bool {
+	return e.addr == ""
+}
+
+func (e Email) MarshalJSON() ([]byte, error) {
+	return json.Marshal(e.addr)
+}
+
+func (e *Email) UnmarshalJSON(b []byte) error {
+	var s string
+	err := json.Unmarshal(b, &s)
+	if err != nil {
+		return err
+	}
+
+	parsed, err := ParseEmail(s)
+	if err != nil {
+		return err
+	}
+	*e = parsed
+	return nil
+}
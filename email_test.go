@@ -0,0 +1,91 @@
+package separation
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/oralordos/separation/internal/clock"
+)
+
+// FuzzParseEmail checks that parsing never panics, and that a parsed email is valid
+// UTF-8 and already canonical, so parsing it again changes nothing. Hostile inputs, such
+// as malformed UTF-8, are in testdata/fuzz/FuzzParseEmail.
+func FuzzParseEmail(f *testing.F) {
+	for _, s := range []string{"a@example.com", " A@Example.COM ", "@", "a@", "@b", "a@b@c", "a @b"} {
+		f.Add(s)
+	}
+	f.Fuzz(func(t *testing.T, s string) {
+		email, err := ParseEmail(s)
+		if err != nil {
+			if !isValidationError(err) {
+				t.Fatalf("ParseEmail(%q) returned %v, which is not a ValidationError", s, err)
+			}
+			return
+		}
+
+		addr := email.String()
+		if !utf8.ValidString(addr) {
+			t.Fatalf("ParseEmail(%q) = %q, which is not valid UTF-8", s, addr)
+		}
+		if !strings.Contains(addr, "@") || email.Domain() == "" {
+			t.Fatalf("ParseEmail(%q) = %q, which has no domain", s, addr)
+		}
+		again, err := ParseEmail(addr)
+		if err != nil || again != email {
+			t.Fatalf("ParseEmail(%q) = %q, which parses again as %q, %v", s, addr, again, err)
+		}
+	})
+}
+
+// TestEmailEntryPointsAgree sends the same invalid emails to POST /register and GET /user,
+// and checks both reject each with the same ValidationError, status and message.
+func TestEmailEntryPointsAgree(t *testing.T) {
+	us := NewMemoryUserStorage()
+	d := NewDispatcher()
+	d.UseCommand(ValidateCommands)
+	d.HandleCommand((&RegisterParams{}).CommandName(), NewRegisterUserHandler(us, NewMemoryInviteStorage(), NewEventBus(), clock.Real, "", false))
+	d.HandleQuery((&GetUserQuery{}).QueryName(), NewGetUserQueryHandler(us))
+	j := NewJsonOverHTTP(NewUserServiceImpl(d), nil, 1<<20)
+
+	serve := func(r *http.Request) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		j.ServeHTTP(w, r)
+		return w
+	}
+
+	cases := []struct {
+		email string
+		want  error
+	}{
+		{"", ErrEmailEmpty},
+		{"   ", ErrEmailEmpty},
+		{"ada", ErrEmailNoAt},
+		{"@example.com", ErrEmailNoAt},
+		{"ada@", ErrEmailNoAt},
+		{" ada@ ", ErrEmailNoAt},
+	}
+	for _, c := range cases {
+		body, err := json.Marshal(map[string]string{"email": c.email, "name": "Ada Lovelace"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		reg := httptest.NewRequest(http.MethodPost, "/register", strings.NewReader(string(body)))
+		reg.Header.Set("Content-Type", "application/json")
+		registered := serve(reg)
+		got := serve(httptest.NewRequest(http.MethodGet, "/user?email="+url.QueryEscape(c.email), nil))
+
+		want := lookupError(c.want)
+		if registered.Code != want.Status || registered.Header().Get("X-Error-Code") != want.Code {
+			t.Errorf("Registering %q answered %d %s, want %d %s", c.email, registered.Code, registered.Header().Get("X-Error-Code"), want.Status, want.Code)
+		}
+		if got.Code != registered.Code || got.Header().Get("X-Error-Code") != registered.Header().Get("X-Error-Code") || got.Body.String() != registered.Body.String() {
+			t.Errorf("Getting %q answered %d %s %q, but registering it answered %d %s %q", c.email,
+				got.Code, got.Header().Get("X-Error-Code"), got.Body, registered.Code, registered.Header().Get("X-Error-Code"), registered.Body)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package separation
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"io"
+	"sync"
+	"time"
+)
+
+// Business Logic
+// Event tells the rest of the program that something happened in the business logic.
+type Event interface {
+	EventName() string
+}
+
+type EventHandler interface {
+	HandleEvent(ctx context.Context, e Event)
+}
+
+type EventHandlerFunc func(ctx context.Context, e Event)
+
+func (f EventHandlerFunc) HandleEvent(ctx context.Context, e Event) {
+	f(ctx, e)
+}
+
+var eventCounts = expvar.NewMap("events")
+
+// EventBus delivers events to the handlers subscribed to them.
+// Delivery is synchronous and in subscription order, after the change the event
+// describes has been saved, so a handler cannot undo or fail it. Handlers that do
+// slow work should hand it off to a goroutine of their own.
+type EventBus struct {
+	mu   sync.RWMutex
+	subs map[string][]EventHandler
+	all  []EventHandler
+}
+
+func NewEventBus() *EventBus {
+	return &EventBus{
+		subs: map[string][]EventHandler{},
+	}
+}
+
+// Subscribe calls h for every event called name.
+func (eb *EventBus) Subscribe(name string, h EventHandler) {
+	eb.mu.Lock()
+	defer eb.mu.Unlock()
+	eb.subs[name] = append(eb.subs[name], h)
+}
+
+// SubscribeAll calls h for every event.
+func (eb *EventBus) SubscribeAll(h EventHandler) {
+	eb.mu.Lock()
+	defer eb.mu.Unlock()
+	eb.all = append(eb.all, h)
+}
+
+func (eb *EventBus) Publish(ctx context.Context, e Event) {
+	eventCounts.Add(e.EventName(), 1)
+
+	eb.mu.RLock()
+	handlers := append(append([]EventHandler(nil), eb.all...), eb.subs[e.EventName()]...)
+	eb.mu.RUnlock()
+
+	for _, h := range handlers {
+		h.HandleEvent(ctx, e)
+	}
+}
+
+// Access Layer
+// LogEvents writes each event to w as a line of JSON, wrapped in an EventEnvelope.
+func LogEvents(w io.Writer) EventHandler {
+	var mu sync.Mutex
+	return EventHandlerFunc(func(ctx context.Context, e Event) {
+		env, err := NewEventEnvelope(e, time.Now())
+		if err != nil {
+			return
+		}
+		b, err := json.Marshal(env)
+		if err != nil {
+			return
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		_, _ = w.Write(append(b, '\n'))
+	})
+}
@@ -0,0 +1,156 @@
+package separation
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Business Logic
+// VersionedEvent is implemented by events whose payload has changed shape since version 1.
+// Events that do not implement it are written as their latest registered version.
+type VersionedEvent interface {
+	Event
+	EventVersion() int
+}
+
+// EventUpcaster rewrites the payload of one version of an event into the next version.
+type EventUpcaster func(payload json.RawMessage) (json.RawMessage, error)
+
+type eventSchema struct {
+	latest    int
+	newEvent  func() Event
+	upcasters map[int]EventUpcaster
+}
+
+var (
+	eventSchemasMu sync.RWMutex
+	eventSchemas   = map[string]*eventSchema{}
+)
+
+func init() {
+	RegisterEventSchema("UserRegistered", 1, func() Event { return &UserRegistered{} })
+	RegisterEventSchema("UserReferred", 1, func() Event { return &UserReferred{} })
+	RegisterEventSchema("NewDeviceLogin", 1, func() Event { return &NewDeviceLogin{} })
+}
+
+// RegisterEventSchema records that version is the latest shape of the event called name,
+// decoded into what newEvent returns. A breaking change to an event's payload bumps its
+// version, and registers an upcaster from the old version so old payloads still decode.
+// It panics if the version is not newer than the one registered before.
+func RegisterEventSchema(name string, version int, newEvent func() Event) {
+	eventSchemasMu.Lock()
+	defer eventSchemasMu.Unlock()
+	s, ok := eventSchemas[name]
+	if !ok {
+		s = &eventSchema{upcasters: map[int]EventUpcaster{}}
+		eventSchemas[name] = s
+	}
+	if version <= s.latest {
+		panic(fmt.Sprintf("Event schema %s registered at version %d after version %d", name, version, s.latest))
+	}
+	s.latest = version
+	s.newEvent = newEvent
+}
+
+// RegisterEventUpcaster makes fn rewrite version from of the event called name into version from+1.
+// It panics if the event has no schema or the upcaster is registered twice.
+func RegisterEventUpcaster(name string, from int, fn EventUpcaster) {
+	eventSchemasMu.Lock()
+	defer eventSchemasMu.Unlock()
+	s, ok := eventSchemas[name]
+	if !ok {
+		panic("Event upcaster registered before its schema: " + name)
+	}
+	if _, dup := s.upcasters[from]; dup {
+		panic(fmt.Sprintf("Event upcaster registered twice: %s version %d", name, from))
+	}
+	s.upcasters[from] = fn
+}
+
+// EventEnvelope is how events leave the program. Consumers read Type and Version to know
+// the shape of Payload. Fields are only ever added to a version's payload, so a consumer
+// written against a version keeps working until the version changes.
+type EventEnvelope struct {
+	Type       string          `json:"type"`
+	Version    int             `json:"version"`
+	ID         string          `json:"id"`
+	OccurredAt time.Time       `json:"occurred_at"`
+	Payload    json.RawMessage `json:"payload"`
+}
+
+func newEventID() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// NewEventEnvelope wraps e, which occurred at at, with a new ID.
+func NewEventEnvelope(e Event, at time.Time) (*EventEnvelope, error) {
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+	id, err := newEventID()
+	if err != nil {
+		return nil, err
+	}
+
+	version := 1
+	if ve, ok := e.(VersionedEvent); ok {
+		version = ve.EventVersion()
+	} else {
+		eventSchemasMu.RLock()
+		if s, ok := eventSchemas[e.EventName()]; ok {
+			version = s.latest
+		}
+		eventSchemasMu.RUnlock()
+	}
+
+	return &EventEnvelope{
+		Type:       e.EventName(),
+		Version:    version,
+		ID:         id,
+		OccurredAt: at.UTC(),
+		Payload:    payload,
+	}, nil
+}
+
+// Decode upcasts the payload to the latest version of its event and decodes it.
+func (ee *EventEnvelope) Decode() (Event, error) {
+	eventSchemasMu.RLock()
+	s, ok := eventSchemas[ee.Type]
+	eventSchemasMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("Event %s has no schema", ee.Type)
+	}
+	if ee.Version > s.latest {
+		return nil, fmt.Errorf("Event %s version %d is newer than the latest known, %d", ee.Type, ee.Version, s.latest)
+	}
+
+	payload := ee.Payload
+	for v := ee.Version; v < s.latest; v++ {
+		up, ok := s.upcasters[v]
+		if !ok {
+			return nil, fmt.Errorf("Event %s has no upcaster from version %d", ee.Type, v)
+		}
+		var err error
+		payload, err = up(payload)
+		if err != nil {
+			return nil, fmt.Errorf("Upcasting event %s from version %d: %v", ee.Type, v, err)
+		}
+	}
+
+	e := s.newEvent()
+	err := json.Unmarshal(payload, e)
+	if err != nil {
+		return nil, err
+	}
+	return e, nil
+}
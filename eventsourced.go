@@ -0,0 +1,532 @@
+package separation
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/oralordos/separation/internal/clock"
+)
+
+// Action Layer
+// The types of stored user events.
+const (
+	UserEventRegistered = "UserRegistered"
+	UserEventUpdated    = "UserUpdated"
+	UserEventDeleted    = "UserDeleted"
+)
+
+// UserEvent is one change to one user, as kept by a UserEventStore.
+type UserEvent struct {
+	Seq   uint64    `json:"seq"`
+	Type  string    `json:"type"`
+	Email Email     `json:"email"`
+	At    time.Time `json:"at"`
+	// User is the whole user after the event. It is nil for UserDeleted.
+	User *User `json:"user,omitempty"`
+}
+
+// UserEventStore is the append-only history an EventSourcedUserStorage is rebuilt from.
+type UserEventStore interface {
+	// Append assigns the next sequence numbers to events and durably records them, all or none.
+	Append(ctx context.Context, events []*UserEvent) error
+	// Replay calls fn for every event with a sequence number after afterSeq, in order.
+	Replay(ctx context.Context, afterSeq uint64, fn func(*UserEvent) error) error
+}
+
+// MemoryUserEventStore keeps events encoded, so later changes to a saved user
+// cannot rewrite its history.
+type MemoryUserEventStore struct {
+	mu     sync.Mutex
+	events [][]byte
+}
+
+func NewMemoryUserEventStore() *MemoryUserEventStore {
+	return &MemoryUserEventStore{}
+}
+
+func (ms *MemoryUserEventStore) Append(ctx context.Context, events []*UserEvent) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	encoded := make([][]byte, len(events))
+	for i, e := range events {
+		e.Seq = uint64(len(ms.events) + i + 1)
+		b, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		encoded[i] = b
+	}
+	ms.events = append(ms.events, encoded...)
+	return nil
+}
+
+func (ms *MemoryUserEventStore) Replay(ctx context.Context, afterSeq uint64, fn func(*UserEvent) error) error {
+	ms.mu.Lock()
+	var events [][]byte
+	if afterSeq < uint64(len(ms.events)) {
+		events = append(events, ms.events[afterSeq:]...)
+	}
+	ms.mu.Unlock()
+
+	return replayUserEvents(ctx, bytes.NewReader(bytes.Join(events, []byte("\n"))), afterSeq, fn)
+}
+
+// FileUserEventStore keeps events as JSON lines in an append-only file.
+type FileUserEventStore struct {
+	path string
+
+	mu   sync.Mutex
+	file *os.File
+	seq  uint64
+}
+
+func OpenFileUserEventStore(path string) (*FileUserEventStore, error) {
+	fs := &FileUserEventStore{
+		path: path,
+	}
+
+	// Find the last sequence number so appends continue from it.
+	err := fs.Replay(context.Background(), 0, func(e *UserEvent) error {
+		fs.seq = e.Seq
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	fs.file, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return fs, nil
+}
+
+func (fs *FileUserEventStore) Append(ctx context.Context, events []*UserEvent) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	var buf bytes.Buffer
+	for i, e := range events {
+		e.Seq = fs.seq + uint64(i) + 1
+		line, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		buf.Write(append(line, '\n'))
+	}
+
+	// One write keeps a batch together, short of a crash mid write, which replay reports
+	_, err := fs.file.Write(buf.Bytes())
+	if err != nil {
+		return err
+	}
+	err = fs.file.Sync()
+	if err != nil {
+		return err
+	}
+	fs.seq += uint64(len(events))
+	return nil
+}
+
+func (fs *FileUserEventStore) Replay(ctx context.Context, afterSeq uint64, fn func(*UserEvent) error) error {
+	f, err := os.Open(fs.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return replayUserEvents(ctx, f, afterSeq, fn)
+}
+
+func (fs *FileUserEventStore) Close() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.file.Close()
+}
+
+func replayUserEvents(ctx context.Context, r io.Reader, afterSeq uint64, fn func(*UserEvent) error) error {
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, 1<<20)
+	for sc.Scan() {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if len(sc.Bytes()) == 0 {
+			continue
+		}
+
+		e := &UserEvent{}
+		err := json.Unmarshal(sc.Bytes(), e)
+		if err != nil {
+			return fmt.Errorf("Corrupt user event: %v", err)
+		}
+		if e.Seq <= afterSeq {
+			continue
+		}
+
+		err = fn(e)
+		if err != nil {
+			return err
+		}
+	}
+	return sc.Err()
+}
+
+// UserSnapshot is every user as of the event numbered Seq.
+type UserSnapshot struct {
+	Seq   uint64  `json:"seq"`
+	Users []*User `json:"users"`
+}
+
+// UserSnapshotStore keeps the latest snapshot, so rebuilding the users only replays the events after it.
+type UserSnapshotStore interface {
+	// Load returns nil when no snapshot has been saved.
+	Load(ctx context.Context) (*UserSnapshot, error)
+	Save(ctx context.Context, snap *UserSnapshot) error
+}
+
+type MemoryUserSnapshotStore struct {
+	mu   sync.Mutex
+	snap []byte
+}
+
+func NewMemoryUserSnapshotStore() *MemoryUserSnapshotStore {
+	return &MemoryUserSnapshotStore{}
+}
+
+func (ms *MemoryUserSnapshotStore) Load(ctx context.Context) (*UserSnapshot, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if ms.snap == nil {
+		return nil, nil
+	}
+	snap := &UserSnapshot{}
+	return snap, json.Unmarshal(ms.snap, snap)
+}
+
+func (ms *MemoryUserSnapshotStore) Save(ctx context.Context, snap *UserSnapshot) error {
+	b, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.snap = b
+	return nil
+}
+
+// FileUserSnapshotStore keeps the snapshot in a JSON file, replaced atomically.
+type FileUserSnapshotStore struct {
+	path string
+	mu   sync.Mutex
+}
+
+func NewFileUserSnapshotStore(path string) *FileUserSnapshotStore {
+	return &FileUserSnapshotStore{
+		path: path,
+	}
+}
+
+func (fs *FileUserSnapshotStore) Load(ctx context.Context) (*UserSnapshot, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	b, err := os.ReadFile(fs.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	snap := &UserSnapshot{}
+	err = json.Unmarshal(b, snap)
+	if err != nil {
+		return nil, fmt.Errorf("Corrupt user snapshot: %v", err)
+	}
+	return snap, nil
+}
+
+func (fs *FileUserSnapshotStore) Save(ctx context.Context, snap *UserSnapshot) error {
+	b, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return writeFileAtomic(fs.path, b)
+}
+
+// EventSourcedUserStorage implements UserStorer by appending every change to an event
+// store. The current users are a projection of the events, held in memory and rebuilt
+// on open from the latest snapshot and the events after it. A snapshot is taken every
+// snapshotEvery events, so that rebuilding stays quick as the history grows.
+type EventSourcedUserStorage struct {
+	events        UserEventStore
+	snapshots     UserSnapshotStore
+	snapshotEvery int
+	clock         clock.Clock
+
+	// mu serializes writes, so events are checked against the projection they apply to
+	mu            sync.Mutex
+	state         *RepositoryUserStorage
+	seq           uint64
+	sinceSnapshot int
+	// projector is nil until Project is called
+	projector *Projector
+}
+
+// NewEventSourcedUserStorage rebuilds the users from snapshots and events.
+// A snapshotEvery of zero never takes snapshots.
+func NewEventSourcedUserStorage(ctx context.Context, events UserEventStore, snapshots UserSnapshotStore, snapshotEvery int, clk clock.Clock) (*EventSourcedUserStorage, error) {
+	es := &EventSourcedUserStorage{
+		events:        events,
+		snapshots:     snapshots,
+		snapshotEvery: snapshotEvery,
+		clock:         clk,
+		state:         NewMemoryUserStorage(),
+	}
+
+	snap, err := snapshots.Load(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if snap != nil {
+		for _, u := range snap.Users {
+			err = es.state.Save(ctx, u)
+			if err != nil {
+				return nil, err
+			}
+		}
+		es.seq = snap.Seq
+	}
+
+	err = events.Replay(ctx, es.seq, func(e *UserEvent) error {
+		es.sinceSnapshot++
+		es.seq = e.Seq
+		return es.apply(ctx, e)
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	return es, nil
+}
+
+// Project catches p up with every event recorded so far, then feeds it every new one.
+// Its checkpoint is saved with each snapshot and on Close.
+func (es *EventSourcedUserStorage) Project(ctx context.Context, p *Projector) error {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+
+	err := p.CatchUp(ctx, es.events)
+	if err != nil {
+		return err
+	}
+	es.projector = p
+	return nil
+}
+
+// Projector returns the projector fed by Project, or nil.
+func (es *EventSourcedUserStorage) Projector() *Projector {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	return es.projector
+}
+
+// apply projects one event onto the current users.
+func (es *EventSourcedUserStorage) apply(ctx context.Context, e *UserEvent) error {
+	switch e.Type {
+	case UserEventRegistered, UserEventUpdated:
+		return es.state.Save(ctx, e.User)
+	case UserEventDeleted:
+		_, err := es.state.Delete(ctx, []Email{e.Email})
+		return err
+	}
+	return fmt.Errorf("User event %d has unknown type %q", e.Seq, e.Type)
+}
+
+func (es *EventSourcedUserStorage) Get(ctx context.Context, email Email) (*User, error) {
+	return es.state.Get(ctx, email)
+}
+
+func (es *EventSourcedUserStorage) GetByUsername(ctx context.Context, username Username) (*User, error) {
+	return es.state.GetByUsername(ctx, username)
+}
+
+func (es *EventSourcedUserStorage) List(ctx context.Context, sel LabelSelector) ([]*User, error) {
+	return es.state.List(ctx, sel)
+}
+
+func (es *EventSourcedUserStorage) ListFiltered(ctx context.Context, sel LabelSelector, f Filter) ([]*User, error) {
+	return es.state.ListFiltered(ctx, sel, f)
+}
+
+func (es *EventSourcedUserStorage) Save(ctx context.Context, user *User) error {
+	return es.save(ctx, user, false)
+}
+
+func (es *EventSourcedUserStorage) Insert(ctx context.Context, user *User) error {
+	return es.save(ctx, user, true)
+}
+
+// save records user as registered or updated, refusing an existing user when insert is set.
+func (es *EventSourcedUserStorage) save(ctx context.Context, user *User, insert bool) error {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+
+	// Refuse before recording, so the history holds no event the projection would refuse
+	if !user.Username.IsZero() {
+		owner, err := es.state.GetByUsername(ctx, user.Username)
+		if err == nil && owner.Email != user.Email {
+			return ErrUsernameTaken
+		} else if err != nil && err != ErrUserNotFound {
+			return err
+		}
+	}
+
+	typ := UserEventUpdated
+	_, err := es.state.Get(ctx, user.Email)
+	if err == ErrUserNotFound {
+		typ = UserEventRegistered
+	} else if err != nil {
+		return err
+	} else if insert {
+		return ErrEmailExists
+	}
+
+	return es.record(ctx, []*UserEvent{{
+		Type:  typ,
+		Email: user.Email,
+		At:    es.clock.Now().UTC(),
+		User:  user,
+	}})
+}
+
+func (es *EventSourcedUserStorage) Delete(ctx context.Context, emails []Email) (int, error) {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+
+	now := es.clock.Now().UTC()
+	var events []*UserEvent
+	seen := map[Email]bool{}
+	for _, email := range emails {
+		if seen[email] {
+			continue
+		}
+		seen[email] = true
+		_, err := es.state.Get(ctx, email)
+		if err == ErrUserNotFound {
+			continue
+		} else if err != nil {
+			return 0, err
+		}
+		events = append(events, &UserEvent{
+			Type:  UserEventDeleted,
+			Email: email,
+			At:    now,
+		})
+	}
+	if len(events) == 0 {
+		return 0, nil
+	}
+
+	err := es.record(ctx, events)
+	if err != nil {
+		return 0, err
+	}
+	return len(events), nil
+}
+
+// record appends events and projects them. The caller must hold mu.
+func (es *EventSourcedUserStorage) record(ctx context.Context, events []*UserEvent) error {
+	err := es.events.Append(ctx, events)
+	if err != nil {
+		return err
+	}
+	for _, e := range events {
+		err = es.apply(ctx, e)
+		if err != nil {
+			return err
+		}
+		if es.projector != nil {
+			es.projector.Apply(e)
+		}
+		es.seq = e.Seq
+	}
+
+	es.sinceSnapshot += len(events)
+	if es.snapshotEvery > 0 && es.sinceSnapshot >= es.snapshotEvery {
+		es.snapshot(ctx)
+	}
+	return nil
+}
+
+// snapshot saves the current users. A failed snapshot only makes the next rebuild slower,
+// so it is retried after the next write rather than failing this one. The caller must hold mu.
+func (es *EventSourcedUserStorage) snapshot(ctx context.Context) {
+	users, err := es.state.List(ctx, LabelSelector{})
+	if err != nil {
+		return
+	}
+	if es.snapshots.Save(ctx, &UserSnapshot{Seq: es.seq, Users: users}) == nil {
+		es.sinceSnapshot = 0
+	}
+	if es.projector != nil {
+		_ = es.projector.Save()
+	}
+}
+
+// Close checkpoints the projections, and closes the event store when it can be closed.
+func (es *EventSourcedUserStorage) Close() error {
+	es.mu.Lock()
+	defer es.mu.Unlock()
+	if es.projector != nil {
+		err := es.projector.Save()
+		if err != nil {
+			return err
+		}
+	}
+	if c, ok := es.events.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+func init() {
+	RegisterStorage("eventsourced", func(cfg *Config) (UserStorer, error) {
+		ctx := context.Background()
+		if cfg.StorageDSN == "" {
+			es, err := NewEventSourcedUserStorage(ctx, NewMemoryUserEventStore(), NewMemoryUserSnapshotStore(), cfg.StorageSnapshotEvery, clock.Real)
+			if err != nil {
+				return nil, err
+			}
+			return es, es.Project(ctx, NewProjector("", DefaultUserProjections()...))
+		}
+
+		err := os.MkdirAll(cfg.StorageDSN, 0755)
+		if err != nil {
+			return nil, err
+		}
+		events, err := OpenFileUserEventStore(filepath.Join(cfg.StorageDSN, "events.jsonl"))
+		if err != nil {
+			return nil, err
+		}
+		snapshots := NewFileUserSnapshotStore(filepath.Join(cfg.StorageDSN, "snapshot.json"))
+		es, err := NewEventSourcedUserStorage(ctx, events, snapshots, cfg.StorageSnapshotEvery, clock.Real)
+		if err == nil {
+			err = es.Project(ctx, NewProjector(filepath.Join(cfg.StorageDSN, "projections.json"), DefaultUserProjections()...))
+		}
+		if err != nil {
+			events.Close()
+			return nil, err
+		}
+		return es, nil
+	})
+}
@@ -0,0 +1,363 @@
+package separation
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Business Logic
+// Filter is a parsed filter expression over users, such as
+//
+//	domain eq example.com and (created_at gt 2024-01-01 or labels.plan eq pro)
+//
+// It is a tree of FilterAnd, FilterOr and FilterCondition, which backends that can
+// filter natively walk to build their own query. A nil Filter matches every user.
+type Filter interface {
+	filterNode()
+}
+
+// FilterAnd matches users that both sides match.
+type FilterAnd struct {
+	Left, Right Filter
+}
+
+// FilterOr matches users that either side matches.
+type FilterOr struct {
+	Left, Right Filter
+}
+
+// FilterOp compares a field with a value.
+type FilterOp string
+
+const (
+	FilterEq FilterOp = "eq"
+	FilterNe FilterOp = "ne"
+	// FilterContains matches text fields holding the value, ignoring case.
+	FilterContains FilterOp = "contains"
+	// FilterGt matches timestamp fields after the value.
+	FilterGt FilterOp = "gt"
+)
+
+// FilterCondition compares one field of a user with a value. Field is one of the
+// filterFields, or labels.<key> for a label. Time is the parsed Value of timestamp fields.
+type FilterCondition struct {
+	Field string
+	Op    FilterOp
+	Value string
+	Time  time.Time
+}
+
+func (FilterAnd) filterNode()       {}
+func (FilterOr) filterNode()        {}
+func (FilterCondition) filterNode() {}
+
+type filterFieldKind int
+
+const (
+	filterText filterFieldKind = iota
+	filterTimestamp
+)
+
+// filterFields are the fields filters may compare, besides labels.
+var filterFields = map[string]filterFieldKind{
+	"email":        filterText,
+	"domain":       filterText,
+	"name":         filterText,
+	"username":     filterText,
+	"created_at":   filterTimestamp,
+	"updated_at":   filterTimestamp,
+	"last_seen_at": filterTimestamp,
+}
+
+const labelFieldPrefix = "labels."
+
+func filterFieldKindOf(field string) (filterFieldKind, bool) {
+	if strings.HasPrefix(field, labelFieldPrefix) {
+		return filterText, validateLabelKey(field[len(labelFieldPrefix):]) == nil
+	}
+	kind, ok := filterFields[field]
+	return kind, ok
+}
+
+// filterMaxDepth bounds nesting, so a hostile filter cannot exhaust the stack.
+const filterMaxDepth = 32
+
+type filterParser struct {
+	tokens []string
+	pos    int
+	depth  int
+}
+
+// ParseFilter reads a filter expression. Conditions are a field, an operator of eq, ne,
+// contains or gt, and a value, which is quoted when it holds spaces or parentheses.
+// They are combined with and, which binds tighter, or, and parentheses. Timestamps are
+// RFC 3339 times or dates. An empty expression returns a nil Filter.
+// It may return a ValidationError.
+func ParseFilter(s string) (Filter, error) {
+	tokens, err := lexFilter(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, nil
+	}
+
+	p := &filterParser{tokens: tokens}
+	f, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, NewValidationError(fmt.Sprintf("Filter has an unexpected %q", p.tokens[p.pos]))
+	}
+	return f, nil
+}
+
+// lexFilter splits a filter into words, quoted values with the quotes kept, and parentheses.
+func lexFilter(s string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(s); {
+		switch c := s[i]; {
+		case c == ' ' || c == '\t' || c == '\n':
+			i++
+		case c == '(' || c == ')':
+			tokens = append(tokens, string(c))
+			i++
+		case c == '"':
+			var b strings.Builder
+			b.WriteByte('"')
+			j := i + 1
+			for ; j < len(s) && s[j] != '"'; j++ {
+				if s[j] == '\\' && j+1 < len(s) {
+					j++
+				}
+				b.WriteByte(s[j])
+			}
+			if j == len(s) {
+				return nil, NewValidationError("Filter has an unterminated quote")
+			}
+			tokens = append(tokens, b.String())
+			i = j + 1
+		default:
+			j := i
+			for j < len(s) && !strings.ContainsRune(" \t\n()\"", rune(s[j])) {
+				j++
+			}
+			tokens = append(tokens, s[i:j])
+			i = j
+		}
+	}
+	return tokens, nil
+}
+
+func (p *filterParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *filterParser) next() (string, error) {
+	if p.pos >= len(p.tokens) {
+		return "", NewValidationError("Filter ends too soon")
+	}
+	p.pos++
+	return p.tokens[p.pos-1], nil
+}
+
+func (p *filterParser) or() (Filter, error) {
+	left, err := p.and()
+	if err != nil {
+		return nil, err
+	}
+	for strings.EqualFold(p.peek(), "or") {
+		p.pos++
+		right, err := p.and()
+		if err != nil {
+			return nil, err
+		}
+		left = FilterOr{Left: left, Right: right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) and() (Filter, error) {
+	left, err := p.term()
+	if err != nil {
+		return nil, err
+	}
+	for strings.EqualFold(p.peek(), "and") {
+		p.pos++
+		right, err := p.term()
+		if err != nil {
+			return nil, err
+		}
+		left = FilterAnd{Left: left, Right: right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) term() (Filter, error) {
+	if p.peek() == "(" {
+		p.pos++
+		p.depth++
+		if p.depth > filterMaxDepth {
+			return nil, NewValidationError("Filter is nested too deeply")
+		}
+		f, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if tok, _ := p.next(); tok != ")" {
+			return nil, NewValidationError("Filter is missing a closing parenthesis")
+		}
+		p.depth--
+		return f, nil
+	}
+	return p.condition()
+}
+
+func (p *filterParser) condition() (Filter, error) {
+	field, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	op, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	value, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	if value == "(" || value == ")" {
+		return nil, NewValidationError(fmt.Sprintf("Filter condition on %s is missing its value", field))
+	}
+	value = strings.TrimPrefix(value, `"`)
+
+	kind, ok := filterFieldKindOf(field)
+	if !ok {
+		return nil, NewValidationError(fmt.Sprintf("Cannot filter on %q", field))
+	}
+	c := FilterCondition{Field: field, Op: FilterOp(strings.ToLower(op)), Value: value}
+	switch {
+	case c.Op == FilterEq || c.Op == FilterNe:
+	case c.Op == FilterContains && kind == filterText:
+	case c.Op == FilterGt && kind == filterTimestamp:
+	default:
+		return nil, NewValidationError(fmt.Sprintf("Cannot filter %s with %q", field, op))
+	}
+	if kind == filterTimestamp {
+		c.Time, err = parseFilterTime(value)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func parseFilterTime(s string) (time.Time, error) {
+	t, err := time.Parse(time.RFC3339, s)
+	if err == nil {
+		return t, nil
+	}
+	t, err = time.Parse("2006-01-02", s)
+	if err == nil {
+		return t, nil
+	}
+	return time.Time{}, NewValidationError(fmt.Sprintf("%q must be an RFC 3339 time or a date", s))
+}
+
+// CompileFilter turns f into a predicate, the query of backends that filter in memory.
+func CompileFilter(f Filter) func(u *User) bool {
+	switch f := f.(type) {
+	case nil:
+		return func(*User) bool { return true }
+	case FilterAnd:
+		left, right := CompileFilter(f.Left), CompileFilter(f.Right)
+		return func(u *User) bool { return left(u) && right(u) }
+	case FilterOr:
+		left, right := CompileFilter(f.Left), CompileFilter(f.Right)
+		return func(u *User) bool { return left(u) || right(u) }
+	case FilterCondition:
+		return compileFilterCondition(f)
+	}
+	return func(*User) bool { return false }
+}
+
+func compileFilterCondition(c FilterCondition) func(u *User) bool {
+	if kind, _ := filterFieldKindOf(c.Field); kind == filterTimestamp {
+		get := map[string]func(u *User) *time.Time{
+			"created_at":   func(u *User) *time.Time { return &u.CreatedAt },
+			"updated_at":   func(u *User) *time.Time { return &u.UpdatedAt },
+			"last_seen_at": func(u *User) *time.Time { return u.LastSeenAt },
+		}[c.Field]
+		return func(u *User) bool {
+			t := get(u)
+			switch c.Op {
+			case FilterEq:
+				return t != nil && t.Equal(c.Time)
+			case FilterNe:
+				return t == nil || !t.Equal(c.Time)
+			}
+			return t != nil && t.After(c.Time)
+		}
+	}
+
+	get := func(u *User) string {
+		switch c.Field {
+		case "email":
+			return u.Email.String()
+		case "domain":
+			return u.Email.Domain()
+		case "name":
+			return u.Name
+		case "username":
+			return u.Username.String()
+		}
+		return u.Labels[c.Field[len(labelFieldPrefix):]]
+	}
+	value := c.Value
+	if c.Field == "email" || c.Field == "domain" {
+		value = strings.ToLower(value)
+	}
+	return func(u *User) bool {
+		switch c.Op {
+		case FilterEq:
+			return get(u) == value
+		case FilterNe:
+			return get(u) != value
+		}
+		return strings.Contains(strings.ToLower(get(u)), strings.ToLower(value))
+	}
+}
+
+// FilteringUserStorer is implemented by backends that filter users natively, such as by
+// compiling the filter to their query language.
+// The UserStorer decorators implement it too, passing the filter on to what they wrap.
+type FilteringUserStorer interface {
+	ListFiltered(ctx context.Context, sel LabelSelector, f Filter) ([]*User, error)
+}
+
+// listFiltered lists the users matching sel and f, natively when us can, and otherwise by
+// listing those matching sel and filtering them in memory.
+func listFiltered(ctx context.Context, us UserStorer, sel LabelSelector, f Filter) ([]*User, error) {
+	if fs, ok := us.(FilteringUserStorer); ok {
+		return fs.ListFiltered(ctx, sel, f)
+	}
+	users, err := us.List(ctx, sel)
+	if err != nil || f == nil {
+		return users, err
+	}
+
+	match := CompileFilter(f)
+	matched := users[:0]
+	for _, u := range users {
+		if match(u) {
+			matched = append(matched, u)
+		}
+	}
+	return matched, nil
+}
@@ -0,0 +1,79 @@
+package separation
+
+import (
+	"context"
+	"io"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/oralordos/separation/internal/clock"
+)
+
+// nativeFilterStorer counts the users listed natively and those listed for filtering in memory.
+type nativeFilterStorer struct {
+	*RepositoryUserStorage
+	lists, filtered int
+}
+
+func (ns *nativeFilterStorer) List(ctx context.Context, sel LabelSelector) ([]*User, error) {
+	ns.lists++
+	return ns.RepositoryUserStorage.List(ctx, sel)
+}
+
+func (ns *nativeFilterStorer) ListFiltered(ctx context.Context, sel LabelSelector, f Filter) ([]*User, error) {
+	ns.filtered++
+	return ns.RepositoryUserStorage.ListFiltered(ctx, sel, f)
+}
+
+// TestDecoratorsPassFiltersThrough wraps a backend that filters natively in every
+// UserStorer decorator, and checks a filtered list still reaches the backend as one.
+func TestDecoratorsPassFiltersThrough(t *testing.T) {
+	ctx := context.Background()
+	backend := &nativeFilterStorer{RepositoryUserStorage: NewMemoryUserStorage()}
+	a, _ := ParseEmail("a@example.com")
+	b, _ := ParseEmail("b@example.org")
+	for _, email := range []Email{a, b} {
+		err := backend.Save(ctx, &User{Email: email})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	log, err := OpenFileChangeLog(filepath.Join(t.TempDir(), "changes.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer log.Close()
+	bloom, err := NewBloomUserStorage(ctx, backend, EmailsFromStorage(backend), 100, 0.01, time.Hour, func(err error) {
+		t.Error(err)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bloom.Close()
+
+	// Building the bloom filter lists every user
+	backend.lists = 0
+
+	var us UserStorer = bloom
+	us = NewChangeLogger(us, log, clock.Real)
+	us = NewCachingUserStorage(us, time.Minute, clock.Real)
+	us = NewSlowQueryLogger(us, time.Hour, NewSlowCallLog(10))
+	us = NewInstrumentedUserStorer(us, "users", NewLogStorageObserver(io.Discard))
+
+	f, err := ParseFilter("domain eq example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	users, err := listFiltered(ctx, us, LabelSelector{}, f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 1 || users[0].Email != a {
+		t.Errorf("Listed %v, want only %s", users, a)
+	}
+	if backend.filtered != 1 || backend.lists != 0 {
+		t.Errorf("The backend filtered %d times and listed %d times, want it to filter once", backend.filtered, backend.lists)
+	}
+}
@@ -1,3 +1,5 @@
 module github.com/oralordos/separation
 
-go 1.13
+go 1.18
+
+require golang.org/x/text v0.14.0
@@ -0,0 +1,73 @@
+package separation
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/oralordos/separation/internal/ctxkeys"
+)
+
+// Access Layer
+// Hooks let an embedder feed the access layer's requests into their own telemetry
+// without wrapping or forking it. Any hook left nil is skipped.
+// Hooks run on the request's goroutine, so they should return quickly.
+type Hooks struct {
+	// OnRequestStart runs before the request is routed.
+	OnRequestStart func(r *http.Request)
+	// OnRequestEnd runs after the response is written, including after a panic.
+	OnRequestEnd func(r *http.Request, status int, elapsed time.Duration)
+	// OnError runs whenever a handler responds with an error, with the code it was mapped to.
+	OnError func(r *http.Request, err error, info ErrorInfo)
+	// OnPanic runs when a handler panics. The panic is recovered and answered with 500,
+	// rather than left to net/http, only when OnPanic is set.
+	OnPanic func(r *http.Request, recovered interface{})
+}
+
+var hooksKey = ctxkeys.New[*Hooks]("hooks")
+
+func hooksFromContext(ctx context.Context) *Hooks {
+	h, _ := hooksKey.From(ctx)
+	return h
+}
+
+// serveWithHooks runs next with the hooks in place. The hooks travel in the request's
+// context so writeError can find OnError from any handler.
+func serveWithHooks(h *Hooks, next http.Handler, w http.ResponseWriter, r *http.Request) {
+	if h.OnRequestStart == nil && h.OnRequestEnd == nil && h.OnError == nil && h.OnPanic == nil {
+		next.ServeHTTP(w, r)
+		return
+	}
+
+	start := time.Now()
+	r = r.WithContext(hooksKey.With(r.Context(), h))
+	rec := NewStatusRecorder(w)
+
+	if h.OnRequestStart != nil {
+		h.OnRequestStart(r)
+	}
+
+	defer func() {
+		if h.OnPanic != nil {
+			if p := recover(); p != nil {
+				if p == http.ErrAbortHandler {
+					panic(p)
+				}
+				h.OnPanic(r, p)
+				if rec.status == 0 {
+					writeError(rec, r, errPanicked)
+				}
+			}
+		}
+
+		if h.OnRequestEnd != nil {
+			h.OnRequestEnd(r, rec.Status(), time.Since(start))
+		}
+	}()
+
+	next.ServeHTTP(rec, r)
+}
+
+// errPanicked is reported in place of a recovered panic, so its details do not leak to the client.
+var errPanicked = errors.New("Internal server error")
@@ -0,0 +1,90 @@
+// Package http3 serves the JSON access layer over HTTP/3, for clients on lossy networks.
+// It is a module of its own, so the quic-go dependency and the Go version it needs
+// are only taken on by programs that import it:
+//
+//	import _ "github.com/oralordos/separation/http3"
+//
+// Importing it registers the http3 transport, started when HTTP3_LISTEN is set.
+package http3
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+
+	"github.com/oralordos/separation"
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+func init() {
+	separation.RegisterTransport("http3", newTransport)
+}
+
+// Transport serves a handler over HTTP/3 on a UDP address.
+type Transport struct {
+	server  *http3.Server
+	closers []io.Closer
+}
+
+// NewTransport serves handler on addr with tlsConfig, which must include the server certificate.
+// Early data is refused, as a request sent in it could be replayed by an attacker.
+func NewTransport(addr string, handler http.Handler, tlsConfig *tls.Config, closers ...io.Closer) *Transport {
+	return &Transport{
+		server: &http3.Server{
+			Addr:       addr,
+			Handler:    handler,
+			TLSConfig:  tlsConfig,
+			QUICConfig: &quic.Config{Allow0RTT: false},
+		},
+		closers: closers,
+	}
+}
+
+func newTransport(deps *separation.TransportDeps) (separation.Transport, error) {
+	cfg := deps.Config
+	if cfg.HTTP3Listen == "" || cfg.HTTP3CertFile == "" || cfg.HTTP3KeyFile == "" {
+		return nil, fmt.Errorf("HTTP3_LISTEN, HTTP3_CERT_FILE and HTTP3_KEY_FILE must be set")
+	}
+
+	cert, err := tls.LoadX509KeyPair(cfg.HTTP3CertFile, cfg.HTTP3KeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	handler, closers, err := separation.JSONOverHTTPHandler(deps)
+	if err != nil {
+		return nil, err
+	}
+	return NewTransport(cfg.HTTP3Listen, handler, &tls.Config{Certificates: []tls.Certificate{cert}}, closers...), nil
+}
+
+// Start opens the UDP socket itself and closes it once serving stops, as the server
+// does not close sockets it is given.
+func (t *Transport) Start(ctx context.Context) error {
+	conn, err := net.ListenPacket("udp", t.server.Addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	err = t.server.Serve(conn)
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+func (t *Transport) Shutdown(ctx context.Context) error {
+	err := t.server.Shutdown(ctx)
+	for _, c := range t.closers {
+		cerr := c.Close()
+		if err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
@@ -0,0 +1,81 @@
+package separation
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+//go:generate go run ./internal/cmd/instrumentgen -type UserStorer,PreferencesStorer,InviteStorer,PolicyStorer,OrgStorer,OrgTokenStorer,MaintenanceStorer,IPRuleStorer -o instrumented.go
+
+// Action Layer
+// StorageObserver is told about every call made through an instrumented storage decorator.
+// Instrumented decorators are generated by internal/cmd/instrumentgen, so adding a store
+// to the go:generate line is all it takes to instrument it.
+type StorageObserver interface {
+	ObserveStorageCall(ctx context.Context, store, op string, start time.Time, err error)
+}
+
+// StorageObservers tells every observer in it about each call.
+type StorageObservers []StorageObserver
+
+func (so StorageObservers) ObserveStorageCall(ctx context.Context, store, op string, start time.Time, err error) {
+	for _, o := range so {
+		o.ObserveStorageCall(ctx, store, op, start, err)
+	}
+}
+
+// LogStorageObserver writes a line for every storage call.
+type LogStorageObserver struct {
+	mu  sync.Mutex
+	out io.Writer
+}
+
+func NewLogStorageObserver(out io.Writer) *LogStorageObserver {
+	return &LogStorageObserver{
+		out: out,
+	}
+}
+
+func (lo *LogStorageObserver) ObserveStorageCall(ctx context.Context, store, op string, start time.Time, err error) {
+	line := fmt.Sprintf("store=%s op=%s start=%s duration=%s", store, op, start.UTC().Format(time.RFC3339Nano), time.Since(start))
+	if err != nil {
+		line += fmt.Sprintf(" error=%q", err.Error())
+	}
+
+	lo.mu.Lock()
+	defer lo.mu.Unlock()
+	// A failing log must never fail the call itself.
+	_, _ = fmt.Fprintln(lo.out, line)
+}
+
+var (
+	storageCalls      = expvar.NewMap("storage_calls")
+	storageCallErrors = expvar.NewMap("storage_call_errors")
+	storageCallNanos  = expvar.NewMap("storage_call_ns")
+)
+
+// MetricsStorageObserver counts calls, errors and time spent per store and operation,
+// published through expvar as storage_calls, storage_call_errors and storage_call_ns.
+type MetricsStorageObserver struct{}
+
+func (MetricsStorageObserver) ObserveStorageCall(ctx context.Context, store, op string, start time.Time, err error) {
+	key := store + "." + op
+	storageCalls.Add(key, 1)
+	storageCallNanos.Add(key, int64(time.Since(start)))
+	if err != nil {
+		storageCallErrors.Add(key, 1)
+	}
+}
+
+// ListFiltered passes filters through to the backend, so a backend that filters natively
+// still does when instrumented. The generator only covers the methods of UserStorer.
+func (i *InstrumentedUserStorer) ListFiltered(ctx context.Context, sel LabelSelector, f Filter) ([]*User, error) {
+	start := time.Now()
+	users, err := listFiltered(ctx, i.next, sel, f)
+	i.obs.ObserveStorageCall(ctx, i.store, "ListFiltered", start, err)
+	return users, err
+}
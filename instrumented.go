@@ -0,0 +1,300 @@
+// Code generated by instrumentgen -type UserStorer,PreferencesStorer,InviteStorer,PolicyStorer,OrgStorer,OrgTokenStorer,MaintenanceStorer,IPRuleStorer. DO NOT EDIT.
+
+package separation
+
+import (
+	"context"
+	"time"
+)
+
+// InstrumentedIPRuleStorer reports every call through its IPRuleStorer to a StorageObserver.
+type InstrumentedIPRuleStorer struct {
+	next  IPRuleStorer
+	store string
+	obs   StorageObserver
+}
+
+// NewInstrumentedIPRuleStorer reports the calls to next as made to store.
+func NewInstrumentedIPRuleStorer(next IPRuleStorer, store string, obs StorageObserver) *InstrumentedIPRuleStorer {
+	return &InstrumentedIPRuleStorer{next: next, store: store, obs: obs}
+}
+
+func (i *InstrumentedIPRuleStorer) Get(ctx context.Context) (*IPRules, error) {
+	start := time.Now()
+	r0, r1 := i.next.Get(ctx)
+	i.obs.ObserveStorageCall(ctx, i.store, "Get", start, r1)
+	return r0, r1
+}
+
+func (i *InstrumentedIPRuleStorer) Save(ctx context.Context, rules *IPRules) error {
+	start := time.Now()
+	r0 := i.next.Save(ctx, rules)
+	i.obs.ObserveStorageCall(ctx, i.store, "Save", start, r0)
+	return r0
+}
+
+// InstrumentedInviteStorer reports every call through its InviteStorer to a StorageObserver.
+type InstrumentedInviteStorer struct {
+	next  InviteStorer
+	store string
+	obs   StorageObserver
+}
+
+// NewInstrumentedInviteStorer reports the calls to next as made to store.
+func NewInstrumentedInviteStorer(next InviteStorer, store string, obs StorageObserver) *InstrumentedInviteStorer {
+	return &InstrumentedInviteStorer{next: next, store: store, obs: obs}
+}
+
+func (i *InstrumentedInviteStorer) Get(ctx context.Context, id string) (*Invite, error) {
+	start := time.Now()
+	r0, r1 := i.next.Get(ctx, id)
+	i.obs.ObserveStorageCall(ctx, i.store, "Get", start, r1)
+	return r0, r1
+}
+
+func (i *InstrumentedInviteStorer) GetByToken(ctx context.Context, tokenHash string) (*Invite, error) {
+	start := time.Now()
+	r0, r1 := i.next.GetByToken(ctx, tokenHash)
+	i.obs.ObserveStorageCall(ctx, i.store, "GetByToken", start, r1)
+	return r0, r1
+}
+
+func (i *InstrumentedInviteStorer) Save(ctx context.Context, invite *Invite) error {
+	start := time.Now()
+	r0 := i.next.Save(ctx, invite)
+	i.obs.ObserveStorageCall(ctx, i.store, "Save", start, r0)
+	return r0
+}
+
+func (i *InstrumentedInviteStorer) List(ctx context.Context) ([]*Invite, error) {
+	start := time.Now()
+	r0, r1 := i.next.List(ctx)
+	i.obs.ObserveStorageCall(ctx, i.store, "List", start, r1)
+	return r0, r1
+}
+
+// InstrumentedMaintenanceStorer reports every call through its MaintenanceStorer to a StorageObserver.
+type InstrumentedMaintenanceStorer struct {
+	next  MaintenanceStorer
+	store string
+	obs   StorageObserver
+}
+
+// NewInstrumentedMaintenanceStorer reports the calls to next as made to store.
+func NewInstrumentedMaintenanceStorer(next MaintenanceStorer, store string, obs StorageObserver) *InstrumentedMaintenanceStorer {
+	return &InstrumentedMaintenanceStorer{next: next, store: store, obs: obs}
+}
+
+func (i *InstrumentedMaintenanceStorer) Get(ctx context.Context) (*MaintenanceState, error) {
+	start := time.Now()
+	r0, r1 := i.next.Get(ctx)
+	i.obs.ObserveStorageCall(ctx, i.store, "Get", start, r1)
+	return r0, r1
+}
+
+func (i *InstrumentedMaintenanceStorer) Save(ctx context.Context, state *MaintenanceState) error {
+	start := time.Now()
+	r0 := i.next.Save(ctx, state)
+	i.obs.ObserveStorageCall(ctx, i.store, "Save", start, r0)
+	return r0
+}
+
+// InstrumentedOrgStorer reports every call through its OrgStorer to a StorageObserver.
+type InstrumentedOrgStorer struct {
+	next  OrgStorer
+	store string
+	obs   StorageObserver
+}
+
+// NewInstrumentedOrgStorer reports the calls to next as made to store.
+func NewInstrumentedOrgStorer(next OrgStorer, store string, obs StorageObserver) *InstrumentedOrgStorer {
+	return &InstrumentedOrgStorer{next: next, store: store, obs: obs}
+}
+
+func (i *InstrumentedOrgStorer) Get(ctx context.Context, id string) (*Organization, error) {
+	start := time.Now()
+	r0, r1 := i.next.Get(ctx, id)
+	i.obs.ObserveStorageCall(ctx, i.store, "Get", start, r1)
+	return r0, r1
+}
+
+func (i *InstrumentedOrgStorer) Save(ctx context.Context, org *Organization) error {
+	start := time.Now()
+	r0 := i.next.Save(ctx, org)
+	i.obs.ObserveStorageCall(ctx, i.store, "Save", start, r0)
+	return r0
+}
+
+func (i *InstrumentedOrgStorer) GetMembership(ctx context.Context, orgID string, email Email) (*Membership, error) {
+	start := time.Now()
+	r0, r1 := i.next.GetMembership(ctx, orgID, email)
+	i.obs.ObserveStorageCall(ctx, i.store, "GetMembership", start, r1)
+	return r0, r1
+}
+
+func (i *InstrumentedOrgStorer) SaveMembership(ctx context.Context, m *Membership) error {
+	start := time.Now()
+	r0 := i.next.SaveMembership(ctx, m)
+	i.obs.ObserveStorageCall(ctx, i.store, "SaveMembership", start, r0)
+	return r0
+}
+
+func (i *InstrumentedOrgStorer) DeleteMembership(ctx context.Context, orgID string, email Email) error {
+	start := time.Now()
+	r0 := i.next.DeleteMembership(ctx, orgID, email)
+	i.obs.ObserveStorageCall(ctx, i.store, "DeleteMembership", start, r0)
+	return r0
+}
+
+func (i *InstrumentedOrgStorer) Members(ctx context.Context, orgID string) ([]*Membership, error) {
+	start := time.Now()
+	r0, r1 := i.next.Members(ctx, orgID)
+	i.obs.ObserveStorageCall(ctx, i.store, "Members", start, r1)
+	return r0, r1
+}
+
+func (i *InstrumentedOrgStorer) MembershipsOf(ctx context.Context, email Email) ([]*Membership, error) {
+	start := time.Now()
+	r0, r1 := i.next.MembershipsOf(ctx, email)
+	i.obs.ObserveStorageCall(ctx, i.store, "MembershipsOf", start, r1)
+	return r0, r1
+}
+
+// InstrumentedOrgTokenStorer reports every call through its OrgTokenStorer to a StorageObserver.
+type InstrumentedOrgTokenStorer struct {
+	next  OrgTokenStorer
+	store string
+	obs   StorageObserver
+}
+
+// NewInstrumentedOrgTokenStorer reports the calls to next as made to store.
+func NewInstrumentedOrgTokenStorer(next OrgTokenStorer, store string, obs StorageObserver) *InstrumentedOrgTokenStorer {
+	return &InstrumentedOrgTokenStorer{next: next, store: store, obs: obs}
+}
+
+func (i *InstrumentedOrgTokenStorer) Get(ctx context.Context, id string) (*OrgToken, error) {
+	start := time.Now()
+	r0, r1 := i.next.Get(ctx, id)
+	i.obs.ObserveStorageCall(ctx, i.store, "Get", start, r1)
+	return r0, r1
+}
+
+func (i *InstrumentedOrgTokenStorer) Save(ctx context.Context, token *OrgToken) error {
+	start := time.Now()
+	r0 := i.next.Save(ctx, token)
+	i.obs.ObserveStorageCall(ctx, i.store, "Save", start, r0)
+	return r0
+}
+
+func (i *InstrumentedOrgTokenStorer) ListOrg(ctx context.Context, orgID string) ([]*OrgToken, error) {
+	start := time.Now()
+	r0, r1 := i.next.ListOrg(ctx, orgID)
+	i.obs.ObserveStorageCall(ctx, i.store, "ListOrg", start, r1)
+	return r0, r1
+}
+
+// InstrumentedPolicyStorer reports every call through its PolicyStorer to a StorageObserver.
+type InstrumentedPolicyStorer struct {
+	next  PolicyStorer
+	store string
+	obs   StorageObserver
+}
+
+// NewInstrumentedPolicyStorer reports the calls to next as made to store.
+func NewInstrumentedPolicyStorer(next PolicyStorer, store string, obs StorageObserver) *InstrumentedPolicyStorer {
+	return &InstrumentedPolicyStorer{next: next, store: store, obs: obs}
+}
+
+func (i *InstrumentedPolicyStorer) Get(ctx context.Context) (*RegistrationPolicy, error) {
+	start := time.Now()
+	r0, r1 := i.next.Get(ctx)
+	i.obs.ObserveStorageCall(ctx, i.store, "Get", start, r1)
+	return r0, r1
+}
+
+func (i *InstrumentedPolicyStorer) Save(ctx context.Context, policy *RegistrationPolicy) error {
+	start := time.Now()
+	r0 := i.next.Save(ctx, policy)
+	i.obs.ObserveStorageCall(ctx, i.store, "Save", start, r0)
+	return r0
+}
+
+// InstrumentedPreferencesStorer reports every call through its PreferencesStorer to a StorageObserver.
+type InstrumentedPreferencesStorer struct {
+	next  PreferencesStorer
+	store string
+	obs   StorageObserver
+}
+
+// NewInstrumentedPreferencesStorer reports the calls to next as made to store.
+func NewInstrumentedPreferencesStorer(next PreferencesStorer, store string, obs StorageObserver) *InstrumentedPreferencesStorer {
+	return &InstrumentedPreferencesStorer{next: next, store: store, obs: obs}
+}
+
+func (i *InstrumentedPreferencesStorer) Get(ctx context.Context, email Email) (*UserPreferences, error) {
+	start := time.Now()
+	r0, r1 := i.next.Get(ctx, email)
+	i.obs.ObserveStorageCall(ctx, i.store, "Get", start, r1)
+	return r0, r1
+}
+
+func (i *InstrumentedPreferencesStorer) Save(ctx context.Context, prefs *UserPreferences) error {
+	start := time.Now()
+	r0 := i.next.Save(ctx, prefs)
+	i.obs.ObserveStorageCall(ctx, i.store, "Save", start, r0)
+	return r0
+}
+
+// InstrumentedUserStorer reports every call through its UserStorer to a StorageObserver.
+type InstrumentedUserStorer struct {
+	next  UserStorer
+	store string
+	obs   StorageObserver
+}
+
+// NewInstrumentedUserStorer reports the calls to next as made to store.
+func NewInstrumentedUserStorer(next UserStorer, store string, obs StorageObserver) *InstrumentedUserStorer {
+	return &InstrumentedUserStorer{next: next, store: store, obs: obs}
+}
+
+func (i *InstrumentedUserStorer) Get(ctx context.Context, email Email) (*User, error) {
+	start := time.Now()
+	r0, r1 := i.next.Get(ctx, email)
+	i.obs.ObserveStorageCall(ctx, i.store, "Get", start, r1)
+	return r0, r1
+}
+
+func (i *InstrumentedUserStorer) GetByUsername(ctx context.Context, username Username) (*User, error) {
+	start := time.Now()
+	r0, r1 := i.next.GetByUsername(ctx, username)
+	i.obs.ObserveStorageCall(ctx, i.store, "GetByUsername", start, r1)
+	return r0, r1
+}
+
+func (i *InstrumentedUserStorer) Save(ctx context.Context, user *User) error {
+	start := time.Now()
+	r0 := i.next.Save(ctx, user)
+	i.obs.ObserveStorageCall(ctx, i.store, "Save", start, r0)
+	return r0
+}
+
+func (i *InstrumentedUserStorer) Insert(ctx context.Context, user *User) error {
+	start := time.Now()
+	r0 := i.next.Insert(ctx, user)
+	i.obs.ObserveStorageCall(ctx, i.store, "Insert", start, r0)
+	return r0
+}
+
+func (i *InstrumentedUserStorer) List(ctx context.Context, sel LabelSelector) ([]*User, error) {
+	start := time.Now()
+	r0, r1 := i.next.List(ctx, sel)
+	i.obs.ObserveStorageCall(ctx, i.store, "List", start, r1)
+	return r0, r1
+}
+
+func (i *InstrumentedUserStorer) Delete(ctx context.Context, emails []Email) (int, error) {
+	start := time.Now()
+	r0, r1 := i.next.Delete(ctx, emails)
+	i.obs.ObserveStorageCall(ctx, i.store, "Delete", start, r1)
+	return r0, r1
+}
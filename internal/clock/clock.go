@@ -0,0 +1,19 @@
+// Package clock lets the business logic read the time through an interface,
+// so expiry and timestamps can be controlled in tests with clocktest.
+package clock
+
+import "time"
+
+// Clock tells the current time.
+type Clock interface {
+	Now() time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+// Real is the system clock.
+var Real Clock = realClock{}
@@ -0,0 +1,308 @@
+// Command fakegen writes fakes of a package's interfaces into another package, so tests
+// need not hand roll their own. Each fake has a func field per method, named after the
+// method with a Func suffix, which the method calls. A method whose field is not set
+// panics, so a test only sets what it expects to be called. It is run by go generate
+// in the package the fakes are written to:
+//
+//	//go:generate go run ../cmd/fakegen -src ../.. -import github.com/oralordos/separation -type UserStorer -o fakes.go
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+func main() {
+	src := flag.String("src", ".", "directory of the package declaring the interfaces")
+	importPath := flag.String("import", "", "import path of that package")
+	typeList := flag.String("type", "", "comma separated interfaces to fake")
+	out := flag.String("o", "fakes.go", "file to write")
+	flag.Parse()
+
+	g := &generator{
+		srcPkg:  path.Base(*importPath),
+		imports: map[string]string{},
+		used:    map[string]bool{"sync": true, *importPath: true},
+	}
+	err := g.run(*src, strings.Split(*typeList, ","), *out)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "fakegen:", err)
+		os.Exit(1)
+	}
+}
+
+type generator struct {
+	// srcPkg is the name the faked package is imported as
+	srcPkg string
+	// imports maps the names the faked package imports packages as to their paths
+	imports map[string]string
+	// used are the import paths the fakes refer to
+	used map[string]bool
+}
+
+func (g *generator) run(dir string, names []string, out string) error {
+	fset := token.NewFileSet()
+	pkgs, err := parser.ParseDir(fset, dir, func(fi os.FileInfo) bool {
+		return !strings.HasSuffix(fi.Name(), "_test.go")
+	}, 0)
+	if err != nil {
+		return err
+	}
+	if len(pkgs) != 1 {
+		return fmt.Errorf("Expected one package in %s, found %d", dir, len(pkgs))
+	}
+
+	ifaces := map[string]*ast.InterfaceType{}
+	for _, pkg := range pkgs {
+		for _, f := range pkg.Files {
+			for _, imp := range f.Imports {
+				p, _ := strconv.Unquote(imp.Path.Value)
+				name := path.Base(p)
+				if imp.Name != nil {
+					name = imp.Name.Name
+				}
+				g.imports[name] = p
+			}
+			ast.Inspect(f, func(n ast.Node) bool {
+				if ts, ok := n.(*ast.TypeSpec); ok {
+					if it, ok := ts.Type.(*ast.InterfaceType); ok {
+						ifaces[ts.Name.Name] = it
+					}
+				}
+				return true
+			})
+		}
+	}
+
+	var body bytes.Buffer
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		it, ok := ifaces[name]
+		if !ok {
+			return fmt.Errorf("No interface named %s", name)
+		}
+		err = g.writeFake(&body, name, it)
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+	}
+
+	paths := make([]string, 0, len(g.used))
+	for p := range g.used {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "// Code generated by fakegen -type %s. DO NOT EDIT.\n\n", strings.Join(names, ","))
+	pkgName, err := outPackage(out)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(&buf, "package %s\n\nimport (\n", pkgName)
+	// The standard library comes first, then everything else
+	for _, std := range []bool{true, false} {
+		for _, p := range paths {
+			if !strings.Contains(strings.Split(p, "/")[0], ".") == std {
+				fmt.Fprintf(&buf, "\t%q\n", p)
+			}
+		}
+		if std {
+			fmt.Fprintf(&buf, "\n")
+		}
+	}
+	fmt.Fprintf(&buf, ")\n\n")
+	fmt.Fprintf(&buf, `// calls counts the calls made to a fake, by method.
+type calls struct {
+	mu sync.Mutex
+	n  map[string]int
+}
+
+func (c *calls) record(method string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.n == nil {
+		c.n = map[string]int{}
+	}
+	c.n[method]++
+}
+
+// Calls returns how many times method has been called.
+func (c *calls) Calls(method string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.n[method]
+}
+`)
+	buf.Write(body.Bytes())
+
+	src, err := format.Source(buf.Bytes())
+	if err != nil {
+		return fmt.Errorf("Generated code does not parse: %v", err)
+	}
+	return ioutil.WriteFile(out, src, 0644)
+}
+
+// outPackage names the package of out after the directory it is written to.
+func outPackage(out string) (string, error) {
+	dir, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+	return path.Base(path.Dir(path.Join(dir, out))), nil
+}
+
+func (g *generator) writeFake(buf *bytes.Buffer, name string, it *ast.InterfaceType) error {
+	type method struct {
+		name, params, args, results string
+		returns                     bool
+	}
+	var methods []method
+	for _, m := range it.Methods.List {
+		ft, ok := m.Type.(*ast.FuncType)
+		if !ok || len(m.Names) != 1 {
+			return fmt.Errorf("embeds %s, list its methods instead", types.ExprString(m.Type))
+		}
+		params, args, err := g.params(ft.Params)
+		if err != nil {
+			return err
+		}
+		results, err := g.results(ft.Results)
+		if err != nil {
+			return err
+		}
+		methods = append(methods, method{m.Names[0].Name, params, args, results, ft.Results != nil && len(ft.Results.List) > 0})
+	}
+
+	fmt.Fprintf(buf, "\n// %s is a fake %s.%s.\ntype %s struct {\n\tcalls\n\n", name, g.srcPkg, name, name)
+	for _, m := range methods {
+		fmt.Fprintf(buf, "\t%sFunc func(%s) %s\n", m.name, m.params, m.results)
+	}
+	fmt.Fprintf(buf, "}\n\nvar _ %s.%s = (*%s)(nil)\n", g.srcPkg, name, name)
+
+	for _, m := range methods {
+		fmt.Fprintf(buf, "\nfunc (f *%s) %s(%s) %s {\n", name, m.name, m.params, m.results)
+		fmt.Fprintf(buf, "\tf.record(%q)\n", m.name)
+		fmt.Fprintf(buf, "\tif f.%sFunc == nil {\n\t\tpanic(\"%s.%s called, but %sFunc is not set\")\n\t}\n", m.name, name, m.name, m.name)
+		if m.returns {
+			fmt.Fprintf(buf, "\treturn f.%sFunc(%s)\n}\n", m.name, m.args)
+		} else {
+			fmt.Fprintf(buf, "\tf.%sFunc(%s)\n}\n", m.name, m.args)
+		}
+	}
+	return nil
+}
+
+func (g *generator) params(fl *ast.FieldList) (params, args string, err error) {
+	var ps, as []string
+	for _, field := range fl.List {
+		t, err := g.qualify(field.Type)
+		if err != nil {
+			return "", "", err
+		}
+		names := field.Names
+		if len(names) == 0 {
+			names = []*ast.Ident{nil}
+		}
+		for _, n := range names {
+			arg := fmt.Sprintf("p%d", len(as))
+			if n != nil && n.Name != "_" {
+				arg = n.Name
+			}
+			ps = append(ps, arg+" "+t)
+			if strings.HasPrefix(t, "...") {
+				arg += "..."
+			}
+			as = append(as, arg)
+		}
+	}
+	return strings.Join(ps, ", "), strings.Join(as, ", "), nil
+}
+
+func (g *generator) results(fl *ast.FieldList) (string, error) {
+	if fl == nil {
+		return "", nil
+	}
+	var rs []string
+	for _, field := range fl.List {
+		t, err := g.qualify(field.Type)
+		if err != nil {
+			return "", err
+		}
+		n := len(field.Names)
+		if n == 0 {
+			n = 1
+		}
+		for i := 0; i < n; i++ {
+			rs = append(rs, t)
+		}
+	}
+	if len(rs) == 1 {
+		return rs[0], nil
+	}
+	return "(" + strings.Join(rs, ", ") + ")", nil
+}
+
+// qualify writes a type from the faked package as it must be written from the fakes' package.
+func (g *generator) qualify(expr ast.Expr) (string, error) {
+	switch e := expr.(type) {
+	case *ast.Ident:
+		if types.Universe.Lookup(e.Name) != nil {
+			return e.Name, nil
+		}
+		if !ast.IsExported(e.Name) {
+			return "", fmt.Errorf("uses the unexported type %s", e.Name)
+		}
+		return g.srcPkg + "." + e.Name, nil
+	case *ast.SelectorExpr:
+		pkg, ok := e.X.(*ast.Ident)
+		if !ok || g.imports[pkg.Name] == "" {
+			return "", fmt.Errorf("uses %s from an unknown package", types.ExprString(e))
+		}
+		g.used[g.imports[pkg.Name]] = true
+		return types.ExprString(e), nil
+	case *ast.StarExpr:
+		x, err := g.qualify(e.X)
+		return "*" + x, err
+	case *ast.Ellipsis:
+		x, err := g.qualify(e.Elt)
+		return "..." + x, err
+	case *ast.ArrayType:
+		x, err := g.qualify(e.Elt)
+		if e.Len != nil {
+			return "[" + types.ExprString(e.Len) + "]" + x, err
+		}
+		return "[]" + x, err
+	case *ast.MapType:
+		k, err := g.qualify(e.Key)
+		if err != nil {
+			return "", err
+		}
+		v, err := g.qualify(e.Value)
+		return "map[" + k + "]" + v, err
+	case *ast.InterfaceType:
+		if len(e.Methods.List) == 0 {
+			return "interface{}", nil
+		}
+	case *ast.FuncType:
+		params, _, err := g.params(e.Params)
+		if err != nil {
+			return "", err
+		}
+		results, err := g.results(e.Results)
+		return strings.TrimSpace("func(" + params + ") " + results), err
+	}
+	return "", fmt.Errorf("uses %s, which fakegen cannot write", types.ExprString(expr))
+}
@@ -0,0 +1,169 @@
+// Command instrumentgen writes decorators that report every call through a storage
+// interface to a StorageObserver, so each new store gets logging and metrics without
+// a hand written decorator. It is run by go generate in the package declaring the interfaces:
+//
+//	//go:generate go run ./internal/cmd/instrumentgen -type UserStorer,InviteStorer -o instrumented.go
+//
+// For each interface Foo it writes InstrumentedFoo and NewInstrumentedFoo. A method's
+// context is the first parameter of type context.Context, and its error the last result
+// of type error; methods without them are observed with context.Background and a nil error.
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+)
+
+func main() {
+	typeList := flag.String("type", "", "comma separated interfaces to instrument")
+	out := flag.String("o", "instrumented.go", "file to write")
+	flag.Parse()
+
+	err := run(".", strings.Split(*typeList, ","), *out)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "instrumentgen:", err)
+		os.Exit(1)
+	}
+}
+
+func run(dir string, names []string, out string) error {
+	fset := token.NewFileSet()
+	pkgs, err := parser.ParseDir(fset, dir, func(fi os.FileInfo) bool {
+		return !strings.HasSuffix(fi.Name(), "_test.go") && fi.Name() != out
+	}, 0)
+	if err != nil {
+		return err
+	}
+	if len(pkgs) != 1 {
+		return fmt.Errorf("Expected one package in %s, found %d", dir, len(pkgs))
+	}
+
+	var pkgName string
+	ifaces := map[string]*ast.InterfaceType{}
+	for name, pkg := range pkgs {
+		pkgName = name
+		for _, f := range pkg.Files {
+			ast.Inspect(f, func(n ast.Node) bool {
+				if ts, ok := n.(*ast.TypeSpec); ok {
+					if it, ok := ts.Type.(*ast.InterfaceType); ok {
+						ifaces[ts.Name.Name] = it
+					}
+				}
+				return true
+			})
+		}
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "// Code generated by instrumentgen -type %s. DO NOT EDIT.\n\n", strings.Join(names, ","))
+	fmt.Fprintf(&buf, "package %s\n\nimport (\n\t\"context\"\n\t\"time\"\n)\n\n", pkgName)
+
+	sort.Strings(names)
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		it, ok := ifaces[name]
+		if !ok {
+			return fmt.Errorf("No interface named %s", name)
+		}
+		err = writeDecorator(&buf, name, it)
+		if err != nil {
+			return err
+		}
+	}
+
+	src, err := format.Source(buf.Bytes())
+	if err != nil {
+		return fmt.Errorf("Generated code does not parse: %v", err)
+	}
+	return ioutil.WriteFile(out, src, 0644)
+}
+
+func writeDecorator(buf *bytes.Buffer, name string, it *ast.InterfaceType) error {
+	typ := "Instrumented" + name
+	fmt.Fprintf(buf, "\n// %s reports every call through its %s to a StorageObserver.\n", typ, name)
+	fmt.Fprintf(buf, "type %s struct {\n\tnext  %s\n\tstore string\n\tobs   StorageObserver\n}\n\n", typ, name)
+	fmt.Fprintf(buf, "// New%s reports the calls to next as made to store.\n", typ)
+	fmt.Fprintf(buf, "func New%s(next %s, store string, obs StorageObserver) *%s {\n", typ, name, typ)
+	fmt.Fprintf(buf, "\treturn &%s{next: next, store: store, obs: obs}\n}\n", typ)
+
+	for _, m := range it.Methods.List {
+		ft, ok := m.Type.(*ast.FuncType)
+		if !ok || len(m.Names) != 1 {
+			return fmt.Errorf("%s embeds %s, list its methods instead", name, types.ExprString(m.Type))
+		}
+		writeMethod(buf, typ, m.Names[0].Name, ft)
+	}
+	return nil
+}
+
+func writeMethod(buf *bytes.Buffer, typ, method string, ft *ast.FuncType) {
+	var params, args []string
+	ctxArg := "context.Background()"
+	i := 0
+	for _, field := range ft.Params.List {
+		t := types.ExprString(field.Type)
+		names := field.Names
+		if len(names) == 0 {
+			names = []*ast.Ident{nil}
+		}
+		for _, n := range names {
+			arg := fmt.Sprintf("p%d", i)
+			if n != nil && n.Name != "_" {
+				arg = n.Name
+			}
+			i++
+			if t == "context.Context" && ctxArg == "context.Background()" {
+				ctxArg = arg
+			}
+			params = append(params, arg+" "+t)
+			if strings.HasPrefix(t, "...") {
+				arg += "..."
+			}
+			args = append(args, arg)
+		}
+	}
+
+	var results, rets []string
+	errRet := "nil"
+	if ft.Results != nil {
+		for _, field := range ft.Results.List {
+			t := types.ExprString(field.Type)
+			n := len(field.Names)
+			if n == 0 {
+				n = 1
+			}
+			for j := 0; j < n; j++ {
+				r := fmt.Sprintf("r%d", len(rets))
+				results = append(results, t)
+				rets = append(rets, r)
+				if t == "error" {
+					errRet = r
+				}
+			}
+		}
+	}
+
+	fmt.Fprintf(buf, "\nfunc (i *%s) %s(%s) (%s) {\n", typ, method, strings.Join(params, ", "), strings.Join(results, ", "))
+	fmt.Fprintf(buf, "\tstart := time.Now()\n")
+	call := fmt.Sprintf("i.next.%s(%s)", method, strings.Join(args, ", "))
+	if len(rets) > 0 {
+		fmt.Fprintf(buf, "\t%s := %s\n", strings.Join(rets, ", "), call)
+	} else {
+		fmt.Fprintf(buf, "\t%s\n", call)
+	}
+	fmt.Fprintf(buf, "\ti.obs.ObserveStorageCall(%s, i.store, %q, start, %s)\n", ctxArg, method, errRet)
+	if len(rets) > 0 {
+		fmt.Fprintf(buf, "\treturn %s\n", strings.Join(rets, ", "))
+	}
+	fmt.Fprintf(buf, "}\n")
+}
@@ -0,0 +1,230 @@
+// Package cookies keeps state in browser cookies that clients can neither read nor forge.
+// Values are signed with HMAC-SHA256 and may also be encrypted with AES-GCM.
+// Several keys may be configured so they can be rotated without logging everyone out.
+package cookies
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/oralordos/separation/internal/clock"
+)
+
+var (
+	// ErrInvalid is returned for a cookie that was tampered with, or signed with a key no longer configured.
+	ErrInvalid = errors.New("Cookie is invalid")
+	// ErrExpired is returned for a cookie older than the codec's MaxAge.
+	ErrExpired = errors.New("Cookie has expired")
+)
+
+// MinKeyLen is the shortest secret a key may be.
+const MinKeyLen = 32
+
+type key struct {
+	sign []byte
+	aead cipher.AEAD
+}
+
+// derive splits one secret into separate signing and encryption keys.
+func derive(secret []byte, purpose string) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+func newKey(secret []byte) (*key, error) {
+	if len(secret) < MinKeyLen {
+		return nil, fmt.Errorf("Cookie keys must be at least %d bytes", MinKeyLen)
+	}
+
+	block, err := aes.NewCipher(derive(secret, "separation cookie encryption"))
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &key{
+		sign: derive(secret, "separation cookie signing"),
+		aead: aead,
+	}, nil
+}
+
+// Options configure a Codec.
+type Options struct {
+	// Encrypt hides the value from the client as well as signing it.
+	Encrypt bool
+	// MaxAge rejects cookies issued longer ago than it. Zero accepts cookies of any age.
+	MaxAge time.Duration
+	// Clock defaults to the system clock.
+	Clock clock.Clock
+}
+
+// Codec encodes and decodes cookie values. It is safe for concurrent use.
+type Codec struct {
+	keys []*key
+	opts Options
+}
+
+// New returns a codec that issues cookies with the first secret and accepts
+// cookies issued with any of them. To rotate, put the new secret first and
+// drop the old one once MaxAge has passed.
+func New(secrets [][]byte, opts Options) (*Codec, error) {
+	if len(secrets) == 0 {
+		return nil, errors.New("At least one cookie key is required")
+	}
+	if opts.Clock == nil {
+		opts.Clock = clock.Real
+	}
+
+	c := &Codec{opts: opts}
+	for _, s := range secrets {
+		k, err := newKey(s)
+		if err != nil {
+			return nil, err
+		}
+		c.keys = append(c.keys, k)
+	}
+	return c, nil
+}
+
+// Encode protects value for a cookie called name. The name is bound into the
+// signature, so a value cannot be moved from one cookie to another.
+func (c *Codec) Encode(name, value string) (string, error) {
+	k := c.keys[0]
+
+	payload := make([]byte, 8, 8+len(value))
+	binary.BigEndian.PutUint64(payload, uint64(c.opts.Clock.Now().Unix()))
+	payload = append(payload, value...)
+
+	if c.opts.Encrypt {
+		nonce := make([]byte, k.aead.NonceSize())
+		_, err := rand.Read(nonce)
+		if err != nil {
+			return "", err
+		}
+		payload = k.aead.Seal(nonce, nonce, payload, []byte(name))
+	}
+
+	body := base64.RawURLEncoding.EncodeToString(payload)
+	return body + "." + base64.RawURLEncoding.EncodeToString(sign(k, name, body)), nil
+}
+
+func sign(k *key, name, body string) []byte {
+	mac := hmac.New(sha256.New, k.sign)
+	mac.Write([]byte(name))
+	mac.Write([]byte{0})
+	mac.Write([]byte(body))
+	return mac.Sum(nil)
+}
+
+// Decode returns the value Encode protected.
+// Decode may return an ErrInvalid or ErrExpired error.
+func (c *Codec) Decode(name, encoded string) (string, error) {
+	body, sig, ok := strings.Cut(encoded, ".")
+	if !ok {
+		return "", ErrInvalid
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil {
+		return "", ErrInvalid
+	}
+
+	var k *key
+	for _, candidate := range c.keys {
+		if hmac.Equal(mac, sign(candidate, name, body)) {
+			k = candidate
+			break
+		}
+	}
+	if k == nil {
+		return "", ErrInvalid
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(body)
+	if err != nil {
+		return "", ErrInvalid
+	}
+
+	if c.opts.Encrypt {
+		n := k.aead.NonceSize()
+		if len(payload) < n {
+			return "", ErrInvalid
+		}
+		payload, err = k.aead.Open(nil, payload[:n], payload[n:], []byte(name))
+		if err != nil {
+			return "", ErrInvalid
+		}
+	}
+
+	if len(payload) < 8 {
+		return "", ErrInvalid
+	}
+	issued := time.Unix(int64(binary.BigEndian.Uint64(payload)), 0)
+	if c.opts.MaxAge > 0 && c.opts.Clock.Now().Sub(issued) > c.opts.MaxAge {
+		return "", ErrExpired
+	}
+	return string(payload[8:]), nil
+}
+
+// Set writes cookie with its value protected. The cookie is always HttpOnly and Secure.
+// Unless the caller chose otherwise, it is also SameSite=Lax, scoped to the whole site,
+// and lives as long as MaxAge.
+func (c *Codec) Set(w http.ResponseWriter, cookie *http.Cookie) error {
+	value, err := c.Encode(cookie.Name, cookie.Value)
+	if err != nil {
+		return err
+	}
+
+	out := *cookie
+	out.Value = value
+	out.HttpOnly = true
+	out.Secure = true
+	if out.SameSite == 0 {
+		out.SameSite = http.SameSiteLaxMode
+	}
+	if out.Path == "" {
+		out.Path = "/"
+	}
+	if out.MaxAge == 0 && c.opts.MaxAge > 0 {
+		out.MaxAge = int(c.opts.MaxAge / time.Second)
+	}
+	http.SetCookie(w, &out)
+	return nil
+}
+
+// Get reads and verifies the cookie called name from r.
+// Get may return http.ErrNoCookie, ErrInvalid or ErrExpired.
+func (c *Codec) Get(r *http.Request, name string) (string, error) {
+	cookie, err := r.Cookie(name)
+	if err != nil {
+		return "", err
+	}
+	return c.Decode(name, cookie.Value)
+}
+
+// Clear tells the browser to delete the cookie called name.
+func Clear(w http.ResponseWriter, name, path string) {
+	if path == "" {
+		path = "/"
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Path:     path,
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   true,
+	})
+}
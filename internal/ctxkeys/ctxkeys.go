@@ -0,0 +1,31 @@
+// Package ctxkeys gives every value carried in a context its own typed key,
+// so packages cannot collide on a key and callers never assert the value's type.
+package ctxkeys
+
+import "context"
+
+// Key identifies one value of type T in a context. Keys are compared by identity,
+// so two keys made by New never collide, even when they share a name.
+type Key[T any] struct {
+	name string
+}
+
+// New makes a key. The name is only used to describe the key.
+func New[T any](name string) *Key[T] {
+	return &Key[T]{name: name}
+}
+
+// With returns a copy of ctx carrying v under k.
+func (k *Key[T]) With(ctx context.Context, v T) context.Context {
+	return context.WithValue(ctx, k, v)
+}
+
+// From returns the value ctx carries under k, and false if it carries none.
+func (k *Key[T]) From(ctx context.Context) (T, bool) {
+	v, ok := ctx.Value(k).(T)
+	return v, ok
+}
+
+func (k *Key[T]) String() string {
+	return k.name
+}
@@ -0,0 +1,250 @@
+// Package httpclient is the one HTTP client every outbound integration shares.
+// It pools connections, bounds each attempt with a timeout, retries idempotent
+// requests within a budget, and publishes what it did through expvar.
+package httpclient
+
+import (
+	"context"
+	"expvar"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptrace"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Options configure a Client. Zero fields take the defaults noted on each.
+type Options struct {
+	// Timeout bounds each attempt, including reading the response headers. Defaults to 30s.
+	Timeout time.Duration
+	// MaxRetries is how many times a failed request may be retried. Defaults to 2.
+	// Set it below zero to disable retries.
+	MaxRetries int
+	// Backoff is the delay before the first retry, doubling for each one after. Defaults to 100ms.
+	Backoff time.Duration
+	// RetryRatio is the share of requests that may be retries, so a struggling
+	// server is not hit with a multiple of its normal load. Defaults to 0.2.
+	RetryRatio float64
+}
+
+func (o *Options) setDefaults() {
+	if o.Timeout == 0 {
+		o.Timeout = 30 * time.Second
+	}
+	if o.MaxRetries == 0 {
+		o.MaxRetries = 2
+	}
+	if o.Backoff == 0 {
+		o.Backoff = 100 * time.Millisecond
+	}
+	if o.RetryRatio == 0 {
+		o.RetryRatio = 0.2
+	}
+}
+
+// metrics are published under the httpclient expvar, one map per client name.
+var (
+	metricsMu sync.Mutex
+	metrics   = expvar.NewMap("httpclient")
+)
+
+func metricsFor(name string) *expvar.Map {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+
+	if m, ok := metrics.Get(name).(*expvar.Map); ok {
+		return m
+	}
+	m := new(expvar.Map).Init()
+	metrics.Set(name, m)
+	return m
+}
+
+// Client sends requests for one integration. It is safe for concurrent use.
+type Client struct {
+	http    *http.Client
+	opts    Options
+	budget  *retryBudget
+	metrics *expvar.Map
+}
+
+// New returns a client whose metrics are published under name.
+func New(name string, opts Options) *Client {
+	opts.setDefaults()
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConnsPerHost = 16
+	transport.ResponseHeaderTimeout = opts.Timeout
+
+	return &Client{
+		http:    &http.Client{Transport: transport},
+		opts:    opts,
+		budget:  newRetryBudget(opts.RetryRatio),
+		metrics: metricsFor(name),
+	}
+}
+
+// Do sends req, retrying network errors and 429, 502, 503 and 504 responses
+// while retries and budget remain. Only requests that are safe to repeat are retried:
+// those with an idempotent method and a body that can be read again.
+// The caller must close the response body.
+func (c *Client) Do(req *http.Request) (*http.Response, error) {
+	c.metrics.Add("requests", 1)
+	c.budget.deposit()
+
+	ctx := httptrace.WithClientTrace(req.Context(), c.trace())
+	req = req.WithContext(ctx)
+
+	for attempt := 0; ; attempt++ {
+		start := time.Now()
+		resp, err := c.http.Do(req)
+		c.metrics.Add("request_ns", int64(time.Since(start)))
+
+		if !c.shouldRetry(req, resp, err, attempt) {
+			if err != nil {
+				c.metrics.Add("errors", 1)
+			}
+			return resp, err
+		}
+
+		delay := c.backoff(attempt, resp)
+		if resp != nil {
+			// Drain so the connection goes back to the pool
+			_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+			resp.Body.Close()
+		}
+
+		err = sleep(ctx, delay)
+		if err != nil {
+			c.metrics.Add("errors", 1)
+			return nil, err
+		}
+
+		if req.GetBody != nil {
+			req.Body, err = req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+		}
+		c.metrics.Add("retries", 1)
+	}
+}
+
+func (c *Client) shouldRetry(req *http.Request, resp *http.Response, err error, attempt int) bool {
+	if attempt >= c.opts.MaxRetries || !replayable(req) || req.Context().Err() != nil {
+		return false
+	}
+
+	if err == nil {
+		switch resp.StatusCode {
+		case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		default:
+			return false
+		}
+	}
+
+	if !c.budget.withdraw() {
+		c.metrics.Add("retry_budget_exhausted", 1)
+		return false
+	}
+	return true
+}
+
+func replayable(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+	default:
+		return false
+	}
+	return req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+}
+
+// backoff doubles the delay for each attempt with up to half of it again as jitter,
+// unless the server said how long to wait with Retry-After. No wait is longer than Timeout.
+func (c *Client) backoff(attempt int, resp *http.Response) time.Duration {
+	if resp != nil {
+		secs, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+		if err == nil && secs >= 0 {
+			d := time.Duration(secs) * time.Second
+			if d > c.opts.Timeout {
+				d = c.opts.Timeout
+			}
+			return d
+		}
+	}
+
+	d := c.opts.Backoff << attempt
+	return d + time.Duration(rand.Int63n(int64(d)/2+1))
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+func (c *Client) trace() *httptrace.ClientTrace {
+	return &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			if info.Reused {
+				c.metrics.Add("conns_reused", 1)
+			} else {
+				c.metrics.Add("conns_new", 1)
+			}
+		},
+		DNSDone: func(info httptrace.DNSDoneInfo) {
+			if info.Err != nil {
+				c.metrics.Add("dns_errors", 1)
+			}
+		},
+		ConnectDone: func(network, addr string, err error) {
+			if err != nil {
+				c.metrics.Add("connect_errors", 1)
+			}
+		},
+	}
+}
+
+// retryBudget lets a fixed share of requests be retries. Every request deposits
+// ratio tokens and every retry withdraws one, with a small reserve so the first
+// few failures can be retried before any traffic has built up the balance.
+type retryBudget struct {
+	mu      sync.Mutex
+	ratio   float64
+	balance float64
+	max     float64
+}
+
+func newRetryBudget(ratio float64) *retryBudget {
+	return &retryBudget{
+		ratio:   ratio,
+		balance: 10,
+		max:     10,
+	}
+}
+
+func (rb *retryBudget) deposit() {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	rb.balance += rb.ratio
+	if rb.balance > rb.max {
+		rb.balance = rb.max
+	}
+}
+
+func (rb *retryBudget) withdraw() bool {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	if rb.balance < 1 {
+		return false
+	}
+	rb.balance--
+	return true
+}
@@ -0,0 +1,875 @@
+// Code generated by fakegen -type UserStorer,PreferencesStorer,InviteStorer,OrgStorer,OrgTokenStorer,UserService,OrgService,EventHandler,InviteSender,BlobStore,Authenticator,AlertSink,SecretsProvider,SMSProvider. DO NOT EDIT.
+
+package mocks
+
+import (
+	"context"
+	"net/http"
+	"sync"
+
+	"github.com/oralordos/separation"
+	"github.com/oralordos/separation/internal/principal"
+)
+
+// calls counts the calls made to a fake, by method.
+type calls struct {
+	mu sync.Mutex
+	n  map[string]int
+}
+
+func (c *calls) record(method string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.n == nil {
+		c.n = map[string]int{}
+	}
+	c.n[method]++
+}
+
+// Calls returns how many times method has been called.
+func (c *calls) Calls(method string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.n[method]
+}
+
+// UserStorer is a fake separation.UserStorer.
+type UserStorer struct {
+	calls
+
+	GetFunc           func(ctx context.Context, email separation.Email) (*separation.User, error)
+	GetByUsernameFunc func(ctx context.Context, username separation.Username) (*separation.User, error)
+	SaveFunc          func(ctx context.Context, user *separation.User) error
+	InsertFunc        func(ctx context.Context, user *separation.User) error
+	ListFunc          func(ctx context.Context, sel separation.LabelSelector) ([]*separation.User, error)
+	DeleteFunc        func(ctx context.Context, emails []separation.Email) (int, error)
+}
+
+var _ separation.UserStorer = (*UserStorer)(nil)
+
+func (f *UserStorer) Get(ctx context.Context, email separation.Email) (*separation.User, error) {
+	f.record("Get")
+	if f.GetFunc == nil {
+		panic("UserStorer.Get called, but GetFunc is not set")
+	}
+	return f.GetFunc(ctx, email)
+}
+
+func (f *UserStorer) GetByUsername(ctx context.Context, username separation.Username) (*separation.User, error) {
+	f.record("GetByUsername")
+	if f.GetByUsernameFunc == nil {
+		panic("UserStorer.GetByUsername called, but GetByUsernameFunc is not set")
+	}
+	return f.GetByUsernameFunc(ctx, username)
+}
+
+func (f *UserStorer) Save(ctx context.Context, user *separation.User) error {
+	f.record("Save")
+	if f.SaveFunc == nil {
+		panic("UserStorer.Save called, but SaveFunc is not set")
+	}
+	return f.SaveFunc(ctx, user)
+}
+
+func (f *UserStorer) Insert(ctx context.Context, user *separation.User) error {
+	f.record("Insert")
+	if f.InsertFunc == nil {
+		panic("UserStorer.Insert called, but InsertFunc is not set")
+	}
+	return f.InsertFunc(ctx, user)
+}
+
+func (f *UserStorer) List(ctx context.Context, sel separation.LabelSelector) ([]*separation.User, error) {
+	f.record("List")
+	if f.ListFunc == nil {
+		panic("UserStorer.List called, but ListFunc is not set")
+	}
+	return f.ListFunc(ctx, sel)
+}
+
+func (f *UserStorer) Delete(ctx context.Context, emails []separation.Email) (int, error) {
+	f.record("Delete")
+	if f.DeleteFunc == nil {
+		panic("UserStorer.Delete called, but DeleteFunc is not set")
+	}
+	return f.DeleteFunc(ctx, emails)
+}
+
+// PreferencesStorer is a fake separation.PreferencesStorer.
+type PreferencesStorer struct {
+	calls
+
+	GetFunc  func(ctx context.Context, email separation.Email) (*separation.UserPreferences, error)
+	SaveFunc func(ctx context.Context, prefs *separation.UserPreferences) error
+}
+
+var _ separation.PreferencesStorer = (*PreferencesStorer)(nil)
+
+func (f *PreferencesStorer) Get(ctx context.Context, email separation.Email) (*separation.UserPreferences, error) {
+	f.record("Get")
+	if f.GetFunc == nil {
+		panic("PreferencesStorer.Get called, but GetFunc is not set")
+	}
+	return f.GetFunc(ctx, email)
+}
+
+func (f *PreferencesStorer) Save(ctx context.Context, prefs *separation.UserPreferences) error {
+	f.record("Save")
+	if f.SaveFunc == nil {
+		panic("PreferencesStorer.Save called, but SaveFunc is not set")
+	}
+	return f.SaveFunc(ctx, prefs)
+}
+
+// InviteStorer is a fake separation.InviteStorer.
+type InviteStorer struct {
+	calls
+
+	GetFunc        func(ctx context.Context, id string) (*separation.Invite, error)
+	GetByTokenFunc func(ctx context.Context, tokenHash string) (*separation.Invite, error)
+	SaveFunc       func(ctx context.Context, invite *separation.Invite) error
+	ListFunc       func(ctx context.Context) ([]*separation.Invite, error)
+}
+
+var _ separation.InviteStorer = (*InviteStorer)(nil)
+
+func (f *InviteStorer) Get(ctx context.Context, id string) (*separation.Invite, error) {
+	f.record("Get")
+	if f.GetFunc == nil {
+		panic("InviteStorer.Get called, but GetFunc is not set")
+	}
+	return f.GetFunc(ctx, id)
+}
+
+func (f *InviteStorer) GetByToken(ctx context.Context, tokenHash string) (*separation.Invite, error) {
+	f.record("GetByToken")
+	if f.GetByTokenFunc == nil {
+		panic("InviteStorer.GetByToken called, but GetByTokenFunc is not set")
+	}
+	return f.GetByTokenFunc(ctx, tokenHash)
+}
+
+func (f *InviteStorer) Save(ctx context.Context, invite *separation.Invite) error {
+	f.record("Save")
+	if f.SaveFunc == nil {
+		panic("InviteStorer.Save called, but SaveFunc is not set")
+	}
+	return f.SaveFunc(ctx, invite)
+}
+
+func (f *InviteStorer) List(ctx context.Context) ([]*separation.Invite, error) {
+	f.record("List")
+	if f.ListFunc == nil {
+		panic("InviteStorer.List called, but ListFunc is not set")
+	}
+	return f.ListFunc(ctx)
+}
+
+// OrgStorer is a fake separation.OrgStorer.
+type OrgStorer struct {
+	calls
+
+	GetFunc              func(ctx context.Context, id string) (*separation.Organization, error)
+	SaveFunc             func(ctx context.Context, org *separation.Organization) error
+	GetMembershipFunc    func(ctx context.Context, orgID string, email separation.Email) (*separation.Membership, error)
+	SaveMembershipFunc   func(ctx context.Context, m *separation.Membership) error
+	DeleteMembershipFunc func(ctx context.Context, orgID string, email separation.Email) error
+	MembersFunc          func(ctx context.Context, orgID string) ([]*separation.Membership, error)
+	MembershipsOfFunc    func(ctx context.Context, email separation.Email) ([]*separation.Membership, error)
+}
+
+var _ separation.OrgStorer = (*OrgStorer)(nil)
+
+func (f *OrgStorer) Get(ctx context.Context, id string) (*separation.Organization, error) {
+	f.record("Get")
+	if f.GetFunc == nil {
+		panic("OrgStorer.Get called, but GetFunc is not set")
+	}
+	return f.GetFunc(ctx, id)
+}
+
+func (f *OrgStorer) Save(ctx context.Context, org *separation.Organization) error {
+	f.record("Save")
+	if f.SaveFunc == nil {
+		panic("OrgStorer.Save called, but SaveFunc is not set")
+	}
+	return f.SaveFunc(ctx, org)
+}
+
+func (f *OrgStorer) GetMembership(ctx context.Context, orgID string, email separation.Email) (*separation.Membership, error) {
+	f.record("GetMembership")
+	if f.GetMembershipFunc == nil {
+		panic("OrgStorer.GetMembership called, but GetMembershipFunc is not set")
+	}
+	return f.GetMembershipFunc(ctx, orgID, email)
+}
+
+func (f *OrgStorer) SaveMembership(ctx context.Context, m *separation.Membership) error {
+	f.record("SaveMembership")
+	if f.SaveMembershipFunc == nil {
+		panic("OrgStorer.SaveMembership called, but SaveMembershipFunc is not set")
+	}
+	return f.SaveMembershipFunc(ctx, m)
+}
+
+func (f *OrgStorer) DeleteMembership(ctx context.Context, orgID string, email separation.Email) error {
+	f.record("DeleteMembership")
+	if f.DeleteMembershipFunc == nil {
+		panic("OrgStorer.DeleteMembership called, but DeleteMembershipFunc is not set")
+	}
+	return f.DeleteMembershipFunc(ctx, orgID, email)
+}
+
+func (f *OrgStorer) Members(ctx context.Context, orgID string) ([]*separation.Membership, error) {
+	f.record("Members")
+	if f.MembersFunc == nil {
+		panic("OrgStorer.Members called, but MembersFunc is not set")
+	}
+	return f.MembersFunc(ctx, orgID)
+}
+
+func (f *OrgStorer) MembershipsOf(ctx context.Context, email separation.Email) ([]*separation.Membership, error) {
+	f.record("MembershipsOf")
+	if f.MembershipsOfFunc == nil {
+		panic("OrgStorer.MembershipsOf called, but MembershipsOfFunc is not set")
+	}
+	return f.MembershipsOfFunc(ctx, email)
+}
+
+// OrgTokenStorer is a fake separation.OrgTokenStorer.
+type OrgTokenStorer struct {
+	calls
+
+	GetFunc     func(ctx context.Context, id string) (*separation.OrgToken, error)
+	SaveFunc    func(ctx context.Context, token *separation.OrgToken) error
+	ListOrgFunc func(ctx context.Context, orgID string) ([]*separation.OrgToken, error)
+}
+
+var _ separation.OrgTokenStorer = (*OrgTokenStorer)(nil)
+
+func (f *OrgTokenStorer) Get(ctx context.Context, id string) (*separation.OrgToken, error) {
+	f.record("Get")
+	if f.GetFunc == nil {
+		panic("OrgTokenStorer.Get called, but GetFunc is not set")
+	}
+	return f.GetFunc(ctx, id)
+}
+
+func (f *OrgTokenStorer) Save(ctx context.Context, token *separation.OrgToken) error {
+	f.record("Save")
+	if f.SaveFunc == nil {
+		panic("OrgTokenStorer.Save called, but SaveFunc is not set")
+	}
+	return f.SaveFunc(ctx, token)
+}
+
+func (f *OrgTokenStorer) ListOrg(ctx context.Context, orgID string) ([]*separation.OrgToken, error) {
+	f.record("ListOrg")
+	if f.ListOrgFunc == nil {
+		panic("OrgTokenStorer.ListOrg called, but ListOrgFunc is not set")
+	}
+	return f.ListOrgFunc(ctx, orgID)
+}
+
+// UserService is a fake separation.UserService.
+type UserService struct {
+	calls
+
+	RegisterFunc              func(p0 context.Context, p1 *separation.RegisterParams) error
+	GetByEmailFunc            func(p0 context.Context, p1 separation.Email) (*separation.User, error)
+	GetByUsernameFunc         func(p0 context.Context, p1 separation.Username) (*separation.User, error)
+	SetUsernameFunc           func(p0 context.Context, p1 *separation.SetUsernameParams) error
+	SetAvatarFunc             func(p0 context.Context, p1 *separation.SetAvatarParams) error
+	AvatarFunc                func(p0 context.Context, p1 *separation.GetAvatarQuery) (*separation.Avatar, error)
+	PreferencesFunc           func(p0 context.Context, p1 *separation.GetPreferencesQuery) (*separation.Preferences, error)
+	SetPreferencesFunc        func(p0 context.Context, p1 *separation.SetPreferencesParams) error
+	TermsFunc                 func(p0 context.Context) (*separation.Terms, error)
+	AcceptTermsFunc           func(p0 context.Context, p1 *separation.AcceptTermsParams) error
+	PendingTermsFunc          func(p0 context.Context) ([]*separation.User, error)
+	CreateInviteFunc          func(p0 context.Context, p1 *separation.CreateInviteParams) (*separation.CreatedInvite, error)
+	ResendInviteFunc          func(p0 context.Context, p1 *separation.ResendInviteParams) (*separation.CreatedInvite, error)
+	RevokeInviteFunc          func(p0 context.Context, p1 *separation.RevokeInviteParams) error
+	ListInvitesFunc           func(p0 context.Context) ([]*separation.InviteStatus, error)
+	ListReviewsFunc           func(p0 context.Context) ([]*separation.PendingRegistration, error)
+	ApproveRegistrationFunc   func(p0 context.Context, p1 *separation.ResolveReviewParams) error
+	RejectRegistrationFunc    func(p0 context.Context, p1 *separation.ResolveReviewParams) error
+	RegistrationPolicyFunc    func(p0 context.Context) (*separation.RegistrationPolicy, error)
+	SetRegistrationPolicyFunc func(p0 context.Context, p1 *separation.SetRegistrationPolicyParams) error
+	ReferralsFunc             func(p0 context.Context, p1 separation.Email) (*separation.Referrals, error)
+	SendPhoneCodeFunc         func(p0 context.Context, p1 *separation.SendPhoneCodeParams) error
+	VerifyPhoneFunc           func(p0 context.Context, p1 *separation.VerifyPhoneParams) error
+	RequestMagicLinkFunc      func(p0 context.Context, p1 *separation.RequestMagicLinkParams) error
+	RedeemMagicLinkFunc       func(p0 context.Context, p1 *separation.RedeemMagicLinkParams) (*separation.User, error)
+	StartSessionFunc          func(p0 context.Context, p1 *separation.StartSessionParams) error
+	AuthenticateSessionFunc   func(p0 context.Context, p1 *separation.AuthenticateSessionParams) error
+	ListSessionsFunc          func(p0 context.Context, p1 *separation.ListSessionsQuery) ([]*separation.Session, error)
+	RevokeSessionFunc         func(p0 context.Context, p1 *separation.RevokeSessionParams) error
+	ListLoginsFunc            func(p0 context.Context, p1 *separation.ListLoginsQuery) ([]*separation.Login, error)
+	RecordActivityFunc        func(p0 context.Context, p1 *separation.RecordActivityParams) error
+	InactiveUsersFunc         func(p0 context.Context, p1 *separation.InactiveUsersQuery) ([]*separation.User, error)
+	MeFunc                    func(p0 context.Context) (*separation.User, error)
+	PreviewBulkDeleteFunc     func(p0 context.Context, p1 *separation.UserFilter) (*separation.BulkDeletePreview, error)
+	BulkDeleteFunc            func(p0 context.Context, p1 *separation.BulkDeleteParams) error
+	ListFunc                  func(p0 context.Context, p1 *separation.ListUsersQuery) ([]*separation.User, error)
+	SetLabelsFunc             func(p0 context.Context, p1 *separation.SetLabelsParams) error
+	RemoveLabelsFunc          func(p0 context.Context, p1 *separation.RemoveLabelsParams) error
+	ExportFunc                func(p0 context.Context, p1 *separation.ExportUsersQuery) ([]*separation.User, error)
+	ImportFunc                func(p0 context.Context, p1 []*separation.User) error
+}
+
+var _ separation.UserService = (*UserService)(nil)
+
+func (f *UserService) Register(p0 context.Context, p1 *separation.RegisterParams) error {
+	f.record("Register")
+	if f.RegisterFunc == nil {
+		panic("UserService.Register called, but RegisterFunc is not set")
+	}
+	return f.RegisterFunc(p0, p1)
+}
+
+func (f *UserService) GetByEmail(p0 context.Context, p1 separation.Email) (*separation.User, error) {
+	f.record("GetByEmail")
+	if f.GetByEmailFunc == nil {
+		panic("UserService.GetByEmail called, but GetByEmailFunc is not set")
+	}
+	return f.GetByEmailFunc(p0, p1)
+}
+
+func (f *UserService) GetByUsername(p0 context.Context, p1 separation.Username) (*separation.User, error) {
+	f.record("GetByUsername")
+	if f.GetByUsernameFunc == nil {
+		panic("UserService.GetByUsername called, but GetByUsernameFunc is not set")
+	}
+	return f.GetByUsernameFunc(p0, p1)
+}
+
+func (f *UserService) SetUsername(p0 context.Context, p1 *separation.SetUsernameParams) error {
+	f.record("SetUsername")
+	if f.SetUsernameFunc == nil {
+		panic("UserService.SetUsername called, but SetUsernameFunc is not set")
+	}
+	return f.SetUsernameFunc(p0, p1)
+}
+
+func (f *UserService) SetAvatar(p0 context.Context, p1 *separation.SetAvatarParams) error {
+	f.record("SetAvatar")
+	if f.SetAvatarFunc == nil {
+		panic("UserService.SetAvatar called, but SetAvatarFunc is not set")
+	}
+	return f.SetAvatarFunc(p0, p1)
+}
+
+func (f *UserService) Avatar(p0 context.Context, p1 *separation.GetAvatarQuery) (*separation.Avatar, error) {
+	f.record("Avatar")
+	if f.AvatarFunc == nil {
+		panic("UserService.Avatar called, but AvatarFunc is not set")
+	}
+	return f.AvatarFunc(p0, p1)
+}
+
+func (f *UserService) Preferences(p0 context.Context, p1 *separation.GetPreferencesQuery) (*separation.Preferences, error) {
+	f.record("Preferences")
+	if f.PreferencesFunc == nil {
+		panic("UserService.Preferences called, but PreferencesFunc is not set")
+	}
+	return f.PreferencesFunc(p0, p1)
+}
+
+func (f *UserService) SetPreferences(p0 context.Context, p1 *separation.SetPreferencesParams) error {
+	f.record("SetPreferences")
+	if f.SetPreferencesFunc == nil {
+		panic("UserService.SetPreferences called, but SetPreferencesFunc is not set")
+	}
+	return f.SetPreferencesFunc(p0, p1)
+}
+
+func (f *UserService) Terms(p0 context.Context) (*separation.Terms, error) {
+	f.record("Terms")
+	if f.TermsFunc == nil {
+		panic("UserService.Terms called, but TermsFunc is not set")
+	}
+	return f.TermsFunc(p0)
+}
+
+func (f *UserService) AcceptTerms(p0 context.Context, p1 *separation.AcceptTermsParams) error {
+	f.record("AcceptTerms")
+	if f.AcceptTermsFunc == nil {
+		panic("UserService.AcceptTerms called, but AcceptTermsFunc is not set")
+	}
+	return f.AcceptTermsFunc(p0, p1)
+}
+
+func (f *UserService) PendingTerms(p0 context.Context) ([]*separation.User, error) {
+	f.record("PendingTerms")
+	if f.PendingTermsFunc == nil {
+		panic("UserService.PendingTerms called, but PendingTermsFunc is not set")
+	}
+	return f.PendingTermsFunc(p0)
+}
+
+func (f *UserService) CreateInvite(p0 context.Context, p1 *separation.CreateInviteParams) (*separation.CreatedInvite, error) {
+	f.record("CreateInvite")
+	if f.CreateInviteFunc == nil {
+		panic("UserService.CreateInvite called, but CreateInviteFunc is not set")
+	}
+	return f.CreateInviteFunc(p0, p1)
+}
+
+func (f *UserService) ResendInvite(p0 context.Context, p1 *separation.ResendInviteParams) (*separation.CreatedInvite, error) {
+	f.record("ResendInvite")
+	if f.ResendInviteFunc == nil {
+		panic("UserService.ResendInvite called, but ResendInviteFunc is not set")
+	}
+	return f.ResendInviteFunc(p0, p1)
+}
+
+func (f *UserService) RevokeInvite(p0 context.Context, p1 *separation.RevokeInviteParams) error {
+	f.record("RevokeInvite")
+	if f.RevokeInviteFunc == nil {
+		panic("UserService.RevokeInvite called, but RevokeInviteFunc is not set")
+	}
+	return f.RevokeInviteFunc(p0, p1)
+}
+
+func (f *UserService) ListInvites(p0 context.Context) ([]*separation.InviteStatus, error) {
+	f.record("ListInvites")
+	if f.ListInvitesFunc == nil {
+		panic("UserService.ListInvites called, but ListInvitesFunc is not set")
+	}
+	return f.ListInvitesFunc(p0)
+}
+
+func (f *UserService) ListReviews(p0 context.Context) ([]*separation.PendingRegistration, error) {
+	f.record("ListReviews")
+	if f.ListReviewsFunc == nil {
+		panic("UserService.ListReviews called, but ListReviewsFunc is not set")
+	}
+	return f.ListReviewsFunc(p0)
+}
+
+func (f *UserService) ApproveRegistration(p0 context.Context, p1 *separation.ResolveReviewParams) error {
+	f.record("ApproveRegistration")
+	if f.ApproveRegistrationFunc == nil {
+		panic("UserService.ApproveRegistration called, but ApproveRegistrationFunc is not set")
+	}
+	return f.ApproveRegistrationFunc(p0, p1)
+}
+
+func (f *UserService) RejectRegistration(p0 context.Context, p1 *separation.ResolveReviewParams) error {
+	f.record("RejectRegistration")
+	if f.RejectRegistrationFunc == nil {
+		panic("UserService.RejectRegistration called, but RejectRegistrationFunc is not set")
+	}
+	return f.RejectRegistrationFunc(p0, p1)
+}
+
+func (f *UserService) RegistrationPolicy(p0 context.Context) (*separation.RegistrationPolicy, error) {
+	f.record("RegistrationPolicy")
+	if f.RegistrationPolicyFunc == nil {
+		panic("UserService.RegistrationPolicy called, but RegistrationPolicyFunc is not set")
+	}
+	return f.RegistrationPolicyFunc(p0)
+}
+
+func (f *UserService) SetRegistrationPolicy(p0 context.Context, p1 *separation.SetRegistrationPolicyParams) error {
+	f.record("SetRegistrationPolicy")
+	if f.SetRegistrationPolicyFunc == nil {
+		panic("UserService.SetRegistrationPolicy called, but SetRegistrationPolicyFunc is not set")
+	}
+	return f.SetRegistrationPolicyFunc(p0, p1)
+}
+
+func (f *UserService) Referrals(p0 context.Context, p1 separation.Email) (*separation.Referrals, error) {
+	f.record("Referrals")
+	if f.ReferralsFunc == nil {
+		panic("UserService.Referrals called, but ReferralsFunc is not set")
+	}
+	return f.ReferralsFunc(p0, p1)
+}
+
+func (f *UserService) SendPhoneCode(p0 context.Context, p1 *separation.SendPhoneCodeParams) error {
+	f.record("SendPhoneCode")
+	if f.SendPhoneCodeFunc == nil {
+		panic("UserService.SendPhoneCode called, but SendPhoneCodeFunc is not set")
+	}
+	return f.SendPhoneCodeFunc(p0, p1)
+}
+
+func (f *UserService) VerifyPhone(p0 context.Context, p1 *separation.VerifyPhoneParams) error {
+	f.record("VerifyPhone")
+	if f.VerifyPhoneFunc == nil {
+		panic("UserService.VerifyPhone called, but VerifyPhoneFunc is not set")
+	}
+	return f.VerifyPhoneFunc(p0, p1)
+}
+
+func (f *UserService) RequestMagicLink(p0 context.Context, p1 *separation.RequestMagicLinkParams) error {
+	f.record("RequestMagicLink")
+	if f.RequestMagicLinkFunc == nil {
+		panic("UserService.RequestMagicLink called, but RequestMagicLinkFunc is not set")
+	}
+	return f.RequestMagicLinkFunc(p0, p1)
+}
+
+func (f *UserService) RedeemMagicLink(p0 context.Context, p1 *separation.RedeemMagicLinkParams) (*separation.User, error) {
+	f.record("RedeemMagicLink")
+	if f.RedeemMagicLinkFunc == nil {
+		panic("UserService.RedeemMagicLink called, but RedeemMagicLinkFunc is not set")
+	}
+	return f.RedeemMagicLinkFunc(p0, p1)
+}
+
+func (f *UserService) StartSession(p0 context.Context, p1 *separation.StartSessionParams) error {
+	f.record("StartSession")
+	if f.StartSessionFunc == nil {
+		panic("UserService.StartSession called, but StartSessionFunc is not set")
+	}
+	return f.StartSessionFunc(p0, p1)
+}
+
+func (f *UserService) AuthenticateSession(p0 context.Context, p1 *separation.AuthenticateSessionParams) error {
+	f.record("AuthenticateSession")
+	if f.AuthenticateSessionFunc == nil {
+		panic("UserService.AuthenticateSession called, but AuthenticateSessionFunc is not set")
+	}
+	return f.AuthenticateSessionFunc(p0, p1)
+}
+
+func (f *UserService) ListSessions(p0 context.Context, p1 *separation.ListSessionsQuery) ([]*separation.Session, error) {
+	f.record("ListSessions")
+	if f.ListSessionsFunc == nil {
+		panic("UserService.ListSessions called, but ListSessionsFunc is not set")
+	}
+	return f.ListSessionsFunc(p0, p1)
+}
+
+func (f *UserService) RevokeSession(p0 context.Context, p1 *separation.RevokeSessionParams) error {
+	f.record("RevokeSession")
+	if f.RevokeSessionFunc == nil {
+		panic("UserService.RevokeSession called, but RevokeSessionFunc is not set")
+	}
+	return f.RevokeSessionFunc(p0, p1)
+}
+
+func (f *UserService) ListLogins(p0 context.Context, p1 *separation.ListLoginsQuery) ([]*separation.Login, error) {
+	f.record("ListLogins")
+	if f.ListLoginsFunc == nil {
+		panic("UserService.ListLogins called, but ListLoginsFunc is not set")
+	}
+	return f.ListLoginsFunc(p0, p1)
+}
+
+func (f *UserService) RecordActivity(p0 context.Context, p1 *separation.RecordActivityParams) error {
+	f.record("RecordActivity")
+	if f.RecordActivityFunc == nil {
+		panic("UserService.RecordActivity called, but RecordActivityFunc is not set")
+	}
+	return f.RecordActivityFunc(p0, p1)
+}
+
+func (f *UserService) InactiveUsers(p0 context.Context, p1 *separation.InactiveUsersQuery) ([]*separation.User, error) {
+	f.record("InactiveUsers")
+	if f.InactiveUsersFunc == nil {
+		panic("UserService.InactiveUsers called, but InactiveUsersFunc is not set")
+	}
+	return f.InactiveUsersFunc(p0, p1)
+}
+
+func (f *UserService) Me(p0 context.Context) (*separation.User, error) {
+	f.record("Me")
+	if f.MeFunc == nil {
+		panic("UserService.Me called, but MeFunc is not set")
+	}
+	return f.MeFunc(p0)
+}
+
+func (f *UserService) PreviewBulkDelete(p0 context.Context, p1 *separation.UserFilter) (*separation.BulkDeletePreview, error) {
+	f.record("PreviewBulkDelete")
+	if f.PreviewBulkDeleteFunc == nil {
+		panic("UserService.PreviewBulkDelete called, but PreviewBulkDeleteFunc is not set")
+	}
+	return f.PreviewBulkDeleteFunc(p0, p1)
+}
+
+func (f *UserService) BulkDelete(p0 context.Context, p1 *separation.BulkDeleteParams) error {
+	f.record("BulkDelete")
+	if f.BulkDeleteFunc == nil {
+		panic("UserService.BulkDelete called, but BulkDeleteFunc is not set")
+	}
+	return f.BulkDeleteFunc(p0, p1)
+}
+
+func (f *UserService) List(p0 context.Context, p1 *separation.ListUsersQuery) ([]*separation.User, error) {
+	f.record("List")
+	if f.ListFunc == nil {
+		panic("UserService.List called, but ListFunc is not set")
+	}
+	return f.ListFunc(p0, p1)
+}
+
+func (f *UserService) SetLabels(p0 context.Context, p1 *separation.SetLabelsParams) error {
+	f.record("SetLabels")
+	if f.SetLabelsFunc == nil {
+		panic("UserService.SetLabels called, but SetLabelsFunc is not set")
+	}
+	return f.SetLabelsFunc(p0, p1)
+}
+
+func (f *UserService) RemoveLabels(p0 context.Context, p1 *separation.RemoveLabelsParams) error {
+	f.record("RemoveLabels")
+	if f.RemoveLabelsFunc == nil {
+		panic("UserService.RemoveLabels called, but RemoveLabelsFunc is not set")
+	}
+	return f.RemoveLabelsFunc(p0, p1)
+}
+
+func (f *UserService) Export(p0 context.Context, p1 *separation.ExportUsersQuery) ([]*separation.User, error) {
+	f.record("Export")
+	if f.ExportFunc == nil {
+		panic("UserService.Export called, but ExportFunc is not set")
+	}
+	return f.ExportFunc(p0, p1)
+}
+
+func (f *UserService) Import(p0 context.Context, p1 []*separation.User) error {
+	f.record("Import")
+	if f.ImportFunc == nil {
+		panic("UserService.Import called, but ImportFunc is not set")
+	}
+	return f.ImportFunc(p0, p1)
+}
+
+// OrgService is a fake separation.OrgService.
+type OrgService struct {
+	calls
+
+	CreateFunc       func(p0 context.Context, p1 *separation.CreateOrgParams) (*separation.Organization, error)
+	GetFunc          func(ctx context.Context, id string) (*separation.Organization, error)
+	AddMemberFunc    func(p0 context.Context, p1 *separation.AddMemberParams) error
+	RemoveMemberFunc func(p0 context.Context, p1 *separation.RemoveMemberParams) error
+	MembersFunc      func(ctx context.Context, orgID string) ([]*separation.OrgMember, error)
+	MineFunc         func(p0 context.Context) ([]*separation.UserOrg, error)
+	IssueTokenFunc   func(p0 context.Context, p1 *separation.IssueOrgTokenParams) (*separation.IssuedOrgToken, error)
+	RevokeTokenFunc  func(p0 context.Context, p1 *separation.RevokeOrgTokenParams) error
+	TokensFunc       func(ctx context.Context, orgID string) ([]*separation.OrgToken, error)
+	VerifyTokenFunc  func(ctx context.Context, token string) (*separation.OrgToken, error)
+}
+
+var _ separation.OrgService = (*OrgService)(nil)
+
+func (f *OrgService) Create(p0 context.Context, p1 *separation.CreateOrgParams) (*separation.Organization, error) {
+	f.record("Create")
+	if f.CreateFunc == nil {
+		panic("OrgService.Create called, but CreateFunc is not set")
+	}
+	return f.CreateFunc(p0, p1)
+}
+
+func (f *OrgService) Get(ctx context.Context, id string) (*separation.Organization, error) {
+	f.record("Get")
+	if f.GetFunc == nil {
+		panic("OrgService.Get called, but GetFunc is not set")
+	}
+	return f.GetFunc(ctx, id)
+}
+
+func (f *OrgService) AddMember(p0 context.Context, p1 *separation.AddMemberParams) error {
+	f.record("AddMember")
+	if f.AddMemberFunc == nil {
+		panic("OrgService.AddMember called, but AddMemberFunc is not set")
+	}
+	return f.AddMemberFunc(p0, p1)
+}
+
+func (f *OrgService) RemoveMember(p0 context.Context, p1 *separation.RemoveMemberParams) error {
+	f.record("RemoveMember")
+	if f.RemoveMemberFunc == nil {
+		panic("OrgService.RemoveMember called, but RemoveMemberFunc is not set")
+	}
+	return f.RemoveMemberFunc(p0, p1)
+}
+
+func (f *OrgService) Members(ctx context.Context, orgID string) ([]*separation.OrgMember, error) {
+	f.record("Members")
+	if f.MembersFunc == nil {
+		panic("OrgService.Members called, but MembersFunc is not set")
+	}
+	return f.MembersFunc(ctx, orgID)
+}
+
+func (f *OrgService) Mine(p0 context.Context) ([]*separation.UserOrg, error) {
+	f.record("Mine")
+	if f.MineFunc == nil {
+		panic("OrgService.Mine called, but MineFunc is not set")
+	}
+	return f.MineFunc(p0)
+}
+
+func (f *OrgService) IssueToken(p0 context.Context, p1 *separation.IssueOrgTokenParams) (*separation.IssuedOrgToken, error) {
+	f.record("IssueToken")
+	if f.IssueTokenFunc == nil {
+		panic("OrgService.IssueToken called, but IssueTokenFunc is not set")
+	}
+	return f.IssueTokenFunc(p0, p1)
+}
+
+func (f *OrgService) RevokeToken(p0 context.Context, p1 *separation.RevokeOrgTokenParams) error {
+	f.record("RevokeToken")
+	if f.RevokeTokenFunc == nil {
+		panic("OrgService.RevokeToken called, but RevokeTokenFunc is not set")
+	}
+	return f.RevokeTokenFunc(p0, p1)
+}
+
+func (f *OrgService) Tokens(ctx context.Context, orgID string) ([]*separation.OrgToken, error) {
+	f.record("Tokens")
+	if f.TokensFunc == nil {
+		panic("OrgService.Tokens called, but TokensFunc is not set")
+	}
+	return f.TokensFunc(ctx, orgID)
+}
+
+func (f *OrgService) VerifyToken(ctx context.Context, token string) (*separation.OrgToken, error) {
+	f.record("VerifyToken")
+	if f.VerifyTokenFunc == nil {
+		panic("OrgService.VerifyToken called, but VerifyTokenFunc is not set")
+	}
+	return f.VerifyTokenFunc(ctx, token)
+}
+
+// EventHandler is a fake separation.EventHandler.
+type EventHandler struct {
+	calls
+
+	HandleEventFunc func(ctx context.Context, e separation.Event)
+}
+
+var _ separation.EventHandler = (*EventHandler)(nil)
+
+func (f *EventHandler) HandleEvent(ctx context.Context, e separation.Event) {
+	f.record("HandleEvent")
+	if f.HandleEventFunc == nil {
+		panic("EventHandler.HandleEvent called, but HandleEventFunc is not set")
+	}
+	f.HandleEventFunc(ctx, e)
+}
+
+// InviteSender is a fake separation.InviteSender.
+type InviteSender struct {
+	calls
+
+	SendInviteFunc func(ctx context.Context, invite *separation.Invite, token string) error
+}
+
+var _ separation.InviteSender = (*InviteSender)(nil)
+
+func (f *InviteSender) SendInvite(ctx context.Context, invite *separation.Invite, token string) error {
+	f.record("SendInvite")
+	if f.SendInviteFunc == nil {
+		panic("InviteSender.SendInvite called, but SendInviteFunc is not set")
+	}
+	return f.SendInviteFunc(ctx, invite, token)
+}
+
+// BlobStore is a fake separation.BlobStore.
+type BlobStore struct {
+	calls
+
+	PutFunc    func(ctx context.Context, key string, contentType string, data []byte) error
+	GetFunc    func(ctx context.Context, key string) ([]byte, string, error)
+	DeleteFunc func(ctx context.Context, key string) error
+}
+
+var _ separation.BlobStore = (*BlobStore)(nil)
+
+func (f *BlobStore) Put(ctx context.Context, key string, contentType string, data []byte) error {
+	f.record("Put")
+	if f.PutFunc == nil {
+		panic("BlobStore.Put called, but PutFunc is not set")
+	}
+	return f.PutFunc(ctx, key, contentType, data)
+}
+
+func (f *BlobStore) Get(ctx context.Context, key string) ([]byte, string, error) {
+	f.record("Get")
+	if f.GetFunc == nil {
+		panic("BlobStore.Get called, but GetFunc is not set")
+	}
+	return f.GetFunc(ctx, key)
+}
+
+func (f *BlobStore) Delete(ctx context.Context, key string) error {
+	f.record("Delete")
+	if f.DeleteFunc == nil {
+		panic("BlobStore.Delete called, but DeleteFunc is not set")
+	}
+	return f.DeleteFunc(ctx, key)
+}
+
+// Authenticator is a fake separation.Authenticator.
+type Authenticator struct {
+	calls
+
+	AuthenticateFunc func(r *http.Request) (*principal.Principal, error)
+}
+
+var _ separation.Authenticator = (*Authenticator)(nil)
+
+func (f *Authenticator) Authenticate(r *http.Request) (*principal.Principal, error) {
+	f.record("Authenticate")
+	if f.AuthenticateFunc == nil {
+		panic("Authenticator.Authenticate called, but AuthenticateFunc is not set")
+	}
+	return f.AuthenticateFunc(r)
+}
+
+// AlertSink is a fake separation.AlertSink.
+type AlertSink struct {
+	calls
+
+	SendAlertFunc func(ctx context.Context, a *separation.Alert) error
+}
+
+var _ separation.AlertSink = (*AlertSink)(nil)
+
+func (f *AlertSink) SendAlert(ctx context.Context, a *separation.Alert) error {
+	f.record("SendAlert")
+	if f.SendAlertFunc == nil {
+		panic("AlertSink.SendAlert called, but SendAlertFunc is not set")
+	}
+	return f.SendAlertFunc(ctx, a)
+}
+
+// SecretsProvider is a fake separation.SecretsProvider.
+type SecretsProvider struct {
+	calls
+
+	SecretFunc func(ctx context.Context, name string) (*separation.Secret, error)
+}
+
+var _ separation.SecretsProvider = (*SecretsProvider)(nil)
+
+func (f *SecretsProvider) Secret(ctx context.Context, name string) (*separation.Secret, error) {
+	f.record("Secret")
+	if f.SecretFunc == nil {
+		panic("SecretsProvider.Secret called, but SecretFunc is not set")
+	}
+	return f.SecretFunc(ctx, name)
+}
+
+// SMSProvider is a fake separation.SMSProvider.
+type SMSProvider struct {
+	calls
+
+	SendSMSFunc func(ctx context.Context, to string, body string) error
+}
+
+var _ separation.SMSProvider = (*SMSProvider)(nil)
+
+func (f *SMSProvider) SendSMS(ctx context.Context, to string, body string) error {
+	f.record("SendSMS")
+	if f.SendSMSFunc == nil {
+		panic("SMSProvider.SendSMS called, but SendSMSFunc is not set")
+	}
+	return f.SendSMSFunc(ctx, to, body)
+}
@@ -0,0 +1,15 @@
+// Package mocks holds fakes of the separation interfaces, for tests that need
+// a collaborator to behave a certain way or to check how it was called.
+// Tests of package separation itself must be in package separation_test to use them,
+// as mocks imports separation:
+//
+//	users := &mocks.UserStorer{
+//		GetFunc: func(ctx context.Context, email separation.Email) (*separation.User, error) {
+//			return nil, separation.ErrUserNotFound
+//		},
+//	}
+//
+// Regenerate the fakes with go generate after changing any of the interfaces.
+package mocks
+
+//go:generate go run ../cmd/fakegen -src ../.. -import github.com/oralordos/separation -type UserStorer,PreferencesStorer,InviteStorer,OrgStorer,OrgTokenStorer,UserService,OrgService,EventHandler,InviteSender,BlobStore,Authenticator,AlertSink,SecretsProvider,SMSProvider -o fakes.go
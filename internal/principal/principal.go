@@ -0,0 +1,49 @@
+// Package principal carries the authenticated caller through a request's context,
+// so the access layer can record who is calling and the business logic can act on it.
+package principal
+
+import (
+	"context"
+
+	"github.com/oralordos/separation/internal/ctxkeys"
+)
+
+// Principal is whoever made the current request.
+type Principal struct {
+	// Subject uniquely identifies the caller within the scheme that authenticated it.
+	Subject string
+	// Email is set when the caller is a registered user.
+	Email string
+	// Scheme names the authenticator that produced the principal.
+	Scheme string
+	Admin  bool
+
+	// Org is set when the caller acts for an organization, such as with an organization API token.
+	Org string
+	// Scopes limit what the caller may do. A nil Scopes is not limited beyond the caller's own rights.
+	Scopes []string
+	// Session is the ID of the server-side session the caller signed in with, when they used a session cookie.
+	Session string
+}
+
+// HasScope reports whether the caller holds scope.
+func (p *Principal) HasScope(scope string) bool {
+	for _, s := range p.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+var contextKey = ctxkeys.New[*Principal]("principal")
+
+func NewContext(ctx context.Context, p *Principal) context.Context {
+	return contextKey.With(ctx, p)
+}
+
+// FromContext returns the principal for the request, if the caller authenticated.
+func FromContext(ctx context.Context) (*Principal, bool) {
+	p, ok := contextKey.From(ctx)
+	return p, ok && p != nil
+}
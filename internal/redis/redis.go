@@ -0,0 +1,249 @@
+// Package redis is a small Redis client speaking RESP2 over TCP, enough for the
+// counters, locks and messages instances share. Commands are sent one at a time on
+// pooled connections.
+package redis
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ErrClosed is returned by commands on a closed client.
+var ErrClosed = errors.New("Redis client is closed")
+
+// Error is an error reply from the server, such as WRONGTYPE.
+type Error string
+
+func (e Error) Error() string {
+	return "Redis: " + string(e)
+}
+
+// Options configure how connections are opened. The zero value connects without a password to database 0.
+type Options struct {
+	Password string
+	DB       int
+	// PoolSize is how many idle connections are kept. It defaults to 8.
+	PoolSize int
+	// DialTimeout bounds connecting, and commands without a context deadline. It defaults to 5s.
+	DialTimeout time.Duration
+}
+
+// Client sends commands to the server at one address. It is safe for concurrent use.
+type Client struct {
+	addr string
+	opts Options
+
+	mu     sync.Mutex
+	idle   []*Conn
+	closed bool
+}
+
+func New(addr string, opts Options) *Client {
+	if opts.PoolSize <= 0 {
+		opts.PoolSize = 8
+	}
+	if opts.DialTimeout <= 0 {
+		opts.DialTimeout = 5 * time.Second
+	}
+	return &Client{
+		addr: addr,
+		opts: opts,
+	}
+}
+
+// Conn is a single connection, for commands such as SUBSCRIBE that hold on to it.
+type Conn struct {
+	nc      net.Conn
+	r       *bufio.Reader
+	timeout time.Duration
+}
+
+// Dial opens a connection of its own, outside the pool. The caller closes it.
+func (c *Client) Dial(ctx context.Context) (*Conn, error) {
+	d := net.Dialer{Timeout: c.opts.DialTimeout}
+	nc, err := d.DialContext(ctx, "tcp", c.addr)
+	if err != nil {
+		return nil, err
+	}
+	conn := &Conn{nc: nc, r: bufio.NewReader(nc), timeout: c.opts.DialTimeout}
+
+	if c.opts.Password != "" {
+		_, err = conn.Do(ctx, "AUTH", c.opts.Password)
+		if err != nil {
+			nc.Close()
+			return nil, err
+		}
+	}
+	if c.opts.DB != 0 {
+		_, err = conn.Do(ctx, "SELECT", strconv.Itoa(c.opts.DB))
+		if err != nil {
+			nc.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+func (c *Client) get(ctx context.Context) (*Conn, error) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil, ErrClosed
+	}
+	if n := len(c.idle); n > 0 {
+		conn := c.idle[n-1]
+		c.idle = c.idle[:n-1]
+		c.mu.Unlock()
+		return conn, nil
+	}
+	c.mu.Unlock()
+	return c.Dial(ctx)
+}
+
+func (c *Client) put(conn *Conn) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed || len(c.idle) >= c.opts.PoolSize {
+		conn.Close()
+		return
+	}
+	c.idle = append(c.idle, conn)
+}
+
+// Do sends a command and returns its reply. Replies are int64, string, nil for a
+// null reply, or []interface{} of those. Error replies are returned as Error.
+func (c *Client) Do(ctx context.Context, args ...string) (interface{}, error) {
+	conn, err := c.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	reply, err := conn.Do(ctx, args...)
+	var replyErr Error
+	if err != nil && !errors.As(err, &replyErr) {
+		// The connection may be part way through a reply, so it cannot be reused
+		conn.Close()
+		return nil, err
+	}
+	c.put(conn)
+	return reply, err
+}
+
+// Close closes the idle connections, and any returned to the pool later.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	for _, conn := range c.idle {
+		conn.Close()
+	}
+	c.idle = nil
+	return nil
+}
+
+func (conn *Conn) deadline(ctx context.Context) time.Time {
+	if d, ok := ctx.Deadline(); ok {
+		return d
+	}
+	return time.Now().Add(conn.timeout)
+}
+
+// Do sends a command on the connection and reads its reply.
+func (conn *Conn) Do(ctx context.Context, args ...string) (interface{}, error) {
+	err := conn.Send(ctx, args...)
+	if err != nil {
+		return nil, err
+	}
+	return conn.Receive(conn.deadline(ctx))
+}
+
+// Send writes a command without waiting for a reply.
+func (conn *Conn) Send(ctx context.Context, args ...string) error {
+	buf := []byte("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, a := range args {
+		buf = append(buf, '$')
+		buf = strconv.AppendInt(buf, int64(len(a)), 10)
+		buf = append(buf, "\r\n"...)
+		buf = append(buf, a...)
+		buf = append(buf, "\r\n"...)
+	}
+	conn.nc.SetWriteDeadline(conn.deadline(ctx))
+	_, err := conn.nc.Write(buf)
+	return err
+}
+
+// Receive reads the next reply, waiting until deadline, or forever when it is zero.
+func (conn *Conn) Receive(deadline time.Time) (interface{}, error) {
+	conn.nc.SetReadDeadline(deadline)
+	return readReply(conn.r, 0)
+}
+
+func (conn *Conn) Close() error {
+	return conn.nc.Close()
+}
+
+// maxDepth bounds nested arrays, which no command used here replies with more than two of.
+const maxDepth = 8
+
+func readReply(r *bufio.Reader, depth int) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("Redis: malformed reply %q", line)
+	}
+	kind, body := line[0], line[1:len(line)-2]
+
+	switch kind {
+	case '+':
+		return body, nil
+	case '-':
+		return nil, Error(body)
+	case ':':
+		n, err := strconv.ParseInt(body, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Redis: malformed integer %q", body)
+		}
+		return n, nil
+	case '$', '*':
+		n, err := strconv.Atoi(body)
+		if err != nil || n < -1 {
+			return nil, fmt.Errorf("Redis: malformed length %q", body)
+		}
+		if n == -1 {
+			return nil, nil
+		}
+		if kind == '$' {
+			b := make([]byte, n+2)
+			_, err = io.ReadFull(r, b)
+			if err != nil {
+				return nil, err
+			}
+			return string(b[:n]), nil
+		}
+		if depth >= maxDepth {
+			return nil, fmt.Errorf("Redis: reply nested too deeply")
+		}
+		items := make([]interface{}, 0, n)
+		for i := 0; i < n; i++ {
+			item, err := readReply(r, depth+1)
+			var replyErr Error
+			if err != nil && !errors.As(err, &replyErr) {
+				return nil, err
+			}
+			if err != nil {
+				item = replyErr
+			}
+			items = append(items, item)
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("Redis: unknown reply type %q", kind)
+}
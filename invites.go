@@ -0,0 +1,468 @@
+package separation
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/oralordos/separation/internal/clock"
+)
+
+// Action Layer
+var ErrInviteNotFound = registerError(errors.New("Invite not found"), "invite_not_found", http.StatusNotFound, "No invite has the requested ID")
+
+// Invite lets one email address register, as a given role, until it expires.
+// Only a hash of its token is kept, so the token cannot be recovered from storage.
+type Invite struct {
+	ID    string `json:"id"`
+	Email Email  `json:"email"`
+	// Role is applied to the new user as the role label
+	Role      string `json:"role,omitempty"`
+	TokenHash string `json:"-"`
+
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	// Sends counts how many times the invite was sent, including resends
+	Sends     int        `json:"sends"`
+	UsedAt    *time.Time `json:"used_at,omitempty"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+// Invite states, as reported by Status.
+const (
+	InvitePending = "pending"
+	InviteUsed    = "used"
+	InviteRevoked = "revoked"
+	InviteExpired = "expired"
+)
+
+func (i *Invite) Status(now time.Time) string {
+	switch {
+	case i.UsedAt != nil:
+		return InviteUsed
+	case i.RevokedAt != nil:
+		return InviteRevoked
+	case !now.Before(i.ExpiresAt):
+		return InviteExpired
+	}
+	return InvitePending
+}
+
+type InviteStorer interface {
+	// Get may return an ErrInviteNotFound error
+	Get(ctx context.Context, id string) (*Invite, error)
+	// GetByToken looks an invite up by the hash of its token
+	// GetByToken may return an ErrInviteNotFound error
+	GetByToken(ctx context.Context, tokenHash string) (*Invite, error)
+	Save(ctx context.Context, invite *Invite) error
+	// List returns every invite in no particular order
+	List(ctx context.Context) ([]*Invite, error)
+}
+
+// RepositoryInviteStorage implements InviteStorer on top of any invite repository.
+type RepositoryInviteStorage struct {
+	repo Repository[string, *Invite]
+}
+
+func NewRepositoryInviteStorage(repo Repository[string, *Invite]) *RepositoryInviteStorage {
+	return &RepositoryInviteStorage{
+		repo: repo,
+	}
+}
+
+func NewMemoryInviteStorage() *RepositoryInviteStorage {
+	return NewRepositoryInviteStorage(NewMemoryRepository(func(i *Invite) string {
+		return i.ID
+	}))
+}
+
+func (rs *RepositoryInviteStorage) Get(ctx context.Context, id string) (*Invite, error) {
+	i, err := rs.repo.Get(ctx, id)
+	if err == ErrNotFound {
+		return nil, ErrInviteNotFound
+	}
+	return i, err
+}
+
+// GetByToken scans every invite. There are few enough that an index is not worth keeping.
+func (rs *RepositoryInviteStorage) GetByToken(ctx context.Context, tokenHash string) (*Invite, error) {
+	invites, err := rs.repo.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, i := range invites {
+		if i.TokenHash == tokenHash {
+			return i, nil
+		}
+	}
+	return nil, ErrInviteNotFound
+}
+
+func (rs *RepositoryInviteStorage) Save(ctx context.Context, invite *Invite) error {
+	return rs.repo.Save(ctx, invite)
+}
+
+func (rs *RepositoryInviteStorage) List(ctx context.Context) ([]*Invite, error) {
+	return rs.repo.List(ctx)
+}
+
+// InviteSender delivers an invite's token to the invited address.
+type InviteSender interface {
+	SendInvite(ctx context.Context, invite *Invite, token string) error
+}
+
+// LogInviteSender writes invites to a log instead of delivering them, for development
+// and for deployments that hand the token returned by the admin API on themselves.
+type LogInviteSender struct {
+	w io.Writer
+}
+
+func NewLogInviteSender(w io.Writer) *LogInviteSender {
+	return &LogInviteSender{w: w}
+}
+
+func (ls *LogInviteSender) SendInvite(ctx context.Context, invite *Invite, token string) error {
+	_, err := fmt.Fprintf(ls.w, "Invite %s for %s expires %s, token %s\n", invite.ID, invite.Email, invite.ExpiresAt.Format(time.RFC3339), token)
+	return err
+}
+
+// Business Logic
+var (
+	ErrInviteRequired   = registerError(errors.New("Registration requires an invite"), "invite_required", http.StatusForbidden, "Registration is by invite only, and no invite token was given")
+	ErrInviteInvalid    = registerError(errors.New("Invite is invalid, used, revoked, expired or for another email"), "invite_invalid", http.StatusForbidden, "The invite token is unknown, used, revoked, expired or for another email")
+	ErrInviteNotPending = registerError(errors.New("Invite has already been used, revoked or has expired"), "invite_not_pending", http.StatusConflict, "The invite has already been used or revoked")
+)
+
+func hashInviteToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// newInviteToken returns a random invite ID and token.
+func newInviteToken() (id, token string, err error) {
+	b := make([]byte, 40)
+	_, err = rand.Read(b)
+	if err != nil {
+		return "", "", err
+	}
+	return hex.EncodeToString(b[:8]), base64.RawURLEncoding.EncodeToString(b[8:]), nil
+}
+
+// CreatedInvite is an invite along with its token, which is only available when it is issued.
+type CreatedInvite struct {
+	*Invite
+	Token string `json:"token"`
+}
+
+type CreateInviteParams struct {
+	Email Email  `json:"email"`
+	Role  string `json:"role"`
+	// ExpiresAt defaults to the configured invite lifetime from now
+	ExpiresAt time.Time `json:"expires_at"`
+
+	// ID and Token are issued by the service before dispatching
+	ID    string `json:"-"`
+	Token string `json:"-"`
+}
+
+func (cp *CreateInviteParams) CommandName() string {
+	return "CreateInvite"
+}
+
+func (cp *CreateInviteParams) Validate() error {
+	if cp.Email.IsZero() {
+		return ErrEmailEmpty
+	}
+	if cp.Role != "" {
+		return validateLabelValue("role", cp.Role)
+	}
+	return nil
+}
+
+type ResendInviteParams struct {
+	ID string `json:"id"`
+
+	// Token replaces the invite's token, and is issued by the service before dispatching
+	Token string `json:"-"`
+}
+
+func (rp *ResendInviteParams) CommandName() string {
+	return "ResendInvite"
+}
+
+type RevokeInviteParams struct {
+	ID string `json:"id"`
+}
+
+func (rp *RevokeInviteParams) CommandName() string {
+	return "RevokeInvite"
+}
+
+type ListInvitesQuery struct{}
+
+func (lq *ListInvitesQuery) QueryName() string {
+	return "ListInvites"
+}
+
+// InviteStatus is an invite with its state worked out.
+type InviteStatus struct {
+	*Invite
+	Status string `json:"status"`
+}
+
+type InviteHandler struct {
+	userStorage   UserStorer
+	inviteStorage InviteStorer
+	sender        InviteSender
+	ttl           time.Duration
+	clock         clock.Clock
+}
+
+// NewInviteHandler issues invites that expire after ttl unless told otherwise.
+func NewInviteHandler(us UserStorer, is InviteStorer, sender InviteSender, ttl time.Duration, clk clock.Clock) *InviteHandler {
+	return &InviteHandler{
+		userStorage:   us,
+		inviteStorage: is,
+		sender:        sender,
+		ttl:           ttl,
+		clock:         clk,
+	}
+}
+
+func (ih *InviteHandler) Create(ctx context.Context, cmd Command) error {
+	params, ok := cmd.(*CreateInviteParams)
+	if !ok {
+		return fmt.Errorf("InviteHandler cannot create %T", cmd)
+	}
+
+	err := requireAdmin(ctx)
+	if err != nil {
+		return err
+	}
+
+	_, err = ih.userStorage.Get(ctx, params.Email)
+	if err == nil {
+		return ErrEmailExists
+	} else if err != ErrUserNotFound {
+		return err
+	}
+
+	now := ih.clock.Now().UTC()
+	expires := params.ExpiresAt
+	if expires.IsZero() {
+		expires = now.Add(ih.ttl)
+	} else if !expires.After(now) {
+		return NewValidationError("Invite expiry must be in the future")
+	}
+
+	invite := &Invite{
+		ID:        params.ID,
+		Email:     params.Email,
+		Role:      params.Role,
+		TokenHash: hashInviteToken(params.Token),
+		CreatedAt: now,
+		ExpiresAt: expires,
+		Sends:     1,
+	}
+	err = ih.inviteStorage.Save(ctx, invite)
+	if err != nil {
+		return err
+	}
+	return ih.sender.SendInvite(ctx, invite, params.Token)
+}
+
+// Resend gives a pending invite a new token and a fresh lifetime, and sends it again.
+// The old token stops working.
+func (ih *InviteHandler) Resend(ctx context.Context, cmd Command) error {
+	params, ok := cmd.(*ResendInviteParams)
+	if !ok {
+		return fmt.Errorf("InviteHandler cannot resend %T", cmd)
+	}
+
+	err := requireAdmin(ctx)
+	if err != nil {
+		return err
+	}
+
+	invite, err := ih.inviteStorage.Get(ctx, params.ID)
+	if err != nil {
+		return err
+	}
+	now := ih.clock.Now().UTC()
+	// An expired invite may be resent, that is what resending is for
+	if s := invite.Status(now); s != InvitePending && s != InviteExpired {
+		return ErrInviteNotPending
+	}
+
+	updated := *invite
+	updated.TokenHash = hashInviteToken(params.Token)
+	updated.ExpiresAt = now.Add(ih.ttl)
+	updated.Sends++
+	err = ih.inviteStorage.Save(ctx, &updated)
+	if err != nil {
+		return err
+	}
+	return ih.sender.SendInvite(ctx, &updated, params.Token)
+}
+
+func (ih *InviteHandler) Revoke(ctx context.Context, cmd Command) error {
+	params, ok := cmd.(*RevokeInviteParams)
+	if !ok {
+		return fmt.Errorf("InviteHandler cannot revoke %T", cmd)
+	}
+
+	err := requireAdmin(ctx)
+	if err != nil {
+		return err
+	}
+
+	invite, err := ih.inviteStorage.Get(ctx, params.ID)
+	if err != nil {
+		return err
+	}
+	if invite.UsedAt != nil {
+		return ErrInviteNotPending
+	}
+	if invite.RevokedAt != nil {
+		return nil
+	}
+
+	now := ih.clock.Now().UTC()
+	updated := *invite
+	updated.RevokedAt = &now
+	return ih.inviteStorage.Save(ctx, &updated)
+}
+
+func (ih *InviteHandler) List(ctx context.Context, q Query) (interface{}, error) {
+	err := requireAdmin(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	invites, err := ih.inviteStorage.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	now := ih.clock.Now()
+	statuses := make([]*InviteStatus, len(invites))
+	for i, invite := range invites {
+		statuses[i] = &InviteStatus{Invite: invite, Status: invite.Status(now)}
+	}
+	return statuses, nil
+}
+
+// redeemableInvite returns the pending invite for token, if it was issued to email.
+// It may return an ErrInviteInvalid error.
+func redeemableInvite(ctx context.Context, invites InviteStorer, token string, email Email, now time.Time) (*Invite, error) {
+	invite, err := invites.GetByToken(ctx, hashInviteToken(token))
+	if err == ErrInviteNotFound {
+		return nil, ErrInviteInvalid
+	} else if err != nil {
+		return nil, err
+	}
+
+	if invite.Status(now) != InvitePending || invite.Email != email {
+		return nil, ErrInviteInvalid
+	}
+	return invite, nil
+}
+
+// Access Layer
+// Invites serves GET /invites, listing every invite, and POST /invites with a body of
+// {"email": "...", "role": "...", "expires_at": "..."}, responding with the new invite's token.
+func (a *AdminHTTP) Invites(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		invites, err := a.users.ListInvites(r.Context())
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(invites)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+	case http.MethodPost:
+		params := &CreateInviteParams{}
+		err := json.NewDecoder(r.Body).Decode(params)
+		if err != nil {
+			writeError(w, r, decodeError(err))
+			return
+		}
+
+		created, err := a.users.CreateInvite(r.Context(), params)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(w).Encode(created)
+	default:
+		writeError(w, r, NewMethodError("Invites requires a get or post request"))
+	}
+}
+
+// ResendInvite serves POST /invites/resend with a body of {"id": "..."}, responding with the new token.
+func (a *AdminHTTP) ResendInvite(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, NewMethodError("ResendInvite requires a post request"))
+		return
+	}
+
+	params := &ResendInviteParams{}
+	err := json.NewDecoder(r.Body).Decode(params)
+	if err != nil {
+		writeError(w, r, decodeError(err))
+		return
+	}
+
+	created, err := a.users.ResendInvite(r.Context(), params)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(created)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+}
+
+// RevokeInvite serves POST /invites/revoke with a body of {"id": "..."}.
+func (a *AdminHTTP) RevokeInvite(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, NewMethodError("RevokeInvite requires a post request"))
+		return
+	}
+
+	params := &RevokeInviteParams{}
+	err := json.NewDecoder(r.Body).Decode(params)
+	if err != nil {
+		writeError(w, r, decodeError(err))
+		return
+	}
+
+	err = a.users.RevokeInvite(r.Context(), params)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
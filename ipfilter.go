@@ -0,0 +1,338 @@
+package separation
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oralordos/separation/internal/clock"
+)
+
+// Action Layer
+// IPRule limits which client addresses may reach part of the service.
+type IPRule struct {
+	// Transport is the access layer the rule applies to, such as http or admin. Empty applies to all of them.
+	Transport string `json:"transport,omitempty"`
+	// PathPrefix limits the rule to paths starting with it. Empty applies to every path.
+	PathPrefix string `json:"path_prefix,omitempty"`
+	// Allow lets only these CIDRs or addresses through when it is not empty
+	Allow []string `json:"allow,omitempty"`
+	// Deny turns these CIDRs or addresses away, even when they are allowed
+	Deny []string `json:"deny,omitempty"`
+}
+
+type IPRules struct {
+	Rules     []IPRule  `json:"rules"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type IPRuleStorer interface {
+	// Get returns no rules if nothing has been saved yet
+	Get(ctx context.Context) (*IPRules, error)
+	Save(ctx context.Context, rules *IPRules) error
+}
+
+type MemoryIPRuleStorage struct {
+	mu    sync.Mutex
+	rules IPRules
+}
+
+func NewMemoryIPRuleStorage() *MemoryIPRuleStorage {
+	return &MemoryIPRuleStorage{}
+}
+
+func (ms *MemoryIPRuleStorage) Get(ctx context.Context) (*IPRules, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	r := ms.rules
+	return &r, nil
+}
+
+func (ms *MemoryIPRuleStorage) Save(ctx context.Context, rules *IPRules) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.rules = *rules
+	return nil
+}
+
+// FileIPRuleStorage keeps the IP rules in a JSON file so they survive restarts.
+type FileIPRuleStorage struct {
+	path string
+	mu   sync.Mutex
+}
+
+func NewFileIPRuleStorage(path string) *FileIPRuleStorage {
+	return &FileIPRuleStorage{
+		path: path,
+	}
+}
+
+func (fs *FileIPRuleStorage) Get(ctx context.Context) (*IPRules, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	rules := &IPRules{}
+	b, err := ioutil.ReadFile(fs.path)
+	if os.IsNotExist(err) {
+		return rules, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(b, rules)
+	if err != nil {
+		return nil, err
+	}
+	return rules, nil
+}
+
+func (fs *FileIPRuleStorage) Save(ctx context.Context, rules *IPRules) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	b, err := json.Marshal(rules)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(fs.path, b)
+}
+
+// Business Logic
+var ErrIPBlocked = registerError(errors.New("Requests from your address are not allowed"), "ip_blocked", http.StatusForbidden, "The IP rules do not let requests through from the client's address")
+
+// parseIPNets reads CIDRs or single addresses, which cover only themselves.
+func parseIPNets(entries []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(entries))
+	for _, e := range entries {
+		e = strings.TrimSpace(e)
+		if !strings.Contains(e, "/") {
+			ip := net.ParseIP(e)
+			if ip == nil {
+				return nil, fmt.Errorf("Invalid address %q", e)
+			}
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, n, err := net.ParseCIDR(e)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid CIDR %q", e)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func netsContain(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+type compiledIPRule struct {
+	transport  string
+	pathPrefix string
+	allow      []*net.IPNet
+	deny       []*net.IPNet
+}
+
+func compileIPRules(rules []IPRule) ([]compiledIPRule, error) {
+	compiled := make([]compiledIPRule, 0, len(rules))
+	for i, r := range rules {
+		allow, err := parseIPNets(r.Allow)
+		if err != nil {
+			return nil, NewValidationError(fmt.Sprintf("Rule %d allow: %v", i, err))
+		}
+		deny, err := parseIPNets(r.Deny)
+		if err != nil {
+			return nil, NewValidationError(fmt.Sprintf("Rule %d deny: %v", i, err))
+		}
+		compiled = append(compiled, compiledIPRule{
+			transport:  r.Transport,
+			pathPrefix: r.PathPrefix,
+			allow:      allow,
+			deny:       deny,
+		})
+	}
+	return compiled, nil
+}
+
+type SetIPRulesParams struct {
+	Rules []IPRule `json:"rules"`
+}
+
+func (sp *SetIPRulesParams) Validate() error {
+	_, err := compileIPRules(sp.Rules)
+	return err
+}
+
+type IPFilterService interface {
+	// Rules returns the rules in force
+	Rules(ctx context.Context) IPRules
+	// SetRules replaces every rule, and may return a ValidationError
+	SetRules(ctx context.Context, params *SetIPRulesParams) error
+	// Allowed is called on every request, so it must not hit storage.
+	// Every rule matching the transport and path must let ip through.
+	Allowed(transport, path string, ip net.IP) bool
+}
+
+type IPFilterServiceImpl struct {
+	storage IPRuleStorer
+	clk     clock.Clock
+
+	mu       sync.RWMutex
+	current  IPRules
+	compiled []compiledIPRule
+}
+
+// NewIPFilterServiceImpl loads the saved rules so they survive restarts.
+func NewIPFilterServiceImpl(ctx context.Context, rs IPRuleStorer, clk clock.Clock) (*IPFilterServiceImpl, error) {
+	rules, err := rs.Get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	compiled, err := compileIPRules(rules.Rules)
+	if err != nil {
+		return nil, err
+	}
+
+	return &IPFilterServiceImpl{
+		storage:  rs,
+		clk:      clk,
+		current:  *rules,
+		compiled: compiled,
+	}, nil
+}
+
+func (is *IPFilterServiceImpl) Rules(ctx context.Context) IPRules {
+	is.mu.RLock()
+	defer is.mu.RUnlock()
+	return is.current
+}
+
+func (is *IPFilterServiceImpl) SetRules(ctx context.Context, params *SetIPRulesParams) error {
+	compiled, err := compileIPRules(params.Rules)
+	if err != nil {
+		return err
+	}
+	rules := IPRules{Rules: params.Rules, UpdatedAt: is.clk.Now().UTC()}
+	if rules.Rules == nil {
+		rules.Rules = []IPRule{}
+	}
+
+	is.mu.Lock()
+	defer is.mu.Unlock()
+
+	err = is.storage.Save(ctx, &rules)
+	if err != nil {
+		return err
+	}
+	is.current = rules
+	is.compiled = compiled
+	return nil
+}
+
+func (is *IPFilterServiceImpl) Allowed(transport, path string, ip net.IP) bool {
+	is.mu.RLock()
+	defer is.mu.RUnlock()
+
+	for _, r := range is.compiled {
+		if r.transport != "" && r.transport != transport {
+			continue
+		}
+		if !strings.HasPrefix(path, r.pathPrefix) {
+			continue
+		}
+		if ip == nil {
+			// An unknown address cannot be shown to be allowed
+			return false
+		}
+		if netsContain(r.deny, ip) {
+			return false
+		}
+		if len(r.allow) > 0 && !netsContain(r.allow, ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// Access Layer
+// ipBlocked counts the requests turned away, by transport.
+var ipBlocked = expvar.NewMap("ip_blocked")
+
+// IPFilterMiddleware turns away requests the IP rules do not let through.
+type IPFilterMiddleware struct {
+	next      http.Handler
+	filter    IPFilterService
+	transport string
+	trusted   TrustedProxies
+}
+
+// NewIPFilterMiddleware applies the rules for transport, reading the client address
+// through trusted the same way the ClientIP middleware does.
+func NewIPFilterMiddleware(next http.Handler, filter IPFilterService, transport string, trusted TrustedProxies) *IPFilterMiddleware {
+	return &IPFilterMiddleware{
+		next:      next,
+		filter:    filter,
+		transport: transport,
+		trusted:   trusted,
+	}
+}
+
+func (im *IPFilterMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !im.filter.Allowed(im.transport, r.URL.Path, ClientIP(r, im.trusted)) {
+		ipBlocked.Add(im.transport, 1)
+		writeError(w, r, ErrIPBlocked)
+		return
+	}
+	im.next.ServeHTTP(w, r)
+}
+
+// IPRules serves GET and PUT /ip-rules. PUT replaces every rule.
+func (a *AdminHTTP) IPRules(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		err := json.NewEncoder(w).Encode(a.ipFilter.Rules(r.Context()))
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+	case http.MethodPut:
+		params := &SetIPRulesParams{}
+		dec := json.NewDecoder(r.Body)
+		dec.DisallowUnknownFields()
+		err := dec.Decode(params)
+		if err != nil {
+			writeError(w, r, decodeError(err))
+			return
+		}
+
+		err = a.ipFilter.SetRules(r.Context(), params)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, r, NewMethodError("IPRules requires a get or put request"))
+	}
+}
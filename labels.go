@@ -0,0 +1,388 @@
+package separation
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/oralordos/separation/internal/clock"
+	"golang.org/x/text/language"
+)
+
+// Labels are arbitrary key/value pairs attached to a user, used to select groups of users.
+type Labels map[string]string
+
+var (
+	labelNameRE   = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9_.-]{0,61}[A-Za-z0-9])?$`)
+	labelPrefixRE = regexp.MustCompile(`^[a-z0-9]([a-z0-9.-]{0,251}[a-z0-9])?$`)
+)
+
+// validateLabelKey follows the Kubernetes rules: an optional DNS prefix and a slash,
+// then a name of at most 63 alphanumerics, '-', '_' or '.'.
+func validateLabelKey(key string) error {
+	name := key
+	if i := strings.IndexByte(key, '/'); i >= 0 {
+		if !labelPrefixRE.MatchString(key[:i]) {
+			return NewValidationError(fmt.Sprintf("Label key %q has an invalid prefix", key))
+		}
+		name = key[i+1:]
+	}
+
+	if !labelNameRE.MatchString(name) {
+		return NewValidationError(fmt.Sprintf("Label key %q is invalid", key))
+	}
+	return nil
+}
+
+func validateLabelValue(key, value string) error {
+	if value != "" && !labelNameRE.MatchString(value) {
+		return NewValidationError(fmt.Sprintf("Label value %q for %q is invalid", value, key))
+	}
+	return nil
+}
+
+func (l Labels) Validate() error {
+	for k, v := range l {
+		err := validateLabelKey(k)
+		if err != nil {
+			return err
+		}
+
+		err = validateLabelValue(k, v)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type selectorOp int
+
+const (
+	selectorEquals selectorOp = iota
+	selectorNotEquals
+	selectorExists
+	selectorNotExists
+)
+
+type selectorRequirement struct {
+	key   string
+	op    selectorOp
+	value string
+}
+
+func (sr selectorRequirement) matches(l Labels) bool {
+	v, ok := l[sr.key]
+	switch sr.op {
+	case selectorEquals:
+		return ok && v == sr.value
+	case selectorNotEquals:
+		return !ok || v != sr.value
+	case selectorExists:
+		return ok
+	case selectorNotExists:
+		return !ok
+	}
+	return false
+}
+
+// LabelSelector matches users whose labels meet every requirement.
+// The zero value matches every user.
+type LabelSelector struct {
+	reqs []selectorRequirement
+}
+
+// ParseLabelSelector reads comma separated requirements of the forms
+// key=value, key==value, key!=value, key and !key.
+// It may return a ValidationError.
+func ParseLabelSelector(s string) (LabelSelector, error) {
+	var sel LabelSelector
+	for _, part := range strings.Split(s, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		var req selectorRequirement
+		switch {
+		case strings.Contains(part, "!="):
+			i := strings.Index(part, "!=")
+			req = selectorRequirement{key: part[:i], op: selectorNotEquals, value: part[i+2:]}
+		case strings.Contains(part, "=="):
+			i := strings.Index(part, "==")
+			req = selectorRequirement{key: part[:i], op: selectorEquals, value: part[i+2:]}
+		case strings.Contains(part, "="):
+			i := strings.Index(part, "=")
+			req = selectorRequirement{key: part[:i], op: selectorEquals, value: part[i+1:]}
+		case strings.HasPrefix(part, "!"):
+			req = selectorRequirement{key: part[1:], op: selectorNotExists}
+		default:
+			req = selectorRequirement{key: part, op: selectorExists}
+		}
+
+		req.key = strings.TrimSpace(req.key)
+		req.value = strings.TrimSpace(req.value)
+		err := validateLabelKey(req.key)
+		if err != nil {
+			return LabelSelector{}, err
+		}
+		err = validateLabelValue(req.key, req.value)
+		if err != nil {
+			return LabelSelector{}, err
+		}
+		sel.reqs = append(sel.reqs, req)
+	}
+	return sel, nil
+}
+
+func (ls LabelSelector) Matches(l Labels) bool {
+	for _, req := range ls.reqs {
+		if !req.matches(l) {
+			return false
+		}
+	}
+	return true
+}
+
+func (ls LabelSelector) IsEmpty() bool {
+	return len(ls.reqs) == 0
+}
+
+// Business Logic
+const (
+	SortByEmail = "email"
+	SortByName  = "name"
+)
+
+type ListUsersQuery struct {
+	Selector LabelSelector
+	// Filter further narrows the users listed, when it is not nil
+	Filter Filter
+	// SortBy is SortByEmail or SortByName. It defaults to SortByEmail.
+	SortBy string
+	// Languages are the locales to sort names for, most preferred first
+	Languages []language.Tag
+}
+
+func (lq *ListUsersQuery) QueryName() string {
+	return "ListUsers"
+}
+
+type SetLabelsParams struct {
+	Email  Email  `json:"email"`
+	Labels Labels `json:"labels"`
+}
+
+func (sp *SetLabelsParams) CommandName() string {
+	return "SetUserLabels"
+}
+
+func (sp *SetLabelsParams) Validate() error {
+	if sp.Email.IsZero() {
+		return ErrEmailEmpty
+	}
+
+	return sp.Labels.Validate()
+}
+
+type RemoveLabelsParams struct {
+	Email Email
+	Keys  []string
+}
+
+func (rp *RemoveLabelsParams) CommandName() string {
+	return "RemoveUserLabels"
+}
+
+func (rp *RemoveLabelsParams) Validate() error {
+	if rp.Email.IsZero() {
+		return ErrEmailEmpty
+	}
+
+	if len(rp.Keys) == 0 {
+		return NewValidationError("At least one label key is required")
+	}
+
+	for _, k := range rp.Keys {
+		err := validateLabelKey(k)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type LabelHandler struct {
+	userStorage UserStorer
+	clock       clock.Clock
+	collators   *CollatorCache
+	updates     *UserUpdater
+}
+
+// NewLabelHandler sorts names for locale when a listing asks for no supported locale.
+func NewLabelHandler(us UserStorer, updates *UserUpdater, clk clock.Clock, locale language.Tag) *LabelHandler {
+	return &LabelHandler{
+		userStorage: us,
+		updates:     updates,
+		clock:       clk,
+		collators:   NewCollatorCache(locale),
+	}
+}
+
+func (lh *LabelHandler) List(ctx context.Context, q Query) (interface{}, error) {
+	query, ok := q.(*ListUsersQuery)
+	if !ok {
+		return nil, fmt.Errorf("LabelHandler cannot list %T", q)
+	}
+
+	err := requireAdmin(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if query.SortBy != "" && query.SortBy != SortByEmail && query.SortBy != SortByName {
+		return nil, NewValidationError(fmt.Sprintf("Cannot sort users by %q", query.SortBy))
+	}
+
+	users, err := listFiltered(ctx, lh.userStorage, query.Selector, query.Filter)
+	if err != nil {
+		return nil, err
+	}
+
+	if query.SortBy == SortByName {
+		lh.collators.SortByName(users, query.Languages)
+		return users, nil
+	}
+
+	sort.Slice(users, func(i, j int) bool {
+		return users[i].Email.String() < users[j].Email.String()
+	})
+	return users, nil
+}
+
+// update saves a copy of the user with its labels changed by change,
+// so readers holding the stored user never see it mutate.
+func (lh *LabelHandler) update(ctx context.Context, email Email, change func(Labels)) error {
+	err := requireAdmin(ctx)
+	if err != nil {
+		return err
+	}
+
+	return lh.updates.Update(ctx, email, func(u *User) (bool, error) {
+		labels := Labels{}
+		for k, v := range u.Labels {
+			labels[k] = v
+		}
+		change(labels)
+		u.Labels = labels
+		u.UpdatedAt = lh.clock.Now().UTC()
+		return true, nil
+	})
+}
+
+func (lh *LabelHandler) Set(ctx context.Context, cmd Command) error {
+	params, ok := cmd.(*SetLabelsParams)
+	if !ok {
+		return fmt.Errorf("LabelHandler cannot set %T", cmd)
+	}
+
+	return lh.update(ctx, params.Email, func(l Labels) {
+		for k, v := range params.Labels {
+			l[k] = v
+		}
+	})
+}
+
+func (lh *LabelHandler) Remove(ctx context.Context, cmd Command) error {
+	params, ok := cmd.(*RemoveLabelsParams)
+	if !ok {
+		return fmt.Errorf("LabelHandler cannot remove %T", cmd)
+	}
+
+	return lh.update(ctx, params.Email, func(l Labels) {
+		for _, k := range params.Keys {
+			delete(l, k)
+		}
+	})
+}
+
+// Access Layer
+// ListUsers serves GET /users, optionally filtered with ?selector=env=prod,team!=qa
+// and a filter expression in ?filter=, such as domain eq example.com.
+// ?sort=name orders users by name for the locale in the Accept-Language header.
+func (a *AdminHTTP) ListUsers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, NewMethodError("ListUsers requires a get request"))
+		return
+	}
+
+	sel, err := ParseLabelSelector(r.FormValue("selector"))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	filter, err := ParseFilter(r.FormValue("filter"))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	// A malformed Accept-Language header falls back to the default locale
+	langs, _, _ := language.ParseAcceptLanguage(r.Header.Get("Accept-Language"))
+	users, err := a.users.List(r.Context(), &ListUsersQuery{
+		Selector:  sel,
+		Filter:    filter,
+		SortBy:    r.FormValue("sort"),
+		Languages: langs,
+	})
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(users)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+}
+
+// Labels serves PUT /users/labels, merging labels into a user,
+// and DELETE /users/labels?email=...&key=..., removing them.
+func (a *AdminHTTP) Labels(w http.ResponseWriter, r *http.Request) {
+	var err error
+	switch r.Method {
+	case http.MethodPut:
+		params := &SetLabelsParams{}
+		err = json.NewDecoder(r.Body).Decode(params)
+		if err != nil {
+			writeError(w, r, decodeError(err))
+			return
+		}
+		err = a.users.SetLabels(r.Context(), params)
+	case http.MethodDelete:
+		params := &RemoveLabelsParams{
+			Keys: r.URL.Query()["key"],
+		}
+		params.Email, err = ParseEmail(r.URL.Query().Get("email"))
+		if err == nil {
+			err = a.users.RemoveLabels(r.Context(), params)
+		}
+	default:
+		writeError(w, r, NewMethodError("Labels requires a put or delete request"))
+		return
+	}
+
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,101 @@
+package separation
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+	"testing"
+
+	"github.com/oralordos/separation/internal/clock"
+	"github.com/oralordos/separation/internal/principal"
+	"golang.org/x/text/language"
+)
+
+// TestConcurrentLabelUpdatesAllApply sets a different label on the same user from many
+// goroutines at once, and checks that none of them is lost.
+func TestConcurrentLabelUpdatesAllApply(t *testing.T) {
+	const updates = 50
+	ctx := principal.NewContext(context.Background(), &principal.Principal{Subject: "admin", Admin: true})
+	email, _ := ParseEmail("a@example.com")
+	us := &yieldingUserStorer{UserStorer: NewMemoryUserStorage(), rng: rand.New(rand.NewSource(1))}
+	err := us.Save(ctx, &User{Email: email})
+	if err != nil {
+		t.Fatal(err)
+	}
+	updater := NewUserUpdater(us)
+	lh := NewLabelHandler(us, updater, clock.Real, language.English)
+
+	var wg sync.WaitGroup
+	for i := 0; i < updates; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			err := lh.Set(ctx, &SetLabelsParams{Email: email, Labels: Labels{fmt.Sprintf("key%d", i): "set"}})
+			if err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	u, err := us.Get(ctx, email)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(u.Labels) != updates {
+		t.Errorf("The user has %d labels after %d updates set one each", len(u.Labels), updates)
+	}
+	if len(updater.locks.locks) != 0 {
+		t.Errorf("%d locks are left after the updates finished", len(updater.locks.locks))
+	}
+}
+
+// TestConcurrentUserUpdatesAllApply changes a user's labels and username at once, from
+// separate handlers, and checks neither change overwrites the other.
+func TestConcurrentUserUpdatesAllApply(t *testing.T) {
+	const rounds = 50
+	ctx := principal.NewContext(context.Background(), &principal.Principal{Subject: "admin", Admin: true})
+	email, _ := ParseEmail("a@example.com")
+	us := &yieldingUserStorer{UserStorer: NewMemoryUserStorage(), rng: rand.New(rand.NewSource(1))}
+	err := us.Save(ctx, &User{Email: email})
+	if err != nil {
+		t.Fatal(err)
+	}
+	updater := NewUserUpdater(us)
+	lh := NewLabelHandler(us, updater, clock.Real, language.English)
+	uh := NewUsernameHandler(us, updater, clock.Real)
+
+	for i := 0; i < rounds; i++ {
+		username, err := ParseUsername(fmt.Sprintf("user%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			err := lh.Set(ctx, &SetLabelsParams{Email: email, Labels: Labels{fmt.Sprintf("key%d", i): "set"}})
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			err := uh.Set(ctx, &SetUsernameParams{Email: email, Username: username})
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+		wg.Wait()
+
+		u, err := us.Get(ctx, email)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if u.Username != username || len(u.Labels) != i+1 {
+			t.Fatalf("Round %d left the username %s and %d labels, want %s and %d", i, u.Username, len(u.Labels), username, i+1)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package separation
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Business Logic
+var (
+	// leaders is 1 for each subsystem this instance leads, and 0 for the others
+	leaders = expvar.NewMap("leaders")
+	// leadershipChanges counts this instance gaining and losing the leadership of each subsystem
+	leadershipChanges = expvar.NewMap("leadership_changes")
+)
+
+// Leader runs a background subsystem on one instance at a time. Every instance campaigns
+// for the subsystem's lock, and the one that takes it runs the subsystem until the lease
+// is lost or the instance stops. When the leader dies its lease expires and another
+// instance takes over within a TTL and a third.
+type Leader struct {
+	locker  Locker
+	name    string
+	ttl     time.Duration
+	run     func(ctx context.Context) error
+	onError func(error)
+
+	mu      sync.Mutex
+	leading bool
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// NewLeader campaigns for the leadership of the subsystem called name until it is closed,
+// running run whenever it leads. run must return once its context is done, and returning
+// earlier gives up the leadership for another instance to take. Failures are reported to onError.
+func NewLeader(locker Locker, name string, ttl time.Duration, run func(ctx context.Context) error, onError func(error)) *Leader {
+	ctx, cancel := context.WithCancel(context.Background())
+	l := &Leader{
+		locker:  locker,
+		name:    name,
+		ttl:     ttl,
+		run:     run,
+		onError: onError,
+		cancel:  cancel,
+		done:    make(chan struct{}),
+	}
+	leaders.Set(name, new(expvar.Int))
+	go l.campaign(ctx)
+	return l
+}
+
+func (l *Leader) campaign(ctx context.Context) {
+	defer close(l.done)
+	for {
+		err := WithLock(ctx, l.locker, "leader:"+l.name, LockOptions{TTL: l.ttl}, l.lead)
+		if err != nil && err != ErrLockHeld && ctx.Err() == nil {
+			l.onError(fmt.Errorf("Leading %s failed: %v", l.name, err))
+		}
+
+		select {
+		case <-time.After(l.ttl / 3):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (l *Leader) lead(ctx context.Context, lease *Lease) error {
+	l.setLeading(true)
+	defer l.setLeading(false)
+	return l.run(ctx)
+}
+
+func (l *Leader) setLeading(leading bool) {
+	l.mu.Lock()
+	l.leading = leading
+	l.mu.Unlock()
+
+	v := new(expvar.Int)
+	if leading {
+		v.Set(1)
+		leadershipChanges.Add(l.name+"_elected", 1)
+	} else {
+		leadershipChanges.Add(l.name+"_lost", 1)
+	}
+	leaders.Set(l.name, v)
+}
+
+// Leading reports whether this instance runs the subsystem now.
+func (l *Leader) Leading() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.leading
+}
+
+// Close stops campaigning, stopping the subsystem and giving up the leadership if this instance has it.
+func (l *Leader) Close() error {
+	l.cancel()
+	<-l.done
+	return nil
+}
@@ -0,0 +1,128 @@
+package separation
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/oralordos/separation/internal/clock"
+)
+
+// leakGrace is how long goroutines have to exit once a test is over, since closing
+// something usually only signals its goroutines to stop.
+const leakGrace = 2 * time.Second
+
+// checkLeaks fails t if goroutines started during the test are still running once it
+// and its cleanups are done. Idle HTTP client connections are closed first, so a
+// connection left open by the server shows up as its read and write loops. Call it
+// before registering other cleanups, so it runs after them.
+func checkLeaks(t *testing.T) {
+	before := goroutineStacks()
+	t.Cleanup(func() {
+		http.DefaultClient.CloseIdleConnections()
+
+		var leaked []string
+		deadline := time.Now().Add(leakGrace)
+		for {
+			leaked = leaked[:0]
+			for id, stack := range goroutineStacks() {
+				if _, ok := before[id]; !ok {
+					leaked = append(leaked, stack)
+				}
+			}
+			if len(leaked) == 0 || time.Now().After(deadline) {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		for _, stack := range leaked {
+			t.Errorf("Leaked a goroutine:\n%s", stack)
+		}
+	})
+}
+
+// goroutineStacks returns the stack of every goroutine except the caller, by goroutine ID.
+func goroutineStacks() map[string]string {
+	buf := make([]byte, 1<<16)
+	for {
+		n := runtime.Stack(buf, true)
+		if n < len(buf) {
+			buf = buf[:n]
+			break
+		}
+		buf = make([]byte, 2*len(buf))
+	}
+
+	stacks := map[string]string{}
+	for i, stack := range bytes.Split(buf, []byte("\n\n")) {
+		// The first stack is the caller's
+		if i == 0 {
+			continue
+		}
+		header := strings.Fields(string(stack))
+		if len(header) < 2 || header[0] != "goroutine" {
+			continue
+		}
+		stacks[header[1]] = string(stack)
+	}
+	return stacks
+}
+
+// TestBackgroundWorkersStopOnClose checks that everything that starts goroutines stops
+// them all when it is closed.
+func TestBackgroundWorkersStopOnClose(t *testing.T) {
+	ctx := context.Background()
+	onError := func(err error) { t.Error(err) }
+
+	tests := map[string]func(t *testing.T) interface{ Close() error }{
+		"ActivityTracker": func(t *testing.T) interface{ Close() error } {
+			d := NewDispatcher()
+			return NewActivityTracker(NewUserServiceImpl(d), clock.Real, time.Millisecond)
+		},
+		"WriteBehindUserStorage": func(t *testing.T) interface{ Close() error } {
+			return NewWriteBehindUserStorage(NewMemoryUserStorage(), time.Minute, clock.Real, time.Millisecond, 10, onError)
+		},
+		"CachingUserStorage with shared invalidations": func(t *testing.T) interface{ Close() error } {
+			cs := NewCachingUserStorage(NewMemoryUserStorage(), time.Minute, clock.Real)
+			cs.ShareInvalidations(NewMemoryInvalidationBus(), "test", time.Second, onError)
+			return cs
+		},
+		"BloomUserStorage": func(t *testing.T) interface{ Close() error } {
+			us := NewMemoryUserStorage()
+			bs, err := NewBloomUserStorage(ctx, us, EmailsFromStorage(us), 100, 0.01, time.Millisecond, onError)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return bs
+		},
+		"UserStats": func(t *testing.T) interface{ Close() error } {
+			return NewUserStats(NewMemoryUserStorage(), clock.Real, time.Millisecond, onError)
+		},
+		"Notifier": func(t *testing.T) interface{ Close() error } {
+			opts := NotifierOptions{MaxAttempts: 1, QueueSize: 10, Workers: 4}
+			return NewNotifier(NewMemoryUserStorage(), NewMemoryPreferencesStorage(), Preferences{}, nil, nil, nil, opts, clock.Real, onError)
+		},
+		"Leader": func(t *testing.T) interface{ Close() error } {
+			return NewLeader(NewMemoryLocker(clock.Real), "test", time.Second, func(ctx context.Context) error {
+				<-ctx.Done()
+				return nil
+			}, onError)
+		},
+	}
+	for name, start := range tests {
+		t.Run(name, func(t *testing.T) {
+			checkLeaks(t)
+			c := start(t)
+			// Let the goroutines get going before stopping them
+			time.Sleep(5 * time.Millisecond)
+			err := c.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,91 @@
+package separation
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Access Layer
+// systemdFirstFD is the first file descriptor systemd passes with socket activation.
+const systemdFirstFD = 3
+
+// parseListenAddr splits a listen address into a network and address.
+// It accepts host:port, tcp://host:port, unix:///path/to.sock and systemd.
+func parseListenAddr(addr string) (network, address string, err error) {
+	switch {
+	case addr == "systemd":
+		return "systemd", "", nil
+	case strings.HasPrefix(addr, "unix://"):
+		path := strings.TrimPrefix(addr, "unix://")
+		if path == "" {
+			return "", "", fmt.Errorf("Listen address %q has no socket path", addr)
+		}
+		return "unix", path, nil
+	case strings.HasPrefix(addr, "tcp://"):
+		return "tcp", strings.TrimPrefix(addr, "tcp://"), nil
+	case strings.Contains(addr, "://"):
+		return "", "", fmt.Errorf("Listen address %q must use tcp://, unix:// or be systemd", addr)
+	}
+	return "tcp", addr, nil
+}
+
+// Listen opens a listener for an address accepted by parseListenAddr.
+// A stale unix socket left behind by an earlier run is removed first.
+func Listen(addr string) (net.Listener, error) {
+	network, address, err := parseListenAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	switch network {
+	case "systemd":
+		return systemdListener()
+	case "unix":
+		err = removeStaleSocket(address)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return net.Listen(network, address)
+}
+
+func removeStaleSocket(path string) error {
+	fi, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+	return os.Remove(path)
+}
+
+// systemdListener takes the first socket passed with systemd socket activation,
+// as described in sd_listen_fds(3).
+func systemdListener() (net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, errors.New("No sockets were passed by systemd, LISTEN_PID does not match this process")
+	}
+
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 1 {
+		return nil, errors.New("No sockets were passed by systemd, LISTEN_FDS is not set")
+	}
+
+	// Keep child processes from thinking the sockets are theirs
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	f := os.NewFile(systemdFirstFD, "systemd socket")
+	defer f.Close()
+	return net.FileListener(f)
+}
@@ -0,0 +1,436 @@
+package separation
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"math"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oralordos/separation/internal/clock"
+	"github.com/oralordos/separation/internal/principal"
+)
+
+// Access Layer
+var ErrOverloaded = registerError(errors.New("The server is too busy to take the request"), "overloaded", http.StatusServiceUnavailable, "Too many requests like it are already running, retry after the Retry-After header")
+
+// RouteClass groups routes that share a concurrency limit.
+type RouteClass string
+
+const (
+	// ClassRead routes only look data up.
+	ClassRead RouteClass = "read"
+	// ClassWrite routes change data.
+	ClassWrite RouteClass = "write"
+	// ClassUpload routes take large bodies, such as avatars.
+	ClassUpload RouteClass = "upload"
+)
+
+// ConcurrencyLimit is how many requests of a class may run at once, and how many more
+// may wait for one of them to finish before requests are shed.
+type ConcurrencyLimit struct {
+	MaxInFlight int
+	MaxQueue    int
+}
+
+// ConcurrencyLimits maps each limited route class to its limit. Classes not in it are unlimited.
+type ConcurrencyLimits map[RouteClass]ConcurrencyLimit
+
+// ParseConcurrencyLimits reads comma separated class=max or class=max/queue pairs.
+// The queue defaults to the same size as max.
+func ParseConcurrencyLimits(s string) (ConcurrencyLimits, error) {
+	limits := ConcurrencyLimits{}
+	for _, pair := range parseNameList(s) {
+		class, limit, ok := strings.Cut(pair, "=")
+		if !ok || class == "" {
+			return nil, fmt.Errorf("%q must be class=max or class=max/queue", pair)
+		}
+		max, queue, hasQueue := strings.Cut(limit, "/")
+
+		var l ConcurrencyLimit
+		var err error
+		l.MaxInFlight, err = strconv.Atoi(max)
+		if err != nil || l.MaxInFlight <= 0 {
+			return nil, fmt.Errorf("%q must have a positive max", pair)
+		}
+		l.MaxQueue = l.MaxInFlight
+		if hasQueue {
+			l.MaxQueue, err = strconv.Atoi(queue)
+			if err != nil || l.MaxQueue < 0 {
+				return nil, fmt.Errorf("%q must have a queue of zero or more", pair)
+			}
+		}
+		limits[RouteClass(class)] = l
+	}
+	return limits, nil
+}
+
+// Caller tiers, weighed against each other by PriorityWeights when requests queue.
+const (
+	TierAnonymous     = "anonymous"
+	TierAuthenticated = "authenticated"
+	TierAdmin         = "admin"
+)
+
+var callerTiers = []string{TierAnonymous, TierAuthenticated, TierAdmin}
+
+// callerTier is the tier of the caller the authenticators identified, if any.
+func callerTier(ctx context.Context) string {
+	p, ok := principal.FromContext(ctx)
+	switch {
+	case !ok:
+		return TierAnonymous
+	case p.Admin:
+		return TierAdmin
+	}
+	return TierAuthenticated
+}
+
+// PriorityWeights maps caller tiers to their share of the slots that free up while
+// requests of several tiers are queued. Tiers not in it weigh one.
+type PriorityWeights map[string]int
+
+// ParsePriorityWeights reads comma separated tier=weight pairs.
+func ParsePriorityWeights(s string) (PriorityWeights, error) {
+	weights := PriorityWeights{}
+	for _, pair := range parseNameList(s) {
+		tier, weight, ok := strings.Cut(pair, "=")
+		if !ok || !containsString(callerTiers, tier) {
+			return nil, fmt.Errorf("%q must be tier=weight, with a tier of %s", pair, strings.Join(callerTiers, ", "))
+		}
+		w, err := strconv.Atoi(weight)
+		if err != nil || w <= 0 {
+			return nil, fmt.Errorf("%q must have a positive weight", pair)
+		}
+		weights[tier] = w
+	}
+	return weights, nil
+}
+
+func (pw PriorityWeights) weight(tier string) int {
+	if w, ok := pw[tier]; ok {
+		return w
+	}
+	return 1
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+var requestsShed = expvar.NewMap("requests_shed")
+
+// limiterWaiter is a queued request. granted is set, under the limiter's lock,
+// when a finishing request hands its slot over.
+type limiterWaiter struct {
+	ready   chan struct{}
+	granted bool
+}
+
+// ConcurrencyLimiter bounds the requests of one route class running at once. Requests over
+// the limit wait in a bounded queue, and are shed when it is full or they wait too long,
+// so a slow backend ties up a known number of goroutines rather than all of them.
+// Each caller tier queues separately, and freed slots go to the tiers in proportion to
+// their weights, so that anonymous registrations cannot crowd out signed in users.
+type ConcurrencyLimiter struct {
+	class       RouteClass
+	maxInFlight int
+	maxQueue    int
+	wait        time.Duration
+	weights     PriorityWeights
+
+	mu       sync.Mutex
+	inFlight int
+	queued   int
+	queues   map[string][]*limiterWaiter
+	// credit is the smooth weighted round robin state of each tier
+	credit map[string]int
+}
+
+func NewConcurrencyLimiter(class RouteClass, limit ConcurrencyLimit, wait time.Duration, weights PriorityWeights) *ConcurrencyLimiter {
+	return &ConcurrencyLimiter{
+		class:       class,
+		maxInFlight: limit.MaxInFlight,
+		maxQueue:    limit.MaxQueue,
+		wait:        wait,
+		weights:     weights,
+		queues:      map[string][]*limiterWaiter{},
+		credit:      map[string]int{},
+	}
+}
+
+// NewConcurrencyLimiters makes a limiter for every class in limits.
+func NewConcurrencyLimiters(limits ConcurrencyLimits, wait time.Duration, weights PriorityWeights) map[RouteClass]*ConcurrencyLimiter {
+	limiters := map[RouteClass]*ConcurrencyLimiter{}
+	for class, l := range limits {
+		limiters[class] = NewConcurrencyLimiter(class, l, wait, weights)
+	}
+	return limiters
+}
+
+// Acquire takes a slot, waiting in the queue of the caller's tier if there is room, and
+// returns the function that gives it back. It returns ErrOverloaded when the request is shed.
+func (cl *ConcurrencyLimiter) Acquire(ctx context.Context) (func(), error) {
+	cl.mu.Lock()
+	if cl.inFlight < cl.maxInFlight {
+		cl.inFlight++
+		cl.mu.Unlock()
+		return cl.release, nil
+	}
+	if cl.queued >= cl.maxQueue {
+		cl.mu.Unlock()
+		requestsShed.Add(string(cl.class), 1)
+		return nil, ErrOverloaded
+	}
+	tier := callerTier(ctx)
+	waiter := &limiterWaiter{ready: make(chan struct{})}
+	cl.queues[tier] = append(cl.queues[tier], waiter)
+	cl.queued++
+	cl.mu.Unlock()
+
+	timer := time.NewTimer(cl.wait)
+	defer timer.Stop()
+	var err error
+	select {
+	case <-waiter.ready:
+		return cl.release, nil
+	case <-timer.C:
+		err = ErrOverloaded
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	// The slot may have been handed over while giving up
+	if waiter.granted {
+		return cl.release, nil
+	}
+	queue := cl.queues[tier]
+	for i, w := range queue {
+		if w == waiter {
+			cl.queues[tier] = append(queue[:i], queue[i+1:]...)
+			break
+		}
+	}
+	cl.queued--
+	if err == ErrOverloaded {
+		requestsShed.Add(string(cl.class), 1)
+	}
+	return nil, err
+}
+
+// release hands the slot to the next queued request, or frees it when none are waiting.
+func (cl *ConcurrencyLimiter) release() {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	tier := cl.nextTier()
+	if tier == "" {
+		cl.inFlight--
+		return
+	}
+	waiter := cl.queues[tier][0]
+	cl.queues[tier] = cl.queues[tier][1:]
+	cl.queued--
+	waiter.granted = true
+	close(waiter.ready)
+}
+
+// nextTier picks the tier to serve next by smooth weighted round robin over the
+// tiers with requests queued. It returns "" when no request is queued.
+func (cl *ConcurrencyLimiter) nextTier() string {
+	best, total := "", 0
+	for _, tier := range callerTiers {
+		if len(cl.queues[tier]) == 0 {
+			continue
+		}
+		w := cl.weights.weight(tier)
+		cl.credit[tier] += w
+		total += w
+		if best == "" || cl.credit[tier] > cl.credit[best] {
+			best = tier
+		}
+	}
+	if best != "" {
+		cl.credit[best] -= total
+	}
+	return best
+}
+
+// RetryAfter is how many whole seconds a shed client is told to wait, at least one.
+func (cl *ConcurrencyLimiter) RetryAfter() int {
+	return int(math.Max(1, math.Ceil(cl.wait.Seconds())))
+}
+
+// serveLimited runs next once limiter has a slot for the request, or sheds it with 503.
+func serveLimited(limiter *ConcurrencyLimiter, next http.Handler, w http.ResponseWriter, r *http.Request) {
+	release, err := limiter.Acquire(r.Context())
+	if err != nil {
+		if errors.Is(err, ErrOverloaded) {
+			w.Header().Set("Retry-After", strconv.Itoa(limiter.RetryAfter()))
+		}
+		writeError(w, r, err)
+		return
+	}
+	defer release()
+	next.ServeHTTP(w, r)
+}
+
+// shedPriority is how much worse than its targets the storage backend must get before
+// requests of a class start being shed. Listings go long before registrations.
+var shedPriority = map[RouteClass]float64{
+	ClassRead:   0,
+	ClassUpload: 0,
+	ClassWrite:  1,
+}
+
+const (
+	// maxShedFraction leaves some requests through even at the worst, so the storage
+	// calls they make show when the backend has recovered.
+	maxShedFraction = 0.95
+	// minPressureSamples is how many storage calls the window must hold before it is trusted.
+	minPressureSamples = 20
+	// pressureSamples bounds the storage calls remembered.
+	pressureSamples = 1024
+	// pressureInterval is how often the pressure is worked out again.
+	pressureInterval = time.Second
+)
+
+var (
+	requestsShedAdaptive = expvar.NewMap("requests_shed_adaptive")
+	storagePressure      = new(expvar.Float)
+)
+
+func init() {
+	expvar.Publish("storage_pressure", storagePressure)
+}
+
+type storageSample struct {
+	at       time.Time
+	duration time.Duration
+	failed   bool
+}
+
+// AdaptiveShedder watches the latency and errors of storage calls, as a StorageObserver,
+// and rejects a growing fraction of the less critical requests while the backend is
+// slower or failing more than its targets allow.
+type AdaptiveShedder struct {
+	targetP95       time.Duration
+	targetErrorRate float64
+	window          time.Duration
+	weights         PriorityWeights
+	clock           clock.Clock
+
+	mu       sync.Mutex
+	samples  []storageSample
+	next     int
+	pressure float64
+	computed time.Time
+}
+
+// NewAdaptiveShedder sheds once the p95 latency of the storage calls in the last window
+// goes over targetP95, or their error rate over targetErrorRate. Zero disables either target.
+// Callers of heavier tiers in weights are shed that many times less often.
+func NewAdaptiveShedder(targetP95 time.Duration, targetErrorRate float64, window time.Duration, weights PriorityWeights, clk clock.Clock) *AdaptiveShedder {
+	return &AdaptiveShedder{
+		targetP95:       targetP95,
+		targetErrorRate: targetErrorRate,
+		window:          window,
+		weights:         weights,
+		clock:           clk,
+		samples:         make([]storageSample, 0, pressureSamples),
+	}
+}
+
+func (as *AdaptiveShedder) ObserveStorageCall(ctx context.Context, store, op string, start time.Time, err error) {
+	s := storageSample{
+		at:       as.clock.Now(),
+		duration: time.Since(start),
+		failed:   err != nil,
+	}
+
+	as.mu.Lock()
+	defer as.mu.Unlock()
+	if len(as.samples) < pressureSamples {
+		as.samples = append(as.samples, s)
+		return
+	}
+	as.samples[as.next] = s
+	as.next = (as.next + 1) % pressureSamples
+}
+
+// Pressure is how far the backend is past its worse target, as a multiple of it.
+// It is at most one while the backend is healthy.
+func (as *AdaptiveShedder) Pressure() float64 {
+	as.mu.Lock()
+	defer as.mu.Unlock()
+
+	now := as.clock.Now()
+	if now.Sub(as.computed) < pressureInterval {
+		return as.pressure
+	}
+	as.computed = now
+
+	var durations []time.Duration
+	var failed int
+	for _, s := range as.samples {
+		if now.Sub(s.at) > as.window {
+			continue
+		}
+		durations = append(durations, s.duration)
+		if s.failed {
+			failed++
+		}
+	}
+
+	as.pressure = 0
+	if len(durations) >= minPressureSamples {
+		if as.targetP95 > 0 {
+			sort.Slice(durations, func(i, j int) bool {
+				return durations[i] < durations[j]
+			})
+			p95 := durations[len(durations)*95/100]
+			as.pressure = float64(p95) / float64(as.targetP95)
+		}
+		if as.targetErrorRate > 0 {
+			rate := float64(failed) / float64(len(durations))
+			as.pressure = math.Max(as.pressure, rate/as.targetErrorRate)
+		}
+	}
+	storagePressure.Set(as.pressure)
+	return as.pressure
+}
+
+// ShedFraction is the fraction of the requests of class being rejected. It grows from
+// zero once the pressure passes one plus the class's priority, up to maxShedFraction.
+// Routes without a class are never shed.
+func (as *AdaptiveShedder) ShedFraction(class RouteClass) float64 {
+	priority, ok := shedPriority[class]
+	if !ok {
+		return 0
+	}
+	return math.Min(maxShedFraction, math.Max(0, as.Pressure()-1-priority))
+}
+
+// Shed decides whether to reject one request of class, made by the caller in ctx.
+func (as *AdaptiveShedder) Shed(ctx context.Context, class RouteClass) bool {
+	weight := float64(as.weights.weight(callerTier(ctx)))
+	if rand.Float64() >= as.ShedFraction(class)/weight {
+		return false
+	}
+	requestsShedAdaptive.Add(string(class), 1)
+	return true
+}
@@ -0,0 +1,278 @@
+package separation
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/oralordos/separation/internal/clock"
+	"github.com/oralordos/separation/internal/redis"
+)
+
+// Action Layer
+var (
+	ErrLockHeld = registerError(errors.New("Lock is held by another instance"), "lock_held", http.StatusConflict, "Another instance holds the lock the operation needs, retrying later may succeed")
+	ErrLockLost = registerError(errors.New("Lock lease expired and may have been taken by another instance"), "lock_lost", http.StatusServiceUnavailable, "The lock the operation held expired part way through, retrying may succeed")
+)
+
+// Lease is a held lock. It lasts until ExpiresAt unless it is renewed.
+type Lease struct {
+	Name string
+	// Token is the fencing token of the lease, greater than that of every earlier lease
+	// on the same lock. Storage that sees a token lower than one it has seen knows the
+	// writer's lease was lost.
+	Token     int64
+	ExpiresAt time.Time
+	owner     string
+}
+
+// Locker hands out named locks that expire, so one instance at a time runs a job even
+// when the instance holding it dies.
+type Locker interface {
+	// Acquire takes the lock called name for ttl
+	// Acquire may return an ErrLockHeld error
+	Acquire(ctx context.Context, name string, ttl time.Duration) (*Lease, error)
+	// Renew extends the lease to ttl from now
+	// Renew may return an ErrLockLost error
+	Renew(ctx context.Context, lease *Lease, ttl time.Duration) error
+	// Release gives up the lease, so the lock can be taken at once. Releasing a lost lease does nothing.
+	Release(ctx context.Context, lease *Lease) error
+}
+
+func newLockOwner() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+type memoryLock struct {
+	owner     string
+	expiresAt time.Time
+	// token is kept after the lock is released, so tokens keep growing
+	token int64
+}
+
+// MemoryLocker keeps locks in memory, so it only excludes jobs within one instance.
+type MemoryLocker struct {
+	clock clock.Clock
+	mu    sync.Mutex
+	locks map[string]*memoryLock
+}
+
+func NewMemoryLocker(clk clock.Clock) *MemoryLocker {
+	return &MemoryLocker{
+		clock: clk,
+		locks: map[string]*memoryLock{},
+	}
+}
+
+func (ml *MemoryLocker) Acquire(ctx context.Context, name string, ttl time.Duration) (*Lease, error) {
+	owner, err := newLockOwner()
+	if err != nil {
+		return nil, err
+	}
+	now := ml.clock.Now()
+
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+
+	l, ok := ml.locks[name]
+	if !ok {
+		l = &memoryLock{}
+		ml.locks[name] = l
+	}
+	if l.owner != "" && now.Before(l.expiresAt) {
+		return nil, ErrLockHeld
+	}
+	l.owner = owner
+	l.expiresAt = now.Add(ttl)
+	l.token++
+	return &Lease{Name: name, Token: l.token, ExpiresAt: l.expiresAt, owner: owner}, nil
+}
+
+func (ml *MemoryLocker) Renew(ctx context.Context, lease *Lease, ttl time.Duration) error {
+	now := ml.clock.Now()
+
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+
+	l, ok := ml.locks[lease.Name]
+	if !ok || l.owner != lease.owner || !now.Before(l.expiresAt) {
+		return ErrLockLost
+	}
+	l.expiresAt = now.Add(ttl)
+	lease.ExpiresAt = l.expiresAt
+	return nil
+}
+
+func (ml *MemoryLocker) Release(ctx context.Context, lease *Lease) error {
+	ml.mu.Lock()
+	defer ml.mu.Unlock()
+
+	l, ok := ml.locks[lease.Name]
+	if ok && l.owner == lease.owner {
+		l.owner = ""
+	}
+	return nil
+}
+
+// The Redis lock scripts. KEYS[1] holds the owner of the lock and expires with its lease,
+// and KEYS[2] counts the leases handed out, giving the fencing tokens.
+const (
+	lockAcquireScript = `if redis.call('SET', KEYS[1], ARGV[1], 'NX', 'PX', ARGV[2]) then
+return redis.call('INCR', KEYS[2])
+end
+return 0`
+	lockRenewScript = `if redis.call('GET', KEYS[1]) == ARGV[1] then
+return redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+return 0`
+	lockReleaseScript = `if redis.call('GET', KEYS[1]) == ARGV[1] then
+return redis.call('DEL', KEYS[1])
+end
+return 0`
+)
+
+// RedisLocker keeps locks in Redis, so it excludes jobs across every instance using the same server.
+type RedisLocker struct {
+	client *redis.Client
+	prefix string
+	clock  clock.Clock
+}
+
+// NewRedisLocker stores locks under keys starting with prefix.
+func NewRedisLocker(client *redis.Client, prefix string, clk clock.Clock) *RedisLocker {
+	return &RedisLocker{
+		client: client,
+		prefix: prefix,
+		clock:  clk,
+	}
+}
+
+func (rl *RedisLocker) eval(ctx context.Context, script, name string, args ...string) (int64, error) {
+	cmd := append([]string{"EVAL", script, "2", rl.prefix + name, rl.prefix + name + ":fence"}, args...)
+	reply, err := rl.client.Do(ctx, cmd...)
+	if err != nil {
+		return 0, err
+	}
+	n, ok := reply.(int64)
+	if !ok {
+		return 0, fmt.Errorf("Unexpected lock reply %v", reply)
+	}
+	return n, nil
+}
+
+func (rl *RedisLocker) Acquire(ctx context.Context, name string, ttl time.Duration) (*Lease, error) {
+	owner, err := newLockOwner()
+	if err != nil {
+		return nil, err
+	}
+	now := rl.clock.Now()
+	token, err := rl.eval(ctx, lockAcquireScript, name, owner, strconv.FormatInt(ttl.Milliseconds(), 10))
+	if err != nil {
+		return nil, err
+	}
+	if token == 0 {
+		return nil, ErrLockHeld
+	}
+	return &Lease{Name: name, Token: token, ExpiresAt: now.Add(ttl), owner: owner}, nil
+}
+
+func (rl *RedisLocker) Renew(ctx context.Context, lease *Lease, ttl time.Duration) error {
+	now := rl.clock.Now()
+	ok, err := rl.eval(ctx, lockRenewScript, lease.Name, lease.owner, strconv.FormatInt(ttl.Milliseconds(), 10))
+	if err != nil {
+		return err
+	}
+	if ok == 0 {
+		return ErrLockLost
+	}
+	lease.ExpiresAt = now.Add(ttl)
+	return nil
+}
+
+func (rl *RedisLocker) Release(ctx context.Context, lease *Lease) error {
+	_, err := rl.eval(ctx, lockReleaseScript, lease.Name, lease.owner)
+	return err
+}
+
+// Business Logic
+// LockOptions say how long a lease lasts between renewals, and whether to wait for a held lock.
+type LockOptions struct {
+	TTL time.Duration
+	// Wait retries a held lock every tenth of TTL until it is free or the context is done.
+	// Without it a held lock returns ErrLockHeld, as a scheduled job that another instance
+	// is running skips its turn.
+	Wait bool
+}
+
+// WithLock runs fn holding the lock called name, renewing the lease every third of its TTL.
+// If a renewal fails the context given to fn is cancelled, since another instance may take
+// the lock, and WithLock returns ErrLockLost unless fn failed first. fn should pass the
+// lease's Token to any storage that checks fencing tokens.
+func WithLock(ctx context.Context, locker Locker, name string, opts LockOptions, fn func(ctx context.Context, lease *Lease) error) error {
+	lease, err := locker.Acquire(ctx, name, opts.TTL)
+	for err == ErrLockHeld && opts.Wait {
+		select {
+		case <-time.After(opts.TTL / 10):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		lease, err = locker.Acquire(ctx, name, opts.TTL)
+	}
+	if err != nil {
+		return err
+	}
+
+	fnCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	lost := make(chan error, 1)
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(opts.TTL / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				err := locker.Renew(fnCtx, lease, opts.TTL)
+				if err != nil {
+					lost <- ErrLockLost
+					cancel()
+					return
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	err = fn(fnCtx, lease)
+	close(stop)
+	<-done
+	select {
+	case lostErr := <-lost:
+		if err == nil || errors.Is(err, context.Canceled) {
+			err = lostErr
+		}
+		return err
+	default:
+	}
+
+	// Release with the caller's context, as fn's may be cancelled
+	releaseErr := locker.Release(ctx, lease)
+	if err == nil {
+		err = releaseErr
+	}
+	return err
+}
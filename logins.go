@@ -0,0 +1,200 @@
+package separation
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/oralordos/separation/internal/principal"
+)
+
+// Action Layer
+
+// Login is one time a user signed in.
+type Login struct {
+	Email     Email     `json:"email"`
+	At        time.Time `json:"at"`
+	IP        string    `json:"ip,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	// Location is where the GeoResolver placed the IP address, such as "Paris, FR", when there is one
+	Location string `json:"location,omitempty"`
+	// Method is how the user signed in, such as magic_link or passkey
+	Method string `json:"method"`
+}
+
+type LoginStorer interface {
+	Add(ctx context.Context, l *Login) error
+	// List returns the user's logins, newest first
+	List(ctx context.Context, email Email) ([]*Login, error)
+}
+
+// maxLoginsPerUser is how many logins of each user MemoryLoginStorage keeps, dropping the oldest.
+const maxLoginsPerUser = 100
+
+// MemoryLoginStorage keeps the latest logins of each user in memory.
+type MemoryLoginStorage struct {
+	mu     sync.Mutex
+	logins map[Email][]*Login
+}
+
+func NewMemoryLoginStorage() *MemoryLoginStorage {
+	return &MemoryLoginStorage{
+		logins: map[Email][]*Login{},
+	}
+}
+
+func (ms *MemoryLoginStorage) Add(ctx context.Context, l *Login) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	logins := append(ms.logins[l.Email], l)
+	if len(logins) > maxLoginsPerUser {
+		logins = logins[len(logins)-maxLoginsPerUser:]
+	}
+	ms.logins[l.Email] = logins
+	return nil
+}
+
+func (ms *MemoryLoginStorage) List(ctx context.Context, email Email) ([]*Login, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	stored := ms.logins[email]
+	logins := make([]*Login, len(stored))
+	for i, l := range stored {
+		logins[len(stored)-1-i] = l
+	}
+	return logins, nil
+}
+
+// Business Logic
+
+// Login methods, as recorded on each Login.
+const (
+	LoginMethodMagicLink = "magic_link"
+	LoginMethodPasskey   = "passkey"
+)
+
+// GeoResolver places an IP address roughly, such as "Paris, FR", for the login history.
+type GeoResolver interface {
+	Locate(ctx context.Context, ip string) (string, error)
+}
+
+// NewDeviceLogin is published when a user signs in from a browser they have not signed in
+// from before. A user's first login is not a new device.
+type NewDeviceLogin struct {
+	Email     Email     `json:"email"`
+	IP        string    `json:"ip,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	Location  string    `json:"location,omitempty"`
+	At        time.Time `json:"at"`
+}
+
+func (nl *NewDeviceLogin) EventName() string {
+	return "NewDeviceLogin"
+}
+
+type ListLoginsQuery struct {
+	Email Email
+}
+
+func (lq *ListLoginsQuery) QueryName() string {
+	return "ListLogins"
+}
+
+// LoginRecorder keeps the login history of users, telling them when a new device signs in.
+type LoginRecorder struct {
+	loginStorage LoginStorer
+	geo          GeoResolver
+	events       *EventBus
+}
+
+// NewLoginRecorder records logins to ls. geo may be nil, leaving logins without a location.
+func NewLoginRecorder(ls LoginStorer, geo GeoResolver, events *EventBus) *LoginRecorder {
+	return &LoginRecorder{
+		loginStorage: ls,
+		geo:          geo,
+		events:       events,
+	}
+}
+
+// Record adds a login to the user's history, publishing NewDeviceLogin when the user agent
+// is not among the user's earlier logins.
+func (lr *LoginRecorder) Record(ctx context.Context, l *Login) error {
+	if lr.geo != nil && l.IP != "" {
+		// A login is still recorded when it cannot be placed
+		l.Location, _ = lr.geo.Locate(ctx, l.IP)
+	}
+
+	earlier, err := lr.loginStorage.List(ctx, l.Email)
+	if err != nil {
+		return err
+	}
+	err = lr.loginStorage.Add(ctx, l)
+	if err != nil {
+		return err
+	}
+
+	if len(earlier) == 0 {
+		return nil
+	}
+	for _, e := range earlier {
+		if e.UserAgent == l.UserAgent {
+			return nil
+		}
+	}
+	lr.events.Publish(ctx, &NewDeviceLogin{
+		Email:     l.Email,
+		IP:        l.IP,
+		UserAgent: l.UserAgent,
+		Location:  l.Location,
+		At:        l.At,
+	})
+	return nil
+}
+
+// List returns the login history of a user, newest first.
+func (lr *LoginRecorder) List(ctx context.Context, q Query) (interface{}, error) {
+	query, ok := q.(*ListLoginsQuery)
+	if !ok {
+		return nil, fmt.Errorf("LoginRecorder cannot list %T", q)
+	}
+
+	err := requireSelfOrAdmin(ctx, query.Email)
+	if err != nil {
+		return nil, err
+	}
+	return lr.loginStorage.List(ctx, query.Email)
+}
+
+// Access Layer
+
+// MyLogins serves GET /me/logins, the calling user's login history, newest first.
+func (j *JsonOverHTTP) MyLogins(w http.ResponseWriter, r *http.Request) {
+	p, ok := principal.FromContext(r.Context())
+	if !ok || p.Email == "" {
+		writeError(w, r, ErrUnauthenticated)
+		return
+	}
+	email, err := ParseEmail(p.Email)
+	if err != nil {
+		writeError(w, r, ErrUnauthenticated)
+		return
+	}
+
+	logins, err := j.usrServ.ListLogins(r.Context(), &ListLoginsQuery{Email: email})
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(logins)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+}
@@ -0,0 +1,44 @@
+package separation
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+type fixedGeo string
+
+func (g fixedGeo) Locate(ctx context.Context, ip string) (string, error) {
+	return string(g), nil
+}
+
+func TestNewDeviceLogin(t *testing.T) {
+	events := NewEventBus()
+	var published []*NewDeviceLogin
+	events.Subscribe("NewDeviceLogin", EventHandlerFunc(func(ctx context.Context, e Event) {
+		published = append(published, e.(*NewDeviceLogin))
+	}))
+	ls := NewMemoryLoginStorage()
+	lr := NewLoginRecorder(ls, fixedGeo("Paris, FR"), events)
+
+	ada, _ := ParseEmail("ada@example.com")
+	at := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i, ua := range []string{"Firefox", "Firefox", "Safari"} {
+		err := lr.Record(context.Background(), &Login{Email: ada, At: at.Add(time.Duration(i) * time.Hour), IP: "192.0.2.1", UserAgent: ua, Method: LoginMethodMagicLink})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(published) != 1 || published[0].UserAgent != "Safari" || published[0].Location != "Paris, FR" {
+		t.Errorf("got NewDeviceLogin events %+v, want one for Safari in Paris, FR", published)
+	}
+
+	logins, err := ls.List(context.Background(), ada)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(logins) != 3 || logins[0].UserAgent != "Safari" || !logins[0].At.After(logins[2].At) {
+		t.Errorf("got logins %+v, want all three newest first", logins)
+	}
+}
@@ -0,0 +1,490 @@
+package separation
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/oralordos/separation/internal/clock"
+	"github.com/oralordos/separation/internal/cookies"
+)
+
+// Action Layer
+var ErrMagicLinkNotFound = registerError(errors.New("Magic link not found"), "magic_link_not_found", http.StatusNotFound, "No sign-in link has the token")
+
+// MagicLink is a sign-in link emailed to a user. Only the hash of its token is kept.
+type MagicLink struct {
+	// ID is the SHA-256 of the token in the link
+	ID    string `json:"id"`
+	Email Email  `json:"email"`
+	// DeviceHash and IP bind the link to the browser or address that asked for it, when set
+	DeviceHash string    `json:"device_hash,omitempty"`
+	IP         string    `json:"ip,omitempty"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+type MagicLinkStorer interface {
+	Save(ctx context.Context, link *MagicLink) error
+	// Consume removes the link and returns it, so that of two redemptions racing
+	// for one link, only one succeeds
+	// Consume may return an ErrMagicLinkNotFound error
+	Consume(ctx context.Context, id string) (*MagicLink, error)
+	// DeleteExpired removes the links that expired before now, returning how many there were
+	DeleteExpired(ctx context.Context, now time.Time) (int, error)
+}
+
+// RepositoryMagicLinkStorage implements MagicLinkStorer on top of any magic link repository.
+// Consume holds a lock around reading and deleting the link, so the repository must not be
+// shared with another process.
+type RepositoryMagicLinkStorage struct {
+	repo Repository[string, *MagicLink]
+	mu   sync.Mutex
+}
+
+func NewRepositoryMagicLinkStorage(repo Repository[string, *MagicLink]) *RepositoryMagicLinkStorage {
+	return &RepositoryMagicLinkStorage{
+		repo: repo,
+	}
+}
+
+func NewMemoryMagicLinkStorage() *RepositoryMagicLinkStorage {
+	return NewRepositoryMagicLinkStorage(NewMemoryRepository(func(l *MagicLink) string {
+		return l.ID
+	}))
+}
+
+func (rs *RepositoryMagicLinkStorage) Save(ctx context.Context, link *MagicLink) error {
+	return rs.repo.Save(ctx, link)
+}
+
+func (rs *RepositoryMagicLinkStorage) Consume(ctx context.Context, id string) (*MagicLink, error) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	link, err := rs.repo.Get(ctx, id)
+	if err == ErrNotFound {
+		return nil, ErrMagicLinkNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	err = rs.repo.Delete(ctx, id)
+	if err == ErrNotFound {
+		return nil, ErrMagicLinkNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return link, nil
+}
+
+func (rs *RepositoryMagicLinkStorage) DeleteExpired(ctx context.Context, now time.Time) (int, error) {
+	links, err := rs.repo.List(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for _, l := range links {
+		if now.Before(l.ExpiresAt) {
+			continue
+		}
+		err = rs.repo.Delete(ctx, l.ID)
+		if err == ErrNotFound {
+			continue
+		} else if err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// Business Logic
+var (
+	ErrMagicLinkInvalid = registerError(errors.New("Sign-in link is invalid, used, expired or was requested from another device"), "magic_link_invalid", http.StatusUnauthorized, "The sign-in link is unknown, used, expired, or was requested from another device or address")
+	ErrMagicLinkLimited = registerError(errors.New("Too many sign-in links were requested, try again later"), "magic_link_limited", http.StatusTooManyRequests, "Too many sign-in links were requested for the email or from the address recently")
+	ErrLoginDisabled    = registerError(errors.New("Signing in with a link is not configured"), "login_disabled", http.StatusNotFound, "Signing in with a link is not configured on the server")
+)
+
+// Magic link bindings, as given to MagicLinkOptions.
+const (
+	// MagicLinkBindNone lets a link be opened anywhere
+	MagicLinkBindNone = "none"
+	// MagicLinkBindIP requires a link to be opened from the address that asked for it
+	MagicLinkBindIP = "ip"
+	// MagicLinkBindDevice requires a link to be opened in the browser that asked for it
+	MagicLinkBindDevice = "device"
+)
+
+// MagicLinkSender delivers a sign-in link to the user it signs in.
+type MagicLinkSender interface {
+	SendMagicLink(ctx context.Context, u *User, link string, expiresAt time.Time) error
+}
+
+// MagicLinkOptions configure the links MagicLinkHandler issues.
+type MagicLinkOptions struct {
+	// URL is the callback the token is added to, as the token query parameter
+	URL     string
+	TTL     time.Duration
+	Binding string
+	// SendLimit is how many links may be requested for one email within SendWindow, and
+	// IPSendLimit how many from one address
+	SendLimit   int
+	IPSendLimit int
+	SendWindow  time.Duration
+}
+
+type RequestMagicLinkParams struct {
+	Email Email `json:"email"`
+	// Device identifies the browser asking, for MagicLinkBindDevice
+	Device string `json:"-"`
+}
+
+func (rp *RequestMagicLinkParams) CommandName() string {
+	return "RequestMagicLink"
+}
+
+func (rp *RequestMagicLinkParams) Validate() error {
+	if rp.Email.IsZero() {
+		return ErrEmailEmpty
+	}
+	return nil
+}
+
+type RedeemMagicLinkParams struct {
+	Token string `json:"token"`
+	// Device identifies the browser opening the link, for MagicLinkBindDevice
+	Device string `json:"-"`
+
+	// Email is set to the user signed in once the link is redeemed
+	Email Email `json:"-"`
+}
+
+func (rp *RedeemMagicLinkParams) CommandName() string {
+	return "RedeemMagicLink"
+}
+
+func (rp *RedeemMagicLinkParams) Validate() error {
+	if rp.Token == "" {
+		return ErrMagicLinkInvalid
+	}
+	return nil
+}
+
+func hashMagicLinkSecret(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func newMagicLinkToken() (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+type MagicLinkHandler struct {
+	userStorage UserStorer
+	linkStorage MagicLinkStorer
+	sender      MagicLinkSender
+	opts        MagicLinkOptions
+	emailLimit  *sendLimiter[Email]
+	ipLimit     *sendLimiter[string]
+	clock       clock.Clock
+}
+
+func NewMagicLinkHandler(us UserStorer, ls MagicLinkStorer, sender MagicLinkSender, opts MagicLinkOptions, clk clock.Clock) *MagicLinkHandler {
+	return &MagicLinkHandler{
+		userStorage: us,
+		linkStorage: ls,
+		sender:      sender,
+		opts:        opts,
+		emailLimit:  newSendLimiter[Email](opts.SendLimit, opts.SendWindow),
+		ipLimit:     newSendLimiter[string](opts.IPSendLimit, opts.SendWindow),
+		clock:       clk,
+	}
+}
+
+// Request sends a sign-in link to a registered user. Nothing happens for an email that is
+// not registered, and no error says so, so the endpoint cannot be used to find users.
+// Requests are limited per email and per address whether the email is registered or not,
+// for the same reason.
+func (mh *MagicLinkHandler) Request(ctx context.Context, cmd Command) error {
+	params, ok := cmd.(*RequestMagicLinkParams)
+	if !ok {
+		return fmt.Errorf("MagicLinkHandler cannot request %T", cmd)
+	}
+	if mh.opts.URL == "" {
+		return ErrLoginDisabled
+	}
+
+	now := mh.clock.Now().UTC()
+	if ip := clientIPFromContext(ctx); ip != "" && !mh.ipLimit.allow(ip, now) {
+		return ErrMagicLinkLimited
+	}
+	if !mh.emailLimit.allow(params.Email, now) {
+		return ErrMagicLinkLimited
+	}
+
+	u, err := mh.userStorage.Get(ctx, params.Email)
+	if err == ErrUserNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	_, err = mh.linkStorage.DeleteExpired(ctx, now)
+	if err != nil {
+		return err
+	}
+
+	token, err := newMagicLinkToken()
+	if err != nil {
+		return err
+	}
+	link := &MagicLink{
+		ID:        hashMagicLinkSecret(token),
+		Email:     u.Email,
+		ExpiresAt: now.Add(mh.opts.TTL),
+		CreatedAt: now,
+	}
+	switch mh.opts.Binding {
+	case MagicLinkBindDevice:
+		if params.Device == "" {
+			return ErrMagicLinkInvalid
+		}
+		link.DeviceHash = hashMagicLinkSecret(params.Device)
+	case MagicLinkBindIP:
+		link.IP = clientIPFromContext(ctx)
+	}
+	err = mh.linkStorage.Save(ctx, link)
+	if err != nil {
+		return err
+	}
+
+	callback, err := url.Parse(mh.opts.URL)
+	if err != nil {
+		return err
+	}
+	q := callback.Query()
+	q.Set("token", token)
+	callback.RawQuery = q.Encode()
+	return mh.sender.SendMagicLink(ctx, u, callback.String(), link.ExpiresAt)
+}
+
+// Redeem uses up a sign-in link, setting params.Email to the user it signs in.
+func (mh *MagicLinkHandler) Redeem(ctx context.Context, cmd Command) error {
+	params, ok := cmd.(*RedeemMagicLinkParams)
+	if !ok {
+		return fmt.Errorf("MagicLinkHandler cannot redeem %T", cmd)
+	}
+
+	link, err := mh.linkStorage.Consume(ctx, hashMagicLinkSecret(params.Token))
+	if err == ErrMagicLinkNotFound {
+		return ErrMagicLinkInvalid
+	} else if err != nil {
+		return err
+	}
+
+	if !mh.clock.Now().Before(link.ExpiresAt) {
+		return ErrMagicLinkInvalid
+	}
+	if link.DeviceHash != "" && subtle.ConstantTimeCompare([]byte(hashMagicLinkSecret(params.Device)), []byte(link.DeviceHash)) != 1 {
+		return ErrMagicLinkInvalid
+	}
+	if link.IP != "" && clientIPFromContext(ctx) != link.IP {
+		return ErrMagicLinkInvalid
+	}
+
+	u, err := mh.userStorage.Get(ctx, link.Email)
+	if err == ErrUserNotFound {
+		return ErrMagicLinkInvalid
+	} else if err != nil {
+		return err
+	}
+	params.Email = u.Email
+	return nil
+}
+
+// MagicLinkData is what the magic_link message templates are given.
+type MagicLinkData struct {
+	User      *User
+	Link      string
+	ExpiresAt time.Time
+}
+
+// magicLinkSample is the preview data of the magic_link templates.
+func magicLinkSample() interface{} {
+	email, _ := ParseEmail("ada@example.com")
+	return &MagicLinkData{
+		User:      &User{Email: email, Name: "Ada Lovelace"},
+		Link:      "https://example.com/login/magic/callback?token=sample",
+		ExpiresAt: time.Now().UTC().Add(15 * time.Minute),
+	}
+}
+
+// Access Layer
+// EmailMagicLinkSender emails sign-in links from the magic_link templates, in the locale of
+// the user's preferences.
+type EmailMagicLinkSender struct {
+	sender    EmailSender
+	templates *MessageTemplates
+	prefs     PreferencesStorer
+	defaults  Preferences
+}
+
+func NewEmailMagicLinkSender(sender EmailSender, templates *MessageTemplates, ps PreferencesStorer, defaults Preferences) *EmailMagicLinkSender {
+	return &EmailMagicLinkSender{
+		sender:    sender,
+		templates: templates,
+		prefs:     ps,
+		defaults:  defaults,
+	}
+}
+
+func (es *EmailMagicLinkSender) SendMagicLink(ctx context.Context, u *User, link string, expiresAt time.Time) error {
+	prefs := es.defaults
+	stored, err := es.prefs.Get(ctx, u.Email)
+	if err == nil {
+		prefs = es.defaults.Merge(stored.Settings)
+	} else if err != ErrNotFound {
+		return err
+	}
+
+	msg, err := es.templates.Render(ctx, "magic_link", prefs.Locale, &MagicLinkData{User: u, Link: link, ExpiresAt: expiresAt})
+	if err != nil {
+		return err
+	}
+	return es.sender.SendEmail(ctx, u.Email, msg)
+}
+
+// LogMagicLinkSender writes sign-in links to a log instead of delivering them, for development.
+type LogMagicLinkSender struct {
+	w io.Writer
+}
+
+func NewLogMagicLinkSender(w io.Writer) *LogMagicLinkSender {
+	return &LogMagicLinkSender{w: w}
+}
+
+func (ls *LogMagicLinkSender) SendMagicLink(ctx context.Context, u *User, link string, expiresAt time.Time) error {
+	_, err := fmt.Fprintf(ls.w, "Sign-in link for %s expires %s, %s\n", u.Email, expiresAt.Format(time.RFC3339), link)
+	return err
+}
+
+const (
+	sessionCookie = "session"
+	deviceCookie  = "magic_device"
+)
+
+// ParseSessionKeys parses a comma separated list of secrets, the first of which signs new sessions.
+func ParseSessionKeys(s string) ([][]byte, error) {
+	var keys [][]byte
+	for _, k := range parseNameList(s) {
+		if len(k) < cookies.MinKeyLen {
+			return nil, fmt.Errorf("Session keys must be at least %d characters", cookies.MinKeyLen)
+		}
+		keys = append(keys, []byte(k))
+	}
+	return keys, nil
+}
+
+// bindDevice gives the browser a random device ID in a cookie, returning it.
+func (s *Sessions) bindDevice(w http.ResponseWriter, r *http.Request) (string, error) {
+	device, err := s.codec.Get(r, deviceCookie)
+	if err == nil {
+		return device, nil
+	}
+	device, err = newMagicLinkToken()
+	if err != nil {
+		return "", err
+	}
+	return device, s.codec.Set(w, &http.Cookie{Name: deviceCookie, Value: device})
+}
+
+// device returns the device ID bindDevice gave the browser, or nothing.
+func (s *Sessions) device(r *http.Request) string {
+	device, _ := s.codec.Get(r, deviceCookie)
+	return device
+}
+
+// RequestMagicLink serves POST /login/magic with a body of {"email": "..."}, emailing a
+// sign-in link if the email is registered. It answers 202 either way.
+func (j *JsonOverHTTP) RequestMagicLink(w http.ResponseWriter, r *http.Request) {
+	if j.Sessions == nil {
+		writeError(w, r, ErrLoginDisabled)
+		return
+	}
+
+	params := &RequestMagicLinkParams{}
+	err := json.NewDecoder(r.Body).Decode(params)
+	if err != nil {
+		writeError(w, r, decodeError(err))
+		return
+	}
+
+	params.Device, err = j.Sessions.bindDevice(w, r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	err = j.usrServ.RequestMagicLink(r.Context(), params)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// MagicLinkCallback serves GET /login/magic/callback?token=..., the link in the email.
+// It starts a session and redirects to the landing page, or returns the user without one.
+func (j *JsonOverHTTP) MagicLinkCallback(w http.ResponseWriter, r *http.Request) {
+	if j.Sessions == nil {
+		writeError(w, r, ErrLoginDisabled)
+		return
+	}
+
+	params := &RedeemMagicLinkParams{
+		Token:  r.FormValue("token"),
+		Device: j.Sessions.device(r),
+	}
+	u, err := j.usrServ.RedeemMagicLink(r.Context(), params)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	err = j.Sessions.start(w, r, u.Email, LoginMethodMagicLink)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	cookies.Clear(w, deviceCookie, "")
+
+	if j.Sessions.landing != "" {
+		http.Redirect(w, r, j.Sessions.landing, http.StatusSeeOther)
+		return
+	}
+	codec := responseCodec(r)
+	w.Header().Set("Content-Type", codec.ContentType())
+	err = codec.EncodeUser(w, u)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+}
@@ -0,0 +1,68 @@
+package separation
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/oralordos/separation/internal/clock/clocktest"
+)
+
+type countingLinkSender struct {
+	sent int
+}
+
+func (cs *countingLinkSender) SendMagicLink(ctx context.Context, u *User, link string, expiresAt time.Time) error {
+	cs.sent++
+	return nil
+}
+
+func TestMagicLinkRequestLimit(t *testing.T) {
+	clk := clocktest.NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	us := NewMemoryUserStorage()
+	ada, _ := ParseEmail("ada@example.com")
+	err := us.Insert(context.Background(), &User{Email: ada})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender := &countingLinkSender{}
+	mh := NewMagicLinkHandler(us, NewMemoryMagicLinkStorage(), sender, MagicLinkOptions{
+		URL:         "https://example.com/login/magic/callback",
+		TTL:         15 * time.Minute,
+		Binding:     MagicLinkBindNone,
+		SendLimit:   2,
+		IPSendLimit: 4,
+		SendWindow:  time.Hour,
+	}, clk)
+
+	request := func(ip, email string) error {
+		e, _ := ParseEmail(email)
+		ctx := clientIPKey.With(context.Background(), net.ParseIP(ip))
+		return mh.Request(ctx, &RequestMagicLinkParams{Email: e})
+	}
+
+	for _, email := range []string{"ada@example.com", "ada@example.com", "nobody@example.com", "nobody@example.com"} {
+		err = request("192.0.2.1", email)
+		if err != nil {
+			t.Fatalf("Requesting a link for %s answered %v", email, err)
+		}
+	}
+	if err := request("192.0.2.2", "ada@example.com"); err != ErrMagicLinkLimited {
+		t.Errorf("A third link for a registered email answered %v, want ErrMagicLinkLimited", err)
+	}
+	if err := request("192.0.2.2", "nobody@example.com"); err != ErrMagicLinkLimited {
+		t.Errorf("A third link for an unregistered email answered %v, want ErrMagicLinkLimited", err)
+	}
+	if err := request("192.0.2.1", "grace@example.com"); err != ErrMagicLinkLimited {
+		t.Errorf("A fifth link from one address answered %v, want ErrMagicLinkLimited", err)
+	}
+	if sender.sent != 2 {
+		t.Errorf("Sent %d links, want 2", sender.sent)
+	}
+
+	clk.Advance(time.Hour)
+	if err := request("192.0.2.1", "ada@example.com"); err != nil {
+		t.Errorf("A link after the window answered %v", err)
+	}
+}
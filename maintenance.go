@@ -0,0 +1,268 @@
+package separation
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+)
+
+// Action Layer
+type MaintenanceState struct {
+	Enabled bool   `json:"enabled"`
+	Message string `json:"message"`
+	// RetryAfter is the number of seconds clients are told to wait.
+	RetryAfter int `json:"retry_after"`
+}
+
+type MaintenanceStorer interface {
+	// Get returns a disabled state if nothing has been saved yet
+	Get(ctx context.Context) (*MaintenanceState, error)
+	Save(ctx context.Context, state *MaintenanceState) error
+}
+
+type MemoryMaintenanceStorage struct {
+	mu    sync.Mutex
+	state MaintenanceState
+}
+
+func NewMemoryMaintenanceStorage() *MemoryMaintenanceStorage {
+	return &MemoryMaintenanceStorage{}
+}
+
+func (ms *MemoryMaintenanceStorage) Get(ctx context.Context) (*MaintenanceState, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	s := ms.state
+	return &s, nil
+}
+
+func (ms *MemoryMaintenanceStorage) Save(ctx context.Context, state *MaintenanceState) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.state = *state
+	return nil
+}
+
+// FileMaintenanceStorage keeps the maintenance state in a JSON file so it survives restarts.
+type FileMaintenanceStorage struct {
+	path string
+	mu   sync.Mutex
+}
+
+func NewFileMaintenanceStorage(path string) *FileMaintenanceStorage {
+	return &FileMaintenanceStorage{
+		path: path,
+	}
+}
+
+func (fs *FileMaintenanceStorage) Get(ctx context.Context) (*MaintenanceState, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	state := &MaintenanceState{}
+	b, err := ioutil.ReadFile(fs.path)
+	if os.IsNotExist(err) {
+		return state, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(b, state)
+	if err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+func (fs *FileMaintenanceStorage) Save(ctx context.Context, state *MaintenanceState) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	b, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so a crash never leaves a truncated state file.
+	tmp, err := ioutil.TempFile(filepath.Dir(fs.path), filepath.Base(fs.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(b)
+	if err != nil {
+		tmp.Close()
+		return err
+	}
+
+	err = tmp.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), fs.path)
+}
+
+// Business Logic
+type SetMaintenanceParams struct {
+	Enabled    bool   `json:"enabled"`
+	Message    string `json:"message"`
+	RetryAfter int    `json:"retry_after"`
+}
+
+func (mp *SetMaintenanceParams) Validate() error {
+	if mp.RetryAfter < 0 {
+		return NewValidationError("Retry after cannot be negative")
+	}
+
+	return nil
+}
+
+type MaintenanceService interface {
+	// Status is called on every request, so it must not hit storage
+	Status(ctx context.Context) MaintenanceState
+	// Set validates params and may return a ValidationError
+	Set(ctx context.Context, params *SetMaintenanceParams) error
+}
+
+type MaintenanceServiceImpl struct {
+	storage    MaintenanceStorer
+	defaultMsg string
+	defaultRA  int
+
+	mu      sync.RWMutex
+	current MaintenanceState
+}
+
+// NewMaintenanceServiceImpl loads the saved state so maintenance mode survives restarts.
+// defaultMsg and defaultRetryAfter are used when Set does not provide them.
+func NewMaintenanceServiceImpl(ctx context.Context, ms MaintenanceStorer, defaultMsg string, defaultRetryAfter int) (*MaintenanceServiceImpl, error) {
+	state, err := ms.Get(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &MaintenanceServiceImpl{
+		storage:    ms,
+		defaultMsg: defaultMsg,
+		defaultRA:  defaultRetryAfter,
+		current:    *state,
+	}, nil
+}
+
+func (ms *MaintenanceServiceImpl) Status(ctx context.Context) MaintenanceState {
+	ms.mu.RLock()
+	defer ms.mu.RUnlock()
+	return ms.current
+}
+
+func (ms *MaintenanceServiceImpl) Set(ctx context.Context, params *SetMaintenanceParams) error {
+	err := params.Validate()
+	if err != nil {
+		return err
+	}
+
+	state := MaintenanceState{
+		Enabled:    params.Enabled,
+		Message:    params.Message,
+		RetryAfter: params.RetryAfter,
+	}
+	if state.Message == "" {
+		state.Message = ms.defaultMsg
+	}
+	if state.RetryAfter == 0 {
+		state.RetryAfter = ms.defaultRA
+	}
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	err = ms.storage.Save(ctx, &state)
+	if err != nil {
+		return err
+	}
+	ms.current = state
+	return nil
+}
+
+// Access Layer
+// MaintenanceError is returned for requests rejected during maintenance.
+type MaintenanceError struct {
+	Message string
+}
+
+func init() {
+	registerErrorType[*MaintenanceError]("maintenance", http.StatusServiceUnavailable, "The service is in maintenance mode, retry after the Retry-After header")
+}
+
+func (me *MaintenanceError) Error() string {
+	return me.Message
+}
+
+// MaintenanceMiddleware rejects requests with 503 while maintenance mode is enabled.
+// Paths in exempt, such as health checks, are always let through.
+type MaintenanceMiddleware struct {
+	next   http.Handler
+	maint  MaintenanceService
+	exempt map[string]bool
+}
+
+func NewMaintenanceMiddleware(next http.Handler, maint MaintenanceService, exempt ...string) *MaintenanceMiddleware {
+	mm := &MaintenanceMiddleware{
+		next:   next,
+		maint:  maint,
+		exempt: map[string]bool{},
+	}
+	for _, p := range exempt {
+		mm.exempt[p] = true
+	}
+	return mm
+}
+
+func (mm *MaintenanceMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !mm.exempt[r.URL.Path] {
+		state := mm.maint.Status(r.Context())
+		if state.Enabled {
+			if state.RetryAfter > 0 {
+				w.Header().Set("Retry-After", strconv.Itoa(state.RetryAfter))
+			}
+			writeError(w, r, &MaintenanceError{Message: state.Message})
+			return
+		}
+	}
+	mm.next.ServeHTTP(w, r)
+}
+
+func (a *AdminHTTP) Maintenance(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		err := json.NewEncoder(w).Encode(a.maint.Status(r.Context()))
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+	case http.MethodPut:
+		params := &SetMaintenanceParams{}
+		err := json.NewDecoder(r.Body).Decode(params)
+		if err != nil {
+			writeError(w, r, ErrMalformedRequest)
+			return
+		}
+
+		err = a.maint.Set(r.Context(), params)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, r, NewMethodError("Maintenance requires a get or put request"))
+	}
+}
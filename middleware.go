@@ -0,0 +1,223 @@
+package separation
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/oralordos/separation/internal/clock"
+)
+
+// Access Layer
+// Middleware wraps a handler with behaviour of its own.
+type Middleware func(http.Handler) http.Handler
+
+// MiddlewareFactory builds a named middleware for the user facing access layer.
+// It returns a nil Middleware to leave itself out, such as when it is not configured.
+// Any closers are closed when the transport shuts down.
+type MiddlewareFactory func(deps *TransportDeps) (Middleware, []io.Closer, error)
+
+var (
+	middlewareMu sync.Mutex
+	middleware   = map[string]MiddlewareFactory{}
+)
+
+// DefaultMiddleware is the stack used when MIDDLEWARE is not set, outermost first.
+var DefaultMiddleware = []string{"record", "errors", "securityheaders", "altsvc", "clientip", "accesslog", "ipfilter", "mtls", "replay", "maintenance", "auth", "csrf", "ratelimit", "activity", "deadline"}
+
+// RegisterMiddleware makes a middleware available by name to the MIDDLEWARE setting,
+// so embedders can place their own anywhere in the stack.
+// It panics if the name is registered twice.
+func RegisterMiddleware(name string, factory MiddlewareFactory) {
+	middlewareMu.Lock()
+	defer middlewareMu.Unlock()
+
+	if _, ok := middleware[name]; ok {
+		panic("Middleware registered twice: " + name)
+	}
+	middleware[name] = factory
+}
+
+// BuildMiddleware wraps next in the named middleware, the first name outermost.
+func BuildMiddleware(names []string, deps *TransportDeps, next http.Handler) (http.Handler, []io.Closer, error) {
+	middlewareMu.Lock()
+	defer middlewareMu.Unlock()
+
+	var closers []io.Closer
+	handler := next
+	for i := len(names) - 1; i >= 0; i-- {
+		factory, ok := middleware[names[i]]
+		if !ok {
+			return nil, closers, fmt.Errorf("Unknown middleware %q", names[i])
+		}
+
+		mw, cs, err := factory(deps)
+		closers = append(closers, cs...)
+		if err != nil {
+			return nil, closers, fmt.Errorf("Unable to build middleware %q: %v", names[i], err)
+		}
+		if mw != nil {
+			handler = mw(handler)
+		}
+	}
+	return handler, closers, nil
+}
+
+func init() {
+	RegisterMiddleware("record", func(deps *TransportDeps) (Middleware, []io.Closer, error) {
+		cfg := deps.Config
+		if cfg.RecordFile == "" {
+			return nil, nil, nil
+		}
+
+		out, err := OpenAccessLog(cfg.RecordFile, 0, 0)
+		if err != nil {
+			return nil, nil, err
+		}
+		var closers []io.Closer
+		if c, ok := out.(io.Closer); ok && !isStdStream(cfg.RecordFile) {
+			closers = append(closers, c)
+		}
+		return func(next http.Handler) http.Handler {
+			return NewRequestRecorder(next, out)
+		}, closers, nil
+	})
+
+	RegisterMiddleware("errors", func(deps *TransportDeps) (Middleware, []io.Closer, error) {
+		return func(next http.Handler) http.Handler {
+			return WithErrorWriter(next, deps.Config.ErrorFormat)
+		}, nil, nil
+	})
+
+	RegisterMiddleware("securityheaders", func(deps *TransportDeps) (Middleware, []io.Closer, error) {
+		return func(next http.Handler) http.Handler {
+			return NewSecurityHeaders(next, deps.Config.ContentSecurityPolicy)
+		}, nil, nil
+	})
+
+	RegisterMiddleware("altsvc", func(deps *TransportDeps) (Middleware, []io.Closer, error) {
+		cfg := deps.Config
+		if cfg.HTTP3Listen == "" || !containsString(cfg.Transports, "http3") {
+			return nil, nil, nil
+		}
+		_, port, err := net.SplitHostPort(cfg.HTTP3Listen)
+		if err != nil {
+			return nil, nil, fmt.Errorf("HTTP3_LISTEN: %v", err)
+		}
+		altSvc := fmt.Sprintf(`h3=":%s"; ma=86400`, port)
+		return func(next http.Handler) http.Handler {
+			return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				// Clients already on HTTP/3 need no pointer to it
+				if r.ProtoMajor < 3 {
+					w.Header().Set("Alt-Svc", altSvc)
+				}
+				next.ServeHTTP(w, r)
+			})
+		}, nil, nil
+	})
+
+	RegisterMiddleware("clientip", func(deps *TransportDeps) (Middleware, []io.Closer, error) {
+		return func(next http.Handler) http.Handler {
+			return WithClientIP(next, deps.Config.TrustedProxies)
+		}, nil, nil
+	})
+
+	RegisterMiddleware("accesslog", func(deps *TransportDeps) (Middleware, []io.Closer, error) {
+		cfg := deps.Config
+		if cfg.AccessLog == "" {
+			return nil, nil, nil
+		}
+
+		out, err := OpenAccessLog(cfg.AccessLog, cfg.AccessLogMaxSize, cfg.AccessLogMaxAge)
+		if err != nil {
+			return nil, nil, err
+		}
+		var closers []io.Closer
+		if c, ok := out.(io.Closer); ok && !isStdStream(cfg.AccessLog) {
+			closers = append(closers, c)
+		}
+		return func(next http.Handler) http.Handler {
+			return NewAccessLogger(next, out, cfg.AccessLogFormat)
+		}, closers, nil
+	})
+
+	RegisterMiddleware("ipfilter", func(deps *TransportDeps) (Middleware, []io.Closer, error) {
+		if deps.IPFilter == nil {
+			return nil, nil, nil
+		}
+		return func(next http.Handler) http.Handler {
+			return NewIPFilterMiddleware(next, deps.IPFilter, "http", deps.Config.TrustedProxies)
+		}, nil, nil
+	})
+
+	RegisterMiddleware("mtls", func(deps *TransportDeps) (Middleware, []io.Closer, error) {
+		if len(deps.Config.MTLSRequiredPaths) == 0 {
+			return nil, nil, nil
+		}
+		return func(next http.Handler) http.Handler {
+			return NewMTLSRequired(next, deps.Config.MTLSRequiredPaths)
+		}, nil, nil
+	})
+
+	RegisterMiddleware("replay", func(deps *TransportDeps) (Middleware, []io.Closer, error) {
+		cfg := deps.Config
+		if len(cfg.ReplayProtectedPaths) == 0 {
+			return nil, nil, nil
+		}
+		store := NewMemoryNonceStore(clock.Real)
+		return func(next http.Handler) http.Handler {
+			return NewReplayGuard(next, store, cfg.ReplayWindow, cfg.ReplayProtectedPaths, clock.Real)
+		}, nil, nil
+	})
+
+	RegisterMiddleware("maintenance", func(deps *TransportDeps) (Middleware, []io.Closer, error) {
+		return func(next http.Handler) http.Handler {
+			return NewMaintenanceMiddleware(next, deps.Maintenance, "/healthz")
+		}, nil, nil
+	})
+
+	RegisterMiddleware("auth", func(deps *TransportDeps) (Middleware, []io.Closer, error) {
+		return func(next http.Handler) http.Handler {
+			return NewAuthMiddleware(next, deps.Authenticators...)
+		}, nil, nil
+	})
+
+	RegisterMiddleware("csrf", func(deps *TransportDeps) (Middleware, []io.Closer, error) {
+		keys := deps.Config.SessionKeys
+		if len(keys) == 0 {
+			return nil, nil, nil
+		}
+		return func(next http.Handler) http.Handler {
+			return NewCSRFGuard(next, keys)
+		}, nil, nil
+	})
+
+	RegisterMiddleware("ratelimit", func(deps *TransportDeps) (Middleware, []io.Closer, error) {
+		cfg := deps.Config
+		if len(cfg.RateLimits) == 0 {
+			return nil, nil, nil
+		}
+		var counter RateCounter = NewMemoryRateCounter(clock.Real)
+		if deps.Redis != nil {
+			counter = NewRedisRateCounter(deps.Redis, "separation:ratelimit:", clock.Real)
+		}
+		return func(next http.Handler) http.Handler {
+			return NewRateLimiter(next, counter, cfg.RateLimits, deps.Users, clock.Real)
+		}, nil, nil
+	})
+
+	RegisterMiddleware("activity", func(deps *TransportDeps) (Middleware, []io.Closer, error) {
+		tracker := NewActivityTracker(deps.Users, clock.Real, deps.Config.ActivityFlushInterval)
+		return func(next http.Handler) http.Handler {
+			return NewActivityMiddleware(next, tracker)
+		}, []io.Closer{tracker}, nil
+	})
+
+	RegisterMiddleware("deadline", func(deps *TransportDeps) (Middleware, []io.Closer, error) {
+		return func(next http.Handler) http.Handler {
+			return NewDeadlineMiddleware(next, deps.Config.MaxRequestTimeout)
+		}, nil, nil
+	})
+}
@@ -0,0 +1,102 @@
+package separation
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/oralordos/separation/internal/principal"
+)
+
+// Access Layer
+var ErrClientCertRequired = registerError(errors.New("The endpoint requires a verified client certificate"), "client_cert_required", http.StatusForbidden, "The endpoint is only served to clients with a verified certificate, on the mTLS listener")
+
+// LoadMTLSConfig builds a TLS config serving certFile and keyFile that requires every
+// client to present a certificate issued by a CA in clientCAFile.
+func LoadMTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	pem, err := ioutil.ReadFile(clientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("%s has no PEM certificates", clientCAFile)
+	}
+
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// verifiedClientCert returns the client certificate of r if it was verified against the client CAs.
+func verifiedClientCert(r *http.Request) *x509.Certificate {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	return r.TLS.VerifiedChains[0][0]
+}
+
+// ClientCertAuthenticator identifies callers by their verified client certificate.
+// The first email SAN becomes the principal's email, so a certificate can act as a user,
+// and the subject is the certificate's common name.
+type ClientCertAuthenticator struct{}
+
+func NewClientCertAuthenticator() *ClientCertAuthenticator {
+	return &ClientCertAuthenticator{}
+}
+
+func (ca *ClientCertAuthenticator) Authenticate(r *http.Request) (*principal.Principal, error) {
+	cert := verifiedClientCert(r)
+	if cert == nil {
+		return nil, nil
+	}
+
+	p := &principal.Principal{
+		Subject: "cert:" + cert.Subject.CommonName,
+		Scheme:  "mtls",
+	}
+	if len(cert.EmailAddresses) > 0 {
+		email, err := ParseEmail(cert.EmailAddresses[0])
+		if err != nil {
+			return nil, err
+		}
+		p.Email = email.String()
+	}
+	return p, nil
+}
+
+// MTLSRequired rejects requests to paths starting with any of prefixes unless they
+// came with a verified client certificate, whichever transport they arrived on.
+type MTLSRequired struct {
+	next     http.Handler
+	prefixes []string
+}
+
+func NewMTLSRequired(next http.Handler, prefixes []string) *MTLSRequired {
+	return &MTLSRequired{
+		next:     next,
+		prefixes: prefixes,
+	}
+}
+
+func (mr *MTLSRequired) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	for _, p := range mr.prefixes {
+		if strings.HasPrefix(r.URL.Path, p) && verifiedClientCert(r) == nil {
+			writeError(w, r, ErrClientCertRequired)
+			return
+		}
+	}
+	mr.next.ServeHTTP(w, r)
+}
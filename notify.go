@@ -0,0 +1,470 @@
+package separation
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oralordos/separation/internal/clock"
+	"github.com/oralordos/separation/internal/httpclient"
+)
+
+// Business Logic
+// Notification channels, as named in NotificationPreferences.
+const (
+	ChannelEmail   = "email"
+	ChannelWebhook = "webhook"
+	ChannelSMS     = "sms"
+)
+
+// Notification is one message for one user, rendered and ready to send.
+type Notification struct {
+	// Kind is the name of the rule that raised it, such as welcome
+	Kind string `json:"kind"`
+	To   *User  `json:"-"`
+	*RenderedMessage
+	At time.Time `json:"at"`
+}
+
+// NotificationChannel delivers notifications one way, such as by email.
+// Channels must be safe to call concurrently.
+type NotificationChannel interface {
+	ChannelName() string
+	// Reaches reports whether the channel has an address for u
+	Reaches(u *User) bool
+	Send(ctx context.Context, n *Notification) error
+}
+
+// NotificationRule turns one kind of event into a notification for one user, rendered
+// from the message templates of its kind.
+type NotificationRule struct {
+	Kind  string
+	Event string
+	// Recipient returns who e notifies
+	Recipient func(e Event) Email
+	// Sample returns an event to preview the templates with
+	Sample func() Event
+}
+
+// MessageData is what message templates are given: the recipient as .User and the event as .Event.
+type MessageData struct {
+	User  *User
+	Event Event
+}
+
+// DefaultNotificationRules are the notifications sent to users.
+func DefaultNotificationRules() []*NotificationRule {
+	sampleEmail := func(s string) Email {
+		e, _ := ParseEmail(s)
+		return e
+	}
+	return []*NotificationRule{
+		{
+			Kind:      "welcome",
+			Event:     "UserRegistered",
+			Recipient: func(e Event) Email { return e.(*UserRegistered).Email },
+			Sample: func() Event {
+				return &UserRegistered{Email: sampleEmail("ada@example.com"), At: time.Now().UTC()}
+			},
+		},
+		{
+			Kind:      "referral_joined",
+			Event:     "UserReferred",
+			Recipient: func(e Event) Email { return e.(*UserReferred).Referrer },
+			Sample: func() Event {
+				return &UserReferred{Referrer: sampleEmail("ada@example.com"), Referred: sampleEmail("charles@example.com"), At: time.Now().UTC()}
+			},
+		},
+		{
+			Kind:      "new_device_login",
+			Event:     "NewDeviceLogin",
+			Recipient: func(e Event) Email { return e.(*NewDeviceLogin).Email },
+			Sample: func() Event {
+				return &NewDeviceLogin{Email: sampleEmail("ada@example.com"), IP: "192.0.2.1", UserAgent: "Mozilla/5.0 (X11; Linux x86_64) Firefox/128.0", Location: "Paris, FR", At: time.Now().UTC()}
+			},
+		},
+	}
+}
+
+// NotificationSamples makes the preview data of each rule, for NewMessageTemplates.
+func NotificationSamples(rules []*NotificationRule) map[string]func() interface{} {
+	samples := map[string]func() interface{}{}
+	for _, r := range rules {
+		r := r
+		samples[r.Kind] = func() interface{} {
+			e := r.Sample()
+			return &MessageData{
+				User:  &User{Email: r.Recipient(e), Name: "Ada Lovelace"},
+				Event: e,
+			}
+		}
+	}
+	return samples
+}
+
+// NotifierOptions tune how a Notifier retries and suppresses.
+type NotifierOptions struct {
+	// MaxAttempts is how many times a notification is tried on a channel before it is dropped
+	MaxAttempts int
+	// Backoff is the wait before the first retry, doubling for each retry after
+	Backoff time.Duration
+	// SuppressWindow drops a notification of the same kind to the same user on the same
+	// channel as one queued within it, so a replayed event does not notify twice
+	SuppressWindow time.Duration
+	// QueueSize bounds the notifications waiting to be sent. Notifications past it are dropped.
+	QueueSize int
+	// Workers is how many notifications are sent at once
+	Workers int
+}
+
+var notificationCounts = expvar.NewMap("notifications")
+
+type notificationDelivery struct {
+	channel NotificationChannel
+	n       *Notification
+}
+
+// Notifier turns events into notifications by its rules, and sends them on every channel
+// the recipient has enabled in their preferences and the channel can reach them on.
+// Sending happens in the background, so a slow channel does not hold up the event bus.
+//
+// Sent, suppressed, retried, failed and dropped notifications are counted in the notifications expvar.
+type Notifier struct {
+	users     UserStorer
+	prefs     PreferencesStorer
+	defaults  Preferences
+	templates *MessageTemplates
+	channels  []NotificationChannel
+	rules     map[string][]*NotificationRule
+	opts      NotifierOptions
+	clock     clock.Clock
+	onError   func(error)
+
+	mu   sync.Mutex
+	sent map[string]time.Time
+
+	queue chan notificationDelivery
+	stop  chan struct{}
+	wg    sync.WaitGroup
+}
+
+// NewNotifier starts sending until it is closed, reporting notifications it gives up on to onError.
+func NewNotifier(us UserStorer, ps PreferencesStorer, defaults Preferences, templates *MessageTemplates, channels []NotificationChannel, rules []*NotificationRule, opts NotifierOptions, clk clock.Clock, onError func(error)) *Notifier {
+	n := &Notifier{
+		users:     us,
+		prefs:     ps,
+		defaults:  defaults,
+		templates: templates,
+		channels:  channels,
+		rules:     map[string][]*NotificationRule{},
+		opts:      opts,
+		clock:     clk,
+		onError:   onError,
+		sent:      map[string]time.Time{},
+		queue:     make(chan notificationDelivery, opts.QueueSize),
+		stop:      make(chan struct{}),
+	}
+	for _, r := range rules {
+		n.rules[r.Event] = append(n.rules[r.Event], r)
+	}
+	for i := 0; i < opts.Workers; i++ {
+		n.wg.Add(1)
+		go n.run()
+	}
+	return n
+}
+
+// Events are the names of the events the notifier has rules for, to subscribe it to.
+func (n *Notifier) Events() []string {
+	var events []string
+	for e := range n.rules {
+		events = append(events, e)
+	}
+	return events
+}
+
+func (n *Notifier) HandleEvent(ctx context.Context, e Event) {
+	for _, r := range n.rules[e.EventName()] {
+		err := n.notify(ctx, r, e)
+		if err != nil {
+			n.onError(fmt.Errorf("Unable to send %s notification: %w", r.Kind, err))
+		}
+	}
+}
+
+func (n *Notifier) notify(ctx context.Context, r *NotificationRule, e Event) error {
+	u, err := n.users.Get(ctx, r.Recipient(e))
+	if err == ErrUserNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	prefs := n.defaults
+	stored, err := n.prefs.Get(ctx, u.Email)
+	if err == nil {
+		prefs = n.defaults.Merge(stored.Settings)
+	} else if err != ErrNotFound {
+		return err
+	}
+
+	now := n.clock.Now().UTC()
+	var notification *Notification
+	for _, c := range n.channels {
+		if !prefs.Notifications.Channel(c.ChannelName()) || !c.Reaches(u) {
+			continue
+		}
+		if n.suppressed(r.Kind, c.ChannelName(), u.Email, now) {
+			notificationCounts.Add("suppressed", 1)
+			continue
+		}
+
+		if notification == nil {
+			msg, err := n.templates.Render(ctx, r.Kind, prefs.Locale, &MessageData{User: u, Event: e})
+			if err != nil {
+				return err
+			}
+			notification = &Notification{Kind: r.Kind, To: u, RenderedMessage: msg, At: now}
+		}
+		select {
+		case n.queue <- notificationDelivery{channel: c, n: notification}:
+		default:
+			notificationCounts.Add("dropped", 1)
+			return fmt.Errorf("Notification queue is full, dropped %s for %s", c.ChannelName(), u.Email)
+		}
+	}
+	return nil
+}
+
+// suppressed reports whether the notification was already sent within the window, and
+// records it as sent if not.
+func (n *Notifier) suppressed(kind, channel string, to Email, now time.Time) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	// Forget sends outside the window, so the map does not grow without bound
+	for k, at := range n.sent {
+		if now.Sub(at) >= n.opts.SuppressWindow {
+			delete(n.sent, k)
+		}
+	}
+
+	key := kind + "|" + channel + "|" + to.String()
+	if _, ok := n.sent[key]; ok {
+		return true
+	}
+	n.sent[key] = now
+	return false
+}
+
+func (n *Notifier) run() {
+	defer n.wg.Done()
+	for {
+		select {
+		case d := <-n.queue:
+			n.deliver(d)
+		case <-n.stop:
+			return
+		}
+	}
+}
+
+// deliver tries d until it is sent, it runs out of attempts, or the notifier is closed.
+func (n *Notifier) deliver(d notificationDelivery) {
+	backoff := n.opts.Backoff
+	for attempt := 1; ; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		err := d.channel.Send(ctx, d.n)
+		cancel()
+		if err == nil {
+			notificationCounts.Add("sent", 1)
+			return
+		}
+		if attempt >= n.opts.MaxAttempts {
+			notificationCounts.Add("failed", 1)
+			n.onError(fmt.Errorf("Giving up on %s notification by %s for %s after %d attempts: %w", d.n.Kind, d.channel.ChannelName(), d.n.To.Email, attempt, err))
+			return
+		}
+
+		notificationCounts.Add("retried", 1)
+		select {
+		case <-time.After(backoff):
+			backoff *= 2
+		case <-n.stop:
+			notificationCounts.Add("dropped", 1)
+			return
+		}
+	}
+}
+
+// Close stops sending. Notifications still queued or waiting to retry are dropped.
+func (n *Notifier) Close() error {
+	close(n.stop)
+	n.wg.Wait()
+	return nil
+}
+
+// Access Layer
+// EmailSender delivers one email. The HTML of msg may be empty.
+type EmailSender interface {
+	SendEmail(ctx context.Context, to Email, msg *RenderedMessage) error
+}
+
+// EmailChannel sends notifications to the user's email address.
+type EmailChannel struct {
+	sender EmailSender
+}
+
+func NewEmailChannel(sender EmailSender) *EmailChannel {
+	return &EmailChannel{sender: sender}
+}
+
+func (ec *EmailChannel) ChannelName() string {
+	return ChannelEmail
+}
+
+func (ec *EmailChannel) Reaches(u *User) bool {
+	return !u.Email.IsZero()
+}
+
+func (ec *EmailChannel) Send(ctx context.Context, n *Notification) error {
+	return ec.sender.SendEmail(ctx, n.To.Email, n.RenderedMessage)
+}
+
+// SMTPEmailSender sends email through an SMTP server, authenticating when given a username.
+// Messages with HTML are sent as multipart/alternative, with the plain text first.
+type SMTPEmailSender struct {
+	addr string
+	from string
+	auth smtp.Auth
+}
+
+func NewSMTPEmailSender(addr, from, username, password string) *SMTPEmailSender {
+	es := &SMTPEmailSender{
+		addr: addr,
+		from: from,
+	}
+	if username != "" {
+		host, _, _ := net.SplitHostPort(addr)
+		es.auth = smtp.PlainAuth("", username, password, host)
+	}
+	return es
+}
+
+func (es *SMTPEmailSender) SendEmail(ctx context.Context, to Email, msg *RenderedMessage) error {
+	crlf := func(s string) string {
+		return strings.ReplaceAll(strings.ReplaceAll(s, "\r\n", "\n"), "\n", "\r\n")
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", es.from)
+	fmt.Fprintf(&b, "To: %s\r\n", to)
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", strings.NewReplacer("\r", "", "\n", " ").Replace(msg.Subject)))
+	fmt.Fprintf(&b, "MIME-Version: 1.0\r\n")
+	if msg.HTML == "" {
+		fmt.Fprintf(&b, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+		b.WriteString(crlf(msg.Text))
+	} else {
+		mw := multipart.NewWriter(&b)
+		fmt.Fprintf(&b, "Content-Type: multipart/alternative; boundary=%s\r\n\r\n", mw.Boundary())
+		for _, part := range []struct{ contentType, body string }{
+			{"text/plain; charset=utf-8", msg.Text},
+			{"text/html; charset=utf-8", msg.HTML},
+		} {
+			w, err := mw.CreatePart(textproto.MIMEHeader{"Content-Type": {part.contentType}})
+			if err != nil {
+				return err
+			}
+			io.WriteString(w, crlf(part.body))
+		}
+		mw.Close()
+	}
+	return smtp.SendMail(es.addr, es.auth, es.from, []string{to.String()}, b.Bytes())
+}
+
+// WebhookChannel posts every notification as JSON to one URL, for the operator to deliver on.
+type WebhookChannel struct {
+	url    string
+	client *httpclient.Client
+}
+
+func NewWebhookChannel(url string) *WebhookChannel {
+	return &WebhookChannel{
+		url:    url,
+		client: httpclient.New("notifications", httpclient.Options{Timeout: 10 * time.Second}),
+	}
+}
+
+func (wc *WebhookChannel) ChannelName() string {
+	return ChannelWebhook
+}
+
+func (wc *WebhookChannel) Reaches(u *User) bool {
+	return true
+}
+
+func (wc *WebhookChannel) Send(ctx context.Context, n *Notification) error {
+	b, err := json.Marshal(struct {
+		*Notification
+		Email Email `json:"email"`
+	}{n, n.To.Email})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, wc.url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := wc.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("Webhook answered %s", resp.Status)
+	}
+	return nil
+}
+
+// SMSProvider delivers one text message to an E.164 phone number.
+type SMSProvider interface {
+	SendSMS(ctx context.Context, to, body string) error
+}
+
+// SMSChannel texts the body of notifications to users with a verified phone number.
+type SMSChannel struct {
+	provider SMSProvider
+}
+
+func NewSMSChannel(provider SMSProvider) *SMSChannel {
+	return &SMSChannel{
+		provider: provider,
+	}
+}
+
+func (sc *SMSChannel) ChannelName() string {
+	return ChannelSMS
+}
+
+func (sc *SMSChannel) Reaches(u *User) bool {
+	return !u.Phone.IsZero() && u.PhoneVerifiedAt != nil
+}
+
+func (sc *SMSChannel) Send(ctx context.Context, n *Notification) error {
+	return sc.provider.SendSMS(ctx, n.To.Phone.String(), n.Text)
+}
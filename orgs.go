@@ -0,0 +1,808 @@
+package separation
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/oralordos/separation/internal/clock"
+	"github.com/oralordos/separation/internal/principal"
+)
+
+// Action Layer
+var ErrOrgNotFound = registerError(errors.New("Organization not found"), "org_not_found", http.StatusNotFound, "No organization has the requested ID")
+
+// Organization is a group of users, such as a company or a team.
+type Organization struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Membership roles, from most to least privileged.
+// Owners and admins manage members, and only owners manage other owners.
+const (
+	OrgRoleOwner  = "owner"
+	OrgRoleAdmin  = "admin"
+	OrgRoleMember = "member"
+)
+
+var orgRoleRank = map[string]int{
+	OrgRoleOwner:  3,
+	OrgRoleAdmin:  2,
+	OrgRoleMember: 1,
+}
+
+// Membership places a user in an organization with a role.
+type Membership struct {
+	OrgID     string    `json:"org_id"`
+	Email     Email     `json:"email"`
+	Role      string    `json:"role"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type membershipKey struct {
+	orgID string
+	email Email
+}
+
+func keyOfMembership(m *Membership) membershipKey {
+	return membershipKey{orgID: m.OrgID, email: m.Email}
+}
+
+type OrgStorer interface {
+	// Get may return an ErrOrgNotFound error
+	Get(ctx context.Context, id string) (*Organization, error)
+	Save(ctx context.Context, org *Organization) error
+
+	// GetMembership may return an ErrNotFound error if the user is not a member
+	GetMembership(ctx context.Context, orgID string, email Email) (*Membership, error)
+	SaveMembership(ctx context.Context, m *Membership) error
+	// DeleteMembership may return an ErrNotFound error
+	DeleteMembership(ctx context.Context, orgID string, email Email) error
+	// Members returns every membership of an organization in no particular order
+	Members(ctx context.Context, orgID string) ([]*Membership, error)
+	// MembershipsOf returns every membership of a user in no particular order
+	MembershipsOf(ctx context.Context, email Email) ([]*Membership, error)
+}
+
+// RepositoryOrgStorage implements OrgStorer on top of any organization and membership repositories.
+type RepositoryOrgStorage struct {
+	orgs        Repository[string, *Organization]
+	memberships Repository[membershipKey, *Membership]
+}
+
+func NewRepositoryOrgStorage(orgs Repository[string, *Organization], memberships Repository[membershipKey, *Membership]) *RepositoryOrgStorage {
+	return &RepositoryOrgStorage{
+		orgs:        orgs,
+		memberships: memberships,
+	}
+}
+
+func NewMemoryOrgStorage() *RepositoryOrgStorage {
+	return NewRepositoryOrgStorage(
+		NewMemoryRepository(func(o *Organization) string {
+			return o.ID
+		}),
+		NewMemoryRepository(keyOfMembership),
+	)
+}
+
+func (rs *RepositoryOrgStorage) Get(ctx context.Context, id string) (*Organization, error) {
+	o, err := rs.orgs.Get(ctx, id)
+	if err == ErrNotFound {
+		return nil, ErrOrgNotFound
+	}
+	return o, err
+}
+
+func (rs *RepositoryOrgStorage) Save(ctx context.Context, org *Organization) error {
+	return rs.orgs.Save(ctx, org)
+}
+
+func (rs *RepositoryOrgStorage) GetMembership(ctx context.Context, orgID string, email Email) (*Membership, error) {
+	return rs.memberships.Get(ctx, membershipKey{orgID: orgID, email: email})
+}
+
+func (rs *RepositoryOrgStorage) SaveMembership(ctx context.Context, m *Membership) error {
+	return rs.memberships.Save(ctx, m)
+}
+
+func (rs *RepositoryOrgStorage) DeleteMembership(ctx context.Context, orgID string, email Email) error {
+	return rs.memberships.Delete(ctx, membershipKey{orgID: orgID, email: email})
+}
+
+func (rs *RepositoryOrgStorage) filterMemberships(ctx context.Context, keep func(*Membership) bool) ([]*Membership, error) {
+	all, err := rs.memberships.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var matched []*Membership
+	for _, m := range all {
+		if keep(m) {
+			matched = append(matched, m)
+		}
+	}
+	return matched, nil
+}
+
+func (rs *RepositoryOrgStorage) Members(ctx context.Context, orgID string) ([]*Membership, error) {
+	return rs.filterMemberships(ctx, func(m *Membership) bool {
+		return m.OrgID == orgID
+	})
+}
+
+func (rs *RepositoryOrgStorage) MembershipsOf(ctx context.Context, email Email) ([]*Membership, error) {
+	return rs.filterMemberships(ctx, func(m *Membership) bool {
+		return m.Email == email
+	})
+}
+
+// Business Logic
+var (
+	ErrAlreadyMember = registerError(errors.New("User is already a member of the organization"), "already_member", http.StatusConflict, "The user is already a member of the organization")
+	ErrNotMember     = registerError(errors.New("User is not a member of the organization"), "not_member", http.StatusNotFound, "The user is not a member of the organization")
+	ErrLastOwner     = registerError(errors.New("An organization must keep at least one owner"), "last_owner", http.StatusConflict, "The organization's only owner cannot be removed")
+)
+
+func newOrgID() (string, error) {
+	b := make([]byte, 8)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func validateOrgRole(role string) error {
+	if orgRoleRank[role] == 0 {
+		return NewValidationError(fmt.Sprintf("Role must be %s, %s or %s", OrgRoleOwner, OrgRoleAdmin, OrgRoleMember))
+	}
+	return nil
+}
+
+type CreateOrgParams struct {
+	Name string `json:"name"`
+	// Owner becomes the first owner. It defaults to the user creating the organization.
+	Owner Email `json:"owner"`
+
+	// ID is issued by the service before dispatching
+	ID string `json:"-"`
+}
+
+func (cp *CreateOrgParams) CommandName() string {
+	return "CreateOrg"
+}
+
+func (cp *CreateOrgParams) Validate() error {
+	if strings.TrimSpace(cp.Name) == "" {
+		return NewValidationError("Organization name cannot be empty")
+	}
+	return nil
+}
+
+type AddMemberParams struct {
+	OrgID string `json:"-"`
+	Email Email  `json:"email"`
+	Role  string `json:"role"`
+}
+
+func (ap *AddMemberParams) CommandName() string {
+	return "AddOrgMember"
+}
+
+func (ap *AddMemberParams) Validate() error {
+	if ap.Email.IsZero() {
+		return ErrEmailEmpty
+	}
+	if ap.Role == "" {
+		ap.Role = OrgRoleMember
+	}
+	return validateOrgRole(ap.Role)
+}
+
+type RemoveMemberParams struct {
+	OrgID string
+	Email Email
+}
+
+func (rp *RemoveMemberParams) CommandName() string {
+	return "RemoveOrgMember"
+}
+
+func (rp *RemoveMemberParams) Validate() error {
+	if rp.Email.IsZero() {
+		return ErrEmailEmpty
+	}
+	return nil
+}
+
+type GetOrgQuery struct {
+	ID string
+}
+
+func (gq *GetOrgQuery) QueryName() string {
+	return "GetOrg"
+}
+
+type ListOrgMembersQuery struct {
+	OrgID string
+}
+
+func (lq *ListOrgMembersQuery) QueryName() string {
+	return "ListOrgMembers"
+}
+
+// MyOrgsQuery lists the organizations the caller belongs to.
+type MyOrgsQuery struct{}
+
+func (mq *MyOrgsQuery) QueryName() string {
+	return "MyOrgs"
+}
+
+// OrgMember is a member of an organization as listed to the other members.
+type OrgMember struct {
+	Email    Email     `json:"email"`
+	Name     string    `json:"name"`
+	Role     string    `json:"role"`
+	JoinedAt time.Time `json:"joined_at"`
+}
+
+// UserOrg is an organization a user belongs to, with their role in it.
+type UserOrg struct {
+	*Organization
+	Role string `json:"role"`
+}
+
+type OrgService interface {
+	// Create makes an organization with one owner
+	// Create may return a ValidationError, ErrUnauthenticated, ErrForbidden or ErrUserNotFound error
+	Create(context.Context, *CreateOrgParams) (*Organization, error)
+	// Get may return an ErrUnauthenticated, ErrForbidden or ErrOrgNotFound error
+	Get(ctx context.Context, id string) (*Organization, error)
+	// AddMember may return a ValidationError, ErrUnauthenticated, ErrForbidden, ErrOrgNotFound, ErrUserNotFound or ErrAlreadyMember error
+	AddMember(context.Context, *AddMemberParams) error
+	// RemoveMember may return a ValidationError, ErrUnauthenticated, ErrForbidden, ErrOrgNotFound, ErrNotMember or ErrLastOwner error
+	RemoveMember(context.Context, *RemoveMemberParams) error
+	// Members lists the users in an organization
+	// Members may return an ErrUnauthenticated, ErrForbidden or ErrOrgNotFound error
+	Members(ctx context.Context, orgID string) ([]*OrgMember, error)
+	// Mine lists the organizations the caller belongs to
+	// Mine may return an ErrUnauthenticated error
+	Mine(context.Context) ([]*UserOrg, error)
+	// IssueToken gives an organization a scoped API token
+	// IssueToken may return a ValidationError, ErrUnauthenticated, ErrForbidden or ErrOrgNotFound error
+	IssueToken(context.Context, *IssueOrgTokenParams) (*IssuedOrgToken, error)
+	// RevokeToken may return an ErrUnauthenticated, ErrForbidden, ErrOrgNotFound or ErrOrgTokenNotFound error
+	RevokeToken(context.Context, *RevokeOrgTokenParams) error
+	// Tokens may return an ErrUnauthenticated, ErrForbidden or ErrOrgNotFound error
+	Tokens(ctx context.Context, orgID string) ([]*OrgToken, error)
+	// VerifyToken may return an ErrOrgTokenInvalid error
+	VerifyToken(ctx context.Context, token string) (*OrgToken, error)
+}
+
+type OrgHandler struct {
+	orgStorage   OrgStorer
+	tokenStorage OrgTokenStorer
+	userStorage  UserStorer
+	clock        clock.Clock
+}
+
+func NewOrgHandler(orgs OrgStorer, tokens OrgTokenStorer, us UserStorer, clk clock.Clock) *OrgHandler {
+	return &OrgHandler{
+		orgStorage:   orgs,
+		tokenStorage: tokens,
+		userStorage:  us,
+		clock:        clk,
+	}
+}
+
+// callerRole returns the caller's role in the organization, which is empty if they are not a member.
+// Admins act as owners of every organization, and API tokens as admins of their own
+// organization when they may write and as members when they may only read.
+func (oh *OrgHandler) callerRole(ctx context.Context, orgID string) (string, error) {
+	p, ok := principal.FromContext(ctx)
+	if !ok {
+		return "", ErrUnauthenticated
+	}
+
+	_, err := oh.orgStorage.Get(ctx, orgID)
+	if err != nil {
+		return "", err
+	}
+	if p.Admin {
+		return OrgRoleOwner, nil
+	}
+	if p.Org != "" {
+		switch {
+		case p.Org != orgID:
+			return "", nil
+		case p.HasScope(ScopeWriteUsers):
+			return OrgRoleAdmin, nil
+		case p.HasScope(ScopeReadUsers):
+			return OrgRoleMember, nil
+		}
+		return "", nil
+	}
+
+	email, err := ParseEmail(p.Email)
+	if err != nil {
+		return "", nil
+	}
+	m, err := oh.orgStorage.GetMembership(ctx, orgID, email)
+	if err == ErrNotFound {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	return m.Role, nil
+}
+
+// requireRole may return an ErrUnauthenticated, ErrForbidden or ErrOrgNotFound error.
+func (oh *OrgHandler) requireRole(ctx context.Context, orgID, min string) (string, error) {
+	role, err := oh.callerRole(ctx, orgID)
+	if err != nil {
+		return "", err
+	}
+	if orgRoleRank[role] < orgRoleRank[min] {
+		return "", ErrForbidden
+	}
+	return role, nil
+}
+
+func (oh *OrgHandler) Create(ctx context.Context, cmd Command) error {
+	params, ok := cmd.(*CreateOrgParams)
+	if !ok {
+		return fmt.Errorf("OrgHandler cannot create %T", cmd)
+	}
+
+	p, ok := principal.FromContext(ctx)
+	if !ok {
+		return ErrUnauthenticated
+	}
+	if params.Owner.IsZero() {
+		owner, err := ParseEmail(p.Email)
+		if err != nil {
+			return NewValidationError("An owner is required")
+		}
+		params.Owner = owner
+	}
+	err := requireSelfOrAdmin(ctx, params.Owner)
+	if err != nil {
+		return err
+	}
+
+	_, err = oh.userStorage.Get(ctx, params.Owner)
+	if err != nil {
+		return err
+	}
+
+	now := oh.clock.Now().UTC()
+	err = oh.orgStorage.Save(ctx, &Organization{
+		ID:        params.ID,
+		Name:      strings.TrimSpace(params.Name),
+		CreatedAt: now,
+	})
+	if err != nil {
+		return err
+	}
+	return oh.orgStorage.SaveMembership(ctx, &Membership{
+		OrgID:     params.ID,
+		Email:     params.Owner,
+		Role:      OrgRoleOwner,
+		CreatedAt: now,
+	})
+}
+
+func (oh *OrgHandler) Get(ctx context.Context, q Query) (interface{}, error) {
+	query, ok := q.(*GetOrgQuery)
+	if !ok {
+		return nil, fmt.Errorf("OrgHandler cannot get %T", q)
+	}
+
+	_, err := oh.requireRole(ctx, query.ID, OrgRoleMember)
+	if err != nil {
+		return nil, err
+	}
+	return oh.orgStorage.Get(ctx, query.ID)
+}
+
+// AddMember adds a registered user to an organization. Only owners may add owners.
+func (oh *OrgHandler) AddMember(ctx context.Context, cmd Command) error {
+	params, ok := cmd.(*AddMemberParams)
+	if !ok {
+		return fmt.Errorf("OrgHandler cannot add %T", cmd)
+	}
+
+	min := OrgRoleAdmin
+	if params.Role == OrgRoleOwner {
+		min = OrgRoleOwner
+	}
+	_, err := oh.requireRole(ctx, params.OrgID, min)
+	if err != nil {
+		return err
+	}
+
+	_, err = oh.userStorage.Get(ctx, params.Email)
+	if err != nil {
+		return err
+	}
+
+	_, err = oh.orgStorage.GetMembership(ctx, params.OrgID, params.Email)
+	if err == nil {
+		return ErrAlreadyMember
+	} else if err != ErrNotFound {
+		return err
+	}
+
+	return oh.orgStorage.SaveMembership(ctx, &Membership{
+		OrgID:     params.OrgID,
+		Email:     params.Email,
+		Role:      params.Role,
+		CreatedAt: oh.clock.Now().UTC(),
+	})
+}
+
+// RemoveMember removes a user from an organization. Members may always leave,
+// admins may remove members and admins, and only owners may remove owners.
+func (oh *OrgHandler) RemoveMember(ctx context.Context, cmd Command) error {
+	params, ok := cmd.(*RemoveMemberParams)
+	if !ok {
+		return fmt.Errorf("OrgHandler cannot remove %T", cmd)
+	}
+
+	role, err := oh.callerRole(ctx, params.OrgID)
+	if err != nil {
+		return err
+	}
+
+	m, err := oh.orgStorage.GetMembership(ctx, params.OrgID, params.Email)
+	if err == ErrNotFound {
+		return ErrNotMember
+	} else if err != nil {
+		return err
+	}
+
+	leaving := requireSelfOrAdmin(ctx, params.Email) == nil
+	if !leaving && (orgRoleRank[role] < orgRoleRank[OrgRoleAdmin] || orgRoleRank[role] < orgRoleRank[m.Role]) {
+		return ErrForbidden
+	}
+
+	if m.Role == OrgRoleOwner {
+		members, err := oh.orgStorage.Members(ctx, params.OrgID)
+		if err != nil {
+			return err
+		}
+		owners := 0
+		for _, other := range members {
+			if other.Role == OrgRoleOwner {
+				owners++
+			}
+		}
+		if owners <= 1 {
+			return ErrLastOwner
+		}
+	}
+
+	return oh.orgStorage.DeleteMembership(ctx, params.OrgID, params.Email)
+}
+
+// Members lists an organization's members, owners first and then by email.
+// Members whose user has since been deleted are left out.
+func (oh *OrgHandler) Members(ctx context.Context, q Query) (interface{}, error) {
+	query, ok := q.(*ListOrgMembersQuery)
+	if !ok {
+		return nil, fmt.Errorf("OrgHandler cannot list %T", q)
+	}
+
+	_, err := oh.requireRole(ctx, query.OrgID, OrgRoleMember)
+	if err != nil {
+		return nil, err
+	}
+
+	memberships, err := oh.orgStorage.Members(ctx, query.OrgID)
+	if err != nil {
+		return nil, err
+	}
+
+	members := make([]*OrgMember, 0, len(memberships))
+	for _, m := range memberships {
+		u, err := oh.userStorage.Get(ctx, m.Email)
+		if err == ErrUserNotFound {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		members = append(members, &OrgMember{
+			Email:    m.Email,
+			Name:     u.Name,
+			Role:     m.Role,
+			JoinedAt: m.CreatedAt,
+		})
+	}
+
+	sort.Slice(members, func(i, j int) bool {
+		ri, rj := orgRoleRank[members[i].Role], orgRoleRank[members[j].Role]
+		if ri != rj {
+			return ri > rj
+		}
+		return members[i].Email.String() < members[j].Email.String()
+	})
+	return members, nil
+}
+
+func (oh *OrgHandler) Mine(ctx context.Context, q Query) (interface{}, error) {
+	p, ok := principal.FromContext(ctx)
+	if !ok || p.Email == "" {
+		return nil, ErrUnauthenticated
+	}
+	email, err := ParseEmail(p.Email)
+	if err != nil {
+		return nil, ErrUnauthenticated
+	}
+
+	memberships, err := oh.orgStorage.MembershipsOf(ctx, email)
+	if err != nil {
+		return nil, err
+	}
+
+	orgs := make([]*UserOrg, 0, len(memberships))
+	for _, m := range memberships {
+		o, err := oh.orgStorage.Get(ctx, m.OrgID)
+		if err == ErrOrgNotFound {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		orgs = append(orgs, &UserOrg{Organization: o, Role: m.Role})
+	}
+
+	sort.Slice(orgs, func(i, j int) bool {
+		return orgs[i].Name < orgs[j].Name
+	})
+	return orgs, nil
+}
+
+// NewOrgDispatcher registers the organization handlers, with validation applied to every command.
+func NewOrgDispatcher(orgs OrgStorer, tokens OrgTokenStorer, us UserStorer, clk clock.Clock) *Dispatcher {
+	d := NewDispatcher()
+	d.UseCommand(ValidateCommands)
+
+	scopes := NewScopeChecker(map[string]string{
+		(&GetOrgQuery{}).QueryName():          ScopeReadUsers,
+		(&ListOrgMembersQuery{}).QueryName():  ScopeReadUsers,
+		(&AddMemberParams{}).CommandName():    ScopeWriteUsers,
+		(&RemoveMemberParams{}).CommandName(): ScopeWriteUsers,
+	})
+	d.UseCommand(scopes.Commands)
+	d.UseQuery(scopes.Queries)
+
+	h := NewOrgHandler(orgs, tokens, us, clk)
+	d.HandleCommand((&CreateOrgParams{}).CommandName(), CommandHandlerFunc(h.Create))
+	d.HandleCommand((&AddMemberParams{}).CommandName(), CommandHandlerFunc(h.AddMember))
+	d.HandleCommand((&RemoveMemberParams{}).CommandName(), CommandHandlerFunc(h.RemoveMember))
+	d.HandleQuery((&GetOrgQuery{}).QueryName(), QueryHandlerFunc(h.Get))
+	d.HandleQuery((&ListOrgMembersQuery{}).QueryName(), QueryHandlerFunc(h.Members))
+	d.HandleQuery((&MyOrgsQuery{}).QueryName(), QueryHandlerFunc(h.Mine))
+	d.HandleCommand((&IssueOrgTokenParams{}).CommandName(), CommandHandlerFunc(h.IssueToken))
+	d.HandleCommand((&RevokeOrgTokenParams{}).CommandName(), CommandHandlerFunc(h.RevokeToken))
+	d.HandleQuery((&ListOrgTokensQuery{}).QueryName(), QueryHandlerFunc(h.ListTokens))
+	d.HandleQuery((&VerifyOrgTokenQuery{}).QueryName(), QueryHandlerFunc(h.VerifyToken))
+	return d
+}
+
+// OrgServiceImpl implements OrgService by dispatching to the organization handlers.
+type OrgServiceImpl struct {
+	dispatcher *Dispatcher
+}
+
+func NewOrgServiceImpl(d *Dispatcher) *OrgServiceImpl {
+	return &OrgServiceImpl{
+		dispatcher: d,
+	}
+}
+
+// Create issues the organization's ID itself, so it can return the new organization.
+func (oi *OrgServiceImpl) Create(ctx context.Context, params *CreateOrgParams) (*Organization, error) {
+	var err error
+	params.ID, err = newOrgID()
+	if err != nil {
+		return nil, err
+	}
+
+	err = oi.dispatcher.Dispatch(ctx, params)
+	if err != nil {
+		return nil, err
+	}
+	return oi.Get(ctx, params.ID)
+}
+
+func (oi *OrgServiceImpl) Get(ctx context.Context, id string) (*Organization, error) {
+	res, err := oi.dispatcher.Ask(ctx, &GetOrgQuery{ID: id})
+	if err != nil {
+		return nil, err
+	}
+	return res.(*Organization), nil
+}
+
+func (oi *OrgServiceImpl) AddMember(ctx context.Context, params *AddMemberParams) error {
+	return oi.dispatcher.Dispatch(ctx, params)
+}
+
+func (oi *OrgServiceImpl) RemoveMember(ctx context.Context, params *RemoveMemberParams) error {
+	return oi.dispatcher.Dispatch(ctx, params)
+}
+
+func (oi *OrgServiceImpl) Members(ctx context.Context, orgID string) ([]*OrgMember, error) {
+	res, err := oi.dispatcher.Ask(ctx, &ListOrgMembersQuery{OrgID: orgID})
+	if err != nil {
+		return nil, err
+	}
+	return res.([]*OrgMember), nil
+}
+
+func (oi *OrgServiceImpl) Mine(ctx context.Context) ([]*UserOrg, error) {
+	res, err := oi.dispatcher.Ask(ctx, &MyOrgsQuery{})
+	if err != nil {
+		return nil, err
+	}
+	return res.([]*UserOrg), nil
+}
+
+// IssueToken issues the token's ID and value itself, so it can hand the value back.
+func (oi *OrgServiceImpl) IssueToken(ctx context.Context, params *IssueOrgTokenParams) (*IssuedOrgToken, error) {
+	var err error
+	params.ID, params.Token, err = newOrgToken()
+	if err != nil {
+		return nil, err
+	}
+
+	err = oi.dispatcher.Dispatch(ctx, params)
+	if err != nil {
+		return nil, err
+	}
+
+	tokens, err := oi.Tokens(ctx, params.OrgID)
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range tokens {
+		if t.ID == params.ID {
+			return &IssuedOrgToken{OrgToken: t, Token: params.Token}, nil
+		}
+	}
+	return nil, ErrOrgTokenNotFound
+}
+
+func (oi *OrgServiceImpl) RevokeToken(ctx context.Context, params *RevokeOrgTokenParams) error {
+	return oi.dispatcher.Dispatch(ctx, params)
+}
+
+func (oi *OrgServiceImpl) Tokens(ctx context.Context, orgID string) ([]*OrgToken, error) {
+	res, err := oi.dispatcher.Ask(ctx, &ListOrgTokensQuery{OrgID: orgID})
+	if err != nil {
+		return nil, err
+	}
+	return res.([]*OrgToken), nil
+}
+
+func (oi *OrgServiceImpl) VerifyToken(ctx context.Context, token string) (*OrgToken, error) {
+	res, err := oi.dispatcher.Ask(ctx, &VerifyOrgTokenQuery{Token: token})
+	if err != nil {
+		return nil, err
+	}
+	return res.(*OrgToken), nil
+}
+
+// Access Layer
+// CreateOrg serves POST /orgs with a body of {"name": "..."}, making the caller its owner.
+func (j *JsonOverHTTP) CreateOrg(w http.ResponseWriter, r *http.Request) {
+	params := &CreateOrgParams{}
+	err := json.NewDecoder(r.Body).Decode(params)
+	if err != nil {
+		writeError(w, r, decodeError(err))
+		return
+	}
+
+	org, err := j.orgServ.Create(r.Context(), params)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/orgs/"+org.ID)
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(org)
+}
+
+// Org serves GET /orgs/{id}, and GET, POST and DELETE /orgs/{id}/members and /orgs/{id}/tokens.
+// Members are added with a body of {"email": "...", "role": "..."} and removed with ?email=...
+func (j *JsonOverHTTP) Org(w http.ResponseWriter, r *http.Request) {
+	id, sub, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/orgs/"), "/")
+	switch {
+	case id == "":
+		writeError(w, r, ErrOrgNotFound)
+	case sub == "" && r.Method == http.MethodGet:
+		org, err := j.orgServ.Get(r.Context(), id)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(org)
+	case sub == "":
+		writeError(w, r, NewMethodError("Org requires a get request"))
+	case sub == "members":
+		j.orgMembers(w, r, id)
+	case sub == "tokens":
+		j.orgTokens(w, r, id)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (j *JsonOverHTTP) orgMembers(w http.ResponseWriter, r *http.Request, orgID string) {
+	var err error
+	switch r.Method {
+	case http.MethodGet:
+		members, err := j.orgServ.Members(r.Context(), orgID)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(members)
+		return
+	case http.MethodPost:
+		params := &AddMemberParams{}
+		err = json.NewDecoder(r.Body).Decode(params)
+		if err != nil {
+			writeError(w, r, decodeError(err))
+			return
+		}
+		params.OrgID = orgID
+		err = j.orgServ.AddMember(r.Context(), params)
+	case http.MethodDelete:
+		params := &RemoveMemberParams{OrgID: orgID}
+		params.Email, err = ParseEmail(r.FormValue("email"))
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		err = j.orgServ.RemoveMember(r.Context(), params)
+	default:
+		writeError(w, r, NewMethodError("OrgMembers requires a get, post or delete request"))
+		return
+	}
+
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// MyOrgs serves GET /me/orgs with the organizations the caller belongs to.
+func (j *JsonOverHTTP) MyOrgs(w http.ResponseWriter, r *http.Request) {
+	orgs, err := j.orgServ.Mine(r.Context())
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(orgs)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+}
@@ -0,0 +1,494 @@
+package separation
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/oralordos/separation/internal/principal"
+)
+
+// Action Layer
+var ErrOrgTokenNotFound = registerError(errors.New("API token not found"), "org_token_not_found", http.StatusNotFound, "The organization has no API token with the requested ID")
+
+// OrgToken lets a program act for an organization, limited to its scopes.
+// Only a hash of its secret is kept.
+type OrgToken struct {
+	ID         string     `json:"id"`
+	OrgID      string     `json:"org_id"`
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	SecretHash string     `json:"-"`
+	CreatedAt  time.Time  `json:"created_at"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+}
+
+type OrgTokenStorer interface {
+	// Get may return an ErrOrgTokenNotFound error
+	Get(ctx context.Context, id string) (*OrgToken, error)
+	Save(ctx context.Context, token *OrgToken) error
+	// ListOrg returns every token of an organization in no particular order
+	ListOrg(ctx context.Context, orgID string) ([]*OrgToken, error)
+}
+
+// RepositoryOrgTokenStorage implements OrgTokenStorer on top of any token repository.
+type RepositoryOrgTokenStorage struct {
+	repo Repository[string, *OrgToken]
+}
+
+func NewRepositoryOrgTokenStorage(repo Repository[string, *OrgToken]) *RepositoryOrgTokenStorage {
+	return &RepositoryOrgTokenStorage{
+		repo: repo,
+	}
+}
+
+func NewMemoryOrgTokenStorage() *RepositoryOrgTokenStorage {
+	return NewRepositoryOrgTokenStorage(NewMemoryRepository(func(t *OrgToken) string {
+		return t.ID
+	}))
+}
+
+func (rs *RepositoryOrgTokenStorage) Get(ctx context.Context, id string) (*OrgToken, error) {
+	t, err := rs.repo.Get(ctx, id)
+	if err == ErrNotFound {
+		return nil, ErrOrgTokenNotFound
+	}
+	return t, err
+}
+
+func (rs *RepositoryOrgTokenStorage) Save(ctx context.Context, token *OrgToken) error {
+	return rs.repo.Save(ctx, token)
+}
+
+func (rs *RepositoryOrgTokenStorage) ListOrg(ctx context.Context, orgID string) ([]*OrgToken, error) {
+	all, err := rs.repo.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var tokens []*OrgToken
+	for _, t := range all {
+		if t.OrgID == orgID {
+			tokens = append(tokens, t)
+		}
+	}
+	return tokens, nil
+}
+
+// Business Logic
+// Scopes an organization API token may hold.
+const (
+	ScopeReadUsers  = "read:users"
+	ScopeWriteUsers = "write:users"
+)
+
+var knownScopes = map[string]bool{
+	ScopeReadUsers:  true,
+	ScopeWriteUsers: true,
+}
+
+var (
+	ErrInsufficientScope = registerError(errors.New("The API token does not have the scope required"), "insufficient_scope", http.StatusForbidden, "The API token does not hold the scope the operation requires")
+	ErrOrgTokenInvalid   = registerError(errors.New("API token is invalid or revoked"), "org_token_invalid", http.StatusUnauthorized, "The API token is unknown, revoked or expired")
+)
+
+// orgTokenPrefix marks the tokens, so they are easy to spot in leaked logs or code.
+const orgTokenPrefix = "sep_"
+
+// newOrgToken returns a random token ID and the full token, which embeds the ID
+// so a token can be looked up without scanning.
+func newOrgToken() (id, token string, err error) {
+	b := make([]byte, 40)
+	_, err = rand.Read(b)
+	if err != nil {
+		return "", "", err
+	}
+	id = hex.EncodeToString(b[:8])
+	return id, orgTokenPrefix + id + "_" + base64.RawURLEncoding.EncodeToString(b[8:]), nil
+}
+
+// splitOrgToken returns the ID and secret of a token, and false if it is not an organization token.
+func splitOrgToken(token string) (id, secret string, ok bool) {
+	if !strings.HasPrefix(token, orgTokenPrefix) {
+		return "", "", false
+	}
+	return strings.Cut(strings.TrimPrefix(token, orgTokenPrefix), "_")
+}
+
+func hashOrgTokenSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// IssuedOrgToken is a token along with its value, which is only available when it is issued.
+type IssuedOrgToken struct {
+	*OrgToken
+	Token string `json:"token"`
+}
+
+type IssueOrgTokenParams struct {
+	OrgID  string   `json:"-"`
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+
+	// ID and Token are issued by the service before dispatching
+	ID    string `json:"-"`
+	Token string `json:"-"`
+}
+
+func (ip *IssueOrgTokenParams) CommandName() string {
+	return "IssueOrgToken"
+}
+
+func (ip *IssueOrgTokenParams) Validate() error {
+	if strings.TrimSpace(ip.Name) == "" {
+		return NewValidationError("API token name cannot be empty")
+	}
+	if len(ip.Scopes) == 0 {
+		return NewValidationError("An API token needs at least one scope")
+	}
+	for _, s := range ip.Scopes {
+		if !knownScopes[s] {
+			return NewValidationError(fmt.Sprintf("Unknown scope %q, use %s or %s", s, ScopeReadUsers, ScopeWriteUsers))
+		}
+	}
+	return nil
+}
+
+type RevokeOrgTokenParams struct {
+	OrgID string
+	ID    string
+}
+
+func (rp *RevokeOrgTokenParams) CommandName() string {
+	return "RevokeOrgToken"
+}
+
+type ListOrgTokensQuery struct {
+	OrgID string
+}
+
+func (lq *ListOrgTokensQuery) QueryName() string {
+	return "ListOrgTokens"
+}
+
+// VerifyOrgTokenQuery is asked by the access layer before any caller is known.
+type VerifyOrgTokenQuery struct {
+	Token string
+}
+
+func (vq *VerifyOrgTokenQuery) QueryName() string {
+	return "VerifyOrgToken"
+}
+
+// IssueToken gives an organization a new API token. Organization admins and owners may issue them.
+func (oh *OrgHandler) IssueToken(ctx context.Context, cmd Command) error {
+	params, ok := cmd.(*IssueOrgTokenParams)
+	if !ok {
+		return fmt.Errorf("OrgHandler cannot issue %T", cmd)
+	}
+
+	_, err := oh.requireRole(ctx, params.OrgID, OrgRoleAdmin)
+	if err != nil {
+		return err
+	}
+
+	_, secret, _ := splitOrgToken(params.Token)
+	scopes := append([]string(nil), params.Scopes...)
+	sort.Strings(scopes)
+	return oh.tokenStorage.Save(ctx, &OrgToken{
+		ID:         params.ID,
+		OrgID:      params.OrgID,
+		Name:       strings.TrimSpace(params.Name),
+		Scopes:     scopes,
+		SecretHash: hashOrgTokenSecret(secret),
+		CreatedAt:  oh.clock.Now().UTC(),
+	})
+}
+
+func (oh *OrgHandler) RevokeToken(ctx context.Context, cmd Command) error {
+	params, ok := cmd.(*RevokeOrgTokenParams)
+	if !ok {
+		return fmt.Errorf("OrgHandler cannot revoke %T", cmd)
+	}
+
+	_, err := oh.requireRole(ctx, params.OrgID, OrgRoleAdmin)
+	if err != nil {
+		return err
+	}
+
+	t, err := oh.tokenStorage.Get(ctx, params.ID)
+	if err != nil {
+		return err
+	}
+	if t.OrgID != params.OrgID {
+		return ErrOrgTokenNotFound
+	}
+	if t.RevokedAt != nil {
+		return nil
+	}
+
+	now := oh.clock.Now().UTC()
+	updated := *t
+	updated.RevokedAt = &now
+	return oh.tokenStorage.Save(ctx, &updated)
+}
+
+func (oh *OrgHandler) ListTokens(ctx context.Context, q Query) (interface{}, error) {
+	query, ok := q.(*ListOrgTokensQuery)
+	if !ok {
+		return nil, fmt.Errorf("OrgHandler cannot list %T", q)
+	}
+
+	_, err := oh.requireRole(ctx, query.OrgID, OrgRoleAdmin)
+	if err != nil {
+		return nil, err
+	}
+
+	tokens, err := oh.tokenStorage.ListOrg(ctx, query.OrgID)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].CreatedAt.Before(tokens[j].CreatedAt)
+	})
+	return tokens, nil
+}
+
+// VerifyToken returns the token if it is current. It may return an ErrOrgTokenInvalid error.
+func (oh *OrgHandler) VerifyToken(ctx context.Context, q Query) (interface{}, error) {
+	query, ok := q.(*VerifyOrgTokenQuery)
+	if !ok {
+		return nil, fmt.Errorf("OrgHandler cannot verify %T", q)
+	}
+
+	id, secret, ok := splitOrgToken(query.Token)
+	if !ok {
+		return nil, ErrOrgTokenInvalid
+	}
+
+	t, err := oh.tokenStorage.Get(ctx, id)
+	if err == ErrOrgTokenNotFound {
+		return nil, ErrOrgTokenInvalid
+	} else if err != nil {
+		return nil, err
+	}
+
+	hash := hashOrgTokenSecret(secret)
+	if subtle.ConstantTimeCompare([]byte(hash), []byte(t.SecretHash)) != 1 || t.RevokedAt != nil {
+		return nil, ErrOrgTokenInvalid
+	}
+
+	// A token outliving its organization is no use to anyone
+	_, err = oh.orgStorage.Get(ctx, t.OrgID)
+	if err == ErrOrgNotFound {
+		return nil, ErrOrgTokenInvalid
+	} else if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// ScopeChecker is the authorization decorator for scoped callers, such as organization
+// API tokens. A scoped caller may only use the commands and queries mapped to a scope
+// it holds, and nothing else. Callers without scopes are left to the handlers.
+type ScopeChecker struct {
+	required map[string]string
+}
+
+// NewScopeChecker takes the scope required by each command and query name that scoped callers may use.
+func NewScopeChecker(required map[string]string) *ScopeChecker {
+	return &ScopeChecker{required: required}
+}
+
+func (sc *ScopeChecker) check(ctx context.Context, name string) error {
+	p, ok := principal.FromContext(ctx)
+	if !ok || p.Scopes == nil {
+		return nil
+	}
+
+	scope, ok := sc.required[name]
+	if !ok || !p.HasScope(scope) {
+		return ErrInsufficientScope
+	}
+	return nil
+}
+
+func (sc *ScopeChecker) Commands(next CommandHandler) CommandHandler {
+	return CommandHandlerFunc(func(ctx context.Context, cmd Command) error {
+		err := sc.check(ctx, cmd.CommandName())
+		if err != nil {
+			return err
+		}
+		return next.Handle(ctx, cmd)
+	})
+}
+
+func (sc *ScopeChecker) Queries(next QueryHandler) QueryHandler {
+	return QueryHandlerFunc(func(ctx context.Context, q Query) (interface{}, error) {
+		err := sc.check(ctx, q.QueryName())
+		if err != nil {
+			return nil, err
+		}
+		return next.Handle(ctx, q)
+	})
+}
+
+// OrgTenancy keeps callers acting for an organization to its own members. The user
+// queries a scope allows are answered as if users outside the organization did not
+// exist, so one organization's token cannot read another's users.
+type OrgTenancy struct {
+	orgs OrgStorer
+}
+
+func NewOrgTenancy(orgs OrgStorer) *OrgTenancy {
+	return &OrgTenancy{orgs: orgs}
+}
+
+func (ot *OrgTenancy) isMember(ctx context.Context, orgID string, email Email) (bool, error) {
+	_, err := ot.orgs.GetMembership(ctx, orgID, email)
+	if err == ErrNotFound {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// avatarOfMember reports whether the avatar called id belongs to a member of the organization.
+func (ot *OrgTenancy) avatarOfMember(ctx context.Context, us UserStorer, orgID, id string) (bool, error) {
+	members, err := ot.orgs.Members(ctx, orgID)
+	if err != nil {
+		return false, err
+	}
+	for _, m := range members {
+		u, err := us.Get(ctx, m.Email)
+		if err == ErrUserNotFound {
+			continue
+		} else if err != nil {
+			return false, err
+		}
+		if u.AvatarID == id {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Queries checks the results of user queries, since a query by username or avatar
+// only names its user once it has been answered.
+func (ot *OrgTenancy) Queries(us UserStorer) QueryMiddleware {
+	return func(next QueryHandler) QueryHandler {
+		return QueryHandlerFunc(func(ctx context.Context, q Query) (interface{}, error) {
+			p, ok := principal.FromContext(ctx)
+			if !ok || p.Org == "" || p.Admin {
+				return next.Handle(ctx, q)
+			}
+
+			res, err := next.Handle(ctx, q)
+			if err != nil {
+				return nil, err
+			}
+			switch res := res.(type) {
+			case *User:
+				member, err := ot.isMember(ctx, p.Org, res.Email)
+				if err != nil {
+					return nil, err
+				}
+				if !member {
+					return nil, ErrUserNotFound
+				}
+			case *Avatar:
+				query, _ := q.(*GetAvatarQuery)
+				if query == nil {
+					return nil, ErrBlobNotFound
+				}
+				member, err := ot.avatarOfMember(ctx, us, p.Org, query.ID)
+				if err != nil {
+					return nil, err
+				}
+				if !member {
+					return nil, ErrBlobNotFound
+				}
+			}
+			return res, nil
+		})
+	}
+}
+
+// Access Layer
+// OrgTokenAuthenticator recognizes organization API tokens sent as bearer tokens.
+type OrgTokenAuthenticator struct {
+	orgs OrgService
+}
+
+func NewOrgTokenAuthenticator(orgs OrgService) *OrgTokenAuthenticator {
+	return &OrgTokenAuthenticator{orgs: orgs}
+}
+
+func (oa *OrgTokenAuthenticator) Authenticate(r *http.Request) (*principal.Principal, error) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !strings.HasPrefix(token, orgTokenPrefix) {
+		return nil, nil
+	}
+
+	t, err := oa.orgs.VerifyToken(r.Context(), token)
+	if err != nil {
+		return nil, err
+	}
+	return &principal.Principal{
+		Subject: "token:" + t.ID,
+		Scheme:  "org-token",
+		Org:     t.OrgID,
+		Scopes:  t.Scopes,
+	}, nil
+}
+
+// orgTokens serves GET, POST and DELETE /orgs/{id}/tokens.
+// Tokens are issued with a body of {"name": "...", "scopes": ["read:users"]} and revoked with ?id=...
+func (j *JsonOverHTTP) orgTokens(w http.ResponseWriter, r *http.Request, orgID string) {
+	switch r.Method {
+	case http.MethodGet:
+		tokens, err := j.orgServ.Tokens(r.Context(), orgID)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(tokens)
+	case http.MethodPost:
+		params := &IssueOrgTokenParams{}
+		err := json.NewDecoder(r.Body).Decode(params)
+		if err != nil {
+			writeError(w, r, decodeError(err))
+			return
+		}
+		params.OrgID = orgID
+
+		issued, err := j.orgServ.IssueToken(r.Context(), params)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		_ = json.NewEncoder(w).Encode(issued)
+	case http.MethodDelete:
+		err := j.orgServ.RevokeToken(r.Context(), &RevokeOrgTokenParams{OrgID: orgID, ID: r.FormValue("id")})
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, r, NewMethodError("OrgTokens requires a get, post or delete request"))
+	}
+}
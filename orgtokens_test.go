@@ -0,0 +1,50 @@
+package separation
+
+import (
+	"context"
+	"testing"
+
+	"github.com/oralordos/separation/internal/principal"
+)
+
+func TestOrgTenancyHidesOtherOrganizationsUsers(t *testing.T) {
+	ctx := context.Background()
+	us := NewMemoryUserStorage()
+	orgs := NewMemoryOrgStorage()
+
+	member, _ := ParseEmail("member@example.com")
+	outsider, _ := ParseEmail("outsider@example.com")
+	for _, email := range []Email{member, outsider} {
+		err := us.Save(ctx, &User{Email: email})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := orgs.SaveMembership(ctx, &Membership{OrgID: "acme", Email: member, Role: OrgRoleMember})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := NewDispatcher()
+	d.UseQuery(NewOrgTenancy(orgs).Queries(us))
+	d.HandleQuery((&GetUserQuery{}).QueryName(), NewGetUserQueryHandler(us))
+
+	tokenCtx := principal.NewContext(ctx, &principal.Principal{
+		Subject: "token:1",
+		Org:     "acme",
+		Scopes:  []string{ScopeReadUsers},
+	})
+	_, err = d.Ask(tokenCtx, &GetUserQuery{Email: member})
+	if err != nil {
+		t.Errorf("Reading a member: %v", err)
+	}
+	_, err = d.Ask(tokenCtx, &GetUserQuery{Email: outsider})
+	if err != ErrUserNotFound {
+		t.Errorf("Reading a user outside the organization returned %v, want %v", err, ErrUserNotFound)
+	}
+
+	_, err = d.Ask(ctx, &GetUserQuery{Email: outsider})
+	if err != nil {
+		t.Errorf("Reading without an organization: %v", err)
+	}
+}
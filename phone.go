@@ -0,0 +1,503 @@
+package separation
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oralordos/separation/internal/clock"
+	"github.com/oralordos/separation/internal/httpclient"
+	"github.com/oralordos/separation/internal/principal"
+)
+
+var ErrPhoneInvalid = registerError(NewValidationError("Phone number must be in E.164 format, a + and up to 15 digits such as +14155550123"), "phone_invalid", http.StatusBadRequest, "The phone number is not in E.164 format, a + and up to 15 digits")
+
+// Phone is a validated phone number in E.164 format.
+// The only way to build a non-zero Phone is ParsePhone.
+type Phone struct {
+	number string
+}
+
+// ParsePhone validates s as an E.164 number, ignoring the spaces, dashes, dots and
+// parentheses people write numbers with. It may return an ErrPhoneInvalid error.
+func ParsePhone(s string) (Phone, error) {
+	s = strings.NewReplacer(" ", "", "-", "", ".", "", "(", "", ")", "").Replace(strings.TrimSpace(s))
+	if len(s) < 3 || len(s) > 16 || s[0] != '+' || s[1] == '0' {
+		return Phone{}, ErrPhoneInvalid
+	}
+	for _, c := range s[1:] {
+		if c < '0' || c > '9' {
+			return Phone{}, ErrPhoneInvalid
+		}
+	}
+	return Phone{number: s}, nil
+}
+
+func (p Phone) String() string {
+	return p.number
+}
+
+func (p Phone) IsZero() bool {
+	return p.number == ""
+}
+
+// MarshalJSON writes the zero Phone, a user without a phone number, as null.
+func (p Phone) MarshalJSON() ([]byte, error) {
+	if p.IsZero() {
+		return []byte("null"), nil
+	}
+	return json.Marshal(p.number)
+}
+
+func (p *Phone) UnmarshalJSON(b []byte) error {
+	var s *string
+	err := json.Unmarshal(b, &s)
+	if err != nil {
+		return err
+	}
+
+	if s == nil || *s == "" {
+		*p = Phone{}
+		return nil
+	}
+
+	parsed, err := ParsePhone(*s)
+	if err != nil {
+		return err
+	}
+	*p = parsed
+	return nil
+}
+
+// Action Layer
+var ErrPhoneCodeNotFound = registerError(errors.New("Phone verification code not found"), "phone_code_not_found", http.StatusNotFound, "No verification code is waiting for the phone number")
+
+// PhoneCode is a one-time code texted to a user to prove they hold Phone.
+// A user has at most one code pending, the last one sent.
+type PhoneCode struct {
+	Email Email `json:"email"`
+	Phone Phone `json:"phone"`
+	// CodeHash is the SHA-256 of the code, so stored codes cannot be read back
+	CodeHash string `json:"code_hash"`
+	// Attempts counts the wrong codes given for it
+	Attempts  int       `json:"attempts"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type PhoneCodeStorer interface {
+	// Get may return an ErrPhoneCodeNotFound error
+	Get(ctx context.Context, email Email) (*PhoneCode, error)
+	Save(ctx context.Context, code *PhoneCode) error
+	// Delete may return an ErrPhoneCodeNotFound error
+	Delete(ctx context.Context, email Email) error
+}
+
+// RepositoryPhoneCodeStorage implements PhoneCodeStorer on top of any phone code repository.
+type RepositoryPhoneCodeStorage struct {
+	repo Repository[Email, *PhoneCode]
+}
+
+func NewRepositoryPhoneCodeStorage(repo Repository[Email, *PhoneCode]) *RepositoryPhoneCodeStorage {
+	return &RepositoryPhoneCodeStorage{
+		repo: repo,
+	}
+}
+
+func NewMemoryPhoneCodeStorage() *RepositoryPhoneCodeStorage {
+	return NewRepositoryPhoneCodeStorage(NewMemoryRepository(func(c *PhoneCode) Email {
+		return c.Email
+	}))
+}
+
+func (rs *RepositoryPhoneCodeStorage) Get(ctx context.Context, email Email) (*PhoneCode, error) {
+	c, err := rs.repo.Get(ctx, email)
+	if err == ErrNotFound {
+		return nil, ErrPhoneCodeNotFound
+	}
+	return c, err
+}
+
+func (rs *RepositoryPhoneCodeStorage) Save(ctx context.Context, code *PhoneCode) error {
+	return rs.repo.Save(ctx, code)
+}
+
+func (rs *RepositoryPhoneCodeStorage) Delete(ctx context.Context, email Email) error {
+	err := rs.repo.Delete(ctx, email)
+	if err == ErrNotFound {
+		return ErrPhoneCodeNotFound
+	}
+	return err
+}
+
+// Business Logic
+var (
+	ErrPhoneCodeInvalid = registerError(errors.New("Phone verification code is wrong, used or expired"), "phone_code_invalid", http.StatusBadRequest, "The phone verification code is wrong, was already used or has expired")
+	ErrPhoneCodeLimited = registerError(errors.New("Too many verification codes were sent to the phone number, try again later"), "phone_code_limited", http.StatusTooManyRequests, "Too many verification codes were sent to the phone number recently")
+)
+
+type SendPhoneCodeParams struct {
+	Email Email `json:"-"`
+	// Phone is the number to verify. It defaults to the user's current number, and replaces it once verified.
+	Phone Phone `json:"phone"`
+}
+
+func (sp *SendPhoneCodeParams) CommandName() string {
+	return "SendPhoneCode"
+}
+
+func (sp *SendPhoneCodeParams) Validate() error {
+	if sp.Email.IsZero() {
+		return ErrEmailEmpty
+	}
+	return nil
+}
+
+type VerifyPhoneParams struct {
+	Email Email  `json:"-"`
+	Code  string `json:"code"`
+}
+
+func (vp *VerifyPhoneParams) CommandName() string {
+	return "VerifyPhone"
+}
+
+func (vp *VerifyPhoneParams) Validate() error {
+	if vp.Email.IsZero() {
+		return ErrEmailEmpty
+	}
+	if vp.Code == "" {
+		return NewValidationError("The verification code cannot be empty")
+	}
+	return nil
+}
+
+// PhoneVerificationOptions tune how codes are issued.
+type PhoneVerificationOptions struct {
+	// CodeTTL is how long a code may be used for
+	CodeTTL time.Duration
+	// MaxAttempts is how many wrong codes are accepted before the code is dropped
+	MaxAttempts int
+	// SendLimit is how many codes one phone number is sent within SendWindow
+	SendLimit  int
+	SendWindow time.Duration
+}
+
+// sendLimiter counts the messages sent to each recipient, such as a phone number, within a
+// sliding window.
+type sendLimiter[K comparable] struct {
+	limit  int
+	window time.Duration
+
+	mu   sync.Mutex
+	sent map[K][]time.Time
+}
+
+func newSendLimiter[K comparable](limit int, window time.Duration) *sendLimiter[K] {
+	return &sendLimiter[K]{
+		limit:  limit,
+		window: window,
+		sent:   map[K][]time.Time{},
+	}
+}
+
+// allow records a message sent to the recipient to at now, unless limit were already sent within the window.
+func (sl *sendLimiter[K]) allow(to K, now time.Time) bool {
+	cutoff := now.Add(-sl.window)
+
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+
+	// Forget every recipient that has gone quiet, so the map does not grow without bound
+	for k, times := range sl.sent {
+		if !times[len(times)-1].After(cutoff) {
+			delete(sl.sent, k)
+		}
+	}
+
+	var recent []time.Time
+	for _, t := range sl.sent[to] {
+		if t.After(cutoff) {
+			recent = append(recent, t)
+		}
+	}
+	if len(recent) >= sl.limit {
+		sl.sent[to] = recent
+		return false
+	}
+	sl.sent[to] = append(recent, now)
+	return true
+}
+
+func hashPhoneCode(code string) string {
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+func newPhoneCode() (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(1_000_000))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%06d", n), nil
+}
+
+type PhoneHandler struct {
+	userStorage UserStorer
+	updates     *UserUpdater
+	codeStorage PhoneCodeStorer
+	sms         SMSProvider
+	opts        PhoneVerificationOptions
+	limiter     *sendLimiter[Phone]
+	clock       clock.Clock
+}
+
+// NewPhoneHandler texts verification codes with sms.
+func NewPhoneHandler(us UserStorer, updates *UserUpdater, cs PhoneCodeStorer, sms SMSProvider, opts PhoneVerificationOptions, clk clock.Clock) *PhoneHandler {
+	return &PhoneHandler{
+		userStorage: us,
+		updates:     updates,
+		codeStorage: cs,
+		sms:         sms,
+		opts:        opts,
+		limiter:     newSendLimiter[Phone](opts.SendLimit, opts.SendWindow),
+		clock:       clk,
+	}
+}
+
+// SendCode texts a new code to the phone number being verified, replacing any code sent before.
+// Only users may verify their own numbers.
+func (ph *PhoneHandler) SendCode(ctx context.Context, cmd Command) error {
+	params, ok := cmd.(*SendPhoneCodeParams)
+	if !ok {
+		return fmt.Errorf("PhoneHandler cannot send a code for %T", cmd)
+	}
+
+	p, ok := principal.FromContext(ctx)
+	if !ok {
+		return ErrUnauthenticated
+	}
+	if p.Email != params.Email.String() {
+		return ErrForbidden
+	}
+
+	u, err := ph.userStorage.Get(ctx, params.Email)
+	if err != nil {
+		return err
+	}
+	phone := params.Phone
+	if phone.IsZero() {
+		phone = u.Phone
+	}
+	if phone.IsZero() {
+		return NewValidationError("A phone number is required, the user has none")
+	}
+
+	now := ph.clock.Now().UTC()
+	if !ph.limiter.allow(phone, now) {
+		return ErrPhoneCodeLimited
+	}
+
+	code, err := newPhoneCode()
+	if err != nil {
+		return err
+	}
+	err = ph.codeStorage.Save(ctx, &PhoneCode{
+		Email:     u.Email,
+		Phone:     phone,
+		CodeHash:  hashPhoneCode(code),
+		ExpiresAt: now.Add(ph.opts.CodeTTL),
+	})
+	if err != nil {
+		return err
+	}
+	return ph.sms.SendSMS(ctx, phone.String(), fmt.Sprintf("Your verification code is %s. It expires in %s.", code, ph.opts.CodeTTL))
+}
+
+// Verify checks a code against the one last sent to the user, saving the number it was sent to
+// as their verified phone. A code is dropped once it expires or has been guessed wrong too often.
+func (ph *PhoneHandler) Verify(ctx context.Context, cmd Command) error {
+	params, ok := cmd.(*VerifyPhoneParams)
+	if !ok {
+		return fmt.Errorf("PhoneHandler cannot verify %T", cmd)
+	}
+
+	p, ok := principal.FromContext(ctx)
+	if !ok {
+		return ErrUnauthenticated
+	}
+	if p.Email != params.Email.String() {
+		return ErrForbidden
+	}
+
+	pending, err := ph.codeStorage.Get(ctx, params.Email)
+	if err == ErrPhoneCodeNotFound {
+		return ErrPhoneCodeInvalid
+	} else if err != nil {
+		return err
+	}
+
+	now := ph.clock.Now().UTC()
+	if !now.Before(pending.ExpiresAt) || pending.Attempts >= ph.opts.MaxAttempts {
+		err = ph.codeStorage.Delete(ctx, params.Email)
+		if err != nil && err != ErrPhoneCodeNotFound {
+			return err
+		}
+		return ErrPhoneCodeInvalid
+	}
+	if subtle.ConstantTimeCompare([]byte(hashPhoneCode(strings.TrimSpace(params.Code))), []byte(pending.CodeHash)) != 1 {
+		guessed := *pending
+		guessed.Attempts++
+		err = ph.codeStorage.Save(ctx, &guessed)
+		if err != nil {
+			return err
+		}
+		return ErrPhoneCodeInvalid
+	}
+
+	err = ph.codeStorage.Delete(ctx, params.Email)
+	if err != nil && err != ErrPhoneCodeNotFound {
+		return err
+	}
+
+	return ph.updates.Update(ctx, params.Email, func(u *User) (bool, error) {
+		u.Phone = pending.Phone
+		u.PhoneVerifiedAt = &now
+		u.UpdatedAt = now
+		return true, nil
+	})
+}
+
+// Access Layer
+// TwilioSMSProvider sends text messages through the Twilio Messages API.
+type TwilioSMSProvider struct {
+	url        string
+	accountSID string
+	authToken  string
+	from       string
+	client     *httpclient.Client
+}
+
+func NewTwilioSMSProvider(accountSID, authToken, from string) *TwilioSMSProvider {
+	return &TwilioSMSProvider{
+		url:        "https://api.twilio.com/2010-04-01/Accounts/" + url.PathEscape(accountSID) + "/Messages.json",
+		accountSID: accountSID,
+		authToken:  authToken,
+		from:       from,
+		client:     httpclient.New("twilio", httpclient.Options{Timeout: 10 * time.Second}),
+	}
+}
+
+func (tp *TwilioSMSProvider) SendSMS(ctx context.Context, to, body string) error {
+	form := url.Values{
+		"To":   {to},
+		"From": {tp.from},
+		"Body": {body},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, tp.url, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(tp.accountSID, tp.authToken)
+
+	resp, err := tp.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		var apiErr struct {
+			Message string `json:"message"`
+		}
+		json.NewDecoder(resp.Body).Decode(&apiErr)
+		return fmt.Errorf("Twilio answered %s: %s", resp.Status, apiErr.Message)
+	}
+	return nil
+}
+
+// LogSMSProvider writes text messages to a log instead of sending them, for development.
+type LogSMSProvider struct {
+	w io.Writer
+}
+
+func NewLogSMSProvider(w io.Writer) *LogSMSProvider {
+	return &LogSMSProvider{w: w}
+}
+
+func (ls *LogSMSProvider) SendSMS(ctx context.Context, to, body string) error {
+	_, err := fmt.Fprintf(ls.w, "Text message to %s: %s\n", to, body)
+	return err
+}
+
+// SendMyPhoneCode serves POST /me/phone/code with a body of {"phone": "+14155550123"},
+// or {} to verify the number the user registered with.
+func (j *JsonOverHTTP) SendMyPhoneCode(w http.ResponseWriter, r *http.Request) {
+	p, ok := principal.FromContext(r.Context())
+	if !ok || p.Email == "" {
+		writeError(w, r, ErrUnauthenticated)
+		return
+	}
+
+	params := &SendPhoneCodeParams{}
+	err := json.NewDecoder(r.Body).Decode(params)
+	if err != nil {
+		writeError(w, r, decodeError(err))
+		return
+	}
+
+	params.Email, err = ParseEmail(p.Email)
+	if err != nil {
+		writeError(w, r, ErrUnauthenticated)
+		return
+	}
+
+	err = j.usrServ.SendPhoneCode(r.Context(), params)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// VerifyMyPhone serves POST /me/phone/verify with a body of {"code": "123456"}.
+func (j *JsonOverHTTP) VerifyMyPhone(w http.ResponseWriter, r *http.Request) {
+	p, ok := principal.FromContext(r.Context())
+	if !ok || p.Email == "" {
+		writeError(w, r, ErrUnauthenticated)
+		return
+	}
+
+	params := &VerifyPhoneParams{}
+	err := json.NewDecoder(r.Body).Decode(params)
+	if err != nil {
+		writeError(w, r, decodeError(err))
+		return
+	}
+
+	params.Email, err = ParseEmail(p.Email)
+	if err != nil {
+		writeError(w, r, ErrUnauthenticated)
+		return
+	}
+
+	err = j.usrServ.VerifyPhone(r.Context(), params)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
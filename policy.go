@@ -0,0 +1,336 @@
+package separation
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oralordos/separation/internal/clock"
+	"github.com/oralordos/separation/internal/principal"
+)
+
+// Action Layer
+// RegistrationPolicy decides which emails may register.
+// The zero policy lets everyone register.
+type RegistrationPolicy struct {
+	// AllowedDomains limits registration to these domains and their subdomains when it is not empty
+	AllowedDomains []string `json:"allowed_domains"`
+	// BlockedDomains refuses these domains and their subdomains
+	BlockedDomains []string `json:"blocked_domains"`
+	// BlockDisposable refuses the known disposable email domains
+	BlockDisposable bool `json:"block_disposable"`
+	// BlockedAddresses refuses these exact emails
+	BlockedAddresses []string `json:"blocked_addresses"`
+
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type PolicyStorer interface {
+	// Get returns the zero policy if nothing has been saved yet
+	Get(ctx context.Context) (*RegistrationPolicy, error)
+	Save(ctx context.Context, policy *RegistrationPolicy) error
+}
+
+type MemoryPolicyStorage struct {
+	mu     sync.Mutex
+	policy RegistrationPolicy
+}
+
+func NewMemoryPolicyStorage() *MemoryPolicyStorage {
+	return &MemoryPolicyStorage{}
+}
+
+func (ms *MemoryPolicyStorage) Get(ctx context.Context) (*RegistrationPolicy, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	p := ms.policy
+	return &p, nil
+}
+
+func (ms *MemoryPolicyStorage) Save(ctx context.Context, policy *RegistrationPolicy) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.policy = *policy
+	return nil
+}
+
+// FilePolicyStorage keeps the registration policy in a JSON file so it survives restarts.
+type FilePolicyStorage struct {
+	path string
+	mu   sync.Mutex
+}
+
+func NewFilePolicyStorage(path string) *FilePolicyStorage {
+	return &FilePolicyStorage{
+		path: path,
+	}
+}
+
+func (fs *FilePolicyStorage) Get(ctx context.Context) (*RegistrationPolicy, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	policy := &RegistrationPolicy{}
+	b, err := ioutil.ReadFile(fs.path)
+	if os.IsNotExist(err) {
+		return policy, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(b, policy)
+	if err != nil {
+		return nil, err
+	}
+	return policy, nil
+}
+
+func (fs *FilePolicyStorage) Save(ctx context.Context, policy *RegistrationPolicy) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	b, err := json.Marshal(policy)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(fs.path, b)
+}
+
+// Business Logic
+// PolicyError is returned when the registration policy refuses an email.
+type PolicyError struct {
+	Reason string
+}
+
+func init() {
+	registerErrorType[*PolicyError]("registration_not_allowed", http.StatusForbidden, "The registration policy does not allow the email, the message says why")
+}
+
+func (pe *PolicyError) Error() string {
+	return pe.Reason
+}
+
+// disposableDomains are well known throwaway email providers.
+var disposableDomains = map[string]bool{
+	"10minutemail.com":  true,
+	"discard.email":     true,
+	"dispostable.com":   true,
+	"fakeinbox.com":     true,
+	"getnada.com":       true,
+	"guerrillamail.com": true,
+	"maildrop.cc":       true,
+	"mailinator.com":    true,
+	"mintemail.com":     true,
+	"mohmal.com":        true,
+	"sharklasers.com":   true,
+	"temp-mail.org":     true,
+	"throwawaymail.com": true,
+	"trashmail.com":     true,
+	"yopmail.com":       true,
+}
+
+// domainMatches reports whether domain is rule or one of its subdomains.
+func domainMatches(domain, rule string) bool {
+	return domain == rule || strings.HasSuffix(domain, "."+rule)
+}
+
+// Check returns a PolicyError if the policy refuses email.
+// Blocks are checked before the allowlist, so a blocked subdomain of an allowed domain stays blocked.
+func (rp *RegistrationPolicy) Check(email Email) error {
+	for _, a := range rp.BlockedAddresses {
+		if a == email.String() {
+			return &PolicyError{Reason: "Registration is not allowed for this email"}
+		}
+	}
+
+	domain := email.Domain()
+	for _, d := range rp.BlockedDomains {
+		if domainMatches(domain, d) {
+			return &PolicyError{Reason: fmt.Sprintf("Registration is not allowed for %s emails", domain)}
+		}
+	}
+	if rp.BlockDisposable {
+		for d := range disposableDomains {
+			if domainMatches(domain, d) {
+				return &PolicyError{Reason: "Registration is not allowed with disposable emails"}
+			}
+		}
+	}
+
+	if len(rp.AllowedDomains) == 0 {
+		return nil
+	}
+	for _, d := range rp.AllowedDomains {
+		if domainMatches(domain, d) {
+			return nil
+		}
+	}
+	return &PolicyError{Reason: fmt.Sprintf("Registration is not allowed for %s emails", domain)}
+}
+
+type GetRegistrationPolicyQuery struct{}
+
+func (gq *GetRegistrationPolicyQuery) QueryName() string {
+	return "GetRegistrationPolicy"
+}
+
+// SetRegistrationPolicyParams replace the whole policy.
+type SetRegistrationPolicyParams struct {
+	AllowedDomains   []string `json:"allowed_domains"`
+	BlockedDomains   []string `json:"blocked_domains"`
+	BlockDisposable  bool     `json:"block_disposable"`
+	BlockedAddresses []string `json:"blocked_addresses"`
+}
+
+func (sp *SetRegistrationPolicyParams) CommandName() string {
+	return "SetRegistrationPolicy"
+}
+
+func (sp *SetRegistrationPolicyParams) Validate() error {
+	for _, d := range append(append([]string(nil), sp.AllowedDomains...), sp.BlockedDomains...) {
+		d = strings.TrimSpace(d)
+		if d == "" || strings.ContainsAny(d, "@ ") {
+			return NewValidationError(fmt.Sprintf("Invalid domain %q, use the part after the '@'", d))
+		}
+	}
+	for _, a := range sp.BlockedAddresses {
+		_, err := ParseEmail(a)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// normalizeDomains lowercases and sorts domains, dropping duplicates.
+func normalizeDomains(domains []string) []string {
+	set := map[string]bool{}
+	for _, d := range domains {
+		set[strings.TrimPrefix(strings.ToLower(strings.TrimSpace(d)), ".")] = true
+	}
+
+	normalized := []string{}
+	for d := range set {
+		normalized = append(normalized, d)
+	}
+	sort.Strings(normalized)
+	return normalized
+}
+
+type PolicyHandler struct {
+	storage PolicyStorer
+	clock   clock.Clock
+}
+
+func NewPolicyHandler(ps PolicyStorer, clk clock.Clock) *PolicyHandler {
+	return &PolicyHandler{
+		storage: ps,
+		clock:   clk,
+	}
+}
+
+func (ph *PolicyHandler) Get(ctx context.Context, q Query) (interface{}, error) {
+	err := requireAdmin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return ph.storage.Get(ctx)
+}
+
+func (ph *PolicyHandler) Set(ctx context.Context, cmd Command) error {
+	params, ok := cmd.(*SetRegistrationPolicyParams)
+	if !ok {
+		return fmt.Errorf("PolicyHandler cannot set %T", cmd)
+	}
+
+	err := requireAdmin(ctx)
+	if err != nil {
+		return err
+	}
+
+	addresses := []string{}
+	for _, a := range params.BlockedAddresses {
+		email, _ := ParseEmail(a)
+		addresses = append(addresses, email.String())
+	}
+	sort.Strings(addresses)
+
+	return ph.storage.Save(ctx, &RegistrationPolicy{
+		AllowedDomains:   normalizeDomains(params.AllowedDomains),
+		BlockedDomains:   normalizeDomains(params.BlockedDomains),
+		BlockDisposable:  params.BlockDisposable,
+		BlockedAddresses: addresses,
+		UpdatedAt:        ph.clock.Now().UTC(),
+	})
+}
+
+// Commands is a CommandMiddleware checking registrations against the policy before they reach
+// the register handler, so dry runs are refused too. Admins may register anyone.
+func (ph *PolicyHandler) Commands(next CommandHandler) CommandHandler {
+	return CommandHandlerFunc(func(ctx context.Context, cmd Command) error {
+		params, ok := cmd.(*RegisterParams)
+		if !ok {
+			return next.Handle(ctx, cmd)
+		}
+		if p, ok := principal.FromContext(ctx); ok && p.Admin {
+			return next.Handle(ctx, cmd)
+		}
+
+		policy, err := ph.storage.Get(ctx)
+		if err != nil {
+			return err
+		}
+		err = policy.Check(params.Email)
+		if err != nil {
+			return err
+		}
+		return next.Handle(ctx, cmd)
+	})
+}
+
+// Access Layer
+// RegistrationPolicy serves GET and PUT /policy/registration.
+// PUT replaces the whole policy.
+func (a *AdminHTTP) RegistrationPolicy(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		policy, err := a.users.RegistrationPolicy(r.Context())
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(policy)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+	case http.MethodPut:
+		params := &SetRegistrationPolicyParams{}
+		dec := json.NewDecoder(r.Body)
+		dec.DisallowUnknownFields()
+		err := dec.Decode(params)
+		if err != nil {
+			writeError(w, r, decodeError(err))
+			return
+		}
+
+		err = a.users.SetRegistrationPolicy(r.Context(), params)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, r, NewMethodError("RegistrationPolicy requires a get or put request"))
+	}
+}
@@ -0,0 +1,322 @@
+package separation
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+	// Timezones are validated against the embedded database, so they do not depend on the host
+	_ "time/tzdata"
+
+	"github.com/oralordos/separation/internal/clock"
+	"github.com/oralordos/separation/internal/principal"
+	"golang.org/x/text/language"
+)
+
+// Action Layer
+// Digest frequencies a user may choose.
+const (
+	DigestOff    = "off"
+	DigestDaily  = "daily"
+	DigestWeekly = "weekly"
+)
+
+// Preferences are a user's settings with every field filled in.
+type Preferences struct {
+	Notifications NotificationPreferences `json:"notifications"`
+	// Locale is a BCP 47 language tag
+	Locale string `json:"locale"`
+	// Timezone is an IANA timezone name, such as Europe/London
+	Timezone string `json:"timezone"`
+}
+
+type NotificationPreferences struct {
+	// Email sends account notifications by email
+	Email bool `json:"email"`
+	// Webhook sends account notifications to the operator's notification webhook
+	Webhook bool `json:"webhook"`
+	// SMS sends account notifications by text message
+	SMS bool `json:"sms"`
+	// Product sends news about the service by email
+	Product bool `json:"product"`
+	// Digest is one of off, daily or weekly
+	Digest string `json:"digest"`
+}
+
+// Channel reports whether account notifications may be sent on the channel called name.
+func (np NotificationPreferences) Channel(name string) bool {
+	switch name {
+	case ChannelEmail:
+		return np.Email
+	case ChannelWebhook:
+		return np.Webhook
+	case ChannelSMS:
+		return np.SMS
+	}
+	return false
+}
+
+// PreferenceSettings are the preferences a user chose. A nil field has not been
+// chosen and follows the default, so changing a default reaches everyone who kept it.
+type PreferenceSettings struct {
+	Notifications NotificationSettings `json:"notifications"`
+	Locale        *string              `json:"locale,omitempty"`
+	Timezone      *string              `json:"timezone,omitempty"`
+}
+
+type NotificationSettings struct {
+	Email   *bool   `json:"email,omitempty"`
+	Webhook *bool   `json:"webhook,omitempty"`
+	SMS     *bool   `json:"sms,omitempty"`
+	Product *bool   `json:"product,omitempty"`
+	Digest  *string `json:"digest,omitempty"`
+}
+
+// Validate checks every chosen field, canonicalizing the locale as it goes.
+func (ps *PreferenceSettings) Validate() error {
+	if d := ps.Notifications.Digest; d != nil && *d != DigestOff && *d != DigestDaily && *d != DigestWeekly {
+		return NewValidationError(fmt.Sprintf("Digest must be %s, %s or %s", DigestOff, DigestDaily, DigestWeekly))
+	}
+
+	if ps.Locale != nil {
+		tag, err := language.Parse(*ps.Locale)
+		if err != nil {
+			return NewValidationError(fmt.Sprintf("Locale %q is not a BCP 47 language tag", *ps.Locale))
+		}
+		locale := tag.String()
+		ps.Locale = &locale
+	}
+
+	if ps.Timezone != nil {
+		// LoadLocation accepts "" and "Local", neither of which means anything to another machine
+		_, err := time.LoadLocation(*ps.Timezone)
+		if err != nil || *ps.Timezone == "" || *ps.Timezone == "Local" {
+			return NewValidationError(fmt.Sprintf("Timezone %q is not an IANA timezone name", *ps.Timezone))
+		}
+	}
+	return nil
+}
+
+// Merge fills the fields settings leave unset from p.
+func (p Preferences) Merge(settings PreferenceSettings) Preferences {
+	n := settings.Notifications
+	if n.Email != nil {
+		p.Notifications.Email = *n.Email
+	}
+	if n.Webhook != nil {
+		p.Notifications.Webhook = *n.Webhook
+	}
+	if n.SMS != nil {
+		p.Notifications.SMS = *n.SMS
+	}
+	if n.Product != nil {
+		p.Notifications.Product = *n.Product
+	}
+	if n.Digest != nil {
+		p.Notifications.Digest = *n.Digest
+	}
+	if settings.Locale != nil {
+		p.Locale = *settings.Locale
+	}
+	if settings.Timezone != nil {
+		p.Timezone = *settings.Timezone
+	}
+	return p
+}
+
+// DefaultPreferences are what a user who has chosen nothing gets.
+func DefaultPreferences(locale language.Tag) Preferences {
+	return Preferences{
+		Notifications: NotificationPreferences{
+			Email:   true,
+			Webhook: true,
+			SMS:     false,
+			Product: false,
+			Digest:  DigestWeekly,
+		},
+		Locale:   locale.String(),
+		Timezone: "UTC",
+	}
+}
+
+// UserPreferences is the stored preferences document of one user.
+type UserPreferences struct {
+	Email     Email              `json:"email"`
+	Settings  PreferenceSettings `json:"settings"`
+	UpdatedAt time.Time          `json:"updated_at"`
+}
+
+type PreferencesStorer interface {
+	// Get may return an ErrNotFound error if the user has never saved preferences
+	Get(ctx context.Context, email Email) (*UserPreferences, error)
+	Save(ctx context.Context, prefs *UserPreferences) error
+}
+
+// RepositoryPreferencesStorage implements PreferencesStorer on top of any preferences repository.
+type RepositoryPreferencesStorage struct {
+	repo Repository[Email, *UserPreferences]
+}
+
+func NewRepositoryPreferencesStorage(repo Repository[Email, *UserPreferences]) *RepositoryPreferencesStorage {
+	return &RepositoryPreferencesStorage{
+		repo: repo,
+	}
+}
+
+func NewMemoryPreferencesStorage() *RepositoryPreferencesStorage {
+	return NewRepositoryPreferencesStorage(NewMemoryRepository(func(p *UserPreferences) Email {
+		return p.Email
+	}))
+}
+
+func (rs *RepositoryPreferencesStorage) Get(ctx context.Context, email Email) (*UserPreferences, error) {
+	return rs.repo.Get(ctx, email)
+}
+
+func (rs *RepositoryPreferencesStorage) Save(ctx context.Context, prefs *UserPreferences) error {
+	return rs.repo.Save(ctx, prefs)
+}
+
+// Business Logic
+type GetPreferencesQuery struct {
+	Email Email
+}
+
+func (gq *GetPreferencesQuery) QueryName() string {
+	return "GetPreferences"
+}
+
+// SetPreferencesParams replace every setting of a user. Settings left out return to the defaults.
+type SetPreferencesParams struct {
+	Email    Email
+	Settings PreferenceSettings
+}
+
+func (sp *SetPreferencesParams) CommandName() string {
+	return "SetPreferences"
+}
+
+func (sp *SetPreferencesParams) Validate() error {
+	if sp.Email.IsZero() {
+		return ErrEmailEmpty
+	}
+	return sp.Settings.Validate()
+}
+
+type PreferencesHandler struct {
+	userStorage  UserStorer
+	prefsStorage PreferencesStorer
+	defaults     Preferences
+	clock        clock.Clock
+}
+
+func NewPreferencesHandler(us UserStorer, ps PreferencesStorer, defaults Preferences, clk clock.Clock) *PreferencesHandler {
+	return &PreferencesHandler{
+		userStorage:  us,
+		prefsStorage: ps,
+		defaults:     defaults,
+		clock:        clk,
+	}
+}
+
+// authorize lets users see and change their own preferences, and admins anyone's.
+func (ph *PreferencesHandler) authorize(ctx context.Context, email Email) error {
+	p, ok := principal.FromContext(ctx)
+	if !ok {
+		return ErrUnauthenticated
+	}
+	if !p.Admin && p.Email != email.String() {
+		return ErrForbidden
+	}
+
+	_, err := ph.userStorage.Get(ctx, email)
+	return err
+}
+
+func (ph *PreferencesHandler) Get(ctx context.Context, q Query) (interface{}, error) {
+	query, ok := q.(*GetPreferencesQuery)
+	if !ok {
+		return nil, fmt.Errorf("PreferencesHandler cannot get %T", q)
+	}
+
+	err := ph.authorize(ctx, query.Email)
+	if err != nil {
+		return nil, err
+	}
+
+	stored, err := ph.prefsStorage.Get(ctx, query.Email)
+	if err == ErrNotFound {
+		prefs := ph.defaults
+		return &prefs, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	prefs := ph.defaults.Merge(stored.Settings)
+	return &prefs, nil
+}
+
+func (ph *PreferencesHandler) Set(ctx context.Context, cmd Command) error {
+	params, ok := cmd.(*SetPreferencesParams)
+	if !ok {
+		return fmt.Errorf("PreferencesHandler cannot set %T", cmd)
+	}
+
+	err := ph.authorize(ctx, params.Email)
+	if err != nil {
+		return err
+	}
+
+	return ph.prefsStorage.Save(ctx, &UserPreferences{
+		Email:     params.Email,
+		Settings:  params.Settings,
+		UpdatedAt: ph.clock.Now().UTC(),
+	})
+}
+
+// Access Layer
+// MyPreferences serves GET and PUT /me/preferences. A PUT body holds the settings
+// the user chose; any left out follow the defaults.
+func (j *JsonOverHTTP) MyPreferences(w http.ResponseWriter, r *http.Request) {
+	p, ok := principal.FromContext(r.Context())
+	if !ok || p.Email == "" {
+		writeError(w, r, ErrUnauthenticated)
+		return
+	}
+	email, err := ParseEmail(p.Email)
+	if err != nil {
+		writeError(w, r, ErrUnauthenticated)
+		return
+	}
+
+	if r.Method == http.MethodPut {
+		params := &SetPreferencesParams{Email: email}
+		dec := json.NewDecoder(r.Body)
+		dec.DisallowUnknownFields()
+		err = dec.Decode(&params.Settings)
+		if err != nil {
+			writeError(w, r, decodeError(err))
+			return
+		}
+
+		err = j.usrServ.SetPreferences(r.Context(), params)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+	}
+
+	prefs, err := j.usrServ.Preferences(r.Context(), &GetPreferencesQuery{Email: email})
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(prefs)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+}
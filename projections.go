@@ -0,0 +1,409 @@
+package separation
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Action Layer
+// UserProjection is a read model kept up to date from user events, shaped for the queries
+// it answers rather than for storing users. Its state is saved and restored as JSON.
+type UserProjection interface {
+	ProjectionName() string
+	// Apply updates the read model with e. It is called once for every event, in order.
+	Apply(e *UserEvent)
+	// Reset empties the read model before it is rebuilt from the first event.
+	Reset()
+	json.Marshaler
+	json.Unmarshaler
+}
+
+// DefaultUserProjections are the read models kept by the eventsourced storage driver.
+func DefaultUserProjections() []UserProjection {
+	return []UserProjection{NewUsersByCreation(), NewDomainCounts()}
+}
+
+type creationEntry struct {
+	Email     Email     `json:"email"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func (ce creationEntry) before(other creationEntry) bool {
+	if !ce.CreatedAt.Equal(other.CreatedAt) {
+		return ce.CreatedAt.Before(other.CreatedAt)
+	}
+	return ce.Email.String() < other.Email.String()
+}
+
+// UsersByCreation lists users in the order they registered.
+type UsersByCreation struct {
+	mu      sync.RWMutex
+	entries []creationEntry
+	created map[Email]time.Time
+}
+
+func NewUsersByCreation() *UsersByCreation {
+	return &UsersByCreation{
+		created: map[Email]time.Time{},
+	}
+}
+
+func (uc *UsersByCreation) ProjectionName() string {
+	return "users_by_creation"
+}
+
+func (uc *UsersByCreation) Apply(e *UserEvent) {
+	uc.mu.Lock()
+	defer uc.mu.Unlock()
+
+	switch e.Type {
+	case UserEventRegistered, UserEventUpdated:
+		if at, ok := uc.created[e.Email]; ok {
+			if at.Equal(e.User.CreatedAt) {
+				return
+			}
+			uc.remove(creationEntry{Email: e.Email, CreatedAt: at})
+		}
+		uc.insert(creationEntry{Email: e.Email, CreatedAt: e.User.CreatedAt})
+	case UserEventDeleted:
+		if at, ok := uc.created[e.Email]; ok {
+			uc.remove(creationEntry{Email: e.Email, CreatedAt: at})
+		}
+	}
+}
+
+// search finds where entry belongs. The caller must hold mu.
+func (uc *UsersByCreation) search(entry creationEntry) int {
+	return sort.Search(len(uc.entries), func(i int) bool {
+		return !uc.entries[i].before(entry)
+	})
+}
+
+func (uc *UsersByCreation) insert(entry creationEntry) {
+	i := uc.search(entry)
+	uc.entries = append(uc.entries, creationEntry{})
+	copy(uc.entries[i+1:], uc.entries[i:])
+	uc.entries[i] = entry
+	uc.created[entry.Email] = entry.CreatedAt
+}
+
+func (uc *UsersByCreation) remove(entry creationEntry) {
+	i := uc.search(entry)
+	if i < len(uc.entries) && uc.entries[i].Email == entry.Email {
+		uc.entries = append(uc.entries[:i], uc.entries[i+1:]...)
+	}
+	delete(uc.created, entry.Email)
+}
+
+// Since returns the emails of up to limit users registered at or after since, oldest first.
+func (uc *UsersByCreation) Since(since time.Time, limit int) []Email {
+	uc.mu.RLock()
+	defer uc.mu.RUnlock()
+
+	i := sort.Search(len(uc.entries), func(i int) bool {
+		return !uc.entries[i].CreatedAt.Before(since)
+	})
+	var emails []Email
+	for ; i < len(uc.entries) && len(emails) < limit; i++ {
+		emails = append(emails, uc.entries[i].Email)
+	}
+	return emails
+}
+
+func (uc *UsersByCreation) Reset() {
+	uc.mu.Lock()
+	defer uc.mu.Unlock()
+	uc.entries = nil
+	uc.created = map[Email]time.Time{}
+}
+
+func (uc *UsersByCreation) MarshalJSON() ([]byte, error) {
+	uc.mu.RLock()
+	defer uc.mu.RUnlock()
+	return json.Marshal(uc.entries)
+}
+
+func (uc *UsersByCreation) UnmarshalJSON(b []byte) error {
+	var entries []creationEntry
+	err := json.Unmarshal(b, &entries)
+	if err != nil {
+		return err
+	}
+
+	uc.mu.Lock()
+	defer uc.mu.Unlock()
+	uc.entries = entries
+	uc.created = map[Email]time.Time{}
+	for _, e := range entries {
+		uc.created[e.Email] = e.CreatedAt
+	}
+	return nil
+}
+
+// DomainCounts counts the users of each email domain.
+type DomainCounts struct {
+	mu     sync.RWMutex
+	counts map[string]int
+}
+
+func NewDomainCounts() *DomainCounts {
+	return &DomainCounts{
+		counts: map[string]int{},
+	}
+}
+
+func (dc *DomainCounts) ProjectionName() string {
+	return "domain_counts"
+}
+
+// Apply counts registrations and deletions. Emails never change, so updates do not move users between domains.
+func (dc *DomainCounts) Apply(e *UserEvent) {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+
+	switch e.Type {
+	case UserEventRegistered:
+		dc.counts[e.Email.Domain()]++
+	case UserEventDeleted:
+		domain := e.Email.Domain()
+		dc.counts[domain]--
+		if dc.counts[domain] <= 0 {
+			delete(dc.counts, domain)
+		}
+	}
+}
+
+// Counts returns a copy of the count of each domain.
+func (dc *DomainCounts) Counts() map[string]int {
+	dc.mu.RLock()
+	defer dc.mu.RUnlock()
+	counts := make(map[string]int, len(dc.counts))
+	for d, n := range dc.counts {
+		counts[d] = n
+	}
+	return counts
+}
+
+func (dc *DomainCounts) Reset() {
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	dc.counts = map[string]int{}
+}
+
+func (dc *DomainCounts) MarshalJSON() ([]byte, error) {
+	dc.mu.RLock()
+	defer dc.mu.RUnlock()
+	return json.Marshal(dc.counts)
+}
+
+func (dc *DomainCounts) UnmarshalJSON(b []byte) error {
+	counts := map[string]int{}
+	err := json.Unmarshal(b, &counts)
+	if err != nil {
+		return err
+	}
+
+	dc.mu.Lock()
+	defer dc.mu.Unlock()
+	dc.counts = counts
+	return nil
+}
+
+type projectorCheckpoint struct {
+	Seq         uint64                     `json:"seq"`
+	Projections map[string]json.RawMessage `json:"projections"`
+}
+
+// Projector feeds user events to a set of projections, and checkpoints them to a file
+// with the number of the last event applied, so that they only catch up on what they
+// missed rather than replaying the whole history on every boot.
+type Projector struct {
+	path        string
+	projections []UserProjection
+
+	mu  sync.Mutex
+	seq uint64
+}
+
+// NewProjector checkpoints to path. When path is empty the projections are only
+// kept in memory and rebuilt from the first event on every boot.
+func NewProjector(path string, projections ...UserProjection) *Projector {
+	return &Projector{
+		path:        path,
+		projections: projections,
+	}
+}
+
+// Projection returns the projection called name, or nil when there is none.
+func (p *Projector) Projection(name string) UserProjection {
+	for _, proj := range p.projections {
+		if proj.ProjectionName() == name {
+			return proj
+		}
+	}
+	return nil
+}
+
+// load restores the projections from the checkpoint. It returns false when they must be
+// rebuilt, because there is no checkpoint or it lacks one of them.
+func (p *Projector) load() (bool, error) {
+	if p.path == "" {
+		return false, nil
+	}
+	b, err := os.ReadFile(p.path)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	var cp projectorCheckpoint
+	err = json.Unmarshal(b, &cp)
+	if err != nil {
+		return false, fmt.Errorf("Corrupt projection checkpoint: %v", err)
+	}
+	for _, proj := range p.projections {
+		state, ok := cp.Projections[proj.ProjectionName()]
+		if !ok {
+			return false, nil
+		}
+		err = proj.UnmarshalJSON(state)
+		if err != nil {
+			return false, fmt.Errorf("Corrupt %s projection: %v", proj.ProjectionName(), err)
+		}
+	}
+	p.seq = cp.Seq
+	return true, nil
+}
+
+// CatchUp restores the projections from their checkpoint, or empties them when it cannot,
+// and applies every event after it.
+func (p *Projector) CatchUp(ctx context.Context, events UserEventStore) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	loaded, err := p.load()
+	if err != nil {
+		return err
+	}
+	if !loaded {
+		p.reset()
+	}
+	return p.replay(ctx, events)
+}
+
+// Rebuild empties the projections, applies every event from the first, and saves a checkpoint.
+func (p *Projector) Rebuild(ctx context.Context, events UserEventStore) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.reset()
+	err := p.replay(ctx, events)
+	if err != nil {
+		return err
+	}
+	return p.save()
+}
+
+func (p *Projector) reset() {
+	for _, proj := range p.projections {
+		proj.Reset()
+	}
+	p.seq = 0
+}
+
+func (p *Projector) replay(ctx context.Context, events UserEventStore) error {
+	err := events.Replay(ctx, p.seq, func(e *UserEvent) error {
+		p.apply(e)
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (p *Projector) apply(e *UserEvent) {
+	for _, proj := range p.projections {
+		proj.Apply(e)
+	}
+	p.seq = e.Seq
+}
+
+// Apply feeds one new event to every projection.
+func (p *Projector) Apply(e *UserEvent) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.apply(e)
+}
+
+// Save checkpoints the projections. It does nothing when they are only kept in memory.
+func (p *Projector) Save() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.save()
+}
+
+func (p *Projector) save() error {
+	if p.path == "" {
+		return nil
+	}
+	cp := projectorCheckpoint{
+		Seq:         p.seq,
+		Projections: map[string]json.RawMessage{},
+	}
+	for _, proj := range p.projections {
+		state, err := proj.MarshalJSON()
+		if err != nil {
+			return err
+		}
+		cp.Projections[proj.ProjectionName()] = state
+	}
+
+	b, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(p.path, b)
+}
+
+// runRebuildProjections implements `separation rebuild-projections`, which rebuilds the
+// read models of the eventsourced storage driver from its first event. The server must
+// be stopped, or it overwrites the rebuilt checkpoint with its own.
+func runRebuildProjections(args []string) error {
+	fs := flag.NewFlagSet("rebuild-projections", flag.ExitOnError)
+	fs.Parse(args)
+
+	cfg, err := LoadConfig()
+	if err != nil {
+		return fmt.Errorf("Invalid configuration: %v", err)
+	}
+	if cfg.Storage != "eventsourced" || cfg.StorageDSN == "" {
+		return errors.New("Projections are only kept with STORAGE=eventsourced and STORAGE_DSN set to its directory")
+	}
+
+	events, err := OpenFileUserEventStore(filepath.Join(cfg.StorageDSN, "events.jsonl"))
+	if err != nil {
+		return err
+	}
+	defer events.Close()
+
+	proj := NewProjector(filepath.Join(cfg.StorageDSN, "projections.json"), DefaultUserProjections()...)
+	err = proj.Rebuild(context.Background(), events)
+	if err != nil {
+		return err
+	}
+	for _, p := range proj.projections {
+		fmt.Printf("Rebuilt %s\n", p.ProjectionName())
+	}
+	fmt.Printf("Applied every event up to %d\n", proj.seq)
+	return nil
+}
@@ -0,0 +1,256 @@
+package separation
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oralordos/separation/internal/clock"
+	"github.com/oralordos/separation/internal/principal"
+	"github.com/oralordos/separation/internal/redis"
+)
+
+// Access Layer
+var ErrRateLimited = registerError(errors.New("Too many requests, retry after the Retry-After header"), "rate_limited", http.StatusTooManyRequests, "The caller made too many requests recently, retry after the Retry-After header")
+
+// RateLimit allows Requests in each Window.
+type RateLimit struct {
+	Requests int64
+	Window   time.Duration
+}
+
+// RateLimits maps caller tiers to their limits. Authenticated callers take the tier named by
+// their user's plan label, then their role label, when it has a limit, or else the admin or
+// authenticated tier. Tiers without a limit are unlimited.
+type RateLimits map[string]RateLimit
+
+// ParseRateLimits reads comma separated tier=requests/window pairs, such as authenticated=600/1m.
+func ParseRateLimits(s string) (RateLimits, error) {
+	limits := RateLimits{}
+	for _, pair := range parseNameList(s) {
+		tier, limit, ok := strings.Cut(pair, "=")
+		requests, window, hasWindow := strings.Cut(limit, "/")
+		if !ok || tier == "" || !hasWindow {
+			return nil, fmt.Errorf("%q must be tier=requests/window", pair)
+		}
+
+		var l RateLimit
+		var err error
+		l.Requests, err = strconv.ParseInt(requests, 10, 64)
+		if err != nil || l.Requests <= 0 {
+			return nil, fmt.Errorf("%q must allow a positive number of requests", pair)
+		}
+		l.Window, err = time.ParseDuration(window)
+		if err != nil || l.Window < time.Second {
+			return nil, fmt.Errorf("%q must have a window of a second or more", pair)
+		}
+		limits[tier] = l
+	}
+	return limits, nil
+}
+
+// rateTierLabels are the user labels that may name a caller's tier, in order.
+var rateTierLabels = []string{"plan", "role"}
+
+// RateCounter counts requests in fixed windows. Instances share limits when they share a counter.
+type RateCounter interface {
+	// Incr counts a request against key in the current window of length window, returning the
+	// requests counted so far in it and when it ends
+	Incr(ctx context.Context, key string, window time.Duration) (int64, time.Time, error)
+}
+
+type rateWindow struct {
+	count int64
+	ends  time.Time
+}
+
+// MemoryRateCounter keeps counts in memory, so each instance limits callers separately.
+type MemoryRateCounter struct {
+	clock     clock.Clock
+	mu        sync.Mutex
+	windows   map[string]*rateWindow
+	nextSweep time.Time
+}
+
+func NewMemoryRateCounter(clk clock.Clock) *MemoryRateCounter {
+	return &MemoryRateCounter{
+		clock:   clk,
+		windows: map[string]*rateWindow{},
+	}
+}
+
+func (mc *MemoryRateCounter) Incr(ctx context.Context, key string, window time.Duration) (int64, time.Time, error) {
+	now := mc.clock.Now()
+
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	// Ended windows are swept at most once per window, which keeps the cost off most requests
+	if now.After(mc.nextSweep) {
+		for k, w := range mc.windows {
+			if !now.Before(w.ends) {
+				delete(mc.windows, k)
+			}
+		}
+		mc.nextSweep = now.Add(window)
+	}
+
+	w, ok := mc.windows[key]
+	if !ok || !now.Before(w.ends) {
+		w = &rateWindow{ends: now.Add(window)}
+		mc.windows[key] = w
+	}
+	w.count++
+	return w.count, w.ends, nil
+}
+
+// rateIncrScript counts a request and starts the window's expiry with the first one,
+// returning the count and the milliseconds left in the window.
+const rateIncrScript = `local n = redis.call('INCR', KEYS[1])
+if n == 1 then redis.call('PEXPIRE', KEYS[1], ARGV[1]) end
+local ttl = redis.call('PTTL', KEYS[1])
+if ttl < 0 then redis.call('PEXPIRE', KEYS[1], ARGV[1]) ttl = tonumber(ARGV[1]) end
+return {n, ttl}`
+
+// RedisRateCounter keeps counts in Redis, so every instance using the same server
+// shares them. Each window is a key that expires when it ends.
+type RedisRateCounter struct {
+	client *redis.Client
+	prefix string
+	clock  clock.Clock
+}
+
+// NewRedisRateCounter stores counts under keys starting with prefix.
+func NewRedisRateCounter(client *redis.Client, prefix string, clk clock.Clock) *RedisRateCounter {
+	return &RedisRateCounter{
+		client: client,
+		prefix: prefix,
+		clock:  clk,
+	}
+}
+
+func (rc *RedisRateCounter) Incr(ctx context.Context, key string, window time.Duration) (int64, time.Time, error) {
+	reply, err := rc.client.Do(ctx, "EVAL", rateIncrScript, "1", rc.prefix+key, strconv.FormatInt(window.Milliseconds(), 10))
+	if err != nil {
+		return 0, time.Time{}, err
+	}
+	values, ok := reply.([]interface{})
+	if !ok || len(values) != 2 {
+		return 0, time.Time{}, fmt.Errorf("Unexpected rate limit reply %v", reply)
+	}
+	count, ok1 := values[0].(int64)
+	ttl, ok2 := values[1].(int64)
+	if !ok1 || !ok2 {
+		return 0, time.Time{}, fmt.Errorf("Unexpected rate limit reply %v", reply)
+	}
+	return count, rc.clock.Now().Add(time.Duration(ttl) * time.Millisecond), nil
+}
+
+var rateLimited = expvar.NewMap("rate_limited")
+
+// RateLimiter limits the requests of each authenticated caller, by the tier they are in.
+// Anonymous callers are not limited. When the counter cannot be reached requests are let
+// through, and counted in the rate_limited expvar as errors.
+type RateLimiter struct {
+	next    http.Handler
+	counter RateCounter
+	limits  RateLimits
+	users   UserService
+	clock   clock.Clock
+	// byLabel is set when a limit is for a tier other than admin or authenticated, so
+	// callers' labels must be looked up
+	byLabel bool
+}
+
+// NewRateLimiter looks callers' labels up in users, when any limit is for a plan or role.
+func NewRateLimiter(next http.Handler, counter RateCounter, limits RateLimits, users UserService, clk clock.Clock) *RateLimiter {
+	rl := &RateLimiter{
+		next:    next,
+		counter: counter,
+		limits:  limits,
+		users:   users,
+		clock:   clk,
+	}
+	for tier := range limits {
+		if !containsString(callerTiers, tier) {
+			rl.byLabel = true
+		}
+	}
+	return rl
+}
+
+// tier picks the tier and key the caller is counted under. Users are keyed by email, so
+// they share a limit however they authenticate, and other callers by scheme and subject.
+func (rl *RateLimiter) tier(ctx context.Context, p *principal.Principal) (string, string) {
+	tier := callerTier(ctx)
+	if p.Email == "" {
+		return tier, p.Scheme + ":" + p.Subject
+	}
+
+	key := "user:" + p.Email
+	if !rl.byLabel {
+		return tier, key
+	}
+	email, err := ParseEmail(p.Email)
+	if err != nil {
+		return tier, key
+	}
+	u, err := rl.users.GetByEmail(ctx, email)
+	if err != nil {
+		return tier, key
+	}
+	for _, label := range rateTierLabels {
+		if _, ok := rl.limits[u.Labels[label]]; ok {
+			return u.Labels[label], key
+		}
+	}
+	return tier, key
+}
+
+func (rl *RateLimiter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p, ok := principal.FromContext(r.Context())
+	if !ok {
+		rl.next.ServeHTTP(w, r)
+		return
+	}
+	tier, key := rl.tier(r.Context(), p)
+	limit, ok := rl.limits[tier]
+	if !ok {
+		rl.next.ServeHTTP(w, r)
+		return
+	}
+
+	count, resets, err := rl.counter.Incr(r.Context(), key, limit.Window)
+	if err != nil {
+		rateLimited.Add("errors", 1)
+		rl.next.ServeHTTP(w, r)
+		return
+	}
+
+	remaining := limit.Requests - count
+	if remaining < 0 {
+		remaining = 0
+	}
+	h := w.Header()
+	h.Set("X-RateLimit-Limit", strconv.FormatInt(limit.Requests, 10))
+	h.Set("X-RateLimit-Remaining", strconv.FormatInt(remaining, 10))
+	h.Set("X-RateLimit-Reset", strconv.FormatInt(resets.Unix(), 10))
+	if count > limit.Requests {
+		rateLimited.Add(tier, 1)
+		retry := int(math.Ceil(resets.Sub(rl.clock.Now()).Seconds()))
+		if retry < 1 {
+			retry = 1
+		}
+		h.Set("Retry-After", strconv.Itoa(retry))
+		writeError(w, r, ErrRateLimited)
+		return
+	}
+	rl.next.ServeHTTP(w, r)
+}
@@ -0,0 +1,324 @@
+package separation
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Access Layer
+// maxRecordedBody bounds how much of each request and response body is recorded.
+const maxRecordedBody = 1 << 20
+
+// recordedHeaders are the request headers kept in a recording. Credential headers are
+// never recorded, so authenticated requests are replayed anonymously.
+var recordedHeaders = []string{"Content-Type", "Accept", "Accept-Language"}
+
+// recordedSecrets are query parameters and JSON fields, at any depth, that carry
+// credentials: magic link, invite and organization API tokens, and verification codes.
+// Their values are replaced with redactedValue in recordings.
+var recordedSecrets = map[string]bool{
+	"token":         true,
+	"invite_token":  true,
+	"captcha_token": true,
+	"code":          true,
+	"password":      true,
+	"secret":        true,
+	"signature":     true,
+}
+
+const redactedValue = "REDACTED"
+
+// redactQuery returns the request URI of u with the values of recordedSecrets in its
+// query replaced, and reports whether there were any.
+func redactQuery(u *url.URL) (string, bool) {
+	q := u.Query()
+	redacted := false
+	for k := range q {
+		if recordedSecrets[k] {
+			q[k] = []string{redactedValue}
+			redacted = true
+		}
+	}
+	if !redacted {
+		return u.RequestURI(), false
+	}
+	return u.EscapedPath() + "?" + q.Encode(), true
+}
+
+// redactSecrets replaces the values of recordedSecrets anywhere in v, and reports whether it did.
+func redactSecrets(v interface{}) bool {
+	redacted := false
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, child := range v {
+			if recordedSecrets[k] {
+				v[k] = redactedValue
+				redacted = true
+				continue
+			}
+			redacted = redactSecrets(child) || redacted
+		}
+	case []interface{}:
+		for _, child := range v {
+			redacted = redactSecrets(child) || redacted
+		}
+	}
+	return redacted
+}
+
+// redactBody replaces the secrets in a JSON body. Other bodies cannot be searched for
+// secrets, so only text, images and form uploads are kept, and anything else, such as a
+// protobuf request, is dropped. It reports whether the body was changed.
+func redactBody(body []byte, contentType string) ([]byte, bool) {
+	if len(body) == 0 {
+		return body, false
+	}
+	var v interface{}
+	if json.Unmarshal(body, &v) != nil {
+		if strings.HasPrefix(contentType, "text/") || strings.HasPrefix(contentType, "image/") || strings.HasPrefix(contentType, "multipart/") {
+			return body, false
+		}
+		return nil, true
+	}
+	if !redactSecrets(v) {
+		return body, false
+	}
+	redacted, err := json.Marshal(v)
+	if err != nil {
+		return nil, true
+	}
+	return redacted, true
+}
+
+// RecordedExchange is one request to the JSON access layer and the response it got.
+type RecordedExchange struct {
+	Method       string            `json:"method"`
+	URI          string            `json:"uri"`
+	Header       map[string]string `json:"header,omitempty"`
+	Body         []byte            `json:"body,omitempty"`
+	Status       int               `json:"status"`
+	ResponseType string            `json:"response_type,omitempty"`
+	Response     []byte            `json:"response,omitempty"`
+	// Truncated is set when either body was longer than was recorded, so it cannot be compared.
+	Truncated bool `json:"truncated,omitempty"`
+	// Redacted is set when secrets were left out of the exchange, so it cannot be replayed.
+	Redacted bool `json:"redacted,omitempty"`
+}
+
+// bodyRecorder keeps a copy of what a handler writes, up to maxRecordedBody.
+type bodyRecorder struct {
+	*StatusRecorder
+	body      bytes.Buffer
+	truncated bool
+}
+
+func (br *bodyRecorder) Write(b []byte) (int, error) {
+	if room := maxRecordedBody - br.body.Len(); room < len(b) {
+		br.body.Write(b[:room])
+		br.truncated = true
+	} else {
+		br.body.Write(b)
+	}
+	return br.StatusRecorder.Write(b)
+}
+
+// RequestRecorder writes every exchange through it to out as a JSON line,
+// for `separation replay-recording` to send again later. Secrets are redacted from the
+// query and both bodies, and the bodies of HMAC signed requests, which may be anything
+// the signer was trusted with, are not recorded at all.
+type RequestRecorder struct {
+	next http.Handler
+	mu   sync.Mutex
+	out  io.Writer
+}
+
+func NewRequestRecorder(next http.Handler, out io.Writer) *RequestRecorder {
+	return &RequestRecorder{
+		next: next,
+		out:  out,
+	}
+}
+
+func (rr *RequestRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ex := RecordedExchange{
+		Method: r.Method,
+		Header: map[string]string{},
+	}
+	ex.URI, ex.Redacted = redactQuery(r.URL)
+	for _, h := range recordedHeaders {
+		if v := r.Header.Get(h); v != "" {
+			ex.Header[h] = v
+		}
+	}
+
+	// The body is read to be recorded, and put back for the handler
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxRecordedBody+1))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if len(body) > maxRecordedBody {
+		ex.Truncated = true
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+		body = body[:maxRecordedBody]
+	} else {
+		r.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	ex.Body = body
+
+	rec := &bodyRecorder{StatusRecorder: NewStatusRecorder(w)}
+	rr.next.ServeHTTP(rec, r)
+
+	ex.Status = rec.Status()
+	ex.ResponseType = rec.Header().Get("Content-Type")
+	ex.Response = rec.body.Bytes()
+	ex.Truncated = ex.Truncated || rec.truncated
+
+	var redacted bool
+	if strings.HasPrefix(r.Header.Get("Authorization"), hmacScheme) {
+		ex.Body, redacted = nil, len(ex.Body) > 0
+	} else {
+		ex.Body, redacted = redactBody(ex.Body, r.Header.Get("Content-Type"))
+	}
+	ex.Redacted = ex.Redacted || redacted
+	ex.Response, redacted = redactBody(ex.Response, ex.ResponseType)
+	ex.Redacted = ex.Redacted || redacted
+
+	line, err := json.Marshal(ex)
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+	// A failing recording must never fail the request itself.
+	_, _ = rr.out.Write(line)
+}
+
+// defaultReplayIgnore are JSON fields that differ between runs without any change in behaviour.
+const defaultReplayIgnore = "created_at,updated_at,last_seen_at,terms_accepted_at,referral_code,request_id"
+
+// withoutFields removes every object key in ignore from v, at any depth.
+func withoutFields(v interface{}, ignore map[string]bool) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, child := range v {
+			if ignore[k] {
+				delete(v, k)
+				continue
+			}
+			v[k] = withoutFields(child, ignore)
+		}
+	case []interface{}:
+		for i, child := range v {
+			v[i] = withoutFields(child, ignore)
+		}
+	}
+	return v
+}
+
+// sameResponse compares two response bodies, as JSON without the ignored fields when both are JSON.
+func sameResponse(want, got []byte, contentType string, ignore map[string]bool) bool {
+	if !strings.Contains(contentType, "json") {
+		return bytes.Equal(want, got)
+	}
+
+	var w, g interface{}
+	if json.Unmarshal(want, &w) != nil || json.Unmarshal(got, &g) != nil {
+		return bytes.Equal(want, got)
+	}
+	return reflect.DeepEqual(withoutFields(w, ignore), withoutFields(g, ignore))
+}
+
+// runReplayRecording implements `separation replay-recording`, which sends every recorded
+// request to another server and reports each response that differs from the recorded one.
+func runReplayRecording(args []string) error {
+	fs := flag.NewFlagSet("replay-recording", flag.ExitOnError)
+	in := fs.String("i", "", "recording to replay, defaults to stdin")
+	target := fs.String("target", "http://localhost:8080", "base URL of the server to replay against")
+	ignoreList := fs.String("ignore", defaultReplayIgnore, "comma separated JSON fields left out of the comparison")
+	fs.Parse(args)
+
+	var r io.Reader = os.Stdin
+	if *in != "" {
+		f, err := os.Open(*in)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	ignore := map[string]bool{}
+	for _, name := range parseNameList(*ignoreList) {
+		ignore[name] = true
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	base := strings.TrimSuffix(*target, "/")
+
+	var total, differed, skipped int
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, 4*maxRecordedBody)
+	for sc.Scan() {
+		var ex RecordedExchange
+		err := json.Unmarshal(sc.Bytes(), &ex)
+		if err != nil {
+			return fmt.Errorf("Line %d: %v", total+skipped+1, err)
+		}
+		if ex.Truncated || ex.Redacted {
+			skipped++
+			continue
+		}
+		total++
+
+		req, err := http.NewRequest(ex.Method, base+ex.URI, bytes.NewReader(ex.Body))
+		if err != nil {
+			return err
+		}
+		for h, v := range ex.Header {
+			req.Header.Set(h, v)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		got, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+
+		if resp.StatusCode == ex.Status && sameResponse(ex.Response, got, ex.ResponseType, ignore) {
+			continue
+		}
+		differed++
+		fmt.Printf("%s %s\n  recorded: %d %s\n  replayed: %d %s\n",
+			ex.Method, ex.URI, ex.Status, bytes.TrimSpace(ex.Response), resp.StatusCode, bytes.TrimSpace(got))
+	}
+	if err := sc.Err(); err != nil {
+		return err
+	}
+
+	fmt.Printf("Replayed %d requests, %d differed, %d skipped as truncated or redacted\n", total, differed, skipped)
+	if differed > 0 {
+		return errors.New("Replayed responses differ from the recording")
+	}
+	return nil
+}
@@ -0,0 +1,120 @@
+package separation
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// TestRequestRecorderRedactsSecrets records exchanges carrying credentials and checks
+// that none of them reach the recording.
+func TestRequestRecorderRedactsSecrets(t *testing.T) {
+	const secret = "s3cr3t-value"
+	echo := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		body, _ := io.ReadAll(r.Body)
+		if len(body) == 0 {
+			body = []byte(`{}`)
+		}
+		w.Write(body)
+	})
+
+	tests := []struct {
+		name        string
+		method      string
+		target      string
+		header      map[string]string
+		body        string
+		wantURI     string
+		wantBody    string
+		wantRedacts bool
+	}{
+		{
+			name:        "magic link callback",
+			method:      http.MethodGet,
+			target:      "/login/magic/callback?token=" + secret,
+			wantURI:     "/login/magic/callback?token=REDACTED",
+			wantRedacts: true,
+		},
+		{
+			name:        "organization token",
+			method:      http.MethodPost,
+			target:      "/orgs/acme/tokens",
+			header:      map[string]string{"Content-Type": "application/json"},
+			body:        `{"scopes":["read:users"],"token":"` + secret + `"}`,
+			wantURI:     "/orgs/acme/tokens",
+			wantBody:    `{"scopes":["read:users"],"token":"REDACTED"}`,
+			wantRedacts: true,
+		},
+		{
+			name:        "nested invite token",
+			method:      http.MethodPost,
+			target:      "/register",
+			header:      map[string]string{"Content-Type": "application/json"},
+			body:        `{"email":"a@example.com","extra":[{"invite_token":"` + secret + `"}]}`,
+			wantURI:     "/register",
+			wantBody:    `{"email":"a@example.com","extra":[{"invite_token":"REDACTED"}]}`,
+			wantRedacts: true,
+		},
+		{
+			name:        "HMAC signed",
+			method:      http.MethodPost,
+			target:      "/register",
+			header:      map[string]string{"Content-Type": "application/json", "Authorization": hmacScheme + "key=k,signature=" + secret},
+			body:        `{"email":"` + secret + `@example.com"}`,
+			wantURI:     "/register",
+			wantRedacts: true,
+		},
+		{
+			name:        "protobuf",
+			method:      http.MethodPost,
+			target:      "/register",
+			header:      map[string]string{"Content-Type": protobufContentType},
+			body:        "\n\x0da@example.com\x22\x0c" + secret,
+			wantURI:     "/register",
+			wantRedacts: true,
+		},
+		{
+			name:     "nothing secret",
+			method:   http.MethodPost,
+			target:   "/register?dry_run=true",
+			header:   map[string]string{"Content-Type": "application/json"},
+			body:     `{"email":"a@example.com","name":"A"}`,
+			wantURI:  "/register?dry_run=true",
+			wantBody: `{"email":"a@example.com","name":"A"}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			rr := NewRequestRecorder(echo, &out)
+			r := httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body))
+			for k, v := range tt.header {
+				r.Header.Set(k, v)
+			}
+			rr.ServeHTTP(httptest.NewRecorder(), r)
+
+			if strings.Contains(out.String(), secret) {
+				t.Fatalf("Recorded the secret: %s", out.String())
+			}
+			var ex RecordedExchange
+			err := json.Unmarshal(out.Bytes(), &ex)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ex.URI != tt.wantURI {
+				t.Errorf("Recorded %s, want %s", ex.URI, tt.wantURI)
+			}
+			if string(ex.Body) != tt.wantBody {
+				t.Errorf("Recorded the body %s, want %s", ex.Body, tt.wantBody)
+			}
+			if ex.Redacted != tt.wantRedacts {
+				t.Errorf("Recorded redacted as %v, want %v", ex.Redacted, tt.wantRedacts)
+			}
+		})
+	}
+}
@@ -0,0 +1,231 @@
+package separation
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/oralordos/separation/internal/principal"
+)
+
+// Business Logic
+var ErrReferralCodeInvalid error = NewValidationError("Referral code does not belong to any user")
+
+// referralAlphabet leaves out letters and digits that are easily confused, such as O and 0.
+const (
+	referralAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+	referralCodeLen  = 8
+)
+
+// newReferralCode returns a random code of referralCodeLen characters from referralAlphabet.
+func newReferralCode() (string, error) {
+	b := make([]byte, referralCodeLen)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	for i := range b {
+		// The alphabet has 32 characters, so this keeps the choice uniform
+		b[i] = referralAlphabet[int(b[i])%len(referralAlphabet)]
+	}
+	return string(b), nil
+}
+
+// normalizeReferralCode uppercases code, so codes read out or typed in lowercase still work.
+func normalizeReferralCode(code string) string {
+	return strings.ToUpper(strings.TrimSpace(code))
+}
+
+// UserReferred is published when a user registers with another user's referral code.
+type UserReferred struct {
+	Referrer Email     `json:"referrer"`
+	Referred Email     `json:"referred"`
+	At       time.Time `json:"at"`
+}
+
+func (ur *UserReferred) EventName() string {
+	return "UserReferred"
+}
+
+// userByReferralCode scans every user. Codes are only looked up when registering
+// with one, which is rare enough that an index is not worth keeping.
+// It may return an ErrReferralCodeInvalid error.
+func userByReferralCode(ctx context.Context, us UserStorer, code string) (*User, error) {
+	code = normalizeReferralCode(code)
+	users, err := us.List(ctx, LabelSelector{})
+	if err != nil {
+		return nil, err
+	}
+	for _, u := range users {
+		if u.ReferralCode == code {
+			return u, nil
+		}
+	}
+	return nil, ErrReferralCodeInvalid
+}
+
+// uniqueReferralCode returns a code no user has yet.
+func uniqueReferralCode(ctx context.Context, us UserStorer) (string, error) {
+	for i := 0; i < 5; i++ {
+		code, err := newReferralCode()
+		if err != nil {
+			return "", err
+		}
+
+		_, err = userByReferralCode(ctx, us, code)
+		if err == ErrReferralCodeInvalid {
+			return code, nil
+		} else if err != nil {
+			return "", err
+		}
+	}
+	return "", errors.New("Unable to find an unused referral code")
+}
+
+type GetReferralsQuery struct {
+	Email Email
+}
+
+func (gq *GetReferralsQuery) QueryName() string {
+	return "GetReferrals"
+}
+
+// IssueReferralCodeParams give a user who registered before referral codes existed a code.
+type IssueReferralCodeParams struct {
+	Email Email
+}
+
+func (ip *IssueReferralCodeParams) CommandName() string {
+	return "IssueReferralCode"
+}
+
+func (ip *IssueReferralCodeParams) Validate() error {
+	if ip.Email.IsZero() {
+		return ErrEmailEmpty
+	}
+	return nil
+}
+
+// ReferredUser is what a referrer may see of the users they referred.
+type ReferredUser struct {
+	Email     Email     `json:"email"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type Referrals struct {
+	// Code is empty if the user has not been issued one yet
+	Code  string          `json:"code"`
+	Count int             `json:"count"`
+	Users []*ReferredUser `json:"users"`
+}
+
+type ReferralHandler struct {
+	userStorage UserStorer
+	updates     *UserUpdater
+}
+
+func NewReferralHandler(us UserStorer, updates *UserUpdater) *ReferralHandler {
+	return &ReferralHandler{
+		userStorage: us,
+		updates:     updates,
+	}
+}
+
+// Get lists the users a user referred, oldest first.
+func (rh *ReferralHandler) Get(ctx context.Context, q Query) (interface{}, error) {
+	query, ok := q.(*GetReferralsQuery)
+	if !ok {
+		return nil, fmt.Errorf("ReferralHandler cannot get %T", q)
+	}
+
+	err := requireSelfOrAdmin(ctx, query.Email)
+	if err != nil {
+		return nil, err
+	}
+
+	u, err := rh.userStorage.Get(ctx, query.Email)
+	if err != nil {
+		return nil, err
+	}
+
+	users, err := rh.userStorage.List(ctx, LabelSelector{})
+	if err != nil {
+		return nil, err
+	}
+
+	referrals := &Referrals{Code: u.ReferralCode, Users: []*ReferredUser{}}
+	for _, other := range users {
+		if other.ReferredBy != nil && *other.ReferredBy == u.Email {
+			referrals.Users = append(referrals.Users, &ReferredUser{
+				Email:     other.Email,
+				Name:      other.Name,
+				CreatedAt: other.CreatedAt,
+			})
+		}
+	}
+	sort.Slice(referrals.Users, func(i, j int) bool {
+		return referrals.Users[i].CreatedAt.Before(referrals.Users[j].CreatedAt)
+	})
+	referrals.Count = len(referrals.Users)
+	return referrals, nil
+}
+
+func (rh *ReferralHandler) Issue(ctx context.Context, cmd Command) error {
+	params, ok := cmd.(*IssueReferralCodeParams)
+	if !ok {
+		return fmt.Errorf("ReferralHandler cannot issue %T", cmd)
+	}
+
+	err := requireSelfOrAdmin(ctx, params.Email)
+	if err != nil {
+		return err
+	}
+
+	return rh.updates.Update(ctx, params.Email, func(u *User) (bool, error) {
+		if u.ReferralCode != "" {
+			return false, nil
+		}
+
+		code, err := uniqueReferralCode(ctx, rh.userStorage)
+		if err != nil {
+			return false, err
+		}
+		u.ReferralCode = code
+		return true, nil
+	})
+}
+
+// Access Layer
+// MyReferrals serves GET /me/referrals with the caller's referral code and the users they referred.
+func (j *JsonOverHTTP) MyReferrals(w http.ResponseWriter, r *http.Request) {
+	p, ok := principal.FromContext(r.Context())
+	if !ok || p.Email == "" {
+		writeError(w, r, ErrUnauthenticated)
+		return
+	}
+	email, err := ParseEmail(p.Email)
+	if err != nil {
+		writeError(w, r, ErrUnauthenticated)
+		return
+	}
+
+	referrals, err := j.usrServ.Referrals(r.Context(), email)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(referrals)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+}
@@ -0,0 +1,138 @@
+package separation
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Business Logic
+// PreRegisterHook runs before a user is saved. It may veto the registration by
+// returning an error, or augment it by changing params, such as by adding Labels.
+// It also runs for dry runs, which it can tell by params.DryRun.
+type PreRegisterHook interface {
+	BeforeRegister(ctx context.Context, params *RegisterParams) error
+}
+
+// PostRegisterHook runs after a user is saved. The registration has already
+// happened, so its errors are only reported. It must not change u.
+type PostRegisterHook interface {
+	AfterRegister(ctx context.Context, u *User) error
+}
+
+type PreRegisterHookFunc func(ctx context.Context, params *RegisterParams) error
+
+func (f PreRegisterHookFunc) BeforeRegister(ctx context.Context, params *RegisterParams) error {
+	return f(ctx, params)
+}
+
+type PostRegisterHookFunc func(ctx context.Context, u *User) error
+
+func (f PostRegisterHookFunc) AfterRegister(ctx context.Context, u *User) error {
+	return f(ctx, u)
+}
+
+// RegisterVetoError is returned by a PreRegisterHook to refuse a registration.
+// Reason is shown to the client.
+type RegisterVetoError struct {
+	Reason string
+}
+
+func init() {
+	registerErrorType[*RegisterVetoError]("registration_vetoed", http.StatusForbidden, "A registration check refused the registration, the message says why")
+}
+
+func (ve *RegisterVetoError) Error() string {
+	return ve.Reason
+}
+
+var (
+	ErrRegisterHookFailed  = registerError(errors.New("Registration could not be checked, try again later"), "registration_check_failed", http.StatusServiceUnavailable, "A registration check failed, retrying later may succeed")
+	ErrRegisterHookTimeout = registerError(errors.New("Registration checks took too long, try again later"), "registration_check_timeout", http.StatusGatewayTimeout, "A registration check took too long, retrying later may succeed")
+)
+
+// RegisterHooks let an embedder veto or augment registrations without forking the service.
+// Pre hooks run in order once params are valid, before the service's own checks, and the
+// first error stops the registration. Post hooks all run, in order, once the user is saved.
+type RegisterHooks struct {
+	Pre  []PreRegisterHook
+	Post []PostRegisterHook
+	// Timeout bounds each hook. Zero leaves them to the caller's deadline.
+	Timeout time.Duration
+	// OnError is called with hook errors the client is not shown, which are those of post
+	// hooks and the failures of pre hooks other than vetoes. They are dropped when it is nil.
+	OnError func(ctx context.Context, err error)
+}
+
+// runHook runs f with the hook timeout. A hook that overruns is abandoned rather than
+// waited for, so it must not assume its work is wanted once ctx is done.
+func (rh *RegisterHooks) runHook(ctx context.Context, f func(context.Context) error) error {
+	hookCtx := ctx
+	if rh.Timeout > 0 {
+		var cancel context.CancelFunc
+		hookCtx, cancel = context.WithTimeout(ctx, rh.Timeout)
+		defer cancel()
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- f(hookCtx)
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil && hookCtx.Err() == context.DeadlineExceeded && ctx.Err() == nil {
+			return ErrRegisterHookTimeout
+		}
+		return err
+	case <-hookCtx.Done():
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return ErrRegisterHookTimeout
+	}
+}
+
+// before runs the pre hooks. Vetoes, validation errors and timeouts reach the client as they are,
+// while any other error is answered with ErrRegisterHookFailed so hook internals do not leak.
+func (rh *RegisterHooks) before(ctx context.Context, params *RegisterParams) error {
+	for _, h := range rh.Pre {
+		err := rh.runHook(ctx, func(ctx context.Context) error {
+			return h.BeforeRegister(ctx, params)
+		})
+		if err == nil {
+			continue
+		}
+
+		var veto *RegisterVetoError
+		var invalid *ValidationError
+		switch {
+		case errors.As(err, &veto), errors.As(err, &invalid):
+			return err
+		case err == ErrRegisterHookTimeout, err == ctx.Err():
+			return err
+		}
+		rh.report(ctx, fmt.Errorf("Pre-register hook for %s: %w", params.Email, err))
+		return ErrRegisterHookFailed
+	}
+	return nil
+}
+
+func (rh *RegisterHooks) after(ctx context.Context, u *User) {
+	for _, h := range rh.Post {
+		err := rh.runHook(ctx, func(ctx context.Context) error {
+			return h.AfterRegister(ctx, u)
+		})
+		if err != nil {
+			rh.report(ctx, fmt.Errorf("Post-register hook for %s: %w", u.Email, err))
+		}
+	}
+}
+
+func (rh *RegisterHooks) report(ctx context.Context, err error) {
+	if rh.OnError != nil {
+		rh.OnError(ctx, err)
+	}
+}
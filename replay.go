@@ -0,0 +1,129 @@
+package separation
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oralordos/separation/internal/clock"
+)
+
+// Access Layer
+var (
+	ErrNonceRequired   = registerError(errors.New("Requests to this endpoint need X-Request-Nonce and X-Request-Timestamp headers"), "nonce_required", http.StatusBadRequest, "The endpoint requires X-Request-Nonce and X-Request-Timestamp headers")
+	ErrStaleRequest    = registerError(errors.New("The request timestamp is too far from the server's time"), "request_stale", http.StatusUnauthorized, "The X-Request-Timestamp is too far from the server's time")
+	ErrReplayedRequest = registerError(errors.New("The request nonce has already been used"), "request_replayed", http.StatusConflict, "The X-Request-Nonce has already been used")
+)
+
+// NonceStore remembers nonces for as long as a request carrying them could still be accepted.
+type NonceStore interface {
+	// Remember records nonce for ttl, and returns false if it was already recorded
+	Remember(ctx context.Context, nonce string, ttl time.Duration) (bool, error)
+}
+
+// MemoryNonceStore keeps nonces in memory, so it only protects a single instance.
+type MemoryNonceStore struct {
+	clk clock.Clock
+
+	mu        sync.Mutex
+	expires   map[string]time.Time
+	nextSweep time.Time
+}
+
+func NewMemoryNonceStore(clk clock.Clock) *MemoryNonceStore {
+	return &MemoryNonceStore{
+		clk:     clk,
+		expires: map[string]time.Time{},
+	}
+}
+
+func (ms *MemoryNonceStore) Remember(ctx context.Context, nonce string, ttl time.Duration) (bool, error) {
+	now := ms.clk.Now()
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	// Expired nonces are swept at most once per ttl, which keeps the cost off most requests
+	if now.After(ms.nextSweep) {
+		for n, exp := range ms.expires {
+			if now.After(exp) {
+				delete(ms.expires, n)
+			}
+		}
+		ms.nextSweep = now.Add(ttl)
+	}
+
+	if exp, ok := ms.expires[nonce]; ok && !now.After(exp) {
+		return false, nil
+	}
+	ms.expires[nonce] = now.Add(ttl)
+	return true, nil
+}
+
+// ReplayGuard rejects requests to the protected paths unless they carry a fresh timestamp
+// and a nonce not seen before, so a captured request cannot be sent again.
+// It only protects requests whose signature covers both headers.
+type ReplayGuard struct {
+	next     http.Handler
+	store    NonceStore
+	window   time.Duration
+	prefixes []string
+	clk      clock.Clock
+}
+
+// NewReplayGuard accepts timestamps up to window either side of the server's time
+// on paths starting with any of prefixes. Other paths are let through untouched.
+func NewReplayGuard(next http.Handler, store NonceStore, window time.Duration, prefixes []string, clk clock.Clock) *ReplayGuard {
+	return &ReplayGuard{
+		next:     next,
+		store:    store,
+		window:   window,
+		prefixes: prefixes,
+		clk:      clk,
+	}
+}
+
+func (rg *ReplayGuard) protects(path string) bool {
+	for _, p := range rg.prefixes {
+		if strings.HasPrefix(path, p) {
+			return true
+		}
+	}
+	return false
+}
+
+func (rg *ReplayGuard) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !rg.protects(r.URL.Path) {
+		rg.next.ServeHTTP(w, r)
+		return
+	}
+
+	nonce := r.Header.Get("X-Request-Nonce")
+	ts, err := strconv.ParseInt(r.Header.Get("X-Request-Timestamp"), 10, 64)
+	if len(nonce) < 16 || len(nonce) > 128 || err != nil {
+		writeError(w, r, ErrNonceRequired)
+		return
+	}
+
+	skew := rg.clk.Now().Sub(time.Unix(ts, 0))
+	if skew > rg.window || skew < -rg.window {
+		writeError(w, r, ErrStaleRequest)
+		return
+	}
+
+	// A nonce outlives every timestamp it could be accepted with
+	fresh, err := rg.store.Remember(r.Context(), nonce, 2*rg.window)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if !fresh {
+		writeError(w, r, ErrReplayedRequest)
+		return
+	}
+	rg.next.ServeHTTP(w, r)
+}
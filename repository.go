@@ -0,0 +1,179 @@
+package separation
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// Action Layer
+var ErrNotFound = errors.New("Not found")
+
+// Repository is the storage pattern shared by every entity.
+// Entity specific storers are built on top of it so each new entity
+// does not need a fresh storage implementation per backend.
+type Repository[K comparable, T any] interface {
+	// Get may return an ErrNotFound error
+	Get(ctx context.Context, key K) (T, error)
+	Save(ctx context.Context, value T) error
+	// Delete may return an ErrNotFound error
+	Delete(ctx context.Context, key K) error
+	// List returns every value in no particular order
+	List(ctx context.Context) ([]T, error)
+}
+
+// MemoryRepository keeps values in a map, keyed by the key function given to it.
+//
+// List works on a copy-on-write snapshot: it marks the current map as shared
+// and iterates it without holding the lock, and the next write copies the map
+// before changing it. Listing therefore sees a consistent view without blocking
+// writers, and writers only pay for a copy once per List rather than per write.
+type MemoryRepository[K comparable, T any] struct {
+	keyOf func(T) K
+
+	mu     sync.RWMutex
+	store  map[K]T
+	shared bool
+}
+
+func NewMemoryRepository[K comparable, T any](keyOf func(T) K) *MemoryRepository[K, T] {
+	return &MemoryRepository[K, T]{
+		keyOf: keyOf,
+		store: map[K]T{},
+	}
+}
+
+func (mr *MemoryRepository[K, T]) Get(ctx context.Context, key K) (T, error) {
+	mr.mu.RLock()
+	defer mr.mu.RUnlock()
+
+	if v, ok := mr.store[key]; ok {
+		return v, nil
+	}
+	var zero T
+	return zero, ErrNotFound
+}
+
+// writable must be called with mu held for writing.
+func (mr *MemoryRepository[K, T]) writable() map[K]T {
+	if mr.shared {
+		store := make(map[K]T, len(mr.store))
+		for k, v := range mr.store {
+			store[k] = v
+		}
+		mr.store = store
+		mr.shared = false
+	}
+	return mr.store
+}
+
+func (mr *MemoryRepository[K, T]) Save(ctx context.Context, value T) error {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	mr.writable()[mr.keyOf(value)] = value
+	return nil
+}
+
+func (mr *MemoryRepository[K, T]) Delete(ctx context.Context, key K) error {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	if _, ok := mr.store[key]; !ok {
+		return ErrNotFound
+	}
+	delete(mr.writable(), key)
+	return nil
+}
+
+// snapshot returns a map that no writer will change again.
+func (mr *MemoryRepository[K, T]) snapshot() map[K]T {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	mr.shared = true
+	return mr.store
+}
+
+func (mr *MemoryRepository[K, T]) List(ctx context.Context) ([]T, error) {
+	store := mr.snapshot()
+
+	values := make([]T, 0, len(store))
+	for _, v := range store {
+		values = append(values, v)
+	}
+	return values, nil
+}
+
+// ShardedMemoryRepository spreads values over several MemoryRepository shards,
+// each with its own lock, so concurrent writers to different keys rarely contend.
+// List locks every shard at once to take their snapshots, so it sees the values as
+// they were at a single moment, as an unsharded MemoryRepository would.
+type ShardedMemoryRepository[K comparable, T any] struct {
+	shards []*MemoryRepository[K, T]
+	hashOf func(K) uint64
+}
+
+func NewShardedMemoryRepository[K comparable, T any](n int, keyOf func(T) K, hashOf func(K) uint64) *ShardedMemoryRepository[K, T] {
+	if n < 1 {
+		n = 1
+	}
+
+	shards := make([]*MemoryRepository[K, T], n)
+	for i := range shards {
+		shards[i] = NewMemoryRepository(keyOf)
+	}
+	return &ShardedMemoryRepository[K, T]{
+		shards: shards,
+		hashOf: hashOf,
+	}
+}
+
+func (sr *ShardedMemoryRepository[K, T]) shard(key K) *MemoryRepository[K, T] {
+	return sr.shards[sr.hashOf(key)%uint64(len(sr.shards))]
+}
+
+func (sr *ShardedMemoryRepository[K, T]) Get(ctx context.Context, key K) (T, error) {
+	return sr.shard(key).Get(ctx, key)
+}
+
+func (sr *ShardedMemoryRepository[K, T]) Save(ctx context.Context, value T) error {
+	return sr.shard(sr.shards[0].keyOf(value)).Save(ctx, value)
+}
+
+func (sr *ShardedMemoryRepository[K, T]) Delete(ctx context.Context, key K) error {
+	return sr.shard(key).Delete(ctx, key)
+}
+
+// snapshot returns a map per shard that no writer will change again. Writers lock a
+// single shard, and shards are always locked in the same order, so this cannot deadlock.
+func (sr *ShardedMemoryRepository[K, T]) snapshot() []map[K]T {
+	for _, s := range sr.shards {
+		s.mu.Lock()
+	}
+	stores := make([]map[K]T, len(sr.shards))
+	for i, s := range sr.shards {
+		s.shared = true
+		stores[i] = s.store
+	}
+	for _, s := range sr.shards {
+		s.mu.Unlock()
+	}
+	return stores
+}
+
+func (sr *ShardedMemoryRepository[K, T]) List(ctx context.Context) ([]T, error) {
+	stores := sr.snapshot()
+
+	n := 0
+	for _, store := range stores {
+		n += len(store)
+	}
+	values := make([]T, 0, n)
+	for _, store := range stores {
+		for _, v := range store {
+			values = append(values, v)
+		}
+	}
+	return values, nil
+}
@@ -0,0 +1,172 @@
+package separation
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// lockedListRepository lists by copying the map with the read lock held, as MemoryRepository
+// did before it listed copy-on-write snapshots. It is the baseline of the List benchmarks.
+type lockedListRepository struct {
+	*MemoryRepository[int, int]
+}
+
+func (lr lockedListRepository) List(ctx context.Context) ([]int, error) {
+	lr.mu.RLock()
+	defer lr.mu.RUnlock()
+
+	values := make([]int, 0, len(lr.store))
+	for _, v := range lr.store {
+		values = append(values, v)
+	}
+	return values, nil
+}
+
+func identity(v int) int { return v }
+
+// benchmarkList lists repo, holding size values, while writers save into it as fast as
+// they can. It reports the saves made per List, as a measure of how much listing gets in
+// the writers' way.
+func benchmarkList(b *testing.B, repo Repository[int, int], size, writers int) {
+	ctx := context.Background()
+	for i := 0; i < size; i++ {
+		repo.Save(ctx, i)
+	}
+
+	var saves int64
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := w; ; i += writers {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				repo.Save(ctx, i%size)
+				atomic.AddInt64(&saves, 1)
+			}
+		}(w)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := repo.List(ctx)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+	close(stop)
+	wg.Wait()
+	b.ReportMetric(float64(atomic.LoadInt64(&saves))/float64(b.N), "saves/op")
+}
+
+func benchmarkListSizes(b *testing.B, newRepo func() Repository[int, int]) {
+	for _, size := range []int{1000, 100000} {
+		for _, writers := range []int{0, 1, 4} {
+			b.Run(fmt.Sprintf("size=%d/writers=%d", size, writers), func(b *testing.B) {
+				benchmarkList(b, newRepo(), size, writers)
+			})
+		}
+	}
+}
+
+func BenchmarkMemoryRepositoryListCopyOnWrite(b *testing.B) {
+	benchmarkListSizes(b, func() Repository[int, int] {
+		return NewMemoryRepository(identity)
+	})
+}
+
+func BenchmarkMemoryRepositoryListLocked(b *testing.B) {
+	benchmarkListSizes(b, func() Repository[int, int] {
+		return lockedListRepository{NewMemoryRepository(identity)}
+	})
+}
+
+// versioned is a value whose key is saved again and again with a growing version.
+type versioned struct {
+	key, version int
+}
+
+// TestShardedMemoryRepositoryListIsConsistent saves a value to one shard and then a
+// value of the same version to another, over and over, while listing. A List that saw
+// the second shard's newer value along with the first shard's older one would show a
+// moment that never was.
+func TestShardedMemoryRepositoryListIsConsistent(t *testing.T) {
+	const (
+		padding = 20000
+		lists   = 50
+	)
+	ctx := context.Background()
+	repo := NewShardedMemoryRepository(2, func(v versioned) int {
+		return v.key
+	}, func(k int) uint64 {
+		return uint64(k)
+	})
+	// Padding makes each shard slow to list, so the writer has time to run in between
+	for k := 2; k < 2+2*padding; k++ {
+		repo.Save(ctx, versioned{key: k})
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for v := 1; ; v++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			repo.Save(ctx, versioned{key: 0, version: v})
+			repo.Save(ctx, versioned{key: 1, version: v})
+		}
+	}()
+	defer func() {
+		close(stop)
+		<-done
+	}()
+
+	for i := 0; i < lists; i++ {
+		values, err := repo.List(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		versions := map[int]int{}
+		for _, v := range values {
+			versions[v.key] = v.version
+		}
+		if versions[1] > versions[0] {
+			t.Fatalf("List saw version %d on the second shard but only version %d on the first", versions[1], versions[0])
+		}
+	}
+}
+
+// BenchmarkShardedMemoryRepository saves and gets values from every processor at once,
+// to show how contention falls as shards are added.
+func BenchmarkShardedMemoryRepository(b *testing.B) {
+	for _, shards := range []int{1, 2, 4, 8, 16, 32} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			ctx := context.Background()
+			repo := NewShardedMemoryRepository(shards, identity, func(k int) uint64 {
+				return uint64(k)
+			})
+			var next int64
+			b.RunParallel(func(pb *testing.PB) {
+				i := int(atomic.AddInt64(&next, 1)) * 7919
+				for pb.Next() {
+					i++
+					repo.Save(ctx, i%10000)
+					repo.Get(ctx, (i*31)%10000)
+				}
+			})
+		})
+	}
+}
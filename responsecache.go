@@ -0,0 +1,256 @@
+package separation
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oralordos/separation/internal/clock"
+	"github.com/oralordos/separation/internal/principal"
+)
+
+// Business Logic
+// UsersChanged is published after users are saved or deleted.
+type UsersChanged struct {
+	Emails []Email `json:"emails"`
+}
+
+func (uc *UsersChanged) EventName() string {
+	return "UsersChanged"
+}
+
+// Action Layer
+// UserChangePublisher is a UserStorer decorator that publishes UsersChanged once a save,
+// insert or delete has succeeded, so anything derived from many users can be dropped.
+type UserChangePublisher struct {
+	next   UserStorer
+	events *EventBus
+}
+
+func NewUserChangePublisher(next UserStorer, events *EventBus) *UserChangePublisher {
+	return &UserChangePublisher{
+		next:   next,
+		events: events,
+	}
+}
+
+func (up *UserChangePublisher) Get(ctx context.Context, email Email) (*User, error) {
+	return up.next.Get(ctx, email)
+}
+
+func (up *UserChangePublisher) GetByUsername(ctx context.Context, username Username) (*User, error) {
+	return up.next.GetByUsername(ctx, username)
+}
+
+func (up *UserChangePublisher) List(ctx context.Context, sel LabelSelector) ([]*User, error) {
+	return up.next.List(ctx, sel)
+}
+
+func (up *UserChangePublisher) ListFiltered(ctx context.Context, sel LabelSelector, f Filter) ([]*User, error) {
+	return listFiltered(ctx, up.next, sel, f)
+}
+
+func (up *UserChangePublisher) Save(ctx context.Context, user *User) error {
+	err := up.next.Save(ctx, user)
+	if err != nil {
+		return err
+	}
+	up.events.Publish(ctx, &UsersChanged{Emails: []Email{user.Email}})
+	return nil
+}
+
+func (up *UserChangePublisher) Insert(ctx context.Context, user *User) error {
+	err := up.next.Insert(ctx, user)
+	if err != nil {
+		return err
+	}
+	up.events.Publish(ctx, &UsersChanged{Emails: []Email{user.Email}})
+	return nil
+}
+
+// Delete publishes even when it fails, as some of the users may have been deleted.
+func (up *UserChangePublisher) Delete(ctx context.Context, emails []Email) (int, error) {
+	n, err := up.next.Delete(ctx, emails)
+	if n > 0 || err != nil {
+		up.events.Publish(ctx, &UsersChanged{Emails: emails})
+	}
+	return n, err
+}
+
+// Access Layer
+// responseCacheMaxEntries bounds the memory a flood of distinct queries can take.
+const responseCacheMaxEntries = 1000
+
+// responseCacheVary are the request headers the cached responses depend on, besides the query.
+var responseCacheVary = []string{"Accept", "Accept-Language"}
+
+type cachedResponse struct {
+	header  http.Header
+	body    []byte
+	etag    string
+	expires time.Time
+}
+
+// ResponseCache keeps successful GET responses for ttl, keyed by the caller, the path, the
+// normalized query string and the headers in responseCacheVary, so one caller or tenant is
+// never served another's response. It subscribes to UsersChanged and drops every response
+// when users change, as a listing may depend on any of them. Changes made through other
+// instances are only seen once ttl has passed.
+//
+// Every response carries an ETag and the configured Cache-Control, and a request whose
+// If-None-Match holds the ETag is answered with 304 Not Modified.
+type ResponseCache struct {
+	ttl          time.Duration
+	cacheControl string
+	clk          clock.Clock
+
+	mu      sync.Mutex
+	entries map[string]*cachedResponse
+	// generation grows on every purge, so a response rendered before a change is not stored after it
+	generation uint64
+}
+
+func NewResponseCache(ttl time.Duration, cacheControl string, clk clock.Clock) *ResponseCache {
+	return &ResponseCache{
+		ttl:          ttl,
+		cacheControl: cacheControl,
+		clk:          clk,
+		entries:      map[string]*cachedResponse{},
+	}
+}
+
+// HandleEvent drops every cached response.
+func (rc *ResponseCache) HandleEvent(ctx context.Context, e Event) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.entries = map[string]*cachedResponse{}
+	rc.generation++
+}
+
+// responseCacheKey identifies a response by who asked for it and what they asked.
+// Query parameters are sorted by name, keeping the order of repeated values.
+func responseCacheKey(r *http.Request) string {
+	var b strings.Builder
+	if p, ok := principal.FromContext(r.Context()); ok {
+		b.WriteString(p.Scheme + "\x00" + p.Subject + "\x00" + p.Org)
+	}
+	b.WriteString("\x00" + r.URL.Path + "?" + r.URL.Query().Encode())
+	for _, h := range responseCacheVary {
+		b.WriteString("\x00" + r.Header.Get(h))
+	}
+	return b.String()
+}
+
+func (rc *ResponseCache) lookup(key string) (*cachedResponse, uint64) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	cr, ok := rc.entries[key]
+	if ok && !rc.clk.Now().Before(cr.expires) {
+		delete(rc.entries, key)
+		cr = nil
+	}
+	return cr, rc.generation
+}
+
+func (rc *ResponseCache) store(key string, cr *cachedResponse, generation uint64) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if generation != rc.generation {
+		return
+	}
+	if len(rc.entries) >= responseCacheMaxEntries {
+		now := rc.clk.Now()
+		for k, e := range rc.entries {
+			if !now.Before(e.expires) {
+				delete(rc.entries, k)
+			}
+		}
+		if len(rc.entries) >= responseCacheMaxEntries {
+			return
+		}
+	}
+	rc.entries[key] = cr
+}
+
+// bufferedResponse holds a handler's response until it is known whether it can be cached.
+type bufferedResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (br *bufferedResponse) Header() http.Header {
+	return br.header
+}
+
+func (br *bufferedResponse) WriteHeader(status int) {
+	if br.status == 0 {
+		br.status = status
+	}
+}
+
+func (br *bufferedResponse) Write(b []byte) (int, error) {
+	if br.status == 0 {
+		br.status = http.StatusOK
+	}
+	return br.body.Write(b)
+}
+
+// Wrap caches the GET responses of next.
+func (rc *ResponseCache) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		key := responseCacheKey(r)
+		cr, generation := rc.lookup(key)
+		if cr == nil {
+			br := &bufferedResponse{header: http.Header{}}
+			next.ServeHTTP(br, r)
+			if br.status != http.StatusOK {
+				for k, v := range br.header {
+					w.Header()[k] = v
+				}
+				w.WriteHeader(br.status)
+				_, _ = w.Write(br.body.Bytes())
+				return
+			}
+
+			sum := sha256.Sum256(br.body.Bytes())
+			cr = &cachedResponse{
+				header:  br.header,
+				body:    br.body.Bytes(),
+				etag:    `"` + hex.EncodeToString(sum[:16]) + `"`,
+				expires: rc.clk.Now().Add(rc.ttl),
+			}
+			rc.store(key, cr, generation)
+		}
+		rc.serve(w, r, cr)
+	})
+}
+
+func (rc *ResponseCache) serve(w http.ResponseWriter, r *http.Request, cr *cachedResponse) {
+	for k, v := range cr.header {
+		w.Header()[k] = v
+	}
+	w.Header().Set("ETag", cr.etag)
+	w.Header().Set("Cache-Control", rc.cacheControl)
+	w.Header().Set("Vary", strings.Join(responseCacheVary, ", "))
+
+	for _, tag := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == cr.etag || tag == "W/"+cr.etag || tag == "*" {
+			w.Header().Del("Content-Type")
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+	_, _ = w.Write(cr.body)
+}
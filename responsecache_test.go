@@ -0,0 +1,81 @@
+package separation
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/oralordos/separation/internal/clock/clocktest"
+	"github.com/oralordos/separation/internal/principal"
+)
+
+func TestResponseCache(t *testing.T) {
+	ctx := context.Background()
+	clk := clocktest.NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	events := NewEventBus()
+	rc := NewResponseCache(time.Minute, "private, no-cache", clk)
+	events.Subscribe("UsersChanged", rc)
+	us := NewUserChangePublisher(NewMemoryUserStorage(), events)
+
+	calls := 0
+	handler := rc.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		users, err := us.List(r.Context(), LabelSelector{})
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(users)
+	}))
+	get := func(subject, target, etag string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, target, nil)
+		r = r.WithContext(principal.NewContext(r.Context(), &principal.Principal{Subject: subject, Scheme: "test"}))
+		if etag != "" {
+			r.Header.Set("If-None-Match", etag)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+	expect := func(w *httptest.ResponseRecorder, status, wantCalls int) {
+		t.Helper()
+		if w.Code != status || calls != wantCalls {
+			t.Fatalf("Got %d after %d calls to the handler, want %d after %d", w.Code, calls, status, wantCalls)
+		}
+	}
+
+	first := get("admin", "/users?sort=name&selector=env%3Dprod", "")
+	expect(first, http.StatusOK, 1)
+	etag := first.Header().Get("ETag")
+	if etag == "" || first.Header().Get("Cache-Control") != "private, no-cache" {
+		t.Fatalf("Got the headers %v", first.Header())
+	}
+
+	// The same query in another order is served from the cache, and revalidates
+	expect(get("admin", "/users?selector=env%3Dprod&sort=name", ""), http.StatusOK, 1)
+	expect(get("admin", "/users?selector=env%3Dprod&sort=name", etag), http.StatusNotModified, 1)
+
+	// Another caller is never served the first caller's response
+	expect(get("other", "/users?sort=name&selector=env%3Dprod", ""), http.StatusOK, 2)
+
+	// A save drops the cached listings, and the new one has another ETag
+	email, _ := ParseEmail("a@example.com")
+	err := us.Save(ctx, &User{Email: email})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := get("admin", "/users?sort=name&selector=env%3Dprod", etag)
+	expect(w, http.StatusOK, 3)
+	if w.Header().Get("ETag") == etag {
+		t.Errorf("The ETag %s did not change with the users", etag)
+	}
+
+	// Responses expire after the TTL
+	expect(get("admin", "/users?sort=name&selector=env%3Dprod", ""), http.StatusOK, 3)
+	clk.Advance(time.Minute)
+	expect(get("admin", "/users?sort=name&selector=env%3Dprod", ""), http.StatusOK, 4)
+}
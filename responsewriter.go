@@ -0,0 +1,88 @@
+package separation
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+)
+
+// Access Layer
+// StatusRecorder wraps a ResponseWriter to capture the status code and body size a handler
+// writes, for middleware such as access logging and metrics. It passes Flush, Hijack and
+// Push through to the ResponseWriter it wraps, so streaming responses and protocol
+// upgrades keep working behind it.
+type StatusRecorder struct {
+	http.ResponseWriter
+	status int
+	size   int64
+}
+
+func NewStatusRecorder(w http.ResponseWriter) *StatusRecorder {
+	return &StatusRecorder{ResponseWriter: w}
+}
+
+func (sr *StatusRecorder) WriteHeader(status int) {
+	if sr.status == 0 {
+		sr.status = status
+	}
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+func (sr *StatusRecorder) Write(b []byte) (int, error) {
+	if sr.status == 0 {
+		sr.status = http.StatusOK
+	}
+	n, err := sr.ResponseWriter.Write(b)
+	sr.size += int64(n)
+	return n, err
+}
+
+// Status is the status code written, which is 200 if the handler wrote none.
+func (sr *StatusRecorder) Status() int {
+	if sr.status == 0 {
+		return http.StatusOK
+	}
+	return sr.status
+}
+
+// Size is the number of body bytes written.
+func (sr *StatusRecorder) Size() int64 {
+	return sr.size
+}
+
+// Flush sends any buffered data to the client, if the wrapped ResponseWriter can.
+func (sr *StatusRecorder) Flush() {
+	if f, ok := sr.ResponseWriter.(http.Flusher); ok {
+		if sr.status == 0 {
+			sr.status = http.StatusOK
+		}
+		f.Flush()
+	}
+}
+
+// Hijack hands the connection over to the handler, such as for a WebSocket upgrade.
+// A hijacked response is recorded as 101 Switching Protocols unless a status was written.
+func (sr *StatusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := sr.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, http.ErrNotSupported
+	}
+	conn, rw, err := h.Hijack()
+	if err == nil && sr.status == 0 {
+		sr.status = http.StatusSwitchingProtocols
+	}
+	return conn, rw, err
+}
+
+func (sr *StatusRecorder) Push(target string, opts *http.PushOptions) error {
+	p, ok := sr.ResponseWriter.(http.Pusher)
+	if !ok {
+		return http.ErrNotSupported
+	}
+	return p.Push(target, opts)
+}
+
+// Unwrap returns the wrapped ResponseWriter, for http.ResponseController.
+func (sr *StatusRecorder) Unwrap() http.ResponseWriter {
+	return sr.ResponseWriter
+}
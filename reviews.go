@@ -0,0 +1,307 @@
+package separation
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/oralordos/separation/internal/clock"
+)
+
+// Action Layer
+var ErrReviewNotFound = registerError(errors.New("Registration review not found"), "registration_review_not_found", http.StatusNotFound, "No registration is waiting for review with the ID")
+
+// PendingRegistration is a registration held for an admin to approve or reject,
+// because its risk score reached the review threshold.
+type PendingRegistration struct {
+	ID     string          `json:"id"`
+	Params *RegisterParams `json:"params"`
+	// Labels are those pre-register hooks gave the registration, which Params does not encode
+	Labels Labels `json:"labels,omitempty"`
+	// IP is the client address the registration came from
+	IP        string       `json:"ip,omitempty"`
+	Score     float64      `json:"score"`
+	Scores    []*RiskScore `json:"scores"`
+	CreatedAt time.Time    `json:"created_at"`
+}
+
+type ReviewStorer interface {
+	// Get may return an ErrReviewNotFound error
+	Get(ctx context.Context, id string) (*PendingRegistration, error)
+	Save(ctx context.Context, pending *PendingRegistration) error
+	// Delete may return an ErrReviewNotFound error
+	Delete(ctx context.Context, id string) error
+	// List returns every pending registration in no particular order
+	List(ctx context.Context) ([]*PendingRegistration, error)
+}
+
+// RepositoryReviewStorage implements ReviewStorer on top of any review repository.
+type RepositoryReviewStorage struct {
+	repo Repository[string, *PendingRegistration]
+}
+
+func NewRepositoryReviewStorage(repo Repository[string, *PendingRegistration]) *RepositoryReviewStorage {
+	return &RepositoryReviewStorage{
+		repo: repo,
+	}
+}
+
+func NewMemoryReviewStorage() *RepositoryReviewStorage {
+	return NewRepositoryReviewStorage(NewMemoryRepository(func(p *PendingRegistration) string {
+		return p.ID
+	}))
+}
+
+func (rs *RepositoryReviewStorage) Get(ctx context.Context, id string) (*PendingRegistration, error) {
+	p, err := rs.repo.Get(ctx, id)
+	if err == ErrNotFound {
+		return nil, ErrReviewNotFound
+	}
+	return p, err
+}
+
+func (rs *RepositoryReviewStorage) Save(ctx context.Context, pending *PendingRegistration) error {
+	return rs.repo.Save(ctx, pending)
+}
+
+func (rs *RepositoryReviewStorage) Delete(ctx context.Context, id string) error {
+	err := rs.repo.Delete(ctx, id)
+	if err == ErrNotFound {
+		return ErrReviewNotFound
+	}
+	return err
+}
+
+func (rs *RepositoryReviewStorage) List(ctx context.Context) ([]*PendingRegistration, error) {
+	return rs.repo.List(ctx)
+}
+
+// Business Logic
+// ErrPendingReview answers a registration that was held for review rather than refused.
+var ErrPendingReview = registerError(errors.New("Registration is waiting for review"), "registration_pending_review", http.StatusAccepted, "The registration looked risky and is waiting for an admin to approve it")
+
+// Review decisions, as given to ResolveReviewParams.
+const (
+	ReviewApproved = "approved"
+	ReviewRejected = "rejected"
+)
+
+// reviewStats counts the decisions made, the seconds registrations waited for them, and
+// how many waited longer than the review SLA.
+var reviewStats = expvar.NewMap("registration_reviews")
+
+func newReviewID() (string, error) {
+	b := make([]byte, 8)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// holdForReview queues params for review. A registration already waiting is not queued twice.
+func holdForReview(ctx context.Context, reviews ReviewStorer, params *RegisterParams, total float64, scores []*RiskScore, now time.Time) error {
+	pending, err := reviews.List(ctx)
+	if err != nil {
+		return err
+	}
+	for _, p := range pending {
+		if p.Params.Email == params.Email {
+			return ErrPendingReview
+		}
+	}
+
+	id, err := newReviewID()
+	if err != nil {
+		return err
+	}
+	held := *params
+	err = reviews.Save(ctx, &PendingRegistration{
+		ID:        id,
+		Params:    &held,
+		Labels:    params.Labels,
+		IP:        clientIPFromContext(ctx),
+		Score:     total,
+		Scores:    scores,
+		CreatedAt: now,
+	})
+	if err != nil {
+		return err
+	}
+	reviewStats.Add("held", 1)
+	return ErrPendingReview
+}
+
+type ListReviewsQuery struct{}
+
+func (lq *ListReviewsQuery) QueryName() string {
+	return "ListReviews"
+}
+
+type GetReviewQuery struct {
+	ID string
+}
+
+func (gq *GetReviewQuery) QueryName() string {
+	return "GetReview"
+}
+
+type ResolveReviewParams struct {
+	ID       string `json:"id"`
+	Decision string `json:"-"`
+}
+
+func (rp *ResolveReviewParams) CommandName() string {
+	return "ResolveReview"
+}
+
+type ReviewHandler struct {
+	reviewStorage ReviewStorer
+	sla           time.Duration
+	clock         clock.Clock
+}
+
+// NewReviewHandler counts decisions made later than sla after the registration as breaches.
+func NewReviewHandler(rs ReviewStorer, sla time.Duration, clk clock.Clock) *ReviewHandler {
+	return &ReviewHandler{
+		reviewStorage: rs,
+		sla:           sla,
+		clock:         clk,
+	}
+}
+
+// List returns the pending registrations, oldest first.
+func (rh *ReviewHandler) List(ctx context.Context, q Query) (interface{}, error) {
+	err := requireAdmin(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	pending, err := rh.reviewStorage.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(pending, func(i, j int) bool {
+		return pending[i].CreatedAt.Before(pending[j].CreatedAt)
+	})
+	return pending, nil
+}
+
+func (rh *ReviewHandler) Get(ctx context.Context, q Query) (interface{}, error) {
+	query, ok := q.(*GetReviewQuery)
+	if !ok {
+		return nil, fmt.Errorf("ReviewHandler cannot get %T", q)
+	}
+
+	err := requireAdmin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return rh.reviewStorage.Get(ctx, query.ID)
+}
+
+// Resolve takes a registration off the queue and records how long it waited. Approving it
+// does not register the user, UserServiceImpl.ApproveRegistration does that first.
+func (rh *ReviewHandler) Resolve(ctx context.Context, cmd Command) error {
+	params, ok := cmd.(*ResolveReviewParams)
+	if !ok {
+		return fmt.Errorf("ReviewHandler cannot resolve %T", cmd)
+	}
+
+	err := requireAdmin(ctx)
+	if err != nil {
+		return err
+	}
+	if params.Decision != ReviewApproved && params.Decision != ReviewRejected {
+		return NewValidationError("Decision must be approved or rejected")
+	}
+
+	pending, err := rh.reviewStorage.Get(ctx, params.ID)
+	if err != nil {
+		return err
+	}
+	err = rh.reviewStorage.Delete(ctx, params.ID)
+	if err != nil {
+		return err
+	}
+
+	waited := rh.clock.Now().Sub(pending.CreatedAt)
+	reviewStats.Add(params.Decision, 1)
+	reviewStats.AddFloat("latency_seconds", waited.Seconds())
+	if rh.sla > 0 && waited > rh.sla {
+		reviewStats.Add("sla_breaches", 1)
+	}
+	return nil
+}
+
+// approvalContext is ctx as if it were the request pending was made in, so the events of
+// the registration carry the client address the user registered from.
+func approvalContext(ctx context.Context, pending *PendingRegistration) context.Context {
+	ip := net.ParseIP(pending.IP)
+	if ip == nil {
+		return ctx
+	}
+	return clientIPKey.With(ctx, ip)
+}
+
+// Access Layer
+// Reviews serves GET /reviews, listing the registrations waiting for review, oldest first.
+func (a *AdminHTTP) Reviews(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, NewMethodError("Reviews requires a get request"))
+		return
+	}
+
+	pending, err := a.users.ListReviews(r.Context())
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(pending)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+}
+
+// ApproveReview serves POST /reviews/approve with a body of {"id": "..."}, registering the user.
+func (a *AdminHTTP) ApproveReview(w http.ResponseWriter, r *http.Request) {
+	a.resolveReview(w, r, "ApproveReview", a.users.ApproveRegistration)
+}
+
+// RejectReview serves POST /reviews/reject with a body of {"id": "..."}, dropping the registration.
+func (a *AdminHTTP) RejectReview(w http.ResponseWriter, r *http.Request) {
+	a.resolveReview(w, r, "RejectReview", a.users.RejectRegistration)
+}
+
+func (a *AdminHTTP) resolveReview(w http.ResponseWriter, r *http.Request, name string, resolve func(context.Context, *ResolveReviewParams) error) {
+	if r.Method != http.MethodPost {
+		writeError(w, r, NewMethodError(name+" requires a post request"))
+		return
+	}
+
+	params := &ResolveReviewParams{}
+	err := json.NewDecoder(r.Body).Decode(params)
+	if err != nil {
+		writeError(w, r, decodeError(err))
+		return
+	}
+
+	err = resolve(r.Context(), params)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
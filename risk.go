@@ -0,0 +1,380 @@
+package separation
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oralordos/separation/internal/clock"
+	"github.com/oralordos/separation/internal/httpclient"
+	"github.com/oralordos/separation/internal/principal"
+)
+
+// Business Logic
+var (
+	ErrRegistrationRisky = registerError(errors.New("Registration was refused as likely automated"), "registration_risky", http.StatusForbidden, "The registration looked too much like spam or a bot to accept")
+	ErrCaptchaRequired   = registerError(errors.New("A solved captcha is required to register"), "captcha_required", http.StatusPreconditionRequired, "The registration looked risky, so captcha_token must hold a solved captcha")
+)
+
+// RiskScore is what one RiskScorer found in a registration.
+type RiskScore struct {
+	Scorer string `json:"scorer"`
+	// Score is from 0, nothing suspicious, to 1, as suspicious as the scorer can tell
+	Score  float64 `json:"score"`
+	Reason string  `json:"reason,omitempty"`
+}
+
+// RiskScorer looks for signs that a registration is spam or a bot. It returns nil when it
+// has nothing to say. Scorers must be safe to call concurrently.
+type RiskScorer interface {
+	ScoreRegistration(ctx context.Context, params *RegisterParams) (*RiskScore, error)
+}
+
+// RiskThresholds decide what happens to a registration by the sum of its scores.
+// Each is disabled when zero.
+type RiskThresholds struct {
+	// Review holds the registration for an admin to approve or reject
+	Review float64
+	// Captcha requires the client to send a solved captcha
+	Captcha float64
+	// Reject refuses the registration
+	Reject float64
+}
+
+func (rt RiskThresholds) Enabled() bool {
+	return rt.Review > 0 || rt.Captcha > 0 || rt.Reject > 0
+}
+
+// CaptchaVerifier checks a captcha token solved by the client at ip.
+type CaptchaVerifier interface {
+	VerifyCaptcha(ctx context.Context, token, ip string) (bool, error)
+}
+
+var riskDecisions = expvar.NewMap("registration_risk")
+
+// RiskChecker scores registrations and acts on the thresholds they pass. A scorer that
+// fails is reported to onError and counts as 0, so an outage of a reputation provider
+// does not stop registrations.
+type RiskChecker struct {
+	scorers    []RiskScorer
+	thresholds RiskThresholds
+	captcha    CaptchaVerifier
+	reviews    ReviewStorer
+	clock      clock.Clock
+	onError    func(ctx context.Context, err error)
+}
+
+// NewRiskChecker needs captcha when thresholds.Captcha is set, and holds registrations for review in reviews.
+func NewRiskChecker(scorers []RiskScorer, thresholds RiskThresholds, captcha CaptchaVerifier, reviews ReviewStorer, clk clock.Clock, onError func(ctx context.Context, err error)) *RiskChecker {
+	return &RiskChecker{
+		scorers:    scorers,
+		thresholds: thresholds,
+		captcha:    captcha,
+		reviews:    reviews,
+		clock:      clk,
+		onError:    onError,
+	}
+}
+
+// Score sums the scores of every scorer, returning the ones that found something.
+func (rc *RiskChecker) Score(ctx context.Context, params *RegisterParams) (float64, []*RiskScore) {
+	var total float64
+	var scores []*RiskScore
+	for _, s := range rc.scorers {
+		score, err := s.ScoreRegistration(ctx, params)
+		if err != nil {
+			if rc.onError != nil {
+				rc.onError(ctx, fmt.Errorf("Scoring the registration of %s: %w", params.Email, err))
+			}
+			continue
+		}
+		if score == nil || score.Score <= 0 {
+			continue
+		}
+		total += score.Score
+		scores = append(scores, score)
+	}
+	return total, scores
+}
+
+// Commands is a CommandMiddleware scoring registrations before they reach the register handler.
+// Admins may register anyone, which is how approved reviews are registered. Dry runs are
+// refused like real registrations, but a captcha is only checked for being there, as verifying
+// it would use it up. Registrations are only held for review once a dry run of the rest of the
+// registration passes, so that a review is not spent on one that cannot succeed.
+func (rc *RiskChecker) Commands(next CommandHandler) CommandHandler {
+	return CommandHandlerFunc(func(ctx context.Context, cmd Command) error {
+		params, ok := cmd.(*RegisterParams)
+		if !ok {
+			return next.Handle(ctx, cmd)
+		}
+		if p, ok := principal.FromContext(ctx); ok && p.Admin {
+			return next.Handle(ctx, cmd)
+		}
+
+		total, scores := rc.Score(ctx, params)
+		t := rc.thresholds
+		if t.Reject > 0 && total >= t.Reject {
+			riskDecisions.Add("rejected", 1)
+			return ErrRegistrationRisky
+		}
+		if t.Captcha > 0 && total >= t.Captcha {
+			if params.CaptchaToken == "" {
+				riskDecisions.Add("captcha_required", 1)
+				return ErrCaptchaRequired
+			}
+			if !params.DryRun {
+				solved, err := rc.captcha.VerifyCaptcha(ctx, params.CaptchaToken, clientIPFromContext(ctx))
+				if err != nil {
+					return err
+				}
+				if !solved {
+					riskDecisions.Add("captcha_failed", 1)
+					return ErrCaptchaRequired
+				}
+			}
+		}
+		if t.Review > 0 && total >= t.Review {
+			dry := *params
+			dry.DryRun = true
+			err := next.Handle(ctx, &dry)
+			if err != nil {
+				return err
+			}
+			riskDecisions.Add("held_for_review", 1)
+			if params.DryRun {
+				return ErrPendingReview
+			}
+			return holdForReview(ctx, rc.reviews, params, total, scores, rc.clock.Now().UTC())
+		}
+		return next.Handle(ctx, cmd)
+	})
+}
+
+// EmailEntropyScorer scores local parts that look randomly generated, by how many bits of
+// Shannon entropy each character carries. Local parts shorter than 8 characters are too
+// short to tell.
+type EmailEntropyScorer struct {
+	// low scores 0 and high scores 1, in bits a character
+	low, high float64
+}
+
+func NewEmailEntropyScorer(low, high float64) *EmailEntropyScorer {
+	return &EmailEntropyScorer{
+		low:  low,
+		high: high,
+	}
+}
+
+func (es *EmailEntropyScorer) ScoreRegistration(ctx context.Context, params *RegisterParams) (*RiskScore, error) {
+	email := params.Email.String()
+	local := email[:strings.LastIndexByte(email, '@')]
+	if len(local) < 8 {
+		return nil, nil
+	}
+
+	counts := map[rune]int{}
+	n := 0
+	for _, r := range local {
+		counts[r]++
+		n++
+	}
+	var entropy float64
+	for _, c := range counts {
+		p := float64(c) / float64(n)
+		entropy -= p * math.Log2(p)
+	}
+
+	score := (entropy - es.low) / (es.high - es.low)
+	if score <= 0 {
+		return nil, nil
+	}
+	return &RiskScore{
+		Scorer: "email_entropy",
+		Score:  math.Min(1, score),
+		Reason: fmt.Sprintf("The email looks random, at %.2f bits a character", entropy),
+	}, nil
+}
+
+// DisposableDomainScorer scores emails of the known disposable email domains at 1.
+type DisposableDomainScorer struct{}
+
+func (DisposableDomainScorer) ScoreRegistration(ctx context.Context, params *RegisterParams) (*RiskScore, error) {
+	domain := params.Email.Domain()
+	for d := range disposableDomains {
+		if domainMatches(domain, d) {
+			return &RiskScore{
+				Scorer: "disposable_domain",
+				Score:  1,
+				Reason: fmt.Sprintf("%s is a disposable email domain", domain),
+			}, nil
+		}
+	}
+	return nil, nil
+}
+
+// IPReputationProvider rates how likely an IP address is to send abuse, from 0 to 1.
+type IPReputationProvider interface {
+	IPRisk(ctx context.Context, ip string) (float64, error)
+}
+
+// IPReputationScorer scores registrations by the reputation of the client address.
+// Registrations made outside of a request are not scored.
+type IPReputationScorer struct {
+	provider IPReputationProvider
+}
+
+func NewIPReputationScorer(p IPReputationProvider) *IPReputationScorer {
+	return &IPReputationScorer{provider: p}
+}
+
+func (is *IPReputationScorer) ScoreRegistration(ctx context.Context, params *RegisterParams) (*RiskScore, error) {
+	ip := clientIPFromContext(ctx)
+	if ip == "" {
+		return nil, nil
+	}
+	risk, err := is.provider.IPRisk(ctx, ip)
+	if err != nil {
+		return nil, err
+	}
+	return &RiskScore{
+		Scorer: "ip_reputation",
+		Score:  math.Max(0, math.Min(1, risk)),
+		Reason: fmt.Sprintf("%s has a poor reputation", ip),
+	}, nil
+}
+
+// IPVelocityScorer scores registrations by how many users registered from the same IP
+// address within window, reaching 1 at max. It counts the UserRegistered events it is subscribed to.
+type IPVelocityScorer struct {
+	max    int
+	window time.Duration
+	clock  clock.Clock
+
+	mu   sync.Mutex
+	seen map[string][]time.Time
+}
+
+func NewIPVelocityScorer(max int, window time.Duration, clk clock.Clock) *IPVelocityScorer {
+	return &IPVelocityScorer{
+		max:    max,
+		window: window,
+		clock:  clk,
+		seen:   map[string][]time.Time{},
+	}
+}
+
+// recent drops the registrations older than the window. The caller must hold mu.
+func (vs *IPVelocityScorer) recent(ip string, cutoff time.Time) []time.Time {
+	var recent []time.Time
+	for _, t := range vs.seen[ip] {
+		if t.After(cutoff) {
+			recent = append(recent, t)
+		}
+	}
+	if len(recent) == 0 {
+		delete(vs.seen, ip)
+	} else {
+		vs.seen[ip] = recent
+	}
+	return recent
+}
+
+func (vs *IPVelocityScorer) HandleEvent(ctx context.Context, e Event) {
+	reg, ok := e.(*UserRegistered)
+	if !ok || reg.IP == "" {
+		return
+	}
+
+	now := vs.clock.Now()
+	cutoff := now.Add(-vs.window)
+
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+
+	// Forget every address that has gone quiet, so the map does not grow without bound
+	for ip, times := range vs.seen {
+		if !times[len(times)-1].After(cutoff) {
+			delete(vs.seen, ip)
+		}
+	}
+	vs.seen[reg.IP] = append(vs.recent(reg.IP, cutoff), now)
+}
+
+func (vs *IPVelocityScorer) ScoreRegistration(ctx context.Context, params *RegisterParams) (*RiskScore, error) {
+	ip := clientIPFromContext(ctx)
+	if ip == "" {
+		return nil, nil
+	}
+
+	vs.mu.Lock()
+	n := len(vs.recent(ip, vs.clock.Now().Add(-vs.window)))
+	vs.mu.Unlock()
+	if n == 0 {
+		return nil, nil
+	}
+	return &RiskScore{
+		Scorer: "ip_velocity",
+		Score:  math.Min(1, float64(n)/float64(vs.max)),
+		Reason: fmt.Sprintf("%d users registered from %s within %s", n, ip, vs.window),
+	}, nil
+}
+
+// Access Layer
+// SiteVerifyCaptcha verifies tokens with a siteverify endpoint, the API shared by
+// reCAPTCHA, hCaptcha and Turnstile.
+type SiteVerifyCaptcha struct {
+	url    string
+	secret string
+	client *httpclient.Client
+}
+
+func NewSiteVerifyCaptcha(verifyURL, secret string) *SiteVerifyCaptcha {
+	return &SiteVerifyCaptcha{
+		url:    verifyURL,
+		secret: secret,
+		client: httpclient.New("captcha", httpclient.Options{Timeout: 10 * time.Second}),
+	}
+}
+
+func (sc *SiteVerifyCaptcha) VerifyCaptcha(ctx context.Context, token, ip string) (bool, error) {
+	form := url.Values{
+		"secret":   {sc.secret},
+		"response": {token},
+	}
+	if ip != "" {
+		form.Set("remoteip", ip)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, sc.url, strings.NewReader(form.Encode()))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := sc.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return false, fmt.Errorf("Captcha verification answered %s", resp.Status)
+	}
+
+	var result struct {
+		Success bool `json:"success"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	if err != nil {
+		return false, err
+	}
+	return result.Success, nil
+}
@@ -0,0 +1,252 @@
+package separation
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/oralordos/separation/internal/principal"
+)
+
+// Access Layer
+// maxRequestBodySize bounds the bodies of every route but uploads, which set their own limit.
+const maxRequestBodySize = 1 << 20
+
+// AuthRequirement says who may call a route.
+type AuthRequirement string
+
+const (
+	// AuthPublic routes may be called by anyone. The business logic may still
+	// treat authenticated callers differently.
+	AuthPublic AuthRequirement = "public"
+	// AuthAuthenticated routes are refused before reaching their handler
+	// unless an authenticator identified the caller.
+	AuthAuthenticated AuthRequirement = "authenticated"
+)
+
+// Route declares one path of the JSON access layer and the policy that applies to it,
+// so the router, the authorization check and GET /routes all read the same table.
+type Route struct {
+	// Name is the operation, used in error messages.
+	Name string `json:"name"`
+	// Path is a ServeMux pattern. Paths ending in / serve everything under them.
+	Path string `json:"path"`
+	// Methods are the methods the router lets through. When it is empty the
+	// handler checks methods itself, as routes serving several paths must.
+	Methods []string        `json:"methods,omitempty"`
+	Auth    AuthRequirement `json:"auth"`
+	// Class is the concurrency limit the route counts against. Routes without one are never shed.
+	Class   RouteClass `json:"class,omitempty"`
+	Summary string     `json:"summary"`
+	// Request and Response name the types of the bodies, when they are JSON.
+	Request  string `json:"request,omitempty"`
+	Response string `json:"response,omitempty"`
+	// Examples are requests made to the route by the golden tests, with the responses they got.
+	Examples []RouteExample `json:"examples,omitempty"`
+
+	Handler http.HandlerFunc `json:"-"`
+
+	limiter *ConcurrencyLimiter
+	shedder *AdaptiveShedder
+}
+
+// RouteExample is a request and the response it got. Values that differ between runs,
+// such as timestamps and IDs, are replaced with "<volatile>".
+type RouteExample struct {
+	Name   string `json:"name"`
+	Method string `json:"method"`
+	// Path includes the query string
+	Path    string          `json:"path"`
+	Request json.RawMessage `json:"request,omitempty"`
+	Status  int             `json:"status"`
+	// Response is the JSON body, or a string holding any other body
+	Response json.RawMessage `json:"response,omitempty"`
+}
+
+// routeExamplesJSON holds the examples of each route by name. TestGoldenResponses
+// writes it with -update, and fails when it no longer matches the responses.
+//
+//go:embed routeexamples.json
+var routeExamplesJSON []byte
+
+var routeExamples = func() map[string][]RouteExample {
+	examples := map[string][]RouteExample{}
+	err := json.Unmarshal(routeExamplesJSON, &examples)
+	if err != nil {
+		panic("routeexamples.json is invalid: " + err.Error())
+	}
+	return examples
+}()
+
+func (rt *Route) allows(method string) bool {
+	if len(rt.Methods) == 0 {
+		return true
+	}
+	for _, m := range rt.Methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+// methodList writes the methods as a sentence, such as "get, post or delete".
+func (rt *Route) methodList() string {
+	names := make([]string, len(rt.Methods))
+	for i, m := range rt.Methods {
+		names[i] = strings.ToLower(m)
+	}
+	if len(names) == 1 {
+		return names[0]
+	}
+	return strings.Join(names[:len(names)-1], ", ") + " or " + names[len(names)-1]
+}
+
+// ServeHTTP applies the route's policy before calling its handler.
+func (rt *Route) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !rt.allows(r.Method) {
+		w.Header().Set("Allow", strings.Join(rt.Methods, ", "))
+		writeError(w, r, NewMethodError(fmt.Sprintf("%s requires a %s request", rt.Name, rt.methodList())))
+		return
+	}
+
+	if rt.Auth == AuthAuthenticated {
+		if _, ok := principal.FromContext(r.Context()); !ok {
+			writeError(w, r, ErrUnauthenticated)
+			return
+		}
+	}
+
+	if rt.Class != ClassUpload {
+		r.Body = &limitedBody{body: http.MaxBytesReader(w, r.Body, maxRequestBodySize), limit: maxRequestBodySize}
+	}
+
+	if rt.shedder != nil && rt.shedder.Shed(r.Context(), rt.Class) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(pressureInterval.Seconds())))
+		writeError(w, r, ErrOverloaded)
+		return
+	}
+	if rt.limiter != nil {
+		serveLimited(rt.limiter, rt.Handler, w, r)
+		return
+	}
+	rt.Handler(w, r)
+}
+
+// LimitConcurrency makes each route count against the limiter of its class.
+// Call it before serving.
+func (j *JsonOverHTTP) LimitConcurrency(limiters map[RouteClass]*ConcurrencyLimiter) {
+	for _, rt := range j.routes {
+		rt.limiter = limiters[rt.Class]
+	}
+}
+
+// ShedUnderPressure lets s reject requests while storage is degraded, by their class.
+// Call it before serving.
+func (j *JsonOverHTTP) ShedUnderPressure(s *AdaptiveShedder) {
+	for _, rt := range j.routes {
+		rt.shedder = s
+	}
+}
+
+// Routes is the route table of the JSON access layer.
+func (j *JsonOverHTTP) Routes() []*Route {
+	get := []string{http.MethodGet}
+	post := []string{http.MethodPost}
+	put := []string{http.MethodPut}
+
+	return []*Route{
+		{Name: "Register", Path: "/register", Methods: post, Auth: AuthPublic, Class: ClassWrite, Handler: j.Register,
+			Summary: "Register a new user", Request: "RegisterParams"},
+		{Name: "RequestMagicLink", Path: "/login/magic", Methods: post, Auth: AuthPublic, Class: ClassWrite, Handler: j.RequestMagicLink,
+			Summary: "Email a single-use sign-in link to a registered user", Request: "RequestMagicLinkParams"},
+		{Name: "MagicLinkCallback", Path: "/login/magic/callback", Methods: get, Auth: AuthPublic, Class: ClassWrite, Handler: j.MagicLinkCallback,
+			Summary: "Sign in with the token query parameter of an emailed link, starting a session", Response: "User"},
+		{Name: "BeginPasskeyLogin", Path: "/login/passkey/begin", Methods: post, Auth: AuthPublic, Class: ClassWrite, Handler: j.BeginPasskeyLogin,
+			Summary: "Start signing in with a passkey, optionally of the user with the email in the body", Response: "CredentialRequestOptions"},
+		{Name: "FinishPasskeyLogin", Path: "/login/passkey/finish", Methods: post, Auth: AuthPublic, Class: ClassWrite, Handler: j.FinishPasskeyLogin,
+			Summary: "Sign in with the credential navigator.credentials.get returned, starting a session", Request: "AssertionResponse", Response: "User"},
+		{Name: "Logout", Path: "/logout", Methods: post, Auth: AuthPublic, Handler: j.Logout,
+			Summary: "End the session of the calling browser"},
+		{Name: "GetUser", Path: "/user", Methods: get, Auth: AuthPublic, Class: ClassRead, Handler: j.GetUser,
+			Summary: "Get the public profile of the user with the email in the email query parameter", Response: "PublicUser"},
+		{Name: "GetUserByUsername", Path: "/users/by-username/", Methods: get, Auth: AuthPublic, Class: ClassRead, Handler: j.GetUserByUsername,
+			Summary: "Get the public profile of the user with the username at the end of the path", Response: "PublicUser"},
+		{Name: "Avatar", Path: "/avatars/", Methods: get, Auth: AuthPublic, Class: ClassRead, Handler: j.Avatar,
+			Summary: "Get the avatar image with the ID at the end of the path"},
+		{Name: "Terms", Path: "/terms", Methods: get, Auth: AuthPublic, Class: ClassRead, Handler: j.Terms,
+			Summary: "Get the current terms of service version", Response: "Terms"},
+		{Name: "Me", Path: "/me", Methods: get, Auth: AuthAuthenticated, Class: ClassRead, Handler: j.Me,
+			Summary: "Get the calling user", Response: "User"},
+		{Name: "SetMyUsername", Path: "/me/username", Methods: put, Auth: AuthAuthenticated, Class: ClassWrite, Handler: j.SetMyUsername,
+			Summary: "Pick or change the calling user's username", Request: "SetUsernameParams"},
+		{Name: "SetMyAvatar", Path: "/me/avatar", Methods: post, Auth: AuthAuthenticated, Class: ClassUpload, Handler: j.SetMyAvatar,
+			Summary: "Upload the calling user's avatar as a PNG, JPEG or GIF body"},
+		{Name: "MyPreferences", Path: "/me/preferences", Methods: []string{http.MethodGet, http.MethodPut}, Auth: AuthAuthenticated, Class: ClassWrite, Handler: j.MyPreferences,
+			Summary: "Get or replace the calling user's preferences", Request: "Preferences", Response: "Preferences"},
+		{Name: "AcceptMyTerms", Path: "/me/terms", Methods: post, Auth: AuthAuthenticated, Class: ClassWrite, Handler: j.AcceptMyTerms,
+			Summary: "Accept a version of the terms of service", Request: "AcceptTermsParams"},
+		{Name: "SendMyPhoneCode", Path: "/me/phone/code", Methods: post, Auth: AuthAuthenticated, Class: ClassWrite, Handler: j.SendMyPhoneCode,
+			Summary: "Text a verification code to the calling user's phone number, or to a new one", Request: "SendPhoneCodeParams"},
+		{Name: "VerifyMyPhone", Path: "/me/phone/verify", Methods: post, Auth: AuthAuthenticated, Class: ClassWrite, Handler: j.VerifyMyPhone,
+			Summary: "Verify the calling user's phone number with the code texted to it", Request: "VerifyPhoneParams"},
+		{Name: "BeginMyPasskeyRegistration", Path: "/me/passkeys/register/begin", Methods: post, Auth: AuthAuthenticated, Class: ClassWrite, Handler: j.BeginPasskeyRegistration,
+			Summary: "Start registering a passkey to the calling user", Response: "CredentialCreationOptions"},
+		{Name: "FinishMyPasskeyRegistration", Path: "/me/passkeys/register/finish", Methods: post, Auth: AuthAuthenticated, Class: ClassWrite, Handler: j.FinishPasskeyRegistration,
+			Summary: "Register the credential navigator.credentials.create returned to the calling user", Request: "AttestationResponse"},
+		{Name: "MyReferrals", Path: "/me/referrals", Methods: get, Auth: AuthAuthenticated, Class: ClassRead, Handler: j.MyReferrals,
+			Summary: "Get the calling user's referral code and who registered with it", Response: "Referrals"},
+		{Name: "MySessions", Path: "/me/sessions", Methods: get, Auth: AuthAuthenticated, Class: ClassRead, Handler: j.MySessions,
+			Summary: "List the browsers the calling user is signed in on", Response: "[]Session"},
+		{Name: "RevokeMySession", Path: "/me/sessions/", Methods: []string{http.MethodDelete}, Auth: AuthAuthenticated, Class: ClassWrite, Handler: j.RevokeMySession,
+			Summary: "Sign the calling user out of the session with the ID at the end of the path"},
+		{Name: "MyLogins", Path: "/me/logins", Methods: get, Auth: AuthAuthenticated, Class: ClassRead, Handler: j.MyLogins,
+			Summary: "List when and where the calling user signed in, newest first", Response: "[]Login"},
+		{Name: "MyOrgs", Path: "/me/orgs", Methods: get, Auth: AuthAuthenticated, Class: ClassRead, Handler: j.MyOrgs,
+			Summary: "List the organizations the calling user belongs to", Response: "[]UserOrg"},
+		{Name: "CreateOrg", Path: "/orgs", Methods: post, Auth: AuthAuthenticated, Class: ClassWrite, Handler: j.CreateOrg,
+			Summary: "Create an organization owned by the calling user", Request: "CreateOrgParams", Response: "Organization"},
+		{Name: "Org", Path: "/orgs/", Auth: AuthAuthenticated, Class: ClassWrite, Handler: j.Org,
+			Summary: "Get an organization, and manage its members under /members and API tokens under /tokens"},
+		{Name: "Health", Path: "/healthz", Auth: AuthPublic, Handler: j.Health,
+			Summary: "Report that the service is up, and whether it is in maintenance mode", Response: "Health"},
+		{Name: "Errors", Path: "/errors", Methods: get, Auth: AuthPublic, Handler: j.Errors,
+			Summary: "List every error code with its HTTP status and meaning", Response: "[]ErrorInfo"},
+		{Name: "ListRoutes", Path: "/routes", Methods: get, Auth: AuthPublic, Handler: j.ListRoutes,
+			Summary: "List every route with its methods, auth requirement, concurrency class and body types", Response: "[]Route"},
+	}
+}
+
+// limitedBody reports a body cut off by http.MaxBytesReader as ErrRequestTooLarge,
+// so decoders can tell it from a malformed one.
+type limitedBody struct {
+	body        io.ReadCloser
+	limit, read int64
+}
+
+func (lb *limitedBody) Read(p []byte) (int, error) {
+	n, err := lb.body.Read(p)
+	lb.read += int64(n)
+	if err != nil && err != io.EOF && lb.read >= lb.limit {
+		err = ErrRequestTooLarge
+	}
+	return n, err
+}
+
+func (lb *limitedBody) Close() error {
+	return lb.body.Close()
+}
+
+// ListRoutes serves GET /routes from the route table.
+func (j *JsonOverHTTP) ListRoutes(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(j.routes)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+}
@@ -0,0 +1,250 @@
+package separation
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files under testdata/golden")
+
+// goldenVolatileHeaders differ between runs, so their values are masked in the golden files.
+var goldenVolatileHeaders = []string{"Content-Length", "Date", "Location", "Set-Cookie", "X-Request-Id"}
+
+// goldenVolatileFields differ between runs, so their values are masked in the golden files.
+var goldenVolatileFields = append(strings.Split(defaultReplayIgnore, ","), "id", "expires_at")
+
+// goldenCase is one request, whose response is compared with testdata/golden/<name>.golden.
+type goldenCase struct {
+	name   string
+	method string
+	path   string
+	user   string
+	admin  bool
+	body   string
+	// volatile are fields masked in this response only, besides goldenVolatileFields
+	volatile []string
+}
+
+// goldenCases run in order against one server, so later cases see what earlier ones did.
+var goldenCases = []goldenCase{
+	{name: "healthz", method: http.MethodGet, path: "/healthz"},
+	{name: "errors", method: http.MethodGet, path: "/errors"},
+	{name: "routes", method: http.MethodGet, path: "/routes", volatile: []string{"examples"}},
+	{name: "terms", method: http.MethodGet, path: "/terms"},
+	{name: "register", method: http.MethodPost, path: "/register", body: `{"email":"ada@example.com","name":"Ada Lovelace","accept_terms":"2024-01"}`},
+	{name: "register_duplicate", method: http.MethodPost, path: "/register", body: `{"email":"ada@example.com","name":"Ada Again","accept_terms":"2024-01"}`},
+	{name: "register_invalid_email", method: http.MethodPost, path: "/register", body: `{"email":"not an email","name":"Nobody","accept_terms":"2024-01"}`},
+	{name: "register_terms_not_accepted", method: http.MethodPost, path: "/register", body: `{"email":"grace@example.com","name":"Grace Hopper"}`},
+	{name: "register_malformed", method: http.MethodPost, path: "/register", body: `{"email":`},
+	{name: "register_wrong_method", method: http.MethodGet, path: "/register"},
+	{name: "get_user", method: http.MethodGet, path: "/user?email=ada@example.com"},
+	{name: "get_user_not_found", method: http.MethodGet, path: "/user?email=nobody@example.com"},
+	{name: "me_unauthenticated", method: http.MethodGet, path: "/me"},
+	{name: "me", method: http.MethodGet, path: "/me", user: "ada@example.com"},
+	{name: "set_my_username", method: http.MethodPut, path: "/me/username", user: "ada@example.com", body: `{"username":"ada"}`},
+	{name: "set_my_username_invalid", method: http.MethodPut, path: "/me/username", user: "ada@example.com", body: `{"username":"no spaces allowed"}`},
+	{name: "get_user_by_username", method: http.MethodGet, path: "/users/by-username/ada"},
+	{name: "get_user_by_username_not_found", method: http.MethodGet, path: "/users/by-username/nobody"},
+	{name: "avatar_not_found", method: http.MethodGet, path: "/avatars/ada@example.com"},
+	{name: "my_preferences", method: http.MethodGet, path: "/me/preferences", user: "ada@example.com"},
+	{name: "set_my_preferences", method: http.MethodPut, path: "/me/preferences", user: "ada@example.com", body: `{"locale":"en-GB"}`},
+	{name: "accept_my_terms", method: http.MethodPost, path: "/me/terms", user: "ada@example.com", body: `{"version":"2024-01"}`},
+	{name: "send_my_phone_code", method: http.MethodPost, path: "/me/phone/code", user: "ada@example.com", body: `{"phone":"+15555550100"}`},
+	{name: "verify_my_phone", method: http.MethodPost, path: "/me/phone/verify", user: "ada@example.com", body: `{"code":"000000"}`},
+	{name: "begin_my_passkey_registration", method: http.MethodPost, path: "/me/passkeys/register/begin", user: "ada@example.com"},
+	{name: "my_referrals", method: http.MethodGet, path: "/me/referrals", user: "ada@example.com", volatile: []string{"code"}},
+	{name: "create_org", method: http.MethodPost, path: "/orgs", user: "ada@example.com", body: `{"name":"Analytical Engines"}`},
+	{name: "create_org_unauthenticated", method: http.MethodPost, path: "/orgs", body: `{"name":"Analytical Engines"}`},
+	{name: "my_orgs", method: http.MethodGet, path: "/me/orgs", user: "ada@example.com"},
+	{name: "my_sessions", method: http.MethodGet, path: "/me/sessions", user: "ada@example.com"},
+	{name: "my_logins", method: http.MethodGet, path: "/me/logins", user: "ada@example.com"},
+	{name: "revoke_my_session_not_found", method: http.MethodDelete, path: "/me/sessions/missing", user: "ada@example.com"},
+	{name: "org_not_found", method: http.MethodGet, path: "/orgs/missing", user: "ada@example.com"},
+	{name: "request_magic_link", method: http.MethodPost, path: "/login/magic", body: `{"email":"ada@example.com"}`},
+	{name: "magic_link_callback_invalid", method: http.MethodGet, path: "/login/magic/callback?token=invalid"},
+	{name: "begin_passkey_login", method: http.MethodPost, path: "/login/passkey/begin", body: `{"email":"ada@example.com"}`},
+	{name: "finish_passkey_login", method: http.MethodPost, path: "/login/passkey/finish", body: `{}`},
+	{name: "logout", method: http.MethodPost, path: "/logout"},
+	{name: "admin_users_unauthorized", method: http.MethodGet, path: "/users"},
+	{name: "admin_users", method: http.MethodGet, path: "/users", admin: true},
+	{name: "admin_user_labels", method: http.MethodPut, path: "/users/labels", admin: true, body: `{"email":"ada@example.com","labels":{"plan":"pro"}}`},
+	// Labels, like everything but the public profile, are only shown to the user and admins
+	{name: "get_user_labeled", method: http.MethodGet, path: "/user?email=ada@example.com"},
+	// Maintenance mode is left on last, as it refuses the user facing requests
+	{name: "admin_maintenance_on", method: http.MethodPut, path: "/maintenance", admin: true, body: `{"enabled":true,"message":"Upgrading the database","retry_after":120}`},
+	{name: "healthz_maintenance", method: http.MethodGet, path: "/healthz"},
+	{name: "get_user_maintenance", method: http.MethodGet, path: "/user?email=ada@example.com"},
+}
+
+// TestGoldenResponses sends goldenCases to a server and compares each response's status,
+// headers and body with its golden file. Run with -update to rewrite the golden files.
+func TestGoldenResponses(t *testing.T) {
+	checkLeaks(t)
+	adminPort := freePort(t)
+	cfg := testConfig(t, map[string]string{
+		"ADMIN_PORT":    adminPort,
+		"ADMIN_TOKEN":   "golden-admin-token",
+		"TERMS_VERSION": "2024-01",
+	})
+	base := startServer(t, cfg, WithStorage(NewMemoryUserStorage()), WithAuthenticator(testAuthenticator{}))
+	adminBase := "http://127.0.0.1:" + adminPort
+	waitForServer(t, adminBase+"/users")
+
+	// The route table finds the route each case is an example of
+	router := NewJsonOverHTTP(nil, nil, 0).router
+	examples := map[string][]RouteExample{}
+
+	for _, c := range goldenCases {
+		url := base + c.path
+		if strings.HasPrefix(c.name, "admin_") {
+			url = adminBase + c.path
+		}
+		req, err := http.NewRequest(c.method, url, strings.NewReader(c.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.body != "" {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		if c.user != "" {
+			req.Header.Set("X-Test-User", c.user)
+		}
+		if c.admin {
+			req.Header.Set("Authorization", "Bearer golden-admin-token")
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, body := goldenResponse(t, resp, c.volatile)
+		resp.Body.Close()
+
+		if h, _ := router.Handler(req); !c.admin && h != nil {
+			// GET /routes holds the examples, so it cannot be one
+			if rt, ok := h.(*Route); ok && rt.Name != "ListRoutes" {
+				examples[rt.Name] = append(examples[rt.Name], RouteExample{
+					Name:     c.name,
+					Method:   c.method,
+					Path:     c.path,
+					Request:  exampleBody([]byte(c.body)),
+					Status:   resp.StatusCode,
+					Response: exampleBody(body),
+				})
+			}
+		}
+
+		path := filepath.Join("testdata", "golden", c.name+".golden")
+		if *update {
+			err = os.WriteFile(path, got, 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		want, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("%v, run with -update to create it", err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s %s answered\n%s\nbut %s holds\n%s", c.method, c.path, got, path, want)
+		}
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	err := enc.Encode(examples)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *update {
+		err = os.WriteFile("routeexamples.json", buf.Bytes(), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	} else if !bytes.Equal(buf.Bytes(), routeExamplesJSON) {
+		t.Errorf("routeexamples.json no longer matches the golden responses, run with -update to rewrite it")
+	}
+}
+
+// exampleBody keeps a JSON body as it is, and holds any other body in a string.
+func exampleBody(body []byte) json.RawMessage {
+	if len(body) == 0 {
+		return nil
+	}
+	if json.Valid(body) {
+		return body
+	}
+	b, _ := json.Marshal(string(body))
+	return b
+}
+
+// goldenResponse renders resp as its status, its sorted headers and its indented body,
+// masking anything that differs between runs. It also returns the masked body alone.
+func goldenResponse(t *testing.T, resp *http.Response, volatile []string) ([]byte, []byte) {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%s\n", resp.Status)
+
+	names := make([]string, 0, len(resp.Header))
+	for name := range resp.Header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		value := strings.Join(resp.Header.Values(name), ", ")
+		if containsString(goldenVolatileHeaders, name) {
+			value = "<volatile>"
+		}
+		fmt.Fprintf(&b, "%s: %s\n", name, value)
+	}
+	b.WriteString("\n")
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var v interface{}
+	if json.Unmarshal(body, &v) != nil {
+		b.Write(body)
+		return b.Bytes(), body
+	}
+	var masked bytes.Buffer
+	enc := json.NewEncoder(&masked)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	err = enc.Encode(maskVolatile(v, append(volatile, goldenVolatileFields...)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Write(masked.Bytes())
+	return b.Bytes(), masked.Bytes()
+}
+
+// maskVolatile replaces the values of the volatile fields anywhere in v.
+func maskVolatile(v interface{}, volatile []string) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, field := range v {
+			if containsString(volatile, k) && field != nil {
+				v[k] = "<volatile>"
+			} else {
+				v[k] = maskVolatile(field, volatile)
+			}
+		}
+	case []interface{}:
+		for i := range v {
+			v[i] = maskVolatile(v[i], volatile)
+		}
+	}
+	return v
+}
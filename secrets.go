@@ -0,0 +1,312 @@
+package separation
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oralordos/separation/internal/clock"
+	"github.com/oralordos/separation/internal/httpclient"
+)
+
+// Action Layer
+var ErrSecretNotFound = registerError(errors.New("Secret not found"), "secret_not_found", http.StatusInternalServerError, "A secret the server is configured to use is missing from its secrets provider")
+
+// Secret is a value from a SecretsProvider.
+type Secret struct {
+	Value string
+	// Expires is when a leased secret stops being valid. It is zero for secrets that do not expire.
+	Expires time.Time
+}
+
+// SecretsProvider looks up secrets by name. What a name looks like depends on the provider.
+type SecretsProvider interface {
+	// Secret may return an ErrSecretNotFound error
+	Secret(ctx context.Context, name string) (*Secret, error)
+}
+
+// EnvSecrets reads each secret from the environment variable of the same name.
+type EnvSecrets struct{}
+
+func (EnvSecrets) Secret(ctx context.Context, name string) (*Secret, error) {
+	v, ok := os.LookupEnv(name)
+	if !ok {
+		return nil, ErrSecretNotFound
+	}
+	return &Secret{Value: v}, nil
+}
+
+// FileSecrets reads each secret from the file of the same name in a directory,
+// such as the /run/secrets that Docker and Kubernetes mount.
+type FileSecrets struct {
+	dir string
+}
+
+func NewFileSecrets(dir string) *FileSecrets {
+	return &FileSecrets{dir: dir}
+}
+
+func (fs *FileSecrets) Secret(ctx context.Context, name string) (*Secret, error) {
+	if name == "" || strings.ContainsAny(name, `/\`) || name == "." || name == ".." {
+		return nil, fmt.Errorf("Invalid secret name %q", name)
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(fs.dir, name))
+	if os.IsNotExist(err) {
+		return nil, ErrSecretNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return &Secret{Value: strings.TrimRight(string(b), "\r\n")}, nil
+}
+
+// splitSecretKey splits name into a path and the key of the field wanted from it, after a '#'.
+func splitSecretKey(name, defaultKey string) (path, key string) {
+	path, key, ok := strings.Cut(name, "#")
+	if !ok || key == "" {
+		key = defaultKey
+	}
+	return path, key
+}
+
+// VaultSecrets reads secrets from HashiCorp Vault. Names are a path and a field,
+// such as secret/data/separation#admin_token for the KV version 2 engine,
+// or database/creds/separation#password for a leased database credential.
+// A field of value is read when none is given.
+type VaultSecrets struct {
+	addr   string
+	token  string
+	client *httpclient.Client
+	clk    clock.Clock
+}
+
+func NewVaultSecrets(addr, token string, clk clock.Clock) *VaultSecrets {
+	return &VaultSecrets{
+		addr:   strings.TrimSuffix(addr, "/"),
+		token:  token,
+		client: httpclient.New("vault", httpclient.Options{Timeout: 10 * time.Second}),
+		clk:    clk,
+	}
+}
+
+type vaultResponse struct {
+	LeaseDuration int                    `json:"lease_duration"`
+	Data          map[string]interface{} `json:"data"`
+}
+
+func (vs *VaultSecrets) Secret(ctx context.Context, name string) (*Secret, error) {
+	path, key := splitSecretKey(name, "value")
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, vs.addr+"/v1/"+strings.TrimPrefix(path, "/"), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", vs.token)
+
+	resp, err := vs.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, ErrSecretNotFound
+	}
+	if resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("Vault %s: %s", path, resp.Status)
+	}
+
+	var vr vaultResponse
+	err = json.NewDecoder(resp.Body).Decode(&vr)
+	if err != nil {
+		return nil, err
+	}
+
+	// The KV version 2 engine nests the fields one level further down
+	data := vr.Data
+	if nested, ok := data["data"].(map[string]interface{}); ok {
+		data = nested
+	}
+	v, ok := data[key].(string)
+	if !ok {
+		return nil, ErrSecretNotFound
+	}
+
+	s := &Secret{Value: v}
+	if vr.LeaseDuration > 0 {
+		s.Expires = vs.clk.Now().Add(time.Duration(vr.LeaseDuration) * time.Second)
+	}
+	return s, nil
+}
+
+// AWSSecrets reads secrets from AWS Secrets Manager. Names are a secret ID, optionally
+// followed by the field wanted from a JSON secret, such as prod/separation#admin_token.
+type AWSSecrets struct {
+	endpoint  string
+	region    string
+	accessKey string
+	secretKey string
+	client    *httpclient.Client
+	clk       clock.Clock
+}
+
+func NewAWSSecrets(endpoint, region, accessKey, secretKey string, clk clock.Clock) *AWSSecrets {
+	return &AWSSecrets{
+		endpoint:  strings.TrimSuffix(endpoint, "/"),
+		region:    region,
+		accessKey: accessKey,
+		secretKey: secretKey,
+		client:    httpclient.New("aws-secrets", httpclient.Options{Timeout: 10 * time.Second}),
+		clk:       clk,
+	}
+}
+
+func (as *AWSSecrets) Secret(ctx context.Context, name string) (*Secret, error) {
+	id, key := splitSecretKey(name, "")
+
+	body, err := json.Marshal(map[string]string{"SecretId": id})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, as.endpoint+"/", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "secretsmanager.GetSecretValue")
+	signAWSv4(req, body, as.clk.Now().UTC(), as.accessKey, as.secretKey, as.region, "secretsmanager")
+
+	resp, err := as.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		if strings.Contains(string(msg), "ResourceNotFoundException") {
+			return nil, ErrSecretNotFound
+		}
+		return nil, fmt.Errorf("Secrets Manager %s: %s: %s", id, resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	var out struct {
+		SecretString string
+	}
+	err = json.NewDecoder(resp.Body).Decode(&out)
+	if err != nil {
+		return nil, err
+	}
+	if key == "" {
+		return &Secret{Value: out.SecretString}, nil
+	}
+
+	var fields map[string]interface{}
+	err = json.Unmarshal([]byte(out.SecretString), &fields)
+	if err != nil {
+		return nil, fmt.Errorf("Secrets Manager %s is not a JSON object, so it has no field %s", id, key)
+	}
+	v, ok := fields[key].(string)
+	if !ok {
+		return nil, ErrSecretNotFound
+	}
+	return &Secret{Value: v}, nil
+}
+
+type cachedSecret struct {
+	secret    *Secret
+	refreshAt time.Time
+}
+
+// CachingSecrets keeps secrets from another provider for ttl, so they are not fetched
+// on every use. Leased secrets are renewed once two thirds of their lease has passed,
+// and a cached secret is kept if renewing it fails while it is still valid.
+type CachingSecrets struct {
+	next SecretsProvider
+	ttl  time.Duration
+	clk  clock.Clock
+
+	mu    sync.Mutex
+	cache map[string]*cachedSecret
+}
+
+func NewCachingSecrets(next SecretsProvider, ttl time.Duration, clk clock.Clock) *CachingSecrets {
+	return &CachingSecrets{
+		next:  next,
+		ttl:   ttl,
+		clk:   clk,
+		cache: map[string]*cachedSecret{},
+	}
+}
+
+func (cs *CachingSecrets) Secret(ctx context.Context, name string) (*Secret, error) {
+	now := cs.clk.Now()
+
+	cs.mu.Lock()
+	cached, ok := cs.cache[name]
+	cs.mu.Unlock()
+	if ok && now.Before(cached.refreshAt) {
+		return cached.secret, nil
+	}
+
+	s, err := cs.next.Secret(ctx, name)
+	if err != nil {
+		if ok && (cached.secret.Expires.IsZero() || now.Before(cached.secret.Expires)) {
+			return cached.secret, nil
+		}
+		return nil, err
+	}
+
+	refreshAt := now.Add(cs.ttl)
+	if !s.Expires.IsZero() {
+		if renew := now.Add(s.Expires.Sub(now) * 2 / 3); renew.Before(refreshAt) {
+			refreshAt = renew
+		}
+	}
+
+	cs.mu.Lock()
+	cs.cache[name] = &cachedSecret{secret: s, refreshAt: refreshAt}
+	cs.mu.Unlock()
+	return s, nil
+}
+
+// OpenSecretsProvider opens env, file:///path/to/dir, vault://host:port or awssm://region.
+// Vault is reached over HTTPS unless ?tls=false is given, with the token in VAULT_TOKEN.
+// Secrets Manager uses the credentials in AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY.
+func OpenSecretsProvider(dest string, clk clock.Clock) (SecretsProvider, error) {
+	if dest == "" || dest == "env" {
+		return EnvSecrets{}, nil
+	}
+
+	u, err := url.Parse(dest)
+	if err != nil {
+		return nil, err
+	}
+
+	switch u.Scheme {
+	case "file":
+		return NewFileSecrets(u.Path), nil
+	case "vault":
+		scheme := "https"
+		if u.Query().Get("tls") == "false" {
+			scheme = "http"
+		}
+		return NewVaultSecrets(scheme+"://"+u.Host, os.Getenv("VAULT_TOKEN"), clk), nil
+	case "awssm":
+		endpoint := u.Query().Get("endpoint")
+		if endpoint == "" {
+			endpoint = "https://secretsmanager." + u.Host + ".amazonaws.com"
+		}
+		return NewAWSSecrets(endpoint, u.Host, os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"), clk), nil
+	}
+	return nil, fmt.Errorf("Unknown secrets provider %q, use env, file://, vault:// or awssm://", dest)
+}
@@ -0,0 +1,74 @@
+package separation
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Access Layer
+// DefaultContentSecurityPolicy suits an API that serves no pages: nothing may be loaded or framed.
+const DefaultContentSecurityPolicy = "default-src 'none'; frame-ancestors 'none'"
+
+// SecurityHeaders adds hardening headers to every response. Handlers may still
+// replace them, and routes that serve pages, such as API docs, can be given their
+// own values with Override.
+type SecurityHeaders struct {
+	next      http.Handler
+	headers   http.Header
+	overrides []routeHeaders
+}
+
+type routeHeaders struct {
+	prefix  string
+	headers http.Header
+}
+
+// NewSecurityHeaders uses csp as the Content-Security-Policy, or leaves the header out when it is empty.
+func NewSecurityHeaders(next http.Handler, csp string) *SecurityHeaders {
+	h := http.Header{}
+	h.Set("Strict-Transport-Security", "max-age=63072000; includeSubDomains")
+	h.Set("X-Content-Type-Options", "nosniff")
+	h.Set("X-Frame-Options", "DENY")
+	h.Set("Referrer-Policy", "no-referrer")
+	if csp != "" {
+		h.Set("Content-Security-Policy", csp)
+	}
+
+	return &SecurityHeaders{
+		next:    next,
+		headers: h,
+	}
+}
+
+// Override replaces headers for paths under prefix. An empty value removes the header.
+// The longest matching prefix wins.
+func (sh *SecurityHeaders) Override(prefix string, headers http.Header) {
+	sh.overrides = append(sh.overrides, routeHeaders{prefix: prefix, headers: headers})
+	sort.SliceStable(sh.overrides, func(i, j int) bool {
+		return len(sh.overrides[i].prefix) > len(sh.overrides[j].prefix)
+	})
+}
+
+func (sh *SecurityHeaders) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h := w.Header()
+	for k, v := range sh.headers {
+		h[k] = append([]string(nil), v...)
+	}
+
+	for _, o := range sh.overrides {
+		if !strings.HasPrefix(r.URL.Path, o.prefix) {
+			continue
+		}
+		for k, v := range o.headers {
+			if len(v) == 0 || v[0] == "" {
+				h.Del(k)
+			} else {
+				h[http.CanonicalHeaderKey(k)] = append([]string(nil), v...)
+			}
+		}
+		break
+	}
+
+	sh.next.ServeHTTP(w, r)
+}
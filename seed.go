@@ -0,0 +1,56 @@
+package separation
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// Business Logic
+// seedLockTTL is how long an instance that died while seeding holds up the others.
+const seedLockTTL = 30 * time.Second
+
+// SeedUsers registers each fixture through the service, so the same validation and
+// change logging apply as to any other registration. Fixtures already registered,
+// such as after a restart with a change log, are skipped.
+func SeedUsers(ctx context.Context, users UserService, fixtures []*RegisterParams) (seeded, skipped int, err error) {
+	for _, params := range fixtures {
+		err = users.Register(ctx, params)
+		switch {
+		case err == nil:
+			seeded++
+		case errors.Is(err, ErrEmailExists):
+			skipped++
+		default:
+			return seeded, skipped, fmt.Errorf("Unable to seed %s: %w", params.Email, err)
+		}
+	}
+	return seeded, skipped, nil
+}
+
+// Access Layer
+// ReadFixtures reads a JSON array of users to register, each with an email and a name.
+func ReadFixtures(r io.Reader) ([]*RegisterParams, error) {
+	var fixtures []*RegisterParams
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	err := dec.Decode(&fixtures)
+	if err != nil {
+		return nil, fmt.Errorf("Fixtures must be a JSON array of users with an email and a name: %v", err)
+	}
+	return fixtures, nil
+}
+
+func readFixturesFile(path string) ([]*RegisterParams, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return ReadFixtures(f)
+}
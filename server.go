@@ -0,0 +1,581 @@
+package separation
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"time"
+
+	"github.com/oralordos/separation/internal/clock"
+	"github.com/oralordos/separation/internal/principal"
+	"github.com/oralordos/separation/internal/redis"
+)
+
+// Wire together
+var ErrUnknownCommand = errors.New("Unknown command")
+
+// Server is the whole program wired together, so that other Go programs can embed it
+// rather than copy the wiring:
+//
+//	err := separation.New(separation.WithStorage(s), separation.WithListener(l)).Run(ctx)
+type Server struct {
+	cfg      *Config
+	users    UserStorer
+	blobs    BlobStore
+	listener net.Listener
+	logger   io.Writer
+	auths    []Authenticator
+	scorers  []RiskScorer
+	sms      SMSProvider
+	locker   Locker
+	bus      InvalidationBus
+	geo      GeoResolver
+	tasks    []backgroundTask
+}
+
+// backgroundTask is a subsystem run by the leader of the instances.
+type backgroundTask struct {
+	name string
+	run  func(ctx context.Context) error
+}
+
+// Option changes one part of how a Server is wired.
+type Option func(*Server)
+
+// WithConfig sets the configuration. Without it the server is configured
+// from the environment, as the binary is.
+func WithConfig(cfg *Config) Option {
+	return func(s *Server) {
+		s.cfg = cfg
+	}
+}
+
+// WithStorage stores users in us instead of opening the configured storage driver.
+// The change log and slow query recording still wrap it when they are configured.
+func WithStorage(us UserStorer) Option {
+	return func(s *Server) {
+		s.users = us
+	}
+}
+
+// WithBlobStore stores avatars in bs instead of the configured blob store.
+func WithBlobStore(bs BlobStore) Option {
+	return func(s *Server) {
+		s.blobs = bs
+	}
+}
+
+// WithListener serves the JSON access layer on ln instead of the configured address.
+// The server closes ln when it stops.
+func WithListener(ln net.Listener) Option {
+	return func(s *Server) {
+		s.listener = ln
+	}
+}
+
+// WithLogger writes the boot self-check, invite links and background errors to w instead of stderr.
+func WithLogger(w io.Writer) Option {
+	return func(s *Server) {
+		s.logger = w
+	}
+}
+
+// WithAuthenticator identifies callers with a, after the built in authenticators.
+func WithAuthenticator(a Authenticator) Option {
+	return func(s *Server) {
+		s.auths = append(s.auths, a)
+	}
+}
+
+// WithRiskScorer adds rs to the built in scorers of registrations. It is only consulted
+// when a risk threshold is configured.
+func WithRiskScorer(rs RiskScorer) Option {
+	return func(s *Server) {
+		s.scorers = append(s.scorers, rs)
+	}
+}
+
+// WithIPReputation scores registrations by the reputation of their client address with p.
+func WithIPReputation(p IPReputationProvider) Option {
+	return WithRiskScorer(NewIPReputationScorer(p))
+}
+
+// WithLocker excludes jobs that only one instance may run at a time with l, in place of
+// the Redis locks, or of in memory locks without REDIS_ADDR.
+func WithLocker(l Locker) Option {
+	return func(s *Server) {
+		s.locker = l
+	}
+}
+
+// WithGeoResolver places the addresses users sign in from with g, for their login history.
+// Logins have no location without it.
+func WithGeoResolver(g GeoResolver) Option {
+	return func(s *Server) {
+		s.geo = g
+	}
+}
+
+// WithInvalidationBus shares cache invalidations with the other instances over bus, in
+// place of Redis. It only applies when the user cache is configured.
+func WithInvalidationBus(bus InvalidationBus) Option {
+	return func(s *Server) {
+		s.bus = bus
+	}
+}
+
+// WithBackgroundTask runs a subsystem, such as an outbox relay or a job scheduler, on one
+// instance at a time. The instances elect a leader for it through the Locker, which runs
+// it until its context is done, and another takes over if the leader dies.
+func WithBackgroundTask(name string, run func(ctx context.Context) error) Option {
+	return func(s *Server) {
+		s.tasks = append(s.tasks, backgroundTask{name: name, run: run})
+	}
+}
+
+// WithSMSProvider texts phone verification codes and notifications with p, in place of Twilio.
+func WithSMSProvider(p SMSProvider) Option {
+	return func(s *Server) {
+		s.sms = p
+	}
+}
+
+func New(opts ...Option) *Server {
+	s := &Server{
+		logger: os.Stderr,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// Run starts every configured transport and blocks until ctx is done or one of them fails,
+// then shuts them down within the configured shutdown timeout.
+func (s *Server) Run(ctx context.Context) error {
+	cfg := s.cfg
+	if cfg == nil {
+		var err error
+		cfg, err = LoadConfig()
+		if err != nil {
+			return fmt.Errorf("Invalid configuration: %v", err)
+		}
+	}
+
+	usrStor := s.users
+	if usrStor == nil {
+		var err error
+		usrStor, err = OpenUserStorage(cfg.Storage, cfg)
+		if err != nil {
+			return err
+		}
+		if c, ok := usrStor.(io.Closer); ok {
+			defer c.Close()
+		}
+	}
+
+	// Fail fast on anything that would otherwise only break at request time.
+	results, ok := RunDiagnostics(ctx, bootChecks(cfg, usrStor))
+	PrintDiagnostics(s.logger, results)
+	if !ok {
+		return errors.New("Self-check failed, not starting")
+	}
+	var redisClient *redis.Client
+	if cfg.RedisAddr != "" {
+		redisClient = redis.New(cfg.RedisAddr, redis.Options{Password: cfg.RedisPassword, DB: cfg.RedisDB})
+		defer redisClient.Close()
+	}
+
+	var cache *CachingUserStorage
+	switch {
+	case cfg.StorageWriteBehind:
+		cache = NewWriteBehindUserStorage(usrStor, cfg.StorageCacheTTL, clock.Real, cfg.StorageWriteBehindInterval, cfg.StorageWriteBehindBatch, func(err error) {
+			fmt.Fprintln(s.logger, err)
+		})
+		// Deferred after the backend's close so it runs first, and pending saves reach the backend
+		defer func() {
+			err := cache.Close()
+			if err != nil {
+				fmt.Fprintln(s.logger, err)
+			}
+		}()
+		usrStor = cache
+	case cfg.StorageCacheTTL > 0:
+		cache = NewCachingUserStorage(usrStor, cfg.StorageCacheTTL, clock.Real)
+		defer cache.Close()
+		usrStor = cache
+	}
+	bus := s.bus
+	if bus == nil && cfg.StorageCacheInvalidation {
+		bus = NewRedisInvalidationBus(redisClient, "separation:cache:users")
+	}
+	if cache != nil && bus != nil {
+		origin, err := newInstanceID()
+		if err != nil {
+			return err
+		}
+		cache.ShareInvalidations(bus, origin, cfg.StorageCacheStaleness, func(err error) {
+			fmt.Fprintln(s.logger, err)
+		})
+	}
+
+	var changes ChangeLog
+	if cfg.ChangeLog != "" {
+		log, err := OpenFileChangeLog(cfg.ChangeLog)
+		if err != nil {
+			return err
+		}
+		defer log.Close()
+
+		_, err = RecoverFromChangeLog(ctx, log, usrStor, 0, time.Time{})
+		if err != nil {
+			return err
+		}
+		usrStor = NewChangeLogger(usrStor, log, clock.Real)
+		changes = log
+	}
+
+	if cfg.StorageBloomCapacity > 0 {
+		source := EmailsFromStorage(usrStor)
+		if changes != nil {
+			source = EmailsFromChangeLog(changes)
+		}
+		bloom, err := NewBloomUserStorage(ctx, usrStor, source, cfg.StorageBloomCapacity, cfg.StorageBloomFalsePositiveRate, cfg.StorageBloomRebuildInterval, func(err error) {
+			fmt.Fprintln(s.logger, err)
+		})
+		if err != nil {
+			return fmt.Errorf("Filling the bloom filter failed: %v", err)
+		}
+		defer bloom.Close()
+		usrStor = bloom
+	}
+
+	if cache != nil && cfg.StorageCacheWarm > 0 {
+		// A cold cache only costs latency, so running out of budget is not fatal
+		warmCtx, cancel := context.WithTimeout(ctx, cfg.StorageCacheWarmBudget)
+		warmed, err := cache.Warm(warmCtx, cfg.StorageCacheWarm)
+		cancel()
+		if err != nil {
+			fmt.Fprintf(s.logger, "Cache warming stopped after %d users: %v\n", warmed, err)
+		} else {
+			fmt.Fprintf(s.logger, "Warmed the cache with %d users\n", warmed)
+		}
+	}
+
+	var slowCalls SlowCallLister
+	if cfg.SlowQueryThreshold > 0 {
+		slowLog := NewSlowCallLog(cfg.SlowQueryLogSize)
+		usrStor = NewSlowQueryLogger(usrStor, cfg.SlowQueryThreshold, slowLog)
+		slowCalls = slowLog
+	}
+
+	var prefStor PreferencesStorer = NewMemoryPreferencesStorage()
+	var inviteStor InviteStorer = NewMemoryInviteStorage()
+	var orgStor OrgStorer = NewMemoryOrgStorage()
+	var tokenStor OrgTokenStorer = NewMemoryOrgTokenStorage()
+	var policyStor PolicyStorer = NewMemoryPolicyStorage()
+	if cfg.RegistrationPolicyFile != "" {
+		policyStor = NewFilePolicyStorage(cfg.RegistrationPolicyFile)
+	}
+	var maintStor MaintenanceStorer = NewMemoryMaintenanceStorage()
+	if cfg.MaintenanceStateFile != "" {
+		maintStor = NewFileMaintenanceStorage(cfg.MaintenanceStateFile)
+	}
+	var reviewStor ReviewStorer = NewMemoryReviewStorage()
+	var ipRuleStor IPRuleStorer = NewMemoryIPRuleStorage()
+	if cfg.IPRulesFile != "" {
+		ipRuleStor = NewFileIPRuleStorage(cfg.IPRulesFile)
+	}
+
+	var observers StorageObservers
+	if cfg.StorageMetrics {
+		observers = append(observers, MetricsStorageObserver{})
+	}
+	if cfg.StorageCallLog != "" {
+		out, err := OpenAccessLog(cfg.StorageCallLog, 0, 0)
+		if err != nil {
+			return err
+		}
+		if c, ok := out.(io.Closer); ok && !isStdStream(cfg.StorageCallLog) {
+			defer c.Close()
+		}
+		observers = append(observers, NewLogStorageObserver(out))
+	}
+	locker := s.locker
+	if locker == nil {
+		locker = NewMemoryLocker(clock.Real)
+		if redisClient != nil {
+			locker = NewRedisLocker(redisClient, "separation:lock:", clock.Real)
+		}
+	}
+	for _, t := range s.tasks {
+		leader := NewLeader(locker, t.name, cfg.LeaderTTL, t.run, func(err error) {
+			fmt.Fprintln(s.logger, err)
+		})
+		defer leader.Close()
+	}
+	var shedder *AdaptiveShedder
+	if cfg.BackpressureP95 > 0 || cfg.BackpressureErrorRate > 0 {
+		shedder = NewAdaptiveShedder(cfg.BackpressureP95, cfg.BackpressureErrorRate, cfg.BackpressureWindow, cfg.PriorityWeights, clock.Real)
+		observers = append(observers, shedder)
+	}
+	if len(observers) > 0 {
+		usrStor = NewInstrumentedUserStorer(usrStor, "users", observers)
+		prefStor = NewInstrumentedPreferencesStorer(prefStor, "preferences", observers)
+		inviteStor = NewInstrumentedInviteStorer(inviteStor, "invites", observers)
+		orgStor = NewInstrumentedOrgStorer(orgStor, "orgs", observers)
+		tokenStor = NewInstrumentedOrgTokenStorer(tokenStor, "org_tokens", observers)
+		policyStor = NewInstrumentedPolicyStorer(policyStor, "policy", observers)
+		maintStor = NewInstrumentedMaintenanceStorer(maintStor, "maintenance", observers)
+		ipRuleStor = NewInstrumentedIPRuleStorer(ipRuleStor, "ip_rules", observers)
+	}
+
+	blobs := s.blobs
+	if blobs == nil {
+		var err error
+		blobs, err = OpenBlobStore(cfg.BlobStore)
+		if err != nil {
+			return err
+		}
+	}
+
+	events := NewEventBus()
+	var responses *ResponseCache
+	if cfg.ResponseCacheTTL > 0 {
+		responses = NewResponseCache(cfg.ResponseCacheTTL, cfg.ResponseCacheControl, clock.Real)
+		events.Subscribe("UsersChanged", responses)
+		usrStor = NewUserChangePublisher(usrStor, events)
+	}
+	if cfg.EventLog != "" {
+		out, err := OpenAccessLog(cfg.EventLog, 0, 0)
+		if err != nil {
+			return err
+		}
+		if c, ok := out.(io.Closer); ok && !isStdStream(cfg.EventLog) {
+			defer c.Close()
+		}
+		events.SubscribeAll(LogEvents(out))
+	}
+
+	var rules []DetectionRule
+	if cfg.DetectRegistrationsPerIP > 0 {
+		rules = append(rules, NewRapidRegistrationsRule(cfg.DetectRegistrationsPerIP, cfg.DetectRegistrationsWindow, clock.Real))
+	}
+	if len(cfg.DetectSpikeMultipliers) > 0 {
+		rules = append(rules, NewRegistrationSpikeRule(cfg.DetectSpikeMultipliers, cfg.DetectSpikeBaseline, cfg.DetectSpikeMin, clock.Real))
+	}
+	var sinks []AlertSink
+	if cfg.AlertLog != "" {
+		out, err := OpenAccessLog(cfg.AlertLog, 0, 0)
+		if err != nil {
+			return err
+		}
+		if c, ok := out.(io.Closer); ok && !isStdStream(cfg.AlertLog) {
+			defer c.Close()
+		}
+		sinks = append(sinks, NewLogAlertSink(out))
+	}
+	if cfg.AlertWebhook != "" {
+		sinks = append(sinks, NewWebhookAlertSink(cfg.AlertWebhook))
+	}
+	if len(rules) > 0 && len(sinks) > 0 {
+		events.SubscribeAll(NewDetector(rules, sinks, func(err error) {
+			fmt.Fprintln(s.logger, err)
+		}))
+	}
+
+	stats := NewUserStats(usrStor, clock.Real, cfg.StatsRefreshInterval, func(err error) {
+		fmt.Fprintln(s.logger, err)
+	})
+	defer stats.Close()
+	events.Subscribe("UserRegistered", stats)
+
+	notifyRules := DefaultNotificationRules()
+	samples := NotificationSamples(notifyRules)
+	samples["magic_link"] = magicLinkSample
+	templates := NewMessageTemplates(NewMemoryTemplateStorage(), cfg.TemplatesDir, samples, clock.Real)
+	var channels []NotificationChannel
+	var linkSender MagicLinkSender = NewLogMagicLinkSender(s.logger)
+	if cfg.SMTPAddr != "" {
+		mailer := NewSMTPEmailSender(cfg.SMTPAddr, cfg.SMTPFrom, cfg.SMTPUsername, cfg.SMTPPassword)
+		channels = append(channels, NewEmailChannel(mailer))
+		linkSender = NewEmailMagicLinkSender(mailer, templates, prefStor, DefaultPreferences(cfg.DefaultLocale))
+	}
+	if cfg.NotifyWebhook != "" {
+		channels = append(channels, NewWebhookChannel(cfg.NotifyWebhook))
+	}
+	sms := s.sms
+	if sms == nil && cfg.TwilioAccountSID != "" {
+		sms = NewTwilioSMSProvider(cfg.TwilioAccountSID, cfg.TwilioAuthToken, cfg.TwilioFrom)
+	}
+	if sms != nil {
+		channels = append(channels, NewSMSChannel(sms))
+	} else {
+		// Verification codes are logged, as invites are, until a provider is configured
+		sms = NewLogSMSProvider(s.logger)
+	}
+	if len(channels) > 0 {
+		notifier := NewNotifier(usrStor, prefStor, DefaultPreferences(cfg.DefaultLocale), templates, channels, notifyRules, NotifierOptions{
+			MaxAttempts:    cfg.NotifyMaxAttempts,
+			Backoff:        cfg.NotifyRetryBackoff,
+			SuppressWindow: cfg.NotifySuppressWindow,
+			QueueSize:      1000,
+			Workers:        4,
+		}, clock.Real, func(err error) {
+			fmt.Fprintln(s.logger, err)
+		})
+		defer notifier.Close()
+		for _, e := range notifier.Events() {
+			events.Subscribe(e, notifier)
+		}
+	}
+
+	// Sessions are shared through Redis when there is one, so any instance can sign a browser out
+	var sessionStor SessionStorer = NewMemorySessionStorage()
+	if redisClient != nil {
+		sessionStor = NewRedisSessionStorage(redisClient, "separation:session:", clock.Real)
+	}
+	usrDisp := NewUserDispatcher(usrStor, prefStor, inviteStor, NewLogInviteSender(s.logger), policyStor, reviewStor, NewMemoryPhoneCodeStorage(), sms, NewMemoryMagicLinkStorage(), linkSender, sessionStor, NewMemoryLoginStorage(), s.geo, events, blobs, orgStor, clock.Real, cfg)
+	usrDisp.UseCommand(CountCommands)
+	usrDisp.UseQuery(CountQueries)
+	if cfg.RiskThresholds.Enabled() {
+		velocity := NewIPVelocityScorer(cfg.RiskVelocityPerIP, cfg.RiskVelocityWindow, clock.Real)
+		events.Subscribe("UserRegistered", velocity)
+		scorers := append([]RiskScorer{
+			NewEmailEntropyScorer(3.5, 4.5),
+			DisposableDomainScorer{},
+			velocity,
+		}, s.scorers...)
+		var captcha CaptchaVerifier
+		if cfg.CaptchaVerifyURL != "" {
+			captcha = NewSiteVerifyCaptcha(cfg.CaptchaVerifyURL, cfg.CaptchaSecret)
+		}
+		usrDisp.UseCommand(NewRiskChecker(scorers, cfg.RiskThresholds, captcha, reviewStor, clock.Real, func(ctx context.Context, err error) {
+			fmt.Fprintln(s.logger, err)
+		}).Commands)
+	}
+	usrServ := NewUserServiceImpl(usrDisp)
+
+	orgDisp := NewOrgDispatcher(orgStor, tokenStor, usrStor, clock.Real)
+	orgDisp.UseCommand(CountCommands)
+	orgDisp.UseQuery(CountQueries)
+	orgServ := NewOrgServiceImpl(orgDisp)
+
+	if cfg.SeedFile != "" {
+		fixtures, err := readFixturesFile(cfg.SeedFile)
+		if err != nil {
+			return err
+		}
+		// Fixtures are trusted like the admin API, so they need no invites
+		seedCtx := principal.NewContext(ctx, &principal.Principal{
+			Subject: "seed",
+			Scheme:  "seed-file",
+			Admin:   true,
+		})
+		// Instances booting together take turns, so the later ones skip what the first seeded
+		var seeded, skipped int
+		err = WithLock(seedCtx, locker, "seed", LockOptions{TTL: seedLockTTL, Wait: true}, func(ctx context.Context, lease *Lease) error {
+			var err error
+			seeded, skipped, err = SeedUsers(ctx, usrServ, fixtures)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("Seeding from %s failed: %v", cfg.SeedFile, err)
+		}
+		fmt.Fprintf(s.logger, "Seeded %d users from %s, %d were already registered\n", seeded, cfg.SeedFile, skipped)
+	}
+
+	err := stats.Refresh(ctx)
+	if err != nil {
+		return fmt.Errorf("Computing the user stats failed: %v", err)
+	}
+
+	maint, err := NewMaintenanceServiceImpl(ctx, maintStor, cfg.MaintenanceMessage, cfg.MaintenanceRetryAfter)
+	if err != nil {
+		return err
+	}
+
+	ipFilter, err := NewIPFilterServiceImpl(ctx, ipRuleStor, clock.Real)
+	if err != nil {
+		return err
+	}
+
+	auths := []Authenticator{
+		NewOrgTokenAuthenticator(orgServ),
+	}
+	if cfg.MTLSClientCA != "" {
+		auths = append(auths, NewClientCertAuthenticator())
+	}
+	if len(cfg.HMACKeys) > 0 {
+		auths = append(auths, NewHMACAuthenticator(cfg.HMACKeys, cfg.HMACAdminKeys, cfg.HMACMaxSkew, clock.Real))
+	}
+	var sessions *Sessions
+	if len(cfg.SessionKeys) > 0 {
+		sessions, err = NewSessions(cfg.SessionKeys, usrServ, cfg.SessionTTL, cfg.SessionSameSite, cfg.LoginRedirect, clock.Real)
+		if err != nil {
+			return err
+		}
+		auths = append(auths, sessions)
+	}
+	var webAuthn *WebAuthn
+	if cfg.WebAuthnRPID != "" {
+		webAuthn = NewWebAuthn(usrStor, NewMemoryWebAuthnCredentialStorage(), NewMemoryWebAuthnChallengeStorage(), WebAuthnOptions{
+			RPID:         cfg.WebAuthnRPID,
+			RPName:       cfg.WebAuthnRPName,
+			Origins:      cfg.WebAuthnOrigins,
+			ChallengeTTL: cfg.WebAuthnChallengeTTL,
+		}, clock.Real)
+	}
+	auths = append(auths, s.auths...)
+
+	ts, err := BuildTransports(cfg.Transports, &TransportDeps{
+		Config:         cfg,
+		Listener:       s.listener,
+		Users:          usrServ,
+		Orgs:           orgServ,
+		Authenticators: auths,
+		Maintenance:    maint,
+		IPFilter:       ipFilter,
+		SlowCalls:      slowCalls,
+		Changes:        changes,
+		Stats:          stats,
+		Templates:      templates,
+		Sessions:       sessions,
+		WebAuthn:       webAuthn,
+		Limiters:       NewConcurrencyLimiters(cfg.ConcurrencyLimits, cfg.ConcurrencyQueueWait, cfg.PriorityWeights),
+		Redis:          redisClient,
+		Shedder:        shedder,
+		Responses:      responses,
+	})
+	if err != nil {
+		return err
+	}
+
+	return RunTransports(ctx, func() (context.Context, context.CancelFunc) {
+		return context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	}, ts)
+}
+
+// RunCommand runs one of the subcommands of the binary instead of the server.
+func RunCommand(name string, args []string) error {
+	switch name {
+	case "backup":
+		return runBackup(args)
+	case "restore":
+		return runRestore(args)
+	case "replay-changelog":
+		return runReplayChangeLog(args)
+	case "check":
+		return runCheck(args)
+	case "replay-recording":
+		return runReplayRecording(args)
+	case "dev":
+		return runDev(args)
+	case "rebuild-projections":
+		return runRebuildProjections(args)
+	}
+	return fmt.Errorf("%w %q", ErrUnknownCommand, name)
+}
@@ -0,0 +1,211 @@
+package separation
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/oralordos/separation/internal/clock"
+	"github.com/oralordos/separation/internal/principal"
+)
+
+// testAuthenticator signs callers in as the user named by the X-Test-User header.
+type testAuthenticator struct{}
+
+func (testAuthenticator) Authenticate(r *http.Request) (*principal.Principal, error) {
+	email := r.Header.Get("X-Test-User")
+	if email == "" {
+		return nil, nil
+	}
+	return &principal.Principal{Subject: "test:" + email, Email: email, Scheme: "test"}, nil
+}
+
+// testConfig loads the configuration from the environment with env set over it, after
+// clearing what would make the server depend on anything outside the test.
+func testConfig(t *testing.T, env map[string]string) *Config {
+	for _, name := range []string{"STORAGE", "CHANGE_LOG", "SEED_FILE", "TRANSPORTS", "MIDDLEWARE", "ERROR_FORMAT", "INVITE_ONLY", "SESSION_KEYS", "RECORD_FILE", "DEFAULT_LOCALE", "REDIS_ADDR", "STORAGE_CACHE_INVALIDATION"} {
+		t.Setenv(name, "")
+	}
+	for name, value := range env {
+		t.Setenv(name, value)
+	}
+	cfg, err := LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+// startServer runs a server configured with cfg and opts until the test is over, and
+// returns the URL of its JSON access layer once it is answering.
+func startServer(t *testing.T, cfg *Config, opts ...Option) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	opts = append([]Option{WithConfig(cfg), WithListener(ln), WithLogger(io.Discard)}, opts...)
+	go func() {
+		done <- New(opts...).Run(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		err := <-done
+		if err != nil {
+			t.Error(err)
+		}
+	})
+
+	base := "http://" + ln.Addr().String()
+	waitForServer(t, base+"/healthz")
+	return base
+}
+
+func freePort(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	_, port, _ := net.SplitHostPort(ln.Addr().String())
+	return port
+}
+
+// waitForServer polls url until the server answers, or fails t after a few seconds.
+func waitForServer(t *testing.T, url string) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		resp, err := http.Get(url)
+		if err == nil {
+			resp.Body.Close()
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Server did not start: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// testRequest sends body to url as user, and returns the status and body of the response.
+func testRequest(method, url, user, body string) (int, string, error) {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		return 0, "", err
+	}
+	if body != "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if user != "" {
+		req.Header.Set("X-Test-User", user)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(b), err
+}
+
+// TestTwoInstances runs two servers on one backend, each with its own user cache, as
+// instances behind a load balancer would. Registrations of the same email race at both,
+// and each change is read back from the other instance straight away.
+func TestTwoInstances(t *testing.T) {
+	checkLeaks(t)
+	const (
+		emails      = 10
+		racersEach  = 3
+		rereadCount = 3
+	)
+	cfg := testConfig(t, map[string]string{
+		"STORAGE_CACHE_TTL": "1m",
+		"TERMS_VERSION":     "",
+	})
+	shared := NewMemoryUserStorage()
+	bus := NewMemoryInvalidationBus()
+	locker := NewMemoryLocker(clock.Real)
+	var instances []string
+	for i := 0; i < 2; i++ {
+		instanceCfg := *cfg
+		instances = append(instances, startServer(t, &instanceCfg, WithStorage(shared), WithInvalidationBus(bus), WithLocker(locker), WithAuthenticator(testAuthenticator{})))
+	}
+
+	// Conflicting registrations: exactly one per email succeeds, at whichever instance
+	var mu sync.Mutex
+	created := map[string]int{}
+	var wg sync.WaitGroup
+	for e := 0; e < emails; e++ {
+		email := fmt.Sprintf("user%d@example.com", e)
+		for _, base := range instances {
+			for r := 0; r < racersEach; r++ {
+				wg.Add(1)
+				go func(base string, r int) {
+					defer wg.Done()
+					body := fmt.Sprintf(`{"email":%q,"name":"Racer %d"}`, email, r)
+					status, resp, err := testRequest(http.MethodPost, base+"/register", "", body)
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					switch status {
+					case http.StatusCreated:
+						mu.Lock()
+						created[email]++
+						mu.Unlock()
+					case http.StatusForbidden:
+					default:
+						t.Errorf("Registering %s at %s answered %d: %s", email, base, status, resp)
+					}
+				}(base, r)
+			}
+		}
+	}
+	wg.Wait()
+	for e := 0; e < emails; e++ {
+		email := fmt.Sprintf("user%d@example.com", e)
+		if created[email] != 1 {
+			t.Errorf("%s was registered %d times", email, created[email])
+		}
+	}
+
+	// Read your writes: with both caches holding a user, a change at one instance is
+	// seen at the other by the very next read
+	for e := 0; e < emails; e++ {
+		email := fmt.Sprintf("user%d@example.com", e)
+		query := "/user?email=" + url.QueryEscape(email)
+		for _, base := range instances {
+			status, resp, err := testRequest(http.MethodGet, base+query, "", "")
+			if err != nil || status != http.StatusOK {
+				t.Fatalf("Reading %s at %s answered %d: %s %v", email, base, status, resp, err)
+			}
+		}
+
+		for n := 0; n < rereadCount; n++ {
+			writer, reader := instances[n%2], instances[(n+1)%2]
+			username := fmt.Sprintf("user%d_%d", e, n)
+			status, resp, err := testRequest(http.MethodPut, writer+"/me/username", email, fmt.Sprintf(`{"username":%q}`, username))
+			if err != nil || status != http.StatusNoContent {
+				t.Fatalf("Setting the username of %s at %s answered %d: %s %v", email, writer, status, resp, err)
+			}
+			for _, base := range []string{reader, writer} {
+				status, resp, err = testRequest(http.MethodGet, base+query, "", "")
+				if err != nil || status != http.StatusOK {
+					t.Fatalf("Reading %s at %s answered %d: %s %v", email, base, status, resp, err)
+				}
+				if !strings.Contains(resp, fmt.Sprintf(`"username":%q`, username)) {
+					t.Errorf("%s set its username to %s at %s, but %s answered %s", email, username, writer, base, resp)
+				}
+			}
+		}
+	}
+}
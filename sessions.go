@@ -0,0 +1,652 @@
+package separation
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oralordos/separation/internal/clock"
+	"github.com/oralordos/separation/internal/cookies"
+	"github.com/oralordos/separation/internal/principal"
+	"github.com/oralordos/separation/internal/redis"
+)
+
+// Action Layer
+var ErrSessionNotFound = registerError(errors.New("Session not found"), "session_not_found", http.StatusNotFound, "The user has no session with the ID, or it expired")
+
+// Session is a browser signed in as a user. The browser holds a random token in its session
+// cookie, and only the hash of the token is kept.
+type Session struct {
+	// ID is the SHA-256 of the token in the session cookie
+	ID         string    `json:"id"`
+	Email      Email     `json:"email"`
+	UserAgent  string    `json:"user_agent,omitempty"`
+	IP         string    `json:"ip,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	// ExpiresAt moves forward each time the session is used
+	ExpiresAt time.Time `json:"expires_at"`
+	// Current is set when the session is listed to the browser holding it
+	Current bool `json:"current,omitempty"`
+}
+
+type SessionStorer interface {
+	// Save adds or replaces the session
+	Save(ctx context.Context, s *Session) error
+	// Get may return an ErrSessionNotFound error
+	Get(ctx context.Context, id string) (*Session, error)
+	// Delete may return an ErrSessionNotFound error
+	Delete(ctx context.Context, id string) error
+	// List returns the sessions of the user that have not expired by now, oldest first
+	List(ctx context.Context, email Email, now time.Time) ([]*Session, error)
+	// DeleteExpired removes the sessions that expired before now, returning how many there were
+	DeleteExpired(ctx context.Context, now time.Time) (int, error)
+}
+
+// RepositorySessionStorage implements SessionStorer on top of any session repository.
+// Listing the sessions of one user reads every session, which suits the memory repository.
+type RepositorySessionStorage struct {
+	repo Repository[string, *Session]
+	mu   sync.Mutex
+}
+
+func NewRepositorySessionStorage(repo Repository[string, *Session]) *RepositorySessionStorage {
+	return &RepositorySessionStorage{
+		repo: repo,
+	}
+}
+
+func NewMemorySessionStorage() *RepositorySessionStorage {
+	return NewRepositorySessionStorage(NewMemoryRepository(func(s *Session) string {
+		return s.ID
+	}))
+}
+
+func (rs *RepositorySessionStorage) Save(ctx context.Context, s *Session) error {
+	return rs.repo.Save(ctx, s)
+}
+
+func (rs *RepositorySessionStorage) Get(ctx context.Context, id string) (*Session, error) {
+	s, err := rs.repo.Get(ctx, id)
+	if err == ErrNotFound {
+		return nil, ErrSessionNotFound
+	}
+	return s, err
+}
+
+func (rs *RepositorySessionStorage) Delete(ctx context.Context, id string) error {
+	err := rs.repo.Delete(ctx, id)
+	if err == ErrNotFound {
+		return ErrSessionNotFound
+	}
+	return err
+}
+
+func (rs *RepositorySessionStorage) List(ctx context.Context, email Email, now time.Time) ([]*Session, error) {
+	all, err := rs.repo.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	sessions := []*Session{}
+	for _, s := range all {
+		if s.Email == email && now.Before(s.ExpiresAt) {
+			sessions = append(sessions, s)
+		}
+	}
+	sortSessions(sessions)
+	return sessions, nil
+}
+
+func (rs *RepositorySessionStorage) DeleteExpired(ctx context.Context, now time.Time) (int, error) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	all, err := rs.repo.List(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for _, s := range all {
+		if now.Before(s.ExpiresAt) {
+			continue
+		}
+		err = rs.repo.Delete(ctx, s.ID)
+		if err == ErrNotFound {
+			continue
+		} else if err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+func sortSessions(sessions []*Session) {
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].CreatedAt.Before(sessions[j].CreatedAt)
+	})
+}
+
+// sessionSaveScript stores the session in KEYS[1] until it expires, and adds its ID to the
+// set of the user's sessions in KEYS[2], which lasts as long as the user's last session.
+const sessionSaveScript = `redis.call('SET', KEYS[1], ARGV[1], 'PX', ARGV[2])
+redis.call('SADD', KEYS[2], ARGV[3])
+if redis.call('PTTL', KEYS[2]) < tonumber(ARGV[2]) then redis.call('PEXPIRE', KEYS[2], ARGV[2]) end
+return 1`
+
+// RedisSessionStorage keeps sessions in Redis, so every instance using the same server
+// shares them. Each session is a key that expires with it, so DeleteExpired has nothing to do.
+type RedisSessionStorage struct {
+	client *redis.Client
+	prefix string
+	clock  clock.Clock
+}
+
+// NewRedisSessionStorage stores sessions under keys starting with prefix.
+func NewRedisSessionStorage(client *redis.Client, prefix string, clk clock.Clock) *RedisSessionStorage {
+	return &RedisSessionStorage{
+		client: client,
+		prefix: prefix,
+		clock:  clk,
+	}
+}
+
+func (rs *RedisSessionStorage) key(id string) string {
+	return rs.prefix + id
+}
+
+func (rs *RedisSessionStorage) userKey(email Email) string {
+	return rs.prefix + "user:" + email.String()
+}
+
+func (rs *RedisSessionStorage) Save(ctx context.Context, s *Session) error {
+	b, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	ttl := s.ExpiresAt.Sub(rs.clock.Now()).Milliseconds()
+	if ttl < 1 {
+		ttl = 1
+	}
+	_, err = rs.client.Do(ctx, "EVAL", sessionSaveScript, "2", rs.key(s.ID), rs.userKey(s.Email), string(b), strconv.FormatInt(ttl, 10), s.ID)
+	return err
+}
+
+func (rs *RedisSessionStorage) Get(ctx context.Context, id string) (*Session, error) {
+	reply, err := rs.client.Do(ctx, "GET", rs.key(id))
+	if err != nil {
+		return nil, err
+	}
+	if reply == nil {
+		return nil, ErrSessionNotFound
+	}
+	value, ok := reply.(string)
+	if !ok {
+		return nil, fmt.Errorf("Unexpected session reply %v", reply)
+	}
+	s := &Session{}
+	err = json.Unmarshal([]byte(value), s)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (rs *RedisSessionStorage) Delete(ctx context.Context, id string) error {
+	s, err := rs.Get(ctx, id)
+	if err != nil {
+		return err
+	}
+	reply, err := rs.client.Do(ctx, "DEL", rs.key(id))
+	if err != nil {
+		return err
+	}
+	if n, _ := reply.(int64); n == 0 {
+		return ErrSessionNotFound
+	}
+	_, err = rs.client.Do(ctx, "SREM", rs.userKey(s.Email), id)
+	return err
+}
+
+func (rs *RedisSessionStorage) List(ctx context.Context, email Email, now time.Time) ([]*Session, error) {
+	reply, err := rs.client.Do(ctx, "SMEMBERS", rs.userKey(email))
+	if err != nil {
+		return nil, err
+	}
+	ids, ok := reply.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Unexpected session list reply %v", reply)
+	}
+
+	sessions := []*Session{}
+	for _, v := range ids {
+		id, ok := v.(string)
+		if !ok {
+			return nil, fmt.Errorf("Unexpected session list reply %v", reply)
+		}
+		s, err := rs.Get(ctx, id)
+		if err == ErrSessionNotFound {
+			// The session expired, leaving its ID behind
+			_, err = rs.client.Do(ctx, "SREM", rs.userKey(email), id)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if now.Before(s.ExpiresAt) {
+			sessions = append(sessions, s)
+		}
+	}
+	sortSessions(sessions)
+	return sessions, nil
+}
+
+func (rs *RedisSessionStorage) DeleteExpired(ctx context.Context, now time.Time) (int, error) {
+	return 0, nil
+}
+
+// Business Logic
+
+// sessionTouchInterval is how stale the last seen time of a session may get before using
+// it saves the session again, so that a busy browser does not write on every request.
+const sessionTouchInterval = time.Minute
+
+type StartSessionParams struct {
+	Email     Email  `json:"email"`
+	UserAgent string `json:"user_agent"`
+	// Method is how the user signed in, such as LoginMethodMagicLink
+	Method string `json:"method"`
+
+	// Token is set to the secret the browser presents to use the session
+	Token string `json:"-"`
+}
+
+func (sp *StartSessionParams) CommandName() string {
+	return "StartSession"
+}
+
+func (sp *StartSessionParams) Validate() error {
+	if sp.Email.IsZero() {
+		return ErrEmailEmpty
+	}
+	return nil
+}
+
+type AuthenticateSessionParams struct {
+	Token string `json:"-"`
+
+	// Session is set to the session the token belongs to
+	Session *Session `json:"-"`
+	// Extended is set when the session was used after more than a touch interval, moving its expiry
+	Extended bool `json:"-"`
+}
+
+func (ap *AuthenticateSessionParams) CommandName() string {
+	return "AuthenticateSession"
+}
+
+func (ap *AuthenticateSessionParams) Validate() error {
+	if ap.Token == "" {
+		return ErrSessionNotFound
+	}
+	return nil
+}
+
+type ListSessionsQuery struct {
+	Email Email
+}
+
+func (lq *ListSessionsQuery) QueryName() string {
+	return "ListSessions"
+}
+
+type RevokeSessionParams struct {
+	Email Email  `json:"email"`
+	ID    string `json:"id"`
+}
+
+func (rp *RevokeSessionParams) CommandName() string {
+	return "RevokeSession"
+}
+
+func (rp *RevokeSessionParams) Validate() error {
+	if rp.Email.IsZero() {
+		return ErrEmailEmpty
+	}
+	if rp.ID == "" {
+		return ErrSessionNotFound
+	}
+	return nil
+}
+
+// SessionHandler starts, checks and ends the sessions of signed in browsers. A session lasts
+// ttl from the last time it was used.
+type SessionHandler struct {
+	userStorage    UserStorer
+	sessionStorage SessionStorer
+	logins         *LoginRecorder
+	ttl            time.Duration
+	clock          clock.Clock
+}
+
+// NewSessionHandler records every session started as a login with logins.
+func NewSessionHandler(us UserStorer, ss SessionStorer, logins *LoginRecorder, ttl time.Duration, clk clock.Clock) *SessionHandler {
+	return &SessionHandler{
+		userStorage:    us,
+		sessionStorage: ss,
+		logins:         logins,
+		ttl:            ttl,
+		clock:          clk,
+	}
+}
+
+// Start signs a browser in as a registered user, setting params.Token to the session's secret,
+// and adds the login to the user's history.
+func (sh *SessionHandler) Start(ctx context.Context, cmd Command) error {
+	params, ok := cmd.(*StartSessionParams)
+	if !ok {
+		return fmt.Errorf("SessionHandler cannot start %T", cmd)
+	}
+
+	_, err := sh.userStorage.Get(ctx, params.Email)
+	if err != nil {
+		return err
+	}
+
+	now := sh.clock.Now().UTC()
+	_, err = sh.sessionStorage.DeleteExpired(ctx, now)
+	if err != nil {
+		return err
+	}
+
+	token, err := newMagicLinkToken()
+	if err != nil {
+		return err
+	}
+	ip := clientIPFromContext(ctx)
+	err = sh.sessionStorage.Save(ctx, &Session{
+		ID:         hashMagicLinkSecret(token),
+		Email:      params.Email,
+		UserAgent:  params.UserAgent,
+		IP:         ip,
+		CreatedAt:  now,
+		LastSeenAt: now,
+		ExpiresAt:  now.Add(sh.ttl),
+	})
+	if err != nil {
+		return err
+	}
+
+	err = sh.logins.Record(ctx, &Login{
+		Email:     params.Email,
+		At:        now,
+		IP:        ip,
+		UserAgent: params.UserAgent,
+		Method:    params.Method,
+	})
+	if err != nil {
+		return err
+	}
+	params.Token = token
+	return nil
+}
+
+// Authenticate finds the session of a token, which must not have expired and must belong to
+// a user that still exists. A session outliving its user is deleted.
+func (sh *SessionHandler) Authenticate(ctx context.Context, cmd Command) error {
+	params, ok := cmd.(*AuthenticateSessionParams)
+	if !ok {
+		return fmt.Errorf("SessionHandler cannot authenticate %T", cmd)
+	}
+
+	s, err := sh.sessionStorage.Get(ctx, hashMagicLinkSecret(params.Token))
+	if err != nil {
+		return err
+	}
+	now := sh.clock.Now().UTC()
+	if !now.Before(s.ExpiresAt) {
+		return ErrSessionNotFound
+	}
+
+	_, err = sh.userStorage.Get(ctx, s.Email)
+	if err == ErrUserNotFound {
+		err = sh.sessionStorage.Delete(ctx, s.ID)
+		if err != nil && err != ErrSessionNotFound {
+			return err
+		}
+		return ErrSessionNotFound
+	} else if err != nil {
+		return err
+	}
+
+	if now.Sub(s.LastSeenAt) >= sessionTouchInterval {
+		s.LastSeenAt = now
+		s.ExpiresAt = now.Add(sh.ttl)
+		err = sh.sessionStorage.Save(ctx, s)
+		if err != nil {
+			return err
+		}
+		params.Extended = true
+	}
+	params.Session = s
+	return nil
+}
+
+// List returns the sessions of a user, marking the one the caller is using as current.
+func (sh *SessionHandler) List(ctx context.Context, q Query) (interface{}, error) {
+	query, ok := q.(*ListSessionsQuery)
+	if !ok {
+		return nil, fmt.Errorf("SessionHandler cannot list %T", q)
+	}
+
+	err := requireSelfOrAdmin(ctx, query.Email)
+	if err != nil {
+		return nil, err
+	}
+
+	sessions, err := sh.sessionStorage.List(ctx, query.Email, sh.clock.Now())
+	if err != nil {
+		return nil, err
+	}
+	p, _ := principal.FromContext(ctx)
+	for i, s := range sessions {
+		if p != nil && p.Session != "" && s.ID == p.Session {
+			current := *s
+			current.Current = true
+			sessions[i] = &current
+		}
+	}
+	return sessions, nil
+}
+
+// Revoke ends a session of a user, signing the browser holding it out.
+func (sh *SessionHandler) Revoke(ctx context.Context, cmd Command) error {
+	params, ok := cmd.(*RevokeSessionParams)
+	if !ok {
+		return fmt.Errorf("SessionHandler cannot revoke %T", cmd)
+	}
+
+	err := requireSelfOrAdmin(ctx, params.Email)
+	if err != nil {
+		return err
+	}
+
+	s, err := sh.sessionStorage.Get(ctx, params.ID)
+	if err != nil {
+		return err
+	}
+	// Another user's session is not found, so that IDs cannot be probed
+	if s.Email != params.Email {
+		return ErrSessionNotFound
+	}
+	return sh.sessionStorage.Delete(ctx, params.ID)
+}
+
+// Access Layer
+
+// Sessions keep users signed in with an encrypted cookie holding the token of a server-side
+// session, once they redeem a sign-in link or use a passkey. Sessions is also the
+// Authenticator of those cookies.
+type Sessions struct {
+	codec    *cookies.Codec
+	users    UserService
+	ttl      time.Duration
+	sameSite http.SameSite
+	// landing is where a browser is sent once signed in. When it is empty the user is returned as JSON.
+	landing string
+}
+
+// NewSessions encrypts session cookies with the first of keys, accepting any of them. The
+// cookies last ttl in the browser, matching the sessions users keeps, and are sent on the
+// cross-site requests sameSite allows.
+func NewSessions(keys [][]byte, users UserService, ttl time.Duration, sameSite http.SameSite, landing string, clk clock.Clock) (*Sessions, error) {
+	codec, err := cookies.New(keys, cookies.Options{Encrypt: true, Clock: clk})
+	if err != nil {
+		return nil, err
+	}
+	return &Sessions{
+		codec:    codec,
+		users:    users,
+		ttl:      ttl,
+		sameSite: sameSite,
+		landing:  landing,
+	}, nil
+}
+
+// start signs the browser making r in as the user with email, who signed in with method.
+func (s *Sessions) start(w http.ResponseWriter, r *http.Request, email Email, method string) error {
+	params := &StartSessionParams{Email: email, UserAgent: r.UserAgent(), Method: method}
+	err := s.users.StartSession(r.Context(), params)
+	if err != nil {
+		return err
+	}
+	return s.setCookie(w, params.Token)
+}
+
+func (s *Sessions) setCookie(w http.ResponseWriter, token string) error {
+	return s.codec.Set(w, &http.Cookie{Name: sessionCookie, Value: token, MaxAge: int(s.ttl / time.Second), SameSite: s.sameSite})
+}
+
+// authenticate returns the principal of the session cookie on r, if there is one. A cookie
+// that is tampered with, signed with a key no longer configured, or whose session ended is
+// stale: the caller is anonymous, so they can still sign in again or out.
+func (s *Sessions) authenticate(r *http.Request) (p *principal.Principal, params *AuthenticateSessionParams, stale bool, err error) {
+	token, err := s.codec.Get(r, sessionCookie)
+	if err == http.ErrNoCookie {
+		return nil, nil, false, nil
+	} else if err != nil {
+		return nil, nil, true, nil
+	}
+
+	params = &AuthenticateSessionParams{Token: token}
+	err = s.users.AuthenticateSession(r.Context(), params)
+	if err == ErrSessionNotFound {
+		return nil, nil, true, nil
+	} else if err != nil {
+		return nil, nil, false, err
+	}
+	email := params.Session.Email.String()
+	return &principal.Principal{
+		Subject: email,
+		Email:   email,
+		Scheme:  "session",
+		Session: params.Session.ID,
+	}, params, false, nil
+}
+
+func (s *Sessions) Authenticate(r *http.Request) (*principal.Principal, error) {
+	p, _, _, err := s.authenticate(r)
+	return p, err
+}
+
+// AuthenticateResponse also expires a stale session cookie, so the browser stops sending it,
+// and renews the cookie of a session whose expiry moved.
+func (s *Sessions) AuthenticateResponse(w http.ResponseWriter, r *http.Request) (*principal.Principal, error) {
+	p, params, stale, err := s.authenticate(r)
+	if stale {
+		cookies.Clear(w, sessionCookie, "")
+	}
+	if params != nil && params.Extended {
+		err = s.setCookie(w, params.Token)
+	}
+	return p, err
+}
+
+// Logout serves POST /logout, ending the session of the browser.
+func (j *JsonOverHTTP) Logout(w http.ResponseWriter, r *http.Request) {
+	if p, ok := principal.FromContext(r.Context()); ok && p.Session != "" {
+		email, err := ParseEmail(p.Email)
+		if err != nil {
+			writeError(w, r, ErrUnauthenticated)
+			return
+		}
+		err = j.usrServ.RevokeSession(r.Context(), &RevokeSessionParams{Email: email, ID: p.Session})
+		if err != nil && err != ErrSessionNotFound {
+			writeError(w, r, err)
+			return
+		}
+	}
+	cookies.Clear(w, sessionCookie, "")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// MySessions serves GET /me/sessions, listing where the calling user is signed in.
+func (j *JsonOverHTTP) MySessions(w http.ResponseWriter, r *http.Request) {
+	p, ok := principal.FromContext(r.Context())
+	if !ok || p.Email == "" {
+		writeError(w, r, ErrUnauthenticated)
+		return
+	}
+	email, err := ParseEmail(p.Email)
+	if err != nil {
+		writeError(w, r, ErrUnauthenticated)
+		return
+	}
+
+	sessions, err := j.usrServ.ListSessions(r.Context(), &ListSessionsQuery{Email: email})
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(sessions)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+}
+
+// RevokeMySession serves DELETE /me/sessions/{id}, signing the calling user out of the
+// browser holding the session.
+func (j *JsonOverHTTP) RevokeMySession(w http.ResponseWriter, r *http.Request) {
+	p, ok := principal.FromContext(r.Context())
+	if !ok || p.Email == "" {
+		writeError(w, r, ErrUnauthenticated)
+		return
+	}
+	email, err := ParseEmail(p.Email)
+	if err != nil {
+		writeError(w, r, ErrUnauthenticated)
+		return
+	}
+
+	params := &RevokeSessionParams{Email: email, ID: strings.TrimPrefix(r.URL.Path, "/me/sessions/")}
+	err = j.usrServ.RevokeSession(r.Context(), params)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,240 @@
+package separation
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/oralordos/separation/internal/clock/clocktest"
+	"github.com/oralordos/separation/internal/cookies"
+	"github.com/oralordos/separation/internal/principal"
+)
+
+var testSessionKey = []byte("the session key configured right now")
+
+// sessionServer serves the JSON access layer behind session authentication, with ada@example.com registered.
+func sessionServer(t *testing.T, clk *clocktest.Fake, ttl time.Duration) (http.Handler, *Sessions, UserStorer) {
+	us := NewMemoryUserStorage()
+	email, _ := ParseEmail("ada@example.com")
+	err := us.Insert(context.Background(), &User{Email: email, Name: "Ada Lovelace"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := NewDispatcher()
+	d.UseCommand(ValidateCommands)
+	sh := NewSessionHandler(us, NewMemorySessionStorage(), NewLoginRecorder(NewMemoryLoginStorage(), nil, NewEventBus()), ttl, clk)
+	d.HandleCommand((&StartSessionParams{}).CommandName(), CommandHandlerFunc(sh.Start))
+	d.HandleCommand((&AuthenticateSessionParams{}).CommandName(), CommandHandlerFunc(sh.Authenticate))
+	d.HandleQuery((&ListSessionsQuery{}).QueryName(), QueryHandlerFunc(sh.List))
+	d.HandleCommand((&RevokeSessionParams{}).CommandName(), CommandHandlerFunc(sh.Revoke))
+	d.HandleQuery((&GetMeQuery{}).QueryName(), NewGetMeQueryHandler(us))
+	usrServ := NewUserServiceImpl(d)
+
+	sessions, err := NewSessions([][]byte{testSessionKey}, usrServ, ttl, http.SameSiteLaxMode, "", clk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j := NewJsonOverHTTP(usrServ, nil, 1<<20)
+	j.Sessions = sessions
+	return NewAuthMiddleware(NewCSRFGuard(j, [][]byte{testSessionKey}), sessions), sessions, us
+}
+
+// signIn starts a session of ada@example.com, returning its cookie.
+func signIn(t *testing.T, sessions *Sessions) *http.Cookie {
+	email, _ := ParseEmail("ada@example.com")
+	w := httptest.NewRecorder()
+	err := sessions.start(w, httptest.NewRequest(http.MethodGet, "/login/magic/callback", nil), email, LoginMethodMagicLink)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return w.Result().Cookies()[0]
+}
+
+// serveWithCookie serves a request with the session cookie c and, when it is set, the CSRF token csrf.
+func serveWithCookie(h http.Handler, method, target string, c *http.Cookie, csrf string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, nil)
+	if c != nil {
+		r.AddCookie(c)
+	}
+	if csrf != "" {
+		r.Header.Set(csrfHeader, csrf)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func sessionCookieCleared(w *httptest.ResponseRecorder) bool {
+	for _, c := range w.Result().Cookies() {
+		if c.Name == sessionCookie && c.MaxAge < 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func TestStaleSessionCookieIsAnonymous(t *testing.T) {
+	clk := clocktest.NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	oldKey := []byte("an old session key that was rotated out")
+
+	old, err := cookies.New([][]byte{oldKey}, cookies.Options{Encrypt: true, Clock: clk})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	err = old.Set(rec, &http.Cookie{Name: sessionCookie, Value: "ada@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale := rec.Result().Cookies()[0]
+
+	_, sessions, _ := sessionServer(t, clk, time.Hour)
+	var seen bool
+	var p *principal.Principal
+	h := NewAuthMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = true
+		p, _ = principal.FromContext(r.Context())
+		w.WriteHeader(http.StatusNoContent)
+	}), sessions)
+
+	w := serveWithCookie(h, http.MethodGet, "/me", stale, "")
+
+	if !seen || w.Code != http.StatusNoContent {
+		t.Fatalf("got status %d, want the request to pass through anonymously", w.Code)
+	}
+	if p != nil {
+		t.Errorf("got principal %+v, want none", p)
+	}
+	if !sessionCookieCleared(w) {
+		t.Errorf("got Set-Cookie %q, want the session cookie expired", w.Header().Values("Set-Cookie"))
+	}
+}
+
+func TestSessionRevocation(t *testing.T) {
+	clk := clocktest.NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	h, sessions, _ := sessionServer(t, clk, time.Hour)
+	laptop := signIn(t, sessions)
+	phone := signIn(t, sessions)
+
+	w := serveWithCookie(h, http.MethodGet, "/me/sessions", laptop, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Listing sessions answered %d: %s", w.Code, w.Body)
+	}
+	csrf := w.Header().Get(csrfHeader)
+	var listed []*Session
+	err := json.Unmarshal(w.Body.Bytes(), &listed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(listed) != 2 {
+		t.Fatalf("got %d sessions, want 2", len(listed))
+	}
+	var phoneID string
+	for _, s := range listed {
+		if !s.Current {
+			phoneID = s.ID
+		}
+	}
+	if phoneID == "" {
+		t.Fatalf("got sessions %+v, want one not current", listed)
+	}
+
+	w = serveWithCookie(h, http.MethodDelete, "/me/sessions/"+phoneID, laptop, csrf)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("Revoking the phone's session answered %d: %s", w.Code, w.Body)
+	}
+	w = serveWithCookie(h, http.MethodGet, "/me", phone, "")
+	if w.Code != http.StatusUnauthorized || !sessionCookieCleared(w) {
+		t.Errorf("The revoked session answered %d with Set-Cookie %q, want 401 and the cookie expired", w.Code, w.Header().Values("Set-Cookie"))
+	}
+
+	w = serveWithCookie(h, http.MethodPost, "/logout", laptop, csrf)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("Logging out answered %d: %s", w.Code, w.Body)
+	}
+	// The cookie is still valid, but its session is gone
+	w = serveWithCookie(h, http.MethodGet, "/me", laptop, "")
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("A logged out session answered %d, want 401", w.Code)
+	}
+}
+
+func TestSessionEndsWithUser(t *testing.T) {
+	clk := clocktest.NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	h, sessions, us := sessionServer(t, clk, time.Hour)
+	c := signIn(t, sessions)
+
+	email, _ := ParseEmail("ada@example.com")
+	_, err := us.Delete(context.Background(), []Email{email})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := serveWithCookie(h, http.MethodGet, "/me", c, "")
+	if w.Code != http.StatusUnauthorized || !sessionCookieCleared(w) {
+		t.Errorf("The deleted user's session answered %d with Set-Cookie %q, want 401 and the cookie expired", w.Code, w.Header().Values("Set-Cookie"))
+	}
+}
+
+func TestSessionSlidingExpiry(t *testing.T) {
+	clk := clocktest.NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	h, sessions, _ := sessionServer(t, clk, time.Hour)
+	used := signIn(t, sessions)
+	idle := signIn(t, sessions)
+
+	for i := 0; i < 3; i++ {
+		clk.Advance(40 * time.Minute)
+		w := serveWithCookie(h, http.MethodGet, "/me", used, "")
+		if w.Code != http.StatusOK {
+			t.Fatalf("A session used every 40m answered %d after %d uses", w.Code, i+1)
+		}
+		if len(w.Result().Cookies()) == 0 {
+			t.Errorf("Using the session did not renew its cookie")
+		}
+	}
+
+	w := serveWithCookie(h, http.MethodGet, "/me", idle, "")
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("A session idle for 2h answered %d, want 401", w.Code)
+	}
+}
+
+func TestCSRFToken(t *testing.T) {
+	clk := clocktest.NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	h, sessions, _ := sessionServer(t, clk, time.Hour)
+	laptop := signIn(t, sessions)
+	phone := signIn(t, sessions)
+
+	w := serveWithCookie(h, http.MethodGet, "/me", laptop, "")
+	laptopToken := w.Header().Get(csrfHeader)
+	w = serveWithCookie(h, http.MethodGet, "/me", phone, "")
+	phoneToken := w.Header().Get(csrfHeader)
+	if laptopToken == "" || laptopToken == phoneToken {
+		t.Fatalf("got CSRF tokens %q and %q, want one per session", laptopToken, phoneToken)
+	}
+
+	for _, tc := range []struct {
+		name  string
+		token string
+		want  int
+	}{
+		{name: "missing", token: "", want: http.StatusForbidden},
+		{name: "of another session", token: phoneToken, want: http.StatusForbidden},
+		{name: "of the session", token: laptopToken, want: http.StatusNoContent},
+	} {
+		w = serveWithCookie(h, http.MethodPost, "/logout", laptop, tc.token)
+		if w.Code != tc.want {
+			t.Errorf("Logging out with a token %s answered %d, want %d", tc.name, w.Code, tc.want)
+		}
+	}
+
+	// Anonymous callers have no session to protect
+	w = serveWithCookie(h, http.MethodPost, "/logout", nil, "")
+	if w.Code != http.StatusNoContent || w.Header().Get(csrfHeader) != "" {
+		t.Errorf("Logging out anonymously answered %d with token %q, want 204 and no token", w.Code, w.Header().Get(csrfHeader))
+	}
+}
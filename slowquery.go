@@ -0,0 +1,170 @@
+package separation
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Action Layer
+type SlowCall struct {
+	Op       string        `json:"op"`
+	Key      string        `json:"key,omitempty"`
+	Start    time.Time     `json:"start"`
+	Duration time.Duration `json:"duration_ns"`
+	Err      string        `json:"error,omitempty"`
+}
+
+// SlowCallLog is a fixed size ring buffer of the most recent slow calls.
+type SlowCallLog struct {
+	mu    sync.Mutex
+	calls []SlowCall
+	next  int
+	full  bool
+}
+
+func NewSlowCallLog(size int) *SlowCallLog {
+	return &SlowCallLog{
+		calls: make([]SlowCall, size),
+	}
+}
+
+func (sl *SlowCallLog) Add(c SlowCall) {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+
+	if len(sl.calls) == 0 {
+		return
+	}
+	sl.calls[sl.next] = c
+	sl.next = (sl.next + 1) % len(sl.calls)
+	if sl.next == 0 {
+		sl.full = true
+	}
+}
+
+// Recent returns the recorded calls, newest first.
+func (sl *SlowCallLog) Recent() []SlowCall {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+
+	n := sl.next
+	if sl.full {
+		n = len(sl.calls)
+	}
+
+	recent := make([]SlowCall, 0, n)
+	for i := 1; i <= n; i++ {
+		recent = append(recent, sl.calls[(sl.next-i+len(sl.calls))%len(sl.calls)])
+	}
+	return recent
+}
+
+var slowStorageCalls = expvar.NewInt("slow_storage_calls")
+
+// SlowQueryLogger is a UserStorer decorator that records every call taking
+// longer than threshold, to help diagnose backend regressions.
+type SlowQueryLogger struct {
+	next      UserStorer
+	threshold time.Duration
+	log       *SlowCallLog
+}
+
+func NewSlowQueryLogger(next UserStorer, threshold time.Duration, log *SlowCallLog) *SlowQueryLogger {
+	return &SlowQueryLogger{
+		next:      next,
+		threshold: threshold,
+		log:       log,
+	}
+}
+
+func (sq *SlowQueryLogger) observe(op, key string, start time.Time, err error) {
+	d := time.Since(start)
+	if d < sq.threshold {
+		return
+	}
+
+	c := SlowCall{
+		Op:       op,
+		Key:      key,
+		Start:    start,
+		Duration: d,
+	}
+	if err != nil {
+		c.Err = err.Error()
+	}
+	sq.log.Add(c)
+	slowStorageCalls.Add(1)
+}
+
+func (sq *SlowQueryLogger) Get(ctx context.Context, email Email) (*User, error) {
+	start := time.Now()
+	u, err := sq.next.Get(ctx, email)
+	sq.observe("Get", email.String(), start, err)
+	return u, err
+}
+
+func (sq *SlowQueryLogger) GetByUsername(ctx context.Context, username Username) (*User, error) {
+	start := time.Now()
+	u, err := sq.next.GetByUsername(ctx, username)
+	sq.observe("GetByUsername", username.String(), start, err)
+	return u, err
+}
+
+func (sq *SlowQueryLogger) Save(ctx context.Context, user *User) error {
+	start := time.Now()
+	err := sq.next.Save(ctx, user)
+	sq.observe("Save", user.Email.String(), start, err)
+	return err
+}
+
+func (sq *SlowQueryLogger) Insert(ctx context.Context, user *User) error {
+	start := time.Now()
+	err := sq.next.Insert(ctx, user)
+	sq.observe("Insert", user.Email.String(), start, err)
+	return err
+}
+
+func (sq *SlowQueryLogger) List(ctx context.Context, sel LabelSelector) ([]*User, error) {
+	start := time.Now()
+	users, err := sq.next.List(ctx, sel)
+	sq.observe("List", "", start, err)
+	return users, err
+}
+
+func (sq *SlowQueryLogger) ListFiltered(ctx context.Context, sel LabelSelector, f Filter) ([]*User, error) {
+	start := time.Now()
+	users, err := listFiltered(ctx, sq.next, sel, f)
+	sq.observe("ListFiltered", "", start, err)
+	return users, err
+}
+
+func (sq *SlowQueryLogger) Delete(ctx context.Context, emails []Email) (int, error) {
+	start := time.Now()
+	n, err := sq.next.Delete(ctx, emails)
+	sq.observe("Delete", strconv.Itoa(len(emails))+" users", start, err)
+	return n, err
+}
+
+// Access Layer
+type SlowCallLister interface {
+	Recent() []SlowCall
+}
+
+func (a *AdminHTTP) SlowQueries(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, NewMethodError("SlowQueries requires a get request"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(a.slow.Recent())
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+}
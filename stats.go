@@ -0,0 +1,214 @@
+package separation
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/oralordos/separation/internal/clock"
+)
+
+// Business Logic
+// Stats are materialized counts of the registered users.
+type Stats struct {
+	TotalUsers int `json:"total_users"`
+	// RegistrationsPerDay counts the users still registered by the UTC day they registered on, as 2006-01-02.
+	RegistrationsPerDay map[string]int `json:"registrations_per_day"`
+	UsersPerDomain      map[string]int `json:"users_per_domain"`
+	// RefreshedAt is when the counts were last recomputed from storage. Registrations since are counted as they happen.
+	RefreshedAt time.Time `json:"refreshed_at"`
+}
+
+func (s *Stats) count(email Email, at time.Time) {
+	s.TotalUsers++
+	s.RegistrationsPerDay[at.UTC().Format("2006-01-02")]++
+	s.UsersPerDomain[email.Domain()]++
+}
+
+func (s *Stats) copy() *Stats {
+	c := *s
+	c.RegistrationsPerDay = make(map[string]int, len(s.RegistrationsPerDay))
+	for k, v := range s.RegistrationsPerDay {
+		c.RegistrationsPerDay[k] = v
+	}
+	c.UsersPerDomain = make(map[string]int, len(s.UsersPerDomain))
+	for k, v := range s.UsersPerDomain {
+		c.UsersPerDomain[k] = v
+	}
+	return &c
+}
+
+// UserStats keeps Stats without scanning the users on every request. Each registration
+// is counted from its UserRegistered event, and a scheduled job recomputes the counts
+// from storage every interval, which is when deleted users stop being counted.
+type UserStats struct {
+	users UserStorer
+	clock clock.Clock
+
+	mu    sync.RWMutex
+	stats *Stats
+	// registered records registrations made while refreshing, as the scan may have missed them
+	refreshing bool
+	registered []*UserRegistered
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewUserStats recomputes the counts every interval until it is closed, reporting failures to onError.
+// The counts are empty until the first Refresh.
+func NewUserStats(users UserStorer, clk clock.Clock, interval time.Duration, onError func(error)) *UserStats {
+	us := &UserStats{
+		users: users,
+		clock: clk,
+		stats: &Stats{
+			RegistrationsPerDay: map[string]int{},
+			UsersPerDomain:      map[string]int{},
+		},
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	go us.run(interval, onError)
+	return us
+}
+
+func (us *UserStats) run(interval time.Duration, onError func(error)) {
+	defer close(us.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			err := us.Refresh(context.Background())
+			if err != nil {
+				onError(fmt.Errorf("Refreshing the user stats failed: %v", err))
+			}
+		case <-us.stop:
+			return
+		}
+	}
+}
+
+// Refresh recomputes the counts from every user in storage.
+func (us *UserStats) Refresh(ctx context.Context) error {
+	us.mu.Lock()
+	us.refreshing = true
+	us.registered = nil
+	us.mu.Unlock()
+
+	users, err := us.users.List(ctx, LabelSelector{})
+
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	us.refreshing = false
+	if err != nil {
+		us.registered = nil
+		return err
+	}
+
+	stats := &Stats{
+		RegistrationsPerDay: map[string]int{},
+		UsersPerDomain:      map[string]int{},
+		RefreshedAt:         us.clock.Now().UTC(),
+	}
+	listed := make(map[Email]bool, len(users))
+	for _, u := range users {
+		stats.count(u.Email, u.CreatedAt)
+		listed[u.Email] = true
+	}
+	for _, reg := range us.registered {
+		if !listed[reg.Email] {
+			stats.count(reg.Email, reg.At)
+		}
+	}
+	us.registered = nil
+	us.stats = stats
+	return nil
+}
+
+// HandleEvent counts a UserRegistered event.
+func (us *UserStats) HandleEvent(ctx context.Context, e Event) {
+	reg, ok := e.(*UserRegistered)
+	if !ok {
+		return
+	}
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	us.stats.count(reg.Email, reg.At)
+	if us.refreshing {
+		us.registered = append(us.registered, reg)
+	}
+}
+
+// Stats returns a copy of the current counts.
+func (us *UserStats) Stats() *Stats {
+	us.mu.RLock()
+	defer us.mu.RUnlock()
+	return us.stats.copy()
+}
+
+// Close stops the scheduled refresh.
+func (us *UserStats) Close() error {
+	close(us.stop)
+	<-us.done
+	return nil
+}
+
+// Access Layer
+var promLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// writePrometheusStats writes s in the Prometheus text exposition format.
+func writePrometheusStats(w io.Writer, s *Stats) {
+	fmt.Fprintln(w, "# HELP separation_users Registered users.")
+	fmt.Fprintln(w, "# TYPE separation_users gauge")
+	fmt.Fprintf(w, "separation_users %d\n", s.TotalUsers)
+
+	writeLabelled := func(name, help, label string, values map[string]int) {
+		fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+		fmt.Fprintf(w, "# TYPE %s gauge\n", name)
+		keys := make([]string, 0, len(values))
+		for k := range values {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Fprintf(w, "%s{%s=\"%s\"} %d\n", name, label, promLabelEscaper.Replace(k), values[k])
+		}
+	}
+	writeLabelled("separation_users_by_domain", "Registered users per email domain.", "domain", s.UsersPerDomain)
+	writeLabelled("separation_registrations_by_day", "Users still registered per UTC day they registered on.", "day", s.RegistrationsPerDay)
+	fmt.Fprintln(w, "# HELP separation_stats_refreshed_seconds When the user stats were last recomputed from storage.")
+	fmt.Fprintln(w, "# TYPE separation_stats_refreshed_seconds gauge")
+	fmt.Fprintf(w, "separation_stats_refreshed_seconds %d\n", s.RefreshedAt.Unix())
+}
+
+// Stats serves GET /stats as JSON, or in the Prometheus text format with ?format=prometheus.
+func (a *AdminHTTP) Stats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, NewMethodError("Stats requires a get request"))
+		return
+	}
+
+	s := a.stats.Stats()
+	switch r.FormValue("format") {
+	case "", "json":
+		w.Header().Set("Content-Type", "application/json")
+		err := json.NewEncoder(w).Encode(s)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+	case "prometheus":
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writePrometheusStats(w, s)
+	default:
+		writeError(w, r, NewValidationError("Format must be json or prometheus"))
+	}
+}
@@ -0,0 +1,69 @@
+package separation
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// Action Layer
+// StorageDriver opens the user storage for cfg. Drivers read their connection
+// string from cfg.StorageDSN, and may read any other setting they need.
+// Storage that implements io.Closer is closed when the server stops.
+type StorageDriver func(cfg *Config) (UserStorer, error)
+
+var (
+	storageDriversMu sync.Mutex
+	storageDrivers   = map[string]StorageDriver{}
+)
+
+// RegisterStorage makes a user storage backend available by name to the STORAGE setting.
+// Third party backends call it from init, the way database/sql drivers register themselves.
+// It panics if the name is registered twice.
+func RegisterStorage(name string, driver StorageDriver) {
+	storageDriversMu.Lock()
+	defer storageDriversMu.Unlock()
+
+	if _, ok := storageDrivers[name]; ok {
+		panic("Storage driver registered twice: " + name)
+	}
+	storageDrivers[name] = driver
+}
+
+// StorageDrivers lists the names of the registered backends, sorted.
+func StorageDrivers() []string {
+	storageDriversMu.Lock()
+	defer storageDriversMu.Unlock()
+
+	names := make([]string, 0, len(storageDrivers))
+	for name := range storageDrivers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// OpenUserStorage opens the user storage with the driver registered as name.
+func OpenUserStorage(name string, cfg *Config) (UserStorer, error) {
+	storageDriversMu.Lock()
+	driver, ok := storageDrivers[name]
+	storageDriversMu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("Unknown storage driver %q, registered drivers are %v", name, StorageDrivers())
+	}
+
+	us, err := driver(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open %s storage: %v", name, err)
+	}
+	return us, nil
+}
+
+func init() {
+	RegisterStorage("memory", func(cfg *Config) (UserStorer, error) {
+		if cfg.MemoryShards > 1 {
+			return NewShardedMemoryUserStorage(cfg.MemoryShards), nil
+		}
+		return NewMemoryUserStorage(), nil
+	})
+}
@@ -0,0 +1,230 @@
+package separation
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"testing"
+	"testing/quick"
+	"time"
+
+	"github.com/oralordos/separation/internal/clock"
+)
+
+// userStorers build each storage driver, and each decorator over memory storage.
+var userStorers = map[string]func(t *testing.T) UserStorer{
+	"memory": func(t *testing.T) UserStorer {
+		return NewMemoryUserStorage()
+	},
+	"sharded": func(t *testing.T) UserStorer {
+		return NewShardedMemoryUserStorage(8)
+	},
+	"eventsourced": func(t *testing.T) UserStorer {
+		es, err := NewEventSourcedUserStorage(context.Background(), NewMemoryUserEventStore(), NewMemoryUserSnapshotStore(), 50, clock.Real)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return es
+	},
+	"cache": func(t *testing.T) UserStorer {
+		cs := NewCachingUserStorage(NewMemoryUserStorage(), time.Minute, clock.Real)
+		t.Cleanup(func() { cs.Close() })
+		return cs
+	},
+	"writebehind": func(t *testing.T) UserStorer {
+		cs := NewWriteBehindUserStorage(NewMemoryUserStorage(), time.Minute, clock.Real, time.Millisecond, 16, func(err error) {
+			t.Error(err)
+		})
+		t.Cleanup(func() { cs.Close() })
+		return cs
+	},
+	"changelog": func(t *testing.T) UserStorer {
+		log, err := OpenFileChangeLog(filepath.Join(t.TempDir(), "changes.log"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { log.Close() })
+		return NewChangeLogger(NewMemoryUserStorage(), log, clock.Real)
+	},
+	"bloom": func(t *testing.T) UserStorer {
+		us := NewMemoryUserStorage()
+		bs, err := NewBloomUserStorage(context.Background(), us, EmailsFromStorage(us), 1000, 0.01, time.Hour, func(err error) {
+			t.Error(err)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { bs.Close() })
+		return bs
+	},
+}
+
+// quickConfig runs properties from a fixed seed, so a failure can be run again.
+func quickConfig(seed int64) *quick.Config {
+	return &quick.Config{MaxCount: 200, Rand: rand.New(rand.NewSource(seed))}
+}
+
+// quickEmail turns generated numbers into a valid email, with few enough distinct
+// emails that generated operations often meet the same user.
+func quickEmail(local, domain uint8) Email {
+	email, err := ParseEmail(fmt.Sprintf("user%d@example%d.com", local%32, domain%4))
+	if err != nil {
+		panic(err)
+	}
+	return email
+}
+
+// TestStorageProperties checks the invariants every UserStorer must keep.
+func TestStorageProperties(t *testing.T) {
+	for name, newStorer := range userStorers {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+
+			t.Run("registered users can be read back", func(t *testing.T) {
+				us := newStorer(t)
+				register := NewRegisterUserHandler(us, NewMemoryInviteStorage(), NewEventBus(), clock.Real, "", false)
+				prop := func(local, domain uint8, name string) bool {
+					email := quickEmail(local, domain)
+					err := register.Handle(ctx, &RegisterParams{Email: email, Name: name})
+					if err != nil && err != ErrEmailExists {
+						t.Log(err)
+						return false
+					}
+					u, err := us.Get(ctx, email)
+					return err == nil && u.Email == email
+				}
+				err := quick.Check(prop, quickConfig(1))
+				if err != nil {
+					t.Error(err)
+				}
+			})
+
+			t.Run("registering a registered email fails and changes nothing", func(t *testing.T) {
+				us := newStorer(t)
+				register := NewRegisterUserHandler(us, NewMemoryInviteStorage(), NewEventBus(), clock.Real, "", false)
+				prop := func(local, domain uint8, first, second string) bool {
+					email := quickEmail(local, domain)
+					_, err := us.Get(ctx, email)
+					if err == ErrUserNotFound {
+						err = register.Handle(ctx, &RegisterParams{Email: email, Name: first})
+						if err != nil {
+							t.Log(err)
+							return false
+						}
+					}
+					before, err := us.Get(ctx, email)
+					if err != nil {
+						return false
+					}
+
+					err = register.Handle(ctx, &RegisterParams{Email: email, Name: second})
+					if err != ErrEmailExists {
+						t.Logf("Registering %s again returned %v", email, err)
+						return false
+					}
+					after, err := us.Get(ctx, email)
+					return err == nil && after.Name == before.Name && after.ReferralCode == before.ReferralCode
+				}
+				err := quick.Check(prop, quickConfig(2))
+				if err != nil {
+					t.Error(err)
+				}
+			})
+
+			t.Run("saves are read back by email and username", func(t *testing.T) {
+				us := newStorer(t)
+				prop := func(local, domain uint8, name string, nick uint8) bool {
+					email := quickEmail(local, domain)
+					username, err := ParseUsername(fmt.Sprintf("nick%d", nick))
+					if err != nil {
+						return false
+					}
+					err = us.Save(ctx, &User{Email: email, Name: name, Username: username})
+					if err == ErrUsernameTaken {
+						owner, err := us.GetByUsername(ctx, username)
+						return err == nil && owner.Email != email
+					} else if err != nil {
+						t.Log(err)
+						return false
+					}
+
+					u, err := us.Get(ctx, email)
+					if err != nil || u.Name != name || u.Username != username {
+						return false
+					}
+					u, err = us.GetByUsername(ctx, username)
+					return err == nil && u.Email == email
+				}
+				err := quick.Check(prop, quickConfig(3))
+				if err != nil {
+					t.Error(err)
+				}
+			})
+
+			t.Run("deleted users are gone", func(t *testing.T) {
+				us := newStorer(t)
+				prop := func(local, domain uint8) bool {
+					email := quickEmail(local, domain)
+					err := us.Save(ctx, &User{Email: email})
+					if err != nil {
+						return false
+					}
+					n, err := us.Delete(ctx, []Email{email, email})
+					if err != nil || n != 1 {
+						t.Logf("Deleting %s removed %d users: %v", email, n, err)
+						return false
+					}
+					_, err = us.Get(ctx, email)
+					if err != ErrUserNotFound {
+						return false
+					}
+					users, err := us.List(ctx, LabelSelector{})
+					if err != nil {
+						return false
+					}
+					for _, u := range users {
+						if u.Email == email {
+							return false
+						}
+					}
+					return true
+				}
+				err := quick.Check(prop, quickConfig(4))
+				if err != nil {
+					t.Error(err)
+				}
+			})
+
+			t.Run("list returns each user once", func(t *testing.T) {
+				us := newStorer(t)
+				saved := map[Email]bool{}
+				prop := func(local, domain uint8) bool {
+					email := quickEmail(local, domain)
+					err := us.Save(ctx, &User{Email: email})
+					if err != nil {
+						return false
+					}
+					saved[email] = true
+
+					users, err := us.List(ctx, LabelSelector{})
+					if err != nil || len(users) != len(saved) {
+						return false
+					}
+					listed := map[Email]bool{}
+					for _, u := range users {
+						if listed[u.Email] || !saved[u.Email] {
+							return false
+						}
+						listed[u.Email] = true
+					}
+					return true
+				}
+				err := quick.Check(prop, quickConfig(5))
+				if err != nil {
+					t.Error(err)
+				}
+			})
+		})
+	}
+}
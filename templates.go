@@ -0,0 +1,360 @@
+package separation
+
+import (
+	"context"
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/oralordos/separation/internal/clock"
+	"golang.org/x/text/language"
+)
+
+// Action Layer
+var ErrTemplateNotFound = registerError(errors.New("Template not found"), "template_not_found", http.StatusNotFound, "No message template has the name or kind")
+
+// StoredTemplate is a message template saved to override the defaults.
+type StoredTemplate struct {
+	Name      string    `json:"name"`
+	Body      string    `json:"body"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type TemplateStorer interface {
+	// Get may return an ErrTemplateNotFound error
+	Get(ctx context.Context, name string) (*StoredTemplate, error)
+	Save(ctx context.Context, t *StoredTemplate) error
+	// Delete may return an ErrTemplateNotFound error
+	Delete(ctx context.Context, name string) error
+	// List returns every stored template in no particular order
+	List(ctx context.Context) ([]*StoredTemplate, error)
+}
+
+// RepositoryTemplateStorage implements TemplateStorer on top of any template repository.
+type RepositoryTemplateStorage struct {
+	repo Repository[string, *StoredTemplate]
+}
+
+func NewRepositoryTemplateStorage(repo Repository[string, *StoredTemplate]) *RepositoryTemplateStorage {
+	return &RepositoryTemplateStorage{
+		repo: repo,
+	}
+}
+
+func NewMemoryTemplateStorage() *RepositoryTemplateStorage {
+	return NewRepositoryTemplateStorage(NewMemoryRepository(func(t *StoredTemplate) string {
+		return t.Name
+	}))
+}
+
+func (rs *RepositoryTemplateStorage) Get(ctx context.Context, name string) (*StoredTemplate, error) {
+	t, err := rs.repo.Get(ctx, name)
+	if err == ErrNotFound {
+		return nil, ErrTemplateNotFound
+	}
+	return t, err
+}
+
+func (rs *RepositoryTemplateStorage) Save(ctx context.Context, t *StoredTemplate) error {
+	return rs.repo.Save(ctx, t)
+}
+
+func (rs *RepositoryTemplateStorage) Delete(ctx context.Context, name string) error {
+	err := rs.repo.Delete(ctx, name)
+	if err == ErrNotFound {
+		return ErrTemplateNotFound
+	}
+	return err
+}
+
+func (rs *RepositoryTemplateStorage) List(ctx context.Context) ([]*StoredTemplate, error) {
+	return rs.repo.List(ctx)
+}
+
+// Business Logic
+//
+//go:embed templates
+var defaultTemplates embed.FS
+
+// templateNameRE matches kind[.locale].subject.txt, kind[.locale].txt and kind[.locale].html.
+var templateNameRE = regexp.MustCompile(`^([a-z][a-z0-9_]*)(\.[A-Za-z]{2,8}(?:-[A-Za-z0-9]{1,8})*)?\.(subject\.txt|txt|html)$`)
+
+// RenderedMessage is a message template filled in. HTML is empty when the kind has no HTML template.
+type RenderedMessage struct {
+	Subject string `json:"subject"`
+	Text    string `json:"text"`
+	HTML    string `json:"html,omitempty"`
+}
+
+// MessageTemplates render transactional messages. Each kind of message is a subject, a
+// plain text body and optionally an HTML body, in files named kind.subject.txt, kind.txt
+// and kind.html. A locale variant, such as welcome.fr.txt, is used for recipients with
+// that locale, falling back from pt-BR to pt to the file without a locale.
+//
+// Each file is looked up in the stored overrides, then in the override directory, then in
+// the defaults embedded in the binary. Templates are parsed on every render, so an
+// override takes effect on the next message.
+type MessageTemplates struct {
+	storage TemplateStorer
+	dir     fs.FS
+	samples map[string]func() interface{}
+	clock   clock.Clock
+}
+
+// NewMessageTemplates overrides the defaults from storage and from the files in dir, which may
+// be empty. samples make the data each kind is previewed with.
+func NewMessageTemplates(storage TemplateStorer, dir string, samples map[string]func() interface{}, clk clock.Clock) *MessageTemplates {
+	mt := &MessageTemplates{
+		storage: storage,
+		samples: samples,
+		clock:   clk,
+	}
+	if dir != "" {
+		mt.dir = os.DirFS(dir)
+	}
+	return mt
+}
+
+// read returns the first of the layers to hold name, and which layer that was.
+func (mt *MessageTemplates) read(ctx context.Context, name string) (string, string, error) {
+	t, err := mt.storage.Get(ctx, name)
+	if err == nil {
+		return t.Body, "storage", nil
+	} else if err != ErrTemplateNotFound {
+		return "", "", err
+	}
+	if mt.dir != nil {
+		b, err := fs.ReadFile(mt.dir, name)
+		if err == nil {
+			return string(b), "directory", nil
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return "", "", err
+		}
+	}
+	b, err := defaultTemplates.ReadFile("templates/" + name)
+	if err == nil {
+		return string(b), "default", nil
+	}
+	return "", "", ErrTemplateNotFound
+}
+
+// localeCandidates lists the locale suffixes to try for locale, most specific first, ending with none.
+func localeCandidates(locale string) []string {
+	var candidates []string
+	tag, err := language.Parse(locale)
+	for err == nil && tag != language.Und {
+		candidates = append(candidates, "."+tag.String())
+		tag = tag.Parent()
+	}
+	return append(candidates, "")
+}
+
+// find reads the most specific locale variant of the part of kind, such as "txt".
+func (mt *MessageTemplates) find(ctx context.Context, kind, locale, part string) (string, error) {
+	for _, l := range localeCandidates(locale) {
+		body, _, err := mt.read(ctx, kind+l+"."+part)
+		if err != ErrTemplateNotFound {
+			return body, err
+		}
+	}
+	return "", ErrTemplateNotFound
+}
+
+// Render fills in the templates of kind for a recipient with locale.
+func (mt *MessageTemplates) Render(ctx context.Context, kind, locale string, data interface{}) (*RenderedMessage, error) {
+	msg := &RenderedMessage{}
+	for _, part := range []struct {
+		name string
+		out  *string
+	}{
+		{"subject.txt", &msg.Subject},
+		{"txt", &msg.Text},
+		{"html", &msg.HTML},
+	} {
+		body, err := mt.find(ctx, kind, locale, part.name)
+		if err == ErrTemplateNotFound && part.name == "html" {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("Template %s.%s: %w", kind, part.name, err)
+		}
+
+		var out strings.Builder
+		err = executeTemplate(&out, kind+"."+part.name, body, data)
+		if err != nil {
+			return nil, err
+		}
+		*part.out = out.String()
+	}
+	msg.Subject = strings.TrimSpace(msg.Subject)
+	return msg, nil
+}
+
+// parseTemplate parses body as HTML when name is an HTML template, escaping what it is given,
+// and as text otherwise.
+func parseTemplate(name, body string) (interface {
+	Execute(w io.Writer, data interface{}) error
+}, error) {
+	if strings.HasSuffix(name, ".html") {
+		return htmltemplate.New(name).Option("missingkey=error").Parse(body)
+	}
+	return template.New(name).Option("missingkey=error").Parse(body)
+}
+
+func executeTemplate(w io.Writer, name, body string, data interface{}) error {
+	t, err := parseTemplate(name, body)
+	if err != nil {
+		return err
+	}
+	return t.Execute(w, data)
+}
+
+// Preview renders kind for locale with the sample data of kind.
+func (mt *MessageTemplates) Preview(ctx context.Context, kind, locale string) (*RenderedMessage, error) {
+	sample, ok := mt.samples[kind]
+	if !ok {
+		return nil, ErrTemplateNotFound
+	}
+	return mt.Render(ctx, kind, locale, sample())
+}
+
+// TemplateInfo is one template file and the layer it is read from.
+type TemplateInfo struct {
+	Name   string `json:"name"`
+	Source string `json:"source"`
+}
+
+// List returns every template file, stored, in the directory or default, sorted by name.
+func (mt *MessageTemplates) List(ctx context.Context) ([]*TemplateInfo, error) {
+	names := map[string]bool{}
+	entries, err := defaultTemplates.ReadDir("templates")
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		names[e.Name()] = true
+	}
+	if mt.dir != nil {
+		entries, err := fs.ReadDir(mt.dir, ".")
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+		for _, e := range entries {
+			if templateNameRE.MatchString(e.Name()) {
+				names[e.Name()] = true
+			}
+		}
+	}
+	stored, err := mt.storage.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range stored {
+		names[t.Name] = true
+	}
+
+	infos := make([]*TemplateInfo, 0, len(names))
+	for name := range names {
+		_, source, err := mt.read(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		infos = append(infos, &TemplateInfo{Name: name, Source: source})
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name < infos[j].Name
+	})
+	return infos, nil
+}
+
+// Override stores body as the template called name, once it parses.
+func (mt *MessageTemplates) Override(ctx context.Context, name, body string) error {
+	if !templateNameRE.MatchString(name) {
+		return NewValidationError(fmt.Sprintf("Template name %q must be kind.subject.txt, kind.txt or kind.html, with an optional locale before the extension", name))
+	}
+	_, err := parseTemplate(name, body)
+	if err != nil {
+		return NewValidationError(fmt.Sprintf("Template %s does not parse: %v", name, err))
+	}
+	return mt.storage.Save(ctx, &StoredTemplate{Name: name, Body: body, UpdatedAt: mt.clock.Now().UTC()})
+}
+
+// RemoveOverride deletes the stored template called name, so the directory or default is used again.
+func (mt *MessageTemplates) RemoveOverride(ctx context.Context, name string) error {
+	return mt.storage.Delete(ctx, name)
+}
+
+// Access Layer
+// Templates serves GET /templates, listing every template and where it is read from,
+// PUT /templates?name=... with the template as the body, storing an override, and
+// DELETE /templates?name=..., removing one.
+func (a *AdminHTTP) Templates(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		infos, err := a.templates.List(r.Context())
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(infos)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+	case http.MethodPut:
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeError(w, r, ErrMalformedRequest)
+			return
+		}
+		err = a.templates.Override(r.Context(), r.FormValue("name"), string(body))
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		err := a.templates.RemoveOverride(r.Context(), r.FormValue("name"))
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeError(w, r, NewMethodError("Templates requires a get, put or delete request"))
+	}
+}
+
+// PreviewTemplate serves GET /templates/preview?kind=...&locale=..., rendering the
+// templates of kind with sample data.
+func (a *AdminHTTP) PreviewTemplate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, NewMethodError("PreviewTemplate requires a get request"))
+		return
+	}
+
+	msg, err := a.templates.Preview(r.Context(), r.FormValue("kind"), r.FormValue("locale"))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(msg)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+}
@@ -0,0 +1,266 @@
+package separation
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/oralordos/separation/internal/clock"
+	"github.com/oralordos/separation/internal/principal"
+)
+
+// Business Logic
+// TermsError is returned when the caller has not accepted the current terms of service.
+type TermsError struct {
+	// Version is the version that must be accepted
+	Version string
+}
+
+func init() {
+	registerErrorType[*TermsError]("terms_not_accepted", http.StatusUnavailableForLegalReasons, "The current terms of service must be accepted first, the version is in the message and at GET /terms")
+}
+
+func (te *TermsError) Error() string {
+	return fmt.Sprintf("The terms of service must be accepted, the current version is %s", te.Version)
+}
+
+// Terms describes the terms of service users must accept.
+type Terms struct {
+	// Version is empty when no terms are configured
+	Version string `json:"version"`
+}
+
+type GetTermsQuery struct{}
+
+func (tq *GetTermsQuery) QueryName() string {
+	return "GetTerms"
+}
+
+type PendingTermsQuery struct{}
+
+func (pq *PendingTermsQuery) QueryName() string {
+	return "PendingTerms"
+}
+
+type AcceptTermsParams struct {
+	Email   Email  `json:"-"`
+	Version string `json:"version"`
+}
+
+func (ap *AcceptTermsParams) CommandName() string {
+	return "AcceptTerms"
+}
+
+func (ap *AcceptTermsParams) Validate() error {
+	if ap.Email.IsZero() {
+		return ErrEmailEmpty
+	}
+	if ap.Version == "" {
+		return NewValidationError("The accepted terms version cannot be empty")
+	}
+	return nil
+}
+
+type TermsHandler struct {
+	userStorage UserStorer
+	updates     *UserUpdater
+	version     string
+	clock       clock.Clock
+}
+
+// NewTermsHandler requires users to have accepted version. An empty version requires nothing.
+func NewTermsHandler(us UserStorer, updates *UserUpdater, version string, clk clock.Clock) *TermsHandler {
+	return &TermsHandler{
+		userStorage: us,
+		updates:     updates,
+		version:     version,
+		clock:       clk,
+	}
+}
+
+func (th *TermsHandler) Get(ctx context.Context, q Query) (interface{}, error) {
+	return &Terms{Version: th.version}, nil
+}
+
+// Accept records that a user accepted the current terms. Only users may accept for themselves.
+func (th *TermsHandler) Accept(ctx context.Context, cmd Command) error {
+	params, ok := cmd.(*AcceptTermsParams)
+	if !ok {
+		return fmt.Errorf("TermsHandler cannot accept %T", cmd)
+	}
+
+	p, ok := principal.FromContext(ctx)
+	if !ok {
+		return ErrUnauthenticated
+	}
+	if p.Email != params.Email.String() {
+		return ErrForbidden
+	}
+	if params.Version != th.version {
+		return &TermsError{Version: th.version}
+	}
+
+	return th.updates.Update(ctx, params.Email, func(u *User) (bool, error) {
+		if u.TermsVersion == th.version {
+			return false, nil
+		}
+
+		now := th.clock.Now().UTC()
+		u.TermsVersion = th.version
+		u.TermsAcceptedAt = &now
+		u.UpdatedAt = now
+		return true, nil
+	})
+}
+
+// Pending lists every user who has not accepted the current terms.
+func (th *TermsHandler) Pending(ctx context.Context, q Query) (interface{}, error) {
+	err := requireAdmin(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	users, err := th.userStorage.List(ctx, LabelSelector{})
+	if err != nil {
+		return nil, err
+	}
+
+	pending := []*User{}
+	if th.version == "" {
+		return pending, nil
+	}
+	for _, u := range users {
+		if u.TermsVersion != th.version {
+			pending = append(pending, u)
+		}
+	}
+	return pending, nil
+}
+
+// termsExempt are the commands and queries a user who has not accepted
+// the current terms may still use, so they can find out why and accept.
+var termsExempt = map[string]bool{
+	(&AcceptTermsParams{}).CommandName(): true,
+	(&RegisterParams{}).CommandName():    true,
+	(&GetTermsQuery{}).QueryName():       true,
+	(&GetMeQuery{}).QueryName():          true,
+}
+
+// requireAccepted returns a TermsError if the calling user has not accepted the current terms.
+// Anonymous callers and admins act for no user of their own, so they are let through.
+func (th *TermsHandler) requireAccepted(ctx context.Context, name string) error {
+	if th.version == "" || termsExempt[name] {
+		return nil
+	}
+
+	p, ok := principal.FromContext(ctx)
+	if !ok || p.Admin || p.Email == "" {
+		return nil
+	}
+	email, err := ParseEmail(p.Email)
+	if err != nil {
+		return nil
+	}
+
+	u, err := th.userStorage.Get(ctx, email)
+	if err == ErrUserNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if u.TermsVersion != th.version {
+		return &TermsError{Version: th.version}
+	}
+	return nil
+}
+
+// Commands is a CommandMiddleware rejecting commands from users who have not accepted the current terms.
+func (th *TermsHandler) Commands(next CommandHandler) CommandHandler {
+	return CommandHandlerFunc(func(ctx context.Context, cmd Command) error {
+		err := th.requireAccepted(ctx, cmd.CommandName())
+		if err != nil {
+			return err
+		}
+		return next.Handle(ctx, cmd)
+	})
+}
+
+// Queries is a QueryMiddleware rejecting queries from users who have not accepted the current terms.
+func (th *TermsHandler) Queries(next QueryHandler) QueryHandler {
+	return QueryHandlerFunc(func(ctx context.Context, q Query) (interface{}, error) {
+		err := th.requireAccepted(ctx, q.QueryName())
+		if err != nil {
+			return nil, err
+		}
+		return next.Handle(ctx, q)
+	})
+}
+
+// Access Layer
+// Terms serves GET /terms with the version of the terms of service users must accept.
+func (j *JsonOverHTTP) Terms(w http.ResponseWriter, r *http.Request) {
+	terms, err := j.usrServ.Terms(r.Context())
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(terms)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+}
+
+// AcceptMyTerms serves POST /me/terms with a body of {"version": "..."}.
+func (j *JsonOverHTTP) AcceptMyTerms(w http.ResponseWriter, r *http.Request) {
+	p, ok := principal.FromContext(r.Context())
+	if !ok || p.Email == "" {
+		writeError(w, r, ErrUnauthenticated)
+		return
+	}
+
+	params := &AcceptTermsParams{}
+	err := json.NewDecoder(r.Body).Decode(params)
+	if err != nil {
+		writeError(w, r, decodeError(err))
+		return
+	}
+
+	params.Email, err = ParseEmail(p.Email)
+	if err != nil {
+		writeError(w, r, ErrUnauthenticated)
+		return
+	}
+
+	err = j.usrServ.AcceptTerms(r.Context(), params)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// PendingTerms serves GET /users/terms-pending, listing users who have not accepted the current terms.
+func (a *AdminHTTP) PendingTerms(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, r, NewMethodError("PendingTerms requires a get request"))
+		return
+	}
+
+	users, err := a.users.PendingTerms(r.Context())
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(users)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+}
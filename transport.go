@@ -0,0 +1,286 @@
+package separation
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/oralordos/separation/internal/redis"
+)
+
+// Access Layer
+// Transport is a single access layer.
+// Start blocks until the transport stops, and returns nil once Shutdown has completed.
+type Transport interface {
+	Start(ctx context.Context) error
+	Shutdown(ctx context.Context) error
+}
+
+// TransportDeps are the pieces shared by every access layer.
+type TransportDeps struct {
+	Config *Config
+	// Listener is used by the JSON access layer instead of listening on the configured address.
+	Listener    net.Listener
+	Users       UserService
+	Orgs        OrgService
+	Maintenance MaintenanceService
+	// IPFilter decides which client addresses may reach each access layer.
+	IPFilter IPFilterService
+	// Authenticators identify callers of the user facing access layers.
+	Authenticators []Authenticator
+	// SlowCalls is nil when slow storage calls are not being recorded.
+	SlowCalls SlowCallLister
+	// Changes is nil when mutations are not being recorded.
+	Changes ChangeLog
+	// Stats are the user counts served on the admin access layer.
+	Stats *UserStats
+	// Templates are the notification templates managed on the admin access layer.
+	Templates *MessageTemplates
+	// Sessions is nil when users cannot sign in with magic links.
+	Sessions *Sessions
+	// WebAuthn is nil when users cannot register passkeys.
+	WebAuthn *WebAuthn
+	// Hooks are installed on the user facing JSON access layer.
+	Hooks Hooks
+	// Limiters bound the requests of each route class running at once, shared by every
+	// JSON access layer. Classes without one are unlimited.
+	Limiters map[RouteClass]*ConcurrencyLimiter
+	// Redis is nil when REDIS_ADDR is not set. Instances sharing it share state such as rate limits.
+	Redis *redis.Client
+	// Shedder is nil when requests are not shed as storage degrades.
+	Shedder *AdaptiveShedder
+	// Responses is nil when admin user listings are not cached.
+	Responses *ResponseCache
+}
+
+type TransportFactory func(deps *TransportDeps) (Transport, error)
+
+var (
+	transportsMu sync.Mutex
+	transports   = map[string]TransportFactory{}
+)
+
+// RegisterTransport makes a transport available by name to the TRANSPORTS setting.
+// It panics if the name is registered twice.
+func RegisterTransport(name string, factory TransportFactory) {
+	transportsMu.Lock()
+	defer transportsMu.Unlock()
+
+	if _, ok := transports[name]; ok {
+		panic("Transport registered twice: " + name)
+	}
+	transports[name] = factory
+}
+
+func BuildTransports(names []string, deps *TransportDeps) ([]Transport, error) {
+	transportsMu.Lock()
+	defer transportsMu.Unlock()
+
+	built := make([]Transport, 0, len(names))
+	for _, name := range names {
+		factory, ok := transports[name]
+		if !ok {
+			return nil, fmt.Errorf("Unknown transport %q", name)
+		}
+
+		t, err := factory(deps)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to build transport %q: %v", name, err)
+		}
+		built = append(built, t)
+	}
+	return built, nil
+}
+
+// RunTransports starts every transport and waits until ctx is done or one of them fails,
+// then shuts all of them down using shutdownCtx.
+func RunTransports(ctx context.Context, shutdownCtx func() (context.Context, context.CancelFunc), ts []Transport) error {
+	errs := make(chan error, len(ts))
+	for _, t := range ts {
+		go func(t Transport) {
+			errs <- t.Start(ctx)
+		}(t)
+	}
+
+	var runErr error
+	select {
+	case <-ctx.Done():
+	case runErr = <-errs:
+	}
+
+	sctx, cancel := shutdownCtx()
+	defer cancel()
+
+	for _, t := range ts {
+		err := t.Shutdown(sctx)
+		if err != nil && runErr == nil {
+			runErr = err
+		}
+	}
+	return runErr
+}
+
+// HTTPTransport serves a handler over HTTP on any address Listen accepts,
+// and over HTTPS when it has a TLS config.
+type HTTPTransport struct {
+	server  *http.Server
+	ln      net.Listener
+	closers []io.Closer
+}
+
+func NewHTTPTransport(addr string, handler http.Handler, closers ...io.Closer) *HTTPTransport {
+	return &HTTPTransport{
+		server: &http.Server{
+			Addr:    addr,
+			Handler: handler,
+		},
+		closers: closers,
+	}
+}
+
+// NewTLSTransport serves handler over HTTPS with tlsConfig, which must include the server certificate.
+func NewTLSTransport(addr string, handler http.Handler, tlsConfig *tls.Config, closers ...io.Closer) *HTTPTransport {
+	ht := NewHTTPTransport(addr, handler, closers...)
+	ht.server.TLSConfig = tlsConfig
+	return ht
+}
+
+// NewListenerTransport serves handler on a listener that is already open.
+func NewListenerTransport(ln net.Listener, handler http.Handler, closers ...io.Closer) *HTTPTransport {
+	ht := NewHTTPTransport(ln.Addr().String(), handler, closers...)
+	ht.ln = ln
+	return ht
+}
+
+func (ht *HTTPTransport) Start(ctx context.Context) error {
+	ln := ht.ln
+	if ln == nil {
+		var err error
+		ln, err = Listen(ht.server.Addr)
+		if err != nil {
+			return err
+		}
+	}
+
+	if ht.server.TLSConfig != nil {
+		ln = tls.NewListener(ln, ht.server.TLSConfig)
+	}
+
+	err := ht.server.Serve(ln)
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+func (ht *HTTPTransport) Shutdown(ctx context.Context) error {
+	err := ht.server.Shutdown(ctx)
+	for _, c := range ht.closers {
+		cerr := c.Close()
+		if err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+func init() {
+	RegisterTransport("http", newJSONOverHTTPTransport)
+	RegisterTransport("admin", newAdminTransport)
+	RegisterTransport("mtls", newMTLSTransport)
+}
+
+// JSONOverHTTPHandler builds the JSON access layer wrapped in the configured middleware,
+// for transports that serve it over a protocol of their own, such as the http3 module.
+func JSONOverHTTPHandler(deps *TransportDeps) (http.Handler, []io.Closer, error) {
+	cfg := deps.Config
+	joh := NewJsonOverHTTP(deps.Users, deps.Orgs, cfg.AvatarMaxSize)
+	joh.Hooks = deps.Hooks
+	joh.Sessions = deps.Sessions
+	joh.WebAuthn = deps.WebAuthn
+	joh.Maintenance = deps.Maintenance
+	joh.LimitConcurrency(deps.Limiters)
+	if deps.Shedder != nil {
+		joh.ShedUnderPressure(deps.Shedder)
+	}
+
+	handler, closers, err := BuildMiddleware(cfg.Middleware, deps, joh)
+	if err != nil {
+		for _, c := range closers {
+			c.Close()
+		}
+		return nil, nil, err
+	}
+	return handler, closers, nil
+}
+
+func newJSONOverHTTPTransport(deps *TransportDeps) (Transport, error) {
+	cfg := deps.Config
+	handler, closers, err := JSONOverHTTPHandler(deps)
+	if err != nil {
+		return nil, err
+	}
+
+	if deps.Listener != nil {
+		return NewListenerTransport(deps.Listener, handler, closers...), nil
+	}
+	addr := cfg.Listen
+	if addr == "" {
+		addr = ":" + cfg.Port
+	}
+	return NewHTTPTransport(addr, handler, closers...), nil
+}
+
+func newAdminTransport(deps *TransportDeps) (Transport, error) {
+	cfg := deps.Config
+	if cfg.AdminPort == "" {
+		return nil, fmt.Errorf("ADMIN_PORT must be set")
+	}
+
+	admin := NewAdminHTTP(cfg.AdminToken, cfg.DebugEndpoints, deps.Users, deps.Maintenance, deps.IPFilter, deps.SlowCalls, deps.Changes, deps.Stats, deps.Templates, deps.Responses, cfg.AvatarMaxSize)
+	var handler http.Handler = admin
+	if deps.IPFilter != nil {
+		handler = NewIPFilterMiddleware(handler, deps.IPFilter, "admin", cfg.TrustedProxies)
+	}
+	return NewHTTPTransport(":"+cfg.AdminPort, WithErrorWriter(handler, cfg.ErrorFormat)), nil
+}
+
+// newMTLSTransport serves the JSON access layer on a listener of its own,
+// which only accepts clients with a certificate from the client CA.
+func newMTLSTransport(deps *TransportDeps) (Transport, error) {
+	cfg := deps.Config
+	if cfg.MTLSListen == "" || cfg.MTLSCertFile == "" || cfg.MTLSKeyFile == "" || cfg.MTLSClientCA == "" {
+		return nil, fmt.Errorf("MTLS_LISTEN, MTLS_CERT_FILE, MTLS_KEY_FILE and MTLS_CLIENT_CA must be set")
+	}
+
+	tlsConfig, err := LoadMTLSConfig(cfg.MTLSCertFile, cfg.MTLSKeyFile, cfg.MTLSClientCA)
+	if err != nil {
+		return nil, err
+	}
+
+	handler, closers, err := JSONOverHTTPHandler(deps)
+	if err != nil {
+		return nil, err
+	}
+	return NewTLSTransport(cfg.MTLSListen, handler, tlsConfig, closers...), nil
+}
+
+func isStdStream(dest string) bool {
+	return dest == "stdout" || dest == "stderr"
+}
+
+func parseNameList(s string) []string {
+	var names []string
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
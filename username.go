@@ -0,0 +1,274 @@
+package separation
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/oralordos/separation/internal/clock"
+	"github.com/oralordos/separation/internal/principal"
+)
+
+const (
+	minUsernameLen = 3
+	maxUsernameLen = 30
+)
+
+var (
+	ErrUsernameInvalid  = registerError(NewValidationError(fmt.Sprintf("Username must be %d to %d letters, digits or underscores, starting with a letter", minUsernameLen, maxUsernameLen)), "username_invalid", http.StatusBadRequest, "The username is not 3 to 30 letters, digits or underscores starting with a letter")
+	ErrUsernameReserved = registerError(NewValidationError("Username is reserved"), "username_reserved", http.StatusBadRequest, "The username is reserved and cannot be used")
+
+	ErrUsernameTaken = registerError(errors.New("Username is already in use"), "username_taken", http.StatusConflict, "Another user already has the username")
+)
+
+// reservedUsernames could be mistaken for the service itself, or collide with routes.
+var reservedUsernames = map[string]bool{
+	"admin":         true,
+	"administrator": true,
+	"api":           true,
+	"help":          true,
+	"me":            true,
+	"root":          true,
+	"security":      true,
+	"support":       true,
+	"system":        true,
+	"user":          true,
+	"users":         true,
+}
+
+// Username is a validated, canonical public handle. Unlike the email, which is used
+// to sign in, a user may change their username.
+// The only way to build a non-zero Username is ParseUsername.
+type Username struct {
+	name string
+}
+
+// ParseUsername validates s and canonicalizes it by trimming surrounding
+// whitespace and lowercasing it, so handles differing only in case collide.
+// It may return an ErrUsernameInvalid or ErrUsernameReserved error.
+func ParseUsername(s string) (Username, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if len(s) < minUsernameLen || len(s) > maxUsernameLen {
+		return Username{}, ErrUsernameInvalid
+	}
+
+	for i, c := range s {
+		switch {
+		case c >= 'a' && c <= 'z':
+		case i > 0 && (c >= '0' && c <= '9' || c == '_'):
+		default:
+			return Username{}, ErrUsernameInvalid
+		}
+	}
+
+	if reservedUsernames[s] {
+		return Username{}, ErrUsernameReserved
+	}
+	return Username{name: s}, nil
+}
+
+func (u Username) String() string {
+	return u.name
+}
+
+func (u Username) IsZero() bool {
+	return u.name == ""
+}
+
+// MarshalJSON writes the zero Username, a user without a handle, as null.
+func (u Username) MarshalJSON() ([]byte, error) {
+	if u.IsZero() {
+		return []byte("null"), nil
+	}
+	return json.Marshal(u.name)
+}
+
+func (u *Username) UnmarshalJSON(b []byte) error {
+	var s *string
+	err := json.Unmarshal(b, &s)
+	if err != nil {
+		return err
+	}
+
+	if s == nil {
+		*u = Username{}
+		return nil
+	}
+
+	parsed, err := ParseUsername(*s)
+	if err != nil {
+		return err
+	}
+	*u = parsed
+	return nil
+}
+
+// Business Logic
+type GetUserByUsernameQuery struct {
+	Username Username
+}
+
+func (gq *GetUserByUsernameQuery) QueryName() string {
+	return "GetUserByUsername"
+}
+
+type SetUsernameParams struct {
+	Email    Email    `json:"email"`
+	Username Username `json:"username"`
+}
+
+func (sp *SetUsernameParams) CommandName() string {
+	return "SetUsername"
+}
+
+func (sp *SetUsernameParams) Validate() error {
+	if sp.Email.IsZero() {
+		return ErrEmailEmpty
+	}
+	if sp.Username.IsZero() {
+		return ErrUsernameInvalid
+	}
+	return nil
+}
+
+type UsernameHandler struct {
+	userStorage UserStorer
+	updates     *UserUpdater
+	clock       clock.Clock
+}
+
+func NewUsernameHandler(us UserStorer, updates *UserUpdater, clk clock.Clock) *UsernameHandler {
+	return &UsernameHandler{
+		userStorage: us,
+		updates:     updates,
+		clock:       clk,
+	}
+}
+
+func (uh *UsernameHandler) Get(ctx context.Context, q Query) (interface{}, error) {
+	query, ok := q.(*GetUserByUsernameQuery)
+	if !ok {
+		return nil, fmt.Errorf("UsernameHandler cannot get %T", q)
+	}
+
+	if query.Username.IsZero() {
+		return nil, ErrUserNotFound
+	}
+	return uh.userStorage.GetByUsername(ctx, query.Username)
+}
+
+// Set changes a user's username. Users may change their own, and admins anyone's.
+func (uh *UsernameHandler) Set(ctx context.Context, cmd Command) error {
+	params, ok := cmd.(*SetUsernameParams)
+	if !ok {
+		return fmt.Errorf("UsernameHandler cannot set %T", cmd)
+	}
+
+	p, ok := principal.FromContext(ctx)
+	if !ok {
+		return ErrUnauthenticated
+	}
+	if !p.Admin && p.Email != params.Email.String() {
+		return ErrForbidden
+	}
+
+	return uh.updates.Update(ctx, params.Email, func(u *User) (bool, error) {
+		if u.Username == params.Username {
+			return false, nil
+		}
+
+		// The storage enforces uniqueness too, but checking first keeps
+		// a doomed save out of the change log.
+		owner, err := uh.userStorage.GetByUsername(ctx, params.Username)
+		if err == nil && owner.Email != u.Email {
+			return false, ErrUsernameTaken
+		} else if err != nil && err != ErrUserNotFound {
+			return false, err
+		}
+
+		u.Username = params.Username
+		u.UpdatedAt = uh.clock.Now().UTC()
+		return true, nil
+	})
+}
+
+// Access Layer
+// GetUserByUsername serves GET /users/by-username/{name}.
+func (j *JsonOverHTTP) GetUserByUsername(w http.ResponseWriter, r *http.Request) {
+	// A name that cannot be a username cannot belong to anyone
+	name, err := ParseUsername(strings.TrimPrefix(r.URL.Path, "/users/by-username/"))
+	if err != nil {
+		writeError(w, r, ErrUserNotFound)
+		return
+	}
+
+	u, err := j.usrServ.GetByUsername(r.Context(), name)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	codec := responseCodec(r)
+	w.Header().Set("Content-Type", codec.ContentType())
+	err = codec.EncodePublicUser(w, u.Public())
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+}
+
+// SetMyUsername serves PUT /me/username with a body of {"username": "..."}.
+func (j *JsonOverHTTP) SetMyUsername(w http.ResponseWriter, r *http.Request) {
+	p, ok := principal.FromContext(r.Context())
+	if !ok || p.Email == "" {
+		writeError(w, r, ErrUnauthenticated)
+		return
+	}
+
+	params := &SetUsernameParams{}
+	err := json.NewDecoder(r.Body).Decode(params)
+	if err != nil {
+		writeError(w, r, decodeError(err))
+		return
+	}
+
+	params.Email, err = ParseEmail(p.Email)
+	if err != nil {
+		writeError(w, r, ErrUnauthenticated)
+		return
+	}
+
+	err = j.usrServ.SetUsername(r.Context(), params)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// SetUsername serves PUT /users/username with a body of {"email": "...", "username": "..."}.
+func (a *AdminHTTP) SetUsername(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		writeError(w, r, NewMethodError("SetUsername requires a put request"))
+		return
+	}
+
+	params := &SetUsernameParams{}
+	err := json.NewDecoder(r.Body).Decode(params)
+	if err != nil {
+		writeError(w, r, decodeError(err))
+		return
+	}
+
+	err = a.users.SetUsername(r.Context(), params)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,1260 @@
+package separation
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/oralordos/separation/internal/clock"
+	"github.com/oralordos/separation/internal/principal"
+)
+
+// Action Layer
+var ErrUserNotFound = registerError(errors.New("User not found"), "user_not_found", http.StatusNotFound, "No user has the requested email")
+
+type User struct {
+	Email Email  `json:"email"`
+	Name  string `json:"name"`
+	// Username is the user's public handle. It is the zero Username until they pick one.
+	Username Username `json:"username"`
+	Labels   Labels   `json:"labels,omitempty"`
+	// AvatarID names the user's avatar, served at /avatars/{id}. It is empty until they upload one.
+	AvatarID string `json:"avatar_id,omitempty"`
+	// TermsVersion is the version of the terms of service the user last accepted, and TermsAcceptedAt when.
+	TermsVersion    string     `json:"terms_version,omitempty"`
+	TermsAcceptedAt *time.Time `json:"terms_accepted_at,omitempty"`
+	// ReferralCode is the code others register with to be counted as referred by the user.
+	// Users who registered before codes existed are issued one when they first ask for it.
+	ReferralCode string `json:"referral_code,omitempty"`
+	// ReferredBy is the user whose referral code the user registered with.
+	ReferredBy *Email `json:"referred_by,omitempty"`
+	// LastSeenAt is when the user last made a request. It lags by up to the activity flush interval.
+	LastSeenAt *time.Time `json:"last_seen_at,omitempty"`
+	// Phone is the user's phone number, and PhoneVerifiedAt when they proved they hold it.
+	// Text messages are only sent to verified numbers.
+	Phone           Phone      `json:"phone"`
+	PhoneVerifiedAt *time.Time `json:"phone_verified_at,omitempty"`
+
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// PublicUser is what anyone may see of a user, returned by the routes that need no caller.
+// Everything else, such as the phone number and labels, is only shown to the user and admins.
+type PublicUser struct {
+	Email    Email    `json:"email"`
+	Username Username `json:"username"`
+	AvatarID string   `json:"avatar_id,omitempty"`
+}
+
+func (u *User) Public() *PublicUser {
+	return &PublicUser{
+		Email:    u.Email,
+		Username: u.Username,
+		AvatarID: u.AvatarID,
+	}
+}
+
+type UserStorer interface {
+	// Get may return an ErrUserNotFound error
+	Get(ctx context.Context, email Email) (*User, error)
+	// GetByUsername may return an ErrUserNotFound error
+	GetByUsername(ctx context.Context, username Username) (*User, error)
+	// Save may return an ErrUsernameTaken error if another user has the same username
+	Save(ctx context.Context, user *User) error
+	// Insert saves a new user, refusing in the same step one whose email is already stored.
+	// Insert may return an ErrEmailExists or ErrUsernameTaken error
+	Insert(ctx context.Context, user *User) error
+	// List returns every user matching sel in no particular order
+	List(ctx context.Context, sel LabelSelector) ([]*User, error)
+	// Delete removes a batch of users, skipping any that do not exist,
+	// and returns how many were removed
+	Delete(ctx context.Context, emails []Email) (int, error)
+}
+
+// RepositoryUserStorage implements UserStorer on top of any user repository.
+// It keeps its own index of usernames, so every write must go through it.
+type RepositoryUserStorage struct {
+	repo Repository[Email, *User]
+
+	// mu serializes writes so the username index and the repository agree
+	mu        sync.Mutex
+	usernames map[Username]Email
+}
+
+func NewRepositoryUserStorage(repo Repository[Email, *User]) *RepositoryUserStorage {
+	return &RepositoryUserStorage{
+		repo:      repo,
+		usernames: map[Username]Email{},
+	}
+}
+
+func NewMemoryUserStorage() *RepositoryUserStorage {
+	return NewRepositoryUserStorage(NewMemoryRepository(func(u *User) Email {
+		return u.Email
+	}))
+}
+
+// NewShardedMemoryUserStorage spreads users over n shards by a hash of their email.
+func NewShardedMemoryUserStorage(n int) *RepositoryUserStorage {
+	return NewRepositoryUserStorage(NewShardedMemoryRepository(n, func(u *User) Email {
+		return u.Email
+	}, func(e Email) uint64 {
+		h := fnv.New64a()
+		h.Write([]byte(e.String()))
+		return h.Sum64()
+	}))
+}
+
+func (rs *RepositoryUserStorage) Get(ctx context.Context, email Email) (*User, error) {
+	u, err := rs.repo.Get(ctx, email)
+	if err == ErrNotFound {
+		return nil, ErrUserNotFound
+	}
+	return u, err
+}
+
+func (rs *RepositoryUserStorage) GetByUsername(ctx context.Context, username Username) (*User, error) {
+	rs.mu.Lock()
+	email, ok := rs.usernames[username]
+	rs.mu.Unlock()
+	if !ok {
+		return nil, ErrUserNotFound
+	}
+	return rs.Get(ctx, email)
+}
+
+func (rs *RepositoryUserStorage) Save(ctx context.Context, user *User) error {
+	return rs.save(ctx, user, false)
+}
+
+func (rs *RepositoryUserStorage) Insert(ctx context.Context, user *User) error {
+	return rs.save(ctx, user, true)
+}
+
+// save writes user, refusing an existing user when insert is set.
+func (rs *RepositoryUserStorage) save(ctx context.Context, user *User, insert bool) error {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	if !user.Username.IsZero() {
+		owner, ok := rs.usernames[user.Username]
+		if ok && owner != user.Email {
+			return ErrUsernameTaken
+		}
+	}
+
+	old, err := rs.repo.Get(ctx, user.Email)
+	if err != nil && err != ErrNotFound {
+		return err
+	}
+	if old != nil && insert {
+		return ErrEmailExists
+	}
+
+	err = rs.repo.Save(ctx, user)
+	if err != nil {
+		return err
+	}
+
+	if old != nil && !old.Username.IsZero() {
+		delete(rs.usernames, old.Username)
+	}
+	if !user.Username.IsZero() {
+		rs.usernames[user.Username] = user.Email
+	}
+	return nil
+}
+
+func (rs *RepositoryUserStorage) List(ctx context.Context, sel LabelSelector) ([]*User, error) {
+	users, err := rs.repo.List(ctx)
+	if err != nil || sel.IsEmpty() {
+		return users, err
+	}
+
+	matched := users[:0]
+	for _, u := range users {
+		if sel.Matches(u.Labels) {
+			matched = append(matched, u)
+		}
+	}
+	return matched, nil
+}
+
+// ListFiltered compiles f to a predicate, matching it with sel in one pass over the users.
+func (rs *RepositoryUserStorage) ListFiltered(ctx context.Context, sel LabelSelector, f Filter) ([]*User, error) {
+	users, err := rs.repo.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	match := CompileFilter(f)
+	matched := users[:0]
+	for _, u := range users {
+		if sel.Matches(u.Labels) && match(u) {
+			matched = append(matched, u)
+		}
+	}
+	return matched, nil
+}
+
+func (rs *RepositoryUserStorage) Delete(ctx context.Context, emails []Email) (int, error) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	deleted := 0
+	for _, email := range emails {
+		u, err := rs.repo.Get(ctx, email)
+		if err == ErrNotFound {
+			continue
+		} else if err != nil {
+			return deleted, err
+		}
+
+		err = rs.repo.Delete(ctx, email)
+		if err == ErrNotFound {
+			continue
+		} else if err != nil {
+			return deleted, err
+		}
+		if !u.Username.IsZero() {
+			delete(rs.usernames, u.Username)
+		}
+		deleted++
+	}
+	return deleted, nil
+}
+
+// Business Logic
+// ValidationError is returned by the business logic when input breaks a rule.
+// The access layers translate it into their own "bad request" response.
+type ValidationError struct {
+	msg string
+}
+
+func init() {
+	registerErrorType[*ValidationError]("validation_failed", http.StatusBadRequest, "The request broke a validation rule, the message says which")
+}
+
+func NewValidationError(msg string) *ValidationError {
+	return &ValidationError{msg: msg}
+}
+
+func (ve *ValidationError) Error() string {
+	return ve.msg
+}
+
+func isValidationError(err error) bool {
+	var ve *ValidationError
+	return errors.As(err, &ve)
+}
+
+type RegisterParams struct {
+	Email Email  `json:"email"`
+	Name  string `json:"name"`
+	// Username is optional, and can be chosen later
+	Username Username `json:"username"`
+	// InviteToken redeems an invite. It is required in invite-only mode, unless an admin is registering the user.
+	InviteToken string `json:"invite_token,omitempty"`
+	// ReferralCode attributes the new user to the user it belongs to.
+	ReferralCode string `json:"referral_code,omitempty"`
+	// AcceptTerms is the version of the terms of service the user accepts.
+	// It is required when terms are configured.
+	AcceptTerms string `json:"accept_terms"`
+	// CaptchaToken is a solved captcha, required when the registration looks risky.
+	CaptchaToken string `json:"captcha_token,omitempty"`
+	// Phone is optional, and is verified separately once the user is registered.
+	Phone Phone `json:"phone"`
+	// Labels are given to the new user. Only pre-register hooks may set them.
+	Labels Labels `json:"-"`
+
+	// DryRun runs every check but does not save the user.
+	DryRun bool `json:"-"`
+	// Preview is set by a dry run to the user registering would have created,
+	// without the referral code that is only issued on saving.
+	Preview *User `json:"-"`
+}
+
+func (rp *RegisterParams) Validate() error {
+	if rp.Email.IsZero() {
+		return ErrEmailEmpty
+	}
+
+	if rp.Name == "" {
+		return NewValidationError("Name cannot be empty")
+	}
+
+	return rp.Labels.Validate()
+}
+
+func (rp *RegisterParams) CommandName() string {
+	return "RegisterUser"
+}
+
+// User is the user that registering with these params at now creates.
+func (rp *RegisterParams) User(now time.Time) *User {
+	u := &User{
+		Email:     rp.Email,
+		Name:      rp.Name,
+		Username:  rp.Username,
+		Phone:     rp.Phone,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	if len(rp.Labels) > 0 {
+		u.Labels = Labels{}
+		for k, v := range rp.Labels {
+			u.Labels[k] = v
+		}
+	}
+	if rp.AcceptTerms != "" {
+		u.TermsVersion = rp.AcceptTerms
+		u.TermsAcceptedAt = &now
+	}
+	return u
+}
+
+type GetUserQuery struct {
+	Email Email
+}
+
+func (gq *GetUserQuery) QueryName() string {
+	return "GetUser"
+}
+
+type GetMeQuery struct{}
+
+func (mq *GetMeQuery) QueryName() string {
+	return "GetMe"
+}
+
+type UserService interface {
+	// Register validates params and may return a ValidationError, PolicyError, RegisterVetoError,
+	// ErrRegisterHookFailed, ErrRegisterHookTimeout, ErrRegistrationRisky, ErrCaptchaRequired,
+	// ErrPendingReview or an ErrEmailExists error
+	// When params.DryRun is set nothing is saved, but the same errors are returned
+	Register(context.Context, *RegisterParams) error
+	// GetByEmail may return an ErrUserNotFound error
+	GetByEmail(context.Context, Email) (*User, error)
+	// GetByUsername may return an ErrUserNotFound error
+	GetByUsername(context.Context, Username) (*User, error)
+	// SetUsername changes the public handle of a user
+	// SetUsername may return a ValidationError, ErrUnauthenticated, ErrForbidden, ErrUserNotFound or ErrUsernameTaken error
+	SetUsername(context.Context, *SetUsernameParams) error
+	// SetAvatar may return a ValidationError, ErrUnauthenticated, ErrForbidden or ErrUserNotFound error
+	SetAvatar(context.Context, *SetAvatarParams) error
+	// Avatar may return a ValidationError or ErrBlobNotFound error
+	Avatar(context.Context, *GetAvatarQuery) (*Avatar, error)
+	// Preferences returns a user's preferences, with defaults for anything they have not chosen
+	// Preferences may return an ErrUnauthenticated, ErrForbidden or ErrUserNotFound error
+	Preferences(context.Context, *GetPreferencesQuery) (*Preferences, error)
+	// SetPreferences replaces a user's chosen preferences
+	// SetPreferences may return a ValidationError, ErrUnauthenticated, ErrForbidden or ErrUserNotFound error
+	SetPreferences(context.Context, *SetPreferencesParams) error
+	// Terms returns the terms of service users must accept
+	Terms(context.Context) (*Terms, error)
+	// AcceptTerms records that a user accepted the current terms of service
+	// AcceptTerms may return a ValidationError, TermsError, ErrUnauthenticated, ErrForbidden or ErrUserNotFound error
+	AcceptTerms(context.Context, *AcceptTermsParams) error
+	// PendingTerms lists the users who have not accepted the current terms of service
+	// PendingTerms may return an ErrForbidden error
+	PendingTerms(context.Context) ([]*User, error)
+	// CreateInvite issues an invite and sends it
+	// CreateInvite may return a ValidationError, ErrForbidden or ErrEmailExists error
+	CreateInvite(context.Context, *CreateInviteParams) (*CreatedInvite, error)
+	// ResendInvite replaces an invite's token and sends it again
+	// ResendInvite may return an ErrForbidden, ErrInviteNotFound or ErrInviteNotPending error
+	ResendInvite(context.Context, *ResendInviteParams) (*CreatedInvite, error)
+	// RevokeInvite may return an ErrForbidden, ErrInviteNotFound or ErrInviteNotPending error
+	RevokeInvite(context.Context, *RevokeInviteParams) error
+	// ListInvites may return an ErrForbidden error
+	ListInvites(context.Context) ([]*InviteStatus, error)
+	// ListReviews returns the registrations held for review, oldest first
+	// ListReviews may return an ErrForbidden error
+	ListReviews(context.Context) ([]*PendingRegistration, error)
+	// ApproveRegistration registers a user held for review, publishing the events of a registration
+	// ApproveRegistration may return an ErrForbidden or ErrReviewNotFound error, or an error of Register
+	ApproveRegistration(context.Context, *ResolveReviewParams) error
+	// RejectRegistration may return an ErrForbidden or ErrReviewNotFound error
+	RejectRegistration(context.Context, *ResolveReviewParams) error
+	// RegistrationPolicy returns the rules deciding which emails may register
+	// RegistrationPolicy may return an ErrForbidden error
+	RegistrationPolicy(context.Context) (*RegistrationPolicy, error)
+	// SetRegistrationPolicy replaces the registration policy
+	// SetRegistrationPolicy may return a ValidationError or an ErrForbidden error
+	SetRegistrationPolicy(context.Context, *SetRegistrationPolicyParams) error
+	// Referrals returns a user's referral code and the users who registered with it
+	// Referrals may return an ErrUnauthenticated, ErrForbidden or ErrUserNotFound error
+	Referrals(context.Context, Email) (*Referrals, error)
+	// SendPhoneCode texts a verification code to the user's phone number, or the new number in params
+	// SendPhoneCode may return a ValidationError, ErrUnauthenticated, ErrForbidden, ErrUserNotFound or ErrPhoneCodeLimited error
+	SendPhoneCode(context.Context, *SendPhoneCodeParams) error
+	// VerifyPhone marks the number the last code was sent to as the user's verified phone
+	// VerifyPhone may return a ValidationError, ErrUnauthenticated, ErrForbidden, ErrUserNotFound or ErrPhoneCodeInvalid error
+	VerifyPhone(context.Context, *VerifyPhoneParams) error
+	// RequestMagicLink sends a sign-in link to a registered user, and does nothing for other emails
+	// RequestMagicLink may return a ValidationError, ErrLoginDisabled or ErrMagicLinkLimited error
+	RequestMagicLink(context.Context, *RequestMagicLinkParams) error
+	// RedeemMagicLink uses up a sign-in link, returning the user it signs in
+	// RedeemMagicLink may return an ErrMagicLinkInvalid error
+	RedeemMagicLink(context.Context, *RedeemMagicLinkParams) (*User, error)
+	// StartSession signs a browser in as a registered user, setting the token of the new session on params
+	// StartSession may return a ValidationError or ErrUserNotFound error
+	StartSession(context.Context, *StartSessionParams) error
+	// AuthenticateSession sets the session of a token on params, extending it when it was last used a while ago
+	// AuthenticateSession may return an ErrSessionNotFound error
+	AuthenticateSession(context.Context, *AuthenticateSessionParams) error
+	// ListSessions may return an ErrUnauthenticated or ErrForbidden error
+	ListSessions(context.Context, *ListSessionsQuery) ([]*Session, error)
+	// RevokeSession signs a user out of one browser
+	// RevokeSession may return a ValidationError, ErrUnauthenticated, ErrForbidden or ErrSessionNotFound error
+	RevokeSession(context.Context, *RevokeSessionParams) error
+	// ListLogins returns the login history of a user, newest first
+	// ListLogins may return an ErrUnauthenticated or ErrForbidden error
+	ListLogins(context.Context, *ListLoginsQuery) ([]*Login, error)
+	// RecordActivity may return an ErrForbidden error
+	RecordActivity(context.Context, *RecordActivityParams) error
+	// InactiveUsers lists the users not seen for a while, longest inactive first
+	// InactiveUsers may return a ValidationError or an ErrForbidden error
+	InactiveUsers(context.Context, *InactiveUsersQuery) ([]*User, error)
+	// Me returns the user making the request
+	// Me may return an ErrUnauthenticated or ErrUserNotFound error
+	Me(context.Context) (*User, error)
+	// PreviewBulkDelete counts the users a bulk delete would remove and issues the token needed to do it
+	// PreviewBulkDelete may return a ValidationError or an ErrForbidden error
+	PreviewBulkDelete(context.Context, *UserFilter) (*BulkDeletePreview, error)
+	// BulkDelete may return a ValidationError, ErrForbidden, ErrInvalidConfirmation or ErrFilterChanged error
+	BulkDelete(context.Context, *BulkDeleteParams) error
+	// List may return a ValidationError or an ErrForbidden error
+	List(context.Context, *ListUsersQuery) ([]*User, error)
+	// SetLabels merges labels into a user's labels
+	// SetLabels may return a ValidationError, ErrForbidden or ErrUserNotFound error
+	SetLabels(context.Context, *SetLabelsParams) error
+	// RemoveLabels may return a ValidationError, ErrForbidden or ErrUserNotFound error
+	RemoveLabels(context.Context, *RemoveLabelsParams) error
+	// Export returns every user changed since since, or every user when since is zero
+	// Export may return an ErrForbidden error
+	Export(context.Context, *ExportUsersQuery) ([]*User, error)
+	// Import saves users exactly as given, overwriting existing ones
+	// Import may return a ValidationError or an ErrForbidden error
+	Import(context.Context, []*User) error
+}
+
+var ErrEmailExists = registerError(errors.New("Email is already in use"), "email_exists", http.StatusForbidden, "A user with the email is already registered")
+
+type RegisterUserHandler struct {
+	userStorage   UserStorer
+	inviteStorage InviteStorer
+	events        *EventBus
+	clock         clock.Clock
+	termsVersion  string
+	inviteOnly    bool
+}
+
+// NewRegisterUserHandler requires new users to accept termsVersion, unless it is empty,
+// and to hold an invite when inviteOnly is set.
+func NewRegisterUserHandler(us UserStorer, is InviteStorer, events *EventBus, clk clock.Clock, termsVersion string, inviteOnly bool) *RegisterUserHandler {
+	return &RegisterUserHandler{
+		userStorage:   us,
+		inviteStorage: is,
+		events:        events,
+		clock:         clk,
+		termsVersion:  termsVersion,
+		inviteOnly:    inviteOnly,
+	}
+}
+
+func (rh *RegisterUserHandler) Handle(ctx context.Context, cmd Command) error {
+	params, ok := cmd.(*RegisterParams)
+	if !ok {
+		return fmt.Errorf("RegisterUserHandler cannot handle %T", cmd)
+	}
+
+	if rh.termsVersion != "" && params.AcceptTerms != rh.termsVersion {
+		return &TermsError{Version: rh.termsVersion}
+	}
+
+	_, err := rh.userStorage.Get(ctx, params.Email)
+	if err == nil {
+		return ErrEmailExists
+	} else if err != ErrUserNotFound {
+		return err
+	}
+
+	if !params.Username.IsZero() {
+		_, err = rh.userStorage.GetByUsername(ctx, params.Username)
+		if err == nil {
+			return ErrUsernameTaken
+		} else if err != ErrUserNotFound {
+			return err
+		}
+	}
+
+	now := rh.clock.Now().UTC()
+	var invite *Invite
+	if params.InviteToken != "" {
+		invite, err = redeemableInvite(ctx, rh.inviteStorage, params.InviteToken, params.Email, now)
+		if err != nil {
+			return err
+		}
+	} else if rh.inviteOnly {
+		// Admins register users directly, as seeding does
+		if requireAdmin(ctx) != nil {
+			return ErrInviteRequired
+		}
+	}
+
+	var referrer *User
+	if params.ReferralCode != "" {
+		referrer, err = userByReferralCode(ctx, rh.userStorage, params.ReferralCode)
+		if err != nil {
+			return err
+		}
+	}
+
+	u := params.User(now)
+	if referrer != nil {
+		u.ReferredBy = &referrer.Email
+	}
+	if rh.termsVersion == "" {
+		// Without configured terms there is nothing to have accepted
+		u.TermsVersion = ""
+		u.TermsAcceptedAt = nil
+	}
+	if invite != nil && invite.Role != "" {
+		if u.Labels == nil {
+			u.Labels = Labels{}
+		}
+		u.Labels["role"] = invite.Role
+	}
+	if params.DryRun {
+		params.Preview = u
+		return nil
+	}
+
+	u.ReferralCode, err = uniqueReferralCode(ctx, rh.userStorage)
+	if err != nil {
+		return err
+	}
+	// The check above answers most duplicates early, and Insert refuses those registered since
+	err = rh.userStorage.Insert(ctx, u)
+	if err != nil {
+		return err
+	}
+
+	if invite != nil {
+		used := *invite
+		used.UsedAt = &now
+		err = rh.inviteStorage.Save(ctx, &used)
+		if err != nil {
+			return err
+		}
+	}
+
+	rh.events.Publish(ctx, &UserRegistered{Email: u.Email, IP: clientIPFromContext(ctx), At: now})
+	if referrer != nil {
+		rh.events.Publish(ctx, &UserReferred{Referrer: referrer.Email, Referred: u.Email, At: now})
+	}
+	return nil
+}
+
+type GetUserQueryHandler struct {
+	userStorage UserStorer
+}
+
+func NewGetUserQueryHandler(us UserStorer) *GetUserQueryHandler {
+	return &GetUserQueryHandler{
+		userStorage: us,
+	}
+}
+
+func (gh *GetUserQueryHandler) Handle(ctx context.Context, q Query) (interface{}, error) {
+	query, ok := q.(*GetUserQuery)
+	if !ok {
+		return nil, fmt.Errorf("GetUserQueryHandler cannot handle %T", q)
+	}
+
+	return gh.userStorage.Get(ctx, query.Email)
+}
+
+type GetMeQueryHandler struct {
+	userStorage UserStorer
+}
+
+func NewGetMeQueryHandler(us UserStorer) *GetMeQueryHandler {
+	return &GetMeQueryHandler{
+		userStorage: us,
+	}
+}
+
+func (mh *GetMeQueryHandler) Handle(ctx context.Context, q Query) (interface{}, error) {
+	p, ok := principal.FromContext(ctx)
+	if !ok || p.Email == "" {
+		return nil, ErrUnauthenticated
+	}
+
+	email, err := ParseEmail(p.Email)
+	if err != nil {
+		return nil, ErrUnauthenticated
+	}
+
+	return mh.userStorage.Get(ctx, email)
+}
+
+// UserUpdater applies read-modify-write updates to stored users one at a time for each
+// user, so concurrent updates of the same user apply one after the other instead of the
+// last overwriting the rest. Every handler that changes a stored user updates it through
+// the one UserUpdater the dispatcher shares. Updates are only serialized within this process.
+type UserUpdater struct {
+	userStorage UserStorer
+	locks       userLocks
+}
+
+func NewUserUpdater(us UserStorer) *UserUpdater {
+	return &UserUpdater{
+		userStorage: us,
+	}
+}
+
+// Update reads the user with email and saves it once change has edited it, holding the
+// user's lock throughout. change is given a copy of the stored user, whose maps and pointers
+// are still shared with it, so it must replace them rather than edit them in place.
+// Nothing is saved when change reports no change or returns an error.
+// Update may return an ErrUserNotFound error, or the error change returned
+func (uu *UserUpdater) Update(ctx context.Context, email Email, change func(u *User) (bool, error)) error {
+	unlock := uu.locks.lock(email)
+	defer unlock()
+
+	u, err := uu.userStorage.Get(ctx, email)
+	if err != nil {
+		return err
+	}
+
+	updated := *u
+	changed, err := change(&updated)
+	if err != nil || !changed {
+		return err
+	}
+	return uu.userStorage.Save(ctx, &updated)
+}
+
+// userLocks hands out a lock for each user, dropping it once nobody holds or waits for it.
+type userLocks struct {
+	mu    sync.Mutex
+	locks map[Email]*userLock
+}
+
+type userLock struct {
+	sync.Mutex
+	// waiters counts the holder and those waiting, so the lock is dropped once unused
+	waiters int
+}
+
+// lock blocks until no other update of email holds it, and returns the unlock function.
+func (ul *userLocks) lock(email Email) func() {
+	ul.mu.Lock()
+	if ul.locks == nil {
+		ul.locks = map[Email]*userLock{}
+	}
+	l, ok := ul.locks[email]
+	if !ok {
+		l = &userLock{}
+		ul.locks[email] = l
+	}
+	l.waiters++
+	ul.mu.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		ul.mu.Lock()
+		defer ul.mu.Unlock()
+		l.waiters--
+		if l.waiters == 0 {
+			delete(ul.locks, email)
+		}
+	}
+}
+
+// NewUserDispatcher registers the user handlers, with validation applied to every command.
+// Callers may add further middleware before dispatching.
+func NewUserDispatcher(us UserStorer, prefs PreferencesStorer, invites InviteStorer, sender InviteSender, policies PolicyStorer, reviews ReviewStorer, phoneCodes PhoneCodeStorer, sms SMSProvider, links MagicLinkStorer, linkSender MagicLinkSender, sessions SessionStorer, logins LoginStorer, geo GeoResolver, events *EventBus, blobs BlobStore, orgs OrgStorer, clk clock.Clock, cfg *Config) *Dispatcher {
+	d := NewDispatcher()
+	d.UseCommand(ValidateCommands)
+
+	// API tokens may read the users of their organization, and nothing else of theirs
+	scopes := NewScopeChecker(map[string]string{
+		(&GetUserQuery{}).QueryName():           ScopeReadUsers,
+		(&GetUserByUsernameQuery{}).QueryName(): ScopeReadUsers,
+		(&GetAvatarQuery{}).QueryName():         ScopeReadUsers,
+	})
+	d.UseCommand(scopes.Commands)
+	d.UseQuery(scopes.Queries)
+	d.UseQuery(NewOrgTenancy(orgs).Queries(us))
+
+	d.HandleCommand((&RegisterParams{}).CommandName(), NewRegisterUserHandler(us, invites, events, clk, cfg.TermsVersion, cfg.InviteOnly))
+	d.HandleQuery((&GetUserQuery{}).QueryName(), NewGetUserQueryHandler(us))
+	d.HandleQuery((&GetMeQuery{}).QueryName(), NewGetMeQueryHandler(us))
+
+	// Every handler changing a user shares one updater, so their changes never overwrite each other
+	updates := NewUserUpdater(us)
+
+	bulk := NewBulkDeleteHandler(us, clk, []byte(cfg.BulkDeleteKey))
+	d.HandleQuery((&PreviewBulkDeleteQuery{}).QueryName(), QueryHandlerFunc(bulk.Preview))
+	d.HandleCommand((&BulkDeleteParams{}).CommandName(), CommandHandlerFunc(bulk.Delete))
+
+	usernames := NewUsernameHandler(us, updates, clk)
+	d.HandleQuery((&GetUserByUsernameQuery{}).QueryName(), QueryHandlerFunc(usernames.Get))
+	d.HandleCommand((&SetUsernameParams{}).CommandName(), CommandHandlerFunc(usernames.Set))
+
+	avatars := NewAvatarHandler(us, updates, blobs, clk, cfg.AvatarMaxSize)
+	d.HandleQuery((&GetAvatarQuery{}).QueryName(), QueryHandlerFunc(avatars.Get))
+	d.HandleCommand((&SetAvatarParams{}).CommandName(), CommandHandlerFunc(avatars.Set))
+
+	terms := NewTermsHandler(us, updates, cfg.TermsVersion, clk)
+	d.UseCommand(terms.Commands)
+	d.UseQuery(terms.Queries)
+	d.HandleQuery((&GetTermsQuery{}).QueryName(), QueryHandlerFunc(terms.Get))
+	d.HandleQuery((&PendingTermsQuery{}).QueryName(), QueryHandlerFunc(terms.Pending))
+	d.HandleCommand((&AcceptTermsParams{}).CommandName(), CommandHandlerFunc(terms.Accept))
+
+	policy := NewPolicyHandler(policies, clk)
+	d.UseCommand(policy.Commands)
+	d.HandleQuery((&GetRegistrationPolicyQuery{}).QueryName(), QueryHandlerFunc(policy.Get))
+	d.HandleCommand((&SetRegistrationPolicyParams{}).CommandName(), CommandHandlerFunc(policy.Set))
+
+	inv := NewInviteHandler(us, invites, sender, cfg.InviteTTL, clk)
+	d.HandleQuery((&ListInvitesQuery{}).QueryName(), QueryHandlerFunc(inv.List))
+	d.HandleCommand((&CreateInviteParams{}).CommandName(), CommandHandlerFunc(inv.Create))
+	d.HandleCommand((&ResendInviteParams{}).CommandName(), CommandHandlerFunc(inv.Resend))
+	d.HandleCommand((&RevokeInviteParams{}).CommandName(), CommandHandlerFunc(inv.Revoke))
+
+	review := NewReviewHandler(reviews, cfg.ReviewSLA, clk)
+	d.HandleQuery((&ListReviewsQuery{}).QueryName(), QueryHandlerFunc(review.List))
+	d.HandleQuery((&GetReviewQuery{}).QueryName(), QueryHandlerFunc(review.Get))
+	d.HandleCommand((&ResolveReviewParams{}).CommandName(), CommandHandlerFunc(review.Resolve))
+
+	referrals := NewReferralHandler(us, updates)
+	d.HandleQuery((&GetReferralsQuery{}).QueryName(), QueryHandlerFunc(referrals.Get))
+	d.HandleCommand((&IssueReferralCodeParams{}).CommandName(), CommandHandlerFunc(referrals.Issue))
+
+	phones := NewPhoneHandler(us, updates, phoneCodes, sms, PhoneVerificationOptions{
+		CodeTTL:     cfg.PhoneCodeTTL,
+		MaxAttempts: cfg.PhoneCodeAttempts,
+		SendLimit:   cfg.PhoneCodeLimit,
+		SendWindow:  cfg.PhoneCodeWindow,
+	}, clk)
+	d.HandleCommand((&SendPhoneCodeParams{}).CommandName(), CommandHandlerFunc(phones.SendCode))
+	d.HandleCommand((&VerifyPhoneParams{}).CommandName(), CommandHandlerFunc(phones.Verify))
+
+	magic := NewMagicLinkHandler(us, links, linkSender, MagicLinkOptions{
+		URL:     cfg.MagicLinkURL,
+		TTL:     cfg.MagicLinkTTL,
+		Binding: cfg.MagicLinkBinding,
+
+		SendLimit:   cfg.MagicLinkLimit,
+		IPSendLimit: cfg.MagicLinkIPLimit,
+		SendWindow:  cfg.MagicLinkWindow,
+	}, clk)
+	d.HandleCommand((&RequestMagicLinkParams{}).CommandName(), CommandHandlerFunc(magic.Request))
+	d.HandleCommand((&RedeemMagicLinkParams{}).CommandName(), CommandHandlerFunc(magic.Redeem))
+
+	loginRecorder := NewLoginRecorder(logins, geo, events)
+	d.HandleQuery((&ListLoginsQuery{}).QueryName(), QueryHandlerFunc(loginRecorder.List))
+
+	sessionHandler := NewSessionHandler(us, sessions, loginRecorder, cfg.SessionTTL, clk)
+	d.HandleCommand((&StartSessionParams{}).CommandName(), CommandHandlerFunc(sessionHandler.Start))
+	d.HandleCommand((&AuthenticateSessionParams{}).CommandName(), CommandHandlerFunc(sessionHandler.Authenticate))
+	d.HandleQuery((&ListSessionsQuery{}).QueryName(), QueryHandlerFunc(sessionHandler.List))
+	d.HandleCommand((&RevokeSessionParams{}).CommandName(), CommandHandlerFunc(sessionHandler.Revoke))
+
+	preferences := NewPreferencesHandler(us, prefs, DefaultPreferences(cfg.DefaultLocale), clk)
+	d.HandleQuery((&GetPreferencesQuery{}).QueryName(), QueryHandlerFunc(preferences.Get))
+	d.HandleCommand((&SetPreferencesParams{}).CommandName(), CommandHandlerFunc(preferences.Set))
+
+	labels := NewLabelHandler(us, updates, clk, cfg.DefaultLocale)
+	d.HandleQuery((&ListUsersQuery{}).QueryName(), QueryHandlerFunc(labels.List))
+	d.HandleCommand((&SetLabelsParams{}).CommandName(), CommandHandlerFunc(labels.Set))
+	d.HandleCommand((&RemoveLabelsParams{}).CommandName(), CommandHandlerFunc(labels.Remove))
+
+	activity := NewActivityHandler(us, updates, clk, cfg.InactivityThreshold)
+	d.HandleCommand((&RecordActivityParams{}).CommandName(), CommandHandlerFunc(activity.Record))
+	d.HandleQuery((&InactiveUsersQuery{}).QueryName(), QueryHandlerFunc(activity.Inactive))
+
+	backup := NewBackupHandler(us)
+	d.HandleQuery((&ExportUsersQuery{}).QueryName(), QueryHandlerFunc(backup.Export))
+	d.HandleCommand((&ImportUsersParams{}).CommandName(), CommandHandlerFunc(backup.Import))
+	return d
+}
+
+// UserServiceImpl implements UserService by dispatching to the user handlers.
+type UserServiceImpl struct {
+	dispatcher *Dispatcher
+
+	// RegisterHooks are called around every registration. Set them before serving.
+	RegisterHooks RegisterHooks
+}
+
+func NewUserServiceImpl(d *Dispatcher) *UserServiceImpl {
+	return &UserServiceImpl{
+		dispatcher: d,
+	}
+}
+
+func (us *UserServiceImpl) Register(ctx context.Context, params *RegisterParams) error {
+	// Hooks are handed valid params, and checked again after they change them
+	err := params.Validate()
+	if err != nil {
+		return err
+	}
+
+	err = us.RegisterHooks.before(ctx, params)
+	if err != nil {
+		return err
+	}
+
+	err = us.dispatcher.Dispatch(ctx, params)
+	if err != nil || params.DryRun || len(us.RegisterHooks.Post) == 0 {
+		return err
+	}
+
+	u, err := us.GetByEmail(ctx, params.Email)
+	if err != nil {
+		us.RegisterHooks.report(ctx, fmt.Errorf("Post-register hooks for %s: %w", params.Email, err))
+		return nil
+	}
+	us.RegisterHooks.after(ctx, u)
+	return nil
+}
+
+func (us *UserServiceImpl) GetByEmail(ctx context.Context, email Email) (*User, error) {
+	res, err := us.dispatcher.Ask(ctx, &GetUserQuery{Email: email})
+	if err != nil {
+		return nil, err
+	}
+	return res.(*User), nil
+}
+
+func (us *UserServiceImpl) GetByUsername(ctx context.Context, username Username) (*User, error) {
+	res, err := us.dispatcher.Ask(ctx, &GetUserByUsernameQuery{Username: username})
+	if err != nil {
+		return nil, err
+	}
+	return res.(*User), nil
+}
+
+func (us *UserServiceImpl) SetUsername(ctx context.Context, params *SetUsernameParams) error {
+	return us.dispatcher.Dispatch(ctx, params)
+}
+
+func (us *UserServiceImpl) SetAvatar(ctx context.Context, params *SetAvatarParams) error {
+	return us.dispatcher.Dispatch(ctx, params)
+}
+
+func (us *UserServiceImpl) Avatar(ctx context.Context, query *GetAvatarQuery) (*Avatar, error) {
+	res, err := us.dispatcher.Ask(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	return res.(*Avatar), nil
+}
+
+func (us *UserServiceImpl) Preferences(ctx context.Context, query *GetPreferencesQuery) (*Preferences, error) {
+	res, err := us.dispatcher.Ask(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	return res.(*Preferences), nil
+}
+
+func (us *UserServiceImpl) SetPreferences(ctx context.Context, params *SetPreferencesParams) error {
+	return us.dispatcher.Dispatch(ctx, params)
+}
+
+func (us *UserServiceImpl) Terms(ctx context.Context) (*Terms, error) {
+	res, err := us.dispatcher.Ask(ctx, &GetTermsQuery{})
+	if err != nil {
+		return nil, err
+	}
+	return res.(*Terms), nil
+}
+
+func (us *UserServiceImpl) AcceptTerms(ctx context.Context, params *AcceptTermsParams) error {
+	return us.dispatcher.Dispatch(ctx, params)
+}
+
+func (us *UserServiceImpl) PendingTerms(ctx context.Context) ([]*User, error) {
+	res, err := us.dispatcher.Ask(ctx, &PendingTermsQuery{})
+	if err != nil {
+		return nil, err
+	}
+	return res.([]*User), nil
+}
+
+// CreateInvite issues the invite's ID and token itself, so it can hand the token back.
+func (us *UserServiceImpl) CreateInvite(ctx context.Context, params *CreateInviteParams) (*CreatedInvite, error) {
+	var err error
+	params.ID, params.Token, err = newInviteToken()
+	if err != nil {
+		return nil, err
+	}
+
+	err = us.dispatcher.Dispatch(ctx, params)
+	if err != nil {
+		return nil, err
+	}
+	return us.createdInvite(ctx, params.ID, params.Token)
+}
+
+func (us *UserServiceImpl) ResendInvite(ctx context.Context, params *ResendInviteParams) (*CreatedInvite, error) {
+	var err error
+	_, params.Token, err = newInviteToken()
+	if err != nil {
+		return nil, err
+	}
+
+	err = us.dispatcher.Dispatch(ctx, params)
+	if err != nil {
+		return nil, err
+	}
+	return us.createdInvite(ctx, params.ID, params.Token)
+}
+
+func (us *UserServiceImpl) createdInvite(ctx context.Context, id, token string) (*CreatedInvite, error) {
+	invites, err := us.ListInvites(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, i := range invites {
+		if i.ID == id {
+			return &CreatedInvite{Invite: i.Invite, Token: token}, nil
+		}
+	}
+	return nil, ErrInviteNotFound
+}
+
+func (us *UserServiceImpl) RevokeInvite(ctx context.Context, params *RevokeInviteParams) error {
+	return us.dispatcher.Dispatch(ctx, params)
+}
+
+func (us *UserServiceImpl) ListInvites(ctx context.Context) ([]*InviteStatus, error) {
+	res, err := us.dispatcher.Ask(ctx, &ListInvitesQuery{})
+	if err != nil {
+		return nil, err
+	}
+	return res.([]*InviteStatus), nil
+}
+
+func (us *UserServiceImpl) ListReviews(ctx context.Context) ([]*PendingRegistration, error) {
+	res, err := us.dispatcher.Ask(ctx, &ListReviewsQuery{})
+	if err != nil {
+		return nil, err
+	}
+	return res.([]*PendingRegistration), nil
+}
+
+// ApproveRegistration registers the held user through Register, so the registration runs its
+// hooks and publishes its events as any other would. The caller is an admin, so it is not scored again.
+func (us *UserServiceImpl) ApproveRegistration(ctx context.Context, params *ResolveReviewParams) error {
+	res, err := us.dispatcher.Ask(ctx, &GetReviewQuery{ID: params.ID})
+	if err != nil {
+		return err
+	}
+	pending := res.(*PendingRegistration)
+
+	reg := *pending.Params
+	reg.Labels = pending.Labels
+	err = us.Register(approvalContext(ctx, pending), &reg)
+	if err != nil {
+		return err
+	}
+
+	params.Decision = ReviewApproved
+	return us.dispatcher.Dispatch(ctx, params)
+}
+
+func (us *UserServiceImpl) RejectRegistration(ctx context.Context, params *ResolveReviewParams) error {
+	params.Decision = ReviewRejected
+	return us.dispatcher.Dispatch(ctx, params)
+}
+
+func (us *UserServiceImpl) RegistrationPolicy(ctx context.Context) (*RegistrationPolicy, error) {
+	res, err := us.dispatcher.Ask(ctx, &GetRegistrationPolicyQuery{})
+	if err != nil {
+		return nil, err
+	}
+	return res.(*RegistrationPolicy), nil
+}
+
+func (us *UserServiceImpl) SetRegistrationPolicy(ctx context.Context, params *SetRegistrationPolicyParams) error {
+	return us.dispatcher.Dispatch(ctx, params)
+}
+
+// Referrals issues a code first to users who registered before referral codes existed.
+func (us *UserServiceImpl) Referrals(ctx context.Context, email Email) (*Referrals, error) {
+	res, err := us.dispatcher.Ask(ctx, &GetReferralsQuery{Email: email})
+	if err != nil {
+		return nil, err
+	}
+	if res.(*Referrals).Code != "" {
+		return res.(*Referrals), nil
+	}
+
+	err = us.dispatcher.Dispatch(ctx, &IssueReferralCodeParams{Email: email})
+	if err != nil {
+		return nil, err
+	}
+	res, err = us.dispatcher.Ask(ctx, &GetReferralsQuery{Email: email})
+	if err != nil {
+		return nil, err
+	}
+	return res.(*Referrals), nil
+}
+
+func (us *UserServiceImpl) SendPhoneCode(ctx context.Context, params *SendPhoneCodeParams) error {
+	return us.dispatcher.Dispatch(ctx, params)
+}
+
+func (us *UserServiceImpl) VerifyPhone(ctx context.Context, params *VerifyPhoneParams) error {
+	return us.dispatcher.Dispatch(ctx, params)
+}
+
+func (us *UserServiceImpl) RequestMagicLink(ctx context.Context, params *RequestMagicLinkParams) error {
+	return us.dispatcher.Dispatch(ctx, params)
+}
+
+func (us *UserServiceImpl) RedeemMagicLink(ctx context.Context, params *RedeemMagicLinkParams) (*User, error) {
+	err := us.dispatcher.Dispatch(ctx, params)
+	if err != nil {
+		return nil, err
+	}
+	return us.GetByEmail(ctx, params.Email)
+}
+
+func (us *UserServiceImpl) StartSession(ctx context.Context, params *StartSessionParams) error {
+	return us.dispatcher.Dispatch(ctx, params)
+}
+
+func (us *UserServiceImpl) AuthenticateSession(ctx context.Context, params *AuthenticateSessionParams) error {
+	return us.dispatcher.Dispatch(ctx, params)
+}
+
+func (us *UserServiceImpl) ListSessions(ctx context.Context, query *ListSessionsQuery) ([]*Session, error) {
+	res, err := us.dispatcher.Ask(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	return res.([]*Session), nil
+}
+
+func (us *UserServiceImpl) RevokeSession(ctx context.Context, params *RevokeSessionParams) error {
+	return us.dispatcher.Dispatch(ctx, params)
+}
+
+func (us *UserServiceImpl) ListLogins(ctx context.Context, query *ListLoginsQuery) ([]*Login, error) {
+	res, err := us.dispatcher.Ask(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	return res.([]*Login), nil
+}
+
+func (us *UserServiceImpl) RecordActivity(ctx context.Context, params *RecordActivityParams) error {
+	return us.dispatcher.Dispatch(ctx, params)
+}
+
+func (us *UserServiceImpl) InactiveUsers(ctx context.Context, query *InactiveUsersQuery) ([]*User, error) {
+	res, err := us.dispatcher.Ask(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	return res.([]*User), nil
+}
+
+func (us *UserServiceImpl) Me(ctx context.Context) (*User, error) {
+	res, err := us.dispatcher.Ask(ctx, &GetMeQuery{})
+	if err != nil {
+		return nil, err
+	}
+	return res.(*User), nil
+}
+
+func (us *UserServiceImpl) PreviewBulkDelete(ctx context.Context, filter *UserFilter) (*BulkDeletePreview, error) {
+	res, err := us.dispatcher.Ask(ctx, &PreviewBulkDeleteQuery{Filter: *filter})
+	if err != nil {
+		return nil, err
+	}
+	return res.(*BulkDeletePreview), nil
+}
+
+func (us *UserServiceImpl) BulkDelete(ctx context.Context, params *BulkDeleteParams) error {
+	return us.dispatcher.Dispatch(ctx, params)
+}
+
+func (us *UserServiceImpl) List(ctx context.Context, query *ListUsersQuery) ([]*User, error) {
+	res, err := us.dispatcher.Ask(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	return res.([]*User), nil
+}
+
+func (us *UserServiceImpl) SetLabels(ctx context.Context, params *SetLabelsParams) error {
+	return us.dispatcher.Dispatch(ctx, params)
+}
+
+func (us *UserServiceImpl) RemoveLabels(ctx context.Context, params *RemoveLabelsParams) error {
+	return us.dispatcher.Dispatch(ctx, params)
+}
+
+func (us *UserServiceImpl) Export(ctx context.Context, query *ExportUsersQuery) ([]*User, error) {
+	res, err := us.dispatcher.Ask(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	return res.([]*User), nil
+}
+
+func (us *UserServiceImpl) Import(ctx context.Context, users []*User) error {
+	return us.dispatcher.Dispatch(ctx, &ImportUsersParams{Users: users})
+}
+
+// Access Layer
+type JsonOverHTTP struct {
+	router  *http.ServeMux
+	usrServ UserService
+	orgServ OrgService
+	// maxAvatarSize bounds avatar uploads before they are read into memory
+	maxAvatarSize int64
+
+	// routes is the route table the router was built from
+	routes []*Route
+
+	// Hooks are called around every request. Set them before serving.
+	Hooks Hooks
+	// Sessions sign users in with magic links. It is nil when signing in is not configured.
+	// Set it before serving.
+	Sessions *Sessions
+	// WebAuthn registers passkeys and signs users in with them, starting a session in Sessions.
+	// It is nil when passkeys are not configured. Set it before serving.
+	WebAuthn *WebAuthn
+	// Maintenance is reported by GET /healthz, which maintenance mode does not block.
+	// It is nil when maintenance mode is not available. Set it before serving.
+	Maintenance MaintenanceService
+}
+
+func NewJsonOverHTTP(usrServ UserService, orgServ OrgService, maxAvatarSize int64) *JsonOverHTTP {
+	r := http.NewServeMux()
+	joh := &JsonOverHTTP{
+		router:        r,
+		usrServ:       usrServ,
+		orgServ:       orgServ,
+		maxAvatarSize: maxAvatarSize,
+	}
+	joh.routes = joh.Routes()
+	for _, rt := range joh.routes {
+		rt.Examples = routeExamples[rt.Name]
+		r.Handle(rt.Path, rt)
+	}
+	return joh
+}
+
+func (j *JsonOverHTTP) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	serveWithHooks(&j.Hooks, j.router, w, r)
+}
+
+func (j *JsonOverHTTP) Register(w http.ResponseWriter, r *http.Request) {
+	params := &RegisterParams{}
+	err := requestCodec(r).DecodeRegisterParams(r.Body, params)
+	if err != nil {
+		writeError(w, r, decodeError(err))
+		return
+	}
+
+	params.DryRun, err = dryRunRequested(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	err = j.usrServ.Register(r.Context(), params)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	if params.DryRun {
+		writeDryRun(w, r, params.Preview)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+}
+
+func (j *JsonOverHTTP) GetUser(w http.ResponseWriter, r *http.Request) {
+	email, err := ParseEmail(r.FormValue("email"))
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	u, err := j.usrServ.GetByEmail(r.Context(), email)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	codec := responseCodec(r)
+	w.Header().Set("Content-Type", codec.ContentType())
+	err = codec.EncodePublicUser(w, u.Public())
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+}
+
+func (j *JsonOverHTTP) Me(w http.ResponseWriter, r *http.Request) {
+	u, err := j.usrServ.Me(r.Context())
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	codec := responseCodec(r)
+	w.Header().Set("Content-Type", codec.ContentType())
+	err = codec.EncodeUser(w, u)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+}
+
+// Health is the body of GET /healthz. Status is ok, or maintenance while maintenance mode
+// is on, when Maintenance holds its message and retry time. The service is still up
+// during maintenance, so the response is a 200 either way.
+type Health struct {
+	Status      string            `json:"status"`
+	Maintenance *MaintenanceState `json:"maintenance,omitempty"`
+}
+
+func (j *JsonOverHTTP) Health(w http.ResponseWriter, r *http.Request) {
+	health := &Health{Status: "ok"}
+	if j.Maintenance != nil {
+		if state := j.Maintenance.Status(r.Context()); state.Enabled {
+			health.Status = "maintenance"
+			health.Maintenance = &state
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(health)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+}
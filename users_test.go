@@ -0,0 +1,258 @@
+package separation
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/oralordos/separation/internal/clock"
+	"github.com/oralordos/separation/internal/clock/clocktest"
+)
+
+// yieldingUserStorer hands the processor to other goroutines at seeded points before
+// storage calls, so registrations interleave between their check and their insert
+// even on a single processor.
+type yieldingUserStorer struct {
+	UserStorer
+	mu  sync.Mutex
+	rng *rand.Rand
+}
+
+func (ys *yieldingUserStorer) yield() {
+	ys.mu.Lock()
+	n := ys.rng.Intn(4)
+	ys.mu.Unlock()
+	for i := 0; i < n; i++ {
+		runtime.Gosched()
+	}
+}
+
+func (ys *yieldingUserStorer) Get(ctx context.Context, email Email) (*User, error) {
+	ys.yield()
+	return ys.UserStorer.Get(ctx, email)
+}
+
+func (ys *yieldingUserStorer) Save(ctx context.Context, user *User) error {
+	ys.yield()
+	return ys.UserStorer.Save(ctx, user)
+}
+
+func (ys *yieldingUserStorer) Insert(ctx context.Context, user *User) error {
+	ys.yield()
+	return ys.UserStorer.Insert(ctx, user)
+}
+
+type registrationOp struct {
+	register bool
+	email    Email
+	name     string
+}
+
+// registrationSchedule deals seeded operations over a few emails to each worker, so
+// registrations of the same email race each other and the reads between them.
+func registrationSchedule(seed int64, workers, opsPerWorker, emails int) [][]registrationOp {
+	rng := rand.New(rand.NewSource(seed))
+	schedule := make([][]registrationOp, workers)
+	for w := range schedule {
+		for i := 0; i < opsPerWorker; i++ {
+			email, _ := ParseEmail(fmt.Sprintf("user%d@example.com", rng.Intn(emails)))
+			schedule[w] = append(schedule[w], registrationOp{
+				register: rng.Intn(2) == 0,
+				email:    email,
+				name:     fmt.Sprintf("worker %d op %d", w, i),
+			})
+		}
+	}
+	return schedule
+}
+
+// TestConcurrentRegistrations checks that however registrations of the same email
+// interleave, exactly one succeeds, and no read or later registration loses it.
+func TestConcurrentRegistrations(t *testing.T) {
+	const (
+		workers      = 16
+		opsPerWorker = 200
+		emails       = 40
+	)
+	seeds := []int64{1, 2, 3}
+
+	for name, newBackend := range userStorers {
+		for _, seed := range seeds {
+			t.Run(fmt.Sprintf("%s/seed=%d", name, seed), func(t *testing.T) {
+				ctx := context.Background()
+				us := &yieldingUserStorer{UserStorer: newBackend(t), rng: rand.New(rand.NewSource(seed))}
+				handler := NewRegisterUserHandler(us, NewMemoryInviteStorage(), NewEventBus(), clock.Real, "", false)
+				schedule := registrationSchedule(seed, workers, opsPerWorker, emails)
+
+				var mu sync.Mutex
+				winners := map[Email]string{}
+				seen := map[Email][]string{}
+				var wg sync.WaitGroup
+				for _, ops := range schedule {
+					wg.Add(1)
+					go func(ops []registrationOp) {
+						defer wg.Done()
+						for _, op := range ops {
+							if !op.register {
+								u, err := us.Get(ctx, op.email)
+								if err == ErrUserNotFound {
+									continue
+								} else if err != nil {
+									t.Error(err)
+									return
+								}
+								mu.Lock()
+								seen[op.email] = append(seen[op.email], u.Name)
+								mu.Unlock()
+								continue
+							}
+
+							err := handler.Handle(ctx, &RegisterParams{Email: op.email, Name: op.name})
+							if err == ErrEmailExists {
+								continue
+							} else if err != nil {
+								t.Error(err)
+								return
+							}
+							mu.Lock()
+							if winners[op.email] != "" {
+								t.Errorf("%s registered twice, by %q and %q", op.email, winners[op.email], op.name)
+							}
+							winners[op.email] = op.name
+							mu.Unlock()
+						}
+					}(ops)
+				}
+				wg.Wait()
+
+				users, err := us.List(ctx, LabelSelector{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				stored := map[Email]string{}
+				for _, u := range users {
+					if _, ok := stored[u.Email]; ok {
+						t.Errorf("%s is stored twice", u.Email)
+					}
+					stored[u.Email] = u.Name
+				}
+				if len(stored) != len(winners) {
+					t.Errorf("Stored %d users, but %d registrations succeeded", len(stored), len(winners))
+				}
+				for email, name := range winners {
+					if stored[email] != name {
+						t.Errorf("%s was registered by %q but %q is stored", email, name, stored[email])
+					}
+					for _, read := range seen[email] {
+						if read != name {
+							t.Errorf("%s was registered by %q but read as %q", email, name, read)
+						}
+					}
+				}
+			})
+		}
+	}
+}
+
+// FuzzRegister sends arbitrary bodies to POST /register as JSON and as protobuf. However
+// malformed the body, the handler must answer with a client error or success, never
+// panic or fail with a server error.
+func FuzzRegister(f *testing.F) {
+	// Hostile bodies, such as deeply nested JSON and huge numbers, are in testdata/fuzz/FuzzRegister
+	seeds := []string{
+		`{"email":"a@example.com","name":"A"}`,
+		`{"email":"a@example.com","username":"alice","phone":"+15555550100"}`,
+		"\n\x0da@example.com\x12\x01A",
+		"",
+	}
+	for _, s := range seeds {
+		f.Add([]byte(s), false)
+		f.Add([]byte(s), true)
+	}
+
+	d := NewDispatcher()
+	d.UseCommand(ValidateCommands)
+	d.HandleCommand((&RegisterParams{}).CommandName(), NewRegisterUserHandler(NewMemoryUserStorage(), NewMemoryInviteStorage(), NewEventBus(), clock.Real, "", false))
+	j := NewJsonOverHTTP(NewUserServiceImpl(d), nil, 1<<20)
+
+	f.Fuzz(func(t *testing.T, body []byte, protobuf bool) {
+		r := httptest.NewRequest(http.MethodPost, "/register", bytes.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		if protobuf {
+			r.Header.Set("Content-Type", protobufContentType)
+		}
+		w := httptest.NewRecorder()
+		j.ServeHTTP(w, r)
+
+		if w.Code >= 500 {
+			t.Fatalf("Registering %q answered %d: %s", body, w.Code, w.Body)
+		}
+	})
+}
+
+// TestRegisterDryRunPreview checks a dry run answers with the user the handler would have
+// saved, stamped by the injected clock, and saves nothing.
+func TestRegisterDryRunPreview(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	us := NewMemoryUserStorage()
+	d := NewDispatcher()
+	d.UseCommand(ValidateCommands)
+	d.HandleCommand((&RegisterParams{}).CommandName(), NewRegisterUserHandler(us, NewMemoryInviteStorage(), NewEventBus(), clocktest.NewFake(now), "2024-01", false))
+	j := NewJsonOverHTTP(NewUserServiceImpl(d), nil, 1<<20)
+
+	r := httptest.NewRequest(http.MethodPost, "/register?dry_run=true", bytes.NewBufferString(`{"email":"ada@example.com","name":"Ada Lovelace","accept_terms":"2024-01"}`))
+	r.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	j.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Dry run answered %d: %s", w.Code, w.Body)
+	}
+
+	var body struct {
+		WouldCreate *User `json:"would_create"`
+	}
+	err := json.NewDecoder(w.Body).Decode(&body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := body.WouldCreate
+	if u == nil || !u.CreatedAt.Equal(now) || u.TermsAcceptedAt == nil || !u.TermsAcceptedAt.Equal(now) {
+		t.Errorf("Dry run would create %+v, want it created and accepting the terms at %s", u, now)
+	}
+
+	users, err := us.List(context.Background(), LabelSelector{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 0 {
+		t.Errorf("Dry run saved %d users", len(users))
+	}
+}
+
+// TestRegisterBodyLimit checks neither codec reads a registration body past the limit.
+func TestRegisterBodyLimit(t *testing.T) {
+	d := NewDispatcher()
+	d.UseCommand(ValidateCommands)
+	d.HandleCommand((&RegisterParams{}).CommandName(), NewRegisterUserHandler(NewMemoryUserStorage(), NewMemoryInviteStorage(), NewEventBus(), clock.Real, "", false))
+	j := NewJsonOverHTTP(NewUserServiceImpl(d), nil, 1<<20)
+
+	for _, contentType := range []string{"application/json", protobufContentType} {
+		body := bytes.Repeat([]byte(" "), maxRequestBodySize+1)
+		r := httptest.NewRequest(http.MethodPost, "/register", bytes.NewReader(body))
+		r.Header.Set("Content-Type", contentType)
+		w := httptest.NewRecorder()
+		j.ServeHTTP(w, r)
+
+		if w.Code != http.StatusRequestEntityTooLarge {
+			t.Errorf("Registering with a %d byte %s body answered %d, want %d", len(body), contentType, w.Code, http.StatusRequestEntityTooLarge)
+		}
+	}
+}
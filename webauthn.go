@@ -0,0 +1,835 @@
+package separation
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/oralordos/separation/internal/clock"
+	"github.com/oralordos/separation/internal/principal"
+)
+
+// Action Layer
+var (
+	ErrCredentialNotFound = registerError(errors.New("Passkey not found"), "passkey_not_found", http.StatusNotFound, "No passkey is registered with the ID")
+	ErrChallengeNotFound  = registerError(errors.New("WebAuthn challenge not found"), "webauthn_challenge_not_found", http.StatusBadRequest, "No passkey challenge is waiting with the ID, it may have expired or been answered")
+)
+
+// WebAuthnCredential is a passkey registered to a user.
+type WebAuthnCredential struct {
+	// ID is the credential ID the authenticator chose, base64url encoded
+	ID    string `json:"id"`
+	Email Email  `json:"email"`
+	// PublicKey is the COSE encoded key assertions are verified with
+	PublicKey []byte `json:"public_key"`
+	// SignCount is the last signature counter the authenticator reported. Authenticators
+	// that do not count always report 0.
+	SignCount  uint32     `json:"sign_count"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+}
+
+type WebAuthnCredentialStorer interface {
+	// Get may return an ErrCredentialNotFound error
+	Get(ctx context.Context, id string) (*WebAuthnCredential, error)
+	Save(ctx context.Context, cred *WebAuthnCredential) error
+	// ListByEmail returns the passkeys of a user in no particular order
+	ListByEmail(ctx context.Context, email Email) ([]*WebAuthnCredential, error)
+}
+
+// RepositoryWebAuthnCredentialStorage implements WebAuthnCredentialStorer on top of any credential repository.
+type RepositoryWebAuthnCredentialStorage struct {
+	repo Repository[string, *WebAuthnCredential]
+}
+
+func NewRepositoryWebAuthnCredentialStorage(repo Repository[string, *WebAuthnCredential]) *RepositoryWebAuthnCredentialStorage {
+	return &RepositoryWebAuthnCredentialStorage{
+		repo: repo,
+	}
+}
+
+func NewMemoryWebAuthnCredentialStorage() *RepositoryWebAuthnCredentialStorage {
+	return NewRepositoryWebAuthnCredentialStorage(NewMemoryRepository(func(c *WebAuthnCredential) string {
+		return c.ID
+	}))
+}
+
+func (rs *RepositoryWebAuthnCredentialStorage) Get(ctx context.Context, id string) (*WebAuthnCredential, error) {
+	c, err := rs.repo.Get(ctx, id)
+	if err == ErrNotFound {
+		return nil, ErrCredentialNotFound
+	}
+	return c, err
+}
+
+func (rs *RepositoryWebAuthnCredentialStorage) Save(ctx context.Context, cred *WebAuthnCredential) error {
+	return rs.repo.Save(ctx, cred)
+}
+
+func (rs *RepositoryWebAuthnCredentialStorage) ListByEmail(ctx context.Context, email Email) ([]*WebAuthnCredential, error) {
+	all, err := rs.repo.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var creds []*WebAuthnCredential
+	for _, c := range all {
+		if c.Email == email {
+			creds = append(creds, c)
+		}
+	}
+	return creds, nil
+}
+
+// WebAuthnChallenge is a challenge handed to a browser, waiting for the authenticator's answer.
+type WebAuthnChallenge struct {
+	// ID is the challenge, base64url encoded
+	ID string `json:"id"`
+	// Email is the user registering a passkey, or signing in when they said who they are
+	Email     Email     `json:"email"`
+	Ceremony  string    `json:"ceremony"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type WebAuthnChallengeStorer interface {
+	Save(ctx context.Context, c *WebAuthnChallenge) error
+	// Consume removes the challenge and returns it, so each is answered once
+	// Consume may return an ErrChallengeNotFound error
+	Consume(ctx context.Context, id string) (*WebAuthnChallenge, error)
+	// DeleteExpired removes the challenges that expired before now, returning how many there were
+	DeleteExpired(ctx context.Context, now time.Time) (int, error)
+}
+
+// RepositoryWebAuthnChallengeStorage implements WebAuthnChallengeStorer on top of any challenge
+// repository. Consume holds a lock around reading and deleting the challenge, so the repository
+// must not be shared with another process.
+type RepositoryWebAuthnChallengeStorage struct {
+	repo Repository[string, *WebAuthnChallenge]
+	mu   sync.Mutex
+}
+
+func NewRepositoryWebAuthnChallengeStorage(repo Repository[string, *WebAuthnChallenge]) *RepositoryWebAuthnChallengeStorage {
+	return &RepositoryWebAuthnChallengeStorage{
+		repo: repo,
+	}
+}
+
+func NewMemoryWebAuthnChallengeStorage() *RepositoryWebAuthnChallengeStorage {
+	return NewRepositoryWebAuthnChallengeStorage(NewMemoryRepository(func(c *WebAuthnChallenge) string {
+		return c.ID
+	}))
+}
+
+func (rs *RepositoryWebAuthnChallengeStorage) Save(ctx context.Context, c *WebAuthnChallenge) error {
+	return rs.repo.Save(ctx, c)
+}
+
+func (rs *RepositoryWebAuthnChallengeStorage) Consume(ctx context.Context, id string) (*WebAuthnChallenge, error) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	c, err := rs.repo.Get(ctx, id)
+	if err == ErrNotFound {
+		return nil, ErrChallengeNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	err = rs.repo.Delete(ctx, id)
+	if err == ErrNotFound {
+		return nil, ErrChallengeNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (rs *RepositoryWebAuthnChallengeStorage) DeleteExpired(ctx context.Context, now time.Time) (int, error) {
+	challenges, err := rs.repo.List(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for _, c := range challenges {
+		if now.Before(c.ExpiresAt) {
+			continue
+		}
+		err = rs.repo.Delete(ctx, c.ID)
+		if err == ErrNotFound {
+			continue
+		} else if err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// Business Logic
+var (
+	ErrWebAuthnDisabled = registerError(errors.New("Passkeys are not configured"), "webauthn_disabled", http.StatusNotFound, "Passkeys are not configured on the server")
+	ErrWebAuthnInvalid  = registerError(errors.New("Passkey response is malformed, for another site or challenge, or uses an unsupported algorithm"), "webauthn_invalid", http.StatusBadRequest, "The passkey response is malformed, answers an unknown or expired challenge, is for another site, or uses an unsupported algorithm")
+	ErrWebAuthnFailed   = registerError(errors.New("Passkey sign-in failed"), "webauthn_failed", http.StatusUnauthorized, "The passkey is not registered, or its signature or counter did not check out")
+	ErrCredentialExists = registerError(errors.New("Passkey is already registered"), "passkey_exists", http.StatusConflict, "The passkey is already registered")
+)
+
+// WebAuthn ceremonies, as recorded on a WebAuthnChallenge.
+const (
+	ceremonyRegister = "register"
+	ceremonyLogin    = "login"
+)
+
+// COSE algorithms passkeys may use, in order of preference.
+const (
+	coseES256 = -7
+	coseEdDSA = -8
+	coseRS256 = -257
+)
+
+// WebAuthnOptions name the relying party passkeys are registered to.
+type WebAuthnOptions struct {
+	// RPID is the domain passkeys are scoped to, such as example.com
+	RPID   string
+	RPName string
+	// Origins are the origins of the pages allowed to use the passkeys, such as https://example.com
+	Origins      []string
+	ChallengeTTL time.Duration
+}
+
+// base64URL is bytes written to JSON as unpadded base64url, as the WebAuthn JSON serialization does.
+type base64URL []byte
+
+func (b base64URL) MarshalJSON() ([]byte, error) {
+	return json.Marshal(base64.RawURLEncoding.EncodeToString(b))
+}
+
+func (b *base64URL) UnmarshalJSON(data []byte) error {
+	var s string
+	err := json.Unmarshal(data, &s)
+	if err != nil {
+		return err
+	}
+	// Browsers send unpadded base64url, but some libraries pad it
+	decoded, err := base64.RawURLEncoding.DecodeString(trimPadding(s))
+	if err != nil {
+		return ErrWebAuthnInvalid
+	}
+	*b = decoded
+	return nil
+}
+
+func trimPadding(s string) string {
+	for len(s) > 0 && s[len(s)-1] == '=' {
+		s = s[:len(s)-1]
+	}
+	return s
+}
+
+type credentialDescriptor struct {
+	Type string    `json:"type"`
+	ID   base64URL `json:"id"`
+}
+
+type credentialParameter struct {
+	Type string `json:"type"`
+	Alg  int    `json:"alg"`
+}
+
+// CredentialCreationOptions are the publicKey options of navigator.credentials.create,
+// in the form PublicKeyCredential.parseCreationOptionsFromJSON takes.
+type CredentialCreationOptions struct {
+	Challenge base64URL `json:"challenge"`
+	RP        struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	} `json:"rp"`
+	User struct {
+		ID          base64URL `json:"id"`
+		Name        string    `json:"name"`
+		DisplayName string    `json:"displayName"`
+	} `json:"user"`
+	PubKeyCredParams       []credentialParameter  `json:"pubKeyCredParams"`
+	Timeout                int64                  `json:"timeout"`
+	ExcludeCredentials     []credentialDescriptor `json:"excludeCredentials"`
+	AuthenticatorSelection struct {
+		ResidentKey      string `json:"residentKey"`
+		UserVerification string `json:"userVerification"`
+	} `json:"authenticatorSelection"`
+	Attestation string `json:"attestation"`
+}
+
+// CredentialRequestOptions are the publicKey options of navigator.credentials.get,
+// in the form PublicKeyCredential.parseRequestOptionsFromJSON takes.
+type CredentialRequestOptions struct {
+	Challenge        base64URL              `json:"challenge"`
+	RPID             string                 `json:"rpId"`
+	Timeout          int64                  `json:"timeout"`
+	AllowCredentials []credentialDescriptor `json:"allowCredentials"`
+	UserVerification string                 `json:"userVerification"`
+}
+
+// AttestationResponse is the PublicKeyCredential from navigator.credentials.create, as its toJSON writes it.
+type AttestationResponse struct {
+	ID       string `json:"id"`
+	Type     string `json:"type"`
+	Response struct {
+		ClientDataJSON    base64URL `json:"clientDataJSON"`
+		AttestationObject base64URL `json:"attestationObject"`
+	} `json:"response"`
+}
+
+// AssertionResponse is the PublicKeyCredential from navigator.credentials.get, as its toJSON writes it.
+type AssertionResponse struct {
+	ID       string `json:"id"`
+	Type     string `json:"type"`
+	Response struct {
+		ClientDataJSON    base64URL `json:"clientDataJSON"`
+		AuthenticatorData base64URL `json:"authenticatorData"`
+		Signature         base64URL `json:"signature"`
+	} `json:"response"`
+}
+
+// authenticatorData flags.
+const (
+	flagUserPresent  = 0x01
+	flagAttestedData = 0x40
+)
+
+type authenticatorData struct {
+	rpIDHash  []byte
+	flags     byte
+	signCount uint32
+	// credentialID and publicKey are only present when registering
+	credentialID []byte
+	publicKey    []byte
+}
+
+func parseAuthenticatorData(b []byte) (*authenticatorData, error) {
+	if len(b) < 37 {
+		return nil, ErrWebAuthnInvalid
+	}
+	ad := &authenticatorData{
+		rpIDHash:  b[:32],
+		flags:     b[32],
+		signCount: binary.BigEndian.Uint32(b[33:37]),
+	}
+	if ad.flags&flagAttestedData == 0 {
+		return ad, nil
+	}
+
+	// The AAGUID, then the length of the credential ID, the ID and the COSE key
+	rest := b[37:]
+	if len(rest) < 18 {
+		return nil, ErrWebAuthnInvalid
+	}
+	idLen := int(binary.BigEndian.Uint16(rest[16:18]))
+	rest = rest[18:]
+	if idLen == 0 || len(rest) < idLen {
+		return nil, ErrWebAuthnInvalid
+	}
+	ad.credentialID = rest[:idLen]
+	rest = rest[idLen:]
+	_, after, err := decodeCBOR(rest)
+	if err != nil {
+		return nil, ErrWebAuthnInvalid
+	}
+	ad.publicKey = rest[:len(rest)-len(after)]
+	return ad, nil
+}
+
+// coseKey is a public key and the algorithm it signs with.
+type coseKey struct {
+	alg int64
+	key crypto.PublicKey
+}
+
+func parseCOSEKey(b []byte) (*coseKey, error) {
+	v, _, err := decodeCBOR(b)
+	if err != nil {
+		return nil, ErrWebAuthnInvalid
+	}
+	m, ok := v.(map[interface{}]interface{})
+	if !ok {
+		return nil, ErrWebAuthnInvalid
+	}
+	param := func(label int64) []byte {
+		p, _ := m[label].([]byte)
+		return p
+	}
+	kty, _ := m[int64(1)].(int64)
+	alg, _ := m[int64(3)].(int64)
+	crv, _ := m[int64(-1)].(int64)
+
+	switch {
+	case alg == coseES256 && kty == 2 && crv == 1:
+		x, y := param(-2), param(-3)
+		if len(x) != 32 || len(y) != 32 {
+			return nil, ErrWebAuthnInvalid
+		}
+		pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+			return nil, ErrWebAuthnInvalid
+		}
+		return &coseKey{alg: alg, key: pub}, nil
+	case alg == coseEdDSA && kty == 1 && crv == 6:
+		x := param(-2)
+		if len(x) != ed25519.PublicKeySize {
+			return nil, ErrWebAuthnInvalid
+		}
+		return &coseKey{alg: alg, key: ed25519.PublicKey(x)}, nil
+	case alg == coseRS256 && kty == 3:
+		n, e := param(-1), param(-2)
+		if len(n) < 256 || len(e) == 0 || len(e) > 4 {
+			return nil, ErrWebAuthnInvalid
+		}
+		exp := new(big.Int).SetBytes(e)
+		return &coseKey{alg: alg, key: &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exp.Int64())}}, nil
+	}
+	return nil, ErrWebAuthnInvalid
+}
+
+func (ck *coseKey) verify(data, sig []byte) bool {
+	digest := sha256.Sum256(data)
+	switch key := ck.key.(type) {
+	case *ecdsa.PublicKey:
+		return ecdsa.VerifyASN1(key, digest[:], sig)
+	case ed25519.PublicKey:
+		return ed25519.Verify(key, data, sig)
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig) == nil
+	}
+	return false
+}
+
+// WebAuthn registers passkeys to users and signs them in with them. Attestation is not
+// requested, so any authenticator may be registered.
+type WebAuthn struct {
+	users       UserStorer
+	credentials WebAuthnCredentialStorer
+	challenges  WebAuthnChallengeStorer
+	opts        WebAuthnOptions
+	clock       clock.Clock
+}
+
+func NewWebAuthn(us UserStorer, cs WebAuthnCredentialStorer, chs WebAuthnChallengeStorer, opts WebAuthnOptions, clk clock.Clock) *WebAuthn {
+	return &WebAuthn{
+		users:       us,
+		credentials: cs,
+		challenges:  chs,
+		opts:        opts,
+		clock:       clk,
+	}
+}
+
+// challenge issues a challenge for a ceremony.
+func (wa *WebAuthn) challenge(ctx context.Context, email Email, ceremony string) ([]byte, error) {
+	now := wa.clock.Now().UTC()
+	_, err := wa.challenges.DeleteExpired(ctx, now)
+	if err != nil {
+		return nil, err
+	}
+
+	b := make([]byte, 32)
+	_, err = rand.Read(b)
+	if err != nil {
+		return nil, err
+	}
+	err = wa.challenges.Save(ctx, &WebAuthnChallenge{
+		ID:        base64.RawURLEncoding.EncodeToString(b),
+		Email:     email,
+		Ceremony:  ceremony,
+		ExpiresAt: now.Add(wa.opts.ChallengeTTL),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+func (wa *WebAuthn) descriptors(ctx context.Context, email Email) ([]credentialDescriptor, error) {
+	creds, err := wa.credentials.ListByEmail(ctx, email)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(creds, func(i, j int) bool {
+		return creds[i].CreatedAt.Before(creds[j].CreatedAt)
+	})
+	descriptors := []credentialDescriptor{}
+	for _, c := range creds {
+		id, err := base64.RawURLEncoding.DecodeString(c.ID)
+		if err != nil {
+			return nil, err
+		}
+		descriptors = append(descriptors, credentialDescriptor{Type: "public-key", ID: id})
+	}
+	return descriptors, nil
+}
+
+// verifyClientData checks the client data the browser signed over was for the ceremony and one of
+// our origins, and uses up the challenge in it.
+func (wa *WebAuthn) verifyClientData(ctx context.Context, raw []byte, ceremony string) (*WebAuthnChallenge, error) {
+	var cd struct {
+		Type      string `json:"type"`
+		Challenge string `json:"challenge"`
+		Origin    string `json:"origin"`
+	}
+	err := json.Unmarshal(raw, &cd)
+	if err != nil || cd.Type != "webauthn."+map[string]string{ceremonyRegister: "create", ceremonyLogin: "get"}[ceremony] {
+		return nil, ErrWebAuthnInvalid
+	}
+
+	allowed := false
+	for _, o := range wa.opts.Origins {
+		if cd.Origin == o {
+			allowed = true
+		}
+	}
+	if !allowed {
+		return nil, ErrWebAuthnInvalid
+	}
+
+	c, err := wa.challenges.Consume(ctx, trimPadding(cd.Challenge))
+	if err == ErrChallengeNotFound {
+		return nil, ErrWebAuthnInvalid
+	} else if err != nil {
+		return nil, err
+	}
+	if c.Ceremony != ceremony || !wa.clock.Now().Before(c.ExpiresAt) {
+		return nil, ErrWebAuthnInvalid
+	}
+	return c, nil
+}
+
+func (wa *WebAuthn) verifyRPID(ad *authenticatorData) error {
+	want := sha256.Sum256([]byte(wa.opts.RPID))
+	if subtle.ConstantTimeCompare(ad.rpIDHash, want[:]) != 1 || ad.flags&flagUserPresent == 0 {
+		return ErrWebAuthnInvalid
+	}
+	return nil
+}
+
+// callerEmail is the email of the signed in user calling.
+func callerEmail(ctx context.Context) (Email, error) {
+	p, ok := principal.FromContext(ctx)
+	if !ok || p.Email == "" {
+		return Email{}, ErrUnauthenticated
+	}
+	email, err := ParseEmail(p.Email)
+	if err != nil {
+		return Email{}, ErrUnauthenticated
+	}
+	return email, nil
+}
+
+// BeginRegistration starts registering a passkey to the calling user.
+func (wa *WebAuthn) BeginRegistration(ctx context.Context) (*CredentialCreationOptions, error) {
+	email, err := callerEmail(ctx)
+	if err != nil {
+		return nil, err
+	}
+	u, err := wa.users.Get(ctx, email)
+	if err != nil {
+		return nil, err
+	}
+
+	challenge, err := wa.challenge(ctx, u.Email, ceremonyRegister)
+	if err != nil {
+		return nil, err
+	}
+	exclude, err := wa.descriptors(ctx, u.Email)
+	if err != nil {
+		return nil, err
+	}
+
+	// The user handle is stored on the authenticator, so it is a hash rather than the email
+	handle := sha256.Sum256([]byte(u.Email.String()))
+	opts := &CredentialCreationOptions{
+		Challenge: challenge,
+		PubKeyCredParams: []credentialParameter{
+			{Type: "public-key", Alg: coseES256},
+			{Type: "public-key", Alg: coseEdDSA},
+			{Type: "public-key", Alg: coseRS256},
+		},
+		Timeout:            wa.opts.ChallengeTTL.Milliseconds(),
+		ExcludeCredentials: exclude,
+		Attestation:        "none",
+	}
+	opts.RP.ID = wa.opts.RPID
+	opts.RP.Name = wa.opts.RPName
+	opts.User.ID = handle[:]
+	opts.User.Name = u.Email.String()
+	opts.User.DisplayName = u.Name
+	opts.AuthenticatorSelection.ResidentKey = "preferred"
+	opts.AuthenticatorSelection.UserVerification = "preferred"
+	return opts, nil
+}
+
+// FinishRegistration checks the authenticator's answer to BeginRegistration and saves the passkey.
+func (wa *WebAuthn) FinishRegistration(ctx context.Context, resp *AttestationResponse) (*WebAuthnCredential, error) {
+	email, err := callerEmail(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := wa.verifyClientData(ctx, resp.Response.ClientDataJSON, ceremonyRegister)
+	if err != nil {
+		return nil, err
+	}
+	if c.Email != email {
+		return nil, ErrWebAuthnInvalid
+	}
+
+	v, _, err := decodeCBOR(resp.Response.AttestationObject)
+	if err != nil {
+		return nil, ErrWebAuthnInvalid
+	}
+	att, ok := v.(map[interface{}]interface{})
+	if !ok {
+		return nil, ErrWebAuthnInvalid
+	}
+	raw, _ := att["authData"].([]byte)
+	ad, err := parseAuthenticatorData(raw)
+	if err != nil {
+		return nil, err
+	}
+	err = wa.verifyRPID(ad)
+	if err != nil {
+		return nil, err
+	}
+	if ad.credentialID == nil {
+		return nil, ErrWebAuthnInvalid
+	}
+	_, err = parseCOSEKey(ad.publicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	id := base64.RawURLEncoding.EncodeToString(ad.credentialID)
+	_, err = wa.credentials.Get(ctx, id)
+	if err == nil {
+		return nil, ErrCredentialExists
+	} else if err != ErrCredentialNotFound {
+		return nil, err
+	}
+
+	cred := &WebAuthnCredential{
+		ID:        id,
+		Email:     email,
+		PublicKey: ad.publicKey,
+		SignCount: ad.signCount,
+		CreatedAt: wa.clock.Now().UTC(),
+	}
+	err = wa.credentials.Save(ctx, cred)
+	if err != nil {
+		return nil, err
+	}
+	return cred, nil
+}
+
+// BeginLogin starts signing in with a passkey. Without an email, the browser offers
+// every passkey it holds for the site.
+func (wa *WebAuthn) BeginLogin(ctx context.Context, email Email) (*CredentialRequestOptions, error) {
+	allow := []credentialDescriptor{}
+	if !email.IsZero() {
+		var err error
+		allow, err = wa.descriptors(ctx, email)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	challenge, err := wa.challenge(ctx, email, ceremonyLogin)
+	if err != nil {
+		return nil, err
+	}
+	return &CredentialRequestOptions{
+		Challenge:        challenge,
+		RPID:             wa.opts.RPID,
+		Timeout:          wa.opts.ChallengeTTL.Milliseconds(),
+		AllowCredentials: allow,
+		UserVerification: "preferred",
+	}, nil
+}
+
+// FinishLogin checks the authenticator's answer to BeginLogin, returning the user it signs in.
+// A signature counter that did not go up means the passkey was cloned, and is refused.
+func (wa *WebAuthn) FinishLogin(ctx context.Context, resp *AssertionResponse) (*User, error) {
+	c, err := wa.verifyClientData(ctx, resp.Response.ClientDataJSON, ceremonyLogin)
+	if err != nil {
+		return nil, err
+	}
+
+	cred, err := wa.credentials.Get(ctx, trimPadding(resp.ID))
+	if err == ErrCredentialNotFound {
+		return nil, ErrWebAuthnFailed
+	} else if err != nil {
+		return nil, err
+	}
+	if !c.Email.IsZero() && c.Email != cred.Email {
+		return nil, ErrWebAuthnFailed
+	}
+
+	ad, err := parseAuthenticatorData(resp.Response.AuthenticatorData)
+	if err != nil {
+		return nil, err
+	}
+	err = wa.verifyRPID(ad)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := parseCOSEKey(cred.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	clientDataHash := sha256.Sum256(resp.Response.ClientDataJSON)
+	signed := append(append([]byte(nil), resp.Response.AuthenticatorData...), clientDataHash[:]...)
+	if !key.verify(signed, resp.Response.Signature) {
+		return nil, ErrWebAuthnFailed
+	}
+	if (ad.signCount != 0 || cred.SignCount != 0) && ad.signCount <= cred.SignCount {
+		return nil, ErrWebAuthnFailed
+	}
+
+	u, err := wa.users.Get(ctx, cred.Email)
+	if err == ErrUserNotFound {
+		return nil, ErrWebAuthnFailed
+	} else if err != nil {
+		return nil, err
+	}
+
+	now := wa.clock.Now().UTC()
+	used := *cred
+	used.SignCount = ad.signCount
+	used.LastUsedAt = &now
+	err = wa.credentials.Save(ctx, &used)
+	if err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// Access Layer
+// writeWebAuthnJSON writes v, or the error that produced it.
+func writeWebAuthnJSON(w http.ResponseWriter, r *http.Request, v interface{}, err error) {
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(v)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+}
+
+// BeginPasskeyRegistration serves POST /me/passkeys/register/begin, returning the options
+// to pass to navigator.credentials.create.
+func (j *JsonOverHTTP) BeginPasskeyRegistration(w http.ResponseWriter, r *http.Request) {
+	if j.WebAuthn == nil {
+		writeError(w, r, ErrWebAuthnDisabled)
+		return
+	}
+	opts, err := j.WebAuthn.BeginRegistration(r.Context())
+	writeWebAuthnJSON(w, r, opts, err)
+}
+
+// FinishPasskeyRegistration serves POST /me/passkeys/register/finish with the credential
+// navigator.credentials.create returned, as JSON.
+func (j *JsonOverHTTP) FinishPasskeyRegistration(w http.ResponseWriter, r *http.Request) {
+	if j.WebAuthn == nil {
+		writeError(w, r, ErrWebAuthnDisabled)
+		return
+	}
+
+	resp := &AttestationResponse{}
+	err := json.NewDecoder(r.Body).Decode(resp)
+	if err != nil {
+		writeError(w, r, decodeError(err))
+		return
+	}
+
+	cred, err := j.WebAuthn.FinishRegistration(r.Context(), resp)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	err = json.NewEncoder(w).Encode(map[string]string{"id": cred.ID})
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+}
+
+// BeginPasskeyLogin serves POST /login/passkey/begin with a body of {} or {"email": "..."},
+// returning the options to pass to navigator.credentials.get.
+func (j *JsonOverHTTP) BeginPasskeyLogin(w http.ResponseWriter, r *http.Request) {
+	if j.WebAuthn == nil || j.Sessions == nil {
+		writeError(w, r, ErrWebAuthnDisabled)
+		return
+	}
+
+	var body struct {
+		Email Email `json:"email"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil {
+		writeError(w, r, decodeError(err))
+		return
+	}
+
+	opts, err := j.WebAuthn.BeginLogin(r.Context(), body.Email)
+	writeWebAuthnJSON(w, r, opts, err)
+}
+
+// FinishPasskeyLogin serves POST /login/passkey/finish with the credential
+// navigator.credentials.get returned, starting a session and returning the user.
+func (j *JsonOverHTTP) FinishPasskeyLogin(w http.ResponseWriter, r *http.Request) {
+	if j.WebAuthn == nil || j.Sessions == nil {
+		writeError(w, r, ErrWebAuthnDisabled)
+		return
+	}
+
+	resp := &AssertionResponse{}
+	err := json.NewDecoder(r.Body).Decode(resp)
+	if err != nil {
+		writeError(w, r, decodeError(err))
+		return
+	}
+
+	u, err := j.WebAuthn.FinishLogin(r.Context(), resp)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	err = j.Sessions.start(w, r, u.Email, LoginMethodPasskey)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	codec := responseCodec(r)
+	w.Header().Set("Content-Type", codec.ContentType())
+	err = codec.EncodeUser(w, u)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+}